@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fleet is a named set of endpoints published by the xDS controller, e.g.
+// "collector" for the collectors currently receiving traffic. Scenarios
+// and assignments refer to fleets symbolically so they follow MIG updates.
+type Fleet struct {
+	Name       string          `json:"name"`
+	Cluster    string          `json:"cluster,omitempty"`
+	Endpoints  []FleetEndpoint `json:"endpoints"`
+	Version    int64           `json:"version"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	Source     string          `json:"source,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+}
+
+type FleetEndpoint struct {
+	Instance string `json:"instance,omitempty"`
+	Address  string `json:"address"`
+	Port     uint32 `json:"port"`
+	Zone     string `json:"zone,omitempty"`
+}
+
+// fleetRef is an endpoint of the form fleet://<fleet>/<path>, or
+// fleet+https://<fleet>/<path>, which expands to <path> on every member of
+// the fleet.
+type fleetRef struct {
+	fleet  string
+	scheme string
+	path   string
+}
+
+// parseFleetRef parses a fleet endpoint. ok is false for plain URLs.
+func parseFleetRef(endpoint string) (ref *fleetRef, ok bool, err error) {
+	var scheme string
+	switch {
+	case strings.HasPrefix(endpoint, "fleet://"):
+		scheme = "http"
+	case strings.HasPrefix(endpoint, "fleet+https://"):
+		scheme = "https"
+	default:
+		return nil, false, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid fleet endpoint %q: %w", endpoint, err)
+	}
+	if u.Host == "" {
+		return nil, true, fmt.Errorf("fleet endpoint %q has no fleet name", endpoint)
+	}
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return &fleetRef{fleet: u.Host, scheme: scheme, path: path}, true, nil
+}
+
+// resolveEndpoints expands fleet endpoints into one URL per fleet member
+// and keeps plain URLs. The caller holds cp.mu.
+func (cp *ControlPlane) resolveEndpoints(endpoints []string) ([]string, error) {
+	resolved := []string{}
+	for _, endpoint := range endpoints {
+		ref, ok, err := parseFleetRef(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			resolved = append(resolved, endpoint)
+			continue
+		}
+		fleet, exists := cp.fleets[ref.fleet]
+		if !exists {
+			return nil, fmt.Errorf("fleet %s has not been published", ref.fleet)
+		}
+		for _, member := range fleet.Endpoints {
+			host := net.JoinHostPort(member.Address, strconv.Itoa(int(member.Port)))
+			resolved = append(resolved, ref.scheme+"://"+host+ref.path)
+		}
+	}
+	return resolved, nil
+}
+
+func (cp *ControlPlane) handleListFleets(w http.ResponseWriter, r *http.Request) {
+	cp.mu.RLock()
+	fleets := make([]*Fleet, 0, len(cp.fleets))
+	for _, fleet := range cp.fleets {
+		fleets = append(fleets, fleet)
+	}
+	cp.mu.RUnlock()
+	sort.Slice(fleets, func(i, j int) bool { return fleets[i].Name < fleets[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fleets)
+}
+
+func (cp *ControlPlane) handleGetFleet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	cp.mu.RLock()
+	fleet, exists := cp.fleets[name]
+	cp.mu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fleet)
+}
+
+// handlePutFleet receives a fleet from the xDS controller. An older
+// version from the same source is ignored, so a delayed retry cannot
+// overwrite a newer membership.
+func (cp *ControlPlane) handlePutFleet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var fleet Fleet
+	if err := json.NewDecoder(r.Body).Decode(&fleet); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, member := range fleet.Endpoints {
+		if member.Address == "" || member.Port == 0 {
+			http.Error(w, "Fleet endpoints need an address and port", http.StatusBadRequest)
+			return
+		}
+	}
+	fleet.Name = name
+	fleet.ReceivedAt = time.Now()
+
+	cp.mu.Lock()
+	if current, exists := cp.fleets[name]; exists && current.Source == fleet.Source && current.Version > fleet.Version {
+		cp.mu.Unlock()
+		http.Error(w, "Fleet version is older than the current one", http.StatusConflict)
+		return
+	}
+	cp.fleets[name] = &fleet
+	cp.mu.Unlock()
+
+	fleetEndpoints.WithLabelValues(name).Set(float64(len(fleet.Endpoints)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&fleet)
+}
+
+// handleScenarioEndpoints returns a scenario's endpoints with fleets
+// expanded to their current members.
+func (cp *ControlPlane) handleScenarioEndpoints(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	scenario, exists := cp.scenarios[name]
+	if !exists {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+	endpoints, err := cp.resolveEndpoints(scenario.Spec.Endpoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
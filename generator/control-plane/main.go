@@ -19,13 +19,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
-	"sigs.k8s.io/controller-runtime/pkg/manager"
-	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/option"
@@ -57,6 +54,30 @@ var (
 		},
 		[]string{"scenario", "error_type"},
 	)
+
+	fleetEndpoints = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_fleet_endpoints",
+			Help: "Endpoints in each fleet published by the xDS controller",
+		},
+		[]string{"fleet"},
+	)
+
+	workerRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_worker_requests_total",
+			Help: "Worker requests seen by Envoy, by response status class",
+		},
+		[]string{"worker", "status_class"},
+	)
+
+	workerLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_worker_request_latency_ms",
+			Help: "Worker request latency quantiles seen by Envoy",
+		},
+		[]string{"worker", "quantile"},
+	)
 )
 
 func init() {
@@ -64,6 +85,9 @@ func init() {
 	prometheus.MustRegister(activeWorkers)
 	prometheus.MustRegister(recipesLoaded)
 	prometheus.MustRegister(scenarioErrors)
+	prometheus.MustRegister(fleetEndpoints)
+	prometheus.MustRegister(workerRequests)
+	prometheus.MustRegister(workerLatency)
 }
 
 // LoadScenario represents a load generation scenario
@@ -79,12 +103,37 @@ type LoadScenarioSpec struct {
 	// Target configuration
 	Families    []string `json:"families" yaml:"families"`        // Family patterns/globs
 	Multiplier  float64  `json:"multiplier" yaml:"multiplier"`    // Load multiplier (1.0 = original scale)
+
+	// Per-family factors on Multiplier, by family ID; set by divergence
+	// remediation to throttle families that do not match their recipe
+	FamilyMultipliers map[string]float64 `json:"familyMultipliers,omitempty" yaml:"familyMultipliers,omitempty"`
 	
 	// Traffic shaping
 	BurstFactor    float64            `json:"burstFactor,omitempty" yaml:"burstFactor,omitempty"`
 	SchemaDrift    float64            `json:"schemaDrift,omitempty" yaml:"schemaDrift,omitempty"`
 	ErrorInjection float64            `json:"errorInjection,omitempty" yaml:"errorInjection,omitempty"`
 	TagSkew        map[string]float64 `json:"tagSkew,omitempty" yaml:"tagSkew,omitempty"`
+
+	// Adversarial mode: share of lines carrying never-repeating tag values,
+	// to test ingestion-side cardinality protection
+	CardinalityBomb float64 `json:"cardinalityBomb,omitempty" yaml:"cardinalityBomb,omitempty"`
+
+	// Share of metric names, sources and tag values made edge cases
+	// (multibyte, maximum length, quoting, boundary values), to test the
+	// targets' parsing and escaping
+	EdgeCases float64 `json:"edgeCases,omitempty" yaml:"edgeCases,omitempty"`
+
+	// Fit each line to the recipe's line size distribution, to reproduce
+	// the reference's bytes per line at collector buffers
+	SizeTargeting bool `json:"sizeTargeting,omitempty" yaml:"sizeTargeting,omitempty"`
+
+	// Gradual drift at SchemaDrift strength, 0 to 1: tag value shares
+	// move and values are introduced and retired, while metric values
+	// shift by DriftValueShift (0.2 for +20%). Drift starts DriftStart
+	// into the scenario and ramps to full strength over DriftRamp.
+	DriftStart      *string `json:"driftStart,omitempty" yaml:"driftStart,omitempty"`
+	DriftRamp       *string `json:"driftRamp,omitempty" yaml:"driftRamp,omitempty"`
+	DriftValueShift float64 `json:"driftValueShift,omitempty" yaml:"driftValueShift,omitempty"`
 	
 	// Resource allocation
 	WorkerPods    int32  `json:"workerPods" yaml:"workerPods"`
@@ -95,13 +144,14 @@ type LoadScenarioSpec struct {
 	Duration      *string `json:"duration,omitempty" yaml:"duration,omitempty"`
 	Schedule      *string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
 	
-	// Target endpoints (reuse from old loadgen)
+	// Target endpoints (reuse from old loadgen); fleet://<fleet>/<path>
+	// targets every member of a fleet published by the xDS controller
 	Endpoints     []string `json:"endpoints" yaml:"endpoints"`
 	Authentication map[string]string `json:"authentication,omitempty" yaml:"authentication,omitempty"`
 }
 
 type LoadScenarioStatus struct {
-	Phase        string    `json:"phase" yaml:"phase"` // Pending, Running, Succeeded, Failed
+	Phase        string    `json:"phase" yaml:"phase"` // Pending, Running, Paused, Succeeded, Failed
 	StartTime    *time.Time `json:"startTime,omitempty" yaml:"startTime,omitempty"`
 	EndTime      *time.Time `json:"endTime,omitempty" yaml:"endTime,omitempty"`
 	WorkerCount  int32     `json:"workerCount" yaml:"workerCount"`
@@ -130,9 +180,11 @@ type Recipe struct {
 	Schema      map[string]interface{} `json:"schema"`
 	Statistics  map[string]interface{} `json:"statistics"`
 	Temporal    map[string]interface{} `json:"temporal"`
+	Payload     map[string]interface{} `json:"payload"`
 	Patterns    map[string]interface{} `json:"patterns"`
 	Generation  map[string]interface{} `json:"generation"`
 	LoadedAt    time.Time              `json:"loaded_at"`
+	Stale       *StaleMark             `json:"stale,omitempty"`
 }
 
 // WorkerAssignment represents a recipe assignment to a worker pod
@@ -140,22 +192,36 @@ type WorkerAssignment struct {
 	WorkerID     string    `json:"worker_id"`
 	PodName      string    `json:"pod_name"`
 	Namespace    string    `json:"namespace"`
+	Scenario     string    `json:"scenario,omitempty"` // The drift fields follow this scenario's spec
 	Families     []string  `json:"families"`
 	Multiplier   float64   `json:"multiplier"`
 	BurstFactor  float64   `json:"burst_factor"`
+	CardinalityBomb float64 `json:"cardinality_bomb,omitempty"`
+	EdgeCases    float64   `json:"edge_cases,omitempty"`
+	SizeTargeting bool     `json:"size_targeting,omitempty"`
+	SchemaDrift  float64   `json:"schema_drift,omitempty"`
+	DriftStart   time.Time `json:"drift_start"` // Zero for when synthesis starts
+	DriftRampSeconds float64 `json:"drift_ramp_seconds,omitempty"`
+	DriftValueShift  float64 `json:"drift_value_shift,omitempty"`
 	AssignedAt   time.Time `json:"assigned_at"`
+
+	// Target endpoints; fleet endpoints are expanded when the worker
+	// fetches its assignment
+	Endpoints    []string  `json:"endpoints,omitempty"`
 }
 
 // ControlPlane manages load scenarios and worker coordination
 type ControlPlane struct {
-	k8sClient     client.Client
-	gcsClient     *storage.Client
-	recipeCache   map[string]*Recipe
-	scenarios     map[string]*LoadScenario
-	assignments   map[string]*WorkerAssignment
-	mu            sync.RWMutex
-	recipeBucket  string
-	recipePrefix  string
+	k8sClient        client.Client
+	gcsClient        *storage.Client
+	recipeCache      map[string]*Recipe
+	scenarios        map[string]*LoadScenario
+	assignments      map[string]*WorkerAssignment
+	fleets           map[string]*Fleet
+	requestSummaries map[string]*RequestSummary
+	mu               sync.RWMutex
+	recipeBucket     string
+	recipePrefix     string
 }
 
 func NewControlPlane(recipeBucket, recipePrefix string) (*ControlPlane, error) {
@@ -178,13 +244,15 @@ func NewControlPlane(recipeBucket, recipePrefix string) (*ControlPlane, error) {
 	}
 
 	return &ControlPlane{
-		k8sClient:     k8sClient,
-		gcsClient:     gcsClient,
-		recipeCache:   make(map[string]*Recipe),
-		scenarios:     make(map[string]*LoadScenario),
-		assignments:   make(map[string]*WorkerAssignment),
-		recipeBucket:  recipeBucket,
-		recipePrefix:  recipePrefix,
+		k8sClient:        k8sClient,
+		gcsClient:        gcsClient,
+		recipeCache:      make(map[string]*Recipe),
+		scenarios:        make(map[string]*LoadScenario),
+		assignments:      make(map[string]*WorkerAssignment),
+		fleets:           make(map[string]*Fleet),
+		requestSummaries: make(map[string]*RequestSummary),
+		recipeBucket:     recipeBucket,
+		recipePrefix:     recipePrefix,
 	}, nil
 }
 
@@ -217,15 +285,29 @@ func (cp *ControlPlane) startHTTPServer(ctx context.Context, port int) error {
 	api.HandleFunc("/scenarios/{name}", cp.handleGetScenario).Methods("GET")
 	api.HandleFunc("/scenarios/{name}", cp.handleUpdateScenario).Methods("PUT")
 	api.HandleFunc("/scenarios/{name}", cp.handleDeleteScenario).Methods("DELETE")
+	api.HandleFunc("/scenarios/{name}/endpoints", cp.handleScenarioEndpoints).Methods("GET")
+	api.HandleFunc("/scenarios/{name}/pause", cp.handlePauseScenario).Methods("POST")
+	api.HandleFunc("/scenarios/{name}/resume", cp.handleResumeScenario).Methods("POST")
+	api.HandleFunc("/scenarios/{name}/families/{family_id}/multiplier", cp.handlePutFamilyMultiplier).Methods("PUT")
 	
 	// Recipe management
 	api.HandleFunc("/recipes", cp.handleListRecipes).Methods("GET")
 	api.HandleFunc("/recipes/{family_id}", cp.handleGetRecipe).Methods("GET")
 	api.HandleFunc("/recipes/reload", cp.handleReloadRecipes).Methods("POST")
+	api.HandleFunc("/recipes/{family_id}/stale", cp.handleMarkRecipeStale).Methods("POST")
 	
 	// Worker management
 	api.HandleFunc("/workers", cp.handleListWorkers).Methods("GET")
 	api.HandleFunc("/workers/{id}/assignment", cp.handleWorkerAssignment).Methods("GET", "PUT")
+
+	// Fleets published by the xDS controller
+	api.HandleFunc("/fleets", cp.handleListFleets).Methods("GET")
+	api.HandleFunc("/fleets/{name}", cp.handleGetFleet).Methods("GET")
+	api.HandleFunc("/fleets/{name}", cp.handlePutFleet).Methods("PUT")
+
+	// End-to-end request validation from Envoy access logs
+	api.HandleFunc("/validation/requests", cp.handleListRequestSummaries).Methods("GET")
+	api.HandleFunc("/validation/requests", cp.handlePostRequestSummaries).Methods("POST")
 	
 	// Health and status
 	router.HandleFunc("/health", cp.handleHealth).Methods("GET")
@@ -329,6 +411,10 @@ func (cp *ControlPlane) handleUpdateScenario(w http.ResponseWriter, r *http.Requ
 		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
 		return
 	}
+	if err := validateDrift(&updates.Spec); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid scenario: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	cp.mu.Lock()
 	scenario, exists := cp.scenarios[name]
@@ -340,12 +426,24 @@ func (cp *ControlPlane) handleUpdateScenario(w http.ResponseWriter, r *http.Requ
 
 	// Update allowed fields
 	scenario.Spec.Multiplier = updates.Spec.Multiplier
+	scenario.Spec.FamilyMultipliers = updates.Spec.FamilyMultipliers
 	scenario.Spec.BurstFactor = updates.Spec.BurstFactor
 	scenario.Spec.SchemaDrift = updates.Spec.SchemaDrift
 	scenario.Spec.ErrorInjection = updates.Spec.ErrorInjection
 	scenario.Spec.TagSkew = updates.Spec.TagSkew
+	scenario.Spec.CardinalityBomb = updates.Spec.CardinalityBomb
+	scenario.Spec.EdgeCases = updates.Spec.EdgeCases
+	scenario.Spec.SizeTargeting = updates.Spec.SizeTargeting
+	scenario.Spec.DriftStart = updates.Spec.DriftStart
+	scenario.Spec.DriftRamp = updates.Spec.DriftRamp
+	scenario.Spec.DriftValueShift = updates.Spec.DriftValueShift
 	scenario.Spec.WorkerPods = updates.Spec.WorkerPods
 
+	for _, assignment := range cp.assignments {
+		if assignment.Scenario == name {
+			assignment.applyDrift(scenario)
+		}
+	}
 	cp.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
@@ -357,7 +455,7 @@ func (cp *ControlPlane) handleDeleteScenario(w http.ResponseWriter, r *http.Requ
 	name := vars["name"]
 
 	cp.mu.Lock()
-	scenario, exists := cp.scenarios[name]
+	_, exists := cp.scenarios[name]
 	if exists {
 		delete(cp.scenarios, name)
 		activeScenarios.Dec()
@@ -428,15 +526,25 @@ func (cp *ControlPlane) handleWorkerAssignment(w http.ResponseWriter, r *http.Re
 	if r.Method == "GET" {
 		cp.mu.RLock()
 		assignment, exists := cp.assignments[workerID]
+		var resolved WorkerAssignment
+		var err error
+		if exists {
+			resolved = *assignment
+			resolved.Endpoints, err = cp.resolveEndpoints(assignment.Endpoints)
+		}
 		cp.mu.RUnlock()
 
 		if !exists {
 			http.Error(w, "Worker not found", http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(assignment)
+		json.NewEncoder(w).Encode(&resolved)
 	} else if r.Method == "PUT" {
 		var assignment WorkerAssignment
 		if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
@@ -444,10 +552,26 @@ func (cp *ControlPlane) handleWorkerAssignment(w http.ResponseWriter, r *http.Re
 			return
 		}
 
+		for _, endpoint := range assignment.Endpoints {
+			if _, _, err := parseFleetRef(endpoint); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		assignment.WorkerID = workerID
 		assignment.AssignedAt = time.Now()
 
 		cp.mu.Lock()
+		if assignment.Scenario != "" {
+			scenario, exists := cp.scenarios[assignment.Scenario]
+			if !exists {
+				cp.mu.Unlock()
+				http.Error(w, fmt.Sprintf("Unknown scenario %q", assignment.Scenario), http.StatusBadRequest)
+				return
+			}
+			assignment.applyDrift(scenario)
+		}
 		cp.assignments[workerID] = &assignment
 		cp.mu.Unlock()
 
@@ -482,6 +606,7 @@ func (cp *ControlPlane) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"scenarios":     len(cp.scenarios),
 		"recipes":       len(cp.recipeCache),
 		"workers":       len(cp.assignments),
+		"fleets":        len(cp.fleets),
 		"timestamp":     time.Now().UTC(),
 	}
 	cp.mu.RUnlock()
@@ -500,12 +625,71 @@ func (cp *ControlPlane) validateScenario(scenario *LoadScenario) error {
 	if scenario.Spec.WorkerPods <= 0 {
 		return fmt.Errorf("worker pods must be positive")
 	}
+	if scenario.Spec.CardinalityBomb < 0 || scenario.Spec.CardinalityBomb > 1 {
+		return fmt.Errorf("cardinality bomb must be between 0 and 1")
+	}
+	if scenario.Spec.EdgeCases < 0 || scenario.Spec.EdgeCases > 1 {
+		return fmt.Errorf("edge cases must be between 0 and 1")
+	}
+	if err := validateDrift(&scenario.Spec); err != nil {
+		return err
+	}
 	if len(scenario.Spec.Endpoints) == 0 {
 		return fmt.Errorf("at least one endpoint is required")
 	}
+	for _, endpoint := range scenario.Spec.Endpoints {
+		if _, _, err := parseFleetRef(endpoint); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// validateDrift checks the drift strength and value shift, and that the
+// drift start and ramp parse
+func validateDrift(spec *LoadScenarioSpec) error {
+	if spec.SchemaDrift < 0 || spec.SchemaDrift > 1 {
+		return fmt.Errorf("schema drift must be between 0 and 1")
+	}
+	if spec.DriftValueShift <= -1 {
+		return fmt.Errorf("drift value shift must be greater than -1")
+	}
+	_, _, err := spec.driftTiming()
+	return err
+}
+
+// driftTiming parses the drift start, from the scenario's start, and ramp
+// durations; unset ones are 0
+func (spec *LoadScenarioSpec) driftTiming() (start, ramp time.Duration, err error) {
+	if spec.DriftStart != nil {
+		if start, err = time.ParseDuration(*spec.DriftStart); err != nil || start < 0 {
+			return 0, 0, fmt.Errorf("invalid drift start %q: must be a non-negative duration such as 30m", *spec.DriftStart)
+		}
+	}
+	if spec.DriftRamp != nil {
+		if ramp, err = time.ParseDuration(*spec.DriftRamp); err != nil || ramp < 0 {
+			return 0, 0, fmt.Errorf("invalid drift ramp %q: must be a non-negative duration such as 1h", *spec.DriftRamp)
+		}
+	}
+	return start, ramp, nil
+}
+
+// applyDrift sets the assignment's drift fields from its scenario. The
+// drift start is counted from the scenario's start, or from the assignment
+// while the scenario has not started. The spec has been validated, so its
+// drift timing parses.
+func (assignment *WorkerAssignment) applyDrift(scenario *LoadScenario) {
+	start, ramp, _ := scenario.Spec.driftTiming()
+	began := assignment.AssignedAt
+	if scenario.Status.StartTime != nil {
+		began = *scenario.Status.StartTime
+	}
+	assignment.SchemaDrift = scenario.Spec.SchemaDrift
+	assignment.DriftStart = began.Add(start)
+	assignment.DriftRampSeconds = ramp.Seconds()
+	assignment.DriftValueShift = scenario.Spec.DriftValueShift
+}
+
 func (cp *ControlPlane) recipeLoaderLoop(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Minute)
 	defer ticker.Stop()
@@ -550,6 +734,9 @@ func (cp *ControlPlane) loadRecipes(ctx context.Context) {
 			log.Printf("Failed to load recipe %s: %v", familyID, err)
 		} else {
 			cp.mu.Lock()
+			if previous := cp.recipeCache[familyID]; previous != nil && previous.Version == recipe.Version {
+				recipe.Stale = previous.Stale // until the family is re-profiled
+			}
 			cp.recipeCache[familyID] = recipe
 			cp.mu.Unlock()
 			loadedCount++
@@ -609,6 +796,13 @@ func (cp *ControlPlane) reconcileScenarios(ctx context.Context) {
 }
 
 func (cp *ControlPlane) reconcileScenario(ctx context.Context, scenario *LoadScenario) error {
+	cp.mu.RLock()
+	paused := scenario.Status.Phase == phasePaused
+	cp.mu.RUnlock()
+	if paused {
+		return nil
+	}
+
 	// TODO: Implement scenario reconciliation
 	// - Ensure worker pods are running
 	// - Distribute recipe assignments
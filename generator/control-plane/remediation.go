@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scenario phases set by remediation, besides the reconciler's
+const (
+	phasePaused  = "Paused"
+	phasePending = "Pending"
+)
+
+// StaleMark flags a recipe whose generated load keeps diverging from its
+// reference, so it should be re-profiled. It is cleared when a recipe with
+// a different version is loaded.
+type StaleMark struct {
+	Reason   string    `json:"reason"`
+	Source   string    `json:"source,omitempty"`
+	MarkedAt time.Time `json:"marked_at"`
+	Version  string    `json:"version"`
+}
+
+// handlePauseScenario stops a scenario's load without deleting it; the
+// reconciler leaves paused scenarios alone until they are resumed.
+func (cp *ControlPlane) handlePauseScenario(w http.ResponseWriter, r *http.Request) {
+	cp.setScenarioPhase(w, r, phasePaused)
+}
+
+// handleResumeScenario returns a paused scenario to the reconciler.
+func (cp *ControlPlane) handleResumeScenario(w http.ResponseWriter, r *http.Request) {
+	cp.setScenarioPhase(w, r, phasePending)
+}
+
+func (cp *ControlPlane) setScenarioPhase(w http.ResponseWriter, r *http.Request, phase string) {
+	name := mux.Vars(r)["name"]
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cp.mu.Lock()
+	scenario, exists := cp.scenarios[name]
+	if exists {
+		scenario.Status.Phase = phase
+		scenario.Status.Message = request.Reason
+	}
+	cp.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Scenario %s set to %s: %s", name, phase, request.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scenario)
+}
+
+// handlePutFamilyMultiplier scales one family's load within a scenario,
+// relative to the scenario multiplier.
+func (cp *ControlPlane) handlePutFamilyMultiplier(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, familyID := vars["name"], vars["family_id"]
+
+	var request struct {
+		Multiplier float64 `json:"multiplier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if request.Multiplier < 0 {
+		http.Error(w, "multiplier must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	cp.mu.Lock()
+	scenario, exists := cp.scenarios[name]
+	if exists {
+		if scenario.Spec.FamilyMultipliers == nil {
+			scenario.Spec.FamilyMultipliers = make(map[string]float64)
+		}
+		scenario.Spec.FamilyMultipliers[familyID] = request.Multiplier
+	}
+	cp.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Scenario %s: family %s multiplier set to %.3f", name, familyID, request.Multiplier)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scenario)
+}
+
+// handleMarkRecipeStale flags a recipe for re-profiling.
+func (cp *ControlPlane) handleMarkRecipeStale(w http.ResponseWriter, r *http.Request) {
+	familyID := mux.Vars(r)["family_id"]
+
+	var mark StaleMark
+	if err := json.NewDecoder(r.Body).Decode(&mark); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if mark.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	cp.mu.Lock()
+	recipe, exists := cp.recipeCache[familyID]
+	if exists {
+		mark.MarkedAt = time.Now()
+		mark.Version = recipe.Version
+		recipe.Stale = &mark
+	}
+	cp.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Recipe %s marked stale: %s", familyID, mark.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recipe)
+}
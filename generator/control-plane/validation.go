@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// requestSummaryTTL is how long a worker's last summary is served after
+// the xDS controller stopped reporting it.
+const requestSummaryTTL = 5 * time.Minute
+
+// RequestSummary aggregates the requests one worker sent to one cluster
+// over an interval, as the Envoys saw them. The xDS controller builds it
+// from Envoy access logs, so it validates generated traffic end to end:
+// what the collectors actually received, answered and how fast.
+type RequestSummary struct {
+	Source        string             `json:"source"`
+	Worker        string             `json:"worker"`
+	Cluster       string             `json:"cluster"`
+	WindowStart   time.Time          `json:"window_start"`
+	WindowEnd     time.Time          `json:"window_end"`
+	Requests      int64              `json:"requests"`
+	StatusClasses map[string]int64   `json:"status_classes"`
+	BytesReceived uint64             `json:"bytes_received"`
+	BytesSent     uint64             `json:"bytes_sent"`
+	LatencyMs     map[string]float64 `json:"latency_ms"`
+	ReceivedAt    time.Time          `json:"received_at"`
+}
+
+func (s *RequestSummary) key() string {
+	return s.Source + "/" + s.Worker + "/" + s.Cluster
+}
+
+// handlePostRequestSummaries receives a batch of request summaries from an
+// xDS controller replica.
+func (cp *ControlPlane) handlePostRequestSummaries(w http.ResponseWriter, r *http.Request) {
+	var summaries []*RequestSummary
+	if err := json.NewDecoder(r.Body).Decode(&summaries); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	cp.mu.Lock()
+	for _, summary := range summaries {
+		summary.ReceivedAt = now
+		cp.requestSummaries[summary.key()] = summary
+	}
+	cp.mu.Unlock()
+
+	for _, summary := range summaries {
+		for class, count := range summary.StatusClasses {
+			workerRequests.WithLabelValues(summary.Worker, class).Add(float64(count))
+		}
+		for quantile, value := range summary.LatencyMs {
+			workerLatency.WithLabelValues(summary.Worker, quantile).Set(value)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleListRequestSummaries returns the latest request summary of every
+// worker and cluster; ?worker= filters.
+func (cp *ControlPlane) handleListRequestSummaries(w http.ResponseWriter, r *http.Request) {
+	worker := r.URL.Query().Get("worker")
+	cutoff := time.Now().Add(-requestSummaryTTL)
+
+	cp.mu.Lock()
+	summaries := make([]*RequestSummary, 0, len(cp.requestSummaries))
+	for key, summary := range cp.requestSummaries {
+		if summary.ReceivedAt.Before(cutoff) {
+			delete(cp.requestSummaries, key)
+			continue
+		}
+		if worker == "" || summary.Worker == worker {
+			summaries = append(summaries, summary)
+		}
+	}
+	cp.mu.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].key() < summaries[j].key() })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
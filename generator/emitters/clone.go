@@ -0,0 +1,53 @@
+package emitters
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/loadgen/generator-lib/payload-synth/temporal"
+)
+
+// Clone returns a copy of the synthesizer, with its own random source
+// seeded by seed, for use from another goroutine: a synthesizer is not safe
+// for concurrent use, but its copies are independent of it and of each
+// other. Copies share the recipe and the samplers built from it, which
+// synthesis only reads, so cloning is cheap; each gets its own burst
+// process, delta accumulation, series values and scratch space.
+//
+// The host fleet and active series set are copied as they are, filled
+// first if the original has not yet used them, so every copy emits for the
+// same hosts and series; from then on each copy restarts, replaces and
+// churns them on its own. Settings such as the cardinality bomb, edge case
+// rate, drift and validation carry over, the validation callback being
+// shared.
+// Clone must not run concurrently with other calls on the original.
+func (ws *WavefrontSynthesizer) Clone(seed int64) *WavefrontSynthesizer {
+	ws.advanceTopology(ws.startTime)
+	if ws.churn != nil {
+		ws.churn.Advance(ws.rng, 0, ws.spawnSeries)
+	}
+
+	clone := *ws
+	clone.rng = rand.New(rand.NewSource(seed))
+	clone.burst = temporal.NewProcess(ws.burst.Params)
+	clone.lastRateTime = time.Time{}
+	clone.deltaAccumulator = make(map[string]float64)
+	clone.deltaMinute = 0
+	clone.sinceValidated = 0
+	clone.driftValues = nil
+	if ws.seriesModel != nil {
+		clone.seriesModel = ws.seriesModel.Clone()
+	}
+	if ws.histogramShape != nil {
+		shape := *ws.histogramShape
+		shape.draws = nil
+		clone.histogramShape = &shape
+	}
+	if ws.topology != nil {
+		clone.topology = ws.topology.Clone()
+	}
+	if ws.churn != nil {
+		clone.churn = ws.churn.Clone()
+	}
+	return &clone
+}
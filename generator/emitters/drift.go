@@ -0,0 +1,156 @@
+package emitters
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Drift at full strength
+const (
+	// maxDriftNewShare is the share of tag values drawn from introduced
+	// values
+	maxDriftNewShare = 0.3
+
+	// maxDriftNewValues is how many values are introduced per tag key
+	maxDriftNewValues = 5
+
+	// maxDriftRetiredShare is the share of a tag key's values retired
+	maxDriftRetiredShare = 0.3
+
+	// maxDriftReweight is how many times more likely the most favoured
+	// values become than the least
+	maxDriftReweight = 4.0
+
+	// driftRedraws bounds the draws replacing a rejected value before one
+	// is kept regardless
+	driftRedraws = 8
+)
+
+// DriftSchedule describes gradual drift of a scenario's data. From Start
+// the drift ramps in linearly, reaching full strength after Ramp. At
+// strength 1 tag values' shares move by up to maxDriftReweight times,
+// maxDriftNewShare of values are new ones and maxDriftRetiredShare of the
+// recorded values are no longer seen; values are shifted by ValueShift.
+type DriftSchedule struct {
+	Start      time.Time     // Zero for the synthesizer's start
+	Ramp       time.Duration // 0 for full strength at once
+	Strength   float64       // 0 for no tag drift, to 1
+	ValueShift float64       // Relative change of values at full strength, e.g. 0.2 for +20%
+}
+
+// SetDrift turns on gradual drift on the schedule, to test how schema and
+// distribution inference follow data that changes over a scenario; a zero
+// schedule turns it off. Introduced tag values are variants of recorded
+// ones, named the same way by every synthesizer of the recipe, and they and
+// the retired values are the same whatever the strength, so stronger drift
+// goes further along the same path.
+func (ws *WavefrontSynthesizer) SetDrift(schedule DriftSchedule) {
+	schedule.Strength = math.Max(0, math.Min(schedule.Strength, 1))
+	ws.drift = schedule
+	if schedule.Strength == 0 {
+		ws.driftLevel = 0
+	}
+	if schedule.ValueShift == 0 {
+		ws.driftShift = 0
+	}
+}
+
+// advanceDrift moves the drift's strength and value shift to currentTime
+func (ws *WavefrontSynthesizer) advanceDrift(currentTime time.Time) {
+	if ws.drift.Strength == 0 && ws.drift.ValueShift == 0 {
+		return
+	}
+
+	start := ws.drift.Start
+	if start.IsZero() {
+		start = ws.startTime
+	}
+	elapsed := currentTime.Sub(start)
+	progress := 0.0
+	switch {
+	case elapsed < 0:
+	case elapsed >= ws.drift.Ramp:
+		progress = 1
+	default:
+		progress = float64(elapsed) / float64(ws.drift.Ramp)
+	}
+
+	ws.driftLevel = ws.drift.Strength * progress
+	ws.driftShift = ws.drift.ValueShift * progress
+}
+
+// driftTagValue returns a drawn value of a tag key as drift has it: an
+// introduced value at the drift's share, else the value or a redraw, kept
+// at its acceptance so that shares move and retired values are redrawn
+func (ws *WavefrontSynthesizer) driftTagValue(tagKey, value string) string {
+	if ws.rng.Float64() < ws.driftLevel*maxDriftNewShare {
+		return ws.introducedValue(tagKey)
+	}
+	for i := 0; i < driftRedraws; i++ {
+		if ws.rng.Float64() < ws.driftAcceptance(tagKey, value) {
+			return value
+		}
+		value = ws.drawTagValue(tagKey)
+	}
+	return value
+}
+
+// driftAcceptance is the chance a drawn value is kept: 0 once retired,
+// else falling with the value's disfavour as drift grows. Both come from a
+// hash of the value, so they do not depend on the synthesizer's draws.
+func (ws *WavefrontSynthesizer) driftAcceptance(tagKey, value string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(tagKey))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	sum := h.Sum64()
+	retirement := float64(sum>>32) / (1 << 32)
+	disfavour := float64(sum&0xffffffff) / (1 << 32)
+
+	if retirement < ws.driftLevel*maxDriftRetiredShare {
+		return 0
+	}
+	return math.Exp(-ws.driftLevel * math.Log(maxDriftReweight) * disfavour)
+}
+
+// introducedValue draws one of the values introduced so far, those
+// introduced earlier being more common
+func (ws *WavefrontSynthesizer) introducedValue(tagKey string) string {
+	n := int(math.Ceil(ws.driftLevel * maxDriftNewValues))
+	if ws.driftValues == nil {
+		ws.driftValues = make(map[string][]string)
+	}
+	values := ws.driftValues[tagKey]
+	for len(values) < n {
+		values = append(values, ws.driftVariant(tagKey, len(values)))
+	}
+	ws.driftValues[tagKey] = values
+
+	u := ws.rng.Float64()
+	return values[int(u*u*float64(n))]
+}
+
+// driftVariant names the index-th introduced value of a tag key: a value
+// of the key, drawn with a random source seeded by the key and index, with
+// its trailing number bumped or a number appended, as a new version,
+// region or instance would be named
+func (ws *WavefrontSynthesizer) driftVariant(tagKey string, index int) string {
+	h := fnv.New64a()
+	h.Write([]byte(tagKey))
+	rng := ws.rng
+	ws.rng = rand.New(rand.NewSource(int64(h.Sum64()) + int64(index)))
+	base := ws.drawTagValue(tagKey)
+	ws.rng = rng
+
+	digits := len(base)
+	for digits > 0 && base[digits-1] >= '0' && base[digits-1] <= '9' {
+		digits--
+	}
+	if number, err := strconv.Atoi(base[digits:]); err == nil {
+		return base[:digits] + strconv.Itoa(number+index+1)
+	}
+	return base + "-" + strconv.Itoa(index+2)
+}
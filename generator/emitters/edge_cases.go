@@ -0,0 +1,130 @@
+package emitters
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Length limits of the Wavefront data format, in characters
+const (
+	maxMetricNameLength = 256
+	maxSourceLength     = 128
+	maxTagLength        = 254 // Key and value together
+)
+
+// edgeCaseMultibyte are multibyte UTF-8 strings: accented and CJK letters,
+// a combining mark, right-to-left script, an emoji with a zero-width joiner
+var edgeCaseMultibyte = []string{
+	"ü", "ß", "日本語", "한국어", "é", "שלום", "مرحبا", "😀", "👩‍💻", " ",
+}
+
+// edgeCaseQuoting are characters that need quoting or escaping in a line
+var edgeCaseQuoting = []string{" ", `"`, `\`, "=", ",", "'", `\"`, " = "}
+
+// edgeCaseBoundaries are values at the edges of what parsers interpret
+var edgeCaseBoundaries = []string{
+	"0", "-0", "NaN", "Infinity", "-Infinity", "1e308", "4.9e-324",
+	"9223372036854775807", "-9223372036854775808", "18446744073709551616",
+	"true", "null", "-", ".", "~",
+}
+
+// SetEdgeCaseRate turns on the edge-case string mode: each metric name,
+// source and tag value is, at the given rate, made multibyte, padded to the
+// format's maximum length, given characters that need quoting, or replaced
+// by a boundary value, to exercise the targets' parser and storage escaping.
+// Lines stay within the format's length limits; 0 turns it off.
+func (ws *WavefrontSynthesizer) SetEdgeCaseRate(rate float64) {
+	ws.edgeCaseRate = rate
+}
+
+// applyEdgeCases returns the metric name, source and tags with edge cases
+// injected at the edge-case rate; tags are copied before any is changed,
+// since those of the active series are shared
+func (ws *WavefrontSynthesizer) applyEdgeCases(metricName, source string, tags map[string]string) (string, string, map[string]string) {
+	if ws.edgeCaseRate <= 0 {
+		return metricName, source, tags
+	}
+
+	if ws.rng.Float64() < ws.edgeCaseRate {
+		metricName = ws.edgeCase(metricName, maxMetricNameLength)
+	}
+	if ws.rng.Float64() < ws.edgeCaseRate {
+		source = ws.edgeCase(source, maxSourceLength)
+	}
+
+	var edged map[string]string
+	for _, key := range sortedKeys(tags) {
+		if ws.rng.Float64() >= ws.edgeCaseRate {
+			continue
+		}
+		if edged == nil {
+			edged = make(map[string]string, len(tags))
+			for k, v := range tags {
+				edged[k] = v
+			}
+		}
+		edged[key] = ws.edgeCase(tags[key], maxTagLength-utf8.RuneCountInString(key))
+	}
+	if edged != nil {
+		tags = edged
+	}
+
+	return metricName, source, tags
+}
+
+// edgeCase turns a value into one of the edge cases, at most limit
+// characters long
+func (ws *WavefrontSynthesizer) edgeCase(value string, limit int) string {
+	if limit <= 0 {
+		return value
+	}
+	if value == "" {
+		value = "x"
+	}
+
+	var edged string
+	switch ws.rng.Intn(4) {
+	case 0:
+		edged = ws.insertRandomly(value, edgeCaseMultibyte[ws.rng.Intn(len(edgeCaseMultibyte))])
+	case 1:
+		// Repeat the value to exactly the limit
+		var padded strings.Builder
+		for utf8.RuneCountInString(padded.String()) < limit {
+			padded.WriteString(value)
+		}
+		edged = padded.String()
+	case 2:
+		edged = ws.insertRandomly(value, edgeCaseQuoting[ws.rng.Intn(len(edgeCaseQuoting))])
+	default:
+		edged = edgeCaseBoundaries[ws.rng.Intn(len(edgeCaseBoundaries))]
+	}
+
+	return truncateRunes(edged, limit)
+}
+
+// insertRandomly inserts s into value at a random character boundary
+func (ws *WavefrontSynthesizer) insertRandomly(value, s string) string {
+	runes := []rune(value)
+	at := ws.rng.Intn(len(runes) + 1)
+	return string(runes[:at]) + s + string(runes[at:])
+}
+
+// sortedKeys returns the keys of m in order, so a seeded synthesizer
+// draws for them reproducibly
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// truncateRunes cuts s to at most limit characters
+func truncateRunes(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	return string([]rune(s)[:limit])
+}
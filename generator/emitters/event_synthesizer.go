@@ -0,0 +1,398 @@
+package emitters
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event synthesis defaults
+const (
+	defaultEventsPerHour       = 2.0
+	defaultEventBurstThreshold = 4.0 // Standard deviations over the expected count that open a burst
+
+	// maxBurstEventHosts bounds the hosts a burst event names
+	maxBurstEventHosts = 3
+)
+
+// eventKind is a kind of event and its share of the scheduled ones
+type eventKind struct {
+	name     logTemplate
+	details  logTemplate
+	tags     []logTemplate
+	typ      string
+	severity string
+	weight   float64
+	duration float64 // Mean seconds; 0 for instantaneous events
+	burst    bool    // Marks a burst of the intensity rather than scheduled
+}
+
+// defaultEventKinds are the event kinds of recipes without their own
+var defaultEventKinds = []struct {
+	name     string
+	details  string
+	tags     []string
+	typ      string
+	severity string
+	weight   float64
+	duration float64
+	burst    bool
+}{
+	{"Deploy {source}", "rolled out build {id}", []string{"deploy"}, "deploy", "info", 0.5, 120, false},
+	{"Config change on {source}", "changed {count} settings", []string{"config"}, "config", "info", 0.3, 0, false},
+	{"Maintenance of {source}", "scheduled maintenance", []string{"maintenance"}, "maintenance", "info", 0.2, 1800, false},
+	{"Traffic spike on {source}", "load above expected", []string{"alert", "burst"}, "alert", "warn", 1, 0, true},
+}
+
+// EventSynthesizer generates Wavefront @Event lines from Recipes:
+//
+//	@Event <startMillis> <endMillis> "<name>" severity="<s>" type="<t>" details="<d>" host="<h>" tag="<a>" ...
+//
+// Scheduled events, such as deploys, start at the recipe's rate whatever
+// the traffic. Burst events mark the bursts of the family's emission rate:
+// one opens when the count of lines CalculateTargetRate last found exceeds
+// the intensity curve's by the threshold in standard deviations of a
+// Poisson count, so that noise alone rarely opens one at any rate, and is
+// emitted spanning the burst once the count falls back, more severe the
+// higher it peaked. Hosts and the tag
+// values of templates come from the same samplers as WavefrontSynthesizer,
+// so events name the hosts the metrics of a scenario come from.
+type EventSynthesizer struct {
+	ws             *WavefrontSynthesizer
+	kinds          []eventKind
+	rate           float64 // Scheduled events per second
+	burstThreshold float64
+	surprise       float64 // Standard deviations of the last count over expected
+	lastRateTime   time.Time
+	next           time.Time // Start of the next scheduled event
+	burstStart     time.Time // Zero outside a burst
+	burstPeak      float64   // Highest surprise in the burst
+}
+
+// NewEventSynthesizer creates a new event synthesizer for a given recipe.
+// The recipe's generation.events section may set the scheduled rate, the
+// burst threshold and the event kinds; the defaults are deploys, config
+// changes, maintenance and traffic spike alerts.
+func NewEventSynthesizer(recipe *Recipe, seed int64, startTime time.Time) (*EventSynthesizer, error) {
+	ws, err := NewWavefrontSynthesizer(recipe, seed, startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &EventSynthesizer{
+		ws:             ws,
+		rate:           defaultEventsPerHour / 3600,
+		burstThreshold: defaultEventBurstThreshold,
+	}
+	if err := es.initializeEvents(); err != nil {
+		return nil, fmt.Errorf("failed to initialize events: %w", err)
+	}
+	if es.rate > 0 {
+		es.next = startTime.Add(es.interval())
+	}
+	return es, nil
+}
+
+func (es *EventSynthesizer) initializeEvents() error {
+	generation, _ := es.ws.recipe.Generation["generation"].(map[string]interface{})
+	events, _ := generation["events"].(map[string]interface{})
+
+	if perHour, ok := events["rate_per_hour"].(float64); ok {
+		if perHour < 0 {
+			return fmt.Errorf("negative event rate %g", perHour)
+		}
+		es.rate = perHour / 3600
+	}
+	if threshold, ok := events["burst_threshold"].(float64); ok {
+		if threshold <= 0 {
+			return fmt.Errorf("burst threshold %g is not positive", threshold)
+		}
+		es.burstThreshold = threshold
+	}
+
+	if kinds, ok := events["kinds"].([]interface{}); ok {
+		for _, k := range kinds {
+			kMap, ok := k.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := kMap["name"].(string)
+			if name == "" {
+				continue
+			}
+			weight, ok := kMap["weight"].(float64)
+			if !ok {
+				weight = 1
+			}
+			if weight <= 0 {
+				continue
+			}
+			details, _ := kMap["details"].(string)
+			typ, _ := kMap["type"].(string)
+			severity, _ := kMap["severity"].(string)
+			duration, _ := kMap["duration_seconds"].(float64)
+			burst, _ := kMap["burst"].(bool)
+			var tags []string
+			if list, ok := kMap["tags"].([]interface{}); ok {
+				for _, t := range list {
+					if tag, ok := t.(string); ok && tag != "" {
+						tags = append(tags, tag)
+					}
+				}
+			}
+			if err := es.addKind(name, details, tags, typ, severity, weight, duration, burst); err != nil {
+				return err
+			}
+		}
+	}
+	if len(es.kinds) == 0 {
+		for _, k := range defaultEventKinds {
+			if err := es.addKind(k.name, k.details, k.tags, k.typ, k.severity, k.weight, k.duration, k.burst); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addKind parses an event kind's templates and adds it
+func (es *EventSynthesizer) addKind(name, details string, tags []string, typ, severity string, weight, duration float64, burst bool) error {
+	kind := eventKind{
+		typ:      typ,
+		severity: severity,
+		weight:   weight,
+		duration: math.Max(0, duration),
+		burst:    burst,
+	}
+	var err error
+	if kind.name, err = parseLogTemplate(name); err != nil {
+		return err
+	}
+	if kind.details, err = parseLogTemplate(details); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		template, err := parseLogTemplate(tag)
+		if err != nil {
+			return err
+		}
+		kind.tags = append(kind.tags, template)
+	}
+	es.kinds = append(es.kinds, kind)
+	return nil
+}
+
+// interval draws the time to the next scheduled event
+func (es *EventSynthesizer) interval() time.Duration {
+	return time.Duration(es.ws.rng.ExpFloat64() / es.rate * float64(time.Second))
+}
+
+// CalculateTargetRate computes the family's target emission rate for
+// current time, as WavefrontSynthesizer does, and remembers how far the
+// count it implies since the previous call exceeds the intensity curve's;
+// the bursts SynthesizeEvents marks are those of these rates
+func (es *EventSynthesizer) CalculateTargetRate(currentTime time.Time, baseRate, multiplier, burstFactor float64) float64 {
+	rate := es.ws.CalculateTargetRate(currentTime, baseRate, multiplier, burstFactor)
+
+	expected := baseRate * es.ws.GetCurrentIntensity(currentTime) * multiplier
+	elapsed := currentTime.Sub(es.lastRateTime).Seconds()
+	first := es.lastRateTime.IsZero()
+	es.lastRateTime = currentTime
+	es.surprise = 0
+	if !first && expected > 0 && elapsed > 0 {
+		es.surprise = (rate - expected) * math.Sqrt(elapsed/expected)
+	}
+	return rate
+}
+
+// SynthesizeEvents generates the @Event lines due by currentTime, in order
+// of their start: the scheduled events started since the previous call and
+// the burst that ended, if any
+func (es *EventSynthesizer) SynthesizeEvents(currentTime time.Time) []string {
+	es.ws.advance(currentTime)
+
+	type event struct {
+		start time.Time
+		line  string
+	}
+	var events []event
+
+	for es.rate > 0 && !es.next.After(currentTime) {
+		kind := es.sampleKind(false)
+		if kind == nil {
+			break
+		}
+		end := es.next
+		if kind.duration > 0 {
+			end = end.Add(time.Duration(es.ws.rng.ExpFloat64() * kind.duration * float64(time.Second)))
+		}
+		events = append(events, event{es.next, es.formatEvent(kind, es.next, end, kind.severity, 1)})
+		es.next = es.next.Add(es.interval())
+	}
+
+	if line := es.trackBurst(currentTime); line != "" {
+		events = append(events, event{es.burstStart, line})
+		es.burstStart = time.Time{}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].start.Before(events[j].start) })
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = e.line
+	}
+	return lines
+}
+
+// trackBurst follows the surprise of the counts, returning the event of a
+// burst that ended by currentTime
+func (es *EventSynthesizer) trackBurst(currentTime time.Time) string {
+	if es.surprise >= es.burstThreshold {
+		if es.burstStart.IsZero() {
+			es.burstStart = currentTime
+			es.burstPeak = 0
+		}
+		es.burstPeak = math.Max(es.burstPeak, es.surprise)
+		return ""
+	}
+	if es.burstStart.IsZero() {
+		return ""
+	}
+
+	kind := es.sampleKind(true)
+	if kind == nil {
+		es.burstStart = time.Time{}
+		return ""
+	}
+	severity := kind.severity
+	if es.burstPeak >= 2*es.burstThreshold {
+		severity = "severe"
+	}
+	hosts := 1 + es.ws.rng.Intn(maxBurstEventHosts)
+	return es.formatEvent(kind, es.burstStart, currentTime, severity, hosts)
+}
+
+// sampleKind draws a burst or scheduled event kind by weight, or nil when
+// the recipe has none
+func (es *EventSynthesizer) sampleKind(burst bool) *eventKind {
+	total := 0.0
+	for i := range es.kinds {
+		if es.kinds[i].burst == burst {
+			total += es.kinds[i].weight
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+	target := es.ws.rng.Float64() * total
+	var kind *eventKind
+	for i := range es.kinds {
+		if es.kinds[i].burst != burst {
+			continue
+		}
+		kind = &es.kinds[i]
+		target -= kind.weight
+		if target < 0 {
+			break
+		}
+	}
+	return kind
+}
+
+// formatEvent writes the @Event line of a kind for up to hosts hosts.
+// Instantaneous events end a millisecond after they start, as Wavefront
+// records them.
+func (es *EventSynthesizer) formatEvent(kind *eventKind, start, end time.Time, severity string, hosts int) string {
+	startMillis := start.UnixNano() / int64(time.Millisecond)
+	endMillis := end.UnixNano() / int64(time.Millisecond)
+	if endMillis <= startMillis {
+		endMillis = startMillis + 1
+	}
+
+	source, tags := es.ws.drawSeries()
+	sources := []string{source}
+	for len(sources) < hosts {
+		other, _ := es.ws.drawSeries()
+		duplicate := false
+		for _, s := range sources {
+			duplicate = duplicate || s == other
+		}
+		if duplicate {
+			break
+		}
+		sources = append(sources, other)
+	}
+
+	fields := make(map[string]string)
+	buf := append([]byte(nil), "@Event "...)
+	buf = strconv.AppendInt(buf, startMillis, 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, endMillis, 10)
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, es.expand(kind.name, fields, source, tags))
+	if severity != "" {
+		buf = append(buf, " severity="...)
+		buf = appendQuoted(buf, severity)
+	}
+	if kind.typ != "" {
+		buf = append(buf, " type="...)
+		buf = appendQuoted(buf, kind.typ)
+	}
+	if details := es.expand(kind.details, fields, source, tags); details != "" {
+		buf = append(buf, " details="...)
+		buf = appendQuoted(buf, details)
+	}
+	for _, s := range sources {
+		buf = append(buf, " host="...)
+		buf = appendQuoted(buf, s)
+	}
+	for _, template := range kind.tags {
+		if tag := es.expand(template, fields, source, tags); tag != "" {
+			buf = append(buf, " tag="...)
+			buf = appendQuoted(buf, tag)
+		}
+	}
+	return string(buf)
+}
+
+// expand fills a template's fields, each drawn once per event so the name,
+// details and tags agree: source, id, count, or a tag of the event's series,
+// else a value of that tag's distribution
+func (es *EventSynthesizer) expand(template logTemplate, fields map[string]string, source string, tags map[string]string) string {
+	if len(template.fields) == 0 {
+		return template.parts[0]
+	}
+	var text strings.Builder
+	for i, field := range template.fields {
+		text.WriteString(template.parts[i])
+		value, ok := fields[field]
+		if !ok {
+			value = es.fieldValue(field, source, tags)
+			fields[field] = value
+		}
+		text.WriteString(value)
+	}
+	text.WriteString(template.parts[len(template.parts)-1])
+	return text.String()
+}
+
+func (es *EventSynthesizer) fieldValue(field, source string, tags map[string]string) string {
+	switch field {
+	case "source":
+		return source
+	case "id":
+		return es.ws.uuid()
+	case "count":
+		return strconv.Itoa(1 + es.ws.rng.Intn(20))
+	}
+	if value, ok := tags[field]; ok {
+		return value
+	}
+	if value := es.ws.generateTagValue(field); value != "" {
+		return value
+	}
+	return "-"
+}
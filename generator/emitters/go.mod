@@ -2,6 +2,12 @@ module github.com/loadgen/emitters
 
 go 1.21
 
-require github.com/loadgen/payload-synth v0.1.0
+require (
+	github.com/loadgen/payload-synth v0.1.0
+	github.com/loadgen/wavefront v0.1.0
+)
 
-replace github.com/loadgen/payload-synth => ../payload-synth
\ No newline at end of file
+replace (
+	github.com/loadgen/payload-synth => ../payload-synth
+	github.com/loadgen/wavefront => ../../validation/wavefront
+)
@@ -0,0 +1,184 @@
+package emitters
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/loadgen/generator-lib/payload-synth"
+)
+
+// Histogram shape bounds and the defaults for recipes without
+// histogram_distribution
+const (
+	defaultHistogramObservations = 55 // Mean per line
+	defaultHistogramCompression  = 32 // The Wavefront proxy's digest compression
+	maxHistogramCentroids        = payloadsynth.DefaultCompression
+
+	// maxHistogramDraws bounds the values drawn for one line; the centroids
+	// of a line summarising more observations are scaled up to its count
+	maxHistogramDraws = 1000
+)
+
+// histogramGranularities are the Wavefront histogram bins, with their
+// lengths in seconds
+var histogramGranularities = [...]struct {
+	name    string
+	seconds int64
+}{
+	{"M", 60},
+	{"H", 3600},
+	{"D", 86400},
+}
+
+// histogramShape holds what a histogram line is built from
+type histogramShape struct {
+	granularityWeights [len(histogramGranularities)]float64
+	observations       [len(histogramGranularities)]float64 // Mean per line, by granularity
+	values             *payloadsynth.NumericSampler
+	centroidCounts     *payloadsynth.NumericSampler // Centroids per line
+	draws              []payloadsynth.Centroid      // Reused between lines
+}
+
+// initializeHistogramShape reads the granularity mix, observations per line
+// and centroid statistics of a histogram recipe; missing statistics keep
+// the defaults, and values fall back to the value distribution
+func (ws *WavefrontSynthesizer) initializeHistogramShape(stats map[string]interface{}) {
+	ws.histogramShape = &histogramShape{
+		granularityWeights: [...]float64{0.76, 0.2, 0.04},
+		values:             ws.valueSampler,
+	}
+	shape := ws.histogramShape
+	for i := range shape.observations {
+		shape.observations[i] = defaultHistogramObservations
+	}
+
+	histStats, ok := stats["histogram_distribution"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if mix, ok := histStats["granularities"].(map[string]interface{}); ok {
+		var weights [len(histogramGranularities)]float64
+		total := 0.0
+		for i, g := range histogramGranularities {
+			if w, ok := mix[g.name].(float64); ok && w > 0 {
+				weights[i] = w
+				total += w
+			}
+		}
+		if total > 0 {
+			shape.granularityWeights = weights
+		}
+	}
+	if perHistogram, ok := histStats["count_per_histogram"].(map[string]interface{}); ok {
+		for i, g := range histogramGranularities {
+			if mean, ok := perHistogram[g.name].(float64); ok && mean > 0 {
+				shape.observations[i] = mean
+			}
+		}
+	}
+	if dist, ok := histStats["centroid_value_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			shape.values = sampler
+		}
+	}
+	if dist, ok := histStats["centroid_count_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			shape.centroidCounts = sampler
+		}
+	}
+}
+
+// appendHistogram appends a histogram line:
+// !<M|H|D> <timestamp> #<count> <mean> [#<count> <mean> ...] <metric> source=<source> [tags]
+// Its observations, about the recipe's count per line for the granularity
+// scaled by the multiplier, are drawn from the recorded values and merged
+// into a t-digest, as a proxy would: small centroids in the tails, large
+// ones in the middle. The timestamp is the start of the bin.
+func (ws *WavefrontSynthesizer) appendHistogram(buf []byte, currentTime time.Time, multiplier float64) []byte {
+	shape := ws.histogramShape
+	g := ws.histogramGranularity()
+
+	mean := shape.observations[g] * multiplier
+	total := int(math.Max(1, math.Round(mean+math.Sqrt(mean)*ws.rng.NormFloat64())))
+
+	draws := total
+	if draws > maxHistogramDraws {
+		draws = maxHistogramDraws
+	}
+	shape.draws = shape.draws[:0]
+	for i := 0; i < draws; i++ {
+		var v float64
+		if shape.values != nil {
+			v = shape.values.Sample(ws.rng)
+		} else {
+			v = ws.rng.NormFloat64()*50 + 100
+		}
+		shape.draws = append(shape.draws, payloadsynth.Centroid{Mean: v * (1 + ws.driftShift), Count: 1})
+	}
+
+	// A digest merges to about half its compression in centroids
+	compression := float64(defaultHistogramCompression)
+	if shape.centroidCounts != nil {
+		target := math.Max(1, math.Min(math.Round(shape.centroidCounts.Sample(ws.rng)), maxHistogramCentroids))
+		compression = 2 * target
+	}
+	var centroids []payloadsynth.Centroid
+	if td, err := payloadsynth.NewTDigest(shape.draws, compression, nil, nil); err == nil {
+		centroids = td.Centroids()
+	} else {
+		// Only values the digest cannot hold were drawn
+		centroids = []payloadsynth.Centroid{{Mean: 0, Count: float64(draws)}}
+	}
+
+	bin := histogramGranularities[g]
+	timestamp := currentTime.Unix()
+	timestamp -= timestamp % bin.seconds
+
+	buf = append(buf, '!')
+	buf = append(buf, bin.name...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, timestamp, 10)
+
+	// Counts scale from the draws to the line's total; rounding the running
+	// sum keeps the total exact
+	scale := float64(total) / float64(draws)
+	cumulative, written := 0.0, int64(0)
+	for _, c := range centroids {
+		cumulative += c.Count * scale
+		count := int64(math.Round(cumulative)) - written
+		written += count
+
+		buf = append(buf, " #"...)
+		buf = strconv.AppendInt(buf, count, 10)
+		buf = append(buf, ' ')
+		buf = appendValue(buf, c.Mean)
+	}
+
+	// Add metric name, source and tags
+	source, tags := ws.generateSeries(currentTime)
+	tags = ws.detonateCardinalityBomb(tags, currentTime)
+	metricName, source, tags := ws.applyEdgeCases(ws.recipe.MetricName, source, tags)
+
+	buf = append(buf, ' ')
+	buf = ws.appendMetricName(buf, metricName, false)
+	return appendSourceTags(buf, source, tags)
+}
+
+// histogramGranularity draws a granularity by the recipe's mix
+func (ws *WavefrontSynthesizer) histogramGranularity() int {
+	weights := ws.histogramShape.granularityWeights
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	target := ws.rng.Float64() * total
+	for i, w := range weights {
+		target -= w
+		if target < 0 {
+			return i
+		}
+	}
+	return 0
+}
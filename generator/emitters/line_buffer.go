@@ -0,0 +1,119 @@
+package emitters
+
+import (
+	"math"
+	"strconv"
+	"sync"
+)
+
+// linePool recycles the buffers SynthesizeLine builds lines in
+var linePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// appendMetricName appends a metric name, escaped and with the delta prefix
+// if isDelta. The recipe's own name is escaped once and its fragment
+// reused; names changed by edge cases are escaped each time.
+func (ws *WavefrontSynthesizer) appendMetricName(buf []byte, name string, isDelta bool) []byte {
+	if name != ws.recipe.MetricName {
+		return appendDeltaName(buf, name, isDelta)
+	}
+
+	fragment := &ws.nameFragments[0]
+	if isDelta {
+		fragment = &ws.nameFragments[1]
+	}
+	if *fragment == nil {
+		*fragment = appendDeltaName(nil, name, isDelta)
+	}
+	return append(buf, *fragment...)
+}
+
+func appendDeltaName(buf []byte, name string, isDelta bool) []byte {
+	if isDelta {
+		name = "∆" + truncateRunes(name, maxMetricNameLength-1)
+	}
+	return appendEscapedName(buf, name)
+}
+
+// appendEscapedName appends a metric name, quoted and escaped unless it is
+// only alphanumerics, dots, hyphens and underscores
+func appendEscapedName(buf []byte, name string) []byte {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return appendQuoted(buf, name)
+		}
+	}
+	if name == "" {
+		return appendQuoted(buf, name)
+	}
+	return append(buf, name...)
+}
+
+// appendTagValue appends a source or tag value, quoted and escaped if it
+// contains spaces or special characters
+func appendTagValue(buf []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case ' ', '"', '=', '\\':
+			return appendQuoted(buf, value)
+		}
+	}
+	return append(buf, value...)
+}
+
+// appendQuoted appends s in double quotes, escaping backslashes and quotes
+func appendQuoted(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || s[i] == '"' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return append(buf, '"')
+}
+
+// appendSourceTags appends " source=<source>" and each " key=value" tag
+func appendSourceTags(buf []byte, source string, tags map[string]string) []byte {
+	buf = append(buf, " source="...)
+	buf = appendTagValue(buf, source)
+	for key, val := range tags {
+		buf = append(buf, ' ')
+		buf = append(buf, key...)
+		buf = append(buf, '=')
+		buf = appendTagValue(buf, val)
+	}
+	return buf
+}
+
+// appendValue appends a value with a precision suited to its magnitude
+func appendValue(buf []byte, value float64) []byte {
+	return appendValuePrecision(buf, value, valuePrecision(value))
+}
+
+// appendValuePrecision appends a value with precision decimals; NaN and
+// infinities, which the format has no room for, are written as 0
+func appendValuePrecision(buf []byte, value float64, precision int) []byte {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return append(buf, '0')
+	}
+	return strconv.AppendFloat(buf, value, 'f', precision, 64)
+}
+
+// valuePrecision is the number of decimals suited to a value's magnitude
+func valuePrecision(value float64) int {
+	switch abs := math.Abs(value); {
+	case abs < 0.001:
+		return 6
+	case abs < 1:
+		return 3
+	case abs < 1000:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+package emitters
+
+import (
+	"testing"
+	"time"
+)
+
+func BenchmarkSynthesizeLine(b *testing.B) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ws, err := NewWavefrontSynthesizer(testRecipe(map[string]interface{}{}), 1, start)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ws.SynthesizeLine(start, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSynthesizeLineTo appends to a reused buffer, as batching
+// callers do
+func BenchmarkSynthesizeLineTo(b *testing.B) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ws, err := NewWavefrontSynthesizer(testRecipe(map[string]interface{}{}), 1, start)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if buf, err = ws.SynthesizeLineTo(buf[:0], start, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
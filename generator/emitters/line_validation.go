@@ -0,0 +1,43 @@
+package emitters
+
+import (
+	"math"
+
+	"github.com/loadgen/wavefront"
+)
+
+// SetValidation turns on the runtime validation mode: a share rate of the
+// lines and spans the synthesizer emits is checked against the Wavefront
+// line grammar, and onInvalid called with each line that breaks it. Every
+// 1/rate-th line is checked, so the mode draws nothing from the seeded
+// generator and leaves the output as it was. Edge cases and injected
+// errors break the grammar by design, and are reported like any other
+// line. A rate of 0 turns it off.
+func (ws *WavefrontSynthesizer) SetValidation(rate float64, onInvalid func(line string, err error)) {
+	ws.validateEvery = 0
+	if rate > 0 && onInvalid != nil {
+		ws.validateEvery = int(math.Max(1, math.Round(1/math.Min(rate, 1))))
+	}
+	ws.onInvalid = onInvalid
+}
+
+// sampledForValidation reports whether the next line falls in the
+// validation sample
+func (ws *WavefrontSynthesizer) sampledForValidation() bool {
+	if ws.validateEvery == 0 {
+		return false
+	}
+	ws.sinceValidated++
+	if ws.sinceValidated < ws.validateEvery {
+		return false
+	}
+	ws.sinceValidated = 0
+	return true
+}
+
+// validate checks a sampled line, reporting it if it is invalid
+func (ws *WavefrontSynthesizer) validate(line string) {
+	if _, err := wavefront.Validate(line); err != nil {
+		ws.onInvalid(line, err)
+	}
+}
@@ -0,0 +1,99 @@
+package emitters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/loadgen/wavefront"
+)
+
+// testRecipe returns a recipe of the given schema with recorded sources,
+// tags and values, and spans
+func testRecipe(schema map[string]interface{}) *Recipe {
+	topValues := func(values ...string) map[string]interface{} {
+		var items []interface{}
+		for _, v := range values {
+			items = append(items, map[string]interface{}{"value": v, "frequency": 1.0 / float64(len(values))})
+		}
+		return map[string]interface{}{"top_values": items}
+	}
+
+	return &Recipe{
+		FamilyID:   "test",
+		MetricName: "http.server.requests",
+		Schema:     map[string]interface{}{"schema": schema},
+		Statistics: map[string]interface{}{"statistics": map[string]interface{}{
+			"source_distribution": topValues("web-01", "web-02", "db-01"),
+			"tag_distributions": map[string]interface{}{
+				"env":    topValues("prod", "staging"),
+				"region": topValues("us-east-1", "eu-west-1"),
+			},
+			"value_distribution": map[string]interface{}{
+				"quantiles": map[string]interface{}{"p01": 20.0, "p05": 45.0, "p50": 120.0, "p95": 400.0, "p99": 900.0},
+			},
+			"span_distribution": map[string]interface{}{},
+		}},
+		Temporal:   map[string]interface{}{},
+		Patterns:   map[string]interface{}{},
+		Generation: map[string]interface{}{},
+	}
+}
+
+func TestSynthesizedLinesValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema map[string]interface{}
+		want   wavefront.Type
+	}{
+		{"metric", map[string]interface{}{}, wavefront.TypeMetric},
+		{"delta", map[string]interface{}{"is_delta": true}, wavefront.TypeMetric},
+		{"histogram", map[string]interface{}{"has_histogram": true}, wavefront.TypeHistogram},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := NewWavefrontSynthesizer(testRecipe(tt.schema), 1, start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := false
+			for i := 0; i < 2000; i++ {
+				line, err := ws.SynthesizeLine(start.Add(time.Duration(i)*time.Second), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := wavefront.Validate(line)
+				if err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				seen = seen || parsed.Type == tt.want
+			}
+			if !seen {
+				t.Errorf("no %s line among those synthesized", tt.want)
+			}
+		})
+	}
+
+	t.Run("span", func(t *testing.T) {
+		ws, err := NewWavefrontSynthesizer(testRecipe(map[string]interface{}{"type": "span"}), 1, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			lines, err := ws.SynthesizeTrace(start.Add(time.Duration(i)*time.Second), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				parsed, err := wavefront.Validate(line)
+				if err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				if parsed.Type != wavefront.TypeSpan {
+					t.Fatalf("line %q is a %s, not a span", line, parsed.Type)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,383 @@
+package emitters
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log line formats
+const (
+	LogFormatText = "text" // <timestamp> <LEVEL> <source> <message> [<key>=<value> ...]
+	LogFormatJSON = "json" // One JSON object per line
+)
+
+// maxLogEscalation bounds how far load raises the share of severe levels
+const maxLogEscalation = 10.0
+
+// logLevel is a level and its share of lines at nominal load
+type logLevel struct {
+	name   string
+	weight float64
+	severe bool // Grows with load: bursts bring warnings and errors
+}
+
+// defaultLogLevels are the level shares of recipes without their own
+var defaultLogLevels = []logLevel{
+	{name: "DEBUG", weight: 0.05},
+	{name: "INFO", weight: 0.80},
+	{name: "WARN", weight: 0.10, severe: true},
+	{name: "ERROR", weight: 0.05, severe: true},
+}
+
+// defaultLogTemplates are the message templates of recipes without their own
+var defaultLogTemplates = []struct {
+	template string
+	level    string
+}{
+	{"cache lookup id={id} took {duration_ms}ms", "DEBUG"},
+	{"request completed status={status} duration_ms={duration_ms} id={id}", "INFO"},
+	{"processed {count} items value={value}", "INFO"},
+	{"slow request id={id} duration_ms={duration_ms}", "WARN"},
+	{"retrying connection to {ip}", "WARN"},
+	{"request failed status={status} id={id}", "ERROR"},
+	{"connection to {ip} refused", "ERROR"},
+}
+
+// logTemplate is a parsed message template. Its fields sit between the
+// literal parts, so parts has one more element than fields.
+type logTemplate struct {
+	parts  []string
+	fields []string
+	level  string // "" for any level
+	weight float64
+}
+
+// LogSynthesizer generates log lines from Recipes. Messages expand
+// templates whose {field} placeholders take variable values; sources and
+// tags come from the same samplers as WavefrontSynthesizer, so logs and
+// metrics of a scenario describe the same hosts. Under load, from the
+// intensity curve, the multiplier and bursts, warnings and errors make up
+// a larger share of the lines.
+type LogSynthesizer struct {
+	ws        *WavefrontSynthesizer
+	format    string
+	levels    []logLevel
+	templates []logTemplate
+	load      float64 // Emission rate over the base rate, as last calculated
+}
+
+// NewLogSynthesizer creates a new log synthesizer for a given recipe. The
+// recipe's generation.logs section may set the format, level shares and
+// templates; the defaults are a typical service log.
+func NewLogSynthesizer(recipe *Recipe, seed int64, startTime time.Time) (*LogSynthesizer, error) {
+	ws, err := NewWavefrontSynthesizer(recipe, seed, startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &LogSynthesizer{
+		ws:     ws,
+		format: LogFormatText,
+		levels: defaultLogLevels,
+	}
+	if err := ls.initializeLogs(); err != nil {
+		return nil, fmt.Errorf("failed to initialize logs: %w", err)
+	}
+	return ls, nil
+}
+
+func (ls *LogSynthesizer) initializeLogs() error {
+	generation, _ := ls.ws.recipe.Generation["generation"].(map[string]interface{})
+	logs, _ := generation["logs"].(map[string]interface{})
+
+	if format, ok := logs["format"].(string); ok {
+		if format != LogFormatText && format != LogFormatJSON {
+			return fmt.Errorf("unknown log format %q", format)
+		}
+		ls.format = format
+	}
+
+	if levels, ok := logs["levels"].(map[string]interface{}); ok && len(levels) > 0 {
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		ls.levels = nil
+		for _, name := range names {
+			weight, _ := levels[name].(float64)
+			if weight <= 0 {
+				continue
+			}
+			upper := strings.ToUpper(name)
+			ls.levels = append(ls.levels, logLevel{
+				name:   upper,
+				weight: weight,
+				severe: upper == "WARN" || upper == "ERROR" || upper == "FATAL",
+			})
+		}
+		if len(ls.levels) == 0 {
+			return fmt.Errorf("no log level has a positive share")
+		}
+	}
+
+	if templates, ok := logs["templates"].([]interface{}); ok {
+		for _, t := range templates {
+			tMap, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			text, _ := tMap["template"].(string)
+			if text == "" {
+				continue
+			}
+			level, _ := tMap["level"].(string)
+			weight, ok := tMap["weight"].(float64)
+			if !ok {
+				weight = 1
+			}
+			if weight <= 0 {
+				continue
+			}
+			template, err := parseLogTemplate(text)
+			if err != nil {
+				return err
+			}
+			template.level = strings.ToUpper(level)
+			template.weight = weight
+			ls.templates = append(ls.templates, template)
+		}
+	}
+	if len(ls.templates) == 0 {
+		for _, t := range defaultLogTemplates {
+			template, err := parseLogTemplate(t.template)
+			if err != nil {
+				return err
+			}
+			template.level = t.level
+			template.weight = 1
+			ls.templates = append(ls.templates, template)
+		}
+	}
+
+	return nil
+}
+
+// parseLogTemplate splits a template at its {field} placeholders
+func parseLogTemplate(text string) (logTemplate, error) {
+	var template logTemplate
+	rest := text
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			template.parts = append(template.parts, rest)
+			return template, nil
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return logTemplate{}, fmt.Errorf("unclosed field in log template %q", text)
+		}
+		field := rest[open+1 : open+end]
+		if field == "" {
+			return logTemplate{}, fmt.Errorf("empty field in log template %q", text)
+		}
+		template.parts = append(template.parts, rest[:open])
+		template.fields = append(template.fields, field)
+		rest = rest[open+end+1:]
+	}
+}
+
+// CalculateTargetRate computes the target emission rate for current time,
+// as WavefrontSynthesizer does, and remembers the load it implies for the
+// lines emitted next
+func (ls *LogSynthesizer) CalculateTargetRate(currentTime time.Time, baseRate, multiplier, burstFactor float64) float64 {
+	rate := ls.ws.CalculateTargetRate(currentTime, baseRate, multiplier, burstFactor)
+	if baseRate > 0 {
+		ls.load = rate / baseRate
+	}
+	return rate
+}
+
+// SynthesizeLine generates a log line at currentTime. The load that
+// escalates levels is the one CalculateTargetRate last found, else the
+// intensity curve's times the multiplier.
+func (ls *LogSynthesizer) SynthesizeLine(currentTime time.Time, multiplier float64) string {
+	load := ls.load
+	if load <= 0 {
+		load = ls.ws.GetCurrentIntensity(currentTime) * multiplier
+	}
+
+	level := ls.sampleLevel(load)
+	template := ls.sampleTemplate(level)
+	ls.ws.advance(currentTime)
+	source, tags := ls.ws.drawSeries()
+
+	var message strings.Builder
+	fields := make(map[string]string, len(template.fields))
+	for i, field := range template.fields {
+		message.WriteString(template.parts[i])
+		value, ok := fields[field]
+		if !ok {
+			value = ls.fieldValue(field, level, source, tags)
+			fields[field] = value
+		}
+		message.WriteString(value)
+	}
+	message.WriteString(template.parts[len(template.parts)-1])
+
+	timestamp := currentTime.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	if ls.format == LogFormatJSON {
+		return ls.formatJSON(timestamp, level, source, message.String(), tags, fields)
+	}
+	return ls.formatText(timestamp, level, source, message.String(), tags)
+}
+
+// sampleLevel draws a level, with the severe levels' shares scaled by load
+func (ls *LogSynthesizer) sampleLevel(load float64) string {
+	escalation := math.Max(0, math.Min(load, maxLogEscalation))
+
+	total := 0.0
+	for _, level := range ls.levels {
+		total += ls.levelWeight(level, escalation)
+	}
+	target := ls.ws.rng.Float64() * total
+	for _, level := range ls.levels {
+		target -= ls.levelWeight(level, escalation)
+		if target < 0 {
+			return level.name
+		}
+	}
+	return ls.levels[len(ls.levels)-1].name
+}
+
+func (ls *LogSynthesizer) levelWeight(level logLevel, escalation float64) float64 {
+	if level.severe {
+		return level.weight * escalation
+	}
+	return level.weight
+}
+
+// sampleTemplate draws a template of the level, or of any level when none
+// is specific to it
+func (ls *LogSynthesizer) sampleTemplate(level string) logTemplate {
+	var candidates []logTemplate
+	total := 0.0
+	for _, template := range ls.templates {
+		if template.level == level {
+			candidates = append(candidates, template)
+			total += template.weight
+		}
+	}
+	if len(candidates) == 0 {
+		for _, template := range ls.templates {
+			if template.level == "" {
+				candidates = append(candidates, template)
+				total += template.weight
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ls.templates
+		for _, template := range candidates {
+			total += template.weight
+		}
+	}
+
+	target := ls.ws.rng.Float64() * total
+	for _, template := range candidates {
+		target -= template.weight
+		if target < 0 {
+			return template
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// fieldValue draws the value of a template field. Built-in fields cover
+// common log variables; any other field is a tag of the line, or a value of
+// that tag's distribution.
+func (ls *LogSynthesizer) fieldValue(field, level, source string, tags map[string]string) string {
+	rng := ls.ws.rng
+	switch field {
+	case "source":
+		return source
+	case "value":
+		return ls.ws.formatValue(ls.ws.sampleValue(ls.ws.seriesKey(source, tags)))
+	case "duration_ms":
+		return strconv.FormatInt(int64(math.Ceil(rng.ExpFloat64()*100)), 10)
+	case "id":
+		return ls.ws.uuid()
+	case "count":
+		return strconv.Itoa(rng.Intn(1000))
+	case "ip":
+		return fmt.Sprintf("10.%d.%d.%d", rng.Intn(256), rng.Intn(256), 1+rng.Intn(254))
+	case "status":
+		switch level {
+		case "ERROR", "FATAL":
+			return []string{"500", "502", "503", "504"}[rng.Intn(4)]
+		case "WARN":
+			return []string{"404", "408", "429"}[rng.Intn(3)]
+		}
+		return []string{"200", "200", "200", "201", "204"}[rng.Intn(5)]
+	}
+
+	if value, ok := tags[field]; ok {
+		return value
+	}
+	if value := ls.ws.generateTagValue(field); value != "" {
+		return value
+	}
+	return "-"
+}
+
+// formatText writes <timestamp> <LEVEL> <source> <message> then the tags
+func (ls *LogSynthesizer) formatText(timestamp, level, source, message string, tags map[string]string) string {
+	var line strings.Builder
+	line.WriteString(timestamp)
+	line.WriteString(" ")
+	line.WriteString(level)
+	line.WriteString(" ")
+	line.WriteString(source)
+	line.WriteString(" ")
+	line.WriteString(message)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		line.WriteString(" ")
+		line.WriteString(k)
+		line.WriteString("=")
+		line.WriteString(ls.ws.escapeTagValue(tags[k]))
+	}
+	return line.String()
+}
+
+// formatJSON writes an object of the timestamp, level, source, message,
+// tags and the message's field values; the fixed keys win over tags and
+// fields of the same name
+func (ls *LogSynthesizer) formatJSON(timestamp, level, source, message string, tags, fields map[string]string) string {
+	record := make(map[string]string, len(tags)+len(fields)+4)
+	for k, v := range tags {
+		record[k] = v
+	}
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["timestamp"] = timestamp
+	record["level"] = level
+	record["source"] = source
+	record["message"] = message
+
+	// Maps marshal with sorted keys, and strings always encode
+	encoded, _ := json.Marshal(record)
+	return string(encoded)
+}
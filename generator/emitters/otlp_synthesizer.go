@@ -0,0 +1,325 @@
+package emitters
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/loadgen/generator-lib/payload-synth"
+)
+
+// otlpScopeName is the instrumentation scope of synthesized metrics
+const otlpScopeName = "github.com/loadgen/emitters"
+
+// OTLP aggregation temporality
+const (
+	AggregationTemporalityDelta      = 1
+	AggregationTemporalityCumulative = 2
+)
+
+// ExportMetricsServiceRequest is the body of an OTLP metrics export. The
+// types below follow the OTLP/JSON encoding, so json.Marshal yields a body
+// for POST /v1/metrics.
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+// ResourceMetrics holds the metrics of one resource, a synthesized source
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+// Resource describes the entity producing the metrics
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+// ScopeMetrics holds the metrics of one instrumentation scope
+type ScopeMetrics struct {
+	Scope   InstrumentationScope `json:"scope"`
+	Metrics []Metric             `json:"metrics"`
+}
+
+// InstrumentationScope names what produced the metrics
+type InstrumentationScope struct {
+	Name string `json:"name"`
+}
+
+// Metric is one metric; exactly one of Gauge, Sum and Histogram is set
+type Metric struct {
+	Name      string     `json:"name"`
+	Gauge     *Gauge     `json:"gauge,omitempty"`
+	Sum       *Sum       `json:"sum,omitempty"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+}
+
+// Gauge holds sampled values
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+// Sum holds counter values
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+// Histogram holds bucketed distributions
+type Histogram struct {
+	DataPoints             []HistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+// NumberDataPoint is one value of a series
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64     `json:"timeUnixNano,string"`
+	AsDouble          float64    `json:"asDouble"`
+}
+
+// HistogramDataPoint is one distribution of a series, with explicit buckets
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64     `json:"timeUnixNano,string"`
+	Count             uint64     `json:"count,string"`
+	Sum               *float64   `json:"sum,omitempty"`
+	BucketCounts      Fixed64s   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+	Min               *float64   `json:"min,omitempty"`
+	Max               *float64   `json:"max,omitempty"`
+}
+
+// Fixed64s encodes as decimal strings, as OTLP/JSON does 64-bit integers
+type Fixed64s []uint64
+
+// MarshalJSON implements json.Marshaler
+func (f Fixed64s) MarshalJSON() ([]byte, error) {
+	values := make([]string, len(f))
+	for i, v := range f {
+		values[i] = strconv.FormatUint(v, 10)
+	}
+	return json.Marshal(values)
+}
+
+// KeyValue is a string attribute
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue holds an attribute value
+type AnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// OTLPSynthesizer generates OTLP metrics from Recipes. It draws sources,
+// tags and values from the same samplers as WavefrontSynthesizer, so both
+// outputs follow the recipe alike: sources become the host.name resource
+// attribute and tags the data point attributes.
+type OTLPSynthesizer struct {
+	ws              *WavefrontSynthesizer
+	histogramValues *payloadsynth.NumericSampler
+	bounds          []float64 // Explicit histogram bucket bounds
+	observations    float64   // Mean observations per histogram
+	lastExport      time.Time
+}
+
+// NewOTLPSynthesizer creates a new OTLP synthesizer for a given recipe
+func NewOTLPSynthesizer(recipe *Recipe, seed int64, startTime time.Time) (*OTLPSynthesizer, error) {
+	ws, err := NewWavefrontSynthesizer(recipe, seed, startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	ots := &OTLPSynthesizer{
+		ws:              ws,
+		histogramValues: ws.valueSampler,
+		observations:    defaultHistogramObservations,
+		lastExport:      startTime,
+	}
+	ots.initializeHistograms()
+	return ots, nil
+}
+
+// initializeHistograms takes histogram observations and buckets from the
+// recipe's centroid statistics, else from the value distribution
+func (ots *OTLPSynthesizer) initializeHistograms() {
+	stats, _ := ots.ws.recipe.Statistics["statistics"].(map[string]interface{})
+
+	dist, _ := stats["value_distribution"].(map[string]interface{})
+	if histStats, ok := stats["histogram_distribution"].(map[string]interface{}); ok {
+		if centroids, ok := histStats["centroid_value_distribution"].(map[string]interface{}); ok {
+			if sampler, err := ots.ws.createNumericSampler(centroids); err == nil {
+				ots.histogramValues = sampler
+				dist = centroids
+			}
+		}
+		if perHistogram, ok := histStats["count_per_histogram"].(map[string]interface{}); ok {
+			if minute, ok := perHistogram["M"].(float64); ok && minute > 0 {
+				ots.observations = minute
+			}
+		}
+	}
+
+	// Recorded bin edges make the buckets, else the recorded quantiles
+	edges := floatList(dist["bins"])
+	if len(edges) < 2 {
+		edges = nil
+		if quantiles, ok := dist["quantiles"].(map[string]interface{}); ok {
+			for _, level := range []string{"p01", "p05", "p50", "p95", "p99"} {
+				if q, ok := quantiles[level].(float64); ok {
+					edges = append(edges, q)
+				}
+			}
+		}
+	}
+	sort.Float64s(edges)
+	for i, edge := range edges {
+		if i == 0 || edge > edges[i-1] {
+			ots.bounds = append(ots.bounds, edge)
+		}
+	}
+}
+
+// SynthesizeRequest generates an export request of points data points at
+// currentTime. Sums and histograms are deltas since the previous request.
+func (ots *OTLPSynthesizer) SynthesizeRequest(currentTime time.Time, multiplier float64, points int) *ExportMetricsServiceRequest {
+	schema, _ := ots.ws.recipe.Schema["schema"].(map[string]interface{})
+	isDelta, _ := schema["is_delta"].(bool)
+	hasHistogram, _ := schema["has_histogram"].(bool)
+
+	start := uint64(ots.lastExport.UnixNano())
+	now := uint64(currentTime.UnixNano())
+	ots.lastExport = currentTime
+
+	// Points of each source share a resource; sources keep their first-seen
+	// order so a seeded synthesizer is reproducible
+	type resourcePoints struct {
+		numbers    []NumberDataPoint
+		histograms []HistogramDataPoint
+	}
+	bySource := make(map[string]*resourcePoints)
+	var sources []string
+
+	for i := 0; i < points; i++ {
+		source, tags := ots.ws.generateSeries(currentTime)
+		series := ots.ws.seriesKey(source, tags)
+		tags = ots.ws.detonateCardinalityBomb(tags, currentTime)
+		rp, ok := bySource[source]
+		if !ok {
+			rp = &resourcePoints{}
+			bySource[source] = rp
+			sources = append(sources, source)
+		}
+
+		// Same histogram share as SynthesizeLine
+		if hasHistogram && ots.ws.rng.Float64() < 0.1 {
+			point := ots.histogramPoint(multiplier)
+			point.Attributes = otlpAttributes(tags)
+			point.StartTimeUnixNano, point.TimeUnixNano = start, now
+			rp.histograms = append(rp.histograms, point)
+			continue
+		}
+
+		point := NumberDataPoint{
+			Attributes:   otlpAttributes(tags),
+			TimeUnixNano: now,
+			AsDouble:     ots.ws.sampleValue(series) * multiplier,
+		}
+		if isDelta {
+			point.StartTimeUnixNano = start
+		}
+		rp.numbers = append(rp.numbers, point)
+	}
+
+	request := &ExportMetricsServiceRequest{}
+	for _, source := range sources {
+		rp := bySource[source]
+		var metrics []Metric
+		if len(rp.numbers) > 0 {
+			metric := Metric{Name: ots.ws.recipe.MetricName}
+			if isDelta {
+				metric.Sum = &Sum{
+					DataPoints:             rp.numbers,
+					AggregationTemporality: AggregationTemporalityDelta,
+					IsMonotonic:            true,
+				}
+			} else {
+				metric.Gauge = &Gauge{DataPoints: rp.numbers}
+			}
+			metrics = append(metrics, metric)
+		}
+		if len(rp.histograms) > 0 {
+			metrics = append(metrics, Metric{
+				Name: ots.ws.recipe.MetricName,
+				Histogram: &Histogram{
+					DataPoints:             rp.histograms,
+					AggregationTemporality: AggregationTemporalityDelta,
+				},
+			})
+		}
+
+		request.ResourceMetrics = append(request.ResourceMetrics, ResourceMetrics{
+			Resource: Resource{Attributes: []KeyValue{
+				{Key: "host.name", Value: AnyValue{StringValue: source}},
+			}},
+			ScopeMetrics: []ScopeMetrics{{
+				Scope:   InstrumentationScope{Name: otlpScopeName},
+				Metrics: metrics,
+			}},
+		})
+	}
+
+	return request
+}
+
+// histogramPoint buckets observations drawn from the recipe's histogram
+// values, about the recorded count per histogram scaled by the multiplier
+func (ots *OTLPSynthesizer) histogramPoint(multiplier float64) HistogramDataPoint {
+	rng := ots.ws.rng
+	mean := ots.observations * multiplier
+	count := int(math.Max(1, math.Round(mean+math.Sqrt(mean)*rng.NormFloat64())))
+
+	point := HistogramDataPoint{
+		Count:          uint64(count),
+		BucketCounts:   make(Fixed64s, len(ots.bounds)+1),
+		ExplicitBounds: ots.bounds,
+	}
+	sum, lowest, highest := 0.0, math.Inf(1), math.Inf(-1)
+	for i := 0; i < count; i++ {
+		var v float64
+		if ots.histogramValues != nil {
+			v = ots.histogramValues.Sample(rng)
+		} else {
+			v = rng.NormFloat64()*50 + 100
+		}
+		// Buckets are upper-inclusive: (bounds[i-1], bounds[i]]
+		point.BucketCounts[sort.SearchFloat64s(ots.bounds, v)]++
+		sum += v
+		lowest = math.Min(lowest, v)
+		highest = math.Max(highest, v)
+	}
+	point.Sum, point.Min, point.Max = &sum, &lowest, &highest
+	return point
+}
+
+// otlpAttributes converts tags to attributes, sorted by key
+func otlpAttributes(tags map[string]string) []KeyValue {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		attributes = append(attributes, KeyValue{Key: k, Value: AnyValue{StringValue: tags[k]}})
+	}
+	return attributes
+}
@@ -0,0 +1,380 @@
+package emitters
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	payloadsynth "github.com/loadgen/generator-lib/payload-synth"
+)
+
+// SamplerSpec is what a sampler factory builds a field's sampler from: the
+// recipe's records of the field and the settings of its declaration
+type SamplerSpec struct {
+	Field          string                       // "source", a tag key or "value"; "" for other distributions
+	Distribution   map[string]interface{}       // Recorded distribution, if any
+	Patterns       []interface{}                // Recorded string patterns, if any
+	Model          map[string]interface{}       // Recorded n-gram model, if any
+	Generator      payloadsynth.StringGenerator // The field's pattern or n-gram generator, if any
+	MaxCardinality int                          // Constraint on distinct values, 0 for none
+	Options        map[string]interface{}       // Further settings of the declaration
+}
+
+// StringSamplerFactory builds the sampler of a source or tag field
+type StringSamplerFactory func(spec SamplerSpec) (payloadsynth.StringGenerator, error)
+
+// NumericSamplerFactory builds the sampler of a numeric distribution
+type NumericSamplerFactory func(spec SamplerSpec) (*payloadsynth.NumericSampler, error)
+
+// samplerRegistry holds the sampler types recipes may declare, under the
+// names they declare them by
+var samplerRegistry = struct {
+	sync.RWMutex
+	strings  map[string]StringSamplerFactory
+	numerics map[string]NumericSamplerFactory
+}{
+	strings: map[string]StringSamplerFactory{
+		"zipf":        func(spec SamplerSpec) (payloadsynth.StringGenerator, error) { return newZipfSampler(spec) },
+		"categorical": newTopValuesSampler,
+		"markov":      newMarkovFieldSampler,
+		"pattern":     newPatternFieldSampler,
+	},
+	numerics: map[string]NumericSamplerFactory{
+		"tdigest":  newDigestOrMixtureSampler,
+		"mixture":  newMixtureSampler,
+		"quantile": newQuantileSampler,
+	},
+}
+
+// RegisterStringSampler makes a sampler type available to the source and
+// tag fields of recipes under name, replacing any of the same name
+func RegisterStringSampler(name string, factory StringSamplerFactory) {
+	if factory == nil {
+		panic("emitters: nil string sampler factory for " + name)
+	}
+	samplerRegistry.Lock()
+	defer samplerRegistry.Unlock()
+	samplerRegistry.strings[name] = factory
+}
+
+// RegisterNumericSampler makes a sampler type available to the numeric
+// distributions of recipes under name, replacing any of the same name
+func RegisterNumericSampler(name string, factory NumericSamplerFactory) {
+	if factory == nil {
+		panic("emitters: nil numeric sampler factory for " + name)
+	}
+	samplerRegistry.Lock()
+	defer samplerRegistry.Unlock()
+	samplerRegistry.numerics[name] = factory
+}
+
+// samplerDeclaration returns the sampler type the recipe's
+// generation.samplers declares for a field, as a name or an object of the
+// name under "sampler" and its options, or "" when it declares none
+func (ws *WavefrontSynthesizer) samplerDeclaration(field string) (string, map[string]interface{}) {
+	generation, _ := ws.recipe.Generation["generation"].(map[string]interface{})
+	samplers, _ := generation["samplers"].(map[string]interface{})
+	switch declaration := samplers[field].(type) {
+	case string:
+		return declaration, nil
+	case map[string]interface{}:
+		name, _ := declaration["sampler"].(string)
+		return name, declaration
+	}
+	return "", nil
+}
+
+// samplerFields returns the tag keys with a recorded distribution or a
+// declared sampler, sorted
+func (ws *WavefrontSynthesizer) samplerFields(tagDists map[string]interface{}) []string {
+	fields := make(map[string]bool, len(tagDists))
+	for tagKey := range tagDists {
+		fields[tagKey] = true
+	}
+	generation, _ := ws.recipe.Generation["generation"].(map[string]interface{})
+	samplers, _ := generation["samplers"].(map[string]interface{})
+	for field := range samplers {
+		if field != "source" && field != "value" {
+			fields[field] = true
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for field := range fields {
+		keys = append(keys, field)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// samplerSpec gathers the recipe's records of a field
+func (ws *WavefrontSynthesizer) samplerSpec(field string, dist, options map[string]interface{}) SamplerSpec {
+	spec := SamplerSpec{
+		Field:          field,
+		Distribution:   dist,
+		Generator:      ws.stringPatterns[field],
+		MaxCardinality: ws.maxCardinality(field),
+		Options:        options,
+	}
+	patterns, _ := ws.recipe.Patterns["patterns"].(map[string]interface{})
+	if field == "source" {
+		spec.Patterns, _ = patterns["source_patterns"].([]interface{})
+		spec.Model, _ = patterns["source_model"].(map[string]interface{})
+	} else {
+		tagPatterns, _ := patterns["tag_value_patterns"].(map[string]interface{})
+		spec.Patterns, _ = tagPatterns[field].([]interface{})
+		tagModels, _ := patterns["tag_value_models"].(map[string]interface{})
+		spec.Model, _ = tagModels[field].(map[string]interface{})
+	}
+	return spec
+}
+
+// createStringSampler builds the sampler of a source or tag field of the
+// declared type, by default the Zipf-tailed distribution when one is
+// recorded. It returns nil when there is neither, leaving the field to its
+// pattern or n-gram generator.
+func (ws *WavefrontSynthesizer) createStringSampler(field string, dist map[string]interface{}) (payloadsynth.StringGenerator, error) {
+	name, options := ws.samplerDeclaration(field)
+	if name == "" {
+		if dist == nil {
+			return nil, nil
+		}
+		name = "zipf"
+	}
+
+	samplerRegistry.RLock()
+	factory, ok := samplerRegistry.strings[name]
+	samplerRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sampler %q", name)
+	}
+	return factory(ws.samplerSpec(field, dist, options))
+}
+
+// createNumericSampler builds the sampler of a numeric distribution of the
+// recipe's value_sampler type, by default the recorded t-digest when there
+// is one and else a mixture
+func (ws *WavefrontSynthesizer) createNumericSampler(dist map[string]interface{}) (*payloadsynth.NumericSampler, error) {
+	return ws.createFieldNumericSampler("", dist)
+}
+
+// createFieldNumericSampler builds the sampler of a field's distribution of
+// the type declared for the field, else of the value_sampler type
+func (ws *WavefrontSynthesizer) createFieldNumericSampler(field string, dist map[string]interface{}) (*payloadsynth.NumericSampler, error) {
+	var name string
+	var options map[string]interface{}
+	if field != "" {
+		name, options = ws.samplerDeclaration(field)
+	}
+	if name == "" {
+		generation, _ := ws.recipe.Generation["generation"].(map[string]interface{})
+		name, _ = generation["value_sampler"].(string)
+	}
+	if name == "" {
+		name = "tdigest"
+	}
+
+	samplerRegistry.RLock()
+	factory, ok := samplerRegistry.numerics[name]
+	samplerRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sampler %q", name)
+	}
+	return factory(SamplerSpec{Field: field, Distribution: dist, Options: options})
+}
+
+// newZipfSampler samples the top values of a recorded distribution, the
+// values beyond them following a Zipf tail up to the distinct count, capped
+// by the field's cardinality constraint. An "exponent" option sets the
+// tail's power law, else fit to the top values.
+func newZipfSampler(spec SamplerSpec) (*payloadsynth.CategoricalSampler, error) {
+	items, topMass, err := topValues(spec.Distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	distinct, _ := spec.Distribution["total_count"].(float64)
+	tailMass, _ := spec.Distribution["tail_mass"].(float64)
+	if limit := spec.MaxCardinality; limit > 0 && float64(limit) < distinct {
+		distinct = float64(limit)
+	}
+	if int(distinct) <= len(items) || tailMass <= 0 {
+		return payloadsynth.NewCategoricalSampler(items), nil
+	}
+
+	exponent, _ := spec.Options["exponent"].(float64)
+	return payloadsynth.NewCategoricalSamplerWithTail(items, payloadsynth.ZipfTail{
+		Distinct: int(distinct),
+		Mass:     tailMass / (topMass + tailMass),
+		Exponent: exponent,
+		Name:     tailNamer(spec.Field, spec.Generator, items),
+	}), nil
+}
+
+// newTopValuesSampler samples only the top values of a recorded
+// distribution
+func newTopValuesSampler(spec SamplerSpec) (payloadsynth.StringGenerator, error) {
+	items, _, err := topValues(spec.Distribution)
+	if err != nil {
+		return nil, err
+	}
+	return payloadsynth.NewCategoricalSampler(items), nil
+}
+
+// topValues reads a distribution's top values and their combined frequency
+func topValues(dist map[string]interface{}) ([]payloadsynth.WeightedItem, float64, error) {
+	values, ok := dist["top_values"].([]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid top_values format")
+	}
+
+	var items []payloadsynth.WeightedItem
+	topMass := 0.0
+	for _, item := range values {
+		if itemMap, ok := item.(map[string]interface{}); ok {
+			value, _ := itemMap["value"].(string)
+			frequency, _ := itemMap["frequency"].(float64)
+			items = append(items, payloadsynth.WeightedItem{
+				Value:  value,
+				Weight: frequency,
+			})
+			topMass += frequency
+		}
+	}
+	return items, topMass, nil
+}
+
+// tailNamer names tail values with the field's string generator, keeping
+// them distinct from the top values
+func tailNamer(field string, generator payloadsynth.StringGenerator, items []payloadsynth.WeightedItem) func(rank int) string {
+	top := make(map[string]bool, len(items))
+	for _, item := range items {
+		top[item.Value] = true
+	}
+
+	name := payloadsynth.TailNamer(field, generator)
+	return func(rank int) string {
+		value := name(rank)
+		if top[value] {
+			value = fmt.Sprintf("%s-%d", value, rank)
+		}
+		return value
+	}
+}
+
+// newMarkovFieldSampler generates values from the field's n-gram model
+func newMarkovFieldSampler(spec SamplerSpec) (payloadsynth.StringGenerator, error) {
+	if spec.Model == nil {
+		return nil, fmt.Errorf("no n-gram model for %s", spec.Field)
+	}
+	return newMarkovSampler(spec.Model)
+}
+
+// newPatternFieldSampler generates values from the field's patterns
+func newPatternFieldSampler(spec SamplerSpec) (payloadsynth.StringGenerator, error) {
+	if len(spec.Patterns) == 0 {
+		return nil, fmt.Errorf("no string patterns for %s", spec.Field)
+	}
+	return newStringPatternSampler(spec.Patterns), nil
+}
+
+// newDigestOrMixtureSampler samples the recorded t-digest, extended to the
+// recorded range, or a mixture when none is recorded
+func newDigestOrMixtureSampler(spec SamplerSpec) (*payloadsynth.NumericSampler, error) {
+	dist := spec.Distribution
+	centroids, ok := dist["centroids"].([]interface{})
+	if !ok {
+		return newMixtureSampler(spec)
+	}
+
+	digest := make([]payloadsynth.Centroid, 0, len(centroids))
+	for _, c := range centroids {
+		if cMap, ok := c.(map[string]interface{}); ok {
+			mean, _ := cMap["mean"].(float64)
+			count, _ := cMap["count"].(float64)
+			digest = append(digest, payloadsynth.Centroid{Mean: mean, Count: count})
+		}
+	}
+
+	var lowest, highest *float64
+	if v, ok := dist["min"].(float64); ok {
+		lowest = &v
+	}
+	if v, ok := dist["max"].(float64); ok {
+		highest = &v
+	}
+	sampler, err := payloadsynth.NewTDigestSampler(digest, lowest, highest)
+	if err != nil {
+		return newMixtureSampler(spec)
+	}
+	return sampler, nil
+}
+
+// newMixtureSampler fits a mixture to the recorded quantiles, histogram,
+// range and point masses, falling back to quantile interpolation
+func newMixtureSampler(spec SamplerSpec) (*payloadsynth.NumericSampler, error) {
+	dist := spec.Distribution
+	quantiles, err := recordedQuantiles(dist)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := payloadsynth.ValueProfile{
+		Quantiles: []payloadsynth.QuantilePoint{
+			{Level: 0.01, Value: quantiles[0]},
+			{Level: 0.05, Value: quantiles[1]},
+			{Level: 0.50, Value: quantiles[2]},
+			{Level: 0.95, Value: quantiles[3]},
+			{Level: 0.99, Value: quantiles[4]},
+		},
+		Bins:   floatList(dist["bins"]),
+		Counts: floatList(dist["counts"]),
+	}
+	if min, ok := dist["min"].(float64); ok {
+		profile.Min = &min
+	}
+	if max, ok := dist["max"].(float64); ok {
+		profile.Max = &max
+	}
+	if masses, ok := dist["point_masses"].([]interface{}); ok {
+		for _, mass := range masses {
+			if massMap, ok := mass.(map[string]interface{}); ok {
+				value, _ := massMap["value"].(float64)
+				frequency, _ := massMap["frequency"].(float64)
+				profile.PointMasses = append(profile.PointMasses, payloadsynth.PointMass{
+					Value:  value,
+					Weight: frequency,
+				})
+			}
+		}
+	}
+
+	sampler, err := payloadsynth.NewMixtureSampler(profile)
+	if err != nil {
+		return payloadsynth.NewQuantileSampler(quantiles), nil
+	}
+	return sampler, nil
+}
+
+// newQuantileSampler interpolates between the recorded quantiles
+func newQuantileSampler(spec SamplerSpec) (*payloadsynth.NumericSampler, error) {
+	quantiles, err := recordedQuantiles(spec.Distribution)
+	if err != nil {
+		return nil, err
+	}
+	return payloadsynth.NewQuantileSampler(quantiles), nil
+}
+
+// recordedQuantiles reads a distribution's p01, p05, p50, p95 and p99
+func recordedQuantiles(dist map[string]interface{}) ([]float64, error) {
+	quantiles, ok := dist["quantiles"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid quantiles format")
+	}
+	values := make([]float64, 0, 5)
+	for _, level := range []string{"p01", "p05", "p50", "p95", "p99"} {
+		value, _ := quantiles[level].(float64)
+		values = append(values, value)
+	}
+	return values, nil
+}
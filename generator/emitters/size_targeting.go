@@ -0,0 +1,136 @@
+package emitters
+
+import (
+	"math"
+	"sort"
+)
+
+// maxSizePrecision bounds the decimals a value is given to lengthen a line
+const maxSizePrecision = 12
+
+// initializeSizeTargeting reads the recipe's line size distribution and
+// the tags it may add or drop to reach it: those not on every line, most
+// present first
+func (ws *WavefrontSynthesizer) initializeSizeTargeting(payload map[string]interface{}) {
+	dist, ok := payload["size_distribution"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	sampler, err := ws.createNumericSampler(dist)
+	if err != nil {
+		return
+	}
+	ws.lineSizes = sampler
+
+	schema, _ := ws.recipe.Schema["schema"].(map[string]interface{})
+	tagSchema, _ := schema["tag_schema"].(map[string]interface{})
+	presences := make(map[string]float64)
+	for tagKey, entry := range tagSchema {
+		if schemaMap, ok := entry.(map[string]interface{}); ok {
+			if presence, _ := schemaMap["presence"].(float64); presence < 1 {
+				presences[tagKey] = presence
+				ws.optionalTags = append(ws.optionalTags, tagKey)
+			}
+		}
+	}
+	sort.Slice(ws.optionalTags, func(i, j int) bool {
+		a, b := ws.optionalTags[i], ws.optionalTags[j]
+		if presences[a] != presences[b] {
+			return presences[a] > presences[b]
+		}
+		return a < b
+	})
+}
+
+// SetSizeTargeting turns on the size-targeting mode: each metric line is
+// fitted to a length drawn from the recipe's line size distribution, so
+// the bytes per line match the reference as collector buffers see them.
+// Recipes without a size distribution are unaffected.
+func (ws *WavefrontSynthesizer) SetSizeTargeting(enabled bool) {
+	ws.targetSizes = enabled
+}
+
+// fitSize adjusts a metric line of size bytes towards a length drawn from
+// the size distribution. Optional tags are dropped from a long line, least
+// present first, and drawn for a short one, most present first; the
+// value's precision then takes up what difference it can. It returns the
+// tags, copied if changed, and the precision to write the value at.
+func (ws *WavefrontSynthesizer) fitSize(size int, value float64, tags map[string]string) (map[string]string, int) {
+	target := int(math.Round(ws.lineSizes.Sample(ws.rng)))
+	precision := valuePrecision(value)
+
+	// Tags are copied before the first change, since those of the active
+	// series are shared
+	fitted := tags
+	copied := false
+	change := func() {
+		if !copied {
+			fitted = make(map[string]string, len(tags)+1)
+			for k, v := range tags {
+				fitted[k] = v
+			}
+			copied = true
+		}
+	}
+
+	if size > target {
+		for i := len(ws.optionalTags) - 1; i >= 0 && size > target; i-- {
+			key := ws.optionalTags[i]
+			if v, ok := fitted[key]; ok {
+				change()
+				delete(fitted, key)
+				size -= tagSize(key, v)
+			}
+		}
+	} else {
+		for _, key := range ws.optionalTags {
+			if size >= target {
+				break
+			}
+			if _, ok := fitted[key]; ok {
+				continue
+			}
+			v := ws.generateTagValue(key)
+			if v == "" || size+tagSize(key, v) > target {
+				continue
+			}
+			change()
+			fitted[key] = v
+			size += tagSize(key, v)
+		}
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fitted, precision
+	}
+
+	// A value has no decimals at precision 0, else a point and precision
+	// digits
+	width := precision
+	if precision > 0 {
+		width++
+	}
+	width += target - size
+	precision = int(math.Max(0, math.Min(float64(width-1), maxSizePrecision)))
+	return fitted, precision
+}
+
+// tagSize is the length of " key=value", with the value escaped as
+// appendTagValue does
+func tagSize(key, value string) int {
+	size := 2 + len(key) + len(value)
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\':
+			size++
+			quoted = true
+		case ' ', '=':
+			quoted = true
+		}
+	}
+	if quoted {
+		size += 2
+	}
+	return size
+}
@@ -0,0 +1,264 @@
+package emitters
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loadgen/generator-lib/payload-synth"
+)
+
+// Trace shape bounds and the defaults for recipes without trace_shape
+const (
+	defaultChildrenPerSpan = 1.5
+	childFanoutDecay       = 0.5 // Share of the expected children kept per level deeper
+	maxTraceDepth          = 6
+	maxTraceSpans          = 100
+	defaultApplication     = "loadgen"
+)
+
+// traceShape holds the samplers a trace is built from
+type traceShape struct {
+	durations       *payloadsynth.NumericSampler // Root span duration, ms
+	childrenPerSpan *payloadsynth.NumericSampler
+	childOperations *payloadsynth.CategoricalSampler
+	durationRatio   *payloadsynth.NumericSampler // Child duration over its parent's
+}
+
+// traceSpan is one span of a synthesized trace
+type traceSpan struct {
+	operation  string
+	source     string
+	tags       map[string]string
+	traceID    string
+	spanID     string
+	parentID   string
+	startMs    int64
+	durationMs int64
+	depth      int // Root at 0
+}
+
+// initializeTraceShape builds the trace samplers from a span recipe's
+// statistics; missing statistics keep the defaults
+func (ws *WavefrontSynthesizer) initializeTraceShape(spanDist map[string]interface{}) {
+	ws.traceShape = &traceShape{}
+	if dist, ok := spanDist["duration_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			ws.traceShape.durations = sampler
+		}
+	}
+
+	shape, ok := spanDist["trace_shape"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if dist, ok := shape["children_per_span"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			ws.traceShape.childrenPerSpan = sampler
+		}
+	}
+	if dist, ok := shape["child_operation_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createCategoricalSampler("operation", dist); err == nil {
+			ws.traceShape.childOperations = sampler
+		}
+	}
+	if dist, ok := shape["child_duration_ratio"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			ws.traceShape.durationRatio = sampler
+		}
+	}
+}
+
+// SynthesizeTrace generates a complete trace from a span recipe: a root span
+// of the recipe's operation and a tree of descendants, one Wavefront span
+// line each, root first. Every span carries the traceId, spanId,
+// application and service tags Wavefront requires, and children carry
+// their parent's spanId and fit inside its duration.
+func (ws *WavefrontSynthesizer) SynthesizeTrace(currentTime time.Time, multiplier float64) ([]string, error) {
+	root, err := ws.rootSpan(currentTime)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := []*traceSpan{root}
+	for i := 0; i < len(spans) && len(spans) < maxTraceSpans; i++ {
+		spans = append(spans, ws.childSpans(spans[i], maxTraceSpans-len(spans))...)
+	}
+
+	lines := make([]string, len(spans))
+	for i, span := range spans {
+		lines[i] = ws.formatSpan(span)
+		if ws.sampledForValidation() {
+			ws.validate(lines[i])
+		}
+	}
+	return lines, nil
+}
+
+// rootSpan draws a parentless span of the recipe's operation
+func (ws *WavefrontSynthesizer) rootSpan(currentTime time.Time) (*traceSpan, error) {
+	schema, ok := ws.recipe.Schema["schema"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema format")
+	}
+
+	schemaType, _ := schema["type"].(string)
+	if schemaType != "span" {
+		return nil, fmt.Errorf("recipe is not for spans")
+	}
+
+	durationMs := ws.rng.ExpFloat64() * 1000 // Exponential, 1s mean
+	if ws.traceShape != nil && ws.traceShape.durations != nil {
+		durationMs = ws.traceShape.durations.Sample(ws.rng)
+	}
+
+	ws.advance(currentTime)
+	source, tags := ws.drawSeries()
+	span := &traceSpan{
+		operation:  ws.recipe.MetricName,
+		source:     source,
+		tags:       tags,
+		traceID:    ws.uuid(),
+		spanID:     ws.uuid(),
+		startMs:    currentTime.UnixMilli(),
+		durationMs: int64(math.Max(1, math.Round(durationMs))),
+	}
+	if span.tags["application"] == "" {
+		span.tags["application"] = defaultApplication
+	}
+	if span.tags["service"] == "" {
+		span.tags["service"] = span.operation
+	}
+	return span, nil
+}
+
+// childSpans draws the children of a span, at most limit. Their durations
+// are shares of the parent's; they run one after another when they fit,
+// else overlap as parallel calls.
+func (ws *WavefrontSynthesizer) childSpans(parent *traceSpan, limit int) []*traceSpan {
+	if parent.depth+1 >= maxTraceDepth || limit <= 0 || parent.durationMs < 2 {
+		return nil
+	}
+
+	expected := defaultChildrenPerSpan
+	if ws.traceShape != nil && ws.traceShape.childrenPerSpan != nil {
+		expected = ws.traceShape.childrenPerSpan.Sample(ws.rng)
+	}
+	expected *= math.Pow(childFanoutDecay, float64(parent.depth))
+	n := int(expected)
+	if ws.rng.Float64() < expected-float64(n) {
+		n++
+	}
+	if n > limit {
+		n = limit
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// Child durations, from the recorded ratios or else splitting 80% of
+	// the parent among the children
+	durations := make([]int64, n)
+	var total int64
+	for i := range durations {
+		ratio := 0.8 / float64(n) * (0.5 + ws.rng.Float64())
+		if ws.traceShape != nil && ws.traceShape.durationRatio != nil {
+			ratio = ws.traceShape.durationRatio.Sample(ws.rng)
+		}
+		ratio = math.Max(0, math.Min(ratio, 1))
+		durations[i] = int64(math.Max(1, math.Round(ratio*float64(parent.durationMs))))
+		total += durations[i]
+	}
+
+	children := make([]*traceSpan, n)
+	slack := parent.durationMs - total
+	offset := int64(0)
+	for i, duration := range durations {
+		var start int64
+		if slack >= 0 {
+			// Sequential, with the slack spread over the gaps
+			offset += int64(ws.rng.Float64() * float64(slack) / float64(n))
+			start = offset
+			offset += duration
+		} else {
+			start = int64(ws.rng.Float64() * float64(parent.durationMs-duration))
+		}
+		children[i] = ws.childSpan(parent, parent.startMs+start, duration)
+	}
+	return children
+}
+
+func (ws *WavefrontSynthesizer) childSpan(parent *traceSpan, startMs, durationMs int64) *traceSpan {
+	operation := parent.operation
+	if ws.traceShape != nil && ws.traceShape.childOperations != nil {
+		if op := ws.traceShape.childOperations.Sample(ws.rng); op != "" {
+			operation = op
+		}
+	}
+
+	source, tags := ws.drawSeries()
+	span := &traceSpan{
+		operation:  operation,
+		source:     source,
+		tags:       tags,
+		traceID:    parent.traceID,
+		spanID:     ws.uuid(),
+		parentID:   parent.spanID,
+		startMs:    startMs,
+		durationMs: durationMs,
+		depth:      parent.depth + 1,
+	}
+	// A trace belongs to one application; a child without its own service
+	// runs in its parent's
+	span.tags["application"] = parent.tags["application"]
+	if span.tags["service"] == "" {
+		span.tags["service"] = parent.tags["service"]
+	}
+	return span
+}
+
+// formatSpan writes a span line:
+// <operation> source=<source> traceId=<id> spanId=<id> [parent=<id>] <spanTags> <start_ms> <duration_ms>
+func (ws *WavefrontSynthesizer) formatSpan(span *traceSpan) string {
+	var line strings.Builder
+	line.WriteString(ws.escapeTagValue(span.operation))
+	line.WriteString(" source=")
+	line.WriteString(ws.escapeTagValue(span.source))
+	line.WriteString(" traceId=")
+	line.WriteString(span.traceID)
+	line.WriteString(" spanId=")
+	line.WriteString(span.spanID)
+	if span.parentID != "" {
+		line.WriteString(" parent=")
+		line.WriteString(span.parentID)
+	}
+
+	for key, val := range span.tags {
+		switch key {
+		case "traceId", "spanId", "parent":
+			continue
+		}
+		line.WriteString(" ")
+		line.WriteString(key)
+		line.WriteString("=")
+		line.WriteString(ws.escapeTagValue(val))
+	}
+
+	line.WriteString(" ")
+	line.WriteString(strconv.FormatInt(span.startMs, 10))
+	line.WriteString(" ")
+	line.WriteString(strconv.FormatInt(span.durationMs, 10))
+	return line.String()
+}
+
+// uuid draws a random (version 4) UUID from the synthesizer's generator, so
+// a seeded synthesizer repeats its IDs
+func (ws *WavefrontSynthesizer) uuid() string {
+	var b [16]byte
+	ws.rng.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -11,20 +11,53 @@ import (
 	"time"
 
 	"github.com/loadgen/generator-lib/payload-synth"
+	"github.com/loadgen/generator-lib/payload-synth/temporal"
 )
 
+// maxDeltaSeries bounds the delta counter series accumulated within a
+// minute; lines of further series carry only their own increment
+const maxDeltaSeries = 100000
+
+// defaultHostDowntime is how long, in seconds, a restarting host is silent
+const defaultHostDowntime = 30
+
 // WavefrontSynthesizer generates realistic Wavefront lines from Recipes
 type WavefrontSynthesizer struct {
 	recipe           *Recipe
 	rng              *rand.Rand
-	tagSamplers      map[string]*payloadsynth.CategoricalSampler
-	sourceSampler    *payloadsynth.CategoricalSampler
+	tagSamplers      map[string]payloadsynth.StringGenerator
+	sourceSampler    payloadsynth.StringGenerator
 	valueSampler     *payloadsynth.NumericSampler
-	intensityCurve   []float64
+	seriesModel      *payloadsynth.SeriesModel
+	traceShape       *traceShape
+	histogramShape   *histogramShape
+	lineSizes        *payloadsynth.NumericSampler // Recipe's bytes per line
+	optionalTags     []string                     // Tag keys not on every line, most present first
+	targetSizes      bool
+	topology         *payloadsynth.Topology
+	hostTagKeys      []string // Tag keys fixed per host
+	churn            *payloadsynth.SeriesChurn
+	churnField       string // Source or tag key naming a series' instance
+	bombFraction     float64 // Share of lines with unbounded-cardinality tags
+	edgeCaseRate     float64 // Share of names and values made edge cases
+	validateEvery    int     // Lines between validated ones, 0 when off
+	sinceValidated   int
+	onInvalid        func(line string, err error)
+	nameFragments    [2][]byte // Escaped recipe metric name, plain and delta
+	intensity        *temporal.Intensity
 	currentMinute    int
 	startTime        time.Time
-	deltaAccumulator map[string]float64
-	stringPatterns   map[string]*payloadsynth.StringPatternSampler
+	deltaAccumulator map[string]float64 // Per series, within deltaMinute
+	deltaMinute      int64
+	stringPatterns   map[string]payloadsynth.StringGenerator
+	tagCorrelations  *payloadsynth.CorrelatedTagSampler
+	burst            *temporal.Process
+	burstFano        float64 // Recipe's Fano factor of per-minute counts
+	lastRateTime     time.Time
+	drift            DriftSchedule
+	driftLevel       float64             // Strength reached, 0 to 1
+	driftShift       float64             // Relative change of values reached
+	driftValues      map[string][]string // Introduced values, by tag key
 }
 
 // Recipe represents a loaded Wavefront family recipe
@@ -34,6 +67,7 @@ type Recipe struct {
 	Schema      map[string]interface{} `json:"schema"`
 	Statistics  map[string]interface{} `json:"statistics"`
 	Temporal    map[string]interface{} `json:"temporal"`
+	Payload     map[string]interface{} `json:"payload"`
 	Patterns    map[string]interface{} `json:"patterns"`
 	Generation  map[string]interface{} `json:"generation"`
 	Validation  map[string]interface{} `json:"validation"`
@@ -44,10 +78,12 @@ func NewWavefrontSynthesizer(recipe *Recipe, seed int64, startTime time.Time) (*
 	ws := &WavefrontSynthesizer{
 		recipe:           recipe,
 		rng:              rand.New(rand.NewSource(seed)),
-		tagSamplers:      make(map[string]*payloadsynth.CategoricalSampler),
+		tagSamplers:      make(map[string]payloadsynth.StringGenerator),
 		startTime:        startTime,
 		deltaAccumulator: make(map[string]float64),
-		stringPatterns:   make(map[string]*payloadsynth.StringPatternSampler),
+		stringPatterns:   make(map[string]payloadsynth.StringGenerator),
+		burst:            temporal.NewProcess(temporal.Params{}),
+		intensity:        &temporal.Intensity{Anchor: startTime, Start: startTime},
 	}
 
 	if err := ws.initializeSamplers(); err != nil {
@@ -63,113 +99,372 @@ func (ws *WavefrontSynthesizer) initializeSamplers() error {
 		return fmt.Errorf("invalid statistics format in recipe")
 	}
 
-	// Initialize source sampler
-	if sourceDist, ok := stats["source_distribution"].(map[string]interface{}); ok {
-		sampler, err := ws.createCategoricalSampler(sourceDist)
+	// Initialize string pattern samplers first; they name the tail values
+	// of the categorical samplers
+	if patterns, ok := ws.recipe.Patterns["patterns"].(map[string]interface{}); ok {
+		ws.initializeStringPatterns(patterns)
+	}
+
+	// Initialize source sampler, of the type the recipe declares or the
+	// Zipf-tailed distribution
+	sourceDist, _ := stats["source_distribution"].(map[string]interface{})
+	sampler, err := ws.createStringSampler("source", sourceDist)
+	if err != nil {
+		return fmt.Errorf("failed to create source sampler: %w", err)
+	}
+	ws.sourceSampler = sampler
+
+	// Initialize tag samplers, of recorded distributions and of tags
+	// declaring a sampler without one
+	tagDists, _ := stats["tag_distributions"].(map[string]interface{})
+	for _, tagKey := range ws.samplerFields(tagDists) {
+		distMap, _ := tagDists[tagKey].(map[string]interface{})
+		sampler, err := ws.createStringSampler(tagKey, distMap)
 		if err != nil {
-			return fmt.Errorf("failed to create source sampler: %w", err)
+			return fmt.Errorf("failed to create tag sampler for %s: %w", tagKey, err)
+		}
+		if sampler != nil {
+			ws.tagSamplers[tagKey] = sampler
 		}
-		ws.sourceSampler = sampler
 	}
 
-	// Initialize tag samplers
-	if tagDists, ok := stats["tag_distributions"].(map[string]interface{}); ok {
-		for tagKey, dist := range tagDists {
-			if distMap, ok := dist.(map[string]interface{}); ok {
-				sampler, err := ws.createCategoricalSampler(distMap)
-				if err != nil {
-					return fmt.Errorf("failed to create tag sampler for %s: %w", tagKey, err)
+	// Initialize correlated tag sampling from pairwise co-occurrence
+	if cooccurrence, ok := stats["tag_cooccurrence"].([]interface{}); ok {
+		var combinations []payloadsynth.TagCombination
+		for _, combo := range cooccurrence {
+			if comboMap, ok := combo.(map[string]interface{}); ok {
+				tagMap, _ := comboMap["tags"].(map[string]interface{})
+				frequency, _ := comboMap["frequency"].(float64)
+				tags := make(map[string]string, len(tagMap))
+				for k, v := range tagMap {
+					if value, ok := v.(string); ok {
+						tags[k] = value
+					}
 				}
-				ws.tagSamplers[tagKey] = sampler
+				combinations = append(combinations, payloadsynth.TagCombination{
+					Tags:   tags,
+					Weight: frequency,
+				})
 			}
 		}
+		if sampler := payloadsynth.NewCorrelatedTagSampler(combinations); !sampler.Empty() {
+			ws.tagCorrelations = sampler
+		}
+	}
+
+	// Initialize trace samplers for span recipes
+	if spanDist, ok := stats["span_distribution"].(map[string]interface{}); ok {
+		ws.initializeTraceShape(spanDist)
 	}
 
 	// Initialize value sampler
 	if valueDist, ok := stats["value_distribution"].(map[string]interface{}); ok {
-		sampler, err := ws.createNumericSampler(valueDist)
+		sampler, err := ws.createFieldNumericSampler("value", valueDist)
 		if err != nil {
 			return fmt.Errorf("failed to create value sampler: %w", err)
 		}
 		ws.valueSampler = sampler
 	}
 
-	// Initialize intensity curve
-	if temporal, ok := ws.recipe.Temporal["temporal"].(map[string]interface{}); ok {
-		if curve, ok := temporal["intensity_curve"].([]interface{}); ok {
-			ws.intensityCurve = make([]float64, len(curve))
-			for i, v := range curve {
-				if f, ok := v.(float64); ok {
-					ws.intensityCurve[i] = f
-				} else {
-					ws.intensityCurve[i] = 1.0
-				}
+	// Initialize intensity curve, burstiness and series evolution
+	if temporalStats, ok := ws.recipe.Temporal["temporal"].(map[string]interface{}); ok {
+		ws.initializeIntensity(temporalStats)
+		if burstiness, ok := temporalStats["burstiness"].(map[string]interface{}); ok {
+			ws.burstFano, _ = burstiness["fano_factor"].(float64)
+		}
+
+		// Evolve each series' values with the recipe's autocorrelation
+		if acf, ok := temporalStats["value_autocorrelation"].(map[string]interface{}); ok && ws.valueSampler != nil {
+			var lags []int
+			for _, lag := range floatList(acf["lags"]) {
+				lags = append(lags, int(lag))
+			}
+			if phi := payloadsynth.FitAR1(lags, floatList(acf["values"])); phi > 0 {
+				ws.seriesModel = payloadsynth.NewSeriesModel(ws.valueSampler, phi, ws.rng)
 			}
 		}
 	}
 
-	// Initialize string pattern samplers
-	if patterns, ok := ws.recipe.Patterns["patterns"].(map[string]interface{}); ok {
-		ws.initializeStringPatterns(patterns)
+	// Initialize histogram shape, whose values default to the value
+	// distribution
+	ws.initializeHistogramShape(stats)
+
+	// Initialize line size targets
+	if payload, ok := ws.recipe.Payload["payload"].(map[string]interface{}); ok {
+		ws.initializeSizeTargeting(payload)
+	}
+
+	// Initialize host topology and series churn
+	if generation, ok := ws.recipe.Generation["generation"].(map[string]interface{}); ok {
+		ws.initializeTopology(generation)
+		ws.initializeChurn(generation)
 	}
 
 	return nil
 }
 
-func (ws *WavefrontSynthesizer) createCategoricalSampler(dist map[string]interface{}) (*payloadsynth.CategoricalSampler, error) {
-	topValues, ok := dist["top_values"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid top_values format")
+// initializeIntensity reads the intensity curve, daily or weekly, with its
+// trends and holiday overrides. A curve with a recorded start keeps its
+// phase of the day and week; otherwise it starts with the synthesizer.
+func (ws *WavefrontSynthesizer) initializeIntensity(temporalStats map[string]interface{}) {
+	if curve, ok := temporalStats["intensity_curve"].([]interface{}); ok {
+		ws.intensity.Curve = make([]float64, len(curve))
+		for i, v := range curve {
+			if f, ok := v.(float64); ok {
+				ws.intensity.Curve[i] = f
+			} else {
+				ws.intensity.Curve[i] = 1.0
+			}
+		}
+	}
+	if start, ok := temporalStats["intensity_curve_start"].(string); ok {
+		if anchor, err := time.Parse(time.RFC3339, start); err == nil {
+			ws.intensity.Anchor = anchor
+		}
 	}
 
-	var items []payloadsynth.WeightedItem
-	for _, item := range topValues {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			value, _ := itemMap["value"].(string)
-			frequency, _ := itemMap["frequency"].(float64)
-			items = append(items, payloadsynth.WeightedItem{
-				Value:  value,
-				Weight: frequency,
-			})
+	if trends, ok := temporalStats["trends"].([]interface{}); ok {
+		for _, t := range trends {
+			tMap, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			trend := temporal.Trend{}
+			trend.Kind, _ = tMap["type"].(string)
+			trend.PerDay, _ = tMap["per_day"].(float64)
+			trend.Delta, _ = tMap["delta"].(float64)
+			trend.Amplitude, _ = tMap["amplitude"].(float64)
+			if at, ok := tMap["at"].(string); ok {
+				trend.At, _ = time.Parse(time.RFC3339, at)
+			}
+			if hours, ok := tMap["period_hours"].(float64); ok {
+				trend.Period = time.Duration(hours * float64(time.Hour))
+			}
+			if hours, ok := tMap["phase_hours"].(float64); ok {
+				trend.Phase = time.Duration(hours * float64(time.Hour))
+			}
+			ws.intensity.Trends = append(ws.intensity.Trends, trend)
 		}
 	}
 
-	return payloadsynth.NewCategoricalSampler(items), nil
+	if holidays, ok := temporalStats["holidays"].([]interface{}); ok {
+		for _, h := range holidays {
+			hMap, ok := h.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			startStr, _ := hMap["start"].(string)
+			endStr, _ := hMap["end"].(string)
+			start, err := time.Parse(time.RFC3339, startStr)
+			if err != nil {
+				continue
+			}
+			end, err := time.Parse(time.RFC3339, endStr)
+			if err != nil {
+				continue
+			}
+			override := temporal.Override{Start: start, End: end, Scale: 1}
+			if intensity, ok := hMap["intensity"].(float64); ok {
+				override.Intensity = &intensity
+			} else if scale, ok := hMap["scale"].(float64); ok {
+				override.Scale = scale
+			}
+			ws.intensity.Overrides = append(ws.intensity.Overrides, override)
+		}
+	}
 }
 
-func (ws *WavefrontSynthesizer) createNumericSampler(dist map[string]interface{}) (*payloadsynth.NumericSampler, error) {
-	quantiles, ok := dist["quantiles"].(map[string]interface{})
+// initializeTopology sets up the family's fleet of hosts from the recipe's
+// entity hints: the estimated source count, each host's rate share drawn
+// from the per-source rate distribution, and the topology's host-level tags
+// and lifecycle rates. Recipes without a source count draw every line's
+// source afresh.
+func (ws *WavefrontSynthesizer) initializeTopology(generation map[string]interface{}) {
+	hints, _ := generation["entity_hints"].(map[string]interface{})
+	hosts, _ := hints["source_count_estimate"].(float64)
+	if hosts < 1 {
+		return
+	}
+	params := payloadsynth.TopologyParams{
+		Hosts:    int(hosts),
+		Downtime: defaultHostDowntime,
+	}
+	if dist, ok := hints["per_source_rate_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			params.Shares = sampler
+		}
+	}
+	if topology, ok := hints["topology"].(map[string]interface{}); ok {
+		keys, _ := topology["host_tag_keys"].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.(string); ok {
+				ws.hostTagKeys = append(ws.hostTagKeys, k)
+			}
+		}
+		if rate, ok := topology["restart_rate_per_host_hour"].(float64); ok {
+			params.RestartRate = rate / 3600
+		}
+		if rate, ok := topology["replacement_rate_per_host_hour"].(float64); ok {
+			params.ReplacementRate = rate / 3600
+		}
+	}
+	ws.topology = payloadsynth.NewTopology(params)
+}
+
+// initializeChurn sets up the rotation of the active series set from the
+// recipe's churn hints. Recipes without them, or whose series never retire,
+// draw every line's series afresh.
+func (ws *WavefrontSynthesizer) initializeChurn(generation map[string]interface{}) {
+	hints, _ := generation["entity_hints"].(map[string]interface{})
+	churn, ok := hints["series_churn"].(map[string]interface{})
 	if !ok {
-		return nil, fmt.Errorf("invalid quantiles format")
+		return
+	}
+
+	birthRate, _ := churn["birth_rate_per_hour"].(float64)
+	meanLifetime, _ := churn["mean_lifetime_seconds"].(float64)
+	if birthRate <= 0 || meanLifetime <= 0 {
+		return
+	}
+	params := payloadsynth.ChurnParams{
+		BirthRate:    birthRate / 3600,
+		MeanLifetime: meanLifetime,
+	}
+	if dist, ok := churn["lifetime_distribution"].(map[string]interface{}); ok {
+		if sampler, err := ws.createNumericSampler(dist); err == nil {
+			params.Lifetimes = sampler
+		}
+	}
+
+	ws.churn = payloadsynth.NewSeriesChurn(params)
+	ws.churnField = "source"
+	if settings, ok := generation["series_churn"].(map[string]interface{}); ok {
+		if field, ok := settings["instance_field"].(string); ok {
+			ws.churnField = field
+		}
 	}
+}
+
+// createCategoricalSampler builds a sampler of a recorded distribution,
+// its values beyond the top values following a Zipf tail
+func (ws *WavefrontSynthesizer) createCategoricalSampler(field string, dist map[string]interface{}) (*payloadsynth.CategoricalSampler, error) {
+	return newZipfSampler(ws.samplerSpec(field, dist, nil))
+}
 
-	// Extract percentiles
-	p01, _ := quantiles["p01"].(float64)
-	p05, _ := quantiles["p05"].(float64)
-	p50, _ := quantiles["p50"].(float64)
-	p95, _ := quantiles["p95"].(float64)
-	p99, _ := quantiles["p99"].(float64)
+func (ws *WavefrontSynthesizer) maxCardinality(field string) int {
+	generation, ok := ws.recipe.Generation["generation"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	constraints, ok := generation["constraints"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	limits, ok := constraints["max_cardinality_per_tag"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	limit, _ := limits[field].(float64)
+	return int(limit)
+}
 
-	return payloadsynth.NewQuantileSampler([]float64{p01, p05, p50, p95, p99}), nil
+func floatList(v interface{}) []float64 {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	values := make([]float64, 0, len(list))
+	for _, item := range list {
+		if f, ok := item.(float64); ok {
+			values = append(values, f)
+		}
+	}
+	return values
 }
 
 func (ws *WavefrontSynthesizer) initializeStringPatterns(patterns map[string]interface{}) {
 	// Source patterns
 	if sourcePatterns, ok := patterns["source_patterns"].([]interface{}); ok {
-		ws.stringPatterns["source"] = ws.createStringPatternSampler(sourcePatterns)
+		ws.stringPatterns["source"] = newStringPatternSampler(sourcePatterns)
 	}
 
 	// Tag value patterns
 	if tagPatterns, ok := patterns["tag_value_patterns"].(map[string]interface{}); ok {
 		for tagKey, patterns := range tagPatterns {
 			if patternList, ok := patterns.([]interface{}); ok {
-				ws.stringPatterns[tagKey] = ws.createStringPatternSampler(patternList)
+				ws.stringPatterns[tagKey] = newStringPatternSampler(patternList)
 			}
 		}
 	}
+
+	// N-gram models replace the patterns of a field unless the recipe
+	// selects the pattern generator for it
+	models := make(map[string]interface{})
+	if sourceModel, ok := patterns["source_model"].(map[string]interface{}); ok {
+		models["source"] = sourceModel
+	}
+	if tagModels, ok := patterns["tag_value_models"].(map[string]interface{}); ok {
+		for tagKey, model := range tagModels {
+			models[tagKey] = model
+		}
+	}
+	for field, model := range models {
+		modelMap, ok := model.(map[string]interface{})
+		if !ok || ws.stringGeneratorFor(field) == "pattern" {
+			continue
+		}
+		if sampler, err := newMarkovSampler(modelMap); err == nil {
+			ws.stringPatterns[field] = sampler
+		}
+	}
+}
+
+// stringGeneratorFor returns the generator the recipe selects for a field,
+// "markov" or "pattern", or "" to use the n-gram model when there is one
+func (ws *WavefrontSynthesizer) stringGeneratorFor(field string) string {
+	generation, ok := ws.recipe.Generation["generation"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	generators, ok := generation["string_generators"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	generator, _ := generators[field].(string)
+	return generator
 }
 
-func (ws *WavefrontSynthesizer) createStringPatternSampler(patterns []interface{}) *payloadsynth.StringPatternSampler {
+func newMarkovSampler(model map[string]interface{}) (*payloadsynth.MarkovSampler, error) {
+	order, _ := model["order"].(float64)
+	maxLength, _ := model["max_length"].(float64)
+	transitions, ok := model["transitions"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid transitions format")
+	}
+
+	markovModel := payloadsynth.MarkovModel{
+		Order:       int(order),
+		Transitions: make(map[string]map[string]float64, len(transitions)),
+		MaxLength:   int(maxLength),
+	}
+	for context, next := range transitions {
+		nextMap, ok := next.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		counts := make(map[string]float64, len(nextMap))
+		for char, count := range nextMap {
+			if c, ok := count.(float64); ok {
+				counts[char] = c
+			}
+		}
+		markovModel.Transitions[context] = counts
+	}
+
+	return payloadsynth.NewMarkovSampler(markovModel)
+}
+
+func newStringPatternSampler(patterns []interface{}) *payloadsynth.StringPatternSampler {
 	var weightedPatterns []payloadsynth.WeightedPattern
 	
 	for _, p := range patterns {
@@ -188,141 +483,222 @@ func (ws *WavefrontSynthesizer) createStringPatternSampler(patterns []interface{
 
 // SynthesizeLine generates a single Wavefront metric line
 func (ws *WavefrontSynthesizer) SynthesizeLine(currentTime time.Time, multiplier float64) (string, error) {
+	buf := linePool.Get().(*[]byte)
+	line, err := ws.SynthesizeLineTo((*buf)[:0], currentTime, multiplier)
+	text := string(line)
+	*buf = line
+	linePool.Put(buf)
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// SynthesizeLineTo appends a single Wavefront metric line to buf, without
+// a newline, and returns the extended buffer. Callers that reuse buf for
+// a batch of lines avoid SynthesizeLine's per-line allocations.
+func (ws *WavefrontSynthesizer) SynthesizeLineTo(buf []byte, currentTime time.Time, multiplier float64) ([]byte, error) {
 	// Check if this is a delta counter
 	schema, ok := ws.recipe.Schema["schema"].(map[string]interface{})
 	if !ok {
-		return "", fmt.Errorf("invalid schema format")
+		return buf, fmt.Errorf("invalid schema format")
 	}
 	
 	isDelta, _ := schema["is_delta"].(bool)
 	hasHistogram, _ := schema["has_histogram"].(bool)
 
 	// Decide whether to generate metric or histogram
+	start := len(buf)
 	if hasHistogram && ws.rng.Float64() < 0.1 { // 10% histogram probability
-		return ws.synthesizeHistogram(currentTime, multiplier)
+		buf = ws.appendHistogram(buf, currentTime, multiplier)
+	} else {
+		buf = ws.appendMetric(buf, currentTime, multiplier, isDelta)
 	}
 
-	return ws.synthesizeMetric(currentTime, multiplier, isDelta)
+	if ws.sampledForValidation() {
+		ws.validate(string(buf[start:]))
+	}
+	return buf, nil
 }
 
-func (ws *WavefrontSynthesizer) synthesizeMetric(currentTime time.Time, multiplier float64, isDelta bool) (string, error) {
-	// Generate metric name with delta prefix if needed
-	metricName := ws.recipe.MetricName
-	if isDelta {
-		metricName = "∆" + metricName
-	}
+func (ws *WavefrontSynthesizer) appendMetric(buf []byte, currentTime time.Time, multiplier float64, isDelta bool) []byte {
+	// Generate source and tags
+	source, tags := ws.generateSeries(currentTime)
 
-	// Generate value
-	var value float64
-	if ws.valueSampler != nil {
-		value = ws.valueSampler.Sample(ws.rng)
-	} else {
-		value = ws.rng.NormFloat64() * 10 + 50 // Default distribution
+	// Generate value; only autocorrelated values and delta counters need
+	// the series' key
+	var series string
+	if ws.seriesModel != nil || isDelta {
+		series = ws.seriesKey(source, tags)
 	}
-
+	value := ws.sampleValue(series)
 	// Apply multiplier
 	value *= multiplier
 
-	// For delta counters, accumulate per-minute and emit deltas
+	// For delta counters, accumulate each series over the minute and emit
+	// its total so far; a new minute flushes every series back to zero
 	if isDelta {
-		minuteKey := fmt.Sprintf("%d", currentTime.Unix()/60)
-		ws.deltaAccumulator[minuteKey] += value
-		value = ws.deltaAccumulator[minuteKey]
-		// Reset accumulator for next period (simplified)
+		minute := currentTime.Unix() / 60
+		if minute != ws.deltaMinute {
+			ws.deltaAccumulator = make(map[string]float64)
+			ws.deltaMinute = minute
+		}
+		if total, ok := ws.deltaAccumulator[series]; ok || len(ws.deltaAccumulator) < maxDeltaSeries {
+			value += total
+			ws.deltaAccumulator[series] = value
+		}
 	}
 
-	// Generate source
-	source := ws.generateSource()
-
-	// Generate tags
-	tags := ws.generateTags()
-
 	// Format timestamp (optional in Wavefront, but useful for testing)
 	timestamp := currentTime.Unix()
 
+	tags = ws.detonateCardinalityBomb(tags, currentTime)
+	metricName, source, tags := ws.applyEdgeCases(ws.recipe.MetricName, source, tags)
+
 	// Construct line: <metric> <value> [<timestamp>] source=<source> [<tags>]
-	var line strings.Builder
-	line.WriteString(ws.escapeMetricName(metricName))
-	line.WriteString(" ")
-	line.WriteString(ws.formatValue(value))
-	line.WriteString(" ")
-	line.WriteString(strconv.FormatInt(timestamp, 10))
-	line.WriteString(" source=")
-	line.WriteString(ws.escapeTagValue(source))
+	start := len(buf)
+	precision := valuePrecision(value)
+	buf = appendMetricLine(ws.appendMetricName(buf, metricName, isDelta), value, precision, timestamp, source, tags)
 
-	for key, val := range tags {
-		line.WriteString(" ")
-		line.WriteString(key)
-		line.WriteString("=")
-		line.WriteString(ws.escapeTagValue(val))
+	// In size-targeting mode, rebuild the line fitted to a drawn length
+	if ws.targetSizes && ws.lineSizes != nil {
+		tags, precision = ws.fitSize(len(buf)-start, value, tags)
+		buf = appendMetricLine(ws.appendMetricName(buf[:start], metricName, isDelta), value, precision, timestamp, source, tags)
 	}
+	return buf
+}
 
-	return line.String(), nil
+// appendMetricLine appends what follows a metric's name:
+// <value> <timestamp> source=<source> [<tags>]
+func appendMetricLine(buf []byte, value float64, precision int, timestamp int64, source string, tags map[string]string) []byte {
+	buf = append(buf, ' ')
+	buf = appendValuePrecision(buf, value, precision)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, timestamp, 10)
+	return appendSourceTags(buf, source, tags)
 }
 
-func (ws *WavefrontSynthesizer) synthesizeHistogram(currentTime time.Time, multiplier float64) (string, error) {
-	// Generate histogram line: !M <timestamp> #<count> <centroid_count> <centroid_value> ...
-	// Followed by metric line with source and tags
+// sampleValue draws the next value of a series, continuing it when values
+// are autocorrelated, shifted as far as drift has taken them
+func (ws *WavefrontSynthesizer) sampleValue(series string) float64 {
+	var value float64
+	switch {
+	case ws.seriesModel != nil:
+		value = ws.seriesModel.Sample(ws.rng, series)
+	case ws.valueSampler != nil:
+		value = ws.valueSampler.Sample(ws.rng)
+	default:
+		value = ws.rng.NormFloat64()*10 + 50 // Default distribution
+	}
+	return value * (1 + ws.driftShift)
+}
 
-	granularity := "M" // Default to minute
-	if ws.rng.Float64() < 0.2 {
-		granularity = "H" // 20% hour
-	} else if ws.rng.Float64() < 0.05 {
-		granularity = "D" // 5% day
+// seriesKey identifies a series by its source and tags
+func (ws *WavefrontSynthesizer) seriesKey(source string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	timestamp := currentTime.Unix()
-	
-	// Generate centroids (simplified)
-	centroidCount := 1 + ws.rng.Intn(5) // 1-5 centroids
-	totalCount := int(multiplier * float64(10+ws.rng.Intn(90))) // 10-100 base count
-
-	var line strings.Builder
-	line.WriteString("!")
-	line.WriteString(granularity)
-	line.WriteString(" ")
-	line.WriteString(strconv.FormatInt(timestamp, 10))
-	line.WriteString(" #")
-	line.WriteString(strconv.Itoa(totalCount))
-
-	// Generate centroids
-	for i := 0; i < centroidCount; i++ {
-		count := totalCount / centroidCount
-		if i == centroidCount-1 {
-			count = totalCount - (centroidCount-1)*count // Remainder
-		}
-		
-		value := ws.rng.NormFloat64()*50 + 100 // Sample centroid value
-		
-		line.WriteString(" ")
-		line.WriteString(strconv.Itoa(count))
-		line.WriteString(" ")
-		line.WriteString(ws.formatValue(value))
-	}
-
-	line.WriteString("\n")
-
-	// Add metric line
-	source := ws.generateSource()
+	var key strings.Builder
+	key.WriteString(source)
+	for _, k := range keys {
+		key.WriteString("\x00")
+		key.WriteString(k)
+		key.WriteString("=")
+		key.WriteString(tags[k])
+	}
+	return key.String()
+}
+
+// generateSeries returns the source and tags of a line: a series of the
+// active set when series churn, else a fresh draw
+func (ws *WavefrontSynthesizer) generateSeries(currentTime time.Time) (string, map[string]string) {
+	ws.advance(currentTime)
+	if ws.churn != nil {
+		ws.churn.Advance(ws.rng, currentTime.Sub(ws.startTime).Seconds(), ws.spawnSeries)
+		if series := ws.churn.Pick(ws.rng); series != nil {
+			return series.Source, series.Tags
+		}
+	}
+	return ws.drawSeries()
+}
+
+// drawSeries draws a source and tags afresh. With a host topology the
+// source is a host's, picked by its rate share, and the host-level tags
+// present take the host's values.
+func (ws *WavefrontSynthesizer) drawSeries() (string, map[string]string) {
+	if ws.topology == nil {
+		return ws.generateSource(), ws.generateTags()
+	}
+	host := ws.topology.Pick(ws.rng)
+	if host == nil {
+		return ws.generateSource(), ws.generateTags()
+	}
 	tags := ws.generateTags()
+	for key, value := range host.Tags {
+		if _, ok := tags[key]; ok {
+			tags[key] = value
+		}
+	}
+	return host.Name, tags
+}
 
-	line.WriteString(ws.escapeMetricName(ws.recipe.MetricName))
-	line.WriteString(" source=")
-	line.WriteString(ws.escapeTagValue(source))
+// advance moves the state that evolves over the scenario, the host
+// topology and drift, to currentTime
+func (ws *WavefrontSynthesizer) advance(currentTime time.Time) {
+	ws.advanceTopology(currentTime)
+	ws.advanceDrift(currentTime)
+}
 
-	for key, val := range tags {
-		line.WriteString(" ")
-		line.WriteString(key)
-		line.WriteString("=")
-		line.WriteString(ws.escapeTagValue(val))
+// advanceTopology moves the host topology, if any, to currentTime
+func (ws *WavefrontSynthesizer) advanceTopology(currentTime time.Time) {
+	if ws.topology != nil {
+		ws.topology.Advance(ws.rng, currentTime.Sub(ws.startTime).Seconds(), ws.spawnHost)
 	}
+}
 
-	return line.String(), nil
+// spawnHost draws a new host's name and its values of the host-level tags
+func (ws *WavefrontSynthesizer) spawnHost() (string, map[string]string) {
+	tags := make(map[string]string, len(ws.hostTagKeys))
+	for _, key := range ws.hostTagKeys {
+		if value := ws.generateTagValue(key); value != "" {
+			tags[key] = value
+		}
+	}
+	return ws.generateSource(), tags
+}
+
+// spawnSeries draws a series born into the active set. Its instance field
+// gets a fresh suffix, as a rolled pod's name does, so a series born after
+// another retired is a new series even where the recipe's values repeat.
+func (ws *WavefrontSynthesizer) spawnSeries() (string, map[string]string) {
+	source, tags := ws.drawSeries()
+	switch {
+	case ws.churnField == "":
+	case ws.churnField == "source":
+		source += "-" + ws.instanceSuffix()
+	case tags[ws.churnField] != "":
+		tags[ws.churnField] += "-" + ws.instanceSuffix()
+	}
+	return source, tags
+}
+
+// instanceSuffix draws a five-character suffix of the kind Kubernetes gives
+// pods, without vowels or easily confused characters
+func (ws *WavefrontSynthesizer) instanceSuffix() string {
+	const alphabet = "bcdfghjklmnpqrstvwxz2456789"
+	suffix := make([]byte, 5)
+	for i := range suffix {
+		suffix[i] = alphabet[ws.rng.Intn(len(alphabet))]
+	}
+	return string(suffix)
 }
 
 func (ws *WavefrontSynthesizer) generateSource() string {
 	if ws.sourceSampler != nil {
-		return ws.sourceSampler.Sample(ws.rng)
+		return ws.sourceSampler.Generate(ws.rng)
 	}
 
 	// Generate using pattern if available
@@ -348,27 +724,53 @@ func (ws *WavefrontSynthesizer) generateTags() map[string]string {
 		return tags
 	}
 
-	for tagKey, schemaInfo := range tagSchema {
-		if schemaMap, ok := schemaInfo.(map[string]interface{}); ok {
+	// Sorted so a seeded synthesizer is reproducible
+	tagKeys := make([]string, 0, len(tagSchema))
+	for tagKey := range tagSchema {
+		tagKeys = append(tagKeys, tagKey)
+	}
+	sort.Strings(tagKeys)
+
+	var present []string
+	for _, tagKey := range tagKeys {
+		if schemaMap, ok := tagSchema[tagKey].(map[string]interface{}); ok {
 			presence, _ := schemaMap["presence"].(float64)
 			
 			// Decide whether to include this tag
 			if ws.rng.Float64() < presence {
-				value := ws.generateTagValue(tagKey)
-				if value != "" {
-					tags[tagKey] = value
-				}
+				present = append(present, tagKey)
 			}
 		}
 	}
 
+	// Draw correlated keys together when the recipe records co-occurrence
+	if ws.tagCorrelations != nil {
+		return ws.tagCorrelations.Sample(ws.rng, present, ws.generateTagValue)
+	}
+
+	for _, tagKey := range present {
+		value := ws.generateTagValue(tagKey)
+		if value != "" {
+			tags[tagKey] = value
+		}
+	}
+
 	return tags
 }
 
+// generateTagValue draws a value of a tag key, drifted when drift is on
 func (ws *WavefrontSynthesizer) generateTagValue(tagKey string) string {
+	value := ws.drawTagValue(tagKey)
+	if ws.driftLevel > 0 {
+		value = ws.driftTagValue(tagKey, value)
+	}
+	return value
+}
+
+func (ws *WavefrontSynthesizer) drawTagValue(tagKey string) string {
 	// Try tag-specific sampler first
 	if sampler, ok := ws.tagSamplers[tagKey]; ok {
-		return sampler.Sample(ws.rng)
+		return sampler.Generate(ws.rng)
 	}
 
 	// Try string pattern sampler
@@ -393,117 +795,62 @@ func (ws *WavefrontSynthesizer) generateTagValue(tagKey string) string {
 	}
 }
 
+// GetCurrentIntensity returns the recipe's intensity at currentTime: its
+// daily or weekly curve, interpolated between minutes, with trends and
+// holiday overrides applied
 func (ws *WavefrontSynthesizer) GetCurrentIntensity(currentTime time.Time) float64 {
-	if len(ws.intensityCurve) == 0 {
-		return 1.0
-	}
-
-	// Calculate minutes since start
-	minutes := int(currentTime.Sub(ws.startTime).Minutes()) % 1440 // 24-hour cycle
-	if minutes < 0 {
-		minutes = 0
-	} else if minutes >= len(ws.intensityCurve) {
-		minutes = len(ws.intensityCurve) - 1
-	}
-
-	return ws.intensityCurve[minutes]
+	return ws.intensity.At(currentTime)
 }
 
 func (ws *WavefrontSynthesizer) escapeMetricName(name string) string {
-	// Metric names can contain alphanumeric, dots, hyphens, underscores
-	// If it contains other characters, it should be quoted
-	validPattern := regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
-	if validPattern.MatchString(name) {
-		return name
-	}
-
-	// Quote and escape
-	escaped := strings.ReplaceAll(name, `"`, `\"`)
-	escaped = strings.ReplaceAll(escaped, `\`, `\\`)
-	return `"` + escaped + `"`
+	return string(appendEscapedName(nil, name))
 }
 
 func (ws *WavefrontSynthesizer) escapeTagValue(value string) string {
-	// Tag values need quoting if they contain spaces or special characters
-	if strings.ContainsAny(value, ` "=`) {
-		escaped := strings.ReplaceAll(value, `"`, `\"`)
-		escaped = strings.ReplaceAll(escaped, `\`, `\\`)
-		return `"` + escaped + `"`
-	}
-	return value
+	return string(appendTagValue(nil, value))
 }
 
 func (ws *WavefrontSynthesizer) formatValue(value float64) string {
-	// Format value appropriately
-	if math.IsNaN(value) || math.IsInf(value, 0) {
-		return "0"
-	}
-
-	// Use appropriate precision
-	if math.Abs(value) < 0.001 {
-		return fmt.Sprintf("%.6f", value)
-	} else if math.Abs(value) < 1 {
-		return fmt.Sprintf("%.3f", value)
-	} else if math.Abs(value) < 1000 {
-		return fmt.Sprintf("%.1f", value)
-	} else {
-		return fmt.Sprintf("%.0f", value)
-	}
+	return string(appendValue(nil, value))
 }
 
 // SynthesizeSpan generates a span line (if recipe supports spans)
 func (ws *WavefrontSynthesizer) SynthesizeSpan(currentTime time.Time, multiplier float64) (string, error) {
-	schema, ok := ws.recipe.Schema["schema"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid schema format")
+	// A single root span; SynthesizeTrace generates its descendants too
+	span, err := ws.rootSpan(currentTime)
+	if err != nil {
+		return "", err
 	}
 
-	schemaType, _ := schema["type"].(string)
-	if schemaType != "span" {
-		return "", fmt.Errorf("recipe is not for spans")
+	line := ws.formatSpan(span)
+	if ws.sampledForValidation() {
+		ws.validate(line)
 	}
-
-	// Generate span: <operation> source=<source> <spanTags> <start_ms> <duration_ms>
-	operation := ws.recipe.MetricName
-	source := ws.generateSource()
-	
-	// Generate span tags (similar to metric tags)
-	tags := ws.generateTags()
-	
-	// Generate timing
-	startMs := currentTime.UnixMilli()
-	durationMs := int64(ws.rng.ExpFloat64()*1000) + 1 // 1+ ms, exponential distribution
-
-	var line strings.Builder
-	line.WriteString(operation)
-	line.WriteString(" source=")
-	line.WriteString(ws.escapeTagValue(source))
-
-	for key, val := range tags {
-		line.WriteString(" ")
-		line.WriteString(key)
-		line.WriteString("=")
-		line.WriteString(ws.escapeTagValue(val))
-	}
-
-	line.WriteString(" ")
-	line.WriteString(strconv.FormatInt(startMs, 10))
-	line.WriteString(" ")
-	line.WriteString(strconv.FormatInt(durationMs, 10))
-
-	return line.String(), nil
+	return line, nil
 }
 
-// CalculateTargetRate computes the target emission rate for current time
+// CalculateTargetRate computes the target emission rate for current time.
+// Lines follow a Hawkes process, so the rate is the one it realized since
+// the previous call; callers emit it over that same interval.
 func (ws *WavefrontSynthesizer) CalculateTargetRate(currentTime time.Time, baseRate, multiplier, burstFactor float64) float64 {
-	intensity := ws.GetCurrentIntensity(currentTime)
-	
-	// Apply burst factor (Hawkes-like process simulation)
-	if burstFactor > 1.0 && ws.rng.Float64() < 0.1 { // 10% chance of burst
-		intensity *= (1.0 + (burstFactor-1.0)*ws.rng.Float64())
+	background := baseRate * ws.GetCurrentIntensity(currentTime) * multiplier
+
+	// Bursts come from a Hawkes process fit to the recipe's burstiness,
+	// which the burst factor amplifies
+	fano := ws.burstFano
+	if burstFactor > 1.0 {
+		fano = math.Max(fano, 1.0) * burstFactor
 	}
+	ws.burst.Params = temporal.ParamsFromFano(fano)
 
-	return baseRate * intensity * multiplier
+	events := ws.burst.Events(ws.rng, currentTime.Sub(ws.startTime).Seconds(), background)
+	elapsed := currentTime.Sub(ws.lastRateTime).Seconds()
+	first := ws.lastRateTime.IsZero()
+	ws.lastRateTime = currentTime
+	if first || elapsed <= 0 {
+		return background
+	}
+	return float64(events) / elapsed
 }
 
 // InjectSchemaDrift adds probabilistic schema evolution
@@ -531,6 +878,34 @@ func (ws *WavefrontSynthesizer) InjectSchemaDrift(tags map[string]string, driftR
 	return tags
 }
 
+// SetCardinalityBomb turns on the adversarial cardinality mode: a fraction
+// of lines carry a tag whose value never repeats, a UUID request ID or a
+// nanosecond timestamp, so every such line starts a new series. It exists
+// to exercise cardinality protection at the ingestion side; 0 turns it off.
+func (ws *WavefrontSynthesizer) SetCardinalityBomb(fraction float64) {
+	ws.bombFraction = math.Max(0, math.Min(fraction, 1))
+}
+
+// detonateCardinalityBomb adds an unbounded-cardinality tag to the share of
+// lines the cardinality bomb sets, to a copy of tags since those of the
+// active series are shared
+func (ws *WavefrontSynthesizer) detonateCardinalityBomb(tags map[string]string, currentTime time.Time) map[string]string {
+	if ws.bombFraction <= 0 || ws.rng.Float64() >= ws.bombFraction {
+		return tags
+	}
+
+	bombed := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		bombed[k] = v
+	}
+	if ws.rng.Float64() < 0.5 {
+		bombed["request_id"] = ws.uuid()
+	} else {
+		bombed["timestamp"] = strconv.FormatInt(currentTime.UnixNano()+ws.rng.Int63n(1000), 10)
+	}
+	return bombed
+}
+
 // InjectErrors adds realistic error patterns
 func (ws *WavefrontSynthesizer) InjectErrors(line string, errorRate float64) string {
 	if errorRate <= 0 || ws.rng.Float64() >= errorRate {
@@ -2,6 +2,7 @@ package libauth
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -26,11 +27,56 @@ type ConnectionPool struct {
 	maxConns int
 }
 
-// AuthConfig holds authentication configuration
+// AuthConfig holds authentication configuration. Type "bearer" sends the
+// static Token; type "oauth2" fetches short-lived tokens from TokenURL with
+// the client-credentials grant and refreshes them before they expire.
 type AuthConfig struct {
 	Type   string            `json:"type" yaml:"type"`
 	Token  string            `json:"token,omitempty" yaml:"token,omitempty"`
 	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// OAuth2 client credentials, for type "oauth2"
+	TokenURL     string   `json:"token_url,omitempty" yaml:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// Validate checks the configuration has what its type needs
+func (ac AuthConfig) Validate() error {
+	switch ac.Type {
+	case "":
+	case "bearer":
+		if ac.Token == "" {
+			return fmt.Errorf("bearer authentication needs a token")
+		}
+	case "oauth2":
+		if ac.TokenURL == "" {
+			return fmt.Errorf("oauth2 authentication needs a token URL")
+		}
+	default:
+		return fmt.Errorf("unknown authentication type %q: must be bearer or oauth2", ac.Type)
+	}
+	return nil
+}
+
+// TokenSource returns the source of the configuration's bearer tokens, or
+// nil when it sends none
+func (ac AuthConfig) TokenSource() TokenSource {
+	switch ac.Type {
+	case "bearer":
+		if ac.Token != "" {
+			return StaticTokenSource(ac.Token)
+		}
+	case "oauth2":
+		return NewClientCredentialsTokenSource(ClientCredentialsConfig{
+			TokenURL:     ac.TokenURL,
+			ClientID:     ac.ClientID,
+			ClientSecret: ac.ClientSecret,
+			Scopes:       ac.Scopes,
+		})
+	}
+	return nil
 }
 
 // NewAuthManager creates a new authentication manager
@@ -323,6 +369,7 @@ type HTTPSender struct {
 	client   *http.Client
 	endpoint string
 	auth     AuthConfig
+	tokens   TokenSource
 }
 
 // NewHTTPSender creates a new HTTP-based sender
@@ -338,34 +385,39 @@ func NewHTTPSender(endpoint string, auth AuthConfig) *HTTPSender {
 		},
 		endpoint: endpoint,
 		auth:     auth,
+		tokens:   auth.TokenSource(),
 	}
 }
 
 // SendBatch sends a batch via HTTP POST
 func (hs *HTTPSender) SendBatch(lines []string) error {
+	return hs.SendBatchContext(context.Background(), lines)
+}
+
+// SendBatchContext sends a batch via HTTP POST, giving up when ctx is done
+func (hs *HTTPSender) SendBatchContext(ctx context.Context, lines []string) error {
 	payload := ""
 	for _, line := range lines {
 		payload += line + "\n"
 	}
 	
-	req, err := http.NewRequest("POST", hs.endpoint, strings.NewReader(payload))
-	if err != nil {
-		return err
+	// Requests are built per attempt, since a rejected token is retried
+	// with a fresh one
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", hs.endpoint, strings.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("User-Agent", "wavefront-loadgen/2.0")
+		for k, v := range hs.auth.Headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
 	}
 	
 	// Apply authentication
-	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("User-Agent", "wavefront-loadgen/2.0")
-	
-	if hs.auth.Type == "bearer" && hs.auth.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+hs.auth.Token)
-	}
-	
-	for k, v := range hs.auth.Headers {
-		req.Header.Set(k, v)
-	}
-	
-	resp, err := hs.client.Do(req)
+	resp, err := DoWithToken(ctx, hs.client, hs.tokens, newRequest)
 	if err != nil {
 		return err
 	}
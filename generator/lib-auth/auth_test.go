@@ -0,0 +1,26 @@
+package libauth
+
+import "testing"
+
+func TestAuthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AuthConfig
+		wantErr bool
+	}{
+		{"none", AuthConfig{}, false},
+		{"bearer", AuthConfig{Type: "bearer", Token: "abc"}, false},
+		{"bearer without a token", AuthConfig{Type: "bearer"}, true},
+		{"oauth2", AuthConfig{Type: "oauth2", TokenURL: "https://auth.example.com/token", ClientID: "client"}, false},
+		{"oauth2 without a token URL", AuthConfig{Type: "oauth2", ClientID: "client"}, true},
+		{"unknown type", AuthConfig{Type: "basic"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package libauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token refresh defaults
+const (
+	// defaultRefreshBefore is how long before expiry a cached token is
+	// replaced, so that requests never carry one about to lapse
+	defaultRefreshBefore = 60 * time.Second
+
+	// defaultTokenLifetime is assumed for tokens issued without expires_in
+	defaultTokenLifetime = time.Hour
+
+	// maxTokenResponseSize bounds the token endpoint's response
+	maxTokenResponseSize = 1 << 20
+
+	// tokenFetchTimeout bounds a token fetch, which outlives the request
+	// that started it when other callers wait for it too
+	tokenFetchTimeout = 10 * time.Second
+)
+
+// TokenSource supplies the bearer tokens of requests
+type TokenSource interface {
+	// Token returns a valid token, fetching one if none is cached
+	Token(ctx context.Context) (string, error)
+
+	// Invalidate drops token if it is the cached one, after the server
+	// rejected it, so that the next Token fetches anew
+	Invalidate(token string)
+}
+
+// StaticTokenSource always supplies the same token
+type StaticTokenSource string
+
+// Token returns the token
+func (s StaticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+// Invalidate does nothing; a static token cannot be replaced
+func (s StaticTokenSource) Invalidate(token string) {}
+
+// ClientCredentialsConfig configures the OAuth2 client-credentials grant
+type ClientCredentialsConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// RefreshBefore is how long before expiry a token is replaced; tokens
+	// living less than twice as long are replaced at half their lifetime
+	RefreshBefore time.Duration
+
+	// HTTPClient fetches tokens; nil for a client with a 10 second timeout
+	HTTPClient *http.Client
+}
+
+// ClientCredentialsTokenSource fetches tokens with the OAuth2
+// client-credentials grant (RFC 6749, section 4.4) and caches each until
+// shortly before it expires. Concurrent callers share a single fetch, and
+// a token due for refresh is still served until it expires while its
+// replacement is fetched.
+type ClientCredentialsTokenSource struct {
+	config ClientCredentialsConfig
+
+	mu       sync.Mutex
+	token    string
+	refresh  time.Time   // When the cached token is replaced
+	expiry   time.Time   // When the cached token lapses
+	fetching *tokenFetch // The fetch in flight, if any
+}
+
+// tokenFetch is a fetch shared by the callers waiting for it; token and
+// err are set before done is closed
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// tokenResponse is the token endpoint's answer, successful or not
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// NewClientCredentialsTokenSource creates a token source for the grant
+func NewClientCredentialsTokenSource(config ClientCredentialsConfig) *ClientCredentialsTokenSource {
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = defaultRefreshBefore
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &ClientCredentialsTokenSource{config: config}
+}
+
+// Token returns the cached token, or fetches one when there is none or it
+// is due for refresh. A caller waiting for a fetch gives up when ctx is
+// done; the fetch carries on for the others.
+func (cs *ClientCredentialsTokenSource) Token(ctx context.Context) (string, error) {
+	cs.mu.Lock()
+	now := time.Now()
+	if cs.token != "" && now.Before(cs.refresh) {
+		token := cs.token
+		cs.mu.Unlock()
+		return token, nil
+	}
+	fetch := cs.fetching
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		cs.fetching = fetch
+		go cs.run(fetch)
+	}
+	if cs.token != "" && now.Before(cs.expiry) {
+		token := cs.token
+		cs.mu.Unlock()
+		return token, nil
+	}
+	cs.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// run performs a fetch and caches its token. A failed refresh leaves the
+// cached token in place until it expires, and the next Token tries again.
+func (cs *ClientCredentialsTokenSource) run(fetch *tokenFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenFetchTimeout)
+	defer cancel()
+
+	token, lifetime, err := cs.fetch(ctx)
+	now := time.Now()
+
+	cs.mu.Lock()
+	if err == nil {
+		refreshAfter := lifetime - cs.config.RefreshBefore
+		if lifetime < 2*cs.config.RefreshBefore {
+			refreshAfter = lifetime / 2
+		}
+		cs.token = token
+		cs.refresh = now.Add(refreshAfter)
+		cs.expiry = now.Add(lifetime)
+	}
+	cs.fetching = nil
+	cs.mu.Unlock()
+
+	fetch.token, fetch.err = token, err
+	close(fetch.done)
+}
+
+// Invalidate drops token if it is still the cached one
+func (cs *ClientCredentialsTokenSource) Invalidate(token string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.token == token {
+		cs.token = ""
+	}
+}
+
+// fetch requests a token, authenticating the client with HTTP Basic
+// authentication as the RFC recommends
+func (cs *ClientCredentialsTokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(cs.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(cs.config.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cs.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cs.config.ClientID), url.QueryEscape(cs.config.ClientSecret))
+
+	resp, err := cs.config.HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read token response: %w", err)
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil && resp.StatusCode == http.StatusOK {
+		return "", 0, fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		if token.ErrorDescription != "" {
+			return "", 0, fmt.Errorf("token request failed: HTTP %d: %s: %s", resp.StatusCode, token.Error, token.ErrorDescription)
+		}
+		if token.Error != "" {
+			return "", 0, fmt.Errorf("token request failed: HTTP %d: %s", resp.StatusCode, token.Error)
+		}
+		return "", 0, fmt.Errorf("token request failed: HTTP %d: %s", resp.StatusCode, string(body))
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return token.AccessToken, lifetime, nil
+}
+
+// DoWithToken sends the request newRequest builds, with ctx, carrying the
+// source's token. If the server answers 401 Unauthorized the token is
+// invalidated and the request, built anew, is sent once more with a fresh
+// one; a static token is not retried. A nil source sends the request as it
+// is.
+func DoWithToken(ctx context.Context, client *http.Client, source TokenSource, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	send := func() (*http.Response, string, error) {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		if source == nil {
+			resp, err := client.Do(req)
+			return resp, "", err
+		}
+		token, err := source.Token(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		return resp, token, err
+	}
+
+	resp, token, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if _, static := source.(StaticTokenSource); static || source == nil {
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxTokenResponseSize))
+	resp.Body.Close()
+	source.Invalidate(token)
+
+	resp, _, err = send()
+	return resp, err
+}
@@ -0,0 +1,318 @@
+package libauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer issues token-1, token-2, ... with the given lifetime, and
+// counts the requests
+type tokenServer struct {
+	*httptest.Server
+	issued    atomic.Int32
+	expiresIn int
+	release   chan struct{} // If set, each request waits for it
+}
+
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	ts := &tokenServer{expiresIn: expiresIn}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			t.Errorf("token request authenticated as %q:%q", id, secret)
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" {
+			t.Errorf("token request form %v: %v", r.PostForm, err)
+		}
+		if ts.release != nil {
+			<-ts.release
+		}
+		n := ts.issued.Add(1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, n, ts.expiresIn)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *tokenServer) source() *ClientCredentialsTokenSource {
+	return NewClientCredentialsTokenSource(ClientCredentialsConfig{
+		TokenURL:     ts.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+	})
+}
+
+func TestClientCredentialsRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("schedule", func(t *testing.T) {
+		for _, tt := range []struct {
+			expiresIn   int
+			wantRefresh time.Duration
+		}{
+			{3600, 3540 * time.Second}, // RefreshBefore ahead of expiry
+			{90, 45 * time.Second},     // Half the lifetime when that is shorter
+			{0, 59 * time.Minute},      // The default lifetime
+		} {
+			source := newTokenServer(t, tt.expiresIn).source()
+			before := time.Now()
+			if _, err := source.Token(ctx); err != nil {
+				t.Fatal(err)
+			}
+			refresh := source.refresh.Sub(before)
+			if refresh < tt.wantRefresh || refresh > tt.wantRefresh+time.Second {
+				t.Errorf("expires_in %d: refreshed after %s, want %s", tt.expiresIn, refresh, tt.wantRefresh)
+			}
+		}
+	})
+
+	t.Run("cached until refresh", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		source := server.source()
+		for i := 0; i < 3; i++ {
+			if token, err := source.Token(ctx); err != nil || token != "token-1" {
+				t.Fatalf("Token = %q, %v; want token-1", token, err)
+			}
+		}
+		if n := server.issued.Load(); n != 1 {
+			t.Errorf("%d tokens fetched, want 1", n)
+		}
+	})
+
+	t.Run("served while refreshing", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		source := server.source()
+		if _, err := source.Token(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// Due for refresh but not expired: the old token is served while
+		// the new one is fetched
+		server.release = make(chan struct{})
+		source.mu.Lock()
+		source.refresh = time.Now().Add(-time.Second)
+		source.mu.Unlock()
+		if token, err := source.Token(ctx); err != nil || token != "token-1" {
+			t.Fatalf("Token = %q, %v while refreshing; want token-1", token, err)
+		}
+		close(server.release)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			token, err := source.Token(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == "token-2" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("still served %s after the refresh", token)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		source := server.source()
+		if _, err := source.Token(ctx); err != nil {
+			t.Fatal(err)
+		}
+		source.mu.Lock()
+		source.refresh = time.Now().Add(-time.Second)
+		source.expiry = time.Now().Add(-time.Second)
+		source.mu.Unlock()
+		if token, err := source.Token(ctx); err != nil || token != "token-2" {
+			t.Errorf("Token = %q, %v after expiry; want token-2", token, err)
+		}
+	})
+
+	t.Run("single fetch", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		server.release = make(chan struct{})
+		source := server.source()
+
+		var wg sync.WaitGroup
+		tokens := make([]string, 10)
+		for i := range tokens {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				token, err := source.Token(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				tokens[i] = token
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(server.release)
+		wg.Wait()
+
+		if n := server.issued.Load(); n != 1 {
+			t.Errorf("%d tokens fetched by concurrent callers, want 1", n)
+		}
+		for _, token := range tokens {
+			if token != "token-1" {
+				t.Errorf("caller got %q, want token-1", token)
+			}
+		}
+	})
+
+	t.Run("caller gives up", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		server.release = make(chan struct{})
+		source := server.source()
+
+		waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		if _, err := source.Token(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Token = %v, want the caller's deadline", err)
+		}
+
+		// The fetch carries on for the next caller
+		close(server.release)
+		if token, err := source.Token(ctx); err != nil || token != "token-1" {
+			t.Errorf("Token = %q, %v; want token-1", token, err)
+		}
+		if n := server.issued.Load(); n != 1 {
+			t.Errorf("%d tokens fetched, want 1", n)
+		}
+	})
+}
+
+func TestClientCredentialsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"oauth error", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"unknown client"}`,
+			"token request failed: HTTP 401: invalid_client: unknown client"},
+		{"oauth error without description", http.StatusBadRequest, `{"error":"invalid_scope"}`,
+			"token request failed: HTTP 400: invalid_scope"},
+		{"plain body", http.StatusBadGateway, "upstream unavailable",
+			"token request failed: HTTP 502: upstream unavailable"},
+		{"error with 200", http.StatusOK, `{"error":"temporarily_unavailable"}`,
+			"token request failed: HTTP 200: temporarily_unavailable"},
+		{"invalid JSON", http.StatusOK, "<html>",
+			"invalid token response"},
+		{"no token", http.StatusOK, `{"token_type":"Bearer"}`,
+			"token response has no access_token"},
+		{"token type", http.StatusOK, `{"access_token":"abc","token_type":"mac"}`,
+			`unsupported token type "mac"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			source := NewClientCredentialsTokenSource(ClientCredentialsConfig{TokenURL: server.URL})
+			_, err := source.Token(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Token error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoWithToken(t *testing.T) {
+	ctx := context.Background()
+
+	// The resource server rejects token-1, as if it had been revoked
+	var authorizations []string
+	var mu sync.Mutex
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer resource.Close()
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "POST", resource.URL, strings.NewReader("line"))
+	}
+	send := func(source TokenSource) int {
+		t.Helper()
+		mu.Lock()
+		authorizations = nil
+		mu.Unlock()
+		resp, err := DoWithToken(ctx, resource.Client(), source, newRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("retried with a fresh token", func(t *testing.T) {
+		server := newTokenServer(t, 3600)
+		if status := send(server.source()); status != http.StatusOK {
+			t.Errorf("status %d, want 200", status)
+		}
+		want := []string{"Bearer token-1", "Bearer token-2"}
+		if fmt.Sprint(authorizations) != fmt.Sprint(want) {
+			t.Errorf("sent %v, want %v", authorizations, want)
+		}
+	})
+
+	t.Run("retried once", func(t *testing.T) {
+		source := &rejectedTokenSource{}
+		if status := send(source); status != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+		if len(authorizations) != 2 || source.invalidated != 1 {
+			t.Errorf("sent %d times and invalidated %d, want 2 and 1", len(authorizations), source.invalidated)
+		}
+	})
+
+	t.Run("static token not retried", func(t *testing.T) {
+		if status := send(StaticTokenSource("token-1")); status != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+		if len(authorizations) != 1 {
+			t.Errorf("static token sent %d times, want once", len(authorizations))
+		}
+	})
+
+	t.Run("no source", func(t *testing.T) {
+		if status := send(nil); status != http.StatusOK {
+			t.Errorf("status %d, want 200", status)
+		}
+		if len(authorizations) != 1 || authorizations[0] != "" {
+			t.Errorf("sent %q, want no authorization", authorizations)
+		}
+	})
+}
+
+// rejectedTokenSource always supplies token-1, which the resource server
+// rejects, however often it is invalidated
+type rejectedTokenSource struct {
+	invalidated int
+}
+
+func (s *rejectedTokenSource) Token(ctx context.Context) (string, error) {
+	return "token-1", nil
+}
+
+func (s *rejectedTokenSource) Invalidate(token string) {
+	s.invalidated++
+}
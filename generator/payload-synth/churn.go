@@ -0,0 +1,201 @@
+package payloadsynth
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+)
+
+// Sizing of a SeriesChurn
+const (
+	// maxActiveSeries bounds the active set; births past it are dropped
+	maxActiveSeries = 100000
+
+	// churnSizeBiasDraws is how many lifetimes the initial series' lifetime
+	// is picked from, weighted by length
+	churnSizeBiasDraws = 16
+)
+
+// ChurnParams describe how series come and go. Births arrive as a Poisson
+// process and each series lives for a lifetime drawn independently, so the
+// active set holds BirthRate times the mean lifetime series on average.
+type ChurnParams struct {
+	BirthRate    float64         // New series per second
+	MeanLifetime float64         // Seconds
+	Lifetimes    *NumericSampler // Lifetime distribution, seconds, of that mean; else exponential
+}
+
+// ChurnedSeries is a series of the active set
+type ChurnedSeries struct {
+	Source  string
+	Tags    map[string]string
+	Born    float64 // Seconds
+	Retires float64 // Seconds
+
+	index int // In the active set
+}
+
+// SeriesChurn is a fleet's active series set as it rotates: series are
+// born, report for their lifetime and retire, the way pods roll. Lines are
+// emitted for series of the active set rather than for fresh draws, so a
+// scenario sees the series set turn over at the recipe's rate.
+type SeriesChurn struct {
+	params      ChurnParams
+	active      []*ChurnedSeries
+	retirements retirementQueue
+	clock       float64 // Seconds, of the last step
+	started     bool
+}
+
+// NewSeriesChurn creates an empty churn model; the first Advance fills it
+func NewSeriesChurn(params ChurnParams) *SeriesChurn {
+	return &SeriesChurn{params: params}
+}
+
+// ActiveSeries is the mean size of the active set
+func (sc *SeriesChurn) ActiveSeries() float64 {
+	return sc.params.BirthRate * sc.params.MeanLifetime
+}
+
+// Len returns the number of active series
+func (sc *SeriesChurn) Len() int {
+	return len(sc.active)
+}
+
+// Clone returns a copy of the active set as it is, whose series then
+// retire and are born independently of the original's
+func (sc *SeriesChurn) Clone() *SeriesChurn {
+	clone := &SeriesChurn{
+		params:      sc.params,
+		active:      make([]*ChurnedSeries, len(sc.active)),
+		retirements: make(retirementQueue, len(sc.retirements)),
+		clock:       sc.clock,
+		started:     sc.started,
+	}
+	copies := make(map[*ChurnedSeries]*ChurnedSeries, len(sc.active))
+	for i, series := range sc.active {
+		copied := *series
+		clone.active[i] = &copied
+		copies[series] = &copied
+	}
+	// The queue keeps its order, so it remains a heap
+	for i, series := range sc.retirements {
+		clone.retirements[i] = copies[series]
+	}
+	return clone
+}
+
+// Advance moves the active set to time t, in seconds: series whose lifetime
+// ended retire and those born since the previous step join, with spawn
+// drawing each one's source and tags. The first call fills the set to its
+// steady state, with series part-way through their lifetimes.
+func (sc *SeriesChurn) Advance(rng *rand.Rand, t float64, spawn func() (string, map[string]string)) {
+	if !sc.started {
+		sc.started = true
+		sc.clock = t
+		n := int(math.Min(math.Round(sc.ActiveSeries()), maxActiveSeries))
+		for i := 0; i < n; i++ {
+			// A series seen at a given moment is one of the long-lived, as
+			// lifetime is length biased, and is uniformly far through it
+			lifetime := sc.sizeBiasedLifetime(rng)
+			age := rng.Float64() * lifetime
+			sc.add(spawn, t-age, t-age+lifetime)
+		}
+		return
+	}
+	if t <= sc.clock {
+		return
+	}
+
+	// Births in order, each retiring any series that ended before it
+	if sc.params.BirthRate > 0 {
+		for born := sc.clock + rng.ExpFloat64()/sc.params.BirthRate; born <= t; born += rng.ExpFloat64() / sc.params.BirthRate {
+			sc.retire(born)
+			if len(sc.active) < maxActiveSeries {
+				sc.add(spawn, born, born+sc.lifetime(rng))
+			}
+		}
+	}
+	sc.retire(t)
+	sc.clock = t
+}
+
+// Pick returns a uniformly chosen active series, or nil when none is
+func (sc *SeriesChurn) Pick(rng *rand.Rand) *ChurnedSeries {
+	if len(sc.active) == 0 {
+		return nil
+	}
+	return sc.active[rng.Intn(len(sc.active))]
+}
+
+func (sc *SeriesChurn) add(spawn func() (string, map[string]string), born, retires float64) {
+	source, tags := spawn()
+	series := &ChurnedSeries{
+		Source:  source,
+		Tags:    tags,
+		Born:    born,
+		Retires: retires,
+		index:   len(sc.active),
+	}
+	sc.active = append(sc.active, series)
+	heap.Push(&sc.retirements, series)
+}
+
+// retire removes the series whose lifetimes ended by t
+func (sc *SeriesChurn) retire(t float64) {
+	for len(sc.retirements) > 0 && sc.retirements[0].Retires <= t {
+		series := heap.Pop(&sc.retirements).(*ChurnedSeries)
+		last := sc.active[len(sc.active)-1]
+		sc.active[series.index] = last
+		last.index = series.index
+		sc.active = sc.active[:len(sc.active)-1]
+	}
+}
+
+func (sc *SeriesChurn) lifetime(rng *rand.Rand) float64 {
+	if sc.params.Lifetimes != nil {
+		return math.Max(0, sc.params.Lifetimes.Sample(rng))
+	}
+	return rng.ExpFloat64() * sc.params.MeanLifetime
+}
+
+// sizeBiasedLifetime draws a lifetime weighted by its length
+func (sc *SeriesChurn) sizeBiasedLifetime(rng *rand.Rand) float64 {
+	if sc.params.Lifetimes == nil {
+		// The sum of two exponentials is the exponential's size-biased form
+		return (rng.ExpFloat64() + rng.ExpFloat64()) * sc.params.MeanLifetime
+	}
+
+	var draws [churnSizeBiasDraws]float64
+	total := 0.0
+	for i := range draws {
+		draws[i] = sc.lifetime(rng)
+		total += draws[i]
+	}
+	target := rng.Float64() * total
+	for _, lifetime := range draws {
+		target -= lifetime
+		if target < 0 {
+			return lifetime
+		}
+	}
+	return draws[len(draws)-1]
+}
+
+// retirementQueue is a min-heap of series by retirement time
+type retirementQueue []*ChurnedSeries
+
+func (q retirementQueue) Len() int           { return len(q) }
+func (q retirementQueue) Less(i, j int) bool { return q[i].Retires < q[j].Retires }
+func (q retirementQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *retirementQueue) Push(x interface{}) {
+	*q = append(*q, x.(*ChurnedSeries))
+}
+
+func (q *retirementQueue) Pop() interface{} {
+	old := *q
+	series := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return series
+}
@@ -0,0 +1,159 @@
+package payloadsynth
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// CorrelatedTagSampler samples tag values from conditional probability
+// tables built from pairwise co-occurrence, so a value drawn for one key
+// steers the values of the keys seen with it (a service implies its
+// region). Keys no table covers fall back to their marginal distribution.
+type CorrelatedTagSampler struct {
+	pairs []*tagPair
+}
+
+// tagPair is the joint distribution of two tag keys' top value pairs
+type tagPair struct {
+	keys     [2]string
+	rows     [][2]string
+	joint    weightedIndex
+	given    [2]map[string]weightedIndex // Rows by the value of keys[i]
+	coverage float64                     // Share of the pair's records the rows cover
+}
+
+// weightedIndex picks an index into rows by cumulative weight
+type weightedIndex struct {
+	rows       []int
+	cumulative []float64
+	total      float64
+}
+
+// NewCorrelatedTagSampler builds the tables from tag combinations of two
+// keys each, weighted by their share of the records carrying both keys.
+// Tables are consulted in the order their key pairs first appear, so the
+// strongest pairs should come first. Combinations of other sizes are
+// ignored.
+func NewCorrelatedTagSampler(combinations []TagCombination) *CorrelatedTagSampler {
+	cs := &CorrelatedTagSampler{}
+	byKeys := make(map[[2]string]*tagPair)
+
+	for _, combo := range combinations {
+		if len(combo.Tags) != 2 || combo.Weight <= 0 {
+			continue
+		}
+		var keys [2]string
+		i := 0
+		for key := range combo.Tags {
+			keys[i] = key
+			i++
+		}
+		if keys[0] > keys[1] {
+			keys[0], keys[1] = keys[1], keys[0]
+		}
+
+		pair, ok := byKeys[keys]
+		if !ok {
+			pair = &tagPair{
+				keys:  keys,
+				given: [2]map[string]weightedIndex{{}, {}},
+			}
+			byKeys[keys] = pair
+			cs.pairs = append(cs.pairs, pair)
+		}
+
+		row := len(pair.rows)
+		values := [2]string{combo.Tags[keys[0]], combo.Tags[keys[1]]}
+		pair.rows = append(pair.rows, values)
+		pair.joint.add(row, combo.Weight)
+		for side, value := range values {
+			index := pair.given[side][value]
+			index.add(row, combo.Weight)
+			pair.given[side][value] = index
+		}
+	}
+
+	for _, pair := range cs.pairs {
+		pair.coverage = math.Min(pair.joint.total, 1)
+	}
+	return cs
+}
+
+// Empty reports whether no key pair has a table
+func (cs *CorrelatedTagSampler) Empty() bool {
+	return len(cs.pairs) == 0
+}
+
+// Sample draws values for the given keys. Each table whose keys are both
+// requested draws its pair jointly, or one value given the other once that
+// is drawn, with the probability its rows cover; the remaining keys take
+// values from marginal, and keys it returns "" for are left out.
+func (cs *CorrelatedTagSampler) Sample(rng *rand.Rand, keys []string, marginal func(key string) string) map[string]string {
+	requested := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		requested[key] = true
+	}
+
+	tags := make(map[string]string, len(keys))
+	for _, pair := range cs.pairs {
+		if !requested[pair.keys[0]] || !requested[pair.keys[1]] {
+			continue
+		}
+		first, haveFirst := tags[pair.keys[0]]
+		second, haveSecond := tags[pair.keys[1]]
+		if haveFirst && haveSecond {
+			continue
+		}
+		if rng.Float64() >= pair.coverage {
+			continue
+		}
+
+		switch {
+		case !haveFirst && !haveSecond:
+			row := pair.rows[pair.joint.sample(rng)]
+			tags[pair.keys[0]], tags[pair.keys[1]] = row[0], row[1]
+		case haveFirst:
+			if index, ok := pair.given[0][first]; ok {
+				tags[pair.keys[1]] = pair.rows[index.sample(rng)][1]
+			}
+		case haveSecond:
+			if index, ok := pair.given[1][second]; ok {
+				tags[pair.keys[0]] = pair.rows[index.sample(rng)][0]
+			}
+		}
+	}
+
+	// Sorted so a seeded generator is reproducible
+	remaining := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := tags[key]; !ok {
+			remaining = append(remaining, key)
+		}
+	}
+	sort.Strings(remaining)
+	for _, key := range remaining {
+		if value := marginal(key); value != "" {
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
+
+func (w *weightedIndex) add(row int, weight float64) {
+	w.total += weight
+	w.rows = append(w.rows, row)
+	w.cumulative = append(w.cumulative, w.total)
+}
+
+func (w *weightedIndex) sample(rng *rand.Rand) int {
+	target := rng.Float64() * w.total
+	idx := sort.Search(len(w.cumulative), func(i int) bool {
+		return w.cumulative[i] > target
+	})
+	if idx >= len(w.rows) {
+		idx = len(w.rows) - 1
+	}
+	return w.rows[idx]
+}
@@ -0,0 +1,167 @@
+package payloadsynth
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+// StringGenerator produces synthetic string values such as sources and tag
+// values
+type StringGenerator interface {
+	Generate(rng *rand.Rand) string
+}
+
+// defaultMarkovMaxLength caps generated strings when a model records no
+// maximum length; it is the longest DNS name
+const defaultMarkovMaxLength = 253
+
+// MarkovModel is a character n-gram model as recorded in a recipe.
+// Transitions maps a context, the previous Order characters, to counts of
+// the character that followed it. Contexts at the start of a string are
+// shorter than Order, the first character following the empty context,
+// and the empty next character marks the end of a string.
+type MarkovModel struct {
+	Order       int
+	Transitions map[string]map[string]float64
+	MaxLength   int // Longest string generated, in characters
+}
+
+// MarkovSampler generates strings character by character from a MarkovModel.
+// A context the model never saw backs off to the counts of its longest
+// suffix that was seen anywhere in a string.
+type MarkovSampler struct {
+	order     int
+	maxLength int
+	states    map[string]*markovState
+	backoff   []map[string]*markovState // By suffix length, 0 to order-1
+}
+
+type markovState struct {
+	next       []string
+	cumulative []float64
+	total      float64
+}
+
+// NewMarkovSampler creates a sampler from a trained model
+func NewMarkovSampler(model MarkovModel) (*MarkovSampler, error) {
+	if model.Order < 1 {
+		return nil, errors.New("markov model order must be at least 1")
+	}
+
+	ms := &MarkovSampler{
+		order:     model.Order,
+		maxLength: model.MaxLength,
+		states:    make(map[string]*markovState),
+		backoff:   make([]map[string]*markovState, model.Order),
+	}
+	if ms.maxLength <= 0 {
+		ms.maxLength = defaultMarkovMaxLength
+	}
+
+	backoffCounts := make([]map[string]map[string]float64, model.Order)
+	for i := range backoffCounts {
+		backoffCounts[i] = make(map[string]map[string]float64)
+	}
+	for context, counts := range model.Transitions {
+		runes := []rune(context)
+		if len(runes) > model.Order {
+			continue
+		}
+		if state := newMarkovState(counts); state != nil {
+			ms.states[context] = state
+		}
+		for length := 0; length < len(runes) || length == 0; length++ {
+			suffix := string(runes[len(runes)-length:])
+			if backoffCounts[length][suffix] == nil {
+				backoffCounts[length][suffix] = make(map[string]float64)
+			}
+			for next, count := range counts {
+				backoffCounts[length][suffix][next] += count
+			}
+		}
+	}
+	for length, contexts := range backoffCounts {
+		ms.backoff[length] = make(map[string]*markovState)
+		for suffix, counts := range contexts {
+			if state := newMarkovState(counts); state != nil {
+				ms.backoff[length][suffix] = state
+			}
+		}
+	}
+
+	if len(ms.states) == 0 {
+		return nil, errors.New("markov model has no transitions")
+	}
+	return ms, nil
+}
+
+func newMarkovState(counts map[string]float64) *markovState {
+	next := make([]string, 0, len(counts))
+	for char, count := range counts {
+		if count > 0 {
+			next = append(next, char)
+		}
+	}
+	if len(next) == 0 {
+		return nil
+	}
+	// Map order is random; sort so a seeded generator is reproducible
+	sort.Strings(next)
+
+	state := &markovState{
+		next:       next,
+		cumulative: make([]float64, len(next)),
+	}
+	for i, char := range next {
+		state.total += counts[char]
+		state.cumulative[i] = state.total
+	}
+	return state
+}
+
+// Generate creates a string by walking the model from the start context
+// until it emits the end of the string or reaches the maximum length
+func (ms *MarkovSampler) Generate(rng *rand.Rand) string {
+	var result []rune
+	for len(result) < ms.maxLength {
+		start := len(result) - ms.order
+		if start < 0 {
+			start = 0
+		}
+		state := ms.state(result[start:])
+		if state == nil {
+			break
+		}
+
+		next := state.sample(rng)
+		if next == "" {
+			break
+		}
+		result = append(result, []rune(next)...)
+	}
+	return string(result)
+}
+
+func (ms *MarkovSampler) state(context []rune) *markovState {
+	if state, ok := ms.states[string(context)]; ok {
+		return state
+	}
+	for length := len(context) - 1; length >= 0; length-- {
+		if state, ok := ms.backoff[length][string(context[len(context)-length:])]; ok {
+			return state
+		}
+	}
+	return nil
+}
+
+func (s *markovState) sample(rng *rand.Rand) string {
+	target := rng.Float64() * s.total
+	idx := sort.Search(len(s.cumulative), func(i int) bool {
+		return s.cumulative[i] > target
+	})
+	if idx >= len(s.next) {
+		idx = len(s.next) - 1
+	}
+	return s.next[idx]
+}
@@ -0,0 +1,399 @@
+package payloadsynth
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// QuantilePoint is one recorded quantile of a value distribution
+type QuantilePoint struct {
+	Level float64 // In (0, 1)
+	Value float64
+}
+
+// PointMass is a single value carrying a share of the samples, like the
+// zeros of an idle counter
+type PointMass struct {
+	Value  float64
+	Weight float64 // Share of all samples
+}
+
+// ValueProfile is what a recipe records of a value distribution
+type ValueProfile struct {
+	Quantiles   []QuantilePoint
+	Bins        []float64 // Histogram edges, n+1 for n bins
+	Counts      []float64 // Samples per bin, point masses included
+	Min, Max    *float64  // Observed range, if recorded
+	PointMasses []PointMass
+}
+
+// Body distributions of a mixture
+const (
+	BodyHistogram = "histogram"
+	BodyLogNormal = "lognormal"
+	BodyNormal    = "normal"
+)
+
+// MixtureModel is a value distribution fit from a recipe: point masses at
+// common values, a body drawn from the histogram when it has counts or
+// else lognormal (normal for values that are not all positive) through
+// the quantiles, and a Pareto tail above the upper quantiles. Unlike
+// interpolating the quantiles it keeps the modes of the histogram and the
+// heavy tail beyond p99.
+type MixtureModel struct {
+	PointMasses []PointMass
+	Body        string
+	TailStart   float64 // Pareto tail above TailStart, if TailWeight > 0
+	TailAlpha   float64
+	TailWeight  float64
+
+	min, max   float64 // Samples are clamped to the observed range
+	components []mixtureComponent
+	cumulative []float64
+	total      float64
+}
+
+type mixtureComponent struct {
+	weight float64
+	sample func(rng *rand.Rand) float64
+}
+
+// FitMixture fits a mixture to a value profile. It needs at least three
+// quantiles.
+func FitMixture(profile ValueProfile) (*MixtureModel, error) {
+	quantiles := make([]QuantilePoint, 0, len(profile.Quantiles))
+	for _, q := range profile.Quantiles {
+		if q.Level > 0 && q.Level < 1 && !math.IsNaN(q.Value) && !math.IsInf(q.Value, 0) {
+			quantiles = append(quantiles, q)
+		}
+	}
+	if len(quantiles) < 3 {
+		return nil, errors.New("at least three quantiles are required")
+	}
+	sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].Level < quantiles[j].Level })
+	for i := 1; i < len(quantiles); i++ {
+		quantiles[i].Value = math.Max(quantiles[i].Value, quantiles[i-1].Value)
+	}
+
+	m := &MixtureModel{min: math.Inf(-1), max: math.Inf(1)}
+	if profile.Min != nil {
+		m.min = *profile.Min
+	}
+	if profile.Max != nil {
+		m.max = *profile.Max
+	}
+
+	// Point masses, scaled down if they claim more than every sample
+	massWeight := 0.0
+	for _, pm := range profile.PointMasses {
+		if pm.Weight > 0 {
+			m.PointMasses = append(m.PointMasses, pm)
+			massWeight += pm.Weight
+		}
+	}
+	if massWeight > 1 {
+		for i := range m.PointMasses {
+			m.PointMasses[i].Weight /= massWeight
+		}
+		massWeight = 1
+	}
+	for _, pm := range m.PointMasses {
+		value := pm.Value
+		m.add(pm.Weight, func(*rand.Rand) float64 { return value })
+	}
+	continuous := 1 - massWeight
+	if continuous < 1e-9 {
+		return m, nil
+	}
+
+	// The quantiles of the values outside the point masses
+	points := continuousQuantiles(quantiles, m.PointMasses, continuous)
+	if len(points) < 2 {
+		// Everything left sits between the point masses
+		lo, hi := quantiles[0].Value, quantiles[len(quantiles)-1].Value
+		m.Body = BodyHistogram
+		m.add(continuous, func(rng *rand.Rand) float64 { return lo + rng.Float64()*(hi-lo) })
+		return m, nil
+	}
+
+	// The tail's index from the two highest quantiles
+	t, top := points[len(points)-2], points[len(points)-1]
+	if t.Value > 0 && top.Value > t.Value {
+		m.TailAlpha = math.Log((1-t.Level)/(1-top.Level)) / math.Log(top.Value/t.Value)
+	}
+
+	if hasHistogram(profile) {
+		m.fitHistogram(profile, quantiles, continuous)
+	} else {
+		m.fitParametric(points, continuous)
+	}
+	return m, nil
+}
+
+// NewMixtureSampler fits a mixture to a value profile and samples from it.
+func NewMixtureSampler(profile ValueProfile) (*NumericSampler, error) {
+	m, err := FitMixture(profile)
+	if err != nil {
+		return nil, err
+	}
+	quantiles := make([]float64, len(profile.Quantiles))
+	for i, q := range profile.Quantiles {
+		quantiles[i] = q.Value
+	}
+	sort.Float64s(quantiles)
+	return &NumericSampler{quantiles: quantiles, sampler: m.Sample}, nil
+}
+
+// Sample draws a value.
+func (m *MixtureModel) Sample(rng *rand.Rand) float64 {
+	if len(m.components) == 0 {
+		return 0
+	}
+	target := rng.Float64() * m.total
+	idx := sort.Search(len(m.cumulative), func(i int) bool {
+		return m.cumulative[i] >= target
+	})
+	if idx >= len(m.components) {
+		idx = len(m.components) - 1
+	}
+	value := m.components[idx].sample(rng)
+	return math.Min(math.Max(value, m.min), m.max)
+}
+
+func (m *MixtureModel) add(weight float64, sample func(rng *rand.Rand) float64) {
+	if weight <= 0 {
+		return
+	}
+	m.total += weight
+	m.components = append(m.components, mixtureComponent{weight: weight, sample: sample})
+	m.cumulative = append(m.cumulative, m.total)
+}
+
+// addTail adds a Pareto tail above start, truncated at the observed
+// maximum, or the values above start uniformly up to the maximum if no
+// tail index could be fit.
+func (m *MixtureModel) addTail(start, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	alpha, upper := m.TailAlpha, m.max
+	if alpha <= 0 || start <= 0 {
+		if math.IsInf(upper, 1) || upper <= start {
+			m.add(weight, func(*rand.Rand) float64 { return start })
+		} else {
+			m.add(weight, func(rng *rand.Rand) float64 { return start + rng.Float64()*(upper-start) })
+		}
+		return
+	}
+	m.TailStart, m.TailWeight = start, weight
+	cut := 0.0 // Share of the untruncated tail above the maximum
+	if !math.IsInf(upper, 1) && upper > start {
+		cut = math.Pow(start/upper, alpha)
+	}
+	m.add(weight, func(rng *rand.Rand) float64 {
+		u := 1 - rng.Float64()*(1-cut)
+		return start * math.Pow(u, -1/alpha)
+	})
+}
+
+// fitHistogram draws the body from the histogram's bins, uniformly within
+// each, with the point masses taken out of the bins they fall in. Values
+// below the first edge are drawn down to the minimum, and values above
+// the last from the tail.
+func (m *MixtureModel) fitHistogram(profile ValueProfile, quantiles []QuantilePoint, continuous float64) {
+	bins := profile.Bins
+	n := len(profile.Counts)
+	lo, hi := bins[0], bins[n]
+	m.Body = BodyHistogram
+
+	// Counts per unit of all samples, to take the point masses out
+	covered := interpolateLevel(quantiles, hi) - interpolateLevel(quantiles, lo)
+	total := 0.0
+	for _, count := range profile.Counts {
+		total += count
+	}
+	counts := append([]float64(nil), profile.Counts...)
+	if covered > 0 {
+		for _, pm := range m.PointMasses {
+			if pm.Value < lo || pm.Value > hi {
+				continue
+			}
+			i := sort.SearchFloat64s(bins, pm.Value) - 1
+			i = min(max(i, 0), n-1)
+			counts[i] = math.Max(0, counts[i]-pm.Weight*total/covered)
+		}
+	}
+	remaining := 0.0
+	for _, count := range counts {
+		remaining += count
+	}
+
+	below := continuousLevel(quantiles, m.PointMasses, continuous, lo)
+	above := 1 - continuousLevel(quantiles, m.PointMasses, continuous, hi)
+	body := continuous * math.Max(0, 1-below-above)
+	if remaining <= 0 {
+		// The point masses took every count; spread the body evenly
+		for i := range counts {
+			counts[i] = 1
+		}
+		remaining = float64(n)
+	}
+	for i, count := range counts {
+		left, right := bins[i], bins[i+1]
+		m.add(body*count/remaining, func(rng *rand.Rand) float64 { return left + rng.Float64()*(right-left) })
+	}
+
+	if weight := continuous * below; weight > 0 {
+		floor := m.min
+		if math.IsInf(floor, -1) || floor >= lo {
+			floor = lo
+		}
+		m.add(weight, func(rng *rand.Rand) float64 { return floor + rng.Float64()*(lo-floor) })
+	}
+	m.addTail(hi, continuous*above)
+}
+
+// fitParametric draws the body from a lognormal, or a normal if the
+// values are not all positive, between each pair of quantiles below the
+// tail: the (log) value is linear in the normal score of the level, so
+// the body passes through every quantile, and carries on at the slope of
+// the lowest pair below the lowest quantile. The tail is added above.
+func (m *MixtureModel) fitParametric(points []QuantilePoint, continuous float64) {
+	body := points
+	tailStart, tailWeight := math.Inf(1), 0.0
+	if m.TailAlpha > 0 && len(points) >= 3 {
+		t := points[len(points)-2]
+		tailStart, tailWeight = t.Value, continuous*(1-t.Level)
+		body = points[:len(points)-1]
+	}
+
+	m.Body = BodyLogNormal
+	for _, p := range body {
+		if p.Value <= 0 {
+			m.Body = BodyNormal
+		}
+	}
+	scale := func(x float64) float64 { return x }
+	unscale := func(y float64) float64 { return y }
+	if m.Body == BodyLogNormal {
+		scale, unscale = math.Log, math.Exp
+	}
+
+	zs := make([]float64, len(body))
+	ys := make([]float64, len(body))
+	for i, p := range body {
+		zs[i], ys[i] = normalQuantile(p.Level), scale(p.Value)
+	}
+	n := len(body) - 1
+	lowSlope := (ys[1] - ys[0]) / (zs[1] - zs[0])
+	highSlope := (ys[n] - ys[n-1]) / (zs[n] - zs[n-1])
+	valueAt := func(z float64) float64 {
+		switch {
+		case z <= zs[0]:
+			return ys[0] + lowSlope*(z-zs[0])
+		case z >= zs[n]:
+			return ys[n] + highSlope*(z-zs[n])
+		}
+		i := sort.SearchFloat64s(zs, z)
+		return ys[i-1] + (ys[i]-ys[i-1])*(z-zs[i-1])/(zs[i]-zs[i-1])
+	}
+
+	// Levels between the observed minimum and the tail
+	pLo, pHi := 0.0, 1.0
+	if !math.IsInf(m.min, -1) && (m.Body == BodyNormal || m.min > 0) && lowSlope > 0 && scale(m.min) < ys[0] {
+		pLo = normalCDF(zs[0] + (scale(m.min)-ys[0])/lowSlope)
+	}
+	if tailWeight > 0 {
+		pHi = body[n].Level
+	}
+	m.add(continuous-tailWeight, func(rng *rand.Rand) float64 {
+		p := math.Min(math.Max(pLo+rng.Float64()*(pHi-pLo), 1e-12), 1-1e-12)
+		return unscale(valueAt(normalQuantile(p)))
+	})
+	if tailWeight > 0 {
+		m.addTail(tailStart, tailWeight)
+	}
+}
+
+// continuousQuantiles maps quantiles of all the values to quantiles of the
+// values outside the point masses, dropping those that fall on a mass.
+func continuousQuantiles(quantiles []QuantilePoint, masses []PointMass, continuous float64) []QuantilePoint {
+	points := make([]QuantilePoint, 0, len(quantiles))
+	for _, q := range quantiles {
+		below, on := 0.0, false
+		for _, pm := range masses {
+			switch {
+			case pm.Value < q.Value:
+				below += pm.Weight
+			case pm.Value == q.Value:
+				on = true
+			}
+		}
+		if on {
+			continue
+		}
+		level := (q.Level - below) / continuous
+		if level <= 0 || level >= 1 {
+			continue
+		}
+		if n := len(points); n > 0 && (level <= points[n-1].Level || q.Value <= points[n-1].Value) {
+			continue
+		}
+		points = append(points, QuantilePoint{Level: level, Value: q.Value})
+	}
+	return points
+}
+
+// interpolateLevel is the level at value x, linearly between the quantiles
+// and clamped to the outermost ones. Of quantiles tied at x, it is the
+// highest.
+func interpolateLevel(points []QuantilePoint, x float64) float64 {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Value > x })
+	switch i {
+	case 0:
+		return points[0].Level
+	case len(points):
+		return points[len(points)-1].Level
+	}
+	prev, next := points[i-1], points[i]
+	return prev.Level + (x-prev.Value)/(next.Value-prev.Value)*(next.Level-prev.Level)
+}
+
+// continuousLevel is the level at value x among the values outside the
+// point masses.
+func continuousLevel(quantiles []QuantilePoint, masses []PointMass, continuous, x float64) float64 {
+	level := interpolateLevel(quantiles, x)
+	for _, pm := range masses {
+		if pm.Value <= x {
+			level -= pm.Weight
+		}
+	}
+	return math.Min(math.Max(level/continuous, 0), 1)
+}
+
+func hasHistogram(profile ValueProfile) bool {
+	if len(profile.Counts) == 0 || len(profile.Bins) != len(profile.Counts)+1 {
+		return false
+	}
+	for i := 1; i < len(profile.Bins); i++ {
+		if profile.Bins[i] <= profile.Bins[i-1] {
+			return false
+		}
+	}
+	for _, count := range profile.Counts {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+func normalCDF(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
@@ -0,0 +1,135 @@
+package payloadsynth
+
+import (
+	"math/rand"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// maxUnboundedRepeat is how many repetitions beyond the minimum *, + and
+// {n,} may generate
+const maxUnboundedRepeat = 8
+
+// Printable ASCII, preferred whenever a class or wildcard allows it so
+// generated values stay usable as sources and tag values
+const (
+	printableFirst = 0x20
+	printableLast  = 0x7e
+)
+
+// compilePattern parses a pattern into the regex syntax tree it is expanded
+// from. A pattern that does not parse is expanded as a literal string.
+func compilePattern(pattern string) *syntax.Regexp {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		re, _ = syntax.Parse(regexp.QuoteMeta(pattern), syntax.Perl)
+	}
+	return re
+}
+
+// expandRegexp generates a random string matched by the syntax tree
+func expandRegexp(re *syntax.Regexp, rng *rand.Rand) string {
+	var result strings.Builder
+	writeRegexp(&result, re, rng)
+	return result.String()
+}
+
+func writeRegexp(b *strings.Builder, re *syntax.Regexp, rng *rand.Rand) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && rng.Intn(2) == 0 {
+				r = unicode.SimpleFold(r)
+			}
+			b.WriteRune(r)
+		}
+	case syntax.OpCharClass:
+		if r, ok := sampleRanges(re.Rune, rng); ok {
+			b.WriteRune(r)
+		}
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		b.WriteRune(rune(printableFirst + rng.Intn(printableLast-printableFirst+1)))
+	case syntax.OpCapture:
+		writeRegexp(b, re.Sub[0], rng)
+	case syntax.OpStar:
+		writeRepeat(b, re.Sub[0], 0, -1, rng)
+	case syntax.OpPlus:
+		writeRepeat(b, re.Sub[0], 1, -1, rng)
+	case syntax.OpQuest:
+		writeRepeat(b, re.Sub[0], 0, 1, rng)
+	case syntax.OpRepeat:
+		writeRepeat(b, re.Sub[0], re.Min, re.Max, rng)
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			writeRegexp(b, sub, rng)
+		}
+	case syntax.OpAlternate:
+		writeRegexp(b, re.Sub[rng.Intn(len(re.Sub))], rng)
+	default:
+		// Empty matches, anchors and word boundaries generate nothing
+	}
+}
+
+// writeRepeat writes between least and most repetitions of re; a negative
+// most is unbounded
+func writeRepeat(b *strings.Builder, re *syntax.Regexp, least, most int, rng *rand.Rand) {
+	if most < 0 {
+		most = least + maxUnboundedRepeat
+	}
+	count := least
+	if most > least {
+		count += rng.Intn(most - least + 1)
+	}
+	for i := 0; i < count; i++ {
+		writeRegexp(b, re, rng)
+	}
+}
+
+// sampleRanges picks a rune uniformly from a character class given as
+// inclusive [lo, hi] pairs, from its printable ASCII part when it has one
+func sampleRanges(ranges []rune, rng *rand.Rand) (rune, bool) {
+	if r, ok := sampleWithin(ranges, printableFirst, printableLast, rng); ok {
+		return r, true
+	}
+	// Surrogates are not valid in UTF-8, so leave them out
+	valid := make([]rune, 0, len(ranges)+2)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < 0xd800 {
+			valid = append(valid, lo, min(hi, 0xd7ff))
+		}
+		if hi > 0xdfff {
+			valid = append(valid, max(lo, 0xe000), hi)
+		}
+	}
+	return sampleWithin(valid, 0, unicode.MaxRune, rng)
+}
+
+// sampleWithin picks a rune uniformly from the class clipped to [lo, hi]
+func sampleWithin(ranges []rune, lo, hi rune, rng *rand.Rand) (rune, bool) {
+	total := 0
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if from, to := max(ranges[i], lo), min(ranges[i+1], hi); from <= to {
+			total += int(to - from + 1)
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	target := rng.Intn(total)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		from, to := max(ranges[i], lo), min(ranges[i+1], hi)
+		if from > to {
+			continue
+		}
+		if size := int(to - from + 1); target >= size {
+			target -= size
+			continue
+		}
+		return from + rune(target), true
+	}
+	return 0, false
+}
@@ -0,0 +1,111 @@
+package payloadsynth
+
+import (
+	"math/rand"
+	"regexp"
+	"regexp/syntax"
+	"testing"
+)
+
+// maxFuzzExpansion bounds the expansions fuzzed, since nested repetition
+// makes them grow exponentially
+const maxFuzzExpansion = 1 << 12
+
+// FuzzExpandRegexp checks that every expansion of a pattern is matched by it
+func FuzzExpandRegexp(f *testing.F) {
+	for _, pattern := range []string{
+		`web-[0-9]{2}`,
+		`(us|eu|ap)-(east|west)-[1-3]`,
+		`[a-f0-9]{8}-[a-f0-9]{4}`,
+		`ip-10-\d{1,3}-\d{1,3}\.ec2\.internal`,
+		`(?i)prod-[a-z]+`,
+		`.+\..*`,
+		`[^a-z]{3,}`,
+		`x(y(z|w)?)*`,
+		`[\p{Greek}\x{1F600}-\x{1F64F}]+`,
+		`a{0}b{2,5}`,
+	} {
+		f.Add(pattern, int64(1))
+	}
+
+	f.Fuzz(func(t *testing.T, pattern string, seed int64) {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil || !satisfiable(re) || longestExpansion(re) > maxFuzzExpansion {
+			t.Skip()
+		}
+		// An unterminated \Q quotes the wrapping too
+		matcher, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			t.Skip()
+		}
+
+		rng := rand.New(rand.NewSource(seed))
+		for i := 0; i < 10; i++ {
+			if expanded := expandRegexp(re, rng); !matcher.MatchString(expanded) {
+				t.Fatalf("pattern %q expanded to %q, which it does not match", pattern, expanded)
+			}
+		}
+	})
+}
+
+// satisfiable reports whether expandRegexp can satisfy the syntax tree: it
+// has no anchors or word boundaries, which expansion ignores, and no
+// character class without a valid rune
+func satisfiable(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpNoMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return false
+	case syntax.OpCharClass:
+		if _, ok := sampleRanges(re.Rune, rand.New(rand.NewSource(1))); !ok {
+			return false
+		}
+	}
+	for _, sub := range re.Sub {
+		if !satisfiable(sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// longestExpansion bounds the runes an expansion of the syntax tree writes,
+// saturating past maxFuzzExpansion
+func longestExpansion(re *syntax.Regexp) int {
+	repeat := func(most int) int {
+		n := longestExpansion(re.Sub[0]) * most
+		return min(n, maxFuzzExpansion+1)
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCharClass, syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return 1
+	case syntax.OpCapture:
+		return longestExpansion(re.Sub[0])
+	case syntax.OpStar:
+		return repeat(maxUnboundedRepeat)
+	case syntax.OpPlus:
+		return repeat(1 + maxUnboundedRepeat)
+	case syntax.OpQuest:
+		return repeat(1)
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return repeat(re.Min + maxUnboundedRepeat)
+		}
+		return repeat(re.Max)
+	case syntax.OpConcat:
+		total := 0
+		for _, sub := range re.Sub {
+			total = min(total+longestExpansion(sub), maxFuzzExpansion+1)
+		}
+		return total
+	case syntax.OpAlternate:
+		longest := 0
+		for _, sub := range re.Sub {
+			longest = max(longest, longestExpansion(sub))
+		}
+		return longest
+	}
+	return 0
+}
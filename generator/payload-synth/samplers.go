@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"regexp"
+	"regexp/syntax"
 	"sort"
-	"strconv"
-	"strings"
+
+	"github.com/loadgen/payload-synth/temporal"
 )
 
 // WeightedItem represents an item with an associated weight for sampling
@@ -21,6 +21,7 @@ type CategoricalSampler struct {
 	items       []WeightedItem
 	cumulativeWeights []float64
 	totalWeight float64
+	tail        *zipfTail
 }
 
 // NewCategoricalSampler creates a new categorical sampler
@@ -49,6 +50,10 @@ func NewCategoricalSampler(items []WeightedItem) *CategoricalSampler {
 
 // Sample returns a random value according to the weighted distribution
 func (cs *CategoricalSampler) Sample(rng *rand.Rand) string {
+	if cs.tail != nil && (len(cs.items) == 0 || rng.Float64() < cs.tail.mass) {
+		return cs.tail.sample(rng)
+	}
+
 	if len(cs.items) == 0 {
 		return ""
 	}
@@ -71,6 +76,12 @@ func (cs *CategoricalSampler) Sample(rng *rand.Rand) string {
 	return cs.items[idx].Value
 }
 
+// Generate returns a sampled value, so that the sampler is a
+// StringGenerator
+func (cs *CategoricalSampler) Generate(rng *rand.Rand) string {
+	return cs.Sample(rng)
+}
+
 // NumericSampler samples from a numeric distribution
 type NumericSampler struct {
 	quantiles []float64
@@ -152,9 +163,10 @@ type WeightedPattern struct {
 	Weight  float64
 }
 
-// StringPatternSampler generates strings based on regex-like patterns
+// StringPatternSampler generates strings matching weighted regex patterns
 type StringPatternSampler struct {
 	patterns      []WeightedPattern
+	compiled      []*syntax.Regexp
 	cumulativeWeights []float64
 	totalWeight   float64
 }
@@ -170,6 +182,7 @@ func NewStringPatternSampler(patterns []WeightedPattern) *StringPatternSampler {
 
 	sampler := &StringPatternSampler{
 		patterns: make([]WeightedPattern, len(patterns)),
+		compiled: make([]*syntax.Regexp, len(patterns)),
 		cumulativeWeights: make([]float64, len(patterns)),
 	}
 
@@ -178,6 +191,7 @@ func NewStringPatternSampler(patterns []WeightedPattern) *StringPatternSampler {
 	// Calculate cumulative weights
 	cumulative := 0.0
 	for i, pattern := range sampler.patterns {
+		sampler.compiled[i] = compilePattern(pattern.Pattern)
 		cumulative += pattern.Weight
 		sampler.cumulativeWeights[i] = cumulative
 	}
@@ -202,116 +216,7 @@ func (sps *StringPatternSampler) Generate(rng *rand.Rand) string {
 		idx = len(sps.patterns) - 1
 	}
 
-	pattern := sps.patterns[idx].Pattern
-	return sps.expandPattern(pattern, rng)
-}
-
-func (sps *StringPatternSampler) expandPattern(pattern string, rng *rand.Rand) string {
-	// Simple pattern expansion (can be made more sophisticated)
-	result := pattern
-
-	// Replace common patterns
-	result = sps.replacePattern(result, `\\d\+`, func() string {
-		length := 1 + rng.Intn(4) // 1-4 digits
-		return sps.generateDigits(rng, length)
-	})
-
-	result = sps.replacePattern(result, `\\d\{(\d+)\}`, func(matches ...string) string {
-		if len(matches) > 1 {
-			if length, err := strconv.Atoi(matches[1]); err == nil {
-				return sps.generateDigits(rng, length)
-			}
-		}
-		return "123"
-	})
-
-	result = sps.replacePattern(result, `\[a-z\]\+`, func() string {
-		length := 3 + rng.Intn(5) // 3-7 characters
-		return sps.generateLowercase(rng, length)
-	})
-
-	result = sps.replacePattern(result, `\[a-z\]\{(\d+)\}`, func(matches ...string) string {
-		if len(matches) > 1 {
-			if length, err := strconv.Atoi(matches[1]); err == nil {
-				return sps.generateLowercase(rng, length)
-			}
-		}
-		return "abc"
-	})
-
-	result = sps.replacePattern(result, `\[A-Z\]\+`, func() string {
-		length := 3 + rng.Intn(5) // 3-7 characters
-		return sps.generateUppercase(rng, length)
-	})
-
-	result = sps.replacePattern(result, `\[A-Z\]\{(\d+)\}`, func(matches ...string) string {
-		if len(matches) > 1 {
-			if length, err := strconv.Atoi(matches[1]); err == nil {
-				return sps.generateUppercase(rng, length)
-			}
-		}
-		return "ABC"
-	})
-
-	result = sps.replacePattern(result, `\[a-zA-Z0-9\]\+`, func() string {
-		length := 5 + rng.Intn(10) // 5-14 characters
-		return sps.generateAlphanumeric(rng, length)
-	})
-
-	return result
-}
-
-func (sps *StringPatternSampler) replacePattern(input, pattern string, replacer interface{}) string {
-	re := regexp.MustCompile(pattern)
-	
-	switch r := replacer.(type) {
-	case func() string:
-		return re.ReplaceAllStringFunc(input, func(string) string {
-			return r()
-		})
-	case func(...string) string:
-		return re.ReplaceAllStringFunc(input, func(match string) string {
-			matches := re.FindStringSubmatch(match)
-			return r(matches...)
-		})
-	default:
-		return input
-	}
-}
-
-func (sps *StringPatternSampler) generateDigits(rng *rand.Rand, length int) string {
-	var result strings.Builder
-	for i := 0; i < length; i++ {
-		result.WriteString(strconv.Itoa(rng.Intn(10)))
-	}
-	return result.String()
-}
-
-func (sps *StringPatternSampler) generateLowercase(rng *rand.Rand, length int) string {
-	const chars = "abcdefghijklmnopqrstuvwxyz"
-	var result strings.Builder
-	for i := 0; i < length; i++ {
-		result.WriteByte(chars[rng.Intn(len(chars))])
-	}
-	return result.String()
-}
-
-func (sps *StringPatternSampler) generateUppercase(rng *rand.Rand, length int) string {
-	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	var result strings.Builder
-	for i := 0; i < length; i++ {
-		result.WriteByte(chars[rng.Intn(len(chars))])
-	}
-	return result.String()
-}
-
-func (sps *StringPatternSampler) generateAlphanumeric(rng *rand.Rand, length int) string {
-	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var result strings.Builder
-	for i := 0; i < length; i++ {
-		result.WriteByte(chars[rng.Intn(len(chars))])
-	}
-	return result.String()
+	return expandRegexp(sps.compiled[idx], rng)
 }
 
 // TimeSampler generates realistic timestamp distributions
@@ -319,7 +224,7 @@ type TimeSampler struct {
 	baseTime   int64
 	pattern    string // "uniform", "poisson", "bursty"
 	intensity  []float64
-	burstiness float64
+	process    *temporal.Process // Hawkes process behind the bursty pattern
 }
 
 // NewTimeSampler creates a time-based sampler
@@ -328,7 +233,18 @@ func NewTimeSampler(baseTime int64, pattern string, intensity []float64) *TimeSa
 		baseTime:  baseTime,
 		pattern:   pattern,
 		intensity: intensity,
-		burstiness: 1.0,
+		process:   temporal.NewProcess(temporal.DefaultParams()),
+	}
+}
+
+// NewHawkesTimeSampler creates a bursty sampler whose intervals come from a
+// Hawkes process with the given kernel
+func NewHawkesTimeSampler(baseTime int64, intensity []float64, params temporal.Params) *TimeSampler {
+	return &TimeSampler{
+		baseTime:  baseTime,
+		pattern:   "bursty",
+		intensity: intensity,
+		process:   temporal.NewProcess(params),
 	}
 }
 
@@ -346,10 +262,7 @@ func (ts *TimeSampler) SampleInterval(rng *rand.Rand, currentMinute int) float64
 	case "poisson":
 		return rng.ExpFloat64() * baseInterval
 	case "bursty":
-		if rng.Float64() < 0.1 { // 10% chance of burst
-			return baseInterval / (1.0 + ts.burstiness*rng.Float64())
-		}
-		return rng.ExpFloat64() * baseInterval * 2.0
+		return ts.process.NextInterval(rng, 1.0/baseInterval)
 	default: // uniform
 		return baseInterval * (0.5 + rng.Float64())
 	}
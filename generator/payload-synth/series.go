@@ -0,0 +1,102 @@
+package payloadsynth
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Sizing of a SeriesModel
+const (
+	// seriesMarginalDraws is how many draws of the value sampler make up the
+	// inverse CDF series values are mapped through
+	seriesMarginalDraws = 8192
+
+	// maxSeriesStates bounds the series a model remembers; past it every
+	// series restarts from a fresh stationary draw
+	maxSeriesStates = 100000
+
+	// maxSeriesCorrelation keeps a series from freezing at one value
+	maxSeriesCorrelation = 0.999
+)
+
+// SeriesModel evolves the values of each series (a source and its tags) as a
+// mean-reverting random walk, so consecutive points of a series move
+// smoothly instead of being independent draws. Each series holds a standard
+// normal AR(1) state, mapped through the value sampler's distribution, so the
+// values of all series together still follow that distribution.
+type SeriesModel struct {
+	phi      float64
+	marginal []float64 // Sorted draws of the value sampler
+	states   map[string]float64
+}
+
+// NewSeriesModel creates a model whose series have lag-one autocorrelation
+// phi and values distributed like sampler's
+func NewSeriesModel(sampler *NumericSampler, phi float64, rng *rand.Rand) *SeriesModel {
+	marginal := make([]float64, seriesMarginalDraws)
+	for i := range marginal {
+		marginal[i] = sampler.Sample(rng)
+	}
+	sort.Float64s(marginal)
+
+	return &SeriesModel{
+		phi:      math.Max(-maxSeriesCorrelation, math.Min(phi, maxSeriesCorrelation)),
+		marginal: marginal,
+		states:   make(map[string]float64),
+	}
+}
+
+// FitAR1 fits the lag-one coefficient of an AR(1) process, whose
+// autocorrelation at lag k is phi^k, to autocorrelations measured at the
+// given lags. Only positive autocorrelations inform the fit; without any
+// the series are independent and it returns 0.
+func FitAR1(lags []int, autocorrelations []float64) float64 {
+	// Least squares of log(acf) = k*log(phi) through the origin
+	var sumKLog, sumKK float64
+	for i, lag := range lags {
+		if i >= len(autocorrelations) || lag < 1 || autocorrelations[i] <= 0 {
+			continue
+		}
+		k := float64(lag)
+		sumKLog += k * math.Log(math.Min(autocorrelations[i], 1))
+		sumKK += k * k
+	}
+	if sumKK == 0 {
+		return 0
+	}
+	return math.Min(math.Exp(sumKLog/sumKK), maxSeriesCorrelation)
+}
+
+// Sample returns the next value of a series
+func (sm *SeriesModel) Sample(rng *rand.Rand, series string) float64 {
+	z, ok := sm.states[series]
+	if ok {
+		z = sm.phi*z + math.Sqrt(1-sm.phi*sm.phi)*rng.NormFloat64()
+	} else {
+		if len(sm.states) >= maxSeriesStates {
+			sm.states = make(map[string]float64)
+		}
+		z = rng.NormFloat64()
+	}
+	sm.states[series] = z
+
+	pos := normalCDF(z) * float64(len(sm.marginal)-1)
+	idx := int(pos)
+	if idx >= len(sm.marginal)-1 {
+		return sm.marginal[len(sm.marginal)-1]
+	}
+	frac := pos - float64(idx)
+	return sm.marginal[idx] + frac*(sm.marginal[idx+1]-sm.marginal[idx])
+}
+
+// Clone returns a model of the same distribution and correlation, sharing
+// its marginal, whose series start afresh. A model is not safe for
+// concurrent use; its clones are independent of it.
+func (sm *SeriesModel) Clone() *SeriesModel {
+	return &SeriesModel{
+		phi:      sm.phi,
+		marginal: sm.marginal,
+		states:   make(map[string]float64),
+	}
+}
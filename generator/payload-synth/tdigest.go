@@ -0,0 +1,155 @@
+package payloadsynth
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// DefaultCompression bounds a t-digest to about this many centroids, most
+// of them in the tails
+const DefaultCompression = 100
+
+// Centroid is a t-digest centroid: the mean of Count nearby values
+type Centroid struct {
+	Mean  float64
+	Count float64
+}
+
+// TDigest is a value distribution summarized by centroids, small ones near
+// the tails and large ones in the middle, as recipes record histograms.
+// Sampling its quantiles keeps the distribution's modes and the shape of
+// its tails, which a handful of quantiles cannot.
+type TDigest struct {
+	centroids []Centroid
+	middles   []float64 // Weight below each centroid's middle
+	total     float64
+	min, max  float64
+}
+
+// NewTDigest builds a digest from centroids, merging neighbours to the
+// given compression (DefaultCompression if not positive). The range, if
+// recorded, extends the outermost centroids to the extreme values; without
+// it the outermost means bound the distribution.
+func NewTDigest(centroids []Centroid, compression float64, lowest, highest *float64) (*TDigest, error) {
+	valid := make([]Centroid, 0, len(centroids))
+	for _, c := range centroids {
+		if c.Count > 0 && !math.IsNaN(c.Mean) && !math.IsInf(c.Mean, 0) && !math.IsInf(c.Count, 0) {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, errors.New("no valid centroids")
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Mean < valid[j].Mean })
+	if compression <= 0 {
+		compression = DefaultCompression
+	}
+
+	td := &TDigest{centroids: mergeCentroids(valid, compression)}
+	for _, c := range td.centroids {
+		td.middles = append(td.middles, td.total+c.Count/2)
+		td.total += c.Count
+	}
+
+	td.min = td.centroids[0].Mean
+	td.max = td.centroids[len(td.centroids)-1].Mean
+	if lowest != nil && *lowest < td.min {
+		td.min = *lowest
+	}
+	if highest != nil && *highest > td.max {
+		td.max = *highest
+	}
+	return td, nil
+}
+
+// NewTDigestSampler creates a sampler drawing from a digest of centroids
+func NewTDigestSampler(centroids []Centroid, lowest, highest *float64) (*NumericSampler, error) {
+	td, err := NewTDigest(centroids, DefaultCompression, lowest, highest)
+	if err != nil {
+		return nil, err
+	}
+	return &NumericSampler{
+		sampler: func(rng *rand.Rand) float64 {
+			return td.Quantile(rng.Float64())
+		},
+	}, nil
+}
+
+// Centroids returns the digest's centroids, in order of their means
+func (td *TDigest) Centroids() []Centroid {
+	return td.centroids
+}
+
+// Quantile returns the value below which a share q of the weight lies. It
+// interpolates between the middles of neighbouring centroids, and out to
+// the range beyond the outermost; a centroid of a single value is that
+// value for its whole unit of weight.
+func (td *TDigest) Quantile(q float64) float64 {
+	q = math.Max(0, math.Min(q, 1))
+	index := q * td.total
+	n := len(td.centroids)
+
+	first, last := td.centroids[0], td.centroids[n-1]
+	if index < td.middles[0] {
+		if first.Count == 1 {
+			return first.Mean
+		}
+		return td.min + (first.Mean-td.min)*index/td.middles[0]
+	}
+	if index >= td.middles[n-1] {
+		if last.Count == 1 {
+			return last.Mean
+		}
+		return last.Mean + (td.max-last.Mean)*(index-td.middles[n-1])/(td.total-td.middles[n-1])
+	}
+
+	i := sort.SearchFloat64s(td.middles, index)
+	if td.middles[i] > index {
+		i--
+	}
+	left, right := td.centroids[i], td.centroids[i+1]
+	start, end := td.middles[i], td.middles[i+1]
+	if left.Count == 1 {
+		start += 0.5
+	}
+	if right.Count == 1 {
+		end -= 0.5
+	}
+	switch {
+	case index < start:
+		return left.Mean
+	case index >= end:
+		return right.Mean
+	}
+	return left.Mean + (right.Mean-left.Mean)*(index-start)/(end-start)
+}
+
+// mergeCentroids merges sorted neighbours while each merged centroid spans
+// at most one unit of the k1 scale function, which allows less weight per
+// centroid towards the tails
+func mergeCentroids(sorted []Centroid, compression float64) []Centroid {
+	total := 0.0
+	for _, c := range sorted {
+		total += c.Count
+	}
+	scale := func(q float64) float64 {
+		return compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+	}
+
+	merged := []Centroid{sorted[0]}
+	before := 0.0 // Weight below the current merged centroid
+	for _, c := range sorted[1:] {
+		current := &merged[len(merged)-1]
+		if scale((before+current.Count+c.Count)/total)-scale(before/total) <= 1 {
+			count := current.Count + c.Count
+			current.Mean += (c.Mean - current.Mean) * c.Count / count
+			current.Count = count
+			continue
+		}
+		before += current.Count
+		merged = append(merged, c)
+	}
+	return merged
+}
@@ -0,0 +1,145 @@
+// Package temporal models when synthetic lines are emitted. Its Hawkes
+// process is self-exciting: every event briefly raises the rate of the
+// events after it, so lines arrive in bursts the way real traffic does,
+// while the long-run rate still follows the recipe's intensity curve.
+package temporal
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Defaults for the excitation kernel
+const (
+	// DefaultDecay is how fast the excitation of an event fades, per
+	// second. Bursts settle within seconds, well inside the per-minute
+	// counts the recipe's burstiness is measured on.
+	DefaultDecay = 1.0
+
+	// MaxBranchingRatio keeps the process stationary; at 1 every burst
+	// would sustain itself
+	MaxBranchingRatio = 0.95
+)
+
+// Params shape the excitation kernel, an exponential decay
+type Params struct {
+	BranchingRatio float64 // Expected events each event triggers, in [0, 1)
+	Decay          float64 // Decay rate of the excitation, per second
+}
+
+// DefaultParams is a moderately bursty kernel, each event triggering half
+// an event on average
+func DefaultParams() Params {
+	return Params{BranchingRatio: 0.5, Decay: DefaultDecay}
+}
+
+// ParamsFromFano fits the kernel to a Fano factor (variance over mean) of
+// event counts. Over windows longer than the bursts a Hawkes process has
+// a Fano factor of 1/(1-n)^2 for branching ratio n; a factor of 1 or less
+// is a Poisson process, which has no excitation.
+func ParamsFromFano(fano float64) Params {
+	params := Params{Decay: DefaultDecay}
+	if fano > 1 {
+		params.BranchingRatio = math.Min(1-1/math.Sqrt(fano), MaxBranchingRatio)
+	}
+	return params
+}
+
+// Process is a Hawkes process with an exponential kernel. Its conditional
+// intensity is the background rate scaled by 1-n plus the decaying
+// excitation of past events, so that on average it runs at the
+// background rate. Params may be changed between calls.
+type Process struct {
+	Params Params
+
+	excitation float64 // Events per second on top of the background
+	clock      float64 // Seconds, of the last step
+	started    bool
+}
+
+// NewProcess creates a process with no excitation yet
+func NewProcess(params Params) *Process {
+	return &Process{Params: params}
+}
+
+// Events advances the process to time t, in seconds, with the background
+// rate held constant since the previous step, and returns the number of
+// events in between. Callers emit exactly that many; the excitation those
+// events cause is what makes later steps bursty. The first call only sets
+// the clock.
+func (p *Process) Events(rng *rand.Rand, t, background float64) int {
+	if !p.started {
+		p.started = true
+		p.clock = t
+		return 0
+	}
+
+	// Waits are memoryless given the excitation, so the one that runs past
+	// t is cut there and drawn afresh next step
+	count := 0
+	for p.clock < t {
+		wait := p.wait(rng, background)
+		if p.clock+wait > t {
+			p.advance(t - p.clock)
+			break
+		}
+		p.advance(wait)
+		p.fire()
+		count++
+	}
+	return count
+}
+
+// NextInterval returns the seconds until the next event with the background
+// rate held constant, and advances the process past that event
+func (p *Process) NextInterval(rng *rand.Rand, background float64) float64 {
+	wait := p.wait(rng, background)
+	if math.IsInf(wait, 1) {
+		return wait
+	}
+	p.advance(wait)
+	p.fire()
+	return wait
+}
+
+// wait samples the time to the next event exactly, as the first of the
+// background and excitation arrivals
+func (p *Process) wait(rng *rand.Rand, background float64) float64 {
+	n, decay := p.kernel()
+
+	wait := math.Inf(1)
+	if mu := background * (1 - n); mu > 0 {
+		wait = rng.ExpFloat64() / mu
+	}
+	if p.excitation > 0 {
+		// The excitation alone fires again only if its remaining mass
+		// exceeds an exponential draw
+		if d := 1 - decay*rng.ExpFloat64()/p.excitation; d > 0 {
+			wait = math.Min(wait, -math.Log(d)/decay)
+		}
+	}
+	return wait
+}
+
+func (p *Process) advance(dt float64) {
+	_, decay := p.kernel()
+	p.clock += dt
+	p.excitation *= math.Exp(-decay * dt)
+}
+
+// fire adds the excitation of an event at the current clock
+func (p *Process) fire() {
+	n, decay := p.kernel()
+	p.excitation += n * decay
+}
+
+// kernel returns the branching ratio and decay, bounded to keep the
+// process stationary
+func (p *Process) kernel() (float64, float64) {
+	n := math.Max(0, math.Min(p.Params.BranchingRatio, MaxBranchingRatio))
+	decay := p.Params.Decay
+	if decay <= 0 {
+		decay = DefaultDecay
+	}
+	return n, decay
+}
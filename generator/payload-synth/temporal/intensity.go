@@ -0,0 +1,105 @@
+package temporal
+
+import (
+	"math"
+	"time"
+)
+
+// Lengths of an intensity curve, in minutes
+const (
+	DailyMinutes  = 1440
+	WeeklyMinutes = 10080
+)
+
+// Kinds of trend components
+const (
+	TrendLinear   = "linear"   // Grows by PerDay each day
+	TrendStep     = "step"     // Adds Delta from At on
+	TrendSinusoid = "sinusoid" // Swings by Amplitude over Period
+)
+
+// Trend is an additive component of the intensity, on top of the curve
+type Trend struct {
+	Kind      string
+	PerDay    float64       // Linear
+	At        time.Time     // Step
+	Delta     float64       // Step
+	Period    time.Duration // Sinusoid
+	Amplitude float64       // Sinusoid
+	Phase     time.Duration // Sinusoid, offset of its peak from the start
+}
+
+// Override replaces the intensity over a window, like a holiday: with
+// Intensity if set, else the intensity scaled by Scale
+type Override struct {
+	Start, End time.Time
+	Intensity  *float64
+	Scale      float64
+}
+
+// Intensity is the relative emission rate over time: a daily or weekly
+// curve of per-minute points, interpolated between minutes, plus trend
+// components and with override windows. Its value is a factor on the base
+// rate, so a curve normalized to mean 1 keeps the base rate on average.
+type Intensity struct {
+	Curve     []float64
+	Anchor    time.Time // Time of the curve's first point; it repeats from there
+	Start     time.Time // When trends start, normally the scenario start
+	Trends    []Trend
+	Overrides []Override
+}
+
+// At returns the intensity at time t, never negative. Without a curve it
+// is 1 before trends and overrides.
+func (in *Intensity) At(t time.Time) float64 {
+	value := in.curveAt(t)
+
+	for _, trend := range in.Trends {
+		switch trend.Kind {
+		case TrendLinear:
+			value += trend.PerDay * t.Sub(in.Start).Hours() / 24
+		case TrendStep:
+			if !t.Before(trend.At) {
+				value += trend.Delta
+			}
+		case TrendSinusoid:
+			if trend.Period > 0 {
+				cycles := float64(t.Sub(in.Start)-trend.Phase) / float64(trend.Period)
+				value += trend.Amplitude * math.Cos(2*math.Pi*cycles)
+			}
+		}
+	}
+
+	// Later overrides win where windows overlap
+	for i := len(in.Overrides) - 1; i >= 0; i-- {
+		override := in.Overrides[i]
+		if t.Before(override.Start) || !t.Before(override.End) {
+			continue
+		}
+		if override.Intensity != nil {
+			value = *override.Intensity
+		} else {
+			value *= override.Scale
+		}
+		break
+	}
+
+	return math.Max(0, value)
+}
+
+// curveAt interpolates the curve linearly between its minutes, wrapping
+// from the last point back to the first
+func (in *Intensity) curveAt(t time.Time) float64 {
+	n := len(in.Curve)
+	if n == 0 {
+		return 1.0
+	}
+
+	minutes := math.Mod(t.Sub(in.Anchor).Minutes(), float64(n))
+	if minutes < 0 {
+		minutes += float64(n)
+	}
+	i := int(minutes) % n
+	frac := minutes - math.Floor(minutes)
+	return in.Curve[i] + frac*(in.Curve[(i+1)%n]-in.Curve[i])
+}
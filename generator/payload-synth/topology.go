@@ -0,0 +1,190 @@
+package payloadsynth
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Sizing of a Topology
+const (
+	// maxTopologyHosts bounds the hosts of a fleet
+	maxTopologyHosts = 100000
+
+	// hostNameAttempts is how many names spawn is asked for before a taken
+	// one is made unique with a suffix
+	hostNameAttempts = 8
+
+	// hostPickAttempts is how many hosts Pick draws before settling for one
+	// that is down
+	hostPickAttempts = 8
+)
+
+// TopologyParams describe a fleet of hosts. Each host emits its share of a
+// family's lines; over time hosts restart, keeping their name, or are
+// replaced by a new host taking over the share, the way instances of an
+// autoscaling group are.
+type TopologyParams struct {
+	Hosts           int
+	Shares          *NumericSampler // Relative rate of a host; else equal
+	RestartRate     float64         // Restarts per host per second
+	ReplacementRate float64         // Replacements per host per second
+	Downtime        float64         // Seconds a restarting host is silent
+}
+
+// Host is a host of the fleet
+type Host struct {
+	Name     string
+	Tags     map[string]string // Host-level tags, fixed for the host's life
+	Share    float64           // Relative rate
+	Started  float64           // Seconds, of its start or last restart; later while down
+	Restarts int
+}
+
+// Topology is a family's fleet of hosts. Lines are emitted for a host
+// picked by its share, so every line of a host carries the same name and
+// host-level tags and each host keeps its rate, where fresh draws would
+// scatter a source's lines across unrelated tag values.
+type Topology struct {
+	params     TopologyParams
+	hosts      []*Host
+	cumulative []float64 // Of the shares, for Pick
+	names      map[string]bool
+	clock      float64 // Seconds, of the last step
+	started    bool
+}
+
+// NewTopology creates an empty fleet; the first Advance fills it
+func NewTopology(params TopologyParams) *Topology {
+	if params.Hosts > maxTopologyHosts {
+		params.Hosts = maxTopologyHosts
+	}
+	return &Topology{params: params, names: make(map[string]bool)}
+}
+
+// Hosts returns the hosts of the fleet
+func (tp *Topology) Hosts() []*Host {
+	return tp.hosts
+}
+
+// Clone returns a copy of the fleet as it is, whose hosts then restart
+// and are replaced independently of the original's
+func (tp *Topology) Clone() *Topology {
+	clone := &Topology{
+		params:     tp.params,
+		hosts:      make([]*Host, len(tp.hosts)),
+		cumulative: append([]float64(nil), tp.cumulative...),
+		names:      make(map[string]bool, len(tp.names)),
+		clock:      tp.clock,
+		started:    tp.started,
+	}
+	for i, host := range tp.hosts {
+		copied := *host
+		clone.hosts[i] = &copied
+	}
+	for name := range tp.names {
+		clone.names[name] = true
+	}
+	return clone
+}
+
+// Advance moves the fleet to time t, in seconds: hosts restart and are
+// replaced at their rates, with spawn drawing each new host's name and
+// tags. The first call creates the hosts, up for part of their lifetime.
+func (tp *Topology) Advance(rng *rand.Rand, t float64, spawn func() (string, map[string]string)) {
+	lifecycle := tp.params.RestartRate + tp.params.ReplacementRate
+	if !tp.started {
+		tp.started = true
+		tp.clock = t
+		for i := 0; i < tp.params.Hosts; i++ {
+			share := 1.0
+			if tp.params.Shares != nil {
+				share = math.Max(0, tp.params.Shares.Sample(rng))
+			}
+			host := &Host{Share: share, Started: t}
+			if lifecycle > 0 {
+				host.Started -= rng.ExpFloat64() / lifecycle
+			}
+			tp.spawn(rng, host, spawn)
+			tp.hosts = append(tp.hosts, host)
+		}
+		tp.reweigh()
+		return
+	}
+	if t <= tp.clock || lifecycle <= 0 || len(tp.hosts) == 0 {
+		tp.clock = math.Max(tp.clock, t)
+		return
+	}
+
+	// Restarts and replacements of the fleet, in order
+	rate := lifecycle * float64(len(tp.hosts))
+	for at := tp.clock + rng.ExpFloat64()/rate; at <= t; at += rng.ExpFloat64() / rate {
+		host := tp.hosts[rng.Intn(len(tp.hosts))]
+		if rng.Float64()*lifecycle < tp.params.RestartRate {
+			host.Started = at + tp.params.Downtime
+			host.Restarts++
+			continue
+		}
+		host.Started = at
+		delete(tp.names, host.Name)
+		host.Restarts = 0
+		tp.spawn(rng, host, spawn)
+	}
+	tp.clock = t
+}
+
+// Pick returns a host chosen by share, passing over those down for a
+// restart, or nil when the fleet is empty
+func (tp *Topology) Pick(rng *rand.Rand) *Host {
+	if len(tp.hosts) == 0 {
+		return nil
+	}
+	var host *Host
+	for i := 0; i < hostPickAttempts; i++ {
+		host = tp.pickAny(rng)
+		if host.Started <= tp.clock {
+			break
+		}
+	}
+	return host
+}
+
+// pickAny returns a host chosen by share, up or down
+func (tp *Topology) pickAny(rng *rand.Rand) *Host {
+	total := tp.cumulative[len(tp.cumulative)-1]
+	if total <= 0 {
+		return tp.hosts[rng.Intn(len(tp.hosts))]
+	}
+	i := sort.SearchFloat64s(tp.cumulative, rng.Float64()*total)
+	if i >= len(tp.hosts) {
+		i = len(tp.hosts) - 1
+	}
+	return tp.hosts[i]
+}
+
+// spawn names a new host, unique within the fleet
+func (tp *Topology) spawn(rng *rand.Rand, host *Host, spawn func() (string, map[string]string)) {
+	var name string
+	for i := 0; i < hostNameAttempts; i++ {
+		name, host.Tags = spawn()
+		if !tp.names[name] {
+			break
+		}
+	}
+	for base := name; tp.names[name]; {
+		name = base + "-" + strconv.Itoa(rng.Intn(len(tp.names)*10+10))
+	}
+	host.Name = name
+	tp.names[name] = true
+}
+
+// reweigh sums the hosts' shares for Pick
+func (tp *Topology) reweigh() {
+	tp.cumulative = make([]float64, len(tp.hosts))
+	total := 0.0
+	for i, host := range tp.hosts {
+		total += host.Share
+		tp.cumulative[i] = total
+	}
+}
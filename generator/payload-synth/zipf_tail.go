@@ -0,0 +1,153 @@
+package payloadsynth
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Bounds for an exponent fit to the top values
+const (
+	defaultZipfExponent = 1.0
+	minZipfExponent     = 0.1
+	maxZipfExponent     = 5.0
+)
+
+// ZipfTail describes the values of a categorical distribution beyond its top
+// values, which a recipe records only by count and combined frequency
+type ZipfTail struct {
+	Distinct int                   // Distinct values in the whole distribution
+	Mass     float64               // Share of samples outside the top values
+	Exponent float64               // Power-law exponent; 0 fits it to the top values
+	Name     func(rank int) string // Names the value at a rank; nil uses "value-<rank>"
+}
+
+// zipfTail draws ranks after the top values from a power law truncated at
+// the distinct count, by inverting its continuous approximation
+type zipfTail struct {
+	mass     float64
+	exponent float64
+	first    float64 // Rank bounds, widened by half a rank for rounding
+	last     float64
+	name     func(rank int) string
+}
+
+// NewCategoricalSamplerWithTail creates a categorical sampler that also emits
+// rare values past the top values. Tail values are named by rank, so the
+// same rank always yields the same value.
+func NewCategoricalSamplerWithTail(items []WeightedItem, tail ZipfTail) *CategoricalSampler {
+	sampler := NewCategoricalSampler(items)
+
+	first := len(items) + 1
+	if tail.Distinct < first || tail.Mass <= 0 {
+		return sampler
+	}
+
+	exponent := tail.Exponent
+	if exponent <= 0 {
+		exponent = fitZipfExponent(items)
+	}
+	name := tail.Name
+	if name == nil {
+		name = TailNamer("value", nil)
+	}
+	sampler.tail = &zipfTail{
+		mass:     math.Min(tail.Mass, 1),
+		exponent: exponent,
+		first:    float64(first) - 0.5,
+		last:     float64(tail.Distinct) + 0.5,
+		name:     name,
+	}
+	return sampler
+}
+
+// fitZipfExponent fits a power law to the rank-frequency curve of the top
+// values by least squares in log-log space
+func fitZipfExponent(items []WeightedItem) float64 {
+	weights := make([]float64, 0, len(items))
+	for _, item := range items {
+		if item.Weight > 0 {
+			weights = append(weights, item.Weight)
+		}
+	}
+	if len(weights) < 2 {
+		return defaultZipfExponent
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(weights)))
+
+	var sumX, sumY, sumXX, sumXY float64
+	for i, w := range weights {
+		x, y := math.Log(float64(i+1)), math.Log(w)
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	n := float64(len(weights))
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	if math.IsNaN(slope) || slope >= 0 {
+		return defaultZipfExponent
+	}
+	return math.Max(minZipfExponent, math.Min(maxZipfExponent, -slope))
+}
+
+func (t *zipfTail) sample(rng *rand.Rand) string {
+	u := rng.Float64()
+	var x float64
+	if math.Abs(t.exponent-1) < 1e-9 {
+		x = t.first * math.Pow(t.last/t.first, u)
+	} else {
+		e := 1 - t.exponent
+		lo, hi := math.Pow(t.first, e), math.Pow(t.last, e)
+		x = math.Pow(lo+u*(hi-lo), 1/e)
+	}
+
+	rank := int(math.Round(x))
+	if lowest := int(t.first + 0.5); rank < lowest {
+		rank = lowest
+	} else if highest := int(t.last - 0.5); rank > highest {
+		rank = highest
+	}
+	return t.name(rank)
+}
+
+// TailNamer names tail values of a field deterministically: the value at a
+// rank is what gen produces from a generator seeded by the field and rank,
+// or field-rank when gen is nil
+func TailNamer(field string, gen StringGenerator) func(rank int) string {
+	h := fnv.New64a()
+	h.Write([]byte(field))
+	fieldSeed := h.Sum64()
+
+	return func(rank int) string {
+		if gen == nil {
+			return fmt.Sprintf("%s-%d", field, rank)
+		}
+		source := splitMix64(fieldSeed ^ uint64(rank)*0x9e3779b97f4a7c15)
+		if name := gen.Generate(rand.New(&source)); name != "" {
+			return name
+		}
+		return fmt.Sprintf("%s-%d", field, rank)
+	}
+}
+
+// splitMix64 is a small rand.Source64, cheap enough to seed per value
+type splitMix64 uint64
+
+func (s *splitMix64) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	*s = splitMix64(seed)
+}
@@ -1,3 +1,7 @@
 module github.com/loadgen/workers
 
-go 1.21
\ No newline at end of file
+go 1.21
+
+require github.com/loadgen/lib-auth v0.1.0
+
+replace github.com/loadgen/lib-auth => ../lib-auth
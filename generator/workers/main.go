@@ -14,9 +14,13 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	libauth "github.com/loadgen/lib-auth"
 )
 
 const (
@@ -34,6 +38,7 @@ var (
 	linesEmittedCount = make(map[string]int64)
 	bytesEmittedCount = make(map[string]int64)
 	httpErrorCount    = make(map[string]int64)
+	invalidLineCount  = make(map[string]int64)
 	metricsLock       sync.RWMutex
 )
 
@@ -46,6 +51,12 @@ type WorkerConfig struct {
 	PollInterval     time.Duration
 	BatchSize        int
 	FlushInterval    time.Duration
+
+	// Share of synthesized lines checked against the line grammar
+	ValidateRate     float64
+
+	// Authentication of batches sent to the endpoints
+	Auth             libauth.AuthConfig
 }
 
 // Assignment represents the current work assignment from control plane
@@ -56,7 +67,18 @@ type Assignment struct {
 	Families    []string `json:"families"`
 	Multiplier  float64  `json:"multiplier"`
 	BurstFactor float64  `json:"burst_factor"`
+	CardinalityBomb float64 `json:"cardinality_bomb,omitempty"`
+	EdgeCases   float64  `json:"edge_cases,omitempty"`
+	SizeTargeting bool   `json:"size_targeting,omitempty"`
+	SchemaDrift float64  `json:"schema_drift,omitempty"`
+	DriftStart  time.Time `json:"drift_start"`
+	DriftRampSeconds float64 `json:"drift_ramp_seconds,omitempty"`
+	DriftValueShift  float64 `json:"drift_value_shift,omitempty"`
 	AssignedAt  time.Time `json:"assigned_at"`
+
+	// Target endpoints, with fleets already expanded to their members by
+	// the control plane
+	Endpoints   []string `json:"endpoints,omitempty"`
 }
 
 // Recipe represents a loaded metric family recipe (simplified)
@@ -84,10 +106,14 @@ type LoadWorker struct {
 	assignment    *Assignment
 	synthesizers  map[string]*WavefrontSynthesizer
 	httpClients   []*http.Client
+	tokens        libauth.TokenSource // nil when batches carry no token
 	batchBuffer   *BatchBuffer
 	mu            sync.RWMutex
 	stopChan      chan struct{}
 	wg            sync.WaitGroup
+
+	// Round-robin position over the assignment endpoints
+	nextEndpoint  uint64
 }
 
 // BatchBuffer accumulates lines before sending
@@ -207,6 +233,7 @@ func NewLoadWorker(config *WorkerConfig) (*LoadWorker, error) {
 		config:       config,
 		synthesizers: make(map[string]*WavefrontSynthesizer),
 		httpClients:  clients,
+		tokens:       config.Auth.TokenSource(),
 		batchBuffer:  NewBatchBuffer(config.BatchSize, 1024*1024), // 1MB buffer
 		stopChan:     make(chan struct{}),
 	}, nil
@@ -259,6 +286,9 @@ func (lw *LoadWorker) startMetricsServer() {
 		for key, value := range httpErrorCount {
 			fmt.Fprintf(w, "loadgen_http_errors_total{endpoint=\"%s\"} %d\n", key, value)
 		}
+		for key, value := range invalidLineCount {
+			fmt.Fprintf(w, "loadgen_invalid_lines_total{family_id=\"%s\"} %d\n", key, value)
+		}
 	})
 
 	server := &http.Server{
@@ -383,7 +413,9 @@ func (lw *LoadWorker) updateAssignment(assignment *Assignment) {
 
 	// Check if assignment changed
 	if lw.assignment != nil && lw.assignmentEqual(lw.assignment, assignment) {
-		return // No change
+		// Endpoints follow fleet membership without restarting generators
+		lw.assignment = assignment
+		return
 	}
 
 	log.Printf("Updating assignment: %d families, multiplier=%.2f", len(assignment.Families), assignment.Multiplier)
@@ -406,7 +438,11 @@ func (lw *LoadWorker) assignmentEqual(a, b *Assignment) bool {
 			return false
 		}
 	}
-	return a.Multiplier == b.Multiplier && a.BurstFactor == b.BurstFactor
+	return a.Multiplier == b.Multiplier && a.BurstFactor == b.BurstFactor &&
+		a.CardinalityBomb == b.CardinalityBomb && a.EdgeCases == b.EdgeCases &&
+		a.SizeTargeting == b.SizeTargeting && a.SchemaDrift == b.SchemaDrift &&
+		a.DriftStart.Equal(b.DriftStart) && a.DriftRampSeconds == b.DriftRampSeconds &&
+		a.DriftValueShift == b.DriftValueShift
 }
 
 func (lw *LoadWorker) updateSynthesizers() {
@@ -484,8 +520,17 @@ func (lw *LoadWorker) trafficGenerator(familyID string, synthesizer *emitters.Wa
 	defer ticker.Stop()
 
 	lastEmissionTime := time.Now()
+	lastTick := time.Now()
 	linesEmittedCounter := 0
 
+	// Sampled lines that break the line grammar are counted and logged
+	synthesizer.SetValidation(lw.config.ValidateRate, func(line string, err error) {
+		metricsLock.Lock()
+		invalidLineCount[familyID]++
+		metricsLock.Unlock()
+		log.Printf("Family %s: invalid line %q: %v", familyID[:8], line, err)
+	})
+
 	for {
 		select {
 		case <-lw.stopChan:
@@ -500,13 +545,25 @@ func (lw *LoadWorker) trafficGenerator(familyID string, synthesizer *emitters.Wa
 				continue
 			}
 
+			synthesizer.SetCardinalityBomb(assignment.CardinalityBomb)
+			synthesizer.SetEdgeCaseRate(assignment.EdgeCases)
+			synthesizer.SetSizeTargeting(assignment.SizeTargeting)
+			synthesizer.SetDrift(emitters.DriftSchedule{
+				Start:      assignment.DriftStart,
+				Ramp:       time.Duration(assignment.DriftRampSeconds * float64(time.Second)),
+				Strength:   assignment.SchemaDrift,
+				ValueShift: assignment.DriftValueShift,
+			})
+
 			// Calculate target rate based on intensity curve and multiplier
 			baseRate := 1.0 // 1 line per second base rate
 			targetRate := synthesizer.CalculateTargetRate(now, baseRate, assignment.Multiplier, assignment.BurstFactor)
 
-			// Determine if we should emit in this tick
-			timeSinceLastEmission := now.Sub(lastEmissionTime).Seconds()
-			expectedLines := targetRate * timeSinceLastEmission
+			// Determine if we should emit in this tick; the rate is the
+			// one realized since the previous tick
+			timeSinceLastTick := now.Sub(lastTick).Seconds()
+			lastTick = now
+			expectedLines := targetRate * timeSinceLastTick
 			
 			// Emit lines based on expected count (with some randomness)
 			linesToEmit := int(expectedLines)
@@ -589,11 +646,19 @@ func (lw *LoadWorker) flushBatch() {
 		payload.WriteString("\n")
 	}
 
-	// Send to endpoints (simplified - would use old loadgen auth)
+	// Send to endpoints (simplified - would use old loadgen auth). Batches
+	// rotate over the assigned endpoints, so a fleet shares the load
 	endpoints := []string{"http://collectors:8080/api/v2/wfproxy/report"} // Default endpoint
+	if len(assignment.Endpoints) > 0 {
+		n := atomic.AddUint64(&lw.nextEndpoint, 1)
+		endpoints = []string{assignment.Endpoints[n%uint64(len(assignment.Endpoints))]}
+	}
 	
+	// Not the worker's context: the final flush runs after it is cancelled,
+	// and the clients' timeout bounds each send
+	ctx := context.Background()
 	for _, endpoint := range endpoints {
-		if err := lw.sendBatch(endpoint, payload.Bytes()); err != nil {
+		if err := lw.sendBatch(ctx, endpoint, payload.Bytes()); err != nil {
 			log.Printf("Failed to send batch to %s: %v", endpoint, err)
 			// Update error metrics
 			metricsLock.Lock()
@@ -605,25 +670,26 @@ func (lw *LoadWorker) flushBatch() {
 	log.Printf("Flushed batch of %d lines (%d bytes)", len(lines), payload.Len())
 }
 
-func (lw *LoadWorker) sendBatch(endpoint string, payload []byte) error {
+func (lw *LoadWorker) sendBatch(ctx context.Context, endpoint string, payload []byte) error {
 	// Get HTTP client from pool
 	clientIdx := int(time.Now().UnixNano()) % len(lw.httpClients)
 	client := lw.httpClients[clientIdx]
 
-	// Create request
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
-	if err != nil {
-		return err
+	// Create request, anew for the retry after a rejected token
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("User-Agent", "loadgen-worker/1.0")
+		// Lets the xDS controller attribute Envoy access logs to this worker
+		req.Header.Set("X-Loadgen-Worker", lw.config.WorkerID)
+		return req, nil
 	}
 
-	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("User-Agent", "loadgen-worker/1.0")
-
-	// Simple authentication - could be enhanced
-	// req.Header.Set("Authorization", "Bearer token-here")
-
-	// Send request
-	resp, err := client.Do(req)
+	// Send request with the worker's token, if any
+	resp, err := libauth.DoWithToken(ctx, client, lw.tokens, newRequest)
 	if err != nil {
 		return err
 	}
@@ -665,6 +731,12 @@ func main() {
 		pollInterval    = flag.Duration("poll-interval", defaultPollInterval, "Assignment poll interval")
 		batchSize       = flag.Int("batch-size", defaultBatchSize, "Batch size for emission")
 		flushInterval   = flag.Duration("flush-interval", defaultFlushInterval, "Batch flush interval")
+		validateRate    = flag.Float64("validate-rate", 0, "Share of lines checked against the Wavefront line grammar")
+		authType        = flag.String("auth-type", "", "Endpoint authentication: bearer or oauth2")
+		authToken       = flag.String("auth-token", os.Getenv("AUTH_TOKEN"), "Static bearer token")
+		oauthTokenURL   = flag.String("oauth-token-url", "", "OAuth2 token endpoint")
+		oauthClientID   = flag.String("oauth-client-id", "", "OAuth2 client ID")
+		oauthScopes     = flag.String("oauth-scopes", "", "Comma-separated OAuth2 scopes")
 	)
 	flag.Parse()
 
@@ -676,6 +748,21 @@ func main() {
 		PollInterval:    *pollInterval,
 		BatchSize:       *batchSize,
 		FlushInterval:   *flushInterval,
+		ValidateRate:    *validateRate,
+		Auth: libauth.AuthConfig{
+			Type:     *authType,
+			Token:    *authToken,
+			TokenURL: *oauthTokenURL,
+			ClientID: *oauthClientID,
+			// Kept out of the command line, where other processes can read it
+			ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
+		},
+	}
+	if *oauthScopes != "" {
+		config.Auth.Scopes = strings.Split(*oauthScopes, ",")
+	}
+	if err := config.Auth.Validate(); err != nil {
+		log.Fatalf("Invalid authentication flags: %v", err)
 	}
 
 	worker, err := NewLoadWorker(config)
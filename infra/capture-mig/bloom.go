@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	bloomIndexSuffix     = ".idx.json"
+	bloomFalsePositive   = 0.01
+	bloomMinBits         = 1024
+	bloomFamilyKeyPrefix = "family:"
+)
+
+// bloomFilter is a fixed-size Bloom filter using double hashing over a
+// 64-bit FNV hash, split into two halves.
+type bloomFilter struct {
+	bits   []byte
+	m      uint64
+	hashes int
+}
+
+// newBloomFilter sizes a filter for n keys at the target false positive rate.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < bloomMinBits {
+		m = bloomMinBits
+	}
+	m = (m + 7) / 8 * 8
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]byte, m/8), m: m, hashes: k}
+}
+
+func (b *bloomFilter) locations(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := mix64(h.Sum64())
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+func (b *bloomFilter) Add(key []byte) {
+	h1, h2 := b.locations(key)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b *bloomFilter) MayContain(key []byte) bool {
+	h1, h2 := b.locations(key)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ObjectIndex is the sidecar written next to every capture object. It holds
+// a Bloom filter over the object's metric names and families so readers can
+// skip objects that cannot contain what they are looking for.
+type ObjectIndex struct {
+	Object string `json:"object"`
+	Keys   int    `json:"keys"`
+	Bits   uint64 `json:"bits"`
+	Hashes int    `json:"hashes"`
+	Filter string `json:"filter"`
+
+	filter *bloomFilter
+}
+
+// buildObjectIndex indexes the distinct metric names and families in data.
+func buildObjectIndex(objectName string, data []byte) *ObjectIndex {
+	keys := make(map[string]struct{})
+	forEachRecord(data, func(record []byte) {
+		name := metricName(record)
+		if len(name) == 0 {
+			return
+		}
+		keys[string(name)] = struct{}{}
+		keys[bloomFamilyKeyPrefix+string(metricFamily(name))] = struct{}{}
+	})
+
+	filter := newBloomFilter(len(keys), bloomFalsePositive)
+	for key := range keys {
+		filter.Add([]byte(key))
+	}
+	return &ObjectIndex{
+		Object: objectName,
+		Keys:   len(keys),
+		Bits:   filter.m,
+		Hashes: filter.hashes,
+		Filter: base64.StdEncoding.EncodeToString(filter.bits),
+		filter: filter,
+	}
+}
+
+func decodeObjectIndex(data []byte) (*ObjectIndex, error) {
+	var idx ObjectIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode object index: %w", err)
+	}
+	bits, err := base64.StdEncoding.DecodeString(idx.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object index filter: %w", err)
+	}
+	if idx.Hashes < 1 || uint64(len(bits))*8 != idx.Bits {
+		return nil, fmt.Errorf("malformed object index for %s", idx.Object)
+	}
+	idx.filter = &bloomFilter{bits: bits, m: idx.Bits, hashes: idx.Hashes}
+	return &idx, nil
+}
+
+// MayContainMetric reports whether the object may hold the named metric.
+func (idx *ObjectIndex) MayContainMetric(name string) bool {
+	return idx.filter.MayContain([]byte(name))
+}
+
+// MayContainFamily reports whether the object may hold metrics of a family
+// (the first two dotted components of a metric name).
+func (idx *ObjectIndex) MayContainFamily(family string) bool {
+	return idx.filter.MayContain([]byte(bloomFamilyKeyPrefix + family))
+}
+
+// writeObjectIndex uploads the index sidecar for an uploaded object.
+// It shares the object's retention so both expire together.
+func (ca *CaptureAgent) writeObjectIndex(idx *ObjectIndex, retention retentionPolicy, windowStart time.Time) (string, error) {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode object index: %w", err)
+	}
+
+	indexName := idx.Object + bloomIndexSuffix
+	writer := ca.gcsClient.Bucket(ca.config.BucketName).Object(indexName).NewWriter(ca.ctx)
+	writer.ContentType = "application/json"
+	retention.apply(&writer.ObjectAttrs, windowStart)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return "", fmt.Errorf("failed to write object index: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to write object index: %w", err)
+	}
+	return indexName, nil
+}
+
+// QueryObjectIndexes returns the capture objects under prefix whose index
+// says they may contain any of the given families or metric names. Objects
+// without an index are not returned.
+func QueryObjectIndexes(ctx context.Context, client *storage.Client, bucketName, prefix string, families, metrics []string) ([]string, error) {
+	bucket := client.Bucket(bucketName)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	var matches []string
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		if !strings.HasSuffix(attrs.Name, bloomIndexSuffix) {
+			continue
+		}
+
+		reader, err := bucket.Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open object index %s: %w", attrs.Name, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object index %s: %w", attrs.Name, err)
+		}
+
+		idx, err := decodeObjectIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		if idx.matches(families, metrics) {
+			matches = append(matches, idx.Object)
+		}
+	}
+	return matches, nil
+}
+
+// runIndexQuery prints the objects matching the query-mode flags.
+func runIndexQuery(cfg *Config, prefix, families, metrics string) error {
+	if cfg.BucketName == "" {
+		return fmt.Errorf("missing required flag: -bucket")
+	}
+	if prefix == "" {
+		prefix = cfg.BucketPrefix
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithScopes(storage.ScopeReadOnly))
+	if err != nil {
+		return fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	defer client.Close()
+
+	objects, err := QueryObjectIndexes(ctx, client, cfg.BucketName, prefix, splitList(families), splitList(metrics))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		fmt.Println(object)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (idx *ObjectIndex) matches(families, metrics []string) bool {
+	for _, family := range families {
+		if idx.MayContainFamily(family) {
+			return true
+		}
+	}
+	for _, name := range metrics {
+		if idx.MayContainMetric(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec compresses a rotated buffer into the payload of one GCS object.
+type Codec interface {
+	Name() string
+	Extension() string
+	ContentType() string
+	Compress(data []byte) ([]byte, error)
+}
+
+// NewCodec builds the codec named by -codec. A level of 0 selects the
+// codec's default; dictionary is only used by zstd.
+func NewCodec(name string, level int, dictionary []byte) (Codec, error) {
+	switch name {
+	case "zstd":
+		return newZstdCodec(level, dictionary)
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip level must be between %d and %d, got %d", gzip.HuffmanOnly, gzip.BestCompression, level)
+		}
+		return &gzipCodec{level: level}, nil
+	case "lz4":
+		if level < 0 || level > 9 {
+			return nil, fmt.Errorf("lz4 level must be between 0 and 9, got %d", level)
+		}
+		return &lz4Codec{level: level}, nil
+	case "snappy":
+		return snappyCodec{}, nil
+	case "none":
+		return noneCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	dictID  uint32
+}
+
+func newZstdCodec(level int, dictionary []byte) (*zstdCodec, error) {
+	if level == 0 {
+		level = compressionLevel
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))}
+
+	var dictID uint32
+	if len(dictionary) > 0 {
+		info, err := zstd.InspectDictionary(dictionary)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd dictionary: %w", err)
+		}
+		dictID = info.ID()
+		opts = append(opts, zstd.WithEncoderDict(dictionary))
+	}
+
+	// EncodeAll is safe for concurrent use, so one encoder serves every
+	// upload worker.
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return &zstdCodec{encoder: encoder, dictID: dictID}, nil
+}
+
+func (c *zstdCodec) Name() string        { return "zstd" }
+func (c *zstdCodec) Extension() string   { return ".zst" }
+func (c *zstdCodec) ContentType() string { return "application/zstd" }
+
+func (c *zstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, make([]byte, 0, len(data)/4)), nil
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (c *gzipCodec) Name() string        { return "gzip" }
+func (c *gzipCodec) Extension() string   { return ".gz" }
+func (c *gzipCodec) ContentType() string { return "application/gzip" }
+
+func (c *gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type lz4Codec struct {
+	level int
+}
+
+func (c *lz4Codec) Name() string        { return "lz4" }
+func (c *lz4Codec) Extension() string   { return ".lz4" }
+func (c *lz4Codec) ContentType() string { return "application/x-lz4" }
+
+func (c *lz4Codec) Compress(data []byte) ([]byte, error) {
+	level := lz4.Fast
+	if c.level > 0 {
+		level = lz4.CompressionLevel(1 << (8 + c.level - 1))
+	}
+
+	var buf bytes.Buffer
+	writer := lz4.NewWriter(&buf)
+	if err := writer.Apply(lz4.CompressionLevelOption(level)); err != nil {
+		return nil, fmt.Errorf("failed to configure lz4 writer: %w", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close lz4 writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string        { return "snappy" }
+func (snappyCodec) Extension() string   { return ".sz" }
+func (snappyCodec) ContentType() string { return "application/x-snappy-framed" }
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := snappy.NewBufferedWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close snappy writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string                         { return "none" }
+func (noneCodec) Extension() string                    { return "" }
+func (noneCodec) ContentType() string                  { return "text/plain" }
+func (noneCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+
+// dictSampler collects a bounded sample of intake payloads used to train a
+// zstd dictionary once enough traffic has been seen.
+type dictSampler struct {
+	mu        sync.Mutex
+	samples   [][]byte
+	target    int
+	every     uint64
+	seen      uint64
+	done      bool
+	maxSample int
+}
+
+func newDictSampler(target int, every int) *dictSampler {
+	if every < 1 {
+		every = 1
+	}
+	return &dictSampler{
+		target:    target,
+		every:     uint64(every),
+		maxSample: 4096,
+	}
+}
+
+// Offer records a copy of body if it is selected for sampling. It returns
+// true once the sampler has collected its target number of samples.
+func (ds *dictSampler) Offer(body []byte) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.done || len(ds.samples) >= ds.target {
+		return false
+	}
+	ds.seen++
+	if ds.seen%ds.every != 0 {
+		return false
+	}
+
+	if len(body) > ds.maxSample {
+		// Cut on a line boundary so samples stay representative records
+		cut := bytes.LastIndexByte(body[:ds.maxSample], '\n')
+		if cut <= 0 {
+			cut = ds.maxSample - 1
+		}
+		body = body[:cut+1]
+	}
+	sample := make([]byte, len(body))
+	copy(sample, body)
+	ds.samples = append(ds.samples, sample)
+
+	if len(ds.samples) >= ds.target {
+		ds.done = true
+		return true
+	}
+	return false
+}
+
+func (ds *dictSampler) Samples() [][]byte {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.samples
+}
+
+func trainZstdDict(samples [][]byte, maxSize int) ([]byte, error) {
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+	})
+}
+
+// Decompress reverses the named codec. Objects written with a trained zstd
+// dictionary need that dictionary to decode.
+func Decompress(name string, data, dictionary []byte) ([]byte, error) {
+	switch name {
+	case "zstd":
+		var opts []zstd.DOption
+		if len(dictionary) > 0 {
+			opts = append(opts, zstd.WithDecoderDicts(dictionary))
+		}
+		decoder, err := zstd.NewReader(nil, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, nil)
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case "lz4":
+		return io.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+	case "snappy":
+		return io.ReadAll(snappy.NewReader(bytes.NewReader(data)))
+	case "none", "":
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// compactEntrySuffix names the record kept beside each consolidated object:
+// its manifest entry, including the sources it was merged from. Agents
+// overwrite manifests without conditions and can drop a compacted entry, so
+// an unlisted consolidated object is not necessarily left over from a failed
+// run; the record tells the two apart.
+const compactEntrySuffix = ".entry.json"
+
+// compactSource is one small capture object selected for merging.
+type compactSource struct {
+	attrs       *storage.ObjectAttrs
+	codec       string
+	windowStart time.Time
+}
+
+// compactGroup is the set of sources merged into one hourly object. Groups
+// never cross directories, so tenant, partition and instance are preserved.
+type compactGroup struct {
+	dir     string
+	hour    time.Time
+	sources []*compactSource
+}
+
+// compactPlan is what a compaction run does for the day.
+type compactPlan struct {
+	groups    []*compactGroup
+	manifests []*storage.ObjectAttrs
+
+	// Consolidated objects no manifest lists whose sources all remain, left
+	// by a run that failed before its manifests were written; their sources
+	// are merged again
+	orphans []string
+
+	// Consolidated objects no manifest lists whose sources are partly or
+	// wholly gone, so they hold the only copy; they are listed again and
+	// their remaining sources deleted like those of a fresh merge
+	adopted []*compactedObject
+
+	// Entry records whose consolidated object does not exist
+	strays []string
+
+	// Sources a listed consolidated object already holds, left by a run
+	// that failed to delete them; they are deleted rather than merged
+	merged []string
+}
+
+// compactedObject describes a written consolidated object for manifests.
+type compactedObject struct {
+	entry   map[string]interface{}
+	sources []string
+	placed  bool
+}
+
+type compactor struct {
+	ca       *CaptureAgent // only config, GCS client and context are used
+	bucket   *storage.BucketHandle
+	codec    Codec
+	date     time.Time
+	minSize  int64
+	dryRun   bool
+	delete   bool
+	dicts    map[string][]byte
+	replaced map[string]*compactedObject // source object name -> result
+}
+
+// runCompaction merges one day's small capture objects into hourly
+// consolidated .wf.zst objects, rewrites that day's manifests to point at
+// them, and then removes the sources. Sources are only removed once every
+// consolidated object is listed in a manifest, so a rerun after a failure
+// discards unlisted ones whose sources all remain and merges those again,
+// and never merges a source twice. An unlisted object missing any source
+// is listed again instead.
+func runCompaction(cfg *Config) error {
+	if cfg.BucketName == "" {
+		return fmt.Errorf("missing required flag: -bucket")
+	}
+
+	date := time.Now().UTC().AddDate(0, 0, -1).Truncate(24 * time.Hour)
+	if cfg.CompactDate != "" {
+		var err error
+		date, err = time.Parse("2006-01-02", cfg.CompactDate)
+		if err != nil {
+			return fmt.Errorf("invalid -compact-date: %w", err)
+		}
+	}
+	prefix := cfg.CompactPrefix
+	if prefix == "" {
+		prefix = cfg.BucketPrefix
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithScopes(storage.ScopeReadWrite))
+	if err != nil {
+		return fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	defer client.Close()
+
+	codec, err := NewCodec("zstd", cfg.CodecLevel, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create codec: %w", err)
+	}
+
+	c := &compactor{
+		ca:       &CaptureAgent{config: cfg, gcsClient: client, ctx: ctx},
+		bucket:   client.Bucket(cfg.BucketName),
+		codec:    codec,
+		date:     date,
+		minSize:  int64(cfg.CompactMinSizeMB) * 1024 * 1024,
+		dryRun:   cfg.CompactDryRun,
+		delete:   !cfg.CompactKeepSources,
+		dicts:    make(map[string][]byte),
+		replaced: make(map[string]*compactedObject),
+	}
+	return c.run(ctx, prefix)
+}
+
+func (c *compactor) run(ctx context.Context, prefix string) error {
+	plan, err := c.scan(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	groups, manifests := plan.groups, plan.manifests
+	log.Printf("Compaction of %s for %s: %d groups, %d manifests", prefix, c.date.Format("2006-01-02"), len(groups), len(manifests))
+
+	if c.dryRun {
+		for _, name := range plan.orphans {
+			log.Printf("Would remove unlisted consolidated object %s", name)
+		}
+		for _, result := range plan.adopted {
+			log.Printf("Would relist consolidated object %s", result.entry["object_name"])
+		}
+		if c.delete {
+			for _, name := range plan.merged {
+				log.Printf("Would remove already compacted source %s", name)
+			}
+		}
+	} else {
+		for _, name := range plan.orphans {
+			log.Printf("Removing unlisted consolidated object %s from an interrupted run", name)
+			c.deleteObject(ctx, name)
+			c.deleteObject(ctx, name+bloomIndexSuffix)
+			c.deleteObject(ctx, name+compactEntrySuffix)
+		}
+		for _, name := range plan.strays {
+			c.deleteObject(ctx, name)
+		}
+		if c.delete {
+			for _, name := range plan.merged {
+				c.deleteObject(ctx, name)
+				c.deleteObject(ctx, name+bloomIndexSuffix)
+			}
+		}
+	}
+
+	compacted := plan.adopted
+	for _, result := range compacted {
+		log.Printf("Relisting consolidated object %s, whose sources are no longer all present", result.entry["object_name"])
+	}
+	for _, group := range groups {
+		if c.dryRun {
+			log.Printf("Would merge %d objects in %s for hour %s", len(group.sources), group.dir, group.hour.Format("15"))
+			continue
+		}
+		result, err := c.merge(ctx, group)
+		if err != nil {
+			return fmt.Errorf("failed to compact %s hour %s: %w", group.dir, group.hour.Format("15"), err)
+		}
+		compacted = append(compacted, result)
+	}
+	if c.dryRun || len(compacted) == 0 {
+		return nil
+	}
+
+	for _, manifest := range manifests {
+		if err := c.rewriteManifest(ctx, manifest); err != nil {
+			return err
+		}
+	}
+	if err := c.writeUnplacedEntries(ctx, prefix, compacted); err != nil {
+		return err
+	}
+
+	if c.delete {
+		for _, result := range compacted {
+			for _, source := range result.sources {
+				c.deleteObject(ctx, source)
+				c.deleteObject(ctx, source+bloomIndexSuffix)
+			}
+		}
+	}
+	return nil
+}
+
+// scan lists prefix and plans the day's compaction: the mergeable groups,
+// the manifests, and what earlier runs left behind.
+func (c *compactor) scan(ctx context.Context, prefix string) (*compactPlan, error) {
+	day := c.date.Format("2006-01-02")
+	plan := &compactPlan{}
+	var sources, consolidated []*storage.ObjectAttrs
+	present := make(map[string]bool)
+	var entries []string
+
+	it := c.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		present[attrs.Name] = true
+		base := path.Base(attrs.Name)
+		switch {
+		case strings.HasSuffix(base, "-manifest.jsonl") && strings.Contains(attrs.Name, "/dt="+day+"/manifests/"):
+			plan.manifests = append(plan.manifests, attrs)
+		case strings.HasSuffix(base, bloomIndexSuffix) || objectDay(attrs) != day:
+		case strings.HasSuffix(base, compactEntrySuffix):
+			entries = append(entries, attrs.Name)
+		case strings.HasPrefix(base, "compact-"):
+			consolidated = append(consolidated, attrs)
+		case strings.HasPrefix(base, "part-") && attrs.Size < c.minSize:
+			sources = append(sources, attrs)
+		}
+	}
+
+	listed, compactedSources, err := c.manifestReferences(ctx, plan.manifests)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range entries {
+		if !present[strings.TrimSuffix(name, compactEntrySuffix)] {
+			plan.strays = append(plan.strays, name)
+		}
+	}
+
+	// Sources of adopted objects are deleted after the manifests, not merged
+	held := make(map[string]bool)
+	for _, attrs := range consolidated {
+		if listed[attrs.Name] {
+			continue
+		}
+		if !present[attrs.Name+compactEntrySuffix] {
+			log.Printf("Warning: keeping unlisted consolidated object %s, which has no entry record", attrs.Name)
+			continue
+		}
+		result, err := c.readEntry(ctx, attrs.Name+compactEntrySuffix)
+		if err != nil {
+			return nil, err
+		}
+
+		complete := true
+		for _, source := range result.sources {
+			complete = complete && present[source]
+		}
+		if complete {
+			plan.orphans = append(plan.orphans, attrs.Name)
+			continue
+		}
+		for _, source := range result.sources {
+			held[source] = true
+			c.replaced[source] = result
+		}
+		plan.adopted = append(plan.adopted, result)
+	}
+
+	byKey := make(map[string]*compactGroup)
+	for _, attrs := range sources {
+		if compactedSources[attrs.Name] {
+			plan.merged = append(plan.merged, attrs.Name)
+			continue
+		}
+		if held[attrs.Name] {
+			continue
+		}
+		windowStart := objectWindowStart(attrs)
+
+		codec := attrs.Metadata["codec"]
+		if codec == "" {
+			// Objects from before codecs were configurable are all zstd
+			codec = "zstd"
+		}
+
+		hour := windowStart.Truncate(time.Hour)
+		key := path.Dir(attrs.Name) + "@" + hour.Format(time.RFC3339)
+		group, ok := byKey[key]
+		if !ok {
+			group = &compactGroup{dir: path.Dir(attrs.Name), hour: hour}
+			byKey[key] = group
+		}
+		group.sources = append(group.sources, &compactSource{attrs: attrs, codec: codec, windowStart: windowStart})
+	}
+
+	for _, group := range byKey {
+		if len(group.sources) < 2 {
+			continue
+		}
+		sort.Slice(group.sources, func(i, j int) bool { return group.sources[i].attrs.Name < group.sources[j].attrs.Name })
+		plan.groups = append(plan.groups, group)
+	}
+	groups := plan.groups
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].dir != groups[j].dir {
+			return groups[i].dir < groups[j].dir
+		}
+		return groups[i].hour.Before(groups[j].hour)
+	})
+	return plan, nil
+}
+
+// objectWindowStart is the start of an object's capture window, or its
+// creation time for objects without one.
+func objectWindowStart(attrs *storage.ObjectAttrs) time.Time {
+	windowStart, err := time.Parse(time.RFC3339, attrs.Metadata["window_start"])
+	if err != nil {
+		return attrs.Created.UTC()
+	}
+	return windowStart
+}
+
+// objectDay is the UTC day of an object's capture window.
+func objectDay(attrs *storage.ObjectAttrs) string {
+	return objectWindowStart(attrs).UTC().Format("2006-01-02")
+}
+
+// manifestReferences reads the manifests and returns the objects they list
+// and the sources merged into the listed consolidated objects.
+func (c *compactor) manifestReferences(ctx context.Context, manifests []*storage.ObjectAttrs) (listed, compacted map[string]bool, err error) {
+	listed, compacted = make(map[string]bool), make(map[string]bool)
+	for _, attrs := range manifests {
+		reader, err := c.bucket.Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open manifest %s: %w", attrs.Name, err)
+		}
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry struct {
+				ObjectName    string   `json:"object_name"`
+				CompactedFrom []string `json:"compacted_from"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			listed[entry.ObjectName] = true
+			for _, source := range entry.CompactedFrom {
+				compacted[source] = true
+			}
+		}
+		err = scanner.Err()
+		reader.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read manifest %s: %w", attrs.Name, err)
+		}
+	}
+	return listed, compacted, nil
+}
+
+// readEntry reads an entry record back into the consolidated object it
+// describes.
+func (c *compactor) readEntry(ctx context.Context, name string) (*compactedObject, error) {
+	reader, err := c.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open entry record %s: %w", name, err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entry record %s: %w", name, err)
+	}
+
+	var entry map[string]interface{}
+	var sources struct {
+		CompactedFrom []string `json:"compacted_from"`
+	}
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse entry record %s: %w", name, err)
+	}
+	if err := json.Unmarshal(content, &sources); err != nil {
+		return nil, fmt.Errorf("failed to parse entry record %s: %w", name, err)
+	}
+	return &compactedObject{entry: entry, sources: sources.CompactedFrom}, nil
+}
+
+// writeEntry records a consolidated object's manifest entry beside it. It is
+// written first, so every consolidated object has one, and expires with it.
+func (c *compactor) writeEntry(ctx context.Context, result *compactedObject, retention retentionPolicy, windowStart, latest time.Time) error {
+	encoded, err := json.Marshal(result.entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode entry record: %w", err)
+	}
+
+	name := result.entry["object_name"].(string) + compactEntrySuffix
+	writer := c.bucket.Object(name).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.Metadata = map[string]string{"window_start": windowStart.Format(time.RFC3339)}
+	retention.apply(&writer.ObjectAttrs, latest)
+	if _, err := writer.Write(encoded); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write entry record %s: %w", name, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write entry record %s: %w", name, err)
+	}
+	return nil
+}
+
+// merge writes one consolidated object for a group.
+func (c *compactor) merge(ctx context.Context, group *compactGroup) (*compactedObject, error) {
+	var data []byte
+	var names []string
+	payloadType, tenant := "", group.sources[0].attrs.Metadata["tenant"]
+	retention := retentionPolicy{StorageClass: group.sources[0].attrs.StorageClass}
+	latest := group.hour
+
+	for _, source := range group.sources {
+		payload, err := c.read(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, payload...)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		names = append(names, source.attrs.Name)
+
+		metadata := source.attrs.Metadata
+		sourceType := metadata["payload_type"]
+		if sourceType == "" {
+			sourceType = payloadMetric
+		}
+		payloadType = mergePayloadTypes(payloadType, sourceType)
+		if metadata["tenant"] != tenant {
+			tenant = ""
+		}
+		if days, err := strconv.Atoi(metadata["retention_days"]); err == nil && days > retention.Days {
+			retention.Days = days
+		}
+		if source.attrs.StorageClass != retention.StorageClass {
+			retention.StorageClass = ""
+		}
+		if source.windowStart.After(latest) {
+			latest = source.windowStart
+		}
+	}
+
+	compressed, err := c.codec.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	objectName := fmt.Sprintf("%s/compact-%s-%d.wf%s", group.dir, group.hour.Format("2006010215"), now.UnixNano(), c.codec.Extension())
+	checksum := crc32.Checksum(compressed, crc32cTable)
+
+	var stats *ChunkStats
+	if c.ca.config.ChunkStats {
+		stats = computeChunkStats(data)
+	}
+
+	result := &compactedObject{
+		sources: names,
+		entry: map[string]interface{}{
+			"object_name":       objectName,
+			"original_size":     len(data),
+			"compressed_size":   len(compressed),
+			"compression_ratio": float64(len(data)) / float64(len(compressed)),
+			"timestamp":         now.Format(time.RFC3339),
+			"window_start":      group.hour.Format(time.RFC3339),
+			"codec":             c.codec.Name(),
+			"tenant":            tenant,
+			"payload_type":      payloadType,
+			"stats":             stats,
+			"crc32c":            fmt.Sprintf("%08x", checksum),
+			"index":             "",
+			"retention_days":    retention.Days,
+			"storage_class":     retention.StorageClass,
+			"compacted_from":    names,
+		},
+	}
+	if err := c.writeEntry(ctx, result, retention, group.hour, latest); err != nil {
+		return nil, err
+	}
+
+	writer := c.bucket.Object(objectName).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.ContentType = c.codec.ContentType()
+	writer.Metadata = map[string]string{
+		"original_size":   fmt.Sprintf("%d", len(data)),
+		"compressed_size": fmt.Sprintf("%d", len(compressed)),
+		"timestamp":       now.Format(time.RFC3339),
+		"window_start":    group.hour.Format(time.RFC3339),
+		"codec":           c.codec.Name(),
+		"tenant":          tenant,
+		"payload_type":    payloadType,
+		"compacted_from":  fmt.Sprintf("%d", len(names)),
+	}
+	// Expiry runs from the newest source window so nothing expires early
+	retention.apply(&writer.ObjectAttrs, latest)
+	writer.CRC32C = checksum
+	writer.SendCRC32C = true
+
+	if _, err := writer.Write(compressed); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to write compacted object: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return nil, errPreconditionFailed
+		}
+		return nil, fmt.Errorf("failed to close compacted object writer: %w", err)
+	}
+
+	if c.ca.config.ObjectIndex {
+		indexName, err := c.ca.writeObjectIndex(buildObjectIndex(objectName, data), retention, latest)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		result.entry["index"] = indexName
+	}
+
+	for _, name := range names {
+		c.replaced[name] = result
+	}
+
+	log.Printf("Compacted %d objects into %s: %d -> %d bytes", len(names), objectName, len(data), len(compressed))
+	return result, nil
+}
+
+func (c *compactor) read(ctx context.Context, source *compactSource) ([]byte, error) {
+	reader, err := c.bucket.Object(source.attrs.Name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", source.attrs.Name, err)
+	}
+	compressed, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", source.attrs.Name, err)
+	}
+
+	var dictionary []byte
+	if id := source.attrs.Metadata["zstd_dict_id"]; id != "" && id != "0" {
+		dictionary, err = c.dictionary(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := Decompress(source.codec, compressed, dictionary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", source.attrs.Name, err)
+	}
+	return data, nil
+}
+
+// dictionary fetches a trained zstd dictionary published by the agent.
+func (c *compactor) dictionary(ctx context.Context, id string) ([]byte, error) {
+	if dictionary, ok := c.dicts[id]; ok {
+		return dictionary, nil
+	}
+	name := fmt.Sprintf("%s/dicts/zstd-%s.dict", c.ca.config.BucketPrefix, id)
+	reader, err := c.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zstd dictionary %s: %w", name, err)
+	}
+	defer reader.Close()
+	dictionary, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zstd dictionary %s: %w", name, err)
+	}
+	c.dicts[id] = dictionary
+	return dictionary, nil
+}
+
+// rewriteManifest replaces entries for compacted sources with one entry per
+// consolidated object. The write is conditional on the manifest generation
+// read, so a concurrent agent write is never lost.
+func (c *compactor) rewriteManifest(ctx context.Context, attrs *storage.ObjectAttrs) error {
+	reader, err := c.bucket.Object(attrs.Name).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest %s: %w", attrs.Name, err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %s: %w", attrs.Name, err)
+	}
+
+	var out bytes.Buffer
+	written := make(map[*compactedObject]bool)
+	changed := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry struct {
+			ObjectName string `json:"object_name"`
+		}
+		if json.Unmarshal(line, &entry) == nil {
+			if result, ok := c.replaced[entry.ObjectName]; ok {
+				changed = true
+				if !written[result] {
+					written[result] = true
+					result.placed = true
+					encoded, _ := json.Marshal(result.entry)
+					out.Write(encoded)
+					out.WriteByte('\n')
+				}
+				continue
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", attrs.Name, err)
+	}
+	if !changed {
+		return nil
+	}
+
+	writer := c.bucket.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	writer.ContentType = "application/jsonl"
+	if _, err := writer.Write(out.Bytes()); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write manifest %s: %w", attrs.Name, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", attrs.Name, err)
+	}
+	log.Printf("Rewrote manifest %s", attrs.Name)
+	return nil
+}
+
+// writeUnplacedEntries records consolidated objects whose sources appeared in
+// no manifest, so every compacted object is listed somewhere.
+func (c *compactor) writeUnplacedEntries(ctx context.Context, prefix string, compacted []*compactedObject) error {
+	var out bytes.Buffer
+	for _, result := range compacted {
+		if result.placed {
+			continue
+		}
+		encoded, _ := json.Marshal(result.entry)
+		out.Write(encoded)
+		out.WriteByte('\n')
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s/dt=%s/manifests/compaction-%d-manifest.jsonl", prefix, c.date.Format("2006-01-02"), time.Now().UnixNano())
+	writer := c.bucket.Object(name).NewWriter(ctx)
+	writer.ContentType = "application/jsonl"
+	if _, err := writer.Write(out.Bytes()); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write compaction manifest: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write compaction manifest: %w", err)
+	}
+	return nil
+}
+
+func (c *compactor) deleteObject(ctx context.Context, name string) {
+	if err := c.bucket.Object(name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		log.Printf("Warning: failed to delete compacted source %s: %v", name, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	incompleteRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_incomplete_records_total",
+			Help: "Trailing records dropped because the payload ended mid-record",
+		},
+		[]string{"payload_type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(incompleteRecords)
+}
+
+// Payload types tagged on objects. A chunk holding more than one type is
+// tagged as mixed.
+const (
+	payloadMetric    = "metric"
+	payloadHistogram = "histogram"
+	payloadSpan      = "span"
+	payloadSpanLogs  = "span_logs"
+	payloadAccessLog = "access_log"
+	payloadMixed     = "mixed"
+)
+
+// detectPayloadType classifies a mirrored request using the Wavefront proxy's
+// ?f= format parameter, then the request path, then Content-Type, then the
+// payload itself.
+func detectPayloadType(r *http.Request, body []byte) string {
+	switch r.URL.Query().Get("f") {
+	case "wavefront", "graphite_v2":
+		return payloadMetric
+	case "histogram":
+		return payloadHistogram
+	case "trace":
+		return payloadSpan
+	case "spanLogs":
+		return payloadSpanLogs
+	}
+
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/logs") || strings.HasSuffix(path, "/logs"):
+		return payloadAccessLog
+	case strings.HasPrefix(path, "/histogram"):
+		return payloadHistogram
+	case strings.HasPrefix(path, "/trace") || strings.HasPrefix(path, "/spans"):
+		return payloadSpan
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(contentType, "log"):
+		return payloadAccessLog
+	case strings.Contains(contentType, "histogram"):
+		return payloadHistogram
+	case strings.Contains(contentType, "span") || strings.Contains(contentType, "trace"):
+		return payloadSpan
+	}
+
+	return sniffPayloadType(body)
+}
+
+// sniffPayloadType classifies data from its records, as needed when replaying
+// WAL segments that carry no request headers.
+func sniffPayloadType(data []byte) string {
+	payloadType := ""
+	forEachRecord(data, func(record []byte) {
+		if payloadType != payloadMixed {
+			payloadType = mergePayloadTypes(payloadType, classifyRecord(record))
+		}
+	})
+	if payloadType == "" {
+		return payloadMetric
+	}
+	return payloadType
+}
+
+func classifyRecord(record []byte) string {
+	record = bytes.TrimSpace(record)
+	switch {
+	case len(record) == 0:
+		return ""
+	case record[0] == '!':
+		return payloadHistogram
+	case record[0] == '{':
+		return payloadSpanLogs
+	case bytes.Contains(record, []byte("traceId=")):
+		return payloadSpan
+	default:
+		return payloadMetric
+	}
+}
+
+// nextRecord returns the first complete record in data and the remainder.
+// Most records are one line, but a histogram header without a metric name
+// continues on the next line, and span log lines (JSON) belong to the span
+// before them.
+func nextRecord(data []byte) (record, rest []byte) {
+	end := 0
+	for end < len(data) {
+		nl := bytes.IndexByte(data[end:], '\n')
+		if nl < 0 {
+			end = len(data)
+			break
+		}
+		line := data[end : end+nl]
+		end += nl + 1
+
+		if len(line) > 0 && line[0] == '!' && metricName(line) == nil {
+			// Histogram header: the metric line follows
+			continue
+		}
+		break
+	}
+
+	// Attach trailing span log lines to a span. Only spans have them; JSON
+	// after any other record, or starting one (span logs or access logs),
+	// stands alone
+	if classifyRecord(data[:end]) != payloadSpan {
+		return data[:end], data[end:]
+	}
+	for end < len(data) && data[end] == '{' {
+		nl := bytes.IndexByte(data[end:], '\n')
+		if nl < 0 {
+			end = len(data)
+			break
+		}
+		end += nl + 1
+	}
+
+	return data[:end], data[end:]
+}
+
+// forEachRecord calls fn for every record in data, including its newline.
+func forEachRecord(data []byte, fn func(record []byte)) {
+	for len(data) > 0 {
+		var record []byte
+		record, data = nextRecord(data)
+		fn(record)
+	}
+}
+
+// trimIncompleteRecord drops a trailing histogram header that is missing its
+// metric line, so a truncated payload cannot merge with the next request's
+// first record once both sit in the same buffer.
+func trimIncompleteRecord(body []byte, payloadType string) []byte {
+	trimmed := bytes.TrimRight(body, "\n")
+	start := bytes.LastIndexByte(trimmed, '\n') + 1
+	last := trimmed[start:]
+	if len(last) > 0 && last[0] == '!' && metricName(last) == nil {
+		incompleteRecords.WithLabelValues(payloadType).Inc()
+		return body[:start]
+	}
+	return body
+}
+
+// mergePayloadTypes combines the type of newly written data into the type
+// already recorded for a buffer.
+func mergePayloadTypes(current, added string) string {
+	if added == "" {
+		return current
+	}
+	if current == "" || current == added {
+		return added
+	}
+	return payloadMixed
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// resolveInstanceIdentity fills in instance name, zone, project, and the
+// capture agent's own MIG from the GCE metadata server. Values given on the
+// command line always win; off GCE the historical fallbacks apply.
+func resolveInstanceIdentity(cfg *Config) {
+	if cfg.UseMetadata && metadata.OnGCE() {
+		if cfg.InstanceID == "" {
+			cfg.InstanceID = metadataValue("instance name", metadata.InstanceName)
+		}
+		if cfg.Zone == "" {
+			cfg.Zone = metadataValue("zone", metadata.Zone)
+		}
+		if cfg.ProjectID == "" {
+			cfg.ProjectID = metadataValue("project ID", metadata.ProjectID)
+		}
+		if cfg.CaptureMIG == "" {
+			cfg.CaptureMIG = migFromCreatedBy(metadataValue("created-by", func() (string, error) {
+				return metadata.InstanceAttributeValue("created-by")
+			}))
+		}
+	}
+
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = fmt.Sprintf("instance-%d", time.Now().Unix())
+	}
+	if cfg.Zone == "" {
+		cfg.Zone = "unknown-zone"
+	}
+	if cfg.CaptureMIG == "" {
+		cfg.CaptureMIG = "unknown-mig"
+	}
+}
+
+func metadataValue(name string, get func() (string, error)) string {
+	value, err := get()
+	if err != nil {
+		log.Printf("Warning: failed to read %s from metadata server: %v", name, err)
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// migFromCreatedBy extracts the group name from the created-by attribute,
+// e.g. projects/123/zones/us-central1-a/instanceGroupManagers/capture-mig.
+func migFromCreatedBy(createdBy string) string {
+	const marker = "/instanceGroupManagers/"
+	if i := strings.LastIndex(createdBy, marker); i >= 0 {
+		return createdBy[i+len(marker):]
+	}
+	return ""
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -10,29 +9,34 @@ import (
 	"hash/crc32"
 	"io"
 	"log"
+	"errors"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
 const (
 	defaultPort         = 8080
 	defaultMetricsPort  = 9090
+	defaultMaxBodyBytes = 64 << 20
 	defaultMaxMemoryMB  = 512
 	defaultMaxAgeSec    = 60
 	defaultChunkSizeMB  = 128
 	defaultWorkerCount  = 16
-	compressionLevel    = 5 // zstd compression level
+	defaultDrainTimeout = 60 * time.Second
+	compressionLevel    = 5 // default zstd compression level
 )
 
 var (
@@ -95,6 +99,27 @@ var (
 			Help: "Total number of files uploaded to GCS",
 		},
 	)
+
+	shutdownDrainSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_shutdown_drain_seconds",
+			Help: "Time spent draining buffers and uploads during shutdown",
+		},
+	)
+
+	shutdownFlushedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_shutdown_flushed_bytes_total",
+			Help: "Bytes flushed from capture buffers during shutdown",
+		},
+	)
+
+	shutdownDrainTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_shutdown_drain_timeouts_total",
+			Help: "Shutdowns whose upload drain exceeded the deadline",
+		},
+	)
 )
 
 func init() {
@@ -106,6 +131,9 @@ func init() {
 	prometheus.MustRegister(uploadRateBps)
 	prometheus.MustRegister(uploadErrors)
 	prometheus.MustRegister(filesUploaded)
+	prometheus.MustRegister(shutdownDrainSeconds)
+	prometheus.MustRegister(shutdownFlushedBytes)
+	prometheus.MustRegister(shutdownDrainTimeouts)
 }
 
 type Config struct {
@@ -121,17 +149,96 @@ type Config struct {
 	SpillDir       string
 	InstanceID     string
 	Zone           string
+	MIGName        string
+	PartitionKeys  string
+	PartitionMinutes int
+	FamilyBuckets  int
+	AlignRotation  bool
+	Codec          string
+	CodecLevel     int
+	ZstdDictPath   string
+	ZstdDictTrain  bool
+	ZstdDictSamples int
+	ZstdDictSizeKB int
+	WALDir         string
+	TenantConfig   string
+	TenantHeader   string
+	TenantRequired bool
+	CaptureMIG     string
+	UseMetadata    bool
+	DrainTimeout   time.Duration
+	ChunkStats     bool
+	UploadRetries  int
+	UploadRetryInitial time.Duration
+	UploadRetryMax time.Duration
+	TLSCert        string
+	TLSKey         string
+	TLSClientCA    string
+	TLSRequireClientCert bool
+	TLSReloadInterval time.Duration
+	MaxBodyBytes   int64
+	RateLimitBytesPerSec int
+	RateLimitBurstBytes int
+	RateLimitUseXFF bool
+
+	// Live tail
+	TailToken      string
+	TailMaxClients int
+	TailMaxRate    float64
+
+	ObjectIndex bool
+
+	// Retention defaults, overridable per capture session
+	RetentionDays int
+	StorageClass  string
+
+	SubChunkMB int
+
+	RouteByType bool
+
+	// Adaptive tuning bounds
+	Adaptive              bool
+	AdaptiveInterval      time.Duration
+	AdaptiveMaxWorkers    int
+	AdaptiveMinCodecLevel int
+	AdaptiveMaxCodecLevel int
+	AdaptiveMaxAgeSec     int
+
+	// Compaction mode
+	Mode               string
+	CompactDate        string
+	CompactPrefix      string
+	CompactMinSizeMB   int
+	CompactKeepSources bool
+	CompactDryRun      bool
+}
+
+// workerPoolSize is the number of upload worker goroutines: the adaptive
+// upper bound when tuning, otherwise the fixed worker count.
+func (c *Config) workerPoolSize() int {
+	if c.Adaptive && c.AdaptiveMaxWorkers > c.WorkerCount {
+		return c.AdaptiveMaxWorkers
+	}
+	return c.WorkerCount
 }
 
 type CaptureBuffer struct {
-	data      bytes.Buffer
-	createdAt time.Time
-	mu        sync.Mutex
+	data        bytes.Buffer
+	payloadType string // payload type of everything written since the last reset
+	createdAt   time.Time
+	mu          sync.Mutex
 }
 
 func (cb *CaptureBuffer) Write(data []byte) (int, error) {
+	return cb.WriteRecords(data, payloadMetric)
+}
+
+// WriteRecords appends whole records of the given payload type. Callers must
+// pass complete records so a rotation never splits one.
+func (cb *CaptureBuffer) WriteRecords(data []byte, payloadType string) (int, error) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	cb.payloadType = mergePayloadTypes(cb.payloadType, payloadType)
 	return cb.data.Write(data)
 }
 
@@ -139,6 +246,7 @@ func (cb *CaptureBuffer) Reset() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.data.Reset()
+	cb.payloadType = ""
 	cb.createdAt = time.Now()
 }
 
@@ -154,29 +262,100 @@ func (cb *CaptureBuffer) Age() time.Duration {
 	return time.Since(cb.createdAt)
 }
 
-func (cb *CaptureBuffer) ReadAndReset() []byte {
+// ReadAndReset drains the buffer, returning its data and payload type.
+func (cb *CaptureBuffer) ReadAndReset() ([]byte, string) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	data := make([]byte, cb.data.Len())
 	copy(data, cb.data.Bytes())
+	payloadType := cb.payloadType
+	if payloadType == "" {
+		payloadType = payloadMetric
+	}
 	cb.data.Reset()
+	cb.payloadType = ""
 	cb.createdAt = time.Now()
-	return data
+	return data, payloadType
+}
+
+// captureRoute is an independent intake stream with its own buffer, WAL
+// and object prefix. Each tenant gets one route, or one per payload stream
+// when routing by type.
+type captureRoute struct {
+	name         string
+	tenantName   string
+	stream       string // empty unless routing by type
+	prefix       string
+	tenant       *Tenant
+	buffer       *CaptureBuffer
+	wal          *WAL
+	walRecovered []uint64
+	rotateMu     sync.RWMutex // keeps buffer rotation and WAL sealing atomic
+}
+
+// captureChunk is one rotated buffer handed to the upload workers, tagged
+// with the route and start of the window it was collected in.
+type captureChunk struct {
+	route       *captureRoute
+	data        []byte
+	payloadType string
+	windowStart time.Time
+	walSegment  uint64 // sealed WAL segment backing data, 0 without a WAL
+	sessions    []*CaptureSession
+	rotation    *rotationGroup // set when an oversized rotation was split
+	part        int
+}
+
+// codecHandle pairs the active codec with the zstd dictionary ID it was
+// built with, so both can be swapped atomically after training.
+type codecHandle struct {
+	codec      Codec
+	dictID     uint32
+	level      int
+	dictionary []byte // kept so the codec can be rebuilt at another level
 }
 
 type CaptureAgent struct {
 	config        *Config
-	buffer        *CaptureBuffer
+	layout        *PartitionLayout
+	tenants       *TenantRegistry
+	routes        map[string]*captureRoute
 	gcsClient     *storage.Client
-	uploadQueue   chan []byte
+	uploadQueue   chan *captureChunk
+	codec         atomic.Pointer[codecHandle]
+	dictSampler   *dictSampler
+	sessions      *SessionManager
+	certs         *certReloader
+	rateLimiter   *clientRateLimiter
+	tuning        *tuning
+	tuner         *adaptiveTuner
+	tail          *tailHub
+	server        *http.Server
+	draining      atomic.Bool
+	stopping      chan struct{} // closed when intake stops
+	producers     sync.WaitGroup // everything that sends on uploadQueue
+	producersMu   sync.Mutex
+	closing       bool // set under producersMu once Stop waits on producers
+	workers       sync.WaitGroup
 	wg            sync.WaitGroup
 	ctx           context.Context
 	cancel        context.CancelFunc
 	bytesUploaded int64
+	bytesIngested int64
 	uploadStart   time.Time
 }
 
 func NewCaptureAgent(config *Config) (*CaptureAgent, error) {
+	layout, err := ParsePartitionLayout(config.PartitionKeys, config.PartitionMinutes, config.FamilyBuckets, config.MIGName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid partition layout: %w", err)
+	}
+
+	config.StorageClass, err = validateStorageClass(config.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Initialize GCS client
@@ -194,61 +373,284 @@ func NewCaptureAgent(config *Config) (*CaptureAgent, error) {
 
 	ca := &CaptureAgent{
 		config:      config,
-		buffer:      &CaptureBuffer{createdAt: time.Now()},
+		layout:      layout,
+		routes:      make(map[string]*captureRoute),
+		stopping:    make(chan struct{}),
+		sessions:    NewSessionManager(),
 		gcsClient:   client,
-		uploadQueue: make(chan []byte, config.WorkerCount*2),
+		uploadQueue: make(chan *captureChunk, config.workerPoolSize()*2),
+		tuning:      newTuning(config),
 		ctx:         ctx,
 		cancel:      cancel,
 		uploadStart: time.Now(),
 	}
 
+	// Load a pre-trained zstd dictionary if one was supplied
+	var dictionary []byte
+	if config.ZstdDictPath != "" {
+		dictionary, err = os.ReadFile(config.ZstdDictPath)
+		if err != nil {
+			cancel()
+			client.Close()
+			return nil, fmt.Errorf("failed to read zstd dictionary: %w", err)
+		}
+	}
+
+	codec, err := NewCodec(config.Codec, config.CodecLevel, dictionary)
+	if err != nil {
+		cancel()
+		client.Close()
+		return nil, fmt.Errorf("failed to create codec: %w", err)
+	}
+	ca.codec.Store(newCodecHandle(codec, config.CodecLevel, dictionary))
+
+	if config.Codec == "zstd" && config.ZstdDictTrain && len(dictionary) == 0 {
+		ca.dictSampler = newDictSampler(config.ZstdDictSamples, 100)
+	}
+
+	if config.TenantConfig != "" {
+		ca.tenants, err = LoadTenantRegistry(config.TenantConfig, config.TenantHeader, config.TenantRequired, config.BucketPrefix)
+		if err != nil {
+			cancel()
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if err := ca.initRoutes(); err != nil {
+		cancel()
+		client.Close()
+		return nil, err
+	}
+
+	if config.RateLimitBytesPerSec > 0 {
+		if burst := max(config.RateLimitBurstBytes, config.RateLimitBytesPerSec); int64(burst) < config.MaxBodyBytes {
+			log.Printf("Rate limit burst of %d bytes is below -max-body-bytes %d; larger bodies are only admitted from a full bucket", burst, config.MaxBodyBytes)
+		}
+		ca.rateLimiter = newClientRateLimiter(config.RateLimitBytesPerSec, config.RateLimitBurstBytes, config.RateLimitUseXFF)
+	}
+
+	if config.TailMaxClients > 0 {
+		// -tail-token grants the default tenant; tenants bring their own
+		tokens := make(map[string]string)
+		if config.TailToken != "" {
+			tokens[config.TailToken] = defaultTenant
+		}
+		if ca.tenants != nil {
+			for token, tenant := range ca.tenants.byTailToken {
+				if _, exists := tokens[token]; exists {
+					cancel()
+					client.Close()
+					return nil, fmt.Errorf("tenant %q tail token is also the -tail-token", tenant.Name)
+				}
+				tokens[token] = tenant.Name
+			}
+		}
+		if len(tokens) == 0 {
+			cancel()
+			client.Close()
+			return nil, fmt.Errorf("live tail requires a -tail-token or tenant tail_tokens")
+		}
+		ca.tail = newTailHub(tokens, config.TailMaxClients, config.TailMaxRate)
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		ca.certs, err = newCertReloader(config.TLSCert, config.TLSKey, config.TLSClientCA, config.TLSRequireClientCert)
+		if err != nil {
+			cancel()
+			client.Close()
+			return nil, err
+		}
+	}
+
+	// The server exists before Start so that Stop can shut it down however
+	// far Start has got
+	ca.server = ca.newHTTPServer()
+
 	return ca, nil
 }
 
+// addProducer registers a sender on the upload queue, which Stop waits for
+// before closing it. It returns false once the agent is stopping, in which
+// case nothing may be queued.
+func (ca *CaptureAgent) addProducer() bool {
+	ca.producersMu.Lock()
+	defer ca.producersMu.Unlock()
+	if ca.closing {
+		return false
+	}
+	ca.producers.Add(1)
+	return true
+}
+
+// Start runs the upload workers, WAL replay, buffer rotation and metrics,
+// then serves intake until the HTTP server stops.
 func (ca *CaptureAgent) Start() error {
 	log.Printf("Starting capture agent on port %d", ca.config.Port)
 
-	// Start upload workers
-	for i := 0; i < ca.config.WorkerCount; i++ {
-		ca.wg.Add(1)
+	// Start upload workers; with adaptive tuning the extra workers stay
+	// parked until the tuner activates them
+	for i := 0; i < ca.config.workerPoolSize(); i++ {
+		ca.workers.Add(1)
 		go ca.uploadWorker(i)
 	}
 
+	// Re-upload segments left behind by a previous run
+	for _, route := range ca.routes {
+		if len(route.walRecovered) > 0 && ca.addProducer() {
+			go ca.replayWAL(route)
+		}
+	}
+
 	// Start buffer rotation ticker
-	ca.wg.Add(1)
-	go ca.bufferRotator()
+	if ca.addProducer() {
+		go ca.bufferRotator()
+	}
 
 	// Start metrics updater
 	ca.wg.Add(1)
 	go ca.metricsUpdater()
 
+	if ca.config.Adaptive {
+		ca.tuner = newAdaptiveTuner(ca)
+		ca.wg.Add(1)
+		go ca.tuner.run(ca.config.AdaptiveInterval)
+	}
+
 	// Start HTTP servers
 	go ca.startMetricsServer()
-	return ca.startHTTPServer()
+	return ca.serveHTTP()
 }
 
-func (ca *CaptureAgent) Stop() {
+// Stop drains the agent: intake stops, the remaining buffers are flushed,
+// and the upload queue is drained. Uploads still running at the deadline are
+// aborted, which makes them fall back to the spill directory.
+func (ca *CaptureAgent) Stop(drainTimeout time.Duration) {
 	log.Println("Stopping capture agent...")
-	ca.cancel()
+	start := time.Now()
+	ca.draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// Stop intake and let in-flight mirror requests finish
+	if err := ca.server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down capture server: %v", err)
+	}
+
+	// Stop producers before flushing so nothing races the queue close;
+	// session handlers that outlived the shutdown deadline are among them
+	ca.producersMu.Lock()
+	ca.closing = true
+	ca.producersMu.Unlock()
+	close(ca.stopping)
+	ca.producers.Wait()
+	shutdownFlushedBytes.Add(float64(ca.flushBuffers(ctx)))
+	ca.tuning.setWorkers(ca.config.workerPoolSize())
 	close(ca.uploadQueue)
+
+	done := make(chan struct{})
+	go func() {
+		ca.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Drain deadline exceeded with %d chunks queued, aborting uploads", len(ca.uploadQueue))
+		shutdownDrainTimeouts.Inc()
+		ca.cancel()
+		<-done
+	}
+
+	ca.cancel()
 	ca.wg.Wait()
+	for _, route := range ca.routes {
+		if route.wal != nil {
+			route.wal.Close()
+		}
+	}
 	ca.gcsClient.Close()
-	log.Println("Capture agent stopped")
+
+	shutdownDrainSeconds.Set(time.Since(start).Seconds())
+	log.Printf("Capture agent stopped after %.1fs drain", time.Since(start).Seconds())
+}
+
+// flushBuffers rotates every non-empty buffer regardless of size or age and
+// returns the number of bytes flushed. Chunks that cannot be queued before
+// the deadline are spilled.
+func (ca *CaptureAgent) flushBuffers(ctx context.Context) int {
+	flushed := 0
+	for _, route := range ca.routes {
+		size := route.buffer.Size()
+		if size == 0 {
+			continue
+		}
+
+		windowStart := time.Now().Add(-route.buffer.Age())
+		if ca.config.AlignRotation {
+			windowStart = alignedWindowStart(windowStart, time.Duration(ca.config.MaxAgeSec)*time.Second)
+		}
+		chunk, err := ca.takeChunk(route, windowStart)
+		if err != nil {
+			log.Printf("Error flushing %s buffer: %v", route.name, err)
+			continue
+		}
+		flushed += len(chunk.data)
+		log.Printf("Flushing %s buffer: %d bytes", route.name, len(chunk.data))
+
+		for _, part := range ca.splitChunk(chunk) {
+			select {
+			case ca.uploadQueue <- part:
+			case <-ctx.Done():
+				err := ca.spillToDisk(part.data)
+				ca.ackChunk(part, err == nil)
+				ca.recordSessionUpload(part, nil, int64(len(part.data)))
+				log.Printf("Flush deadline reached, spilled %d bytes to disk", len(part.data))
+			}
+		}
+	}
+	return flushed
 }
 
-func (ca *CaptureAgent) startHTTPServer() error {
+func (ca *CaptureAgent) newHTTPServer() *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", ca.handleMirror)
 	mux.HandleFunc("/health", ca.handleHealth)
 	mux.HandleFunc("/ready", ca.handleReady)
+	mux.HandleFunc("/sessions", ca.handleSessions)
+	mux.HandleFunc("/sessions/", ca.handleSessions)
+	mux.HandleFunc("/api/v1/write", ca.handleRemoteWrite)
+	if ca.tail != nil {
+		mux.HandleFunc("/tail", ca.handleTail)
+	}
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", ca.config.Port),
 		Handler: mux,
 	}
+	if ca.certs != nil {
+		server.TLSConfig = ca.certs.TLSConfig()
+	}
+	return server
+}
 
-	log.Printf("Capture HTTP server listening on port %d", ca.config.Port)
-	return server.ListenAndServe()
+// serveHTTP serves intake until Stop shuts the server down.
+func (ca *CaptureAgent) serveHTTP() error {
+	var err error
+	if ca.certs != nil {
+		go ca.certs.watch(ca.config.TLSReloadInterval, ca.stopping)
+
+		log.Printf("Capture HTTPS server listening on port %d (client certs required: %v)", ca.config.Port, ca.config.TLSRequireClientCert)
+		err = ca.server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Capture HTTP server listening on port %d", ca.config.Port)
+		err = ca.server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func (ca *CaptureAgent) startMetricsServer() {
@@ -271,30 +673,135 @@ func (ca *CaptureAgent) handleMirror(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method, r.URL.Path).Inc()
 
 	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+	body, ok := ca.readBody(w, r)
+	if !ok {
 		return
 	}
 
-	// Update bytes received metrics
-	bytesReceived.WithLabelValues(r.Header.Get("Content-Type")).Add(float64(len(body)))
+	tenantName, ok := ca.admitTenant(w, r, len(body))
+	if !ok {
+		return
+	}
 
 	// Add newline if not present (Wavefront line protocol)
 	if len(body) > 0 && body[len(body)-1] != '\n' {
 		body = append(body, '\n')
 	}
 
+	// Only whole records may enter the buffer, so rotation cannot split a
+	// multi-line histogram or a span from its logs
+	payloadType := detectPayloadType(r, body)
+	body = trimIncompleteRecord(body, payloadType)
+
 	// Write to buffer
-	if len(body) > 0 {
-		ca.buffer.Write(body)
+	if err := ca.writePayload(tenantName, payloadType, body); err != nil {
+		log.Printf("Error appending to WAL: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
 
 	// Respond quickly to mirror
 	w.WriteHeader(http.StatusOK)
 }
 
+// readBody reads a request body of at most -max-body-bytes within the
+// client's rate limit. The declared length is charged before reading, so
+// rejected bodies are never buffered; chunked bodies are charged once read.
+// On rejection it writes the response and returns false.
+func (ca *CaptureAgent) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	charged := ca.rateLimiter != nil && r.ContentLength >= 0
+	if charged && !ca.rateLimiter.Allow(r, int(r.ContentLength)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ca.config.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Update bytes received metrics
+	bytesReceived.WithLabelValues(r.Header.Get("Content-Type")).Add(float64(len(body)))
+
+	if ca.rateLimiter != nil && !charged && !ca.rateLimiter.Allow(r, len(body)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil, false
+	}
+	return body, true
+}
+
+// admitTenant identifies the request's tenant and charges n bytes to its
+// quota. On rejection it writes the response and returns false.
+func (ca *CaptureAgent) admitTenant(w http.ResponseWriter, r *http.Request, n int) (string, bool) {
+	tenantName := defaultTenant
+	if ca.tenants != nil {
+		tenant, err := ca.tenants.Identify(r)
+		if err != nil {
+			tenantRequestsRejected.WithLabelValues("unknown", "unidentified").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return "", false
+		}
+		if tenant != nil {
+			if !tenant.Consume(n) {
+				tenantRequestsRejected.WithLabelValues(tenant.Name, "quota").Inc()
+				w.WriteHeader(http.StatusTooManyRequests)
+				return "", false
+			}
+			tenantName = tenant.Name
+		}
+	}
+	tenantBytesReceived.WithLabelValues(tenantName).Add(float64(n))
+	return tenantName, true
+}
+
+// writePayload routes complete records into the tenant's buffers.
+func (ca *CaptureAgent) writePayload(tenantName, payloadType string, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	for _, payload := range ca.demux(tenantName, payloadType, body) {
+		if err := ca.ingest(payload); err != nil {
+			return err
+		}
+	}
+
+	if ca.dictSampler != nil && ca.dictSampler.Offer(body) {
+		go ca.trainDictionary()
+	}
+	return nil
+}
+
+// ingest writes complete records to a route's buffer, first making them
+// durable in the route's WAL when one is configured.
+func (ca *CaptureAgent) ingest(payload routedPayload) error {
+	route := payload.route
+	if route.wal != nil {
+		// The payload must be durable before we acknowledge it
+		route.rotateMu.RLock()
+		if err := route.wal.Append(payload.body); err != nil {
+			route.rotateMu.RUnlock()
+			return err
+		}
+		route.buffer.WriteRecords(payload.body, payload.payloadType)
+		route.rotateMu.RUnlock()
+	} else {
+		route.buffer.WriteRecords(payload.body, payload.payloadType)
+	}
+
+	atomic.AddInt64(&ca.bytesIngested, int64(len(payload.body)))
+	if ca.tail != nil {
+		ca.tail.Publish(route.tenantName, payload.payloadType, payload.body)
+	}
+	return nil
+}
+
 func (ca *CaptureAgent) handleHealth(w http.ResponseWriter, r *http.Request) {
 	// Check if we're severely backlogged
 	backlog := ca.calculateBacklog()
@@ -309,139 +816,337 @@ func (ca *CaptureAgent) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ca *CaptureAgent) handleReady(w http.ResponseWriter, r *http.Request) {
+	if ca.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("DRAINING"))
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("READY"))
 }
 
 func (ca *CaptureAgent) bufferRotator() {
-	defer ca.wg.Done()
+	defer ca.producers.Done()
 
-	ticker := time.NewTicker(5 * time.Second) // Check every 5 seconds
+	interval := 5 * time.Second // Check every 5 seconds
+	if ca.config.AlignRotation {
+		// Tighter checks keep aligned windows close to their boundaries
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ca.ctx.Done():
-			// Final rotation on shutdown
-			ca.rotateBuffer()
+		case <-ca.stopping:
+			// Stop flushes the final buffers once intake has drained
 			return
 		case <-ticker.C:
-			ca.rotateBuffer()
+			ca.rotateBuffers()
 		}
 	}
 }
 
-func (ca *CaptureAgent) rotateBuffer() {
-	bufferSize := ca.buffer.Size()
-	bufferAge := ca.buffer.Age()
+func (ca *CaptureAgent) rotateBuffers() {
+	for _, route := range ca.routes {
+		ca.rotateBuffer(route)
+	}
+}
+
+func (ca *CaptureAgent) rotateBuffer(route *captureRoute) {
+	bufferSize := route.buffer.Size()
+	bufferAge := route.buffer.Age()
+
+	maxSize := ca.tuning.RotateBytes()
+	maxAge := ca.tuning.RotateAge()
 
-	maxSize := ca.config.MaxMemoryMB * 1024 * 1024
-	maxAge := time.Duration(ca.config.MaxAgeSec) * time.Second
+	windowStart := time.Now().Add(-bufferAge)
+	expired := bufferAge > maxAge
+	if ca.config.AlignRotation {
+		// Rotate when the wall clock crosses into the next aligned window
+		windowStart = alignedWindowStart(windowStart, maxAge)
+		expired = !time.Now().Before(windowStart.Add(maxAge))
+	}
 
 	// Rotate if buffer is too large or too old
-	if bufferSize > maxSize || bufferAge > maxAge {
+	if bufferSize > maxSize || expired {
 		if bufferSize > 0 {
-			data := ca.buffer.ReadAndReset()
-			
+			chunk, err := ca.takeChunk(route, windowStart)
+			if err != nil {
+				log.Printf("Error rotating buffer: %v", err)
+				return
+			}
+
+			log.Printf("Rotated %s buffer: %d bytes, age %.1fs", route.name, len(chunk.data), bufferAge.Seconds())
+			for _, part := range ca.splitChunk(chunk) {
+				select {
+				case ca.uploadQueue <- part:
+				default:
+					// Queue full, spill to disk
+					err := ca.spillToDisk(part.data)
+					ca.ackChunk(part, err == nil)
+					ca.recordSessionUpload(part, nil, int64(len(part.data)))
+					log.Printf("Queue full, spilled %d bytes to disk", len(part.data))
+				}
+			}
+		} else if expired {
+			route.buffer.Reset()
+		}
+	}
+}
+
+// takeChunk drains the buffer into a chunk. With a WAL the active segment is
+// sealed under the same lock so the segment holds exactly the chunk's data.
+func (ca *CaptureAgent) takeChunk(route *captureRoute, windowStart time.Time) (*captureChunk, error) {
+	if route.wal == nil {
+		data, payloadType := route.buffer.ReadAndReset()
+		return &captureChunk{
+			route:       route,
+			data:        data,
+			payloadType: payloadType,
+			windowStart: windowStart,
+			sessions:    ca.sessions.attachChunk(),
+		}, nil
+	}
+
+	route.rotateMu.Lock()
+	defer route.rotateMu.Unlock()
+
+	seq, err := route.wal.Seal()
+	if err != nil {
+		return nil, err
+	}
+	data, payloadType := route.buffer.ReadAndReset()
+	return &captureChunk{
+		route:       route,
+		data:        data,
+		payloadType: payloadType,
+		windowStart: windowStart,
+		walSegment:  seq,
+		sessions:    ca.sessions.attachChunk(),
+	}, nil
+}
+
+// ackChunk releases the WAL segment behind a chunk once all of its data has
+// been uploaded or spilled.
+func (ca *CaptureAgent) ackChunk(chunk *captureChunk, durable bool) {
+	if chunk.walSegment == 0 {
+		return
+	}
+	if chunk.rotation != nil {
+		last, allDurable := chunk.rotation.done(durable)
+		if !last {
+			return
+		}
+		durable = allDurable
+	}
+	if !durable {
+		log.Printf("Keeping WAL segment %d for replay after failed persistence", chunk.walSegment)
+		return
+	}
+	if err := chunk.route.wal.Ack(chunk.walSegment); err != nil {
+		log.Printf("Error acknowledging WAL segment %d: %v", chunk.walSegment, err)
+	}
+}
+
+// replayWAL feeds segments recovered at startup back into the upload queue.
+func (ca *CaptureAgent) replayWAL(route *captureRoute) {
+	defer ca.producers.Done()
+
+	for _, seq := range route.walRecovered {
+		data, modTime, err := route.wal.ReadSegment(seq)
+		if err != nil {
+			log.Printf("Error reading WAL segment %d: %v", seq, err)
+			continue
+		}
+
+		chunk := &captureChunk{route: route, data: data, payloadType: sniffPayloadType(data), windowStart: modTime, walSegment: seq}
+		if len(data) == 0 {
+			ca.ackChunk(chunk, true)
+			continue
+		}
+
+		log.Printf("Replaying %s WAL segment %d: %d bytes", route.name, seq, len(data))
+		for _, part := range ca.splitChunk(chunk) {
 			select {
-			case ca.uploadQueue <- data:
-				log.Printf("Rotated buffer: %d bytes, age %.1fs", len(data), bufferAge.Seconds())
-			default:
-				// Queue full, spill to disk
-				ca.spillToDisk(data)
-				log.Printf("Queue full, spilled %d bytes to disk", len(data))
+			case ca.uploadQueue <- part:
+			case <-ca.stopping:
+				// The segment is only acknowledged once all parts are
+				// uploaded, so it is replayed again on the next start
+				return
 			}
 		}
 	}
 }
 
-func (ca *CaptureAgent) spillToDisk(data []byte) {
+func (ca *CaptureAgent) spillToDisk(data []byte) error {
 	filename := fmt.Sprintf("spill-%d-%d.wf", time.Now().UnixNano(), crc32.ChecksumIEEE(data))
 	filepath := filepath.Join(ca.config.SpillDir, filename)
 
 	if err := os.WriteFile(filepath, data, 0644); err != nil {
 		log.Printf("Error spilling to disk: %v", err)
 		uploadErrors.WithLabelValues("spill_error").Inc()
+		return err
 	}
+	return nil
 }
 
 func (ca *CaptureAgent) uploadWorker(workerID int) {
-	defer ca.wg.Done()
+	defer ca.workers.Done()
 
 	log.Printf("Upload worker %d started", workerID)
 
-	for data := range ca.uploadQueue {
+	for {
+		ca.tuning.waitActive(workerID)
+		chunk, ok := <-ca.uploadQueue
+		if !ok {
+			break
+		}
 		uploadsInflight.Inc()
-		
-		if err := ca.uploadToGCS(data); err != nil {
-			log.Printf("Worker %d: Upload failed: %v", workerID, err)
-			uploadErrors.WithLabelValues("upload_error").Inc()
-			
-			// Spill to disk on upload failure
-			ca.spillToDisk(data)
-		} else {
-			filesUploaded.Inc()
-			atomic.AddInt64(&ca.bytesUploaded, int64(len(data)))
+		ca.tuning.busy.Add(1)
+
+		parts := map[int][]byte{0: chunk.data}
+		if ca.layout.HasFamily() {
+			parts = splitByFamily(chunk.data, ca.layout.FamilyBuckets)
+		}
+
+		durable := true
+		var objects []SessionObject
+		var spilled int64
+		for family, data := range parts {
+			objectName, err := ca.uploadToGCS(chunk, data, family)
+			if err != nil {
+				log.Printf("Worker %d: Upload failed: %v", workerID, err)
+
+				// Spill to disk on upload failure
+				if err := ca.spillToDisk(data); err != nil {
+					durable = false
+				}
+				spilled += int64(len(data))
+			} else {
+				filesUploaded.Inc()
+				atomic.AddInt64(&ca.bytesUploaded, int64(len(data)))
+				objects = append(objects, SessionObject{
+					ObjectName:  objectName,
+					Tenant:      chunk.route.tenantName,
+					Bytes:       len(data),
+					WindowStart: chunk.windowStart,
+				})
+			}
 		}
+		ca.ackChunk(chunk, durable)
+		ca.recordSessionUpload(chunk, objects, spilled)
 
+		ca.tuning.busy.Add(-1)
 		uploadsInflight.Dec()
 	}
 
 	log.Printf("Upload worker %d stopped", workerID)
 }
 
-func (ca *CaptureAgent) uploadToGCS(data []byte) error {
-	// Compress data
-	var compressedBuf bytes.Buffer
-	encoder, err := zstd.NewWriter(&compressedBuf, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
-	if err != nil {
-		return fmt.Errorf("failed to create zstd encoder: %w", err)
-	}
+func (ca *CaptureAgent) uploadToGCS(chunk *captureChunk, data []byte, family int) (string, error) {
+	windowStart := chunk.windowStart
 
-	if _, err := encoder.Write(data); err != nil {
-		encoder.Close()
-		return fmt.Errorf("failed to compress data: %w", err)
+	var stats *ChunkStats
+	if ca.config.ChunkStats {
+		stats = computeChunkStats(data)
 	}
 
-	if err := encoder.Close(); err != nil {
-		return fmt.Errorf("failed to close zstd encoder: %w", err)
+	// Compress data
+	handle := ca.codec.Load()
+	compressedData, err := handle.codec.Compress(data)
+	if err != nil {
+		uploadErrors.WithLabelValues("compress_error").Inc()
+		return "", err
 	}
 
-	compressedData := compressedBuf.Bytes()
-
 	// Generate object name
 	timestamp := time.Now().UTC()
-	objectName := fmt.Sprintf("%s/dt=%s/mig=%s/%s/part-%d.wf.zst",
-		ca.config.BucketPrefix,
-		timestamp.Format("2006-01-02"),
-		"tier-e", // MIG identifier
+	objectName := fmt.Sprintf("%s/%s/%s/part-%d.wf%s",
+		chunk.route.prefix,
+		ca.layout.Path(windowStart, family),
 		ca.config.InstanceID,
 		timestamp.UnixNano(),
+		handle.codec.Extension(),
 	)
 
 	// Upload to GCS with resumable uploads
 	bucket := ca.gcsClient.Bucket(ca.config.BucketName)
-	obj := bucket.Object(objectName)
+	target := bucket.Object(objectName)
+	obj := target.If(storage.Conditions{DoesNotExist: true})
 
-	writer := obj.NewWriter(ca.ctx)
-	writer.ChunkSize = ca.config.ChunkSizeMB * 1024 * 1024
-	writer.ContentType = "application/zstd"
-	writer.Metadata = map[string]string{
+	metadata := map[string]string{
 		"original_size":     fmt.Sprintf("%d", len(data)),
 		"compressed_size":   fmt.Sprintf("%d", len(compressedData)),
 		"compression_ratio": fmt.Sprintf("%.2f", float64(len(data))/float64(len(compressedData))),
 		"timestamp":         timestamp.Format(time.RFC3339),
+		"window_start":      windowStart.UTC().Format(time.RFC3339),
 		"instance_id":       ca.config.InstanceID,
 		"zone":              ca.config.Zone,
+		"capture_mig":       ca.config.CaptureMIG,
+		"project_id":        ca.config.ProjectID,
+		"codec":             handle.codec.Name(),
+		"tenant":            chunk.route.tenantName,
+		"payload_type":      chunk.payloadType,
+	}
+	if chunk.route.stream != "" {
+		metadata["stream"] = chunk.route.stream
+	}
+	if handle.dictID != 0 {
+		metadata["zstd_dict_id"] = fmt.Sprintf("%d", handle.dictID)
+	}
+	if chunk.rotation != nil {
+		metadata["rotation_id"] = chunk.rotation.id
+		metadata["rotation_part"] = fmt.Sprintf("%d", chunk.part)
+		metadata["rotation_parts"] = fmt.Sprintf("%d", chunk.rotation.parts)
+	}
+	if len(chunk.sessions) > 0 {
+		ids := make([]string, len(chunk.sessions))
+		for i, session := range chunk.sessions {
+			ids[i] = session.ID
+		}
+		metadata["session_ids"] = strings.Join(ids, ",")
 	}
 
-	if _, err := writer.Write(compressedData); err != nil {
-		writer.Close()
-		return fmt.Errorf("failed to write to GCS: %w", err)
+	retention := ca.retentionFor(chunk)
+
+	// GCS verifies the precomputed CRC32C and rejects corrupted uploads
+	checksum := crc32.Checksum(compressedData, crc32cTable)
+	err = ca.withUploadRetry(target, checksum, int64(len(compressedData)), func(attempt int) error {
+		writer := obj.NewWriter(ca.ctx)
+		writer.ChunkSize = ca.config.ChunkSizeMB * 1024 * 1024
+		writer.ContentType = handle.codec.ContentType()
+		writer.Metadata = metadata
+		retention.apply(&writer.ObjectAttrs, windowStart)
+		writer.CRC32C = checksum
+		writer.SendCRC32C = true
+
+		if _, err := writer.Write(compressedData); err != nil {
+			writer.Close()
+			return fmt.Errorf("failed to write to GCS: %w", err)
+		}
+
+		if err := writer.Close(); err != nil {
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+				return errPreconditionFailed
+			}
+			return fmt.Errorf("failed to close GCS writer: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("failed to close GCS writer: %w", err)
+	// The index is an optimization for readers; the object is already durable
+	var indexName string
+	if ca.config.ObjectIndex {
+		indexName, err = ca.writeObjectIndex(buildObjectIndex(objectName, data), retention, windowStart)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
 	}
 
 	// Create manifest entry
@@ -451,17 +1156,36 @@ func (ca *CaptureAgent) uploadToGCS(data []byte) error {
 		"compressed_size":   len(compressedData),
 		"compression_ratio": float64(len(data)) / float64(len(compressedData)),
 		"timestamp":         timestamp.Format(time.RFC3339),
+		"window_start":      windowStart.UTC().Format(time.RFC3339),
 		"instance_id":       ca.config.InstanceID,
 		"zone":              ca.config.Zone,
+		"capture_mig":       ca.config.CaptureMIG,
+		"project_id":        ca.config.ProjectID,
+		"codec":             handle.codec.Name(),
+		"zstd_dict_id":      handle.dictID,
+		"tenant":            chunk.route.tenantName,
+		"stream":            chunk.route.stream,
+		"payload_type":      chunk.payloadType,
+		"stats":             stats,
 		"sha256":            fmt.Sprintf("%x", crc32.ChecksumIEEE(data)), // Use CRC32 for speed
+		"crc32c":            fmt.Sprintf("%08x", checksum),
+		"index":             indexName,
+		"retention_days":    retention.Days,
+		"storage_class":     retention.StorageClass,
+	}
+
+	if chunk.rotation != nil {
+		manifest["rotation_id"] = chunk.rotation.id
+		manifest["rotation_part"] = chunk.part
+		manifest["rotation_parts"] = chunk.rotation.parts
 	}
 
 	manifestData, _ := json.Marshal(manifest)
 	manifestData = append(manifestData, '\n')
 
 	manifestObjectName := fmt.Sprintf("%s/dt=%s/manifests/%s-manifest.jsonl",
-		ca.config.BucketPrefix,
-		timestamp.Format("2006-01-02"),
+		chunk.route.prefix,
+		windowStart.UTC().Format("2006-01-02"),
 		ca.config.InstanceID,
 	)
 
@@ -482,13 +1206,63 @@ func (ca *CaptureAgent) uploadToGCS(data []byte) error {
 		objectName, len(data), len(compressedData),
 		float64(len(data))/float64(len(compressedData)))
 
-	return nil
+	return objectName, nil
+}
+
+// trainDictionary builds a zstd dictionary from sampled intake, publishes it
+// next to the capture data so readers can decode, and swaps it into the codec.
+func (ca *CaptureAgent) trainDictionary() {
+	samples := ca.dictSampler.Samples()
+	dictionary, err := trainZstdDict(samples, ca.config.ZstdDictSizeKB*1024)
+	if err != nil {
+		log.Printf("Zstd dictionary training failed: %v", err)
+		return
+	}
+
+	level := ca.codec.Load().level
+	codec, err := NewCodec("zstd", level, dictionary)
+	if err != nil {
+		log.Printf("Failed to build codec from trained dictionary: %v", err)
+		return
+	}
+	handle := newCodecHandle(codec, level, dictionary)
+
+	// Publish the dictionary before any object depends on it
+	dictObjectName := fmt.Sprintf("%s/dicts/zstd-%d.dict", ca.config.BucketPrefix, handle.dictID)
+	writer := ca.gcsClient.Bucket(ca.config.BucketName).Object(dictObjectName).NewWriter(ca.ctx)
+	writer.ContentType = "application/octet-stream"
+	if _, err := writer.Write(dictionary); err != nil {
+		writer.Close()
+		log.Printf("Failed to upload zstd dictionary: %v", err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to upload zstd dictionary: %v", err)
+		return
+	}
+
+	ca.codec.Store(handle)
+	log.Printf("Trained zstd dictionary %d (%d bytes) from %d samples", handle.dictID, len(dictionary), len(samples))
+}
+
+func newCodecHandle(codec Codec, level int, dictionary []byte) *codecHandle {
+	handle := &codecHandle{codec: codec, level: level, dictionary: dictionary}
+	if zc, ok := codec.(*zstdCodec); ok {
+		handle.dictID = zc.dictID
+	}
+	return handle
 }
 
 func (ca *CaptureAgent) calculateBacklog() float64 {
 	queueLen := float64(len(ca.uploadQueue))
 	maxQueue := float64(cap(ca.uploadQueue))
-	bufferSize := float64(ca.buffer.Size())
+	bufferSize := 0.0
+	for _, route := range ca.routes {
+		// Routes rotate independently, so the fullest one bounds the backlog
+		if size := float64(route.buffer.Size()); size > bufferSize {
+			bufferSize = size
+		}
+	}
 	maxBuffer := float64(ca.config.MaxMemoryMB * 1024 * 1024)
 
 	// Estimate processing time based on current queue and buffer state
@@ -534,30 +1308,111 @@ func main() {
 	flag.IntVar(&cfg.MaxAgeSec, "max-age-sec", defaultMaxAgeSec, "Max buffer age in seconds")
 	flag.IntVar(&cfg.ChunkSizeMB, "chunk-size-mb", defaultChunkSizeMB, "GCS upload chunk size in MB")
 	flag.IntVar(&cfg.WorkerCount, "workers", defaultWorkerCount, "Number of upload workers")
+	flag.BoolVar(&cfg.Adaptive, "adaptive", false, "Tune workers, compression level and rotation thresholds from observed throughput")
+	flag.DurationVar(&cfg.AdaptiveInterval, "adaptive-interval", 15*time.Second, "How often the adaptive tuner re-evaluates")
+	flag.IntVar(&cfg.AdaptiveMaxWorkers, "adaptive-max-workers", defaultWorkerCount*4, "Upper bound on upload workers under adaptive tuning (-workers is the lower bound)")
+	flag.IntVar(&cfg.AdaptiveMinCodecLevel, "adaptive-min-codec-level", 1, "Fastest compression level the adaptive tuner may select")
+	flag.IntVar(&cfg.AdaptiveMaxCodecLevel, "adaptive-max-codec-level", 9, "Strongest compression level the adaptive tuner may select")
+	flag.IntVar(&cfg.AdaptiveMaxAgeSec, "adaptive-max-age-sec", defaultMaxAgeSec*4, "Longest rotation age the adaptive tuner may select when traffic is quiet")
+	flag.IntVar(&cfg.SubChunkMB, "sub-chunk-mb", 64, "Split rotations larger than this into sub-chunks uploaded in parallel (0 disables)")
 	flag.StringVar(&cfg.SpillDir, "spill-dir", "/var/spool/capture-agent", "Directory for spill files")
-	flag.StringVar(&cfg.InstanceID, "instance-id", "", "Instance ID")
-	flag.StringVar(&cfg.Zone, "zone", "", "GCP zone")
+	flag.StringVar(&cfg.InstanceID, "instance-id", "", "Instance ID (defaults to the GCE instance name)")
+	flag.StringVar(&cfg.Zone, "zone", "", "GCP zone (defaults to the GCE zone)")
+	flag.StringVar(&cfg.CaptureMIG, "capture-mig", "", "Capture agent MIG name (defaults to the GCE instance group)")
+	flag.BoolVar(&cfg.UseMetadata, "metadata", true, "Resolve instance identity from the GCE metadata server")
+	flag.IntVar(&cfg.RetentionDays, "retention-days", 0, "Default object retention in days, recorded as the GCS Custom-Time expiry (0 keeps objects indefinitely)")
+	flag.StringVar(&cfg.StorageClass, "storage-class", "", "Default storage class for uploaded objects (STANDARD, NEARLINE, COLDLINE, ARCHIVE)")
+	flag.BoolVar(&cfg.ObjectIndex, "object-index", true, "Write a Bloom filter index of metric names next to each object")
+	flag.BoolVar(&cfg.ChunkStats, "chunk-stats", true, "Attach line statistics and cardinality sketches to manifest entries")
+	flag.IntVar(&cfg.UploadRetries, "upload-retries", 5, "Retries for transient GCS upload errors before spilling")
+	flag.DurationVar(&cfg.UploadRetryInitial, "upload-retry-initial", 500*time.Millisecond, "Initial upload retry backoff")
+	flag.DurationVar(&cfg.UploadRetryMax, "upload-retry-max", 30*time.Second, "Maximum upload retry backoff")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file for the intake port (enables TLS)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file for the intake port")
+	flag.StringVar(&cfg.TLSClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates")
+	flag.BoolVar(&cfg.TLSRequireClientCert, "tls-require-client-cert", false, "Reject intake connections without a valid client certificate")
+	flag.DurationVar(&cfg.TLSReloadInterval, "tls-reload-interval", 30*time.Second, "How often to check TLS files for changes")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "Largest mirror request body accepted; larger ones get 413")
+	flag.IntVar(&cfg.RateLimitBytesPerSec, "rate-limit-bytes-per-sec", 0, "Per-client intake rate limit in bytes per second (0 disables)")
+	flag.IntVar(&cfg.RateLimitBurstBytes, "rate-limit-burst-bytes", 0, "Per-client burst size in bytes (defaults to one second of rate)")
+	flag.BoolVar(&cfg.RateLimitUseXFF, "rate-limit-xff", false, "Key rate limits on the last X-Forwarded-For address, appended by a trusted proxy, instead of the peer")
+	flag.IntVar(&cfg.TailMaxClients, "tail-max-clients", 0, "Maximum concurrent /tail WebSocket clients (0 disables live tail)")
+	flag.StringVar(&cfg.TailToken, "tail-token", os.Getenv("CAPTURE_TAIL_TOKEN"), "Bearer token for tailing the default tenant's records on /tail; tenants set tail_tokens (defaults to $CAPTURE_TAIL_TOKEN)")
+	flag.Float64Var(&cfg.TailMaxRate, "tail-max-rate", 100, "Maximum records per second streamed to each tail client")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", defaultDrainTimeout, "Maximum time to drain buffers and uploads on shutdown")
+	flag.StringVar(&cfg.MIGName, "mig", "tier-e", "MIG identifier used in object paths")
+	flag.StringVar(&cfg.PartitionKeys, "partition-keys", "dt,mig", "Comma-separated object partition keys (dt, hour, minute, mig, family)")
+	flag.IntVar(&cfg.PartitionMinutes, "partition-minutes", 15, "Minute partition granularity (must divide 60)")
+	flag.IntVar(&cfg.FamilyBuckets, "family-buckets", 16, "Number of metric family buckets for the family partition key")
+	flag.BoolVar(&cfg.AlignRotation, "align-rotation", false, "Rotate buffers on wall-clock boundaries of -max-age-sec")
+	flag.StringVar(&cfg.Codec, "codec", "zstd", "Compression codec (zstd, gzip, lz4, snappy, none)")
+	flag.IntVar(&cfg.CodecLevel, "codec-level", 0, "Compression level (0 selects the codec default)")
+	flag.StringVar(&cfg.ZstdDictPath, "zstd-dict", "", "Path to a pre-trained zstd dictionary")
+	flag.BoolVar(&cfg.ZstdDictTrain, "zstd-dict-train", false, "Train a zstd dictionary from sampled intake")
+	flag.IntVar(&cfg.ZstdDictSamples, "zstd-dict-samples", 2000, "Number of intake samples used for dictionary training")
+	flag.IntVar(&cfg.ZstdDictSizeKB, "zstd-dict-size-kb", 112, "Maximum trained dictionary size in KB")
+	flag.StringVar(&cfg.WALDir, "wal-dir", "", "Enable the fsync'd write-ahead log in this directory")
+	flag.StringVar(&cfg.TenantConfig, "tenant-config", "", "JSON file defining capture tenants (enables multi-tenant routing)")
+	flag.StringVar(&cfg.TenantHeader, "tenant-header", "X-Capture-Tenant", "Header naming the tenant when no bearer token is sent")
+	flag.BoolVar(&cfg.RouteByType, "route-by-type", false, "Give metrics, histograms, spans and access logs separate buffers and type=<stream> prefixes")
+	flag.BoolVar(&cfg.TenantRequired, "tenant-required", false, "Reject requests that do not identify a tenant")
+	queryFamilies := flag.String("query-families", "", "Query mode: list objects that may contain these comma-separated metric families, then exit")
+	queryMetrics := flag.String("query-metrics", "", "Query mode: list objects that may contain these comma-separated metric names, then exit")
+	queryPrefix := flag.String("query-prefix", "", "Object prefix searched in query mode (defaults to -bucket-prefix)")
+	flag.StringVar(&cfg.Mode, "mode", "capture", "Run mode: capture, or compact to merge a day's small objects into hourly files and exit")
+	flag.StringVar(&cfg.CompactDate, "compact-date", "", "Compact mode: UTC day to compact as YYYY-MM-DD (defaults to yesterday)")
+	flag.StringVar(&cfg.CompactPrefix, "compact-prefix", "", "Compact mode: object prefix to compact (defaults to -bucket-prefix)")
+	flag.IntVar(&cfg.CompactMinSizeMB, "compact-min-size-mb", 8, "Compact mode: objects smaller than this are merged")
+	flag.BoolVar(&cfg.CompactKeepSources, "compact-keep-sources", false, "Compact mode: keep source objects after merging")
+	flag.BoolVar(&cfg.CompactDryRun, "compact-dry-run", false, "Compact mode: log the merge plan without writing anything")
 	flag.Parse()
 
-	if cfg.BucketName == "" || cfg.ProjectID == "" {
-		log.Fatal("Missing required flags: -bucket, -project")
+	switch cfg.Mode {
+	case "capture":
+	case "compact":
+		if err := runCompaction(&cfg); err != nil {
+			log.Fatalf("Compaction failed: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown -mode %q (capture, compact)", cfg.Mode)
 	}
 
-	// Get instance metadata if not provided
-	if cfg.InstanceID == "" {
-		// This would typically come from metadata service in GCP
-		cfg.InstanceID = fmt.Sprintf("instance-%d", time.Now().Unix())
+	if *queryFamilies != "" || *queryMetrics != "" {
+		if err := runIndexQuery(&cfg, *queryPrefix, *queryFamilies, *queryMetrics); err != nil {
+			log.Fatalf("Index query failed: %v", err)
+		}
+		return
 	}
-	if cfg.Zone == "" {
-		cfg.Zone = "unknown-zone"
+
+	// Get instance metadata if not provided
+	resolveInstanceIdentity(&cfg)
+
+	if cfg.BucketName == "" || cfg.ProjectID == "" {
+		log.Fatal("Missing required flags: -bucket, -project")
 	}
+	log.Printf("Instance identity: instance=%s zone=%s mig=%s project=%s", cfg.InstanceID, cfg.Zone, cfg.CaptureMIG, cfg.ProjectID)
 
 	agent, err := NewCaptureAgent(&cfg)
 	if err != nil {
 		log.Fatalf("Failed to create capture agent: %v", err)
 	}
 
-	if err := agent.Start(); err != nil {
-		log.Fatalf("Failed to start capture agent: %v", err)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- agent.Start()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			log.Fatalf("Failed to start capture agent: %v", err)
+		}
+	case sig := <-sigCh:
+		log.Printf("Received %v, draining capture agent", sig)
+		agent.Stop(cfg.DrainTimeout)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// Partition keys accepted by -partition-keys. Keys are emitted as path
+// segments in the order they are given.
+const (
+	partitionDate   = "dt"
+	partitionHour   = "hour"
+	partitionMinute = "minute"
+	partitionMIG    = "mig"
+	partitionFamily = "family"
+)
+
+// PartitionLayout describes how captured objects are laid out under the
+// bucket prefix, e.g. dt=2024-01-02/hour=10/minute=15/mig=tier-e/family=07.
+type PartitionLayout struct {
+	Keys              []string
+	MinuteGranularity int
+	FamilyBuckets     int
+	MIG               string
+}
+
+func ParsePartitionLayout(spec string, minuteGranularity, familyBuckets int, mig string) (*PartitionLayout, error) {
+	layout := &PartitionLayout{
+		MinuteGranularity: minuteGranularity,
+		FamilyBuckets:     familyBuckets,
+		MIG:               mig,
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		switch key {
+		case partitionDate, partitionHour, partitionMinute, partitionMIG, partitionFamily:
+		default:
+			return nil, fmt.Errorf("unknown partition key %q", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate partition key %q", key)
+		}
+		seen[key] = true
+		layout.Keys = append(layout.Keys, key)
+	}
+
+	if !seen[partitionDate] {
+		return nil, fmt.Errorf("partition keys must include %q", partitionDate)
+	}
+	if minuteGranularity <= 0 || minuteGranularity > 60 || 60%minuteGranularity != 0 {
+		return nil, fmt.Errorf("minute granularity must divide 60, got %d", minuteGranularity)
+	}
+	if seen[partitionFamily] && familyBuckets <= 0 {
+		return nil, fmt.Errorf("family partitioning requires a positive bucket count, got %d", familyBuckets)
+	}
+
+	return layout, nil
+}
+
+func (pl *PartitionLayout) HasFamily() bool {
+	for _, key := range pl.Keys {
+		if key == partitionFamily {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the partition path for a window starting at t. The family
+// segment is only emitted when family partitioning is enabled.
+func (pl *PartitionLayout) Path(t time.Time, family int) string {
+	t = t.UTC()
+	segments := make([]string, 0, len(pl.Keys))
+	for _, key := range pl.Keys {
+		switch key {
+		case partitionDate:
+			segments = append(segments, "dt="+t.Format("2006-01-02"))
+		case partitionHour:
+			segments = append(segments, fmt.Sprintf("hour=%02d", t.Hour()))
+		case partitionMinute:
+			minute := t.Minute() - t.Minute()%pl.MinuteGranularity
+			segments = append(segments, fmt.Sprintf("minute=%02d", minute))
+		case partitionMIG:
+			segments = append(segments, "mig="+pl.MIG)
+		case partitionFamily:
+			segments = append(segments, fmt.Sprintf("family=%02d", family))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// alignedWindowStart truncates t to the rotation window it falls in, so
+// every instance rotates on the same wall-clock boundaries.
+func alignedWindowStart(t time.Time, window time.Duration) time.Time {
+	if window <= 0 {
+		return t
+	}
+	return t.UTC().Truncate(window)
+}
+
+// metricName returns the metric (or span operation) name of a line protocol
+// record. Histogram lines carry the name after their centroids.
+func metricName(line []byte) []byte {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if fields[0][0] != '!' {
+		return bytes.Trim(fields[0], `"`)
+	}
+	for _, f := range fields[1:] {
+		if f[0] == '#' || (f[0] >= '0' && f[0] <= '9') || f[0] == '-' || f[0] == '.' {
+			continue
+		}
+		return bytes.Trim(f, `"`)
+	}
+	return nil
+}
+
+// metricFamily returns the family of a metric name: its first two dotted
+// components, so related series group together.
+func metricFamily(name []byte) []byte {
+	if i := bytes.IndexByte(name, '.'); i >= 0 {
+		if j := bytes.IndexByte(name[i+1:], '.'); j >= 0 {
+			return name[:i+1+j]
+		}
+	}
+	return name
+}
+
+func familyBucket(name []byte, buckets int) int {
+	h := fnv.New32a()
+	h.Write(metricFamily(name))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// splitByFamily partitions data into per-family-bucket payloads, keeping
+// multi-line records together.
+func splitByFamily(data []byte, buckets int) map[int][]byte {
+	parts := make(map[int][]byte)
+	forEachRecord(data, func(record []byte) {
+		bucket := familyBucket(metricName(record), buckets)
+		parts[bucket] = append(parts[bucket], record...)
+	})
+	return parts
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rateLimitedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_rate_limited_requests_total",
+			Help: "Total number of mirror requests rejected by the per-client rate limit",
+		},
+	)
+
+	rateLimitedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_rate_limited_bytes_total",
+			Help: "Total bytes rejected by the per-client rate limit",
+		},
+	)
+
+	rateLimitClients = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_rate_limit_tracked_clients",
+			Help: "Number of client addresses with an active rate limit bucket",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitedRequests)
+	prometheus.MustRegister(rateLimitedBytes)
+	prometheus.MustRegister(rateLimitClients)
+}
+
+const rateLimitIdleTTL = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// clientRateLimiter is a byte-based token bucket per client address, so one
+// misbehaving mirror source cannot fill the capture buffer for everyone.
+type clientRateLimiter struct {
+	bytesPerSec float64
+	burst       float64
+	useXFF      bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newClientRateLimiter(bytesPerSec, burst int, useXFF bool) *clientRateLimiter {
+	if burst < bytesPerSec {
+		burst = bytesPerSec
+	}
+	return &clientRateLimiter{
+		bytesPerSec: float64(bytesPerSec),
+		burst:       float64(burst),
+		useXFF:      useXFF,
+		buckets:     make(map[string]*tokenBucket),
+		lastSweep:   time.Now(),
+	}
+}
+
+// clientKey identifies the sender: the last X-Forwarded-For hop when
+// trusted, otherwise the connection's remote address. The last hop is the
+// one the trusted proxy appended; earlier ones are whatever the client sent.
+func (rl *clientRateLimiter) clientKey(r *http.Request) string {
+	if rl.useXFF {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			hops := strings.Split(values[len(values)-1], ",")
+			if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Allow charges n bytes to the request's client and reports whether the
+// request fits within its budget. A client with a full bucket is always
+// admitted, going into debt for bodies larger than the burst, so that no
+// body size is rejected forever.
+func (rl *clientRateLimiter) Allow(r *http.Request, n int) bool {
+	key := rl.clientKey(r)
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > time.Minute {
+		rl.sweep(now)
+	}
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, lastFill: now}
+		rl.buckets[key] = bucket
+		rateLimitClients.Set(float64(len(rl.buckets)))
+	}
+
+	bucket.tokens += now.Sub(bucket.lastFill).Seconds() * rl.bytesPerSec
+	if bucket.tokens > rl.burst {
+		bucket.tokens = rl.burst
+	}
+	bucket.lastFill = now
+
+	if bucket.tokens < float64(n) && bucket.tokens < rl.burst {
+		rateLimitedRequests.Inc()
+		rateLimitedBytes.Add(float64(n))
+		return false
+	}
+	bucket.tokens -= float64(n)
+	return true
+}
+
+// sweep drops buckets that have been idle long enough to be full again.
+func (rl *clientRateLimiter) sweep(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastFill) > rateLimitIdleTTL {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+	rateLimitClients.Set(float64(len(rl.buckets)))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWriteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_remote_write_samples_total",
+			Help: "Total remote_write samples received, by outcome",
+		},
+		[]string{"result"},
+	)
+
+	remoteWriteErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_remote_write_errors_total",
+			Help: "Total remote_write requests rejected",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteSamples)
+	prometheus.MustRegister(remoteWriteErrors)
+}
+
+// Field numbers from prometheus/prompb/remote.proto and types.proto.
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+type promLabel struct {
+	name, value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+// handleRemoteWrite accepts Prometheus remote_write requests (snappy block
+// compressed protobuf WriteRequests), converts the samples to line protocol
+// and feeds them into the same buffers as mirrored traffic.
+func (ca *CaptureAgent) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, ok := ca.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		remoteWriteErrors.WithLabelValues("snappy").Inc()
+		http.Error(w, fmt.Sprintf("invalid snappy payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	series, err := decodeWriteRequest(data)
+	if err != nil {
+		remoteWriteErrors.WithLabelValues("protobuf").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := remoteWriteToLines(series)
+
+	tenantName, ok := ca.admitTenant(w, r, len(body))
+	if !ok {
+		return
+	}
+
+	if err := ca.writePayload(tenantName, payloadMetric, body); err != nil {
+		log.Printf("Error appending to WAL: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Prometheus treats any 2xx as success
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeWriteRequest decodes the time series of a WriteRequest. Metadata,
+// exemplars and native histograms are skipped.
+func decodeWriteRequest(data []byte) ([]promSeries, error) {
+	var series []promSeries
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != writeRequestTimeseries || typ != protowire.BytesType {
+			return nil
+		}
+		ts, err := decodeTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid WriteRequest: %w", err)
+	}
+	return series, nil
+}
+
+func decodeTimeSeries(data []byte) (promSeries, error) {
+	var ts promSeries
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case timeSeriesLabels:
+			var label promLabel
+			err := walkMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == labelName && typ == protowire.BytesType:
+					label.name = string(value)
+				case num == labelValue && typ == protowire.BytesType:
+					label.value = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.labels = append(ts.labels, label)
+		case timeSeriesSamples:
+			var sample promSample
+			err := walkMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					v, _ := protowire.ConsumeFixed64(value)
+					sample.value = math.Float64frombits(v)
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					sample.timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.samples = append(ts.samples, sample)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// walkMessage calls fn for every field of a protobuf message with the raw
+// bytes of its value: the payload for length-delimited fields, the encoded
+// value otherwise.
+func walkMessage(data []byte, fn func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, data = v, data[n:]
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, data = data[:n], data[n:]
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteWriteToLines renders samples as line protocol:
+//
+//	"<__name__>" <value> <unix seconds> source="<instance>" "<label>"="<value>" ...
+//
+// Stale markers and other non-finite values have no line protocol form and
+// are dropped.
+func remoteWriteToLines(series []promSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		name, source := "", ""
+		tags := make([]promLabel, 0, len(ts.labels))
+		for _, label := range ts.labels {
+			switch label.name {
+			case "__name__":
+				name = label.value
+			case "instance":
+				source = label.value
+			default:
+				tags = append(tags, label)
+			}
+		}
+		if name == "" {
+			remoteWriteSamples.WithLabelValues("unnamed").Add(float64(len(ts.samples)))
+			continue
+		}
+		if source == "" {
+			source = "prometheus"
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+
+		var suffix strings.Builder
+		suffix.WriteString(" source=")
+		suffix.WriteString(quoteLineValue(source))
+		for _, tag := range tags {
+			suffix.WriteByte(' ')
+			suffix.WriteString(quoteLineValue(tag.name))
+			suffix.WriteByte('=')
+			suffix.WriteString(quoteLineValue(tag.value))
+		}
+		quotedName := quoteLineValue(name)
+
+		for _, sample := range ts.samples {
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				remoteWriteSamples.WithLabelValues("non_finite").Inc()
+				continue
+			}
+			buf = append(buf, quotedName...)
+			buf = append(buf, ' ')
+			buf = strconv.AppendFloat(buf, sample.value, 'g', -1, 64)
+			buf = append(buf, ' ')
+			buf = strconv.AppendInt(buf, sample.timestamp/1000, 10)
+			buf = append(buf, suffix.String()...)
+			buf = append(buf, '\n')
+			remoteWriteSamples.WithLabelValues("accepted").Inc()
+		}
+	}
+	return buf
+}
+
+// quoteLineValue double-quotes a name or tag value for line protocol, which
+// only escapes embedded quotes.
+func quoteLineValue(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
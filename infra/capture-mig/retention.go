@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+var storageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
+// retentionPolicy decides how long an object is kept and where it lives.
+// Objects carry their expiry as the GCS Custom-Time, so a single bucket
+// lifecycle rule (delete when daysSinceCustomTime >= 0) enforces every
+// retention period without relying on object naming.
+type retentionPolicy struct {
+	Days         int
+	StorageClass string
+}
+
+func validateStorageClass(class string) (string, error) {
+	class = strings.ToUpper(class)
+	if class != "" && !storageClasses[class] {
+		return "", fmt.Errorf("unknown storage class %q", class)
+	}
+	return class, nil
+}
+
+// retentionFor resolves the policy for a chunk. Sessions override the agent
+// defaults, and the session asking for the longest retention wins so no
+// session loses data early. Unset session fields fall back to the defaults,
+// so a session that sets nothing keeps data as long as the defaults do.
+func (ca *CaptureAgent) retentionFor(chunk *captureChunk) retentionPolicy {
+	defaults := retentionPolicy{Days: ca.config.RetentionDays, StorageClass: ca.config.StorageClass}
+
+	var chosen *retentionPolicy
+	for _, session := range chunk.sessions {
+		session.mu.Lock()
+		policy := retentionPolicy{Days: session.RetentionDays, StorageClass: session.StorageClass}
+		session.mu.Unlock()
+
+		if policy.Days == 0 {
+			policy.Days = defaults.Days
+		}
+		if policy.StorageClass == "" {
+			policy.StorageClass = defaults.StorageClass
+		}
+		if chosen == nil || policy.outlasts(*chosen) {
+			chosen = &policy
+		}
+	}
+	if chosen == nil {
+		return defaults
+	}
+	return *chosen
+}
+
+// outlasts reports whether p keeps objects longer than other. Zero days
+// means indefinite retention, which outlasts any finite period.
+func (p retentionPolicy) outlasts(other retentionPolicy) bool {
+	if other.Days <= 0 {
+		return false
+	}
+	return p.Days <= 0 || p.Days > other.Days
+}
+
+// apply sets storage class, Custom-Time and retention metadata on an object
+// about to be written. The expiry is counted from the capture window.
+func (p retentionPolicy) apply(attrs *storage.ObjectAttrs, windowStart time.Time) {
+	if p.StorageClass != "" {
+		attrs.StorageClass = p.StorageClass
+	}
+	if p.Days <= 0 {
+		return
+	}
+	expiresAt := windowStart.UTC().AddDate(0, 0, p.Days)
+	attrs.CustomTime = expiresAt
+	if attrs.Metadata == nil {
+		attrs.Metadata = make(map[string]string)
+	}
+	attrs.Metadata["retention_days"] = fmt.Sprintf("%d", p.Days)
+	attrs.Metadata["expires_at"] = expiresAt.Format(time.RFC3339)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Capture streams. With -route-by-type each tenant gets one route per
+// stream, with its own buffer, WAL and object prefix, so consumers never
+// have to demultiplex mixed objects.
+const (
+	streamMetrics    = "metrics"
+	streamHistograms = "histograms"
+	streamSpans      = "spans"
+	streamLogs       = "logs"
+)
+
+var captureStreams = []string{streamMetrics, streamHistograms, streamSpans, streamLogs}
+
+// streamFor maps a payload type to the stream that stores it. Span logs
+// travel with their spans.
+func streamFor(payloadType string) string {
+	switch payloadType {
+	case payloadHistogram:
+		return streamHistograms
+	case payloadSpan, payloadSpanLogs:
+		return streamSpans
+	case payloadAccessLog:
+		return streamLogs
+	default:
+		return streamMetrics
+	}
+}
+
+func routeKey(tenant, stream string) string {
+	if stream == "" {
+		return tenant
+	}
+	return tenant + "/" + stream
+}
+
+// newTenantRoutes creates the routes for one tenant: a single route, or one
+// per stream when routing by type.
+func (ca *CaptureAgent) newTenantRoutes(tenant *Tenant, name, prefix string) {
+	if !ca.config.RouteByType {
+		ca.routes[name] = &captureRoute{name: name, tenantName: name, prefix: prefix, tenant: tenant}
+		return
+	}
+	for _, stream := range captureStreams {
+		key := routeKey(name, stream)
+		ca.routes[key] = &captureRoute{
+			name:       key,
+			tenantName: name,
+			stream:     stream,
+			prefix:     fmt.Sprintf("%s/type=%s", prefix, stream),
+			tenant:     tenant,
+		}
+	}
+}
+
+// walDir returns the WAL directory of a route. The default tenant's metrics
+// keep the WAL root so existing layouts recover unchanged.
+func (ca *CaptureAgent) walDir(route *captureRoute) string {
+	dir := ca.config.WALDir
+	if route.tenant != nil {
+		dir = filepath.Join(dir, "tenants", route.tenantName)
+	}
+	if route.stream != "" && route.stream != streamMetrics {
+		dir = filepath.Join(dir, "streams", route.stream)
+	}
+	return dir
+}
+
+// initRoutes creates the default route plus one route per tenant, one per
+// stream of each with -route-by-type, and opens their WALs. Routes are fixed
+// after startup, so the map is read without locking.
+func (ca *CaptureAgent) initRoutes() error {
+	ca.newTenantRoutes(nil, defaultTenant, ca.config.BucketPrefix)
+	if ca.tenants != nil {
+		for _, tenant := range ca.tenants.Tenants() {
+			ca.newTenantRoutes(tenant, tenant.Name, tenant.Prefix)
+		}
+	}
+
+	for _, route := range ca.routes {
+		route.buffer = &CaptureBuffer{createdAt: time.Now()}
+		if ca.config.WALDir == "" {
+			continue
+		}
+
+		var err error
+		route.wal, route.walRecovered, err = OpenWAL(ca.walDir(route))
+		if err != nil {
+			return fmt.Errorf("failed to open WAL for route %s: %w", route.name, err)
+		}
+		if len(route.walRecovered) > 0 {
+			log.Printf("Recovered %d unacknowledged WAL segments for route %s", len(route.walRecovered), route.name)
+		}
+	}
+	return nil
+}
+
+// routedPayload is the part of a request destined for one route.
+type routedPayload struct {
+	route       *captureRoute
+	payloadType string
+	body        []byte
+}
+
+// demux assigns a request body to routes. Without type routing everything
+// goes to the tenant's route; with it, a mixed body is split record by
+// record across the tenant's streams.
+func (ca *CaptureAgent) demux(tenant, payloadType string, body []byte) []routedPayload {
+	if !ca.config.RouteByType {
+		return []routedPayload{{route: ca.routes[tenant], payloadType: payloadType, body: body}}
+	}
+	if payloadType != payloadMixed {
+		return []routedPayload{{route: ca.routes[routeKey(tenant, streamFor(payloadType))], payloadType: payloadType, body: body}}
+	}
+
+	var payloads []routedPayload
+	index := make(map[string]int)
+	forEachRecord(body, func(record []byte) {
+		recordType := classifyRecord(record)
+		if recordType == "" {
+			return
+		}
+		stream := streamFor(recordType)
+		i, ok := index[stream]
+		if !ok {
+			i = len(payloads)
+			index[stream] = i
+			payloads = append(payloads, routedPayload{route: ca.routes[routeKey(tenant, stream)]})
+		}
+		payloads[i].payloadType = mergePayloadTypes(payloads[i].payloadType, recordType)
+		payloads[i].body = append(payloads[i].body, record...)
+	})
+	return payloads
+}
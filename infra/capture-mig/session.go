@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionFlushTimeout = 10 * time.Second
+
+// sessionNamePattern limits session names to characters that are safe in the
+// session ID and in the GCS paths built from it.
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// SessionObject is one uploaded object attributed to a session.
+type SessionObject struct {
+	ObjectName  string    `json:"object_name"`
+	Tenant      string    `json:"tenant"`
+	Bytes       int       `json:"bytes"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+// sessionState is the serializable part of a session.
+type sessionState struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Labels        map[string]string `json:"labels"`
+	RetentionDays int               `json:"retention_days,omitempty"`
+	StorageClass  string            `json:"storage_class,omitempty"`
+	InstanceID    string            `json:"instance_id"`
+	StartedAt     time.Time         `json:"started_at"`
+	StoppedAt     *time.Time        `json:"stopped_at,omitempty"`
+	Objects       []SessionObject   `json:"objects"`
+	SpilledBytes  int64             `json:"spilled_bytes"`
+	Manifest      string            `json:"manifest,omitempty"`
+}
+
+// CaptureSession is a named capture window. Buffers are flushed when a
+// session starts and stops, so its manifest lists exactly the objects
+// holding data received while it was active.
+type CaptureSession struct {
+	mu sync.Mutex
+	sessionState
+	pending int // chunks taken while active and not yet uploaded
+}
+
+// snapshot returns a copy of the session state that is safe to encode.
+func (s *CaptureSession) snapshot() sessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.sessionState
+	state.Objects = append([]SessionObject{}, s.Objects...)
+	state.Labels = make(map[string]string, len(s.Labels))
+	for k, v := range s.Labels {
+		state.Labels[k] = v
+	}
+	return state
+}
+
+type sessionRequest struct {
+	Name          string            `json:"name"`
+	Labels        map[string]string `json:"labels"`
+	RetentionDays int               `json:"retention_days"`
+	StorageClass  string            `json:"storage_class"`
+}
+
+// SessionManager tracks active and finished sessions on this agent.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*CaptureSession
+	active   []*CaptureSession
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[string]*CaptureSession)}
+}
+
+// attachChunk returns the sessions a newly taken chunk belongs to and counts
+// the chunk as pending on each of them.
+func (sm *SessionManager) attachChunk() []*CaptureSession {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if len(sm.active) == 0 {
+		return nil
+	}
+	sessions := make([]*CaptureSession, len(sm.active))
+	copy(sessions, sm.active)
+	addPending(sessions, 1)
+	return sessions
+}
+
+// addPending counts n more in-flight chunks against each session.
+func addPending(sessions []*CaptureSession, n int) {
+	for _, session := range sessions {
+		session.mu.Lock()
+		session.pending += n
+		session.mu.Unlock()
+	}
+}
+
+func (sm *SessionManager) get(id string) *CaptureSession {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.sessions[id]
+}
+
+func (sm *SessionManager) list() []*CaptureSession {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sessions := make([]*CaptureSession, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+func (sm *SessionManager) start(session *CaptureSession) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.sessions[session.ID] = session
+	sm.active = append(sm.active, session)
+}
+
+func (sm *SessionManager) deactivate(id string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for i, session := range sm.active {
+		if session.ID == id {
+			sm.active = append(sm.active[:i], sm.active[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// recordSessionUpload attributes the outcome of one uploaded chunk to its
+// sessions, finalizing any stopped session that has nothing left pending.
+func (ca *CaptureAgent) recordSessionUpload(chunk *captureChunk, objects []SessionObject, spilled int64) {
+	for _, session := range chunk.sessions {
+		session.mu.Lock()
+		session.Objects = append(session.Objects, objects...)
+		session.SpilledBytes += spilled
+		session.pending--
+		finalize := session.pending == 0 && session.StoppedAt != nil
+		session.mu.Unlock()
+
+		if finalize {
+			ca.writeSessionManifest(session)
+		}
+	}
+}
+
+func (ca *CaptureAgent) writeSessionManifest(session *CaptureSession) {
+	manifestName := fmt.Sprintf("%s/sessions/%s/%s-manifest.json", ca.config.BucketPrefix, session.ID, ca.config.InstanceID)
+	session.mu.Lock()
+	session.Manifest = manifestName
+	session.mu.Unlock()
+
+	data, err := json.MarshalIndent(session.snapshot(), "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode session %s manifest: %v", session.ID, err)
+		return
+	}
+
+	writer := ca.gcsClient.Bucket(ca.config.BucketName).Object(manifestName).NewWriter(ca.ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		log.Printf("Failed to write session %s manifest: %v", session.ID, err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to write session %s manifest: %v", session.ID, err)
+		return
+	}
+	log.Printf("Wrote session %s manifest %s", session.ID, manifestName)
+}
+
+// handleSessions serves the session API:
+//
+//	GET  /sessions             list sessions
+//	POST /sessions             start a session {"name": ..., "labels": {...},
+//	                           "retention_days": 7, "storage_class": "NEARLINE"}
+//	GET  /sessions/{id}        session details
+//	POST /sessions/{id}/stop   stop a session and write its manifest
+//	POST /sessions/{id}/labels merge labels into a session
+func (ca *CaptureAgent) handleSessions(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"), "/")
+
+	switch {
+	case parts[0] == "" && r.Method == http.MethodGet:
+		sessions := ca.sessions.list()
+		states := make([]sessionState, 0, len(sessions))
+		for _, session := range sessions {
+			states = append(states, session.snapshot())
+		}
+		writeJSON(w, http.StatusOK, states)
+	case parts[0] == "" && r.Method == http.MethodPost:
+		ca.startSession(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		session := ca.sessions.get(parts[0])
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, session.snapshot())
+	case len(parts) == 2 && parts[1] == "stop" && r.Method == http.MethodPost:
+		ca.stopSession(w, parts[0])
+	case len(parts) == 2 && parts[1] == "labels" && r.Method == http.MethodPost:
+		ca.labelSession(w, r, parts[0])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (ca *CaptureAgent) startSession(w http.ResponseWriter, r *http.Request) {
+	var req sessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid session request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "session name is required", http.StatusBadRequest)
+		return
+	}
+	if !sessionNamePattern.MatchString(req.Name) {
+		http.Error(w, "session name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if req.RetentionDays < 0 {
+		http.Error(w, "retention_days must not be negative", http.StatusBadRequest)
+		return
+	}
+	storageClass, err := validateStorageClass(req.StorageClass)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	session := &CaptureSession{sessionState: sessionState{
+		ID:            fmt.Sprintf("%s-%d", req.Name, now.Unix()),
+		Name:          req.Name,
+		Labels:        req.Labels,
+		RetentionDays: req.RetentionDays,
+		StorageClass:  storageClass,
+		InstanceID:    ca.config.InstanceID,
+		StartedAt:     now,
+		Objects:       []SessionObject{},
+	}}
+	if session.Labels == nil {
+		session.Labels = make(map[string]string)
+	}
+
+	// Flush first so earlier traffic is not attributed to the session
+	if !ca.addProducer() {
+		http.Error(w, "capture agent is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sessionFlushTimeout)
+	defer cancel()
+	ca.flushBuffers(ctx)
+	ca.producers.Done()
+	ca.sessions.start(session)
+
+	log.Printf("Started capture session %s", session.ID)
+	writeJSON(w, http.StatusCreated, session.snapshot())
+}
+
+func (ca *CaptureAgent) stopSession(w http.ResponseWriter, id string) {
+	session := ca.sessions.get(id)
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// Flush while the session is still active so its last data is attributed
+	if !ca.addProducer() {
+		http.Error(w, "capture agent is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionFlushTimeout)
+	defer cancel()
+	ca.flushBuffers(ctx)
+	ca.producers.Done()
+	if !ca.sessions.deactivate(id) {
+		http.Error(w, "session already stopped", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	session.mu.Lock()
+	session.StoppedAt = &now
+	finalize := session.pending == 0
+	session.mu.Unlock()
+
+	if finalize {
+		ca.writeSessionManifest(session)
+	}
+
+	log.Printf("Stopped capture session %s", id)
+	writeJSON(w, http.StatusOK, session.snapshot())
+}
+
+func (ca *CaptureAgent) labelSession(w http.ResponseWriter, r *http.Request, id string) {
+	session := ca.sessions.get(id)
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		http.Error(w, fmt.Sprintf("invalid labels: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	session.mu.Lock()
+	for k, v := range labels {
+		session.Labels[k] = v
+	}
+	session.mu.Unlock()
+	writeJSON(w, http.StatusOK, session.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rotationsSplit = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_rotations_split_total",
+			Help: "Total rotations split into parallel sub-chunk uploads",
+		},
+	)
+
+	rotationSubChunks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_rotation_sub_chunks_total",
+			Help: "Total sub-chunks produced by splitting oversized rotations",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rotationsSplit)
+	prometheus.MustRegister(rotationSubChunks)
+}
+
+// rotationGroup links the sub-chunks of one rotation. The WAL segment behind
+// the rotation is only acknowledged once every part is durable.
+type rotationGroup struct {
+	id        string
+	parts     int
+	remaining atomic.Int32
+	failed    atomic.Bool
+}
+
+// done records the outcome of one part and reports whether it was the last
+// one, together with whether the rotation as a whole is durable.
+func (g *rotationGroup) done(durable bool) (last bool, allDurable bool) {
+	if !durable {
+		g.failed.Store(true)
+	}
+	if g.remaining.Add(-1) > 0 {
+		return false, false
+	}
+	return true, !g.failed.Load()
+}
+
+// splitChunk cuts an oversized chunk into roughly equal sub-chunks on record
+// boundaries so the worker pool compresses and uploads them in parallel.
+// Chunks within the limit are returned unchanged.
+func (ca *CaptureAgent) splitChunk(chunk *captureChunk) []*captureChunk {
+	maxBytes := ca.config.SubChunkMB * 1024 * 1024
+	if maxBytes <= 0 || len(chunk.data) <= maxBytes {
+		return []*captureChunk{chunk}
+	}
+
+	n := (len(chunk.data) + maxBytes - 1) / maxBytes
+	target := len(chunk.data)/n + 1
+
+	var pieces [][]byte
+	start, size := 0, 0
+	data := chunk.data
+	forEachRecord(data, func(record []byte) {
+		size += len(record)
+		if size >= target {
+			pieces = append(pieces, data[start:start+size])
+			start += size
+			size = 0
+		}
+	})
+	if size > 0 {
+		pieces = append(pieces, data[start:start+size])
+	}
+	if len(pieces) == 1 {
+		return []*captureChunk{chunk}
+	}
+
+	group := &rotationGroup{
+		id:    fmt.Sprintf("%s-%s-%d", ca.config.InstanceID, strings.ReplaceAll(chunk.route.name, "/", "-"), time.Now().UnixNano()),
+		parts: len(pieces),
+	}
+	group.remaining.Store(int32(len(pieces)))
+
+	// Every part settles the sessions once, so each needs its own pending count
+	addPending(chunk.sessions, len(pieces)-1)
+
+	parts := make([]*captureChunk, len(pieces))
+	for i, piece := range pieces {
+		part := *chunk
+		part.data = piece
+		part.rotation = group
+		part.part = i
+		parts[i] = &part
+	}
+
+	rotationsSplit.Inc()
+	rotationSubChunks.Add(float64(len(parts)))
+	log.Printf("Split %s rotation of %d bytes into %d sub-chunks (%s)", chunk.route.name, len(chunk.data), len(parts), group.id)
+	return parts
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	hllPrecision        = 12 // 4096 registers, ~1.6% standard error
+	statsMaxFamilies    = 1000
+	statsMaxTagKeys     = 64
+	statsOtherFamily    = "_other"
+	sourceTagKey        = "source"
+	sourceTagKeyAliased = "host"
+)
+
+// lineSizeBounds are the upper bounds (inclusive) of the line size histogram
+// buckets; a final bucket counts anything larger.
+var lineSizeBounds = []int{64, 128, 256, 512, 1024, 2048, 4096, 16384}
+
+// hyperLogLog is a fixed-precision HLL sketch. Registers are exported in
+// the manifest so downstream jobs can merge sketches across chunks.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) Add(value []byte) {
+	hasher := fnv.New64a()
+	hasher.Write(value)
+	x := mix64(hasher.Sum64())
+
+	index := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+func (h *hyperLogLog) Estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(estimate)
+}
+
+func (h *hyperLogLog) Encode() string {
+	return base64.StdEncoding.EncodeToString(h.registers)
+}
+
+// mix64 is the splitmix64 finalizer; FNV alone leaves the high bits too
+// correlated for HLL register selection.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// SketchStats is a cardinality estimate together with its mergeable sketch.
+type SketchStats struct {
+	Distinct float64 `json:"distinct"`
+	HLL      string  `json:"hll"`
+}
+
+// ChunkStats summarizes one uploaded object for the manifest.
+type ChunkStats struct {
+	Lines           int64                  `json:"lines"`
+	Records         int64                  `json:"records"`
+	Bytes           int64                  `json:"bytes"`
+	Families        map[string]int64       `json:"families"`
+	Sources         SketchStats            `json:"sources"`
+	TagValues       map[string]SketchStats `json:"tag_values"`
+	LineSizeBounds  []int                  `json:"line_size_bounds"`
+	LineSizeBuckets []int64                `json:"line_size_buckets"`
+}
+
+// computeChunkStats scans line protocol data once, record by record. Family
+// and tag key maps are capped so adversarial traffic cannot blow up the
+// manifest.
+func computeChunkStats(data []byte) *ChunkStats {
+	stats := &ChunkStats{
+		Bytes:           int64(len(data)),
+		Families:        make(map[string]int64),
+		LineSizeBounds:  lineSizeBounds,
+		LineSizeBuckets: make([]int64, len(lineSizeBounds)+1),
+	}
+	sources := newHyperLogLog()
+	tagSketches := make(map[string]*hyperLogLog)
+
+	forEachRecord(data, func(record []byte) {
+		line := bytes.TrimRight(record, "\n")
+		if len(bytes.TrimSpace(line)) == 0 {
+			return
+		}
+
+		stats.Records++
+		stats.Lines += int64(bytes.Count(line, []byte{'\n'})) + 1
+		bucket := len(lineSizeBounds)
+		for i, bound := range lineSizeBounds {
+			if len(line) <= bound {
+				bucket = i
+				break
+			}
+		}
+		stats.LineSizeBuckets[bucket]++
+
+		family := string(metricFamily(metricName(line)))
+		if _, ok := stats.Families[family]; !ok && len(stats.Families) >= statsMaxFamilies {
+			family = statsOtherFamily
+		}
+		stats.Families[family]++
+
+		for _, field := range splitLineFields(line) {
+			eq := bytes.IndexByte(field, '=')
+			if eq <= 0 {
+				continue
+			}
+			key := string(bytes.Trim(field[:eq], `"`))
+			value := bytes.Trim(field[eq+1:], `"`)
+
+			if key == sourceTagKey || key == sourceTagKeyAliased {
+				sources.Add(value)
+				continue
+			}
+
+			sketch, ok := tagSketches[key]
+			if !ok {
+				if len(tagSketches) >= statsMaxTagKeys {
+					continue
+				}
+				sketch = newHyperLogLog()
+				tagSketches[key] = sketch
+			}
+			sketch.Add(value)
+		}
+	})
+
+	stats.Sources = SketchStats{Distinct: sources.Estimate(), HLL: sources.Encode()}
+	stats.TagValues = make(map[string]SketchStats, len(tagSketches))
+	for key, sketch := range tagSketches {
+		stats.TagValues[key] = SketchStats{Distinct: sketch.Estimate(), HLL: sketch.Encode()}
+	}
+	return stats
+}
+
+// splitLineFields splits a record on whitespace, keeping double-quoted
+// sections (which may contain spaces) intact.
+func splitLineFields(line []byte) [][]byte {
+	var fields [][]byte
+	start := -1
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case (c == ' ' || c == '\t' || c == '\n') && !quoted:
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	tailClients = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_tail_clients",
+			Help: "Number of connected live-tail clients",
+		},
+	)
+
+	tailRecordsSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_tail_records_sent_total",
+			Help: "Total records streamed to live-tail clients",
+		},
+	)
+
+	tailRecordsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_tail_records_dropped_total",
+			Help: "Total sampled records not streamed to live-tail clients",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tailClients)
+	prometheus.MustRegister(tailRecordsSent)
+	prometheus.MustRegister(tailRecordsDropped)
+}
+
+const (
+	tailQueueSize    = 256
+	tailWriteTimeout = 10 * time.Second
+)
+
+// tailSubscriber is one live-tail client and its filters.
+type tailSubscriber struct {
+	tenant      string
+	payloadType string
+	prefix      []byte
+	sample      float64
+	ratePerSec  float64
+
+	records  chan []byte
+	tokens   float64
+	lastFill time.Time
+}
+
+// allow applies the subscriber's line rate limit. Called with the hub lock
+// held.
+func (s *tailSubscriber) allow(now time.Time) bool {
+	s.tokens += now.Sub(s.lastFill).Seconds() * s.ratePerSec
+	if s.tokens > s.ratePerSec {
+		s.tokens = s.ratePerSec
+	}
+	s.lastFill = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// tailHub fans sampled intake records out to live-tail clients. Intake only
+// pays for the fan-out while at least one client is connected.
+type tailHub struct {
+	tokens     map[string]string // Bearer token to the tenant it may tail
+	maxClients int
+	maxRate    float64
+	mu         sync.Mutex
+	subs       map[*tailSubscriber]struct{}
+	active     atomic.Int32
+}
+
+func newTailHub(tokens map[string]string, maxClients int, maxRate float64) *tailHub {
+	return &tailHub{
+		tokens:     tokens,
+		maxClients: maxClients,
+		maxRate:    maxRate,
+		subs:       make(map[*tailSubscriber]struct{}),
+	}
+}
+
+func (h *tailHub) subscribe(sub *tailSubscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= h.maxClients {
+		return false
+	}
+	h.subs[sub] = struct{}{}
+	h.active.Store(int32(len(h.subs)))
+	tailClients.Set(float64(len(h.subs)))
+	return true
+}
+
+func (h *tailHub) unsubscribe(sub *tailSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+	h.active.Store(int32(len(h.subs)))
+	tailClients.Set(float64(len(h.subs)))
+}
+
+// Publish offers the records in body to every matching subscriber. Slow
+// clients lose records rather than blocking intake.
+func (h *tailHub) Publish(tenant, payloadType string, body []byte) {
+	if h.active.Load() == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for sub := range h.subs {
+		if sub.tenant != "" && sub.tenant != tenant {
+			continue
+		}
+		if sub.payloadType != "" && sub.payloadType != payloadType {
+			continue
+		}
+		forEachRecord(body, func(record []byte) {
+			if len(sub.prefix) > 0 && !bytes.HasPrefix(metricName(record), sub.prefix) {
+				return
+			}
+			if rand.Float64() >= sub.sample {
+				return
+			}
+			if !sub.allow(now) {
+				tailRecordsDropped.WithLabelValues("rate").Inc()
+				return
+			}
+			select {
+			case sub.records <- append([]byte(nil), record...):
+			default:
+				tailRecordsDropped.WithLabelValues("slow_client").Inc()
+			}
+		})
+	}
+}
+
+// authorized returns the tenant whose tail token the request carries, and
+// false if it carries none.
+func (h *tailHub) authorized(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	// Compare against every token so the time taken does not reveal which
+	// one matched
+	tenant, ok := "", false
+	for token, name := range h.tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			tenant, ok = name, true
+		}
+	}
+	return tenant, ok
+}
+
+// checkTailOrigin accepts only WebSocket handshakes whose Origin is the
+// agent itself, so a web page elsewhere cannot open a tail with a browser's
+// credentials. CLI clients send an Origin of the URL they connect to.
+func checkTailOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return fmt.Errorf("missing Origin header")
+	}
+	if origin.Host != r.Host {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// handleTail upgrades to a WebSocket and streams matching records as text
+// messages. Clients authenticate with "Authorization: Bearer <token>" and
+// send an Origin of the agent's own address. A tenant's tail_tokens see only
+// that tenant's records, and -tail-token only the default tenant's. Query
+// parameters:
+//
+//	tenant  must name the token's tenant if given
+//	type    only this payload type (metric, histogram, span, span_logs)
+//	prefix  only metric names with this prefix
+//	sample  fraction of records to consider, 0-1 (default 0.01)
+//	rate    maximum records per second (capped by -tail-max-rate)
+func (ca *CaptureAgent) handleTail(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := ca.tail.authorized(r)
+	if !ok {
+		http.Error(w, "tail token required", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	if requested := query.Get("tenant"); requested != "" && requested != tenant {
+		http.Error(w, fmt.Sprintf("tail token does not grant tenant %q", requested), http.StatusForbidden)
+		return
+	}
+	sub := &tailSubscriber{
+		tenant:      tenant,
+		payloadType: query.Get("type"),
+		prefix:      []byte(query.Get("prefix")),
+		sample:      0.01,
+		ratePerSec:  ca.tail.maxRate,
+		records:     make(chan []byte, tailQueueSize),
+		lastFill:    time.Now(),
+	}
+	if v, err := strconv.ParseFloat(query.Get("sample"), 64); err == nil && v > 0 && v <= 1 {
+		sub.sample = v
+	}
+	if v, err := strconv.ParseFloat(query.Get("rate"), 64); err == nil && v > 0 && v < ca.tail.maxRate {
+		sub.ratePerSec = v
+	}
+	sub.tokens = sub.ratePerSec
+
+	if !ca.tail.subscribe(sub) {
+		http.Error(w, "too many tail clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer ca.tail.unsubscribe(sub)
+
+	server := websocket.Server{Handshake: checkTailOrigin}
+	server.Handler = func(conn *websocket.Conn) {
+		defer conn.Close()
+		log.Printf("Tail client %s connected", r.RemoteAddr)
+
+		// Reads only serve to notice the client going away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(conn, &discard) == nil {
+			}
+		}()
+
+		for {
+			select {
+			case record := <-sub.records:
+				conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+				if err := websocket.Message.Send(conn, string(record)); err != nil {
+					log.Printf("Tail client %s disconnected: %v", r.RemoteAddr, err)
+					return
+				}
+				tailRecordsSent.Inc()
+			case <-closed:
+				log.Printf("Tail client %s disconnected", r.RemoteAddr)
+				return
+			case <-ca.stopping:
+				return
+			}
+		}
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tenantBytesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_tenant_bytes_received_total",
+			Help: "Total bytes accepted per tenant",
+		},
+		[]string{"tenant"},
+	)
+
+	tenantRequestsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_tenant_requests_rejected_total",
+			Help: "Total number of intake requests rejected per tenant",
+		},
+		[]string{"tenant", "reason"},
+	)
+
+	tenantQuotaUsedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "capture_tenant_quota_used_bytes",
+			Help: "Bytes counted against each tenant's daily quota",
+		},
+		[]string{"tenant"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tenantBytesReceived)
+	prometheus.MustRegister(tenantRequestsRejected)
+	prometheus.MustRegister(tenantQuotaUsedBytes)
+}
+
+// defaultTenant names the route used when tenancy is disabled, or for
+// unidentified requests when tenants are optional.
+const defaultTenant = "default"
+
+// Tenant is one team sharing the capture fleet.
+type Tenant struct {
+	Name         string   `json:"name"`
+	Tokens       []string `json:"tokens"`
+	TailTokens   []string `json:"tail_tokens"` // /tail tokens, limited to this tenant's records
+	Prefix       string   `json:"prefix"`
+	DailyQuotaGB float64  `json:"daily_quota_gb"`
+
+	mu        sync.Mutex
+	usedBytes int64
+	quotaDay  string
+}
+
+type tenantFile struct {
+	Tenants []*Tenant `json:"tenants"`
+}
+
+// TenantRegistry identifies tenants on intake and enforces their quotas.
+type TenantRegistry struct {
+	header      string
+	required    bool
+	byName      map[string]*Tenant
+	byToken     map[string]*Tenant
+	byTailToken map[string]*Tenant
+}
+
+func LoadTenantRegistry(path, header string, required bool, bucketPrefix string) (*TenantRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant config: %w", err)
+	}
+
+	var file tenantFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant config: %w", err)
+	}
+
+	registry := &TenantRegistry{
+		header:      header,
+		required:    required,
+		byName:      make(map[string]*Tenant),
+		byToken:     make(map[string]*Tenant),
+		byTailToken: make(map[string]*Tenant),
+	}
+
+	for _, tenant := range file.Tenants {
+		if tenant.Name == "" || tenant.Name == defaultTenant {
+			return nil, fmt.Errorf("invalid tenant name %q", tenant.Name)
+		}
+		if _, exists := registry.byName[tenant.Name]; exists {
+			return nil, fmt.Errorf("duplicate tenant %q", tenant.Name)
+		}
+		if tenant.Prefix == "" {
+			tenant.Prefix = fmt.Sprintf("%s/tenant=%s", bucketPrefix, tenant.Name)
+		}
+		registry.byName[tenant.Name] = tenant
+
+		for _, token := range tenant.Tokens {
+			if other, exists := registry.byToken[token]; exists {
+				return nil, fmt.Errorf("token shared by tenants %q and %q", other.Name, tenant.Name)
+			}
+			registry.byToken[token] = tenant
+		}
+		for _, token := range tenant.TailTokens {
+			if other, exists := registry.byTailToken[token]; exists {
+				return nil, fmt.Errorf("tail token shared by tenants %q and %q", other.Name, tenant.Name)
+			}
+			registry.byTailToken[token] = tenant
+		}
+	}
+
+	return registry, nil
+}
+
+func (tr *TenantRegistry) Tenants() []*Tenant {
+	tenants := make([]*Tenant, 0, len(tr.byName))
+	for _, tenant := range tr.byName {
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// Identify resolves the tenant for a request from its bearer token, falling
+// back to the tenant header. It returns nil for unidentified requests.
+func (tr *TenantRegistry) Identify(r *http.Request) (*Tenant, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tenant, ok := tr.byToken[strings.TrimPrefix(auth, "Bearer ")]
+		if !ok {
+			return nil, fmt.Errorf("unknown bearer token")
+		}
+		return tenant, nil
+	}
+
+	if tr.header != "" {
+		if name := r.Header.Get(tr.header); name != "" {
+			tenant, ok := tr.byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown tenant %q", name)
+			}
+			return tenant, nil
+		}
+	}
+
+	if tr.required {
+		return nil, fmt.Errorf("request does not identify a tenant")
+	}
+	return nil, nil
+}
+
+// Consume charges n bytes against the tenant's daily quota and reports
+// whether the request fits. The quota resets at UTC midnight.
+func (t *Tenant) Consume(n int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	today := time.Now().UTC().Format("2006-01-02")
+	if t.quotaDay != today {
+		t.quotaDay = today
+		t.usedBytes = 0
+	}
+
+	if t.DailyQuotaGB > 0 && float64(t.usedBytes+int64(n)) > t.DailyQuotaGB*1024*1024*1024 {
+		return false
+	}
+	t.usedBytes += int64(n)
+	tenantQuotaUsedBytes.WithLabelValues(t.Name).Set(float64(t.usedBytes))
+	return true
+}
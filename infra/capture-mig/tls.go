@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tlsReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_tls_reloads_total",
+			Help: "Total number of TLS certificate reload attempts",
+		},
+		[]string{"result"},
+	)
+
+	tlsCertExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_tls_cert_expiry_timestamp_seconds",
+			Help: "Expiry time of the serving certificate as a Unix timestamp",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tlsReloads)
+	prometheus.MustRegister(tlsCertExpiry)
+}
+
+// certReloader serves the current certificate and client CA pool, reloading
+// them from disk when the files change so rotated certificates are picked up
+// without restarting the agent.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	requireCert  bool
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string, requireCert bool) (*certReloader, error) {
+	cr := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		requireCert:  requireCert,
+		modTimes:     make(map[string]time.Time),
+	}
+	if requireCert && clientCAFile == "" {
+		return nil, fmt.Errorf("client certificate verification requires a client CA file")
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		tlsReloads.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		cert.Leaf = leaf
+		tlsCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	}
+
+	var pool *x509.CertPool
+	if cr.clientCAFile != "" {
+		pem, err := os.ReadFile(cr.clientCAFile)
+		if err != nil {
+			tlsReloads.WithLabelValues("error").Inc()
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			tlsReloads.WithLabelValues("error").Inc()
+			return fmt.Errorf("no certificates found in client CA file %s", cr.clientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCA = pool
+	for _, file := range cr.files() {
+		if info, err := os.Stat(file); err == nil {
+			cr.modTimes[file] = info.ModTime()
+		}
+	}
+	cr.mu.Unlock()
+
+	tlsReloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.clientCAFile != "" {
+		files = append(files, cr.clientCAFile)
+	}
+	return files
+}
+
+func (cr *certReloader) changed() bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(cr.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the certificate files until stop is closed. A failed reload
+// keeps serving the previous certificate.
+func (cr *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			if err := cr.reload(); err != nil {
+				log.Printf("TLS reload failed, keeping previous certificate: %v", err)
+				continue
+			}
+			log.Printf("Reloaded TLS certificate from %s", cr.certFile)
+		}
+	}
+}
+
+// TLSConfig returns a server config that always uses the latest loaded
+// certificate and client CA pool.
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+			}
+			if cr.clientCA != nil {
+				config.ClientCAs = cr.clientCA
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if cr.requireCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
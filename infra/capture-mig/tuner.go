@@ -0,0 +1,277 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	adaptiveWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_adaptive_active_workers",
+			Help: "Upload workers currently allowed to take chunks",
+		},
+	)
+
+	adaptiveCodecLevel = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_adaptive_codec_level",
+			Help: "Compression level currently selected by the adaptive tuner",
+		},
+	)
+
+	adaptiveRotateBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_adaptive_rotate_bytes",
+			Help: "Buffer size that currently triggers a rotation",
+		},
+	)
+
+	adaptiveRotateAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_adaptive_rotate_age_seconds",
+			Help: "Buffer age that currently triggers a rotation",
+		},
+	)
+
+	adaptiveAdjustments = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_adaptive_adjustments_total",
+			Help: "Total adaptive tuning decisions by direction",
+		},
+		[]string{"direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(adaptiveWorkers)
+	prometheus.MustRegister(adaptiveCodecLevel)
+	prometheus.MustRegister(adaptiveRotateBytes)
+	prometheus.MustRegister(adaptiveRotateAge)
+	prometheus.MustRegister(adaptiveAdjustments)
+}
+
+// tuning holds the knobs the adaptive tuner moves. Without -adaptive they
+// stay at the configured values.
+type tuning struct {
+	rotateBytes atomic.Int64
+	rotateAge   atomic.Int64 // nanoseconds
+	workers     atomic.Int32
+	busy        atomic.Int32 // workers currently uploading
+
+	mu   sync.Mutex
+	wake chan struct{} // closed whenever the worker count changes
+}
+
+func newTuning(config *Config) *tuning {
+	t := &tuning{wake: make(chan struct{})}
+	t.rotateBytes.Store(int64(config.MaxMemoryMB) * 1024 * 1024)
+	t.rotateAge.Store(int64(time.Duration(config.MaxAgeSec) * time.Second))
+	t.workers.Store(int32(config.WorkerCount))
+	adaptiveWorkers.Set(float64(config.WorkerCount))
+	adaptiveRotateBytes.Set(float64(t.rotateBytes.Load()))
+	adaptiveRotateAge.Set(float64(config.MaxAgeSec))
+	return t
+}
+
+func (t *tuning) RotateBytes() int         { return int(t.rotateBytes.Load()) }
+func (t *tuning) RotateAge() time.Duration { return time.Duration(t.rotateAge.Load()) }
+func (t *tuning) workerActive(id int) bool { return int32(id) < t.workers.Load() }
+
+func (t *tuning) setWorkers(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.workers.Store(int32(n))
+	close(t.wake)
+	t.wake = make(chan struct{})
+	adaptiveWorkers.Set(float64(n))
+}
+
+// waitActive parks a worker until the tuner activates it.
+func (t *tuning) waitActive(id int) {
+	for !t.workerActive(id) {
+		t.mu.Lock()
+		wake := t.wake
+		t.mu.Unlock()
+		if t.workerActive(id) {
+			return
+		}
+		<-wake
+	}
+}
+
+// adaptiveTuner compares intake and upload throughput and moves worker
+// count, compression level and rotation thresholds within their bounds:
+// under pressure it adds workers, compresses faster and rotates smaller
+// chunks sooner; when quiet it sheds workers, compresses harder and lets
+// buffers grow so low traffic does not produce swarms of tiny objects.
+type adaptiveTuner struct {
+	ca *CaptureAgent
+
+	minWorkers, maxWorkers int
+	minLevel, maxLevel     int
+	minBytes, maxBytes     int64
+	minAge, maxAge         time.Duration
+
+	lastIngested int64
+	lastUploaded int64
+	lastTick     time.Time
+}
+
+func newAdaptiveTuner(ca *CaptureAgent) *adaptiveTuner {
+	config := ca.config
+	maxBytes := int64(config.MaxMemoryMB) * 1024 * 1024
+	baseAge := time.Duration(config.MaxAgeSec) * time.Second
+	maxAge := time.Duration(config.AdaptiveMaxAgeSec) * time.Second
+	if maxAge < baseAge {
+		maxAge = baseAge
+	}
+	return &adaptiveTuner{
+		ca:         ca,
+		minWorkers: config.WorkerCount,
+		maxWorkers: config.workerPoolSize(),
+		minLevel:   config.AdaptiveMinCodecLevel,
+		maxLevel:   config.AdaptiveMaxCodecLevel,
+		minBytes:   maxBytes / 8,
+		maxBytes:   maxBytes,
+		minAge:     baseAge / 4,
+		maxAge:     maxAge,
+		lastTick:   time.Now(),
+	}
+}
+
+func (at *adaptiveTuner) run(interval time.Duration) {
+	defer at.ca.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-at.ca.stopping:
+			return
+		case <-ticker.C:
+			at.adjust()
+		}
+	}
+}
+
+func (at *adaptiveTuner) adjust() {
+	ca := at.ca
+	now := time.Now()
+	elapsed := now.Sub(at.lastTick).Seconds()
+	ingested := atomic.LoadInt64(&ca.bytesIngested)
+	uploaded := atomic.LoadInt64(&ca.bytesUploaded)
+	intakeRate := float64(ingested-at.lastIngested) / elapsed
+	uploadRate := float64(uploaded-at.lastUploaded) / elapsed
+	at.lastTick, at.lastIngested, at.lastUploaded = now, ingested, uploaded
+
+	queueFill := float64(len(ca.uploadQueue)) / float64(cap(ca.uploadQueue))
+	workers := int(ca.tuning.workers.Load())
+	busy := int(ca.tuning.busy.Load())
+	level := at.currentLevel()
+
+	switch {
+	case queueFill > 0.5 || (queueFill > 0 && (busy >= workers || intakeRate > uploadRate*1.1)):
+		adaptiveAdjustments.WithLabelValues("up").Inc()
+		at.setWorkers(workers + max(1, workers/4))
+		at.setLevel(level - 1)
+		at.setRotation(ca.tuning.RotateBytes()/2, ca.tuning.RotateAge()/2)
+	case queueFill == 0 && busy < workers/2:
+		adaptiveAdjustments.WithLabelValues("down").Inc()
+		at.setWorkers(workers - 1)
+		at.setLevel(level + 1)
+		at.setRotation(ca.tuning.RotateBytes()*2, ca.tuning.RotateAge()*3/2)
+	default:
+		return
+	}
+
+	log.Printf("Adaptive tuning: intake %.0f B/s, upload %.0f B/s, queue %.0f%%, busy %d/%d -> workers=%d level=%d rotate=%dB/%s",
+		intakeRate, uploadRate, queueFill*100, busy, workers, ca.tuning.workers.Load(), at.currentLevel(),
+		ca.tuning.RotateBytes(), ca.tuning.RotateAge())
+}
+
+func (at *adaptiveTuner) setWorkers(n int) {
+	n = clampInt(n, at.minWorkers, at.maxWorkers)
+	if n != int(at.ca.tuning.workers.Load()) {
+		at.ca.tuning.setWorkers(n)
+	}
+}
+
+// currentLevel is the effective level of the active codec; 0 selects the
+// codec default.
+func (at *adaptiveTuner) currentLevel() int {
+	level := at.ca.codec.Load().level
+	if level != 0 {
+		return level
+	}
+	if at.ca.config.Codec == "gzip" {
+		return 6
+	}
+	return compressionLevel
+}
+
+// setLevel rebuilds the codec at a new level, keeping any zstd dictionary.
+// Codecs without meaningful levels are left alone.
+func (at *adaptiveTuner) setLevel(level int) {
+	if at.ca.config.Codec != "zstd" && at.ca.config.Codec != "gzip" {
+		return
+	}
+	level = clampInt(level, at.minLevel, at.maxLevel)
+	if level == at.currentLevel() {
+		return
+	}
+
+	current := at.ca.codec.Load()
+	codec, err := NewCodec(at.ca.config.Codec, level, current.dictionary)
+	if err != nil {
+		log.Printf("Adaptive tuning: failed to build codec at level %d: %v", level, err)
+		return
+	}
+	// A dictionary trained meanwhile wins; the next tick retries
+	if at.ca.codec.CompareAndSwap(current, newCodecHandle(codec, level, current.dictionary)) {
+		adaptiveCodecLevel.Set(float64(level))
+	}
+}
+
+func (at *adaptiveTuner) setRotation(size int, age time.Duration) {
+	tuning := at.ca.tuning
+	tuning.rotateBytes.Store(clampInt64(int64(size), at.minBytes, at.maxBytes))
+	adaptiveRotateBytes.Set(float64(tuning.rotateBytes.Load()))
+
+	// Aligned rotation keeps its configured windows
+	if !at.ca.config.AlignRotation {
+		if age < at.minAge {
+			age = at.minAge
+		}
+		if age > at.maxAge {
+			age = at.maxAge
+		}
+		tuning.rotateAge.Store(int64(age))
+		adaptiveRotateAge.Set(age.Seconds())
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func clampInt64(v, lo, hi int64) int64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	uploadRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_upload_retries_total",
+			Help: "Total number of GCS upload retries by error class",
+		},
+		[]string{"error_class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadRetries)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errPreconditionFailed reports that a DoesNotExist upload found the object
+// already present. After a retry that may be an earlier attempt that
+// succeeded before erroring, which withUploadRetry checks.
+var errPreconditionFailed = errors.New("object already exists")
+
+// classifyUploadError returns "transient" for errors worth retrying in place
+// and "permanent" for errors that will fail the same way again.
+func classifyUploadError(err error) string {
+	if errors.Is(err, errPreconditionFailed) {
+		// Writing again would meet the same object
+		return "permanent"
+	}
+	if errors.Is(err, context.Canceled) {
+		// Shutdown aborted the upload; retrying would only delay the spill
+		return "permanent"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "transient"
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusRequestTimeout,
+			apiErr.Code == http.StatusTooManyRequests,
+			apiErr.Code >= 500:
+			return "transient"
+		case apiErr.Code == http.StatusBadRequest:
+			// GCS rejects checksum mismatches with 400; the payload is
+			// intact in memory, so a fresh attempt can succeed
+			return "transient"
+		default:
+			return "permanent"
+		}
+	}
+
+	// Connection resets, DNS failures and the like
+	return "transient"
+}
+
+// backoff returns the delay before retry attempt n (1-based), using capped
+// exponential backoff with full jitter.
+func backoff(n int, initial, max time.Duration) time.Duration {
+	d := initial << uint(n-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// withUploadRetry runs upload until it succeeds, fails permanently, or runs
+// out of attempts. Callers fall back to the spill directory on error.
+//
+// obj is the unconditioned handle of the object written, and checksum and
+// size describe the bytes sent. A precondition failure on a retry counts as
+// success only if the stored object matches them.
+func (ca *CaptureAgent) withUploadRetry(obj *storage.ObjectHandle, checksum uint32, size int64, upload func(attempt int) error) error {
+	objectName := obj.ObjectName()
+	var err error
+	for attempt := 1; attempt <= ca.config.UploadRetries+1; attempt++ {
+		err = upload(attempt)
+		if err == nil {
+			return nil
+		}
+		if attempt > 1 && errors.Is(err, errPreconditionFailed) {
+			if verr := ca.verifyUploaded(obj, checksum, size); verr != nil {
+				uploadErrors.WithLabelValues("upload_permanent").Inc()
+				return fmt.Errorf("upload of %s failed after %d attempts: %w", objectName, attempt, verr)
+			}
+			log.Printf("Object %s already exists after retry with the expected content, treating as uploaded", objectName)
+			return nil
+		}
+
+		class := classifyUploadError(err)
+		if class == "permanent" || attempt > ca.config.UploadRetries {
+			uploadErrors.WithLabelValues("upload_" + class).Inc()
+			return fmt.Errorf("upload of %s failed after %d attempts (%s): %w", objectName, attempt, class, err)
+		}
+
+		uploadRetries.WithLabelValues(class).Inc()
+		delay := backoff(attempt, ca.config.UploadRetryInitial, ca.config.UploadRetryMax)
+		log.Printf("Upload of %s failed (attempt %d), retrying in %v: %v", objectName, attempt, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ca.ctx.Done():
+			return fmt.Errorf("upload of %s aborted during retry: %w", objectName, err)
+		}
+	}
+	return err
+}
+
+// verifyUploaded checks that the object stored under obj has the given
+// CRC32C and size, i.e. that it holds the bytes an earlier attempt sent.
+func (ca *CaptureAgent) verifyUploaded(obj *storage.ObjectHandle, checksum uint32, size int64) error {
+	attrs, err := obj.Attrs(ca.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read attributes of existing object %s: %w", obj.ObjectName(), err)
+	}
+	if attrs.CRC32C != checksum || attrs.Size != size {
+		return fmt.Errorf("object %s already exists with different content (crc32c %08x, %d bytes; sent %08x, %d bytes)",
+			obj.ObjectName(), attrs.CRC32C, attrs.Size, checksum, size)
+	}
+	return nil
+}
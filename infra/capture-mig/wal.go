@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	walBytesWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "capture_wal_bytes_written_total",
+			Help: "Total payload bytes appended to the write-ahead log",
+		},
+	)
+
+	walSyncSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "capture_wal_sync_seconds",
+			Help:    "Latency of write-ahead log fsyncs",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+		},
+	)
+
+	walSegmentsPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "capture_wal_segments_pending",
+			Help: "Sealed write-ahead log segments not yet uploaded",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(walBytesWritten)
+	prometheus.MustRegister(walSyncSeconds)
+	prometheus.MustRegister(walSegmentsPending)
+}
+
+const (
+	walSegmentPrefix  = "wal-"
+	walSegmentSuffix  = ".log"
+	walCheckpointFile = "checkpoint"
+	walHeaderSize     = 8 // uint32 length + uint32 CRC32C
+)
+
+// WAL is an fsync'd on-disk log of intake payloads. The active segment
+// mirrors the in-memory capture buffer; each buffer rotation seals it, and
+// the sealed segment is deleted once its data has been uploaded or spilled.
+//
+// Appends are group committed: records written while an fsync runs wait for
+// the next one, which covers them all, so the lock is never held across an
+// fsync and concurrent requests share its cost.
+type WAL struct {
+	dir        string
+	mu         sync.Mutex
+	file       *os.File
+	seq        uint64
+	acked      map[uint64]bool
+	checkpoint uint64
+
+	synced  *sync.Cond // signalled when an fsync finishes
+	syncing bool       // an fsync is running without the lock
+	written uint64     // records appended
+	durable uint64     // records known to be synced
+}
+
+// OpenWAL opens the log in dir and returns the sealed segments left over from
+// a previous run, which must be replayed before they can be acknowledged.
+func OpenWAL(dir string) (*WAL, []uint64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	w := &WAL{dir: dir, acked: make(map[uint64]bool)}
+	w.synced = sync.NewCond(&w.mu)
+
+	if data, err := os.ReadFile(filepath.Join(dir, walCheckpointFile)); err == nil {
+		w.checkpoint, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid WAL checkpoint: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read WAL checkpoint: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list WAL directory: %w", err)
+	}
+
+	var recovered []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		recovered = append(recovered, seq)
+	}
+	sort.Slice(recovered, func(i, j int) bool { return recovered[i] < recovered[j] })
+
+	// Segments between the checkpoint and the newest file that are already
+	// gone were uploaded out of order before the restart.
+	w.seq = w.checkpoint
+	if n := len(recovered); n > 0 && recovered[n-1] > w.seq {
+		w.seq = recovered[n-1]
+	}
+	onDisk := make(map[uint64]bool, len(recovered))
+	for _, seq := range recovered {
+		onDisk[seq] = true
+	}
+	for seq := w.checkpoint + 1; seq <= w.seq; seq++ {
+		if !onDisk[seq] {
+			w.acked[seq] = true
+		}
+	}
+	walSegmentsPending.Add(float64(len(recovered)))
+
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return nil, nil, err
+	}
+	return w, recovered, nil
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, seq, walSegmentSuffix))
+}
+
+func (w *WAL) openSegment(seq uint64) error {
+	file, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	w.file = file
+	w.seq = seq
+	return nil
+}
+
+// Append durably records payload; it returns only after the data is synced.
+// The first caller to find no fsync running syncs every record written so
+// far; the others wait for it, or for the next one if theirs came later.
+func (w *WAL) Append(payload []byte) error {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crc32cTable))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	w.written++
+	target := w.written
+
+	for w.durable < target {
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+
+		w.syncing = true
+		file, upTo := w.file, w.written
+		w.mu.Unlock()
+		start := time.Now()
+		err := file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+
+		if err != nil {
+			return fmt.Errorf("failed to sync WAL: %w", err)
+		}
+		walSyncSeconds.Observe(time.Since(start).Seconds())
+		if upTo > w.durable {
+			w.durable = upTo
+		}
+	}
+	walBytesWritten.Add(float64(len(payload)))
+	return nil
+}
+
+// syncLocked waits out a running group commit and syncs the active segment
+// itself, so that it can be closed. The caller holds w.mu.
+func (w *WAL) syncLocked() error {
+	for w.syncing {
+		w.synced.Wait()
+	}
+	if w.durable == w.written {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	w.durable = w.written
+	w.synced.Broadcast()
+	return nil
+}
+
+// Seal closes the active segment and starts a new one, returning the
+// sequence number of the sealed segment.
+func (w *WAL) Seal() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	sealed := w.seq
+	if err := w.file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	if err := w.openSegment(sealed + 1); err != nil {
+		return 0, err
+	}
+	walSegmentsPending.Inc()
+	return sealed, nil
+}
+
+// Ack marks a sealed segment as safely persisted elsewhere, removes it, and
+// advances the checkpoint past any contiguous run of acknowledged segments.
+func (w *WAL) Ack(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.Remove(w.segmentPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove WAL segment: %w", err)
+	}
+	w.acked[seq] = true
+	walSegmentsPending.Dec()
+
+	advanced := false
+	for w.acked[w.checkpoint+1] {
+		delete(w.acked, w.checkpoint+1)
+		w.checkpoint++
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+
+	tmp := filepath.Join(w.dir, walCheckpointFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(w.checkpoint, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to write WAL checkpoint: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(w.dir, walCheckpointFile))
+}
+
+// ReadSegment returns the concatenated payloads of a sealed segment. A
+// torn record at the tail (from a crash mid-write) ends the segment.
+func (w *WAL) ReadSegment(seq uint64) ([]byte, time.Time, error) {
+	file, err := os.Open(w.segmentPath(seq))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat WAL segment: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var data []byte
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.Checksum(payload, crc32cTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		data = append(data, payload...)
+	}
+	return data, info.ModTime(), nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.syncLocked(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
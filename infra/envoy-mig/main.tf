@@ -42,6 +42,24 @@ variable "xds_server_host" {
   type        = string
 }
 
+variable "xds_tls_ca_secret" {
+  description = "Secret Manager secret with the CA bundle validating the xDS controller; enables TLS to the controller"
+  type        = string
+  default     = ""
+}
+
+variable "xds_tls_cert_secret" {
+  description = "Secret Manager secret with the client certificate Envoys present to the xDS controller (mTLS)"
+  type        = string
+  default     = ""
+}
+
+variable "xds_tls_key_secret" {
+  description = "Secret Manager secret with the private key of the xDS client certificate"
+  type        = string
+  default     = ""
+}
+
 variable "min_replicas" {
   description = "Minimum number of Envoy instances"
   type        = number
@@ -79,12 +97,24 @@ resource "google_project_iam_member" "envoy_logging_writer" {
   member  = "serviceAccount:${google_service_account.envoy_sa.email}"
 }
 
+# Read access to the xDS TLS material fetched at boot
+resource "google_secret_manager_secret_iam_member" "envoy_xds_tls" {
+  for_each  = toset(compact([var.xds_tls_ca_secret, var.xds_tls_cert_secret, var.xds_tls_key_secret]))
+  project   = var.project_id
+  secret_id = each.value
+  role      = "roles/secretmanager.secretAccessor"
+  member    = "serviceAccount:${google_service_account.envoy_sa.email}"
+}
+
 # Startup script for Envoy instances
 locals {
   startup_script = base64encode(templatefile("${path.module}/startup.sh", {
-    xds_server_host = var.xds_server_host
-    region          = var.region
-    zone            = var.zone
+    xds_server_host     = var.xds_server_host
+    region              = var.region
+    zone                = var.zone
+    xds_tls_ca_secret   = var.xds_tls_ca_secret
+    xds_tls_cert_secret = var.xds_tls_cert_secret
+    xds_tls_key_secret  = var.xds_tls_key_secret
   }))
 }
 
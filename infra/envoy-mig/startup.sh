@@ -4,6 +4,9 @@ set -euo pipefail
 
 # Variables from metadata
 XDS_SERVER_HOST="${xds_server_host}"
+XDS_TLS_CA_SECRET="${xds_tls_ca_secret}"
+XDS_TLS_CERT_SECRET="${xds_tls_cert_secret}"
+XDS_TLS_KEY_SECRET="${xds_tls_key_secret}"
 REGION="${region}"
 ZONE="${zone}"
 NODE_ID=$(curl -s "http://metadata.google.internal/computeMetadata/v1/instance/id" -H "Metadata-Flavor: Google")
@@ -41,6 +44,39 @@ mkdir -p /etc/envoy
 mkdir -p /var/log/envoy
 mkdir -p /var/lib/envoy
 
+# Fetch TLS material for the xDS connection. With a CA the controller's
+# certificate is verified; with a client certificate Envoy also proves its
+# identity (mTLS). Without a CA the connection stays plaintext.
+XDS_TRANSPORT_SOCKET=""
+if [ -n "$XDS_TLS_CA_SECRET" ]; then
+    log "Fetching xDS TLS material from Secret Manager..."
+    mkdir -p /etc/envoy/xds-tls
+    gcloud secrets versions access latest --secret="$XDS_TLS_CA_SECRET" > /etc/envoy/xds-tls/ca.pem
+    XDS_TLS_CERTIFICATES=""
+    if [ -n "$XDS_TLS_CERT_SECRET" ] && [ -n "$XDS_TLS_KEY_SECRET" ]; then
+        gcloud secrets versions access latest --secret="$XDS_TLS_CERT_SECRET" > /etc/envoy/xds-tls/cert.pem
+        gcloud secrets versions access latest --secret="$XDS_TLS_KEY_SECRET" > /etc/envoy/xds-tls/key.pem
+        chmod 600 /etc/envoy/xds-tls/key.pem
+        XDS_TLS_CERTIFICATES="
+          tls_certificates:
+          - certificate_chain:
+              filename: /etc/envoy/xds-tls/cert.pem
+            private_key:
+              filename: /etc/envoy/xds-tls/key.pem"
+    fi
+    XDS_TRANSPORT_SOCKET="
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        \"@type\": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+        sni: \"$XDS_SERVER_HOST\"
+        common_tls_context:
+          alpn_protocols: [h2]
+          validation_context:
+            trusted_ca:
+              filename: /etc/envoy/xds-tls/ca.pem$XDS_TLS_CERTIFICATES"
+fi
+
 # Generate Envoy configuration from template
 cat > /etc/envoy/envoy.yaml <<EOF
 node:
@@ -49,6 +85,9 @@ node:
   locality:
     region: "$REGION"
     zone: "$ZONE"
+  metadata:
+    role: "collector-tier"
+    zone: "$ZONE"
 
 admin:
   access_log:
@@ -61,131 +100,34 @@ admin:
       port_value: 9901
 
 dynamic_resources:
-  eds_config:
-    api_config_source:
-      api_type: GRPC
-      transport_api_version: V3
-      grpc_services:
-      - envoy_grpc:
-          cluster_name: xds_cluster
-      set_node_on_first_message_only: true
-  rtds_config:
-    api_config_source:
-      api_type: GRPC
-      transport_api_version: V3
-      grpc_services:
-      - envoy_grpc:
-          cluster_name: xds_cluster
-      set_node_on_first_message_only: true
+  # Listeners, routes (including the capture mirror policy), clusters and
+  # endpoints are all generated by the xDS controller over one ADS stream
+  ads_config:
+    api_type: GRPC
+    transport_api_version: V3
+    grpc_services:
+    - envoy_grpc:
+        cluster_name: xds_cluster
+    set_node_on_first_message_only: true
+  lds_config:
+    ads: {}
+    resource_api_version: V3
+  cds_config:
+    ads: {}
     resource_api_version: V3
 
 static_resources:
-  listeners:
-  - name: wavefront_listener
-    address:
-      socket_address:
-        address: 0.0.0.0
-        port_value: 8080
-    filter_chains:
-    - filters:
-      - name: envoy.filters.network.http_connection_manager
-        typed_config:
-          "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
-          stat_prefix: wavefront_ingress
-          access_log:
-          - name: envoy.access_loggers.stdout
-            typed_config:
-              "@type": type.googleapis.com/envoy.extensions.access_loggers.stream.v3.StdoutAccessLog
-          http_filters:
-          - name: envoy.filters.http.router
-            typed_config:
-              "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
-          route_config:
-            name: wavefront_route
-            virtual_hosts:
-            - name: wavefront_service
-              domains: ["*"]
-              routes:
-              - match:
-                  prefix: "/api/v2/wfproxy/"
-                route:
-                  cluster: collector_cluster
-                  timeout: 30s
-                request_mirror_policies:
-                - cluster: capture_cluster
-                  runtime_fraction:
-                    default_value:
-                      numerator: 0
-                      denominator: HUNDRED
-                    runtime_key: capture.enabled
-              - match:
-                  prefix: "/health"
-                direct_response:
-                  status: 200
-                  body:
-                    inline_string: "OK"
-              - match:
-                  prefix: "/ready"  
-                direct_response:
-                  status: 200
-                  body:
-                    inline_string: "READY"
-
   clusters:
-  - name: collector_cluster
-    connect_timeout: 5s
-    type: EDS
-    eds_cluster_config:
-      eds_config:
-        api_config_source:
-          api_type: GRPC
-          transport_api_version: V3
-          grpc_services:
-          - envoy_grpc:
-              cluster_name: xds_cluster
-    lb_policy: LEAST_REQUEST
-    health_checks:
-    - timeout: 2s
-      interval: 10s
-      unhealthy_threshold: 3
-      healthy_threshold: 2
-      http_health_check:
-        path: "/health"
-    outlier_detection:
-      consecutive_5xx: 3
-      interval: 10s
-      base_ejection_time: 30s
-      max_ejection_percent: 50
-  
-  - name: capture_cluster
-    connect_timeout: 200ms
-    type: EDS
-    eds_cluster_config:
-      eds_config:
-        api_config_source:
-          api_type: GRPC
-          transport_api_version: V3
-          grpc_services:
-          - envoy_grpc:
-              cluster_name: xds_cluster
-    lb_policy: ROUND_ROBIN
-    circuit_breakers:
-      thresholds:
-      - priority: DEFAULT
-        max_connections: 32
-        max_pending_requests: 64
-        max_requests: 128
-        max_retries: 0
-    outlier_detection:
-      consecutive_5xx: 10
-      interval: 30s
-      base_ejection_time: 10s
-      max_ejection_percent: 25
-
   - name: xds_cluster
     connect_timeout: 1s
     type: LOGICAL_DNS
     lb_policy: ROUND_ROBIN
+    # xDS is gRPC, which needs HTTP/2 to the controller
+    typed_extension_protocol_options:
+      envoy.extensions.upstreams.http.v3.HttpProtocolOptions:
+        "@type": type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions
+        explicit_http_config:
+          http2_protocol_options: {}
     load_assignment:
       cluster_name: xds_cluster
       endpoints:
@@ -194,7 +136,7 @@ static_resources:
             address:
               socket_address:
                 address: "$XDS_SERVER_HOST"
-                port_value: 18000
+                port_value: 18000$XDS_TRANSPORT_SOCKET
 
 layered_runtime:
   layers:
@@ -202,12 +144,8 @@ layered_runtime:
     rtds_layer:
       name: loadgen_runtime
       rtds_config:
-        api_config_source:
-          api_type: GRPC
-          transport_api_version: V3
-          grpc_services:
-          - envoy_grpc:
-              cluster_name: xds_cluster
+        ads: {}
+        resource_api_version: V3
 EOF
 
 # Create systemd service
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	alsdata "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	grpcals "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	alsservice "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	stringmatcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+const (
+	// Envoys ship access logs over the bootstrap cluster that reaches this
+	// controller
+	alsClusterName = "xds_cluster"
+	alsLogName     = "loadgen"
+
+	// Only requests sent by load generator workers are shipped; the worker
+	// ID header ties them back to an assignment
+	alsUserAgentPrefix = "loadgen-worker/"
+	alsWorkerHeader    = "x-loadgen-worker"
+
+	// Request samples forwarded to the divergence monitor per flush, and
+	// latencies kept per worker and cluster for the quantiles
+	alsMaxSamples   = 1000
+	alsMaxLatencies = 10000
+
+	alsForwardTimeout = 5 * time.Second
+)
+
+// requestSample is one loadgen request as seen by an Envoy.
+type requestSample struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Worker        string    `json:"worker,omitempty"`
+	Cluster       string    `json:"cluster"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Envoy         string    `json:"envoy,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	Status        uint32    `json:"status"`
+	BytesReceived uint64    `json:"bytes_received"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	LatencyMs     float64   `json:"latency_ms"`
+}
+
+// requestSummary aggregates the requests of one worker to one cluster over
+// a flush interval.
+type requestSummary struct {
+	Source        string             `json:"source"`
+	Worker        string             `json:"worker"`
+	Cluster       string             `json:"cluster"`
+	WindowStart   time.Time          `json:"window_start"`
+	WindowEnd     time.Time          `json:"window_end"`
+	Requests      int64              `json:"requests"`
+	StatusClasses map[string]int64   `json:"status_classes"`
+	BytesReceived uint64             `json:"bytes_received"`
+	BytesSent     uint64             `json:"bytes_sent"`
+	LatencyMs     map[string]float64 `json:"latency_ms"`
+
+	latencies []float64
+}
+
+// alsReceiver is an Envoy AccessLogService receiving the access logs of
+// loadgen requests. Every flush interval it forwards a sample of the
+// requests to the divergence monitor and per-worker summaries to the load
+// generator control plane, so generated traffic is validated end to end
+// as the collectors actually received it.
+type alsReceiver struct {
+	alsservice.UnimplementedAccessLogServiceServer
+
+	source          string
+	monitorURL      string
+	controlPlaneURL string
+	client          *http.Client
+
+	mu          sync.Mutex
+	windowStart time.Time
+	seen        int64
+	samples     []requestSample
+	summaries   map[string]*requestSummary
+	last        []*requestSummary
+}
+
+func newALSReceiver(cfg *Config) *alsReceiver {
+	return &alsReceiver{
+		source:          cfg.Identity,
+		monitorURL:      strings.TrimSuffix(cfg.DivergenceMonitorURL, "/"),
+		controlPlaneURL: strings.TrimSuffix(cfg.ControlPlaneURL, "/"),
+		client:          &http.Client{Timeout: alsForwardTimeout},
+		windowStart:     time.Now(),
+		summaries:       make(map[string]*requestSummary),
+	}
+}
+
+// alsAccessLog is the access log shipping loadgen requests to this
+// controller over gRPC.
+func alsAccessLog() (*accesslog.AccessLog, error) {
+	config, err := anypb.New(&grpcals.HttpGrpcAccessLogConfig{
+		CommonConfig: &grpcals.CommonGrpcAccessLogConfig{
+			LogName: alsLogName,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: alsClusterName},
+				},
+			},
+			TransportApiVersion: core.ApiVersion_V3,
+		},
+		AdditionalRequestHeadersToLog: []string{alsWorkerHeader},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal gRPC access log config: %w", err)
+	}
+	return &accesslog.AccessLog{
+		Name: "envoy.access_loggers.http_grpc",
+		Filter: &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_HeaderFilter{
+				HeaderFilter: &accesslog.HeaderFilter{
+					Header: &route.HeaderMatcher{
+						Name: "user-agent",
+						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+							StringMatch: &stringmatcher.StringMatcher{
+								MatchPattern: &stringmatcher.StringMatcher_Prefix{Prefix: alsUserAgentPrefix},
+							},
+						},
+					},
+				},
+			},
+		},
+		ConfigType: &accesslog.AccessLog_TypedConfig{TypedConfig: config},
+	}, nil
+}
+
+// StreamAccessLogs receives the access log stream of one Envoy. Only the
+// first message carries the Envoy's identifier.
+func (r *alsReceiver) StreamAccessLogs(stream alsservice.AccessLogService_StreamAccessLogsServer) error {
+	var envoy string
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id := msg.GetIdentifier(); id != nil {
+			envoy = id.GetNode().GetId()
+		}
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			r.record(envoy, entry)
+		}
+	}
+}
+
+func (r *alsReceiver) record(envoy string, entry *alsdata.HTTPAccessLogEntry) {
+	common, request, response := entry.GetCommonProperties(), entry.GetRequest(), entry.GetResponse()
+	sample := requestSample{
+		Timestamp:     common.GetStartTime().AsTime(),
+		Worker:        request.GetRequestHeaders()[alsWorkerHeader],
+		Cluster:       common.GetUpstreamCluster(),
+		Envoy:         envoy,
+		Path:          request.GetPath(),
+		Status:        response.GetResponseCode().GetValue(),
+		BytesReceived: request.GetRequestHeadersBytes() + request.GetRequestBodyBytes(),
+		BytesSent:     response.GetResponseHeadersBytes() + response.GetResponseBodyBytes(),
+		LatencyMs:     float64(common.GetTimeToLastDownstreamTxByte().AsDuration()) / float64(time.Millisecond),
+	}
+	if upstream := common.GetUpstreamRemoteAddress().GetSocketAddress(); upstream != nil {
+		sample.Upstream = net.JoinHostPort(upstream.GetAddress(), strconv.Itoa(int(upstream.GetPortValue())))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Reservoir sampling keeps a uniform sample of the interval's requests
+	r.seen++
+	if len(r.samples) < alsMaxSamples {
+		r.samples = append(r.samples, sample)
+	} else if i := rand.Int63n(r.seen); i < alsMaxSamples {
+		r.samples[i] = sample
+	}
+
+	key := sample.Worker + "/" + sample.Cluster
+	summary, ok := r.summaries[key]
+	if !ok {
+		summary = &requestSummary{
+			Source:        r.source,
+			Worker:        sample.Worker,
+			Cluster:       sample.Cluster,
+			StatusClasses: make(map[string]int64),
+		}
+		r.summaries[key] = summary
+	}
+	summary.Requests++
+	summary.StatusClasses[statusClass(sample.Status)]++
+	summary.BytesReceived += sample.BytesReceived
+	summary.BytesSent += sample.BytesSent
+	if len(summary.latencies) < alsMaxLatencies {
+		summary.latencies = append(summary.latencies, sample.LatencyMs)
+	} else if i := rand.Int63n(summary.Requests); i < alsMaxLatencies {
+		summary.latencies[i] = sample.LatencyMs
+	}
+}
+
+// statusClass groups a response code into 2xx..5xx; 0 means Envoy sent no
+// response, e.g. on a reset.
+func statusClass(status uint32) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// quantile returns the q quantile of sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// run flushes the collected requests every interval.
+func (r *alsReceiver) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush(ctx)
+		}
+	}
+}
+
+// flush closes the current interval and forwards its samples and
+// summaries. Failed forwards are logged and dropped; validation tolerates
+// gaps better than stale data.
+func (r *alsReceiver) flush(ctx context.Context) {
+	now := time.Now()
+	r.mu.Lock()
+	windowStart, samples, summaries := r.windowStart, r.samples, r.summaries
+	r.windowStart, r.seen, r.samples = now, 0, nil
+	r.summaries = make(map[string]*requestSummary)
+
+	flushed := make([]*requestSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		summary.WindowStart, summary.WindowEnd = windowStart, now
+		sort.Float64s(summary.latencies)
+		summary.LatencyMs = map[string]float64{
+			"p50": quantile(summary.latencies, 0.5),
+			"p90": quantile(summary.latencies, 0.9),
+			"p99": quantile(summary.latencies, 0.99),
+		}
+		flushed = append(flushed, summary)
+	}
+	sort.Slice(flushed, func(i, j int) bool {
+		if flushed[i].Worker != flushed[j].Worker {
+			return flushed[i].Worker < flushed[j].Worker
+		}
+		return flushed[i].Cluster < flushed[j].Cluster
+	})
+	r.last = flushed
+	r.mu.Unlock()
+
+	if len(samples) == 0 {
+		return
+	}
+	if r.monitorURL != "" {
+		batch := map[string]interface{}{"source": r.source, "samples": samples}
+		if err := r.post(ctx, r.monitorURL+"/requests", batch); err != nil {
+			log.Printf("Failed to forward %d request samples to the divergence monitor: %v", len(samples), err)
+		}
+	}
+	if r.controlPlaneURL != "" {
+		if err := r.post(ctx, r.controlPlaneURL+"/api/v1/validation/requests", flushed); err != nil {
+			log.Printf("Failed to forward %d request summaries to the control plane: %v", len(flushed), err)
+		}
+	}
+}
+
+func (r *alsReceiver) post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// handleALS serves GET /als: the requests received in the current
+// interval and the summaries of the last flushed one.
+func (c *Controller) handleALS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.als == nil {
+		http.Error(w, "Access log receiver not enabled (-als)", http.StatusNotFound)
+		return
+	}
+
+	c.als.mu.Lock()
+	defer c.als.mu.Unlock()
+	writeJSON(w, map[string]interface{}{
+		"window_start": c.als.windowStart,
+		"requests":     c.als.seen,
+		"last":         c.als.last,
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsRequestTimeout = 10 * time.Second
+	awsMetadataURL    = "http://169.254.169.254/latest"
+
+	// Instance IDs per DescribeInstances request
+	awsDescribeInstancesBatch = 100
+
+	// Instance role credentials are refreshed this long before they expire
+	awsCredentialsRefresh = 5 * time.Minute
+)
+
+// AWSASGSpec is one EC2 Auto Scaling group backing a cluster. Weight is
+// the per-instance weight, as for MIGs.
+type AWSASGSpec struct {
+	Name   string `yaml:"name"`
+	Region string `yaml:"region"`
+	Weight uint32 `yaml:"weight"`
+}
+
+func (a AWSASGSpec) key() string { return a.Region + "/" + a.Name }
+
+// awsClient is a minimal client for the two EC2 Auto Scaling and EC2 query
+// API calls discovery needs; like the Kubernetes client it does not
+// justify pulling in the AWS SDK. Credentials come from the standard
+// environment variables or, on EC2, from the instance role.
+type awsClient struct {
+	http *http.Client
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func newAWSClient() *awsClient {
+	return &awsClient{http: &http.Client{Timeout: awsRequestTimeout}}
+}
+
+// getCredentials returns the environment credentials, or the instance
+// role credentials from the metadata service (IMDSv2), cached until
+// shortly before they expire.
+func (a *awsClient) getCredentials(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.credentials != nil && time.Until(a.credentials.Expiration) > awsCredentialsRefresh {
+		return a.credentials, nil
+	}
+
+	token, err := a.metadata(ctx, http.MethodPut, "/api/token", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata token: %w", err)
+	}
+	role, err := a.metadata(ctx, http.MethodGet, "/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance role: %w", err)
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	body, err := a.metadata(ctx, http.MethodGet, "/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance role credentials: %w", err)
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return nil, fmt.Errorf("failed to decode instance role credentials: %w", err)
+	}
+	a.credentials = &creds
+	return a.credentials, nil
+}
+
+// metadata calls the EC2 instance metadata service.
+func (a *awsClient) metadata(ctx context.Context, method, path, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, awsMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	} else {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+	return string(body), nil
+}
+
+// call sends a signed query API request to service in region and decodes
+// the XML response into out.
+func (a *awsClient) call(ctx context.Context, service, region string, params url.Values, out interface{}) error {
+	creds, err := a.getCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	host := fmt.Sprintf("%s.%s.amazonaws.com", service, region)
+	body := params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, host, service, region, body, creds, time.Now().UTC())
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", service, params.Get("Action"), resp.Status, awsErrorMessage(data))
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", params.Get("Action"), err)
+	}
+	return nil
+}
+
+// awsErrorMessage extracts the code and message of an error response:
+// Auto Scaling nests the error in ErrorResponse, EC2 in Response>Errors.
+func awsErrorMessage(data []byte) string {
+	type awsError struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	var errResp struct {
+		Error  awsError   `xml:"Error"`
+		Errors []awsError `xml:"Errors>Error"`
+	}
+	if err := xml.Unmarshal(data, &errResp); err != nil {
+		return strings.TrimSpace(string(data))
+	}
+	if len(errResp.Errors) > 0 {
+		errResp.Error = errResp.Errors[0]
+	}
+	if errResp.Error.Code == "" {
+		return strings.TrimSpace(string(data))
+	}
+	return errResp.Error.Code + ": " + errResp.Error.Message
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header.
+func signAWSRequest(req *http.Request, host, service, region, body string, creds *awsCredentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+	}
+	if creds.Token != "" {
+		headers["x-amz-security-token"] = creds.Token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256([]byte(body))
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsASGInstance is an instance of an Auto Scaling group.
+type awsASGInstance struct {
+	InstanceID       string `xml:"InstanceId"`
+	AvailabilityZone string `xml:"AvailabilityZone"`
+	LifecycleState   string `xml:"LifecycleState"`
+	HealthStatus     string `xml:"HealthStatus"`
+}
+
+// describeAutoScalingGroup returns the instances of an Auto Scaling group.
+func (a *awsClient) describeAutoScalingGroup(ctx context.Context, region, name string) ([]awsASGInstance, error) {
+	var resp struct {
+		Groups []struct {
+			Name      string           `xml:"AutoScalingGroupName"`
+			Instances []awsASGInstance `xml:"Instances>member"`
+		} `xml:"DescribeAutoScalingGroupsResult>AutoScalingGroups>member"`
+	}
+	params := url.Values{
+		"Action":                         {"DescribeAutoScalingGroups"},
+		"Version":                        {"2011-01-01"},
+		"AutoScalingGroupNames.member.1": {name},
+	}
+	if err := a.call(ctx, "autoscaling", region, params, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Groups) == 0 {
+		return nil, fmt.Errorf("auto scaling group %s not found in %s", name, region)
+	}
+	return resp.Groups[0].Instances, nil
+}
+
+// describeInstanceAddresses returns the private IP address of each
+// instance, keyed on the instance ID.
+func (a *awsClient) describeInstanceAddresses(ctx context.Context, region string, ids []string) (map[string]string, error) {
+	addresses := make(map[string]string, len(ids))
+	for start := 0; start < len(ids); start += awsDescribeInstancesBatch {
+		end := start + awsDescribeInstancesBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		params := url.Values{
+			"Action":  {"DescribeInstances"},
+			"Version": {"2016-11-15"},
+		}
+		for i, id := range ids[start:end] {
+			params.Set(fmt.Sprintf("InstanceId.%d", i+1), id)
+		}
+		var resp struct {
+			Instances []struct {
+				InstanceID       string `xml:"instanceId"`
+				PrivateIPAddress string `xml:"privateIpAddress"`
+			} `xml:"reservationSet>item>instancesSet>item"`
+		}
+		if err := a.call(ctx, "ec2", region, params, &resp); err != nil {
+			return nil, err
+		}
+		for _, instance := range resp.Instances {
+			addresses[instance.InstanceID] = instance.PrivateIPAddress
+		}
+	}
+	return addresses, nil
+}
+
+// awsASGProvider lists the instances of an EC2 Auto Scaling group. Only
+// instances that are InService and Healthy receive traffic.
+type awsASGProvider struct {
+	c    *Controller
+	asg  AWSASGSpec
+	port uint32
+}
+
+func (p *awsASGProvider) String() string { return "aws-asg:" + p.asg.key() }
+
+func (p *awsASGProvider) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	c, asg := p.c, p.asg
+	instances, err := c.aws.describeAutoScalingGroup(ctx, asg.Region, asg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe auto scaling group: %w", err)
+	}
+
+	// As for MIGs, addresses are kept per instance ID so only new instances
+	// cost a DescribeInstances
+	asgKey := asg.key()
+	known := c.asgAddresses[asgKey]
+	var missing []string
+	for _, instance := range instances {
+		if _, ok := known[instance.InstanceID]; !ok {
+			missing = append(missing, instance.InstanceID)
+		}
+	}
+	var described map[string]string
+	if len(missing) > 0 {
+		if described, err = c.aws.describeInstanceAddresses(ctx, asg.Region, missing); err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+	}
+	addresses := make(map[string]string, len(instances))
+
+	var endpoints []Endpoint
+	for _, instance := range instances {
+		state := instance.LifecycleState
+		// Rediscover quickly while the group launches or terminates instances
+		if strings.HasPrefix(state, "Pending") || strings.HasPrefix(state, "Terminating") {
+			c.enterFastDiscovery(fmt.Sprintf("ASG %s instance %s is %s", asg.Name, instance.InstanceID, state))
+		}
+		if state == "Terminated" {
+			continue
+		}
+
+		ip, ok := known[instance.InstanceID]
+		if !ok {
+			ip = described[instance.InstanceID]
+		}
+		if ip == "" {
+			log.Printf("No private address found for instance %s", instance.InstanceID)
+			continue
+		}
+		addresses[instance.InstanceID] = ip
+
+		endpoints = append(endpoints, Endpoint{
+			Instance:   instance.InstanceID,
+			Address:    ip,
+			Port:       p.port,
+			Zone:       instance.AvailabilityZone,
+			Healthy:    state == "InService" && instance.HealthStatus == "Healthy",
+			Probe:      state + "/" + instance.HealthStatus,
+			Group:      asg.Name,
+			BaseWeight: asg.Weight,
+		})
+	}
+	c.asgAddresses[asgKey] = addresses
+
+	return endpoints, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Cluster roles tie a cluster into the generated route.
+const (
+	roleCollector = "collector" // receives ingress
+	roleCapture   = "capture"   // receives mirrored ingress
+	roleCanary    = "canary"    // receives the weighted canary share of ingress
+)
+
+const (
+	defaultServicePort        = 8080
+	defaultMIGWeight          = 100
+	clusterConfigPollInterval = 10 * time.Second
+)
+
+// HealthCheckSpec configures active HTTP health checking of a cluster.
+type HealthCheckSpec struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   uint32        `yaml:"healthy_threshold"`
+	UnhealthyThreshold uint32        `yaml:"unhealthy_threshold"`
+}
+
+// MIGSpec is one managed instance group backing a cluster. Weight is the
+// relative load-balancing weight of each of its instances, so a group of
+// larger machines can take proportionally more traffic per instance.
+type MIGSpec struct {
+	Name   string `yaml:"name"`
+	Zone   string `yaml:"zone"`
+	Weight uint32 `yaml:"weight"`
+}
+
+func (m MIGSpec) key() string { return m.Zone + "/" + m.Name }
+
+// ClusterSpec declares one upstream cluster and where its endpoints come
+// from: MIGs, a Kubernetes service, a static list, a DNS SRV name and AWS
+// Auto Scaling groups, in any combination. Clusters without a role are
+// extra tiers, reachable through their route prefix and optionally
+// mirrored to the capture cluster. A single mig is shorthand for a migs
+// list of one.
+type ClusterSpec struct {
+	Name           string               `yaml:"name"`
+	Role           string               `yaml:"role"`
+	MIG            string               `yaml:"mig"`
+	MIGs           []MIGSpec            `yaml:"migs"`
+	Zone           string               `yaml:"zone"`
+	K8sService     string               `yaml:"k8s_service"`
+	Static         []StaticEndpointSpec `yaml:"static"`
+	DNSSRV         string               `yaml:"dns_srv"`
+	AWSASGs        []AWSASGSpec         `yaml:"aws_asgs"`
+	Port           uint32               `yaml:"port"`
+	ConnectTimeout time.Duration        `yaml:"connect_timeout"`
+	LBPolicy       string               `yaml:"lb_policy"`
+	RoutePrefix    string               `yaml:"route_prefix"`
+	Mirror         bool                 `yaml:"mirror"`
+	HealthCheck    *HealthCheckSpec     `yaml:"health_check"`
+}
+
+// ClusterConfig is the declarative cluster configuration file.
+type ClusterConfig struct {
+	Clusters []ClusterSpec `yaml:"clusters"`
+}
+
+// defaultHealthCheck is the collector health check used before cluster
+// configuration existed.
+func defaultHealthCheck() *HealthCheckSpec {
+	return &HealthCheckSpec{
+		Path:               "/health",
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// applyDefaults fills unset fields: collectors and canaries are health
+// checked and balanced by least request, capture agents get a short
+// connect timeout for best-effort mirroring.
+func (s *ClusterSpec) applyDefaults(zone, awsRegion string) {
+	if s.Zone == "" {
+		s.Zone = zone
+	}
+	if s.Port == 0 {
+		s.Port = defaultServicePort
+	}
+	if s.MIG != "" && len(s.MIGs) == 0 {
+		s.MIGs = []MIGSpec{{Name: s.MIG}}
+	}
+	for i := range s.MIGs {
+		if s.MIGs[i].Zone == "" {
+			s.MIGs[i].Zone = s.Zone
+		}
+		if s.MIGs[i].Weight == 0 {
+			s.MIGs[i].Weight = defaultMIGWeight
+		}
+	}
+	for i := range s.AWSASGs {
+		if s.AWSASGs[i].Region == "" {
+			s.AWSASGs[i].Region = awsRegion
+		}
+		if s.AWSASGs[i].Weight == 0 {
+			s.AWSASGs[i].Weight = defaultMIGWeight
+		}
+	}
+	switch s.Role {
+	case roleCollector, roleCanary:
+		if s.ConnectTimeout == 0 {
+			s.ConnectTimeout = 5 * time.Second
+		}
+		if s.LBPolicy == "" {
+			s.LBPolicy = "LEAST_REQUEST"
+		}
+		if s.HealthCheck == nil {
+			s.HealthCheck = defaultHealthCheck()
+		}
+	case roleCapture:
+		if s.ConnectTimeout == 0 {
+			s.ConnectTimeout = 200 * time.Millisecond
+		}
+	default:
+		if s.ConnectTimeout == 0 {
+			s.ConnectTimeout = 5 * time.Second
+		}
+	}
+	if s.LBPolicy == "" {
+		s.LBPolicy = "ROUND_ROBIN"
+	}
+
+	if hc := s.HealthCheck; hc != nil {
+		defaults := defaultHealthCheck()
+		if hc.Path == "" {
+			hc.Path = defaults.Path
+		}
+		if hc.Interval == 0 {
+			hc.Interval = defaults.Interval
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = defaults.Timeout
+		}
+		if hc.HealthyThreshold == 0 {
+			hc.HealthyThreshold = defaults.HealthyThreshold
+		}
+		if hc.UnhealthyThreshold == 0 {
+			hc.UnhealthyThreshold = defaults.UnhealthyThreshold
+		}
+	}
+}
+
+func (s *ClusterSpec) lbPolicy() cluster.Cluster_LbPolicy {
+	return cluster.Cluster_LbPolicy(cluster.Cluster_LbPolicy_value[s.LBPolicy])
+}
+
+// validate checks the configuration after defaults are applied. The route
+// needs exactly one collector and one capture cluster.
+func (cc *ClusterConfig) validate(projectID string) error {
+	names := make(map[string]bool)
+	prefixes := map[string]bool{ingressPathPrefix: true}
+	roles := make(map[string]int)
+
+	for _, spec := range cc.Clusters {
+		if spec.Name == "" {
+			return fmt.Errorf("cluster without a name")
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("duplicate cluster %q", spec.Name)
+		}
+		names[spec.Name] = true
+
+		switch spec.Role {
+		case roleCollector, roleCapture, roleCanary:
+			roles[spec.Role]++
+			if spec.RoutePrefix != "" || spec.Mirror {
+				return fmt.Errorf("cluster %q: route_prefix and mirror are only valid for clusters without a role", spec.Name)
+			}
+		case "":
+			if spec.Mirror && spec.RoutePrefix == "" {
+				return fmt.Errorf("cluster %q: mirror needs a route_prefix", spec.Name)
+			}
+			if spec.RoutePrefix != "" {
+				if !strings.HasPrefix(spec.RoutePrefix, "/") || prefixes[spec.RoutePrefix] {
+					return fmt.Errorf("cluster %q: route_prefix %q must start with / and be unique", spec.Name, spec.RoutePrefix)
+				}
+				prefixes[spec.RoutePrefix] = true
+			}
+		default:
+			return fmt.Errorf("cluster %q: unknown role %q", spec.Name, spec.Role)
+		}
+
+		if len(spec.MIGs) == 0 && spec.K8sService == "" && len(spec.Static) == 0 && spec.DNSSRV == "" && len(spec.AWSASGs) == 0 {
+			return fmt.Errorf("cluster %q: needs a mig, migs, k8s_service, static, dns_srv or aws_asgs", spec.Name)
+		}
+		if spec.MIG != "" && (len(spec.MIGs) != 1 || spec.MIGs[0].Name != spec.MIG) {
+			return fmt.Errorf("cluster %q: use either mig or migs", spec.Name)
+		}
+		migs := make(map[string]bool)
+		for _, mig := range spec.MIGs {
+			if mig.Name == "" {
+				return fmt.Errorf("cluster %q: MIG without a name", spec.Name)
+			}
+			if projectID == "" || mig.Zone == "" {
+				return fmt.Errorf("cluster %q: MIG discovery needs -project and a zone", spec.Name)
+			}
+			if migs[mig.key()] {
+				return fmt.Errorf("cluster %q: duplicate MIG %s", spec.Name, mig.key())
+			}
+			migs[mig.key()] = true
+		}
+		for _, static := range spec.Static {
+			if net.ParseIP(static.Address) == nil {
+				return fmt.Errorf("cluster %q: static endpoint address %q is not an IP address", spec.Name, static.Address)
+			}
+		}
+		asgs := make(map[string]bool)
+		for _, asg := range spec.AWSASGs {
+			if asg.Name == "" || asg.Region == "" {
+				return fmt.Errorf("cluster %q: AWS ASGs need a name and a region or -aws-region", spec.Name)
+			}
+			if asgs[asg.key()] {
+				return fmt.Errorf("cluster %q: duplicate AWS ASG %s", spec.Name, asg.key())
+			}
+			asgs[asg.key()] = true
+		}
+		if spec.K8sService != "" {
+			if _, err := parseKubeServiceSource(spec.K8sService); err != nil {
+				return fmt.Errorf("cluster %q: %w", spec.Name, err)
+			}
+		}
+		if _, ok := cluster.Cluster_LbPolicy_value[spec.LBPolicy]; !ok {
+			return fmt.Errorf("cluster %q: unknown lb_policy %q", spec.Name, spec.LBPolicy)
+		}
+	}
+
+	if roles[roleCollector] != 1 || roles[roleCapture] != 1 {
+		return fmt.Errorf("exactly one %s and one %s cluster are required", roleCollector, roleCapture)
+	}
+	if roles[roleCanary] > 1 {
+		return fmt.Errorf("at most one %s cluster is allowed", roleCanary)
+	}
+	return nil
+}
+
+// parseClusterConfig decodes and validates a cluster configuration file.
+func parseClusterConfig(data []byte, cfg *Config) (*ClusterConfig, error) {
+	var cc ClusterConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cc); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster config: %w", err)
+	}
+	for i := range cc.Clusters {
+		cc.Clusters[i].applyDefaults(cfg.Zone, cfg.AWSRegion)
+	}
+	if err := cc.validate(cfg.ProjectID); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+	return &cc, nil
+}
+
+// parseMIGList parses a MIG flag: comma-separated name[@zone][=weight]
+// entries, e.g. "collectors,collectors-c2d@us-central1-b=200".
+func parseMIGList(value string) ([]MIGSpec, error) {
+	var migs []MIGSpec
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var mig MIGSpec
+		if name, weight, ok := strings.Cut(entry, "="); ok {
+			w, err := strconv.ParseUint(weight, 10, 32)
+			if err != nil || w == 0 {
+				return nil, fmt.Errorf("invalid weight in MIG %q", entry)
+			}
+			entry, mig.Weight = name, uint32(w)
+		}
+		mig.Name, mig.Zone, _ = strings.Cut(entry, "@")
+		migs = append(migs, mig)
+	}
+	return migs, nil
+}
+
+// flagClusterConfig builds the configuration from the per-cluster flags,
+// for deployments without a cluster configuration file.
+func flagClusterConfig(cfg *Config) (*ClusterConfig, error) {
+	var migs [3][]MIGSpec
+	for i, value := range []string{cfg.CollectorMIG, cfg.CaptureAgentMIG, cfg.CanaryCollectorMIG} {
+		var err error
+		if migs[i], err = parseMIGList(value); err != nil {
+			return nil, err
+		}
+	}
+
+	cc := &ClusterConfig{Clusters: []ClusterSpec{
+		{Name: collectorClusterName, Role: roleCollector, MIGs: migs[0], K8sService: cfg.CollectorK8sService},
+		{Name: captureClusterName, Role: roleCapture, MIGs: migs[1], K8sService: cfg.CaptureK8sService},
+	}}
+	if cfg.CanaryCollectorMIG != "" || cfg.CanaryCollectorK8sService != "" {
+		cc.Clusters = append(cc.Clusters, ClusterSpec{
+			Name: canaryClusterName, Role: roleCanary, MIGs: migs[2], K8sService: cfg.CanaryCollectorK8sService,
+		})
+	}
+	for i := range cc.Clusters {
+		cc.Clusters[i].applyDefaults(cfg.Zone, cfg.AWSRegion)
+	}
+	if err := cc.validate(cfg.ProjectID); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// clusterByRole returns the cluster with the given role, or nil. The
+// caller holds c.mu.
+func (c *Controller) clusterByRole(role string) *ClusterSpec {
+	for i := range c.clusters {
+		if c.clusters[i].Role == role {
+			return &c.clusters[i]
+		}
+	}
+	return nil
+}
+
+// setClusters switches to a new cluster configuration: it creates the
+// compute and AWS clients on first use, starts EndpointSlice watchers for
+// new services and stops watchers and address caches no longer
+// referenced. The caller holds c.mu.
+func (c *Controller) setClusters(ctx context.Context, cc *ClusterConfig) error {
+	services := make(map[string]bool)
+	migs := make(map[string]bool)
+	asgs := make(map[string]bool)
+	for _, spec := range cc.Clusters {
+		for _, mig := range spec.MIGs {
+			migs[mig.key()] = true
+		}
+		for _, asg := range spec.AWSASGs {
+			asgs[asg.key()] = true
+		}
+		if len(spec.AWSASGs) > 0 && c.aws == nil {
+			c.aws = newAWSClient()
+		}
+		if len(spec.MIGs) > 0 && c.computeSvc == nil {
+			computeSvc, err := compute.NewService(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to create compute service: %w", err)
+			}
+			c.computeSvc = computeSvc
+		}
+		if spec.K8sService == "" {
+			continue
+		}
+		services[spec.K8sService] = true
+		if _, ok := c.watchers[spec.K8sService]; ok {
+			continue
+		}
+		if c.kube == nil {
+			kube, err := newInClusterKubeClient(c.config.KubeAPIServer)
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+			c.kube = kube
+		}
+		source, _ := parseKubeServiceSource(spec.K8sService)
+		watchCtx, cancel := context.WithCancel(ctx)
+		watcher := newKubeWatcher(c.kube, source, c.triggerUpdate)
+		go watcher.run(watchCtx)
+		c.watchers[spec.K8sService] = &clusterWatcher{kubeWatcher: watcher, cancel: cancel}
+	}
+
+	for service, watcher := range c.watchers {
+		if !services[service] {
+			watcher.cancel()
+			delete(c.watchers, service)
+		}
+	}
+	for mig := range c.instanceAddresses {
+		if !migs[mig] {
+			delete(c.instanceAddresses, mig)
+		}
+	}
+	for asg := range c.asgAddresses {
+		if !asgs[asg] {
+			delete(c.asgAddresses, asg)
+		}
+	}
+	c.clusters = cc.Clusters
+	return nil
+}
+
+// clusterWatcher is a running EndpointSlice watcher that can be stopped
+// when its service leaves the configuration.
+type clusterWatcher struct {
+	*kubeWatcher
+	cancel context.CancelFunc
+}
+
+// watchClusterConfig reloads the cluster configuration file whenever its
+// content changes. Invalid configurations are logged and the current one
+// is kept. Polling rather than inotify also follows ConfigMap volume
+// updates, which swap a symlink.
+func (c *Controller) watchClusterConfig(ctx context.Context, current []byte) {
+	ticker := time.NewTicker(clusterConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(c.config.ClustersConfig)
+		if err != nil {
+			log.Printf("Failed to read cluster config: %v", err)
+			continue
+		}
+		if bytes.Equal(data, current) {
+			continue
+		}
+		current = data
+
+		cc, err := parseClusterConfig(data, c.config)
+		if err != nil {
+			log.Printf("Keeping current clusters: %v", err)
+			continue
+		}
+		c.mu.Lock()
+		err = c.setClusters(ctx, cc)
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to apply cluster config: %v", err)
+			continue
+		}
+		log.Printf("Reloaded cluster config: %d clusters", len(cc.Clusters))
+		c.triggerUpdate()
+	}
+}
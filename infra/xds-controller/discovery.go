@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Discovery intervals are spread by up to this fraction either way so
+	// replicas and restarts do not synchronise their Compute API requests
+	discoveryJitter = 0.2
+
+	// Operations listed per zone when watching MIG operations
+	migOperationPageSize = 50
+)
+
+// jitter spreads an interval by up to discoveryJitter either way.
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + discoveryJitter*(2*rand.Float64()-1)))
+}
+
+// enterFastDiscovery switches to the fast discovery interval for the
+// configured window, so instances joining or leaving are picked up within
+// seconds rather than a full interval. The caller holds c.mu.
+func (c *Controller) enterFastDiscovery(reason string) {
+	if c.config.DiscoveryFastWindow <= 0 {
+		return
+	}
+	if time.Now().After(c.discoveryFastUntil) {
+		log.Printf("Fast endpoint discovery for %s: %s", c.config.DiscoveryFastWindow, reason)
+	}
+	c.discoveryFastUntil = time.Now().Add(c.config.DiscoveryFastWindow)
+}
+
+// nextDiscoveryInterval is the jittered time until the next discovery:
+// the fast interval shortly after a change, the normal interval otherwise.
+func (c *Controller) nextDiscoveryInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	interval := c.config.DiscoveryInterval
+	if time.Now().Before(c.discoveryFastUntil) {
+		interval = c.config.DiscoveryFastInterval
+	}
+	return jitter(interval)
+}
+
+// membership fingerprints the discovered endpoints of every cluster,
+// independent of the order the sources returned them in.
+func membership(endpoints map[string][]Endpoint) string {
+	var members []string
+	for name, clusterEndpoints := range endpoints {
+		for _, ep := range clusterEndpoints {
+			members = append(members, fmt.Sprintf("%s/%s/%s:%d/%t", name, ep.Instance, ep.Address, ep.Port, ep.Healthy))
+		}
+	}
+	sort.Strings(members)
+	return strings.Join(members, ",")
+}
+
+// migZones groups the configured MIG names by zone. The caller holds c.mu.
+func (c *Controller) migZones() map[string][]string {
+	zones := make(map[string][]string)
+	for _, spec := range c.clusters {
+		for _, mig := range spec.MIGs {
+			zones[mig.Zone] = append(zones[mig.Zone], mig.Name)
+		}
+	}
+	return zones
+}
+
+// watchMIGOperations polls the zone operations targeting the configured
+// MIGs (resizes, recreations, autoscaler actions) and rediscovers as soon
+// as one starts or finishes. A single filtered list per zone is far
+// cheaper than discovery itself, which reads every instance. Only the
+// leader watches.
+func (c *Controller) watchMIGOperations(ctx context.Context) {
+	// Operation name to last seen status; nil until the first listing, which
+	// only records what is already there
+	var seen map[string]string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(c.config.DiscoveryFastInterval)):
+		}
+
+		c.mu.RLock()
+		leader := c.isLeader()
+		zones := c.migZones()
+		c.mu.RUnlock()
+		if !leader || len(zones) == 0 || c.computeSvc == nil {
+			seen = nil
+			continue
+		}
+
+		current := make(map[string]string)
+		var changed []string
+		failed := false
+		for zone, migs := range zones {
+			for i, mig := range migs {
+				migs[i] = regexp.QuoteMeta(mig)
+			}
+			filter := fmt.Sprintf(`targetLink eq ".*/instanceGroupManagers/(%s)"`, strings.Join(migs, "|"))
+			ops, err := c.computeSvc.ZoneOperations.List(c.config.ProjectID, zone).
+				Filter(filter).OrderBy("creationTimestamp desc").MaxResults(migOperationPageSize).
+				Context(ctx).Do()
+			if err != nil {
+				log.Printf("Failed to list MIG operations in %s: %v", zone, err)
+				failed = true
+				continue
+			}
+			for _, op := range ops.Items {
+				current[op.Name] = op.Status
+				if seen != nil && seen[op.Name] != op.Status {
+					changed = append(changed, fmt.Sprintf("%s %s", op.OperationType, strings.ToLower(op.Status)))
+				}
+			}
+		}
+		if failed && seen != nil {
+			// Keep the last listing so a transient error does not hide changes
+			continue
+		}
+		seen = current
+
+		if len(changed) > 0 {
+			c.mu.Lock()
+			c.enterFastDiscovery("MIG operation " + strings.Join(changed, ", "))
+			c.mu.Unlock()
+			c.triggerUpdate()
+		}
+	}
+}
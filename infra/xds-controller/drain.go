@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+)
+
+const (
+	drainedWeight     = 1 // Envoy rejects zero weights; drained hosts are also marked DRAINING
+	envoyAdminTimeout = 3 * time.Second
+)
+
+// drain takes one instance out of rotation: its weight ramps down over
+// the grace period, then it is held out until HoldUntil.
+type drain struct {
+	Instance  string    `json:"instance"`
+	Weight    *ramp     `json:"weight"`
+	HoldUntil time.Time `json:"hold_until"`
+
+	// Active connections from all reachable Envoys once the weight is
+	// zero, -1 until measured
+	Connections int       `json:"connections"`
+	DrainedAt   time.Time `json:"drained_at,omitempty"`
+
+	// settled is set once a snapshot with the final weight was pushed
+	settled bool
+}
+
+// matches reports whether the drain applies to an endpoint, by instance
+// name or address.
+func (d *drain) matches(ep Endpoint) bool {
+	return d.Instance == ep.Instance || d.Instance == ep.Address
+}
+
+// weightFactor is the fraction of normal weight the endpoint keeps.
+func (d *drain) weightFactor(now time.Time) float64 {
+	return d.Weight.value(now) / 100
+}
+
+// drainFor returns the drain of an endpoint, if any. The caller holds c.mu.
+func (c *Controller) drainFor(ep Endpoint) *drain {
+	for _, d := range c.drains {
+		if d.matches(ep) {
+			return d
+		}
+	}
+	return nil
+}
+
+// applyDrain lowers the weight of a draining endpoint and marks it
+// DRAINING once out of rotation, so Envoy stops sending new requests while
+// in-flight ones complete. The caller holds c.mu.
+func (c *Controller) applyDrain(ep Endpoint, weight uint32) (uint32, core.HealthStatus) {
+	d := c.drainFor(ep)
+	if d == nil {
+		return weight, core.HealthStatus_UNKNOWN
+	}
+	factor := d.weightFactor(time.Now())
+	if factor <= 0 {
+		return drainedWeight, core.HealthStatus_DRAINING
+	}
+	scaled := uint32(float64(weight) * factor)
+	if scaled < drainedWeight {
+		scaled = drainedWeight
+	}
+	return scaled, core.HealthStatus_UNKNOWN
+}
+
+// envoyPeers tracks the addresses of Envoys holding an xDS stream, whose
+// admin endpoints report per-host connection counts.
+type envoyPeers struct {
+	mu    sync.RWMutex
+	peers map[int64]string
+}
+
+func newEnvoyPeers() *envoyPeers {
+	return &envoyPeers{peers: make(map[int64]string)}
+}
+
+// callbacks records stream peers for the xDS server.
+func (p *envoyPeers) callbacks() xds.Callbacks {
+	return xds.CallbackFuncs{
+		StreamOpenFunc: func(ctx context.Context, id int64, _ string) error {
+			if pr, ok := peer.FromContext(ctx); ok {
+				if host, _, err := net.SplitHostPort(pr.Addr.String()); err == nil {
+					p.mu.Lock()
+					p.peers[id] = host
+					p.mu.Unlock()
+				}
+			}
+			return nil
+		},
+		StreamClosedFunc: func(id int64, _ *core.Node) {
+			p.mu.Lock()
+			delete(p.peers, id)
+			p.mu.Unlock()
+		},
+	}
+}
+
+// Addresses returns the distinct Envoy addresses.
+func (p *envoyPeers) Addresses() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, address := range p.peers {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// envoyClusterStatus is the subset of the Envoy admin /clusters?format=json
+// output needed to count connections per upstream host.
+type envoyClusterStatus struct {
+	ClusterStatuses []struct {
+		Name         string `json:"name"`
+		HostStatuses []struct {
+			Address struct {
+				SocketAddress struct {
+					Address string `json:"address"`
+				} `json:"socket_address"`
+			} `json:"address"`
+			Stats []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"stats"`
+			HealthStatus map[string]interface{} `json:"health_status"`
+		} `json:"host_statuses"`
+	} `json:"cluster_statuses"`
+}
+
+// envoyClusters fetches the upstream host status from an Envoy's admin
+// endpoint.
+func (c *Controller) envoyClusters(ctx context.Context, client *http.Client, envoy string) (*envoyClusterStatus, error) {
+	url := fmt.Sprintf("http://%s/clusters?format=json", net.JoinHostPort(envoy, strconv.Itoa(c.config.EnvoyAdminPort)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query admin: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var status envoyClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode clusters: %w", err)
+	}
+	return &status, nil
+}
+
+// activeConnections sums cx_active towards the given addresses over every
+// reachable Envoy. It returns -1 when no Envoy could be asked.
+func (c *Controller) activeConnections(ctx context.Context, addresses map[string]bool) int {
+	client := &http.Client{Timeout: envoyAdminTimeout}
+	total, reached := 0, 0
+	for _, envoy := range c.envoyPeers.Addresses() {
+		status, err := c.envoyClusters(ctx, client, envoy)
+		if err != nil {
+			log.Printf("Skipping Envoy %s: %v", envoy, err)
+			continue
+		}
+		reached++
+
+		for _, cluster := range status.ClusterStatuses {
+			for _, host := range cluster.HostStatuses {
+				if !addresses[host.Address.SocketAddress.Address] {
+					continue
+				}
+				for _, stat := range host.Stats {
+					if stat.Name == "cx_active" {
+						n, _ := strconv.Atoi(stat.Value)
+						total += n
+					}
+				}
+			}
+		}
+	}
+	if reached == 0 {
+		return -1
+	}
+	return total
+}
+
+// drainLoop steps weight ramps, measures remaining connections of drained
+// instances and returns instances to rotation when their hold expires.
+// Only the leader acts; standbys follow the published drains.
+func (c *Controller) drainLoop(ctx context.Context) {
+	ticker := time.NewTicker(rampStepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.RLock()
+		active := len(c.drains) > 0 && c.isLeader()
+		c.mu.RUnlock()
+		if !active {
+			continue
+		}
+		c.stepDrains(ctx)
+	}
+}
+
+func (c *Controller) stepDrains(ctx context.Context) {
+	now := time.Now()
+
+	// Find drained instances whose connections still need counting,
+	// without holding the lock over the admin requests
+	c.mu.RLock()
+	pending := make(map[string]map[string]bool)
+	for name, d := range c.drains {
+		if d.weightFactor(now) > 0 || !d.DrainedAt.IsZero() {
+			continue
+		}
+		addresses := make(map[string]bool)
+		for _, endpoints := range c.endpoints {
+			for _, ep := range endpoints {
+				if d.matches(ep) {
+					addresses[ep.Address] = true
+				}
+			}
+		}
+		pending[name] = addresses
+	}
+	c.mu.RUnlock()
+
+	counts := make(map[string]int, len(pending))
+	for name, addresses := range pending {
+		counts[name] = c.activeConnections(ctx, addresses)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := false
+	for name, d := range c.drains {
+		if now.After(d.HoldUntil) {
+			delete(c.drains, name)
+			log.Printf("Drain of %s expired, returning it to rotation", name)
+			changed = true
+			continue
+		}
+		if !d.settled {
+			changed = true
+			d.settled = d.Weight.done(now)
+		}
+		if n, ok := counts[name]; ok {
+			d.Connections = n
+			if n == 0 {
+				d.DrainedAt = now.UTC()
+				log.Printf("Instance %s drained: no active connections", name)
+			}
+		}
+	}
+	if changed {
+		c.reapplySnapshot()
+	} else if len(counts) > 0 {
+		c.publishState(ctx)
+	}
+}
+
+// handleDrain serves /drain/ (GET lists drains) and /drain/{instance}:
+// POST ?grace=<d>&hold=<d> ramps the instance's weight to zero over the
+// grace period and holds it out of rotation, GET reports its progress and
+// DELETE returns it to rotation. The instance is a name or an address.
+func (c *Controller) handleDrain(w http.ResponseWriter, r *http.Request) {
+	instance := strings.TrimPrefix(r.URL.Path, "/drain/")
+
+	switch {
+	case instance == "" && r.Method == http.MethodGet:
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		writeJSON(w, c.drains)
+		return
+	case instance == "":
+		http.Error(w, "Missing instance", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !c.requireLeader(w) {
+			return
+		}
+		var grace time.Duration
+		if g := r.URL.Query().Get("grace"); g != "" {
+			var err error
+			if grace, err = time.ParseDuration(g); err != nil || grace < 0 {
+				http.Error(w, "Invalid grace duration", http.StatusBadRequest)
+				return
+			}
+		}
+		hold := c.config.DrainHold
+		if h := r.URL.Query().Get("hold"); h != "" {
+			var err error
+			if hold, err = time.ParseDuration(h); err != nil || hold <= 0 {
+				http.Error(w, "Invalid hold duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c.mu.Lock()
+		d := &drain{Instance: instance, Connections: -1}
+		known := false
+		for _, endpoints := range c.endpoints {
+			for _, ep := range endpoints {
+				known = known || d.matches(ep)
+			}
+		}
+		if !known {
+			c.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Instance %s not found in any cluster", instance), http.StatusNotFound)
+			return
+		}
+		now := time.Now().UTC()
+		d.Weight = &ramp{From: 100, To: 0, Start: now, Duration: grace}
+		d.HoldUntil = now.Add(grace + hold)
+		c.drains[instance] = d
+		c.reapplySnapshot()
+		c.mu.Unlock()
+		log.Printf("Draining %s over %s, held out until %s", instance, grace, d.HoldUntil.Format(time.RFC3339))
+	case http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		c.mu.Lock()
+		_, ok := c.drains[instance]
+		delete(c.drains, instance)
+		if ok {
+			c.reapplySnapshot()
+		}
+		c.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("Instance %s is not draining", instance), http.StatusNotFound)
+			return
+		}
+		log.Printf("Returned %s to rotation", instance)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	d, ok := c.drains[instance]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Instance %s is not draining", instance), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, d)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// endpointLoadBalancing is the EDS weight and health status of an
+// endpoint: unhealthy endpoints get no weight, draining ones a reduced
+// weight, and endpoints in a failed zone are marked UNHEALTHY. The caller
+// holds c.mu.
+func (c *Controller) endpointLoadBalancing(ep Endpoint, now time.Time) (uint32, core.HealthStatus) {
+	weight := ep.baseWeight()
+	if !ep.Healthy {
+		weight = 0 // Drain unhealthy endpoints
+	}
+	weight, healthStatus := c.applyDrain(ep, weight)
+	return weight, c.endpointHealth(ep, healthStatus, now)
+}
+
+// endpointStatus is one discovered endpoint as served by /endpoints, with
+// what the controller tells Envoy about it and why.
+type endpointStatus struct {
+	Endpoint
+	Weight       uint32 `json:"weight"`
+	HealthStatus string `json:"health_status"`
+	Priority     *int   `json:"priority,omitempty"`
+	Receiving    bool   `json:"receiving"`
+	Reason       string `json:"reason,omitempty"`
+
+	// Host health flags seen by each Envoy, keyed on the Envoy address
+	Envoys map[string]string `json:"envoys,omitempty"`
+}
+
+// endpointReason explains why an endpoint gets no or reduced traffic. The
+// caller holds c.mu.
+func (c *Controller) endpointReason(ep Endpoint, now time.Time) string {
+	switch {
+	case c.zoneFailed(ep.Zone, now):
+		return fmt.Sprintf("simulated loss of zone %s until %s", ep.Zone, c.failedZones[ep.Zone].Format(time.RFC3339))
+	case !ep.Healthy:
+		return fmt.Sprintf("unhealthy at discovery (%s)", ep.Probe)
+	}
+	if d := c.drainFor(ep); d != nil {
+		if d.weightFactor(now) <= 0 {
+			return fmt.Sprintf("drained until %s", d.HoldUntil.Format(time.RFC3339))
+		}
+		return "draining"
+	}
+	return ""
+}
+
+// envoyHostHealth summarises an Envoy's health_status of an upstream
+// host: the failed checks that exclude it, or its EDS health status.
+func envoyHostHealth(status map[string]interface{}) string {
+	var flags []string
+	for flag, value := range status {
+		if set, ok := value.(bool); ok && set {
+			flags = append(flags, flag)
+		}
+	}
+	if len(flags) > 0 {
+		sort.Strings(flags)
+		return strings.Join(flags, ",")
+	}
+	if eds, ok := status["eds_health_status"].(string); ok {
+		return strings.ToLower(eds)
+	}
+	return "unknown"
+}
+
+// envoyHostHealths asks every connected Envoy how it sees its upstream
+// hosts, keyed on cluster, host address and Envoy address.
+func (c *Controller) envoyHostHealths(ctx context.Context) map[string]map[string]map[string]string {
+	client := &http.Client{Timeout: envoyAdminTimeout}
+	healths := make(map[string]map[string]map[string]string)
+	for _, envoy := range c.envoyPeers.Addresses() {
+		status, err := c.envoyClusters(ctx, client, envoy)
+		if err != nil {
+			continue
+		}
+		for _, cl := range status.ClusterStatuses {
+			hosts, ok := healths[cl.Name]
+			if !ok {
+				hosts = make(map[string]map[string]string)
+				healths[cl.Name] = hosts
+			}
+			for _, host := range cl.HostStatuses {
+				address := host.Address.SocketAddress.Address
+				if hosts[address] == nil {
+					hosts[address] = make(map[string]string)
+				}
+				hosts[address][envoy] = envoyHostHealth(host.HealthStatus)
+			}
+		}
+	}
+	return healths
+}
+
+// handleEndpoints serves GET /endpoints: the discovered endpoints of every
+// cluster with their probe result, the weight and health status sent to
+// Envoy and the reason an endpoint gets no traffic. ?cluster= and
+// ?instance= (name or address) filter, ?zone= adds the priority an Envoy
+// in that zone uses, and ?envoy=true adds each Envoy's own view of the
+// host from its admin endpoint.
+func (c *Controller) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	clusterName, instance, zone := query.Get("cluster"), query.Get("instance"), query.Get("zone")
+
+	// Ask the Envoys before taking the lock
+	var healths map[string]map[string]map[string]string
+	if query.Get("envoy") == "true" {
+		healths = c.envoyHostHealths(r.Context())
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	result := make(map[string][]endpointStatus)
+	for _, spec := range c.clusters {
+		if clusterName != "" && spec.Name != clusterName {
+			continue
+		}
+		statuses := []endpointStatus{}
+		for _, ep := range c.endpoints[spec.Name] {
+			if instance != "" && ep.Instance != instance && ep.Address != instance {
+				continue
+			}
+			weight, healthStatus := c.endpointLoadBalancing(ep, now)
+			status := endpointStatus{
+				Endpoint:     ep,
+				Weight:       weight,
+				HealthStatus: healthStatus.String(),
+				Reason:       c.endpointReason(ep, now),
+				Envoys:       healths[spec.Name][ep.Address],
+			}
+			status.Receiving = status.Reason == "" || (weight > 0 && healthStatus == core.HealthStatus_UNKNOWN)
+			if zone != "" {
+				priority := int(c.localityPriority(ep.Zone, zone))
+				status.Priority = &priority
+			}
+			statuses = append(statuses, status)
+		}
+		result[spec.Name] = statuses
+	}
+	if clusterName != "" && len(result) == 0 {
+		http.Error(w, fmt.Sprintf("Cluster %s not found", clusterName), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
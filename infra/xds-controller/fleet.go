@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+const (
+	fleetPushTimeout    = 5 * time.Second
+	fleetPushRetryDelay = 10 * time.Second
+)
+
+// Fleet is the set of endpoints of a cluster currently receiving traffic,
+// published to the load generator control plane so scenarios can target a
+// fleet by name instead of instance addresses.
+type Fleet struct {
+	Name      string          `json:"name"`
+	Cluster   string          `json:"cluster"`
+	Endpoints []FleetEndpoint `json:"endpoints"`
+	Version   int64           `json:"version"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Source    string          `json:"source"`
+}
+
+// FleetEndpoint is one member of a fleet.
+type FleetEndpoint struct {
+	Instance string `json:"instance,omitempty"`
+	Address  string `json:"address"`
+	Port     uint32 `json:"port"`
+	Zone     string `json:"zone,omitempty"`
+}
+
+// fleetName names a cluster's fleet by its role, so scenarios can refer
+// to "collector" whatever the cluster is called, or by the cluster name
+// for clusters without a role.
+func fleetName(spec *ClusterSpec) string {
+	if spec.Role != "" {
+		return spec.Role
+	}
+	return spec.Name
+}
+
+// fleets builds the fleets from the last applied endpoints, leaving out
+// unhealthy, draining and failed-zone endpoints. The caller holds c.mu.
+func (c *Controller) fleets() map[string]*Fleet {
+	now := time.Now()
+	fleets := make(map[string]*Fleet, len(c.clusters))
+	for i := range c.clusters {
+		spec := &c.clusters[i]
+		fleet := &Fleet{
+			Name:      fleetName(spec),
+			Cluster:   spec.Name,
+			Endpoints: []FleetEndpoint{},
+			Version:   c.version,
+			UpdatedAt: now.UTC(),
+			Source:    c.config.Identity,
+		}
+		for _, ep := range c.endpoints[spec.Name] {
+			weight, healthStatus := c.endpointLoadBalancing(ep, now)
+			if !ep.Healthy || weight == 0 || healthStatus != core.HealthStatus_UNKNOWN {
+				continue
+			}
+			fleet.Endpoints = append(fleet.Endpoints, FleetEndpoint{
+				Instance: ep.Instance,
+				Address:  ep.Address,
+				Port:     ep.Port,
+				Zone:     ep.Zone,
+			})
+		}
+		fleets[fleet.Name] = fleet
+	}
+	return fleets
+}
+
+// fleetMembers fingerprints a fleet's membership, ignoring its version.
+func fleetMembers(fleet *Fleet) string {
+	members := make([]string, 0, len(fleet.Endpoints))
+	for _, ep := range fleet.Endpoints {
+		members = append(members, fmt.Sprintf("%s:%d", ep.Address, ep.Port))
+	}
+	return fleet.Cluster + "=" + strings.Join(members, ",")
+}
+
+// fleetPusher sends changed fleets to the control plane in the
+// background, so a slow or unavailable control plane never delays
+// snapshots. Only the latest version of each fleet is kept; failed pushes
+// are retried.
+type fleetPusher struct {
+	baseURL string
+	client  *http.Client
+
+	mu        sync.Mutex
+	pending   map[string]*Fleet
+	published map[string]string
+	wake      chan struct{}
+}
+
+func newFleetPusher(baseURL string) *fleetPusher {
+	return &fleetPusher{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		client:    &http.Client{Timeout: fleetPushTimeout},
+		pending:   make(map[string]*Fleet),
+		published: make(map[string]string),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Update queues the fleets whose membership differs from what was last
+// published.
+func (p *fleetPusher) Update(fleets map[string]*Fleet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := false
+	for name, fleet := range fleets {
+		if p.published[name] == fleetMembers(fleet) {
+			delete(p.pending, name)
+			continue
+		}
+		p.pending[name] = fleet
+		changed = true
+	}
+	if changed {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *fleetPusher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		}
+
+		for {
+			p.mu.Lock()
+			pending := p.pending
+			p.pending = make(map[string]*Fleet)
+			p.mu.Unlock()
+
+			failed := false
+			for name, fleet := range pending {
+				if err := p.push(ctx, fleet); err != nil {
+					log.Printf("Failed to publish fleet %s: %v", name, err)
+					failed = true
+					p.mu.Lock()
+					if _, newer := p.pending[name]; !newer {
+						p.pending[name] = fleet
+					}
+					p.mu.Unlock()
+					continue
+				}
+				p.mu.Lock()
+				p.published[name] = fleetMembers(fleet)
+				p.mu.Unlock()
+				log.Printf("Published fleet %s: %d endpoints", name, len(fleet.Endpoints))
+			}
+			if !failed {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(fleetPushRetryDelay):
+			}
+		}
+	}
+}
+
+// push sends one fleet with PUT {control plane}/api/v1/fleets/{name}.
+func (p *fleetPusher) push(ctx context.Context, fleet *Fleet) error {
+	body, err := json.Marshal(fleet)
+	if err != nil {
+		return fmt.Errorf("failed to encode fleet: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.baseURL+"/api/v1/fleets/"+url.PathEscape(fleet.Name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("control plane returned %s", resp.Status)
+	}
+	return nil
+}
+
+// publishFleets hands the current fleets to the pusher. Only the leader
+// publishes. The caller holds c.mu.
+func (c *Controller) publishFleets() {
+	if c.fleetPusher == nil || !c.isLeader() {
+		return
+	}
+	c.fleetPusher.Update(c.fleets())
+}
+
+// handleFleets serves GET /fleets (every fleet) and GET /fleets/{name}:
+// the endpoints currently receiving traffic, as also pushed to the control
+// plane with -control-plane-url.
+func (c *Controller) handleFleets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/fleets"), "/")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fleets := c.fleets()
+	if name == "" {
+		writeJSON(w, fleets)
+		return
+	}
+	fleet, ok := fleets[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Fleet %s not found", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, fleet)
+}
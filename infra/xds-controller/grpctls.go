@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcTLSReloadInterval bounds how often the certificate files are checked
+// for rotation, e.g. by cert-manager or a kubelet secret volume update.
+const grpcTLSReloadInterval = 30 * time.Second
+
+// grpcTLS serves the xDS listener's certificate and, with a client CA,
+// verifies Envoy client certificates and their identities. Files are
+// re-read when they change so rotation needs no restart.
+type grpcTLS struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	// Allowed client identities: URI or DNS SANs such as
+	// spiffe://loadgen/ns/loadgen/sa/envoy, with a trailing * as a prefix
+	// match. Empty allows any certificate signed by the CA.
+	identities []string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+func newGRPCTLS(cfg *Config) (*grpcTLS, error) {
+	t := &grpcTLS{
+		certFile: cfg.GRPCTLSCert,
+		keyFile:  cfg.GRPCTLSKey,
+		caFile:   cfg.GRPCClientCA,
+	}
+	for _, identity := range strings.Split(cfg.GRPCAllowedIdentities, ",") {
+		if identity = strings.TrimSpace(identity); identity != "" {
+			t.identities = append(t.identities, identity)
+		}
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	t.modTimes = t.fileModTimes()
+	t.checkedAt = time.Now()
+	return t, nil
+}
+
+// fileModTimes stats the certificate files, skipping unreadable ones.
+func (t *grpcTLS) fileModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{t.certFile, t.keyFile, t.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// load reads the certificate, key and client CA files.
+func (t *grpcTLS) load() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load gRPC certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read gRPC client CA: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in gRPC client CA %s", t.caFile)
+		}
+	}
+
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	return nil
+}
+
+// reloadIfChanged re-reads the files when any modification time changed.
+// A failed reload keeps the current certificate. The caller holds t.mu.
+func (t *grpcTLS) reloadIfChanged() {
+	if time.Since(t.checkedAt) < grpcTLSReloadInterval {
+		return
+	}
+	t.checkedAt = time.Now()
+
+	modTimes := t.fileModTimes()
+	changed := false
+	for file, modTime := range modTimes {
+		changed = changed || !modTime.Equal(t.modTimes[file])
+	}
+	if !changed {
+		return
+	}
+	t.modTimes = modTimes
+	if err := t.load(); err != nil {
+		log.Printf("Keeping current gRPC certificate: %v", err)
+		return
+	}
+	log.Printf("Loaded gRPC certificate from %s", t.certFile)
+}
+
+// certIdentities lists the DNS and URI SANs of a certificate.
+func certIdentities(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// allowed reports whether a verified client certificate carries one of the
+// allowed identities.
+func (t *grpcTLS) allowed(cert *x509.Certificate) bool {
+	if len(t.identities) == 0 {
+		return true
+	}
+	for _, name := range certIdentities(cert) {
+		for _, identity := range t.identities {
+			if prefix, ok := strings.CutSuffix(identity, "*"); ok && strings.HasPrefix(name, prefix) {
+				return true
+			}
+			if name == identity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// config returns the TLS configuration for one handshake, picking up
+// rotated files.
+func (t *grpcTLS) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reloadIfChanged()
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*t.cert},
+		NextProtos:   []string{"h2"},
+	}
+	if t.clientCAs != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = t.clientCAs
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			leaf := chains[0][0]
+			if !t.allowed(leaf) {
+				log.Printf("Rejected xDS client with identities %v", certIdentities(leaf))
+				return fmt.Errorf("client identity not allowed")
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// credentials returns gRPC server credentials using the reloading
+// configuration.
+func (t *grpcTLS) credentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: t.config,
+	})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// sharedState is everything a standby needs to serve exactly the leader's
+// snapshot and to take over capture-rate ownership without a reset.
+type sharedState struct {
+	Leader      string    `json:"leader"`
+	Version     int64     `json:"version"`
+	CaptureRate float64   `json:"capture_rate"`
+	CaptureRamp *ramp     `json:"capture_ramp,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Endpoints by cluster name
+	Endpoints map[string][]Endpoint `json:"endpoints"`
+
+	// Share of ingress sent to the canary cluster in percent, and the ramp
+	// moving it
+	CanaryWeight float64 `json:"canary_weight"`
+	SplitRamp    *ramp   `json:"split_ramp,omitempty"`
+
+	// Instances held out of rotation and simulated zone losses
+	Drains      map[string]*drain    `json:"drains,omitempty"`
+	FailedZones map[string]time.Time `json:"failed_zones,omitempty"`
+
+	// Runtime holds runtime layer keys other than capture.enabled, and
+	// RoleRuntime the overrides layered on top for Envoys of each role
+	Runtime       map[string]interface{}            `json:"runtime,omitempty"`
+	RuntimeExpiry map[string]time.Time              `json:"runtime_expiry,omitempty"`
+	RoleRuntime   map[string]map[string]interface{} `json:"role_runtime,omitempty"`
+}
+
+// StateStore persists the shared controller state.
+type StateStore interface {
+	// Load returns nil without error when no state has been saved yet.
+	Load(ctx context.Context) (*sharedState, error)
+	Save(ctx context.Context, state *sharedState) error
+}
+
+// gcsStateStore keeps the shared state in a single GCS object.
+type gcsStateStore struct {
+	bucket *storage.BucketHandle
+	object string
+}
+
+func (s *gcsStateStore) Load(ctx context.Context) (*sharedState, error) {
+	reader, err := s.bucket.Object(s.object).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state object: %w", err)
+	}
+	defer reader.Close()
+
+	var state sharedState
+	if err := json.NewDecoder(reader).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode state object: %w", err)
+	}
+	return &state, nil
+}
+
+func (s *gcsStateStore) Save(ctx context.Context, state *sharedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	writer := s.bucket.Object(s.object).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write state object: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write state object: %w", err)
+	}
+	return nil
+}
+
+// leaseRecord is the content of the leader lease object. RenewedAt is the
+// holder's clock and informational only; expiry runs from the object's
+// modification time as recorded by GCS.
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	RenewedAt time.Time `json:"renewed_at"`
+	Duration  string    `json:"duration"`
+}
+
+// gcsLease implements a leader lease on a GCS object. Every write is
+// conditional on the generation read, so two replicas can never both
+// believe they acquired or renewed it.
+type gcsLease struct {
+	bucket   *storage.BucketHandle
+	object   string
+	identity string
+	duration time.Duration
+}
+
+// tryAcquire acquires or renews the lease and returns the current holder.
+func (l *gcsLease) tryAcquire(ctx context.Context) (string, error) {
+	handle := l.bucket.Object(l.object)
+	conditions := storage.Conditions{DoesNotExist: true}
+
+	reader, err := handle.NewReader(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+	case err != nil:
+		return "", fmt.Errorf("failed to read lease: %w", err)
+	default:
+		var record leaseRecord
+		err := json.NewDecoder(reader).Decode(&record)
+		generation, renewedAt := reader.Attrs.Generation, reader.Attrs.LastModified
+		reader.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to decode lease: %w", err)
+		}
+		held, _ := time.ParseDuration(record.Duration)
+		if record.Holder != l.identity && time.Since(renewedAt) < held {
+			return record.Holder, nil
+		}
+		conditions = storage.Conditions{GenerationMatch: generation}
+	}
+
+	data, _ := json.Marshal(leaseRecord{Holder: l.identity, RenewedAt: time.Now().UTC(), Duration: l.duration.String()})
+	writer := handle.If(conditions).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return "", fmt.Errorf("failed to write lease: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			// Another replica won the race; it is the holder now
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to write lease: %w", err)
+	}
+	return l.identity, nil
+}
+
+// release gives up the lease if this replica still holds it, so a standby
+// takes over without waiting for expiry.
+func (l *gcsLease) release(ctx context.Context) {
+	handle := l.bucket.Object(l.object)
+	reader, err := handle.NewReader(ctx)
+	if err != nil {
+		return
+	}
+	var record leaseRecord
+	err = json.NewDecoder(reader).Decode(&record)
+	generation := reader.Attrs.Generation
+	reader.Close()
+	if err != nil || record.Holder != l.identity {
+		return
+	}
+	if err := handle.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx); err != nil {
+		log.Printf("Failed to release leader lease: %v", err)
+	}
+}
+
+// leaderElector runs the lease loop and reports transitions.
+type leaderElector struct {
+	lease    *gcsLease
+	onChange func(leader bool)
+
+	leader    atomic.Bool
+	mu        sync.RWMutex
+	holder    string
+	lastRenew time.Time
+}
+
+func (e *leaderElector) IsLeader() bool { return e.leader.Load() }
+
+func (e *leaderElector) Holder() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.holder
+}
+
+func (e *leaderElector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		e.tick(ctx)
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				e.lease.release(releaseCtx)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElector) tick(ctx context.Context) {
+	// The lease counts from no later than the start of the attempt, and an
+	// attempt cannot outlast the tick
+	start := time.Now()
+	attemptCtx, cancel := context.WithTimeout(ctx, e.lease.duration/3)
+	holder, err := e.lease.tryAcquire(attemptCtx)
+	cancel()
+	if err != nil {
+		log.Printf("Leader election: %v", err)
+		// Step down well before the lease can expire for the other
+		// replicas, leaving a third of it for clock drift between them
+		if e.IsLeader() && time.Since(e.lastRenew) >= e.lease.duration*2/3 {
+			e.setLeader(false, "")
+		}
+		return
+	}
+
+	leader := holder == e.lease.identity
+	if leader {
+		e.lastRenew = start
+	}
+	e.setLeader(leader, holder)
+}
+
+func (e *leaderElector) setLeader(leader bool, holder string) {
+	e.mu.Lock()
+	e.holder = holder
+	e.mu.Unlock()
+
+	if e.leader.Swap(leader) != leader {
+		if leader {
+			log.Printf("Acquired leadership as %s", e.lease.identity)
+		} else {
+			log.Printf("Lost leadership, current holder %q", holder)
+		}
+		e.onChange(leader)
+	}
+}
+
+// isLeader reports whether this replica owns discovery and the capture
+// rate. Without HA every replica does.
+func (c *Controller) isLeader() bool {
+	return c.elector == nil || c.elector.IsLeader()
+}
+
+// onLeadershipChange adopts the shared state when becoming leader, so the
+// snapshot version keeps increasing and the capture rate carries over.
+func (c *Controller) onLeadershipChange(ctx context.Context, leader bool) {
+	if leader && c.state != nil {
+		state, err := c.state.Load(ctx)
+		if err != nil {
+			log.Printf("Failed to load shared state on takeover: %v", err)
+		} else if state != nil {
+			c.mu.Lock()
+			c.adoptState(state)
+			c.startCaptureRamp()
+			c.startSplitRamp()
+			c.mu.Unlock()
+		}
+	}
+	c.triggerUpdate()
+}
+
+// adoptState takes over the runtime values and version of a saved state.
+// The version never goes backwards so Envoys always see a new snapshot.
+// The caller holds c.mu.
+func (c *Controller) adoptState(state *sharedState) {
+	if state.Version > c.version {
+		c.version = state.Version
+	}
+	c.captureRate = state.CaptureRate
+	c.captureRamp = state.CaptureRamp
+	c.canaryWeight = state.CanaryWeight
+	c.splitRamp = state.SplitRamp
+	c.runtimeValues = state.Runtime
+	if c.runtimeValues == nil {
+		c.runtimeValues = make(map[string]interface{})
+	}
+	c.runtimeExpiry = state.RuntimeExpiry
+	if c.runtimeExpiry == nil {
+		c.runtimeExpiry = make(map[string]time.Time)
+	}
+	c.roleRuntime = state.RoleRuntime
+	if c.roleRuntime == nil {
+		c.roleRuntime = make(map[string]map[string]interface{})
+	}
+	c.drains = state.Drains
+	if c.drains == nil {
+		c.drains = make(map[string]*drain)
+	}
+	c.failedZones = state.FailedZones
+	if c.failedZones == nil {
+		c.failedZones = make(map[string]time.Time)
+	}
+}
+
+// publishState shares the leader's view with the standbys and persists the
+// runtime values across restarts. The caller holds c.mu.
+func (c *Controller) publishState(ctx context.Context) {
+	if c.state == nil {
+		return
+	}
+	state := &sharedState{
+		Leader:        c.config.Identity,
+		Version:       c.version,
+		CaptureRate:   c.captureRate,
+		CaptureRamp:   c.captureRamp,
+		UpdatedAt:     time.Now().UTC(),
+		Endpoints:     c.endpoints,
+		CanaryWeight:  c.canaryWeight,
+		SplitRamp:     c.splitRamp,
+		Drains:        c.drains,
+		FailedZones:   c.failedZones,
+		Runtime:       c.runtimeValues,
+		RuntimeExpiry: c.runtimeExpiry,
+		RoleRuntime:   c.roleRuntime,
+	}
+	if err := c.state.Save(ctx, state); err != nil {
+		log.Printf("Failed to publish shared state: %v", err)
+	}
+}
+
+// syncFromState serves the leader's last published snapshot. The caller
+// holds c.mu.
+func (c *Controller) syncFromState(ctx context.Context) {
+	if c.state == nil {
+		return
+	}
+	state, err := c.state.Load(ctx)
+	if err != nil {
+		log.Printf("Failed to load shared state: %v", err)
+		return
+	}
+	if state == nil || state.Version == c.version {
+		return
+	}
+
+	c.version = state.Version
+	c.adoptState(state)
+	if err := c.applySnapshot(ctx, state.Endpoints); err != nil {
+		log.Printf("Failed to apply shared snapshot: %v", err)
+	}
+}
+
+// requireLeader rejects runtime changes on a standby, naming the leader so
+// the operator can retry there.
+func (c *Controller) requireLeader(w http.ResponseWriter) bool {
+	if c.isLeader() {
+		return true
+	}
+	holder := c.elector.Holder()
+	w.Header().Set("X-Leader", holder)
+	http.Error(w, fmt.Sprintf("Not the leader; current leader is %q", holder), http.StatusServiceUnavailable)
+	return false
+}
+
+// startLeaderElection runs the GCS lease loop and the standby sync.
+func (c *Controller) startLeaderElection(ctx context.Context, bucket *storage.BucketHandle) {
+	c.elector = &leaderElector{
+		lease: &gcsLease{
+			bucket:   bucket,
+			object:   c.config.LeaseObject,
+			identity: c.config.Identity,
+			duration: c.config.LeaseDuration,
+		},
+		onChange: func(leader bool) { c.onLeadershipChange(ctx, leader) },
+	}
+	go c.elector.run(ctx)
+	go c.standbySyncLoop(ctx)
+}
+
+// standbySyncLoop makes standbys follow the leader's state faster than the
+// discovery interval.
+func (c *Controller) standbySyncLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.config.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.isLeader() {
+				c.triggerUpdate()
+			}
+		}
+	}
+}
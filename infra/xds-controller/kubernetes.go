@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir  = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeWatchTimeout   = 5 * time.Minute
+	kubeRetryInterval  = 5 * time.Second
+	serviceNameLabel   = "kubernetes.io/service-name"
+	endpointSlicesPath = "/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices"
+)
+
+// kubeClient is a minimal Kubernetes API client using the pod's service
+// account. EndpointSlice list/watch and ConfigMap reads and writes are all
+// the controller needs, which does not justify pulling in client-go.
+type kubeClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newInClusterKubeClient(apiServer string) (*kubeClient, error) {
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a cluster and no -k8s-api-server given")
+		}
+		apiServer = "https://" + host + ":" + port
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca, err := os.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+
+	return &kubeClient{
+		baseURL: strings.TrimSuffix(apiServer, "/"),
+		token:   strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// kubeAPIError is a non-2xx response from the API server.
+type kubeAPIError struct {
+	Code   int
+	Status string
+	Path   string
+}
+
+func (e *kubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %s for %s", e.Status, e.Path)
+}
+
+func isKubeNotFound(err error) bool {
+	var apiErr *kubeAPIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func (k *kubeClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	return k.request(ctx, http.MethodGet, path, query, nil)
+}
+
+func (k *kubeClient) request(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	target := k.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &kubeAPIError{Code: resp.StatusCode, Status: resp.Status, Path: path}
+	}
+	return resp, nil
+}
+
+// EndpointSlice carries the subset of discovery.k8s.io/v1 fields the
+// controller uses.
+type EndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		Zone      string `json:"zone"`
+		NodeName  string `json:"nodeName"`
+		TargetRef *struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port *int32 `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []EndpointSlice `json:"items"`
+}
+
+type endpointSliceEvent struct {
+	Type   string        `json:"type"`
+	Object EndpointSlice `json:"object"`
+}
+
+// KubeServiceSource identifies an in-cluster service backing a cluster:
+// namespace/service, optionally with :port naming the service port.
+type KubeServiceSource struct {
+	Namespace string
+	Service   string
+	PortName  string
+}
+
+func parseKubeServiceSource(s string) (*KubeServiceSource, error) {
+	source := &KubeServiceSource{}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		source.PortName = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid kubernetes service %q, expected namespace/service[:port]", s)
+	}
+	source.Namespace, source.Service = parts[0], parts[1]
+	return source, nil
+}
+
+func (s *KubeServiceSource) String() string {
+	return s.Namespace + "/" + s.Service
+}
+
+// kubeWatcher tracks the EndpointSlices of one service with list+watch and
+// notifies the controller on every change, so in-cluster collectors and
+// capture agents (including GKE NEG-backed services, which are fronted by
+// the same EndpointSlices) are picked up without waiting for the poll.
+type kubeWatcher struct {
+	client   *kubeClient
+	source   *KubeServiceSource
+	onChange func()
+
+	mu     sync.RWMutex
+	slices map[string]EndpointSlice
+	synced bool
+}
+
+func newKubeWatcher(client *kubeClient, source *KubeServiceSource, onChange func()) *kubeWatcher {
+	return &kubeWatcher{
+		client:   client,
+		source:   source,
+		onChange: onChange,
+		slices:   make(map[string]EndpointSlice),
+	}
+}
+
+func (w *kubeWatcher) run(ctx context.Context) {
+	for {
+		err := w.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("EndpointSlice watch for %s failed: %v", w.source, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeRetryInterval):
+		}
+	}
+}
+
+func (w *kubeWatcher) listAndWatch(ctx context.Context) error {
+	path := fmt.Sprintf(endpointSlicesPath, w.source.Namespace)
+	query := url.Values{"labelSelector": {serviceNameLabel + "=" + w.source.Service}}
+
+	resp, err := w.client.get(ctx, path, query)
+	if err != nil {
+		return fmt.Errorf("failed to list endpoint slices: %w", err)
+	}
+	var list endpointSliceList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode endpoint slices: %w", err)
+	}
+
+	slices := make(map[string]EndpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	w.mu.Lock()
+	w.slices = slices
+	w.synced = true
+	w.mu.Unlock()
+	w.onChange()
+
+	query.Set("watch", "true")
+	query.Set("resourceVersion", list.Metadata.ResourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", strconv.Itoa(int(kubeWatchTimeout.Seconds())))
+
+	resp, err = w.client.get(ctx, path, query)
+	if err != nil {
+		return fmt.Errorf("failed to watch endpoint slices: %w", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event endpointSliceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("failed to decode watch event: %w", err)
+		}
+
+		w.mu.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[event.Object.Metadata.Name] = event.Object
+		case "DELETED":
+			delete(w.slices, event.Object.Metadata.Name)
+		case "ERROR":
+			// Usually 410 Gone: the resource version expired, so relist
+			w.mu.Unlock()
+			return nil
+		default:
+			w.mu.Unlock()
+			continue
+		}
+		w.mu.Unlock()
+		w.onChange()
+	}
+	return scanner.Err()
+}
+
+// Endpoints returns the current endpoints of the service. Terminating
+// endpoints are reported unhealthy so they drain.
+func (w *kubeWatcher) Endpoints() ([]Endpoint, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if !w.synced {
+		return nil, fmt.Errorf("endpoint slices for %s not synced yet", w.source)
+	}
+
+	names := make([]string, 0, len(w.slices))
+	for name := range w.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var endpoints []Endpoint
+	for _, name := range names {
+		slice := w.slices[name]
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+
+		var port uint32
+		for _, p := range slice.Ports {
+			if p.Port != nil && (w.source.PortName == "" || p.Name == w.source.PortName) {
+				port = uint32(*p.Port)
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			terminating := ep.Conditions.Terminating != nil && *ep.Conditions.Terminating
+			var instance string
+			if ep.TargetRef != nil {
+				instance = ep.TargetRef.Name
+			}
+			probe := "ready"
+			switch {
+			case terminating:
+				probe = "terminating"
+			case !ready:
+				probe = "not-ready"
+			}
+			for _, address := range ep.Addresses {
+				endpoints = append(endpoints, Endpoint{
+					Instance: instance,
+					Address:  address,
+					Port:     port,
+					Zone:     ep.Zone,
+					Healthy:  ready && !terminating,
+					Probe:    probe,
+				})
+			}
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// Locality policies for -locality-policy.
+const (
+	// Same-zone endpoints at priority 0, other zones at priority 1 for
+	// failover, localities weighted by the weight of healthy endpoints
+	localityZoneLocal = "zone-local"
+	// Every zone at priority 0, weighted by the weight of healthy endpoints
+	localityWeighted = "weighted"
+	// Every zone at priority 0 without locality weights
+	localityNone = "none"
+)
+
+func validLocalityPolicy(policy string) bool {
+	switch policy {
+	case localityZoneLocal, localityWeighted, localityNone:
+		return true
+	}
+	return false
+}
+
+// localityPriority places an endpoint zone relative to the Envoy's zone.
+// Endpoints of unknown zone are treated as local.
+func (c *Controller) localityPriority(zone, localZone string) uint32 {
+	if c.config.LocalityPolicy == localityZoneLocal && localZone != "" && zone != "" && zone != localZone {
+		return 1
+	}
+	return 0
+}
+
+// localityWeighted reports whether localities carry weights, which Envoy
+// only honours with locality-weighted load balancing on the cluster.
+func (c *Controller) localityWeighted() bool {
+	return c.config.LocalityPolicy != localityNone
+}
+
+// localityLbConfig enables locality-weighted load balancing when the
+// policy uses locality weights.
+func (c *Controller) localityLbConfig() *cluster.Cluster_CommonLbConfig {
+	if !c.localityWeighted() {
+		return nil
+	}
+	return &cluster.Cluster_CommonLbConfig{
+		LocalityConfigSpecifier: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+			LocalityWeightedLbConfig: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+		},
+	}
+}
+
+// zoneFailed reports whether a simulated zone loss is active. The caller
+// holds c.mu.
+func (c *Controller) zoneFailed(zone string, now time.Time) bool {
+	until, ok := c.failedZones[zone]
+	return ok && now.Before(until)
+}
+
+// expireFailedZones drops simulated zone losses that have ended. The
+// caller holds c.mu.
+func (c *Controller) expireFailedZones(now time.Time) {
+	for zone, until := range c.failedZones {
+		if !now.Before(until) {
+			delete(c.failedZones, zone)
+			log.Printf("Simulated loss of zone %s ended", zone)
+		}
+	}
+}
+
+// endpointHealth is the EDS health status of an endpoint: UNHEALTHY in a
+// failed zone so Envoys fail over exactly as on a real zone loss,
+// otherwise the drain status.
+func (c *Controller) endpointHealth(ep Endpoint, drainStatus core.HealthStatus, now time.Time) core.HealthStatus {
+	if c.zoneFailed(ep.Zone, now) {
+		return core.HealthStatus_UNHEALTHY
+	}
+	return drainStatus
+}
+
+// handleZoneFailure serves GET (active simulated zone losses), POST
+// ?zone=<zone>&duration=<d> which marks every endpoint in the zone
+// unhealthy for the duration, and DELETE ?zone=<zone> which ends it.
+// Losses end within one discovery interval of expiring.
+func (c *Controller) handleZoneFailure(w http.ResponseWriter, r *http.Request) {
+	zone := r.URL.Query().Get("zone")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		if zone == "" {
+			http.Error(w, "Missing zone parameter", http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		if r.Method == http.MethodPost {
+			duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+			if err != nil || duration <= 0 {
+				c.mu.Unlock()
+				http.Error(w, "duration must be a positive duration such as 10m", http.StatusBadRequest)
+				return
+			}
+			c.failedZones[zone] = time.Now().UTC().Add(duration)
+			log.Printf("Simulating loss of zone %s for %s", zone, duration)
+		} else {
+			delete(c.failedZones, zone)
+			log.Printf("Simulated loss of zone %s ended", zone)
+		}
+		c.reapplySnapshot()
+		c.mu.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	writeJSON(w, c.failedZones)
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -21,10 +22,17 @@ import (
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	alsservice "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 	runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 
 	compute "google.golang.org/api/compute/v1"
@@ -33,8 +41,8 @@ import (
 const (
 	grpcPort           = 18000
 	httpPort           = 8080
+	envoyListenerPort  = 8080
 	xdsClusterName     = "loadgen-xds-controller"
-	nodeIDPrefix       = "loadgen-envoy"
 	discoveryInterval  = 30 * time.Second
 	captureRTDSKey     = "capture.enabled"
 )
@@ -45,7 +53,68 @@ type Config struct {
 	CaptureAgentMIG  string
 	Zone             string
 	Port             int
+	ListenerPort     int
 	LogLevel         string
+
+	// Declarative cluster configuration, replacing the per-cluster flags
+	ClustersConfig string
+
+	// Kubernetes EndpointSlice discovery, used alongside or instead of MIGs
+	CollectorK8sService string
+	CaptureK8sService   string
+	KubeAPIServer       string
+
+	// Default region of AWS Auto Scaling groups in the cluster configuration
+	AWSRegion string
+
+	// Canary collector cluster receiving a weighted share of ingress
+	CanaryCollectorMIG        string
+	CanaryCollectorK8sService string
+
+	// Shared state and leader election for running several replicas
+	StateBucket    string
+	StateObject    string
+	StateConfigMap string
+	LeaderElection bool
+	LeaseObject    string
+	LeaseDuration  time.Duration
+	Identity       string
+
+	DefaultCaptureRate float64
+
+	// Adaptive endpoint discovery
+	DiscoveryInterval     time.Duration
+	DiscoveryFastInterval time.Duration
+	DiscoveryFastWindow   time.Duration
+	MIGOperationEvents    bool
+
+	// Instance draining
+	EnvoyAdminPort int
+	DrainHold      time.Duration
+
+	// Locality-aware load balancing (zone-local, weighted, none)
+	LocalityPolicy string
+
+	// Load generator control plane receiving the fleets
+	ControlPlaneURL string
+
+	// Access log receiver forwarding loadgen requests for validation
+	ALS                  bool
+	ALSFlushInterval     time.Duration
+	DivergenceMonitorURL string
+
+	// SDS certificate sources (k8s:namespace/name or gsm:projects/P/secrets/S)
+	SDSServerCert        string
+	SDSClientCert        string
+	SDSCA                string
+	SDSRequireClientCert bool
+
+	// TLS on the xDS gRPC listener, with optional client certificate and
+	// identity checks
+	GRPCTLSCert           string
+	GRPCTLSKey            string
+	GRPCClientCA          string
+	GRPCAllowedIdentities string
 }
 
 type Controller struct {
@@ -55,47 +124,245 @@ type Controller struct {
 	mu          sync.RWMutex
 	version     int64
 	captureRate float64
+
+	// Active capture-rate ramp, in percent
+	captureRamp     *ramp
+	captureRampStop chan struct{}
+
+	ctx     context.Context
+	refresh chan struct{}
+
+	// Discovery runs at the fast interval until this time, and reuses
+	// instance addresses by MIG or ASG and instance ID
+	discoveryFastUntil time.Time
+	instanceAddresses  map[string]map[uint64]string
+	asgAddresses       map[string]map[string]string
+	aws                *awsClient
+
+	// Configured clusters and the EndpointSlice watchers they use, keyed
+	// on the service
+	clusters []ClusterSpec
+	kube     *kubeClient
+	watchers map[string]*clusterWatcher
+
+	state   StateStore
+	elector *leaderElector
+
+	// Runtime layer keys besides capture.enabled with their expiry, and
+	// per-role overrides
+	runtimeValues map[string]interface{}
+	runtimeExpiry map[string]time.Time
+	roleRuntime   map[string]map[string]interface{}
+
+	// Envoy node groups, each served its own snapshot
+	nodeGroups *nodeGroupHash
+
+	// SDS sources and the last successfully fetched certificates
+	certSources map[string]certSource
+	secrets     map[string]*certBundle
+
+	// Endpoints of the last applied snapshot by cluster name
+	endpoints map[string][]Endpoint
+
+	// Instances being drained, and the Envoys asked for their connections
+	drains     map[string]*drain
+	envoyPeers *envoyPeers
+
+	// Publishes fleets to the load generator control plane
+	fleetPusher *fleetPusher
+
+	// Receives the access logs of loadgen requests
+	als *alsReceiver
+
+	// Zones whose endpoints are marked unhealthy until the given time, to
+	// exercise failover
+	failedZones map[string]time.Time
+
+	// Share of ingress sent to the canary collectors, in percent
+	canaryWeight  float64
+	splitRamp     *ramp
+	splitRampStop chan struct{}
 }
 
 func main() {
 	var cfg Config
 	flag.StringVar(&cfg.ProjectID, "project", "", "GCP Project ID")
-	flag.StringVar(&cfg.CollectorMIG, "collector-mig", "", "Collector MIG name")
-	flag.StringVar(&cfg.CaptureAgentMIG, "capture-mig", "", "Capture Agent MIG name")
+	flag.StringVar(&cfg.CollectorMIG, "collector-mig", "", "Collector MIGs, comma-separated name[@zone][=weight] (weight is per instance, default 100)")
+	flag.StringVar(&cfg.CaptureAgentMIG, "capture-mig", "", "Capture Agent MIGs, comma-separated name[@zone][=weight]")
 	flag.StringVar(&cfg.Zone, "zone", "", "GCP Zone")
 	flag.IntVar(&cfg.Port, "port", grpcPort, "gRPC port")
+	flag.IntVar(&cfg.ListenerPort, "listener-port", envoyListenerPort, "Port of the generated Envoy ingress listener")
 	flag.StringVar(&cfg.LogLevel, "log-level", "info", "Log level")
+	flag.StringVar(&cfg.ClustersConfig, "clusters-config", "", "YAML file declaring the clusters, their discovery sources, ports and health checks (reloaded on change; replaces the per-cluster flags)")
+	flag.StringVar(&cfg.CollectorK8sService, "collector-k8s-service", "", "Kubernetes service (namespace/service[:port]) whose EndpointSlices back the collector cluster")
+	flag.StringVar(&cfg.CaptureK8sService, "capture-k8s-service", "", "Kubernetes service (namespace/service[:port]) whose EndpointSlices back the capture cluster")
+	flag.StringVar(&cfg.CanaryCollectorMIG, "canary-collector-mig", "", "MIGs backing the canary collector cluster for weighted traffic splitting, comma-separated name[@zone][=weight]")
+	flag.StringVar(&cfg.CanaryCollectorK8sService, "canary-collector-k8s-service", "", "Kubernetes service (namespace/service[:port]) backing the canary collector cluster")
+	flag.StringVar(&cfg.KubeAPIServer, "k8s-api-server", "", "Kubernetes API server URL (defaults to the in-cluster service)")
+	flag.StringVar(&cfg.AWSRegion, "aws-region", os.Getenv("AWS_REGION"), "Default region of the aws_asgs in -clusters-config (defaults to $AWS_REGION)")
+	flag.StringVar(&cfg.StateBucket, "state-bucket", "", "GCS bucket holding shared controller state (enables state sharing)")
+	flag.StringVar(&cfg.StateObject, "state-object", "xds-controller/state.json", "Object holding the shared snapshot inputs and runtime values")
+	flag.BoolVar(&cfg.LeaderElection, "leader-election", false, "Elect a single leader among replicas; standbys serve the leader's snapshot")
+	flag.StringVar(&cfg.StateConfigMap, "state-configmap", "", "Kubernetes ConfigMap (namespace/name) persisting runtime values, as an alternative to -state-bucket")
+	flag.Float64Var(&cfg.DefaultCaptureRate, "default-capture-rate", 0, "Capture rate percentage used when no saved runtime state exists")
+	flag.StringVar(&cfg.SDSServerCert, "sds-server-cert", "", "Source of the Envoy ingress certificate served over SDS (k8s:namespace/name or gsm:projects/P/secrets/S)")
+	flag.StringVar(&cfg.SDSClientCert, "sds-client-cert", "", "Source of the client certificate Envoys present to collectors and capture agents")
+	flag.StringVar(&cfg.SDSCA, "sds-ca", "", "Source of the CA bundle used to validate upstream and client certificates")
+	flag.BoolVar(&cfg.SDSRequireClientCert, "sds-require-client-cert", false, "Require client certificates on the ingress listener (needs -sds-ca)")
+	flag.DurationVar(&cfg.DiscoveryInterval, "discovery-interval", discoveryInterval, "Endpoint discovery interval")
+	flag.DurationVar(&cfg.DiscoveryFastInterval, "discovery-fast-interval", 5*time.Second, "Discovery interval after a membership change or while a MIG is changing instances")
+	flag.DurationVar(&cfg.DiscoveryFastWindow, "discovery-fast-window", 2*time.Minute, "How long discovery stays fast after a change (0 disables adaptive discovery)")
+	flag.BoolVar(&cfg.MIGOperationEvents, "mig-operation-events", false, "Watch Compute operations on the MIGs and rediscover as soon as one starts or finishes")
+	flag.StringVar(&cfg.GRPCTLSCert, "grpc-tls-cert", "", "Certificate file served on the xDS gRPC listener (enables TLS; re-read on change)")
+	flag.StringVar(&cfg.GRPCTLSKey, "grpc-tls-key", "", "Private key file for -grpc-tls-cert")
+	flag.StringVar(&cfg.GRPCClientCA, "grpc-client-ca", "", "CA bundle file; when set, Envoys must present a client certificate it signed")
+	flag.StringVar(&cfg.GRPCAllowedIdentities, "grpc-allowed-identities", "", "Comma-separated URI or DNS SANs allowed to connect, e.g. spiffe://loadgen/ns/loadgen/sa/envoy; a trailing * matches a prefix")
+	flag.IntVar(&cfg.EnvoyAdminPort, "envoy-admin-port", 9901, "Envoy admin port, queried for connection counts of draining instances")
+	flag.DurationVar(&cfg.DrainHold, "drain-hold", 15*time.Minute, "Default time a drained instance is held out of rotation")
+	flag.StringVar(&cfg.LocalityPolicy, "locality-policy", localityZoneLocal, "Locality load balancing: zone-local (same zone first, cross-zone failover), weighted (all zones by healthy weight) or none")
+	flag.StringVar(&cfg.ControlPlaneURL, "control-plane-url", "", "Load generator control plane URL to publish fleets (endpoints receiving traffic per cluster role) to, e.g. http://loadgen-control-plane:8080")
+	flag.BoolVar(&cfg.ALS, "als", false, "Have Envoys ship access logs of loadgen requests to this controller over ALS and forward them to -divergence-monitor-url and -control-plane-url")
+	flag.DurationVar(&cfg.ALSFlushInterval, "als-flush-interval", 10*time.Second, "Interval at which received access logs are summarised and forwarded")
+	flag.StringVar(&cfg.DivergenceMonitorURL, "divergence-monitor-url", "", "Divergence monitor URL receiving request samples, e.g. http://divergence-monitor:9101")
+	flag.StringVar(&cfg.LeaseObject, "lease-object", "xds-controller/leader.json", "Object used as the leader lease")
+	flag.DurationVar(&cfg.LeaseDuration, "lease-duration", 15*time.Second, "Leader lease duration")
+	flag.StringVar(&cfg.Identity, "identity", "", "Replica identity for leader election (defaults to the hostname)")
 	flag.Parse()
 
-	if cfg.ProjectID == "" || cfg.CollectorMIG == "" || cfg.CaptureAgentMIG == "" || cfg.Zone == "" {
-		log.Fatal("Missing required flags: -project, -collector-mig, -capture-mig, -zone")
+	if cfg.LeaderElection && cfg.StateBucket == "" {
+		log.Fatal("-leader-election requires -state-bucket")
+	}
+	if cfg.DefaultCaptureRate < 0 || cfg.DefaultCaptureRate > 100 {
+		log.Fatal("-default-capture-rate must be between 0 and 100")
+	}
+	if cfg.Identity == "" {
+		cfg.Identity, _ = os.Hostname()
+	}
+	if cfg.DiscoveryInterval <= 0 || cfg.DiscoveryFastInterval <= 0 {
+		log.Fatal("-discovery-interval and -discovery-fast-interval must be positive")
+	}
+	if cfg.ALS && cfg.ALSFlushInterval <= 0 {
+		log.Fatal("-als-flush-interval must be positive")
+	}
+	if (cfg.GRPCTLSCert == "") != (cfg.GRPCTLSKey == "") {
+		log.Fatal("-grpc-tls-cert and -grpc-tls-key must be set together")
+	}
+	if cfg.GRPCClientCA != "" && cfg.GRPCTLSCert == "" {
+		log.Fatal("-grpc-client-ca requires -grpc-tls-cert")
+	}
+	if cfg.GRPCAllowedIdentities != "" && cfg.GRPCClientCA == "" {
+		log.Fatal("-grpc-allowed-identities requires -grpc-client-ca")
+	}
+	if !validLocalityPolicy(cfg.LocalityPolicy) {
+		log.Fatalf("Invalid -locality-policy %q", cfg.LocalityPolicy)
+	}
+
+	// Load cluster configuration
+	var clusterConfig *ClusterConfig
+	var clusterConfigData []byte
+	if cfg.ClustersConfig != "" {
+		data, err := os.ReadFile(cfg.ClustersConfig)
+		if err != nil {
+			log.Fatalf("Failed to read cluster config: %v", err)
+		}
+		if clusterConfig, err = parseClusterConfig(data, &cfg); err != nil {
+			log.Fatal(err)
+		}
+		clusterConfigData = data
+	} else {
+		if cfg.CollectorMIG == "" && cfg.CollectorK8sService == "" {
+			log.Fatal("Missing required flag: -collector-mig or -collector-k8s-service")
+		}
+		if cfg.CaptureAgentMIG == "" && cfg.CaptureK8sService == "" {
+			log.Fatal("Missing required flag: -capture-mig or -capture-k8s-service")
+		}
+		var err error
+		if clusterConfig, err = flagClusterConfig(&cfg); err != nil {
+			log.Fatalf("Invalid cluster flags: %v", err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Initialize compute service
-	computeSvc, err := compute.NewService(ctx)
+	// Create controller
+	controller := &Controller{
+		ctx:               ctx,
+		config:            &cfg,
+		refresh:           make(chan struct{}, 1),
+		runtimeValues:     make(map[string]interface{}),
+		runtimeExpiry:     make(map[string]time.Time),
+		roleRuntime:       make(map[string]map[string]interface{}),
+		secrets:           make(map[string]*certBundle),
+		watchers:          make(map[string]*clusterWatcher),
+		instanceAddresses: make(map[string]map[uint64]string),
+		asgAddresses:      make(map[string]map[string]string),
+		endpoints:         make(map[string][]Endpoint),
+		drains:            make(map[string]*drain),
+		envoyPeers:        newEnvoyPeers(),
+		failedZones:       make(map[string]time.Time),
+	}
+	controller.nodeGroups = newNodeGroupHash(func(group nodeGroup) { go controller.serveNewGroup(group) })
+	controller.cache = cache.NewSnapshotCache(false, controller.nodeGroups, nil)
+
+	// Publish fleets to the load generator control plane
+	if cfg.ControlPlaneURL != "" {
+		controller.fleetPusher = newFleetPusher(cfg.ControlPlaneURL)
+		go controller.fleetPusher.run(ctx)
+	}
+	if cfg.ALS {
+		controller.als = newALSReceiver(&cfg)
+		go controller.als.run(ctx, cfg.ALSFlushInterval)
+	}
+
+	certSources, err := controller.secretSources(ctx)
 	if err != nil {
-		log.Fatalf("Failed to create compute service: %v", err)
+		log.Fatalf("Failed to configure SDS: %v", err)
 	}
+	controller.certSources = certSources
 
-	// Create controller
-	controller := &Controller{
-		config:      &cfg,
-		cache:       cache.NewSnapshotCache(false, cache.IDHash{}, nil),
-		computeSvc:  computeSvc,
-		captureRate: 0.0, // Start with capture disabled
+	// Initialize compute service and EndpointSlice watchers
+	if err := controller.setClusters(ctx, clusterConfig); err != nil {
+		log.Fatalf("Failed to configure clusters: %v", err)
 	}
+	if cfg.ClustersConfig != "" {
+		go controller.watchClusterConfig(ctx, clusterConfigData)
+	}
+
+	// Restore persisted runtime state and start leader election
+	if err := controller.openStateStore(ctx); err != nil {
+		log.Fatalf("Failed to open state store: %v", err)
+	}
+	controller.restoreState(ctx)
 
-	// Start discovery loop
+	// Start discovery and drain loops
 	go controller.discoveryLoop(ctx)
+	if cfg.MIGOperationEvents {
+		go controller.watchMIGOperations(ctx)
+	}
+	go controller.drainLoop(ctx)
 
 	// Start gRPC server
-	server := xds.NewServer(ctx, controller.cache, nil)
-	grpcServer := grpc.NewServer()
+	server := xds.NewServer(ctx, controller.cache, controller.envoyPeers.callbacks())
+	var grpcOptions []grpc.ServerOption
+	if cfg.GRPCTLSCert != "" {
+		grpcTLS, err := newGRPCTLS(&cfg)
+		if err != nil {
+			log.Fatalf("Failed to configure gRPC TLS: %v", err)
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(grpcTLS.credentials()))
+	}
+	grpcServer := grpc.NewServer(grpcOptions...)
 	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, server)
+	listenerservice.RegisterListenerDiscoveryServiceServer(grpcServer, server)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, server)
+	routeservice.RegisterRouteDiscoveryServiceServer(grpcServer, server)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, server)
 	runtime.RegisterRuntimeDiscoveryServiceServer(grpcServer, server)
+	secretservice.RegisterSecretDiscoveryServiceServer(grpcServer, server)
+	if controller.als != nil {
+		alsservice.RegisterAccessLogServiceServer(grpcServer, controller.als)
+	}
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
@@ -103,7 +370,7 @@ func main() {
 	}
 
 	go func() {
-		log.Printf("Starting xDS server on port %d", cfg.Port)
+		log.Printf("Starting xDS server on port %d (tls=%t, client certs=%t)", cfg.Port, cfg.GRPCTLSCert != "", cfg.GRPCClientCA != "")
 		if err := grpcServer.Serve(lis); err != nil {
 			log.Fatalf("Failed to serve: %v", err)
 		}
@@ -122,142 +389,210 @@ func main() {
 	cancel()
 }
 
+// discoveryLoop rediscovers at a jittered interval, which shortens after
+// membership changes, and whenever an update is triggered.
 func (c *Controller) discoveryLoop(ctx context.Context) {
-	ticker := time.NewTicker(discoveryInterval)
-	defer ticker.Stop()
-
 	// Initial discovery
 	c.updateSnapshot(ctx)
 
 	for {
+		timer := time.NewTimer(c.nextDiscoveryInterval())
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return
-		case <-ticker.C:
+		case <-timer.C:
+			c.updateSnapshot(ctx)
+		case <-c.refresh:
+			timer.Stop()
 			c.updateSnapshot(ctx)
 		}
 	}
 }
 
+// triggerUpdate requests an immediate snapshot rebuild. Requests arriving
+// while one is pending coalesce.
+func (c *Controller) triggerUpdate() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// discoverClusterEndpoints merges the endpoints of every provider backing
+// a cluster.
+func (c *Controller) discoverClusterEndpoints(ctx context.Context, spec *ClusterSpec) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, provider := range c.endpointProviders(spec) {
+		providerEndpoints, err := provider.Endpoints(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", provider, err)
+		}
+		endpoints = append(endpoints, providerEndpoints...)
+	}
+	return endpoints, nil
+}
+
 func (c *Controller) updateSnapshot(ctx context.Context) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// Standbys serve the leader's published snapshot instead of discovering
+	if !c.isLeader() {
+		c.syncFromState(ctx)
+		return
+	}
+
 	c.version++
 	log.Printf("Updating snapshot version %d", c.version)
-
-	// Discover collector instances
-	collectorEndpoints, err := c.discoverEndpoints(ctx, c.config.CollectorMIG)
-	if err != nil {
-		log.Printf("Failed to discover collector endpoints: %v", err)
-		return
+	c.expireFailedZones(time.Now())
+	c.expireRuntime(time.Now())
+
+	// Discover the instances of every cluster
+	endpoints := make(map[string][]Endpoint, len(c.clusters))
+	for i := range c.clusters {
+		spec := &c.clusters[i]
+		clusterEndpoints, err := c.discoverClusterEndpoints(ctx, spec)
+		if err != nil {
+			log.Printf("Failed to discover %s endpoints: %v", spec.Name, err)
+			return
+		}
+		endpoints[spec.Name] = clusterEndpoints
+	}
+	if len(c.endpoints) > 0 && membership(endpoints) != membership(c.endpoints) {
+		c.enterFastDiscovery("endpoint membership changed")
 	}
 
-	// Discover capture agent instances
-	captureEndpoints, err := c.discoverEndpoints(ctx, c.config.CaptureAgentMIG)
-	if err != nil {
-		log.Printf("Failed to discover capture agent endpoints: %v", err)
+	if err := c.applySnapshot(ctx, endpoints); err != nil {
+		log.Printf("Failed to apply snapshot: %v", err)
 		return
 	}
+	c.publishState(ctx)
+}
 
-	// Create EDS resources
-	collectorCluster := c.createClusterLoadAssignment("collector_cluster", collectorEndpoints)
-	captureCluster := c.createClusterLoadAssignment("capture_cluster", captureEndpoints)
-
-	// Create RTDS resource
-	rtdsRuntime := c.createRuntimeLayer()
+// applySnapshot builds the snapshots for the current version from
+// discovered endpoints, one per connected node group: endpoints are
+// prioritised by the group's zone and the runtime layer carries its role's
+// overrides. The caller holds c.mu.
+func (c *Controller) applySnapshot(ctx context.Context, endpoints map[string][]Endpoint) error {
+	c.endpoints = endpoints
+	c.refreshSecrets(ctx)
 
-	// Create snapshot
-	snapshot, err := cache.NewSnapshot(
-		fmt.Sprintf("%d", c.version),
-		map[string][]types.Resource{
-			types.Endpoint: {collectorCluster, captureCluster},
-			types.Runtime:  {rtdsRuntime},
-		},
-	)
+	// Create CDS, RDS and LDS resources
+	generated, err := c.createClusters()
 	if err != nil {
-		log.Printf("Failed to create snapshot: %v", err)
-		return
+		return err
 	}
-
-	// Update cache for all Envoy nodes
-	nodeHash := cache.IDHash{}
-	for _, endpoint := range append(collectorEndpoints, captureEndpoints...) {
-		nodeID := fmt.Sprintf("%s-%s", nodeIDPrefix, endpoint.Zone)
-		if err := c.cache.SetSnapshot(ctx, nodeHash.ID(&core.Node{Id: nodeID}), snapshot); err != nil {
-			log.Printf("Failed to set snapshot for node %s: %v", nodeID, err)
-		}
+	var clusters []types.Resource
+	for _, cl := range generated {
+		clusters = append(clusters, cl)
 	}
-
-	log.Printf("Updated snapshot: %d collectors, %d capture agents, capture_rate=%.1f%%", 
-		len(collectorEndpoints), len(captureEndpoints), c.captureRate*100)
-}
-
-type Endpoint struct {
-	Address string
-	Port    uint32
-	Zone    string
-	Healthy bool
-}
-
-func (c *Controller) discoverEndpoints(ctx context.Context, migName string) ([]Endpoint, error) {
-	instances, err := c.computeSvc.InstanceGroupManagers.ListManagedInstances(
-		c.config.ProjectID, c.config.Zone, migName).Context(ctx).Do()
+	listener, err := c.createListener()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list managed instances: %w", err)
+		return err
 	}
 
-	var endpoints []Endpoint
-	for _, instance := range instances.ManagedInstances {
-		// Skip instances that are being deleted
-		if instance.InstanceStatus == "DELETING" || instance.InstanceStatus == "STOPPING" {
-			continue
-		}
+	routeConfig := c.createRouteConfiguration()
+	secrets := c.createSecrets()
 
-		// Extract zone and instance name from URL
-		parts := parseInstanceURL(instance.Instance)
-		if len(parts) < 2 {
-			log.Printf("Failed to parse instance URL: %s", instance.Instance)
-			continue
+	// Update cache for every connected node group
+	groups := c.nodeGroups.Groups()
+	for _, group := range groups {
+		// Create EDS resources
+		var assignments []types.Resource
+		for _, spec := range c.clusters {
+			assignments = append(assignments, c.createClusterLoadAssignment(spec.Name, endpoints[spec.Name], group.Zone))
 		}
 
-		// Get instance details for IP address
-		inst, err := c.computeSvc.Instances.Get(c.config.ProjectID, parts[0], parts[1]).Context(ctx).Do()
+		// Create snapshot
+		snapshot, err := cache.NewSnapshot(
+			fmt.Sprintf("%d", c.version),
+			map[resource.Type][]types.Resource{
+				resource.EndpointType: assignments,
+				resource.ClusterType:  clusters,
+				resource.RouteType:    {routeConfig},
+				resource.ListenerType: {listener},
+				resource.RuntimeType:  {c.createRuntimeLayer(group.Role)},
+				resource.SecretType:   secrets,
+			},
+		)
 		if err != nil {
-			log.Printf("Failed to get instance details for %s: %v", parts[1], err)
-			continue
+			return fmt.Errorf("failed to create snapshot: %w", err)
 		}
-
-		if len(inst.NetworkInterfaces) == 0 {
-			log.Printf("No network interfaces found for instance %s", parts[1])
-			continue
+		if err := snapshot.Consistent(); err != nil {
+			return fmt.Errorf("generated snapshot is inconsistent: %w", err)
 		}
+		if err := c.cache.SetSnapshot(ctx, group.key(), snapshot); err != nil {
+			log.Printf("Failed to set snapshot for node group %s: %v", group.key(), err)
+		}
+	}
 
-		// Use internal IP
-		ip := inst.NetworkInterfaces[0].NetworkIP
-		healthy := instance.InstanceStatus == "RUNNING"
-
-		endpoints = append(endpoints, Endpoint{
-			Address: ip,
-			Port:    8080, // Default service port
-			Zone:    parts[0],
-			Healthy: healthy,
-		})
+	var total int
+	for _, clusterEndpoints := range endpoints {
+		total += len(clusterEndpoints)
 	}
+	log.Printf("Updated snapshot: %d endpoints in %d clusters, %d node groups, capture_rate=%.1f%%", 
+		total, len(c.clusters), len(groups), c.captureRate*100)
+	c.publishFleets()
+	return nil
+}
 
-	return endpoints, nil
+type Endpoint struct {
+	Instance string `json:"instance,omitempty"`
+	Address  string `json:"address"`
+	Port     uint32 `json:"port"`
+	Zone     string `json:"zone"`
+	Healthy  bool   `json:"healthy"`
+
+	// Health as reported by the discovery source: the MIG autohealing
+	// check state or instance status, the EndpointSlice conditions, the ASG
+	// lifecycle state and health status, or "static" and "dns"
+	Probe string `json:"probe,omitempty"`
+
+	// MIG, ASG or SRV name the endpoint belongs to and its per-instance
+	// weight; zero means the default weight
+	Group      string `json:"group,omitempty"`
+	BaseWeight uint32 `json:"base_weight,omitempty"`
 }
 
-func (c *Controller) createClusterLoadAssignment(clusterName string, endpoints []Endpoint) *endpoint.ClusterLoadAssignment {
-	var lbEndpoints []*endpoint.LbEndpoint
-	
+// baseWeight is the load-balancing weight of a healthy endpoint before
+// draining.
+func (ep Endpoint) baseWeight() uint32 {
+	if ep.BaseWeight == 0 {
+		return defaultMIGWeight
+	}
+	return ep.BaseWeight
+}
+
+// createClusterLoadAssignment groups endpoints into one locality per zone.
+// Under the zone-local policy endpoints in localZone (or of unknown zone)
+// get priority 0 and the other zones priority 1, so Envoys stay zone-local
+// and fail over only when the local endpoints are unhealthy. An empty
+// localZone puts every zone first. Localities are weighted by the total
+// weight of their healthy endpoints.
+func (c *Controller) createClusterLoadAssignment(clusterName string, endpoints []Endpoint, localZone string) *endpoint.ClusterLoadAssignment {
+	localities := make(map[string]*endpoint.LocalityLbEndpoints)
+	healthy := make(map[string]uint32)
+	var zones []string
+	now := time.Now()
+
 	for _, ep := range endpoints {
-		weight := uint32(100)
-		if !ep.Healthy {
-			weight = 0 // Drain unhealthy endpoints
+		weight, healthStatus := c.endpointLoadBalancing(ep, now)
+		if ep.Healthy && healthStatus == core.HealthStatus_UNKNOWN {
+			healthy[ep.Zone] += ep.baseWeight()
 		}
 
-		lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+		locality, ok := localities[ep.Zone]
+		if !ok {
+			locality = &endpoint.LocalityLbEndpoints{
+				Locality: &core.Locality{Region: regionOf(ep.Zone), Zone: ep.Zone},
+				Priority: c.localityPriority(ep.Zone, localZone),
+			}
+			localities[ep.Zone] = locality
+			zones = append(zones, ep.Zone)
+		}
+
+		locality.LbEndpoints = append(locality.LbEndpoints, &endpoint.LbEndpoint{
 			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 				Endpoint: &endpoint.Endpoint{
 					Address: &core.Address{
@@ -273,37 +608,74 @@ func (c *Controller) createClusterLoadAssignment(clusterName string, endpoints [
 					},
 				},
 			},
+			HealthStatus:        healthStatus,
 			LoadBalancingWeight: &wrapperspb.UInt32Value{Value: weight},
 		})
 	}
 
-	return &endpoint.ClusterLoadAssignment{
-		ClusterName: clusterName,
-		Endpoints: []*endpoint.LocalityLbEndpoints{
-			{
-				Locality: &core.Locality{
-					Region: "us-central1", // TODO: Make configurable
-					Zone:   c.config.Zone,
-				},
-				LbEndpoints: lbEndpoints,
-			},
-		},
+	// Envoy requires priorities to start at 0, so without local endpoints
+	// every zone is equally remote
+	hasLocal := false
+	for _, locality := range localities {
+		hasLocal = hasLocal || locality.Priority == 0
+	}
+
+	sort.Strings(zones)
+	assignment := &endpoint.ClusterLoadAssignment{ClusterName: clusterName}
+	for _, zone := range zones {
+		if !hasLocal {
+			localities[zone].Priority = 0
+		}
+		if c.localityWeighted() {
+			// Zero-weight localities are ignored; keep them reachable
+			weight := healthy[zone]
+			if weight == 0 {
+				weight = 1
+			}
+			localities[zone].LoadBalancingWeight = wrapperspb.UInt32(weight)
+		}
+		assignment.Endpoints = append(assignment.Endpoints, localities[zone])
 	}
+	return assignment
 }
 
-func (c *Controller) createRuntimeLayer() *runtime.Runtime {
-	return &runtime.Runtime{
-		Name: "loadgen_runtime",
-		Layer: &structpb.Struct{
-			Fields: map[string]*structpb.Value{
-				captureRTDSKey: {
-					Kind: &structpb.Value_NumberValue{
-						NumberValue: c.captureRate * 100, // Convert to percentage
-					},
-				},
+// createRuntimeLayer builds the RTDS layer for Envoys of the given role: the
+// capture rate, the global runtime keys and the role's overrides on top.
+func (c *Controller) createRuntimeLayer(role string) *runtime.Runtime {
+	return c.runtimeLayer(role, c.captureRate, time.Time{})
+}
+
+// runtimeLayer builds the RTDS layer for a role at the given capture rate,
+// leaving out global keys expired at now (none for the zero time).
+func (c *Controller) runtimeLayer(role string, captureRate float64, now time.Time) *runtime.Runtime {
+	fields := map[string]*structpb.Value{
+		captureRTDSKey: {
+			Kind: &structpb.Value_NumberValue{
+				NumberValue: captureRate * 100, // Convert to percentage
 			},
 		},
 	}
+	for i, values := range []map[string]interface{}{c.runtimeValues, c.roleRuntime[role]} {
+		for key, value := range values {
+			if key == captureRTDSKey {
+				continue
+			}
+			if expiresAt, ok := c.runtimeExpiry[key]; i == 0 && ok && !now.IsZero() && !now.Before(expiresAt) {
+				continue
+			}
+			v, err := structpb.NewValue(value)
+			if err != nil {
+				log.Printf("Skipping runtime key %s: %v", key, err)
+				continue
+			}
+			fields[key] = v
+		}
+	}
+
+	return &runtime.Runtime{
+		Name:  "loadgen_runtime",
+		Layer: &structpb.Struct{Fields: fields},
+	}
 }
 
 func (c *Controller) startHTTPServer() {
@@ -316,8 +688,34 @@ func (c *Controller) startHTTPServer() {
 	mux.HandleFunc("/capture/enable", c.handleCaptureEnable)
 	mux.HandleFunc("/capture/disable", c.handleCaptureDisable)
 	mux.HandleFunc("/capture/rate", c.handleCaptureRate)
+	mux.HandleFunc("/capture/ramp", c.handleCaptureRamp)
 	mux.HandleFunc("/status", c.handleStatus)
 
+	// Preview of the next snapshot without pushing it
+	mux.HandleFunc("/snapshot/diff", c.handleSnapshotDiff)
+
+	// Discovered endpoints with their weight and health in EDS
+	mux.HandleFunc("/endpoints", c.handleEndpoints)
+
+	// Endpoints receiving traffic by fleet, as published to the control plane
+	mux.HandleFunc("/fleets", c.handleFleets)
+	mux.HandleFunc("/fleets/", c.handleFleets)
+	mux.HandleFunc("/als", c.handleALS)
+
+	// Traffic splitting between main and canary collectors
+	mux.HandleFunc("/traffic/split", c.handleTrafficSplit)
+
+	// Runtime keys for the whole fleet and overrides per Envoy role
+	mux.HandleFunc("/runtime", c.handleRuntime)
+	mux.HandleFunc("/runtime/", c.handleRuntime)
+	mux.HandleFunc("/runtime/role", c.handleRoleRuntime)
+
+	// Instance draining for rolling updates
+	mux.HandleFunc("/drain/", c.handleDrain)
+
+	// Simulated zone loss for failover testing
+	mux.HandleFunc("/zones/fail", c.handleZoneFailure)
+
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", httpPort),
 		Handler: mux,
@@ -334,6 +732,8 @@ func (c *Controller) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// handleCaptureEnable sets the capture rate (?rate=<percent>, default 100)
+// and aborts any ramp. With ?dry_run=true it only reports the change.
 func (c *Controller) handleCaptureEnable(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -356,23 +756,47 @@ func (c *Controller) handleCaptureEnable(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if r.URL.Query().Get("dry_run") == "true" {
+		c.captureDryRun(w, newRate, nil)
+		return
+	}
+	if !c.requireLeader(w) {
+		return
+	}
+
 	c.mu.Lock()
+	c.stopCaptureRamp()
 	c.captureRate = newRate / 100.0
+	c.publishState(r.Context())
 	c.mu.Unlock()
+	c.triggerUpdate()
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Capture enabled at %.1f%%\n", newRate)
 }
 
+// handleCaptureDisable sets the capture rate to 0. With ?dry_run=true it
+// only reports the change.
 func (c *Controller) handleCaptureDisable(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if r.URL.Query().Get("dry_run") == "true" {
+		c.captureDryRun(w, 0, nil)
+		return
+	}
+	if !c.requireLeader(w) {
+		return
+	}
+
 	c.mu.Lock()
+	c.stopCaptureRamp()
 	c.captureRate = 0.0
+	c.publishState(r.Context())
 	c.mu.Unlock()
+	c.triggerUpdate()
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Capture disabled\n"))
@@ -391,12 +815,23 @@ func (c *Controller) handleStatus(w http.ResponseWriter, r *http.Request) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	clusters := make(map[string]int, len(c.clusters))
+	for _, spec := range c.clusters {
+		clusters[spec.Name] = len(c.endpoints[spec.Name])
+	}
+
 	status := map[string]interface{}{
-		"version":      c.version,
-		"capture_rate": c.captureRate * 100,
-		"project_id":   c.config.ProjectID,
-		"zone":         c.config.Zone,
-		"timestamp":    time.Now().UTC(),
+		"version":       c.version,
+		"capture_rate":  c.captureRate * 100,
+		"capture_ramp":  c.captureRamp,
+		"canary_weight": c.canaryWeight,
+		"project_id":    c.config.ProjectID,
+		"zone":          c.config.Zone,
+		"timestamp":     time.Now().UTC(),
+		"identity":      c.config.Identity,
+		"leader":        c.isLeader(),
+		"node_groups":   c.nodeGroups.Groups(),
+		"clusters":      clusters,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
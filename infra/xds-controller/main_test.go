@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// testController returns a controller serving a collector and a capture
+// cluster, with nothing discovered or connected yet
+func testController(localityPolicy string) *Controller {
+	c := &Controller{
+		config: &Config{ListenerPort: envoyListenerPort, LocalityPolicy: localityPolicy},
+		ctx:    context.Background(),
+		clusters: []ClusterSpec{
+			{Name: collectorClusterName, Role: roleCollector, ConnectTimeout: time.Second},
+			{Name: captureClusterName, Role: roleCapture, ConnectTimeout: time.Second},
+		},
+		runtimeValues: make(map[string]interface{}),
+		runtimeExpiry: make(map[string]time.Time),
+		roleRuntime:   make(map[string]map[string]interface{}),
+		secrets:       make(map[string]*certBundle),
+	}
+	c.nodeGroups = newNodeGroupHash(func(nodeGroup) {})
+	c.cache = cache.NewSnapshotCache(false, c.nodeGroups, nil)
+	return c
+}
+
+// connect registers an Envoy of the given role and zone, as its first
+// request would
+func connect(t *testing.T, c *Controller, role, zone string) nodeGroup {
+	t.Helper()
+	metadata, err := structpb.NewStruct(map[string]interface{}{nodeRoleKey: role, nodeZoneKey: zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.nodeGroups.ID(&core.Node{Id: role + "-" + zone, Metadata: metadata})
+	return nodeGroup{Role: role, Zone: zone}
+}
+
+func TestApplySnapshot(t *testing.T) {
+	c := testController(localityZoneLocal)
+	c.roleRuntime["edge"] = map[string]interface{}{"edge.only": true}
+	groups := []nodeGroup{
+		connect(t, c, "edge", "us-central1-a"),
+		connect(t, c, "edge", "us-central1-b"),
+		connect(t, c, "", ""),
+	}
+
+	endpoints := map[string][]Endpoint{
+		collectorClusterName: {
+			{Instance: "collector-a", Address: "10.0.0.1", Port: 8080, Zone: "us-central1-a", Healthy: true},
+			{Instance: "collector-b", Address: "10.0.1.1", Port: 8080, Zone: "us-central1-b", Healthy: true},
+		},
+		// The capture cluster may have no endpoints; it must still be served
+	}
+	c.version = 7
+	if err := c.applySnapshot(c.ctx, endpoints); err != nil {
+		t.Fatalf("applySnapshot: %v", err)
+	}
+
+	for _, group := range groups {
+		t.Run(group.key(), func(t *testing.T) {
+			served, err := c.cache.GetSnapshot(group.key())
+			if err != nil {
+				t.Fatalf("no snapshot: %v", err)
+			}
+			snapshot := served.(*cache.Snapshot)
+			if err := snapshot.Consistent(); err != nil {
+				t.Errorf("snapshot is inconsistent: %v", err)
+			}
+			for _, typ := range []resource.Type{resource.EndpointType, resource.ClusterType, resource.RouteType, resource.ListenerType, resource.RuntimeType} {
+				if version := snapshot.GetVersion(typ); version != "7" {
+					t.Errorf("%s version = %q, want 7", typ, version)
+				}
+			}
+
+			assignments := snapshot.GetResources(resource.EndpointType)
+			if len(assignments) != len(c.clusters) {
+				t.Fatalf("%d assignments for %d clusters", len(assignments), len(c.clusters))
+			}
+			cla := assignments[collectorClusterName].(*endpoint.ClusterLoadAssignment)
+			for _, locality := range cla.Endpoints {
+				want := uint32(0)
+				if group.Zone != "" && locality.Locality.Zone != group.Zone {
+					want = 1
+				}
+				if locality.Priority != want {
+					t.Errorf("zone %s has priority %d, want %d", locality.Locality.Zone, locality.Priority, want)
+				}
+			}
+
+			layer := snapshot.GetResources(resource.RuntimeType)["loadgen_runtime"].(*runtime.Runtime)
+			_, hasOverride := layer.Layer.Fields["edge.only"]
+			if hasOverride != (group.Role == "edge") {
+				t.Errorf("edge override served = %v for role %q", hasOverride, group.Role)
+			}
+		})
+	}
+}
+
+func TestCreateClusterLoadAssignment(t *testing.T) {
+	endpoints := []Endpoint{
+		{Address: "10.0.0.1", Port: 8080, Zone: "us-central1-a", Healthy: true},
+		{Address: "10.0.0.2", Port: 8080, Zone: "us-central1-a", Healthy: true, BaseWeight: 50},
+		{Address: "10.0.0.3", Port: 8080, Zone: "us-central1-a", Healthy: false},
+		{Address: "10.0.1.1", Port: 8080, Zone: "us-central1-b", Healthy: true},
+		{Address: "10.0.2.1", Port: 8080, Zone: "us-central1-c", Healthy: false},
+	}
+
+	type locality struct {
+		priority uint32
+		weight   uint32 // 0 for no locality weight
+	}
+	tests := []struct {
+		name        string
+		policy      string
+		localZone   string
+		failedZones []string
+		want        map[string]locality
+	}{
+		{"zone-local", localityZoneLocal, "us-central1-a", nil, map[string]locality{
+			"us-central1-a": {0, 150},
+			"us-central1-b": {1, 100},
+			"us-central1-c": {1, 1}, // kept reachable without healthy endpoints
+		}},
+		{"zone-local without local endpoints", localityZoneLocal, "us-central1-f", nil, map[string]locality{
+			"us-central1-a": {0, 150},
+			"us-central1-b": {0, 100},
+			"us-central1-c": {0, 1},
+		}},
+		{"zone-local without a zone", localityZoneLocal, "", nil, map[string]locality{
+			"us-central1-a": {0, 150},
+			"us-central1-b": {0, 100},
+			"us-central1-c": {0, 1},
+		}},
+		{"zone-local with a failed zone", localityZoneLocal, "us-central1-a", []string{"us-central1-a"}, map[string]locality{
+			"us-central1-a": {0, 1},
+			"us-central1-b": {1, 100},
+			"us-central1-c": {1, 1},
+		}},
+		{"weighted", localityWeighted, "us-central1-a", nil, map[string]locality{
+			"us-central1-a": {0, 150},
+			"us-central1-b": {0, 100},
+			"us-central1-c": {0, 1},
+		}},
+		{"none", localityNone, "us-central1-a", nil, map[string]locality{
+			"us-central1-a": {0, 0},
+			"us-central1-b": {0, 0},
+			"us-central1-c": {0, 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testController(tt.policy)
+			c.failedZones = make(map[string]time.Time)
+			for _, zone := range tt.failedZones {
+				c.failedZones[zone] = time.Now().Add(time.Hour)
+			}
+
+			cla := c.createClusterLoadAssignment(collectorClusterName, endpoints, tt.localZone)
+			if cla.ClusterName != collectorClusterName {
+				t.Errorf("cluster name = %q", cla.ClusterName)
+			}
+			if len(cla.Endpoints) != len(tt.want) {
+				t.Fatalf("%d localities, want %d", len(cla.Endpoints), len(tt.want))
+			}
+			for _, got := range cla.Endpoints {
+				zone := got.Locality.Zone
+				want := tt.want[zone]
+				if got.Priority != want.priority {
+					t.Errorf("zone %s priority = %d, want %d", zone, got.Priority, want.priority)
+				}
+				if weight := got.LoadBalancingWeight.GetValue(); weight != want.weight {
+					t.Errorf("zone %s weight = %d, want %d", zone, weight, want.weight)
+				}
+				if got.Locality.Region != "us-central1" {
+					t.Errorf("zone %s region = %q", zone, got.Locality.Region)
+				}
+			}
+		})
+	}
+
+	t.Run("endpoint weights", func(t *testing.T) {
+		c := testController(localityZoneLocal)
+		cla := c.createClusterLoadAssignment(collectorClusterName, endpoints[:3], "us-central1-a")
+		var weights []uint32
+		for _, ep := range cla.Endpoints[0].LbEndpoints {
+			weights = append(weights, ep.LoadBalancingWeight.GetValue())
+		}
+		if len(weights) != 3 || weights[0] != defaultMIGWeight || weights[1] != 50 || weights[2] != 0 {
+			t.Errorf("endpoint weights = %v, want [%d 50 0]", weights, defaultMIGWeight)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// Node metadata keys Envoys set to select their snapshot.
+const (
+	nodeRoleKey = "role"
+	nodeZoneKey = "zone"
+)
+
+// nodeGroup is the set of Envoys sharing one snapshot: the same role and
+// zone. Empty fields mean the Envoy did not say.
+type nodeGroup struct {
+	Role string `json:"role"`
+	Zone string `json:"zone"`
+}
+
+func (g nodeGroup) key() string { return g.Role + "/" + g.Zone }
+
+// nodeGroupOf reads the role and zone from the node metadata, falling back
+// to the node locality for the zone.
+func nodeGroupOf(node *core.Node) nodeGroup {
+	var group nodeGroup
+	if fields := node.GetMetadata().GetFields(); fields != nil {
+		group.Role = fields[nodeRoleKey].GetStringValue()
+		group.Zone = fields[nodeZoneKey].GetStringValue()
+	}
+	if group.Zone == "" {
+		group.Zone = node.GetLocality().GetZone()
+	}
+	return group
+}
+
+// nodeGroupHash keys the snapshot cache on the node group instead of the
+// node ID, and remembers every group that has connected so snapshots are
+// only computed for groups that exist.
+type nodeGroupHash struct {
+	onNewGroup func(nodeGroup)
+
+	mu     sync.RWMutex
+	groups map[string]nodeGroup
+}
+
+func newNodeGroupHash(onNewGroup func(nodeGroup)) *nodeGroupHash {
+	return &nodeGroupHash{
+		onNewGroup: onNewGroup,
+		groups:     make(map[string]nodeGroup),
+	}
+}
+
+// ID implements cache.NodeHash.
+func (h *nodeGroupHash) ID(node *core.Node) string {
+	group := nodeGroupOf(node)
+	key := group.key()
+
+	h.mu.RLock()
+	_, known := h.groups[key]
+	h.mu.RUnlock()
+	if !known {
+		h.mu.Lock()
+		_, known = h.groups[key]
+		h.groups[key] = group
+		h.mu.Unlock()
+		if !known {
+			log.Printf("New Envoy node group role=%q zone=%q (node %s)", group.Role, group.Zone, node.GetId())
+			h.onNewGroup(group)
+		}
+	}
+	return key
+}
+
+// Groups returns the known groups ordered by key.
+func (h *nodeGroupHash) Groups() []nodeGroup {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	keys := make([]string, 0, len(h.groups))
+	for key := range h.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	groups := make([]nodeGroup, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, h.groups[key])
+	}
+	return groups
+}
+
+// serveNewGroup gives a group that connected after the last update the
+// current snapshot version, rather than leaving its Envoys waiting for the
+// next discovery round.
+func (c *Controller) serveNewGroup(group nodeGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version == 0 {
+		// The initial update has not run yet and will include the group
+		return
+	}
+	if err := c.applySnapshot(c.ctx, c.endpoints); err != nil {
+		log.Printf("Failed to apply snapshot for node group %s: %v", group.key(), err)
+	}
+}
+
+// regionOf derives the region from a GCP zone name (us-central1-a) or an
+// AWS availability zone (us-east-1a).
+func regionOf(zone string) string {
+	if n := len(zone); n > 1 && zone[n-1] >= 'a' && zone[n-1] <= 'z' && zone[n-2] >= '0' && zone[n-2] <= '9' {
+		return zone[:n-1]
+	}
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// handleRoleRuntime serves GET (all role overrides), PUT ?role=<role> with a
+// JSON object of runtime keys layered over the global runtime for Envoys of
+// that role, and DELETE ?role=<role>.
+func (c *Controller) handleRoleRuntime(w http.ResponseWriter, r *http.Request) {
+	role := r.URL.Query().Get("role")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		if role == "" {
+			http.Error(w, "Missing role parameter", http.StatusBadRequest)
+			return
+		}
+
+		var values map[string]interface{}
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+				http.Error(w, "Body must be a JSON object of runtime keys", http.StatusBadRequest)
+				return
+			}
+			if _, ok := values[captureRTDSKey]; ok {
+				http.Error(w, captureRTDSKey+" is controlled by the capture API", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c.mu.Lock()
+		if values == nil {
+			delete(c.roleRuntime, role)
+		} else {
+			c.roleRuntime[role] = values
+		}
+		c.reapplySnapshot()
+		c.mu.Unlock()
+		log.Printf("Runtime overrides for role %q: %d keys", role, len(values))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	body, err := json.Marshal(c.roleRuntime)
+	c.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "Failed to encode runtime overrides", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const configMapStateKey = "state.json"
+
+// configMapStateStore keeps the controller state in a Kubernetes ConfigMap.
+// Updates carry the resourceVersion read, so a concurrent writer makes the
+// save fail rather than being silently overwritten.
+type configMapStateStore struct {
+	client    *kubeClient
+	namespace string
+	name      string
+}
+
+type configMap struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+func (s *configMapStateStore) path() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/configmaps", s.namespace)
+}
+
+func (s *configMapStateStore) get(ctx context.Context) (*configMap, error) {
+	resp, err := s.client.get(ctx, s.path()+"/"+s.name, nil)
+	if isKubeNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state configmap: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var cm configMap
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return nil, fmt.Errorf("failed to decode state configmap: %w", err)
+	}
+	return &cm, nil
+}
+
+func (s *configMapStateStore) Load(ctx context.Context) (*sharedState, error) {
+	cm, err := s.get(ctx)
+	if err != nil || cm == nil || cm.Data[configMapStateKey] == "" {
+		return nil, err
+	}
+	var state sharedState
+	if err := json.Unmarshal([]byte(cm.Data[configMapStateKey]), &state); err != nil {
+		return nil, fmt.Errorf("failed to decode state configmap: %w", err)
+	}
+	return &state, nil
+}
+
+func (s *configMapStateStore) Save(ctx context.Context, state *sharedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	cm, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	method, path := http.MethodPut, s.path()+"/"+s.name
+	if cm == nil {
+		cm = &configMap{APIVersion: "v1", Kind: "ConfigMap"}
+		cm.Metadata.Name, cm.Metadata.Namespace = s.name, s.namespace
+		method, path = http.MethodPost, s.path()
+	}
+	cm.Data = map[string]string{configMapStateKey: string(data)}
+
+	body, err := json.Marshal(cm)
+	if err != nil {
+		return fmt.Errorf("failed to encode state configmap: %w", err)
+	}
+	resp, err := s.client.request(ctx, method, path, nil, body)
+	if err != nil {
+		return fmt.Errorf("failed to write state configmap: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// openStateStore configures where runtime values and shared snapshot inputs
+// are persisted, if anywhere.
+func (c *Controller) openStateStore(ctx context.Context) error {
+	switch {
+	case c.config.StateBucket != "" && c.config.StateConfigMap != "":
+		return fmt.Errorf("-state-bucket and -state-configmap are mutually exclusive")
+
+	case c.config.StateBucket != "":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		bucket := client.Bucket(c.config.StateBucket)
+		c.state = &gcsStateStore{bucket: bucket, object: c.config.StateObject}
+		if c.config.LeaderElection {
+			c.startLeaderElection(ctx, bucket)
+		}
+
+	case c.config.StateConfigMap != "":
+		parts := strings.Split(c.config.StateConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid -state-configmap %q, expected namespace/name", c.config.StateConfigMap)
+		}
+		client, err := newInClusterKubeClient(c.config.KubeAPIServer)
+		if err != nil {
+			return fmt.Errorf("failed to create kubernetes client: %w", err)
+		}
+		c.state = &configMapStateStore{client: client, namespace: parts[0], name: parts[1]}
+	}
+	return nil
+}
+
+// restoreState reloads persisted runtime values on startup so a restart
+// does not silently stop a capture campaign. Without saved state the
+// configured default capture rate applies.
+func (c *Controller) restoreState(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.captureRate = c.config.DefaultCaptureRate / 100.0
+	if c.state == nil {
+		return
+	}
+
+	state, err := c.state.Load(ctx)
+	if err != nil {
+		log.Printf("Failed to restore runtime state, using defaults: %v", err)
+		return
+	}
+	if state == nil {
+		log.Printf("No saved runtime state, capture rate defaults to %.1f%%", c.config.DefaultCaptureRate)
+		return
+	}
+	c.adoptState(state)
+	log.Printf("Restored runtime state from version %d: capture_rate=%.1f%%, %d other keys",
+		state.Version, c.captureRate*100, len(c.runtimeValues))
+
+	// Resume an interrupted ramp; with leader election the new leader does
+	if c.isLeader() {
+		c.startCaptureRamp()
+		c.startSplitRamp()
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// EndpointProvider discovers the endpoints of one source backing a
+// cluster: a MIG, a Kubernetes service, a static list, a DNS SRV name or
+// an AWS Auto Scaling group. Providers are called with c.mu held.
+type EndpointProvider interface {
+	Endpoints(ctx context.Context) ([]Endpoint, error)
+	String() string
+}
+
+// StaticEndpointSpec is one fixed endpoint of a cluster, for backends
+// without a discovery API.
+type StaticEndpointSpec struct {
+	Address  string `yaml:"address"`
+	Port     uint32 `yaml:"port"`
+	Zone     string `yaml:"zone"`
+	Instance string `yaml:"instance"`
+	Weight   uint32 `yaml:"weight"`
+}
+
+// endpointProviders builds the providers of a cluster. EndpointSlice
+// watchers must already be running. The caller holds c.mu.
+func (c *Controller) endpointProviders(spec *ClusterSpec) []EndpointProvider {
+	var providers []EndpointProvider
+	for _, mig := range spec.MIGs {
+		providers = append(providers, &migProvider{c: c, mig: mig, port: spec.Port})
+	}
+	if watcher, ok := c.watchers[spec.K8sService]; ok {
+		providers = append(providers, &kubeProvider{watcher: watcher.kubeWatcher})
+	}
+	if len(spec.Static) > 0 {
+		providers = append(providers, &staticProvider{specs: spec.Static, port: spec.Port})
+	}
+	if spec.DNSSRV != "" {
+		providers = append(providers, &dnsSRVProvider{name: spec.DNSSRV, resolver: net.DefaultResolver})
+	}
+	for _, asg := range spec.AWSASGs {
+		providers = append(providers, &awsASGProvider{c: c, asg: asg, port: spec.Port})
+	}
+	return providers
+}
+
+// migProvider lists the instances of a GCE managed instance group.
+type migProvider struct {
+	c    *Controller
+	mig  MIGSpec
+	port uint32
+}
+
+func (p *migProvider) String() string { return "mig:" + p.mig.key() }
+
+func (p *migProvider) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	c, mig := p.c, p.mig
+	instances, err := c.computeSvc.InstanceGroupManagers.ListManagedInstances(
+		c.config.ProjectID, mig.Zone, mig.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managed instances: %w", err)
+	}
+
+	// Addresses are kept per instance ID, which changes when an instance is
+	// recreated, so only new instances cost an Instances.Get
+	migKey := mig.key()
+	known := c.instanceAddresses[migKey]
+	addresses := make(map[uint64]string, len(instances.ManagedInstances))
+
+	var endpoints []Endpoint
+	for _, instance := range instances.ManagedInstances {
+		// Rediscover quickly while the MIG creates, recreates or deletes
+		// instances
+		if instance.CurrentAction != "" && instance.CurrentAction != "NONE" {
+			c.enterFastDiscovery(fmt.Sprintf("MIG %s is %s %s", mig.Name, strings.ToLower(instance.CurrentAction), instance.Instance))
+		}
+
+		// Skip instances that are being deleted
+		if instance.InstanceStatus == "DELETING" || instance.InstanceStatus == "STOPPING" {
+			continue
+		}
+
+		// Extract zone and instance name from URL
+		parts := parseInstanceURL(instance.Instance)
+		if len(parts) < 2 {
+			log.Printf("Failed to parse instance URL: %s", instance.Instance)
+			continue
+		}
+
+		// Get instance details for IP address
+		ip, ok := known[instance.Id]
+		if !ok || instance.Id == 0 {
+			inst, err := c.computeSvc.Instances.Get(c.config.ProjectID, parts[0], parts[1]).Context(ctx).Do()
+			if err != nil {
+				log.Printf("Failed to get instance details for %s: %v", parts[1], err)
+				continue
+			}
+
+			if len(inst.NetworkInterfaces) == 0 {
+				log.Printf("No network interfaces found for instance %s", parts[1])
+				continue
+			}
+
+			// Use internal IP
+			ip = inst.NetworkInterfaces[0].NetworkIP
+		}
+		if instance.Id != 0 && ip != "" {
+			addresses[instance.Id] = ip
+		}
+		healthy := instance.InstanceStatus == "RUNNING"
+		probe := instance.InstanceStatus
+		for _, health := range instance.InstanceHealth {
+			probe = health.DetailedHealthState
+		}
+
+		endpoints = append(endpoints, Endpoint{
+			Instance:   parts[1],
+			Address:    ip,
+			Port:       p.port,
+			Zone:       parts[0],
+			Healthy:    healthy,
+			Probe:      probe,
+			Group:      mig.Name,
+			BaseWeight: mig.Weight,
+		})
+	}
+	c.instanceAddresses[migKey] = addresses
+
+	return endpoints, nil
+}
+
+// kubeProvider serves the endpoints of a watched Kubernetes service.
+type kubeProvider struct {
+	watcher *kubeWatcher
+}
+
+func (p *kubeProvider) String() string { return "k8s:" + p.watcher.source.String() }
+
+func (p *kubeProvider) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	return p.watcher.Endpoints()
+}
+
+// staticProvider serves a fixed list of endpoints, which are always
+// considered healthy; Envoy's active health checks still apply.
+type staticProvider struct {
+	specs []StaticEndpointSpec
+	port  uint32
+}
+
+func (p *staticProvider) String() string { return fmt.Sprintf("static:%d", len(p.specs)) }
+
+func (p *staticProvider) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	endpoints := make([]Endpoint, 0, len(p.specs))
+	for _, spec := range p.specs {
+		port := spec.Port
+		if port == 0 {
+			port = p.port
+		}
+		endpoints = append(endpoints, Endpoint{
+			Instance:   spec.Instance,
+			Address:    spec.Address,
+			Port:       port,
+			Zone:       spec.Zone,
+			Healthy:    true,
+			Probe:      "static",
+			Group:      "static",
+			BaseWeight: spec.Weight,
+		})
+	}
+	return endpoints, nil
+}
+
+// dnsSRVProvider resolves a DNS SRV name, e.g. one published by Consul or
+// a headless service, into one endpoint per target address. SRV weights
+// become endpoint weights.
+type dnsSRVProvider struct {
+	name     string
+	resolver *net.Resolver
+}
+
+func (p *dnsSRVProvider) String() string { return "dns-srv:" + p.name }
+
+func (p *dnsSRVProvider) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV %s: %w", p.name, err)
+	}
+
+	var endpoints []Endpoint
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addresses, err := p.resolver.LookupHost(ctx, target)
+		if err != nil {
+			log.Printf("Failed to resolve SRV target %s: %v", target, err)
+			continue
+		}
+		for _, address := range addresses {
+			endpoints = append(endpoints, Endpoint{
+				Instance:   target,
+				Address:    address,
+				Port:       uint32(record.Port),
+				Healthy:    true,
+				Probe:      "dns",
+				Group:      p.name,
+				BaseWeight: uint32(record.Weight),
+			})
+		}
+	}
+	return endpoints, nil
+}
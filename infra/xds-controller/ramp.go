@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rampStepInterval is how often an active ramp pushes a new snapshot.
+const rampStepInterval = 10 * time.Second
+
+// ramp interpolates a value linearly from one level to another.
+type ramp struct {
+	From     float64       `json:"from"`
+	To       float64       `json:"to"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (r *ramp) value(now time.Time) float64 {
+	if r.Duration <= 0 || !now.Before(r.Start.Add(r.Duration)) {
+		return r.To
+	}
+	progress := float64(now.Sub(r.Start)) / float64(r.Duration)
+	if progress < 0 {
+		progress = 0
+	}
+	return r.From + (r.To-r.From)*progress
+}
+
+func (r *ramp) done(now time.Time) bool {
+	return !now.Before(r.Start.Add(r.Duration))
+}
+
+// startCaptureRamp runs the loop for c.captureRamp unless one is already
+// running. The caller holds c.mu.
+func (c *Controller) startCaptureRamp() {
+	if c.captureRamp == nil || c.captureRampStop != nil {
+		return
+	}
+	c.captureRampStop = make(chan struct{})
+	go c.captureRampLoop(c.captureRampStop)
+}
+
+// stopCaptureRamp aborts an active capture ramp, holding the current rate.
+// It reports whether a ramp was active. The caller holds c.mu.
+func (c *Controller) stopCaptureRamp() bool {
+	active := c.captureRamp != nil
+	if c.captureRampStop != nil {
+		close(c.captureRampStop)
+		c.captureRampStop = nil
+	}
+	c.captureRamp = nil
+	return active
+}
+
+// captureRampLoop moves the RTDS capture.enabled value along the ramp. The
+// ramp is part of the shared state, so a new leader resumes it where the
+// clock says it should be; a replica losing leadership stops stepping.
+func (c *Controller) captureRampLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(rampStepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			select {
+			case <-stop:
+				// Replaced or aborted while waiting for the lock
+				c.mu.Unlock()
+				return
+			default:
+			}
+			if c.captureRamp == nil || !c.isLeader() {
+				c.captureRampStop = nil
+				c.mu.Unlock()
+				return
+			}
+			c.captureRate = c.captureRamp.value(now) / 100.0
+			finished := c.captureRamp.done(now)
+			if finished {
+				c.captureRamp = nil
+				c.captureRampStop = nil
+				log.Printf("Capture ramp finished at %.1f%%", c.captureRate*100)
+			}
+			c.reapplySnapshot()
+			c.mu.Unlock()
+			if finished {
+				return
+			}
+		}
+	}
+}
+
+// handleCaptureRamp serves GET (current ramp), POST
+// ?target=<percent>&duration=<d> which moves the capture rate linearly to
+// the target over the duration, and DELETE which aborts the ramp at the
+// current rate. POST with dry_run=true reports the ramp and the runtime at
+// its target without starting it.
+func (c *Controller) handleCaptureRamp(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		target, err := strconv.ParseFloat(r.URL.Query().Get("target"), 64)
+		if err != nil || target < 0 || target > 100 {
+			http.Error(w, "target must be a percentage between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || duration <= 0 {
+			http.Error(w, "duration must be a positive duration such as 10m", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("dry_run") == "true" {
+			c.mu.RLock()
+			preview := &ramp{From: c.captureRate * 100, To: target, Start: time.Now().UTC(), Duration: duration}
+			c.mu.RUnlock()
+			c.captureDryRun(w, target, preview)
+			return
+		}
+		if !c.requireLeader(w) {
+			return
+		}
+
+		c.mu.Lock()
+		c.stopCaptureRamp()
+		c.captureRamp = &ramp{From: c.captureRate * 100, To: target, Start: time.Now().UTC(), Duration: duration}
+		c.startCaptureRamp()
+		c.publishState(r.Context())
+		log.Printf("Ramping capture from %.1f%% to %.1f%% over %s", c.captureRate*100, target, duration)
+		c.mu.Unlock()
+	case http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		c.mu.Lock()
+		if c.stopCaptureRamp() {
+			c.publishState(r.Context())
+			log.Printf("Capture ramp aborted at %.1f%%", c.captureRate*100)
+		}
+		c.mu.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	status := map[string]interface{}{
+		"capture_rate": c.captureRate * 100,
+		"ramp":         c.captureRamp,
+	}
+	c.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to encode capture ramp: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	stdout "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+)
+
+const (
+	collectorClusterName = "collector_cluster"
+	captureClusterName   = "capture_cluster"
+	listenerName         = "wavefront_listener"
+	routeConfigName      = "wavefront_route"
+	virtualHostName      = "wavefront_service"
+	ingressPathPrefix    = "/api/v2/wfproxy/"
+)
+
+// adsConfigSource points dynamic resources back at the aggregated stream
+// the Envoy already holds with this controller.
+func adsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion: core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		},
+	}
+}
+
+func edsCluster(name string, connectTimeout time.Duration, lbPolicy cluster.Cluster_LbPolicy) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 name,
+		ConnectTimeout:       durationpb.New(connectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: adsConfigSource(),
+		},
+		LbPolicy: lbPolicy,
+	}
+}
+
+// createClusters builds the CDS resources from the configured clusters.
+// Health-checked clusters eject failing hosts; the capture cluster is tuned
+// for cheap, best-effort mirroring and never health checked unless
+// configured, so mirror failures cannot affect endpoint selection.
+func (c *Controller) createClusters() ([]*cluster.Cluster, error) {
+	upstreamTLS, err := c.upstreamTransportSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	var clusters []*cluster.Cluster
+	for _, spec := range c.clusters {
+		cl := edsCluster(spec.Name, spec.ConnectTimeout, spec.lbPolicy())
+		if hc := spec.HealthCheck; hc != nil {
+			cl.HealthChecks = []*core.HealthCheck{
+				{
+					Timeout:            durationpb.New(hc.Timeout),
+					Interval:           durationpb.New(hc.Interval),
+					UnhealthyThreshold: wrapperspb.UInt32(hc.UnhealthyThreshold),
+					HealthyThreshold:   wrapperspb.UInt32(hc.HealthyThreshold),
+					HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+						HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+							Path:             hc.Path,
+							ExpectedStatuses: []*matcher.Int64Range{{Start: 200, End: 300}},
+						},
+					},
+				},
+			}
+		}
+
+		if spec.Role == roleCapture {
+			cl.UpstreamConnectionOptions = &cluster.UpstreamConnectionOptions{
+				TcpKeepalive: &core.TcpKeepalive{
+					KeepaliveProbes:   wrapperspb.UInt32(3),
+					KeepaliveTime:     wrapperspb.UInt32(10),
+					KeepaliveInterval: wrapperspb.UInt32(5),
+				},
+			}
+			cl.CircuitBreakers = &cluster.CircuitBreakers{
+				Thresholds: []*cluster.CircuitBreakers_Thresholds{
+					{
+						Priority:           core.RoutingPriority_DEFAULT,
+						MaxConnections:     wrapperspb.UInt32(32),
+						MaxPendingRequests: wrapperspb.UInt32(64),
+						MaxRequests:        wrapperspb.UInt32(128),
+						MaxRetries:         wrapperspb.UInt32(0), // No retries for mirror traffic
+						TrackRemaining:     true,
+					},
+				},
+			}
+			cl.OutlierDetection = &cluster.OutlierDetection{
+				Consecutive_5Xx:    wrapperspb.UInt32(10),
+				Interval:           durationpb.New(30 * time.Second),
+				BaseEjectionTime:   durationpb.New(10 * time.Second),
+				MaxEjectionPercent: wrapperspb.UInt32(25),
+			}
+		} else {
+			cl.OutlierDetection = &cluster.OutlierDetection{
+				Consecutive_5Xx:                wrapperspb.UInt32(3),
+				Interval:                       durationpb.New(10 * time.Second),
+				BaseEjectionTime:               durationpb.New(30 * time.Second),
+				MaxEjectionPercent:             wrapperspb.UInt32(50),
+				SplitExternalLocalOriginErrors: true,
+			}
+		}
+
+		cl.CommonLbConfig = c.localityLbConfig()
+		cl.TransportSocket = upstreamTLS
+		clusters = append(clusters, cl)
+	}
+	return clusters, nil
+}
+
+func directResponse(prefix, body string) *route.Route {
+	return &route.Route{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: prefix},
+		},
+		Action: &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: 200,
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: body},
+				},
+			},
+		},
+	}
+}
+
+// captureMirrorPolicies mirrors a route to the capture cluster at the
+// fraction held in the capture.enabled runtime key, which the capture API
+// drives over RTDS. With the key unset nothing is mirrored.
+func (c *Controller) captureMirrorPolicies() []*route.RouteAction_RequestMirrorPolicy {
+	return []*route.RouteAction_RequestMirrorPolicy{
+		{
+			Cluster: c.clusterByRole(roleCapture).Name,
+			RuntimeFraction: &core.RuntimeFractionalPercent{
+				DefaultValue: &matcher.FractionalPercent{
+					Numerator:   0,
+					Denominator: matcher.FractionalPercent_HUNDRED,
+				},
+				RuntimeKey: captureRTDSKey,
+			},
+		},
+	}
+}
+
+// createRouteConfiguration builds the RDS resource: ingress goes to the
+// collectors and is mirrored to the capture agents. Extra tiers get a route
+// for their prefix, mirrored too when configured.
+func (c *Controller) createRouteConfiguration() *route.RouteConfiguration {
+	var routes []*route.Route
+	for _, spec := range c.clusters {
+		if spec.RoutePrefix == "" {
+			continue
+		}
+		action := &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: spec.Name},
+			Timeout:          durationpb.New(30 * time.Second),
+		}
+		if spec.Mirror {
+			action.RequestMirrorPolicies = c.captureMirrorPolicies()
+		}
+		routes = append(routes, &route.Route{
+			Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: spec.RoutePrefix},
+			},
+			Action: &route.Route_Route{Route: action},
+		})
+	}
+
+	ingress := &route.Route{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: ingressPathPrefix},
+		},
+		Action: &route.Route_Route{
+			Route: &route.RouteAction{
+				Timeout:               durationpb.New(30 * time.Second),
+				RequestMirrorPolicies: c.captureMirrorPolicies(),
+			},
+		},
+	}
+
+	c.collectorRouteAction(ingress.GetRoute())
+
+	return &route.RouteConfiguration{
+		Name: routeConfigName,
+		VirtualHosts: []*route.VirtualHost{
+			{
+				Name:    virtualHostName,
+				Domains: []string{"*"},
+				Routes: append(routes,
+					ingress,
+					directResponse("/health", "OK"),
+					directResponse("/ready", "READY"),
+				),
+			},
+		},
+	}
+}
+
+// accessLogFormat matches the access log the static bootstrap used to emit,
+// including the mirror status.
+const accessLogFormat = `[%START_TIME%] "%REQ(:method)% %REQ(x-forwarded-proto)%://%REQ(:authority)%%REQ(:path)% %PROTOCOL%"
+%RESPONSE_CODE% %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT% %DURATION%
+"%REQ(x-forwarded-for)%" "%REQ(user-agent)%" "%REQ(x-request-id)%"
+"%REQ(:authority)%" upstream_host="%UPSTREAM_HOST%" mirror_status="%MIRROR_STATUS%"
+`
+
+// createListener builds the LDS resource: one HTTP listener whose routes are
+// fetched over RDS.
+func (c *Controller) createListener() (*listener.Listener, error) {
+	accessLog, err := anypb.New(&stdout.StdoutAccessLog{
+		AccessLogFormat: &stdout.StdoutAccessLog_LogFormat{
+			LogFormat: &core.SubstitutionFormatString{
+				Format: &core.SubstitutionFormatString_TextFormat{TextFormat: accessLogFormat},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal access log config: %w", err)
+	}
+
+	accessLogs := []*accesslog.AccessLog{
+		{
+			Name:       "envoy.access_loggers.stdout",
+			ConfigType: &accesslog.AccessLog_TypedConfig{TypedConfig: accessLog},
+		},
+	}
+	if c.config.ALS {
+		grpcLog, err := alsAccessLog()
+		if err != nil {
+			return nil, err
+		}
+		accessLogs = append(accessLogs, grpcLog)
+	}
+
+	routerConfig, err := anypb.New(&router.Router{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal router config: %w", err)
+	}
+
+	manager, err := anypb.New(&hcm.HttpConnectionManager{
+		CodecType:  hcm.HttpConnectionManager_AUTO,
+		StatPrefix: "wavefront_ingress",
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource:    adsConfigSource(),
+				RouteConfigName: routeConfigName,
+			},
+		},
+		AccessLog: accessLogs,
+		HttpFilters: []*hcm.HttpFilter{
+			{
+				Name:       wellknown.Router,
+				ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: routerConfig},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal http connection manager: %w", err)
+	}
+
+	downstreamTLS, err := c.downstreamTransportSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	return &listener.Listener{
+		Name: listenerName,
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.SocketAddress_TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: uint32(c.config.ListenerPort),
+					},
+				},
+			},
+		},
+		FilterChains: []*listener.FilterChain{
+			{
+				Filters: []*listener.Filter{
+					{
+						Name:       wellknown.HTTPConnectionManager,
+						ConfigType: &listener.Filter_TypedConfig{TypedConfig: manager},
+					},
+				},
+				TransportSocket: downstreamTLS,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeKeyPattern matches Envoy runtime key names.
+var runtimeKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// runtimeEntry is one key of the global runtime layer as served by the
+// /runtime API.
+type runtimeEntry struct {
+	Value     interface{} `json:"value"`
+	Type      string      `json:"type"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	ReadOnly  bool        `json:"read_only,omitempty"`
+}
+
+// runtimeUpdate is the body of PUT /runtime/{key}.
+type runtimeUpdate struct {
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type"`
+	TTL   string          `json:"ttl"`
+}
+
+func runtimeType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "unknown"
+}
+
+// parseRuntimeValue decodes a value as the requested type. Strings are
+// accepted for bool and number so values can come from the command line.
+// Without a type the JSON type is kept.
+func parseRuntimeValue(raw json.RawMessage, valueType string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("invalid value: %w", err)
+	}
+	s, isString := value.(string)
+
+	switch valueType {
+	case "":
+		if t := runtimeType(value); t == "unknown" {
+			return nil, fmt.Errorf("value must be a bool, number or string")
+		}
+		return value, nil
+	case "bool":
+		if isString {
+			return strconv.ParseBool(s)
+		}
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case "number":
+		if isString {
+			return strconv.ParseFloat(s, 64)
+		}
+		if n, ok := value.(float64); ok {
+			return n, nil
+		}
+	case "string":
+		if isString {
+			return s, nil
+		}
+		return strings.TrimSpace(string(raw)), nil
+	default:
+		return nil, fmt.Errorf("unknown type %q (bool, number, string)", valueType)
+	}
+	return nil, fmt.Errorf("value is not a %s", valueType)
+}
+
+// expireRuntime drops runtime keys whose TTL has passed. The caller holds
+// c.mu.
+func (c *Controller) expireRuntime(now time.Time) {
+	for key, expiresAt := range c.runtimeExpiry {
+		if !now.Before(expiresAt) {
+			delete(c.runtimeValues, key)
+			delete(c.runtimeExpiry, key)
+			log.Printf("Runtime key %s expired", key)
+		}
+	}
+}
+
+// runtimeEntries lists the global runtime layer, including the read-only
+// capture.enabled key. The caller holds c.mu.
+func (c *Controller) runtimeEntries() map[string]*runtimeEntry {
+	entries := map[string]*runtimeEntry{
+		captureRTDSKey: {Value: c.captureRate * 100, Type: "number", ReadOnly: true},
+	}
+	for key, value := range c.runtimeValues {
+		if key == captureRTDSKey {
+			continue
+		}
+		entry := &runtimeEntry{Value: value, Type: runtimeType(value)}
+		if expiresAt, ok := c.runtimeExpiry[key]; ok {
+			entry.ExpiresAt = &expiresAt
+		}
+		entries[key] = entry
+	}
+	return entries
+}
+
+// handleRuntime serves /runtime (GET lists every key) and /runtime/{key}:
+// GET reads a key, PUT sets it from {"value": ..., "type": "bool|number|string",
+// "ttl": "30m"} and DELETE removes it. Keys are materialized into the RTDS
+// layer of every Envoy; expired keys are removed within one discovery
+// interval. capture.enabled belongs to the capture API and "role" is
+// reserved for /runtime/role.
+func (c *Controller) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/runtime"), "/")
+
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		writeJSON(w, c.runtimeEntries())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !c.requireLeader(w) {
+			return
+		}
+		if !runtimeKeyPattern.MatchString(key) || key == captureRTDSKey {
+			http.Error(w, fmt.Sprintf("Invalid or reserved runtime key %q", key), http.StatusBadRequest)
+			return
+		}
+		var update runtimeUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Value == nil {
+			http.Error(w, `Body must be {"value": ..., "type": ..., "ttl": ...}`, http.StatusBadRequest)
+			return
+		}
+		value, err := parseRuntimeValue(update.Value, update.Type)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if update.TTL != "" {
+			if ttl, err = time.ParseDuration(update.TTL); err != nil || ttl <= 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c.mu.Lock()
+		c.runtimeValues[key] = value
+		delete(c.runtimeExpiry, key)
+		if ttl > 0 {
+			c.runtimeExpiry[key] = time.Now().UTC().Add(ttl)
+		}
+		c.reapplySnapshot()
+		c.mu.Unlock()
+		log.Printf("Runtime key %s set to %v (ttl %s)", key, value, ttl)
+	case http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		c.mu.Lock()
+		_, ok := c.runtimeValues[key]
+		delete(c.runtimeValues, key)
+		delete(c.runtimeExpiry, key)
+		if ok {
+			c.reapplySnapshot()
+		}
+		c.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("Runtime key %s not set", key), http.StatusNotFound)
+			return
+		}
+		log.Printf("Runtime key %s removed", key)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.runtimeEntries()[key]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Runtime key %s not set", key), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, entry)
+}
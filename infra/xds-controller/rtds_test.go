@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuntimeLayerExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := testController(localityZoneLocal)
+	c.runtimeValues = map[string]interface{}{
+		"feature.kept":    true,
+		"feature.expired": true,
+		"feature.expires": true,
+		captureRTDSKey:    5.0, // never served over the capture rate
+	}
+	c.runtimeExpiry = map[string]time.Time{
+		"feature.expired": now.Add(-time.Second),
+		"feature.expires": now, // expiry is inclusive
+	}
+	c.roleRuntime["edge"] = map[string]interface{}{"feature.expired": false}
+
+	tests := []struct {
+		name string
+		role string
+		now  time.Time
+		want map[string]interface{}
+	}{
+		{"at expiry", "", now, map[string]interface{}{
+			captureRTDSKey: 50.0, "feature.kept": true,
+		}},
+		{"before expiry", "", now.Add(-time.Minute), map[string]interface{}{
+			captureRTDSKey: 50.0, "feature.kept": true, "feature.expired": true, "feature.expires": true,
+		}},
+		{"zero time", "", time.Time{}, map[string]interface{}{
+			captureRTDSKey: 50.0, "feature.kept": true, "feature.expired": true, "feature.expires": true,
+		}},
+		{"role override outlives the global key", "edge", now, map[string]interface{}{
+			captureRTDSKey: 50.0, "feature.kept": true, "feature.expired": false,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := c.runtimeLayer(tt.role, 0.5, tt.now).Layer.AsMap()
+			if len(fields) != len(tt.want) {
+				t.Errorf("layer = %v, want %v", fields, tt.want)
+			}
+			for key, want := range tt.want {
+				if got, ok := fields[key]; !ok || got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+
+	c.expireRuntime(now)
+	if _, ok := c.runtimeValues["feature.expired"]; ok {
+		t.Error("expireRuntime kept an expired key")
+	}
+	if _, ok := c.runtimeExpiry["feature.expires"]; ok {
+		t.Error("expireRuntime kept the expiry of a key expiring now")
+	}
+	if _, ok := c.runtimeValues["feature.kept"]; !ok {
+		t.Error("expireRuntime dropped a key without a TTL")
+	}
+}
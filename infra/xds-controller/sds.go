@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// SDS secret names referenced by the generated listener and clusters.
+const (
+	serverCertSecret = "loadgen_server_cert"
+	clientCertSecret = "loadgen_client_cert"
+	caSecret         = "loadgen_ca"
+)
+
+// certBundle is PEM material fetched from a secret source.
+type certBundle struct {
+	Cert []byte
+	Key  []byte
+	CA   []byte
+}
+
+// certSource fetches the current version of a certificate.
+type certSource interface {
+	Fetch(ctx context.Context) (*certBundle, error)
+	String() string
+}
+
+// kubeSecretSource reads a kubernetes.io/tls secret.
+type kubeSecretSource struct {
+	client    *kubeClient
+	namespace string
+	name      string
+}
+
+func (s *kubeSecretSource) String() string { return "k8s:" + s.namespace + "/" + s.name }
+
+func (s *kubeSecretSource) Fetch(ctx context.Context) (*certBundle, error) {
+	resp, err := s.client.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", s.namespace, s.name), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", s, err)
+	}
+	defer resp.Body.Close()
+
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("failed to decode secret %s: %w", s, err)
+	}
+
+	bundle := &certBundle{}
+	for key, dst := range map[string]*[]byte{"tls.crt": &bundle.Cert, "tls.key": &bundle.Key, "ca.crt": &bundle.CA} {
+		if encoded, ok := secret.Data[key]; ok {
+			if *dst, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+				return nil, fmt.Errorf("failed to decode %s of secret %s: %w", key, s, err)
+			}
+		}
+	}
+	return bundle, nil
+}
+
+// secretManagerSource reads the latest version of a Secret Manager secret
+// holding a PEM bundle: certificates followed by the private key.
+type secretManagerSource struct {
+	service *secretmanager.Service
+	name    string // projects/P/secrets/S
+}
+
+func (s *secretManagerSource) String() string { return "gsm:" + s.name }
+
+func (s *secretManagerSource) Fetch(ctx context.Context) (*certBundle, error) {
+	resp, err := s.service.Projects.Secrets.Versions.Access(s.name + "/versions/latest").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret %s: %w", s.name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret %s: %w", s.name, err)
+	}
+	return splitPEMBundle(data), nil
+}
+
+// splitPEMBundle separates certificates from the private key. All
+// certificates also serve as the CA bundle when the source is used for
+// validation.
+func splitPEMBundle(data []byte) *certBundle {
+	bundle := &certBundle{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		encoded := pem.EncodeToMemory(block)
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			bundle.Key = append(bundle.Key, encoded...)
+		} else {
+			bundle.Cert = append(bundle.Cert, encoded...)
+		}
+	}
+	bundle.CA = bundle.Cert
+	return bundle
+}
+
+// secretSources resolves the -sds-* flags into sources keyed by secret name.
+func (c *Controller) secretSources(ctx context.Context) (map[string]certSource, error) {
+	flags := map[string]string{
+		serverCertSecret: c.config.SDSServerCert,
+		clientCertSecret: c.config.SDSClientCert,
+		caSecret:         c.config.SDSCA,
+	}
+
+	var kube *kubeClient
+	var gsm *secretmanager.Service
+	sources := make(map[string]certSource)
+	for name, spec := range flags {
+		if spec == "" {
+			continue
+		}
+		kind, ref, _ := strings.Cut(spec, ":")
+		switch kind {
+		case "k8s":
+			namespace, secret, ok := strings.Cut(ref, "/")
+			if !ok || namespace == "" || secret == "" {
+				return nil, fmt.Errorf("invalid secret source %q, expected k8s:namespace/name", spec)
+			}
+			if kube == nil {
+				var err error
+				if kube, err = newInClusterKubeClient(c.config.KubeAPIServer); err != nil {
+					return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+				}
+			}
+			sources[name] = &kubeSecretSource{client: kube, namespace: namespace, name: secret}
+		case "gsm":
+			if !strings.HasPrefix(ref, "projects/") || !strings.Contains(ref, "/secrets/") {
+				return nil, fmt.Errorf("invalid secret source %q, expected gsm:projects/P/secrets/S", spec)
+			}
+			if gsm == nil {
+				var err error
+				if gsm, err = secretmanager.NewService(ctx); err != nil {
+					return nil, fmt.Errorf("failed to create secret manager client: %w", err)
+				}
+			}
+			sources[name] = &secretManagerSource{service: gsm, name: ref}
+		default:
+			return nil, fmt.Errorf("unknown secret source %q (k8s:, gsm:)", spec)
+		}
+	}
+	return sources, nil
+}
+
+// refreshSecrets fetches every configured secret. A failed fetch keeps the
+// last good version so Envoys never lose a certificate to a transient
+// error. The caller holds c.mu.
+func (c *Controller) refreshSecrets(ctx context.Context) {
+	for name, source := range c.certSources {
+		bundle, err := source.Fetch(ctx)
+		if err != nil {
+			log.Printf("Failed to refresh SDS secret %s from %s: %v", name, source, err)
+			continue
+		}
+		c.secrets[name] = bundle
+	}
+}
+
+func inlineBytes(data []byte) *core.DataSource {
+	return &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: data}}
+}
+
+// createSecrets builds the SDS resources from the fetched bundles.
+func (c *Controller) createSecrets() []types.Resource {
+	var secrets []types.Resource
+	for _, name := range []string{serverCertSecret, clientCertSecret} {
+		if bundle, ok := c.secrets[name]; ok {
+			secrets = append(secrets, &tls.Secret{
+				Name: name,
+				Type: &tls.Secret_TlsCertificate{
+					TlsCertificate: &tls.TlsCertificate{
+						CertificateChain: inlineBytes(bundle.Cert),
+						PrivateKey:       inlineBytes(bundle.Key),
+					},
+				},
+			})
+		}
+	}
+	if bundle, ok := c.secrets[caSecret]; ok {
+		ca := bundle.CA
+		if len(ca) == 0 {
+			ca = bundle.Cert
+		}
+		secrets = append(secrets, &tls.Secret{
+			Name: caSecret,
+			Type: &tls.Secret_ValidationContext{
+				ValidationContext: &tls.CertificateValidationContext{TrustedCa: inlineBytes(ca)},
+			},
+		})
+	}
+	return secrets
+}
+
+func sdsSecretConfig(name string) *tls.SdsSecretConfig {
+	return &tls.SdsSecretConfig{Name: name, SdsConfig: adsConfigSource()}
+}
+
+// downstreamTransportSocket terminates TLS on the ingress listener with the
+// SDS server certificate, requiring client certificates when a CA is
+// configured. It returns nil without a server certificate.
+func (c *Controller) downstreamTransportSocket() (*core.TransportSocket, error) {
+	if _, ok := c.certSources[serverCertSecret]; !ok {
+		return nil, nil
+	}
+	tlsContext := &tls.DownstreamTlsContext{
+		CommonTlsContext: &tls.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*tls.SdsSecretConfig{sdsSecretConfig(serverCertSecret)},
+		},
+	}
+	if _, ok := c.certSources[caSecret]; ok && c.config.SDSRequireClientCert {
+		tlsContext.CommonTlsContext.ValidationContextType = &tls.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: sdsSecretConfig(caSecret),
+		}
+		tlsContext.RequireClientCertificate = wrapperspb.Bool(true)
+	}
+	return transportSocket(tlsContext)
+}
+
+// upstreamTransportSocket originates TLS to collectors and capture agents,
+// presenting the client certificate and validating against the CA when
+// configured. It returns nil when neither is configured.
+func (c *Controller) upstreamTransportSocket() (*core.TransportSocket, error) {
+	_, hasClient := c.certSources[clientCertSecret]
+	_, hasCA := c.certSources[caSecret]
+	if !hasClient && !hasCA {
+		return nil, nil
+	}
+	common := &tls.CommonTlsContext{}
+	if hasClient {
+		common.TlsCertificateSdsSecretConfigs = []*tls.SdsSecretConfig{sdsSecretConfig(clientCertSecret)}
+	}
+	if hasCA {
+		common.ValidationContextType = &tls.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: sdsSecretConfig(caSecret),
+		}
+	}
+	return transportSocket(&tls.UpstreamTlsContext{CommonTlsContext: common})
+}
+
+func transportSocket(tlsContext proto.Message) (*core.TransportSocket, error) {
+	typed, err := anypb.New(tlsContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal TLS context: %w", err)
+	}
+	return &core.TransportSocket{
+		Name:       wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: typed},
+	}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// endpointLB is the weight and health status an endpoint gets in EDS.
+type endpointLB struct {
+	Weight       uint32 `json:"weight"`
+	HealthStatus string `json:"health_status"`
+}
+
+// endpointChange is an endpoint present in both snapshots whose health or
+// load-balancing changes.
+type endpointChange struct {
+	Endpoint
+	From endpointLB `json:"from"`
+	To   endpointLB `json:"to"`
+}
+
+// clusterDiff lists the endpoint changes of one cluster.
+type clusterDiff struct {
+	Added   []endpointStatus `json:"added"`
+	Removed []endpointStatus `json:"removed"`
+	Changed []endpointChange `json:"changed"`
+}
+
+func (d *clusterDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// valueChange is a runtime key whose value changes; a nil side means the
+// key is absent.
+type valueChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+func endpointKey(ep Endpoint) string {
+	return fmt.Sprintf("%s:%d", ep.Address, ep.Port)
+}
+
+// endpointDiff compares the endpoints of a cluster as last applied with
+// freshly discovered ones. The caller holds c.mu.
+func (c *Controller) endpointDiff(current, next []Endpoint, now time.Time) *clusterDiff {
+	diff := &clusterDiff{Added: []endpointStatus{}, Removed: []endpointStatus{}, Changed: []endpointChange{}}
+	status := func(ep Endpoint) endpointStatus {
+		weight, healthStatus := c.endpointLoadBalancing(ep, now)
+		status := endpointStatus{Endpoint: ep, Weight: weight, HealthStatus: healthStatus.String(), Reason: c.endpointReason(ep, now)}
+		status.Receiving = status.Reason == "" || (weight > 0 && healthStatus == core.HealthStatus_UNKNOWN)
+		return status
+	}
+
+	before := make(map[string]Endpoint, len(current))
+	for _, ep := range current {
+		before[endpointKey(ep)] = ep
+	}
+	for _, ep := range next {
+		key := endpointKey(ep)
+		old, ok := before[key]
+		delete(before, key)
+		if !ok {
+			diff.Added = append(diff.Added, status(ep))
+			continue
+		}
+		from, to := status(old), status(ep)
+		if from.Weight != to.Weight || from.HealthStatus != to.HealthStatus || old.Healthy != ep.Healthy {
+			diff.Changed = append(diff.Changed, endpointChange{
+				Endpoint: ep,
+				From:     endpointLB{Weight: from.Weight, HealthStatus: from.HealthStatus},
+				To:       endpointLB{Weight: to.Weight, HealthStatus: to.HealthStatus},
+			})
+		}
+	}
+	for _, ep := range before {
+		diff.Removed = append(diff.Removed, status(ep))
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		return endpointKey(diff.Removed[i].Endpoint) < endpointKey(diff.Removed[j].Endpoint)
+	})
+	return diff
+}
+
+// runtimeDiff compares the runtime layer each connected node group was
+// last sent with the one it would get next at captureRate, once the keys
+// expired by now are dropped. Groups without changes are left out. The
+// caller holds c.mu.
+func (c *Controller) runtimeDiff(captureRate float64, now time.Time) map[string]map[string]valueChange {
+	diffs := make(map[string]map[string]valueChange)
+	for _, group := range c.nodeGroups.Groups() {
+		current := make(map[string]interface{})
+		if snapshot, err := c.cache.GetSnapshot(group.key()); err == nil {
+			for _, res := range snapshot.GetResources(resource.RuntimeType) {
+				if layer, ok := res.(*runtime.Runtime); ok {
+					current = layer.GetLayer().AsMap()
+				}
+			}
+		}
+		next := c.runtimeLayer(group.Role, captureRate, now).GetLayer().AsMap()
+
+		changes := make(map[string]valueChange)
+		for key, value := range next {
+			if old, ok := current[key]; !ok || !reflect.DeepEqual(old, value) {
+				changes[key] = valueChange{From: current[key], To: value}
+			}
+		}
+		for key, value := range current {
+			if _, ok := next[key]; !ok {
+				changes[key] = valueChange{From: value}
+			}
+		}
+		if len(changes) > 0 {
+			diffs[group.key()] = changes
+		}
+	}
+	return diffs
+}
+
+// handleSnapshotDiff serves GET /snapshot/diff: it discovers every cluster
+// and reports how the next snapshot would differ from the current one
+// (endpoints added, removed or changing weight or health, and runtime
+// changes per node group) without pushing anything. ?capture_rate=
+// previews a capture rate in percent. Only the leader builds snapshots.
+func (c *Controller) handleSnapshotDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.requireLeader(w) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	captureRate := c.captureRate
+	if c.captureRamp != nil {
+		captureRate = c.captureRamp.value(time.Now()) / 100
+	}
+	if value := r.URL.Query().Get("capture_rate"); value != "" {
+		var percent float64
+		if _, err := fmt.Sscanf(value, "%f", &percent); err != nil || percent < 0 || percent > 100 {
+			http.Error(w, "capture_rate must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		captureRate = percent / 100
+	}
+
+	now := time.Now()
+	clusters := make(map[string]*clusterDiff, len(c.clusters))
+	unchanged := true
+	for i := range c.clusters {
+		spec := &c.clusters[i]
+		next, err := c.discoverClusterEndpoints(r.Context(), spec)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to discover %s endpoints: %v", spec.Name, err), http.StatusBadGateway)
+			return
+		}
+		diff := c.endpointDiff(c.endpoints[spec.Name], next, now)
+		clusters[spec.Name] = diff
+		unchanged = unchanged && diff.empty()
+	}
+	runtimeChanges := c.runtimeDiff(captureRate, now)
+
+	writeJSON(w, map[string]interface{}{
+		"version":      c.version,
+		"next_version": c.version + 1,
+		"unchanged":    unchanged && len(runtimeChanges) == 0,
+		"clusters":     clusters,
+		"runtime":      runtimeChanges,
+	})
+}
+
+// captureDryRun answers a capture change with ?dry_run=true: the rate it
+// would set and the runtime each node group would get, without applying
+// anything.
+func (c *Controller) captureDryRun(w http.ResponseWriter, percent float64, ramp *ramp) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	writeJSON(w, map[string]interface{}{
+		"dry_run":      true,
+		"capture_rate": valueChange{From: c.captureRate * 100, To: percent},
+		"ramp":         ramp,
+		"runtime":      c.runtimeDiff(percent/100, time.Now()),
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+)
+
+const canaryClusterName = "collector_canary_cluster"
+
+// canaryEnabled reports whether a canary collector cluster is configured.
+// The caller holds c.mu.
+func (c *Controller) canaryEnabled() bool {
+	return c.clusterByRole(roleCanary) != nil
+}
+
+// collectorRouteAction routes ingress to the collectors, split by weight
+// between the main and canary clusters while a canary is receiving traffic.
+// The caller holds c.mu.
+func (c *Controller) collectorRouteAction(action *route.RouteAction) {
+	collector, canary := c.clusterByRole(roleCollector), c.clusterByRole(roleCanary)
+	weight := uint32(math.Round(c.canaryWeight))
+	switch {
+	case canary == nil || weight == 0:
+		action.ClusterSpecifier = &route.RouteAction_Cluster{Cluster: collector.Name}
+	case weight >= 100:
+		action.ClusterSpecifier = &route.RouteAction_Cluster{Cluster: canary.Name}
+	default:
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+			WeightedClusters: &route.WeightedCluster{
+				Clusters: []*route.WeightedCluster_ClusterWeight{
+					{Name: collector.Name, Weight: wrapperspb.UInt32(100 - weight)},
+					{Name: canary.Name, Weight: wrapperspb.UInt32(weight)},
+				},
+			},
+		}
+	}
+}
+
+// startSplitRamp runs the loop for c.splitRamp unless one is already
+// running. The caller holds c.mu.
+func (c *Controller) startSplitRamp() {
+	if c.splitRamp == nil || c.splitRampStop != nil {
+		return
+	}
+	c.splitRampStop = make(chan struct{})
+	go c.splitRampLoop(c.splitRampStop)
+}
+
+// stopSplitRamp aborts an active traffic split ramp, holding the current
+// weight. It reports whether a ramp was active. The caller holds c.mu.
+func (c *Controller) stopSplitRamp() bool {
+	active := c.splitRamp != nil
+	if c.splitRampStop != nil {
+		close(c.splitRampStop)
+		c.splitRampStop = nil
+	}
+	c.splitRamp = nil
+	return active
+}
+
+// splitRampLoop advances an active traffic split ramp. Each step only
+// rebuilds the snapshot from the last discovered endpoints. Like the
+// capture ramp, the split ramp is part of the shared state, so a new
+// leader resumes it and a replica losing leadership stops stepping.
+func (c *Controller) splitRampLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(rampStepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			select {
+			case <-stop:
+				// Replaced or aborted while waiting for the lock
+				c.mu.Unlock()
+				return
+			default:
+			}
+			if c.splitRamp == nil || !c.isLeader() {
+				c.splitRampStop = nil
+				c.mu.Unlock()
+				return
+			}
+			c.canaryWeight = c.splitRamp.value(now)
+			finished := c.splitRamp.done(now)
+			if finished {
+				c.splitRamp = nil
+				c.splitRampStop = nil
+				log.Printf("Traffic split ramp finished at %.1f%% canary", c.canaryWeight)
+			}
+			c.reapplySnapshot()
+			c.mu.Unlock()
+			if finished {
+				return
+			}
+		}
+	}
+}
+
+// reapplySnapshot pushes a new version built from the last discovered
+// endpoints, for changes that do not need rediscovery. The caller holds c.mu.
+func (c *Controller) reapplySnapshot() {
+	if !c.isLeader() {
+		return
+	}
+	c.version++
+	if err := c.applySnapshot(c.ctx, c.endpoints); err != nil {
+		log.Printf("Failed to apply snapshot: %v", err)
+		return
+	}
+	c.publishState(c.ctx)
+}
+
+// handleTrafficSplit serves GET (current split) and POST
+// ?canary=<percent>[&duration=<d>] which moves the canary share to the
+// target, immediately or ramped linearly over the duration. DELETE aborts
+// a ramp, holding the current weight.
+func (c *Controller) handleTrafficSplit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !c.requireLeader(w) {
+			return
+		}
+		c.mu.RLock()
+		enabled := c.canaryEnabled()
+		c.mu.RUnlock()
+		if !enabled {
+			http.Error(w, "No canary collector cluster configured", http.StatusBadRequest)
+			return
+		}
+
+		target, err := strconv.ParseFloat(r.URL.Query().Get("canary"), 64)
+		if err != nil || target < 0 || target > 100 {
+			http.Error(w, "canary must be a percentage between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if d := r.URL.Query().Get("duration"); d != "" {
+			if duration, err = time.ParseDuration(d); err != nil || duration < 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c.mu.Lock()
+		c.stopSplitRamp()
+		if duration > 0 {
+			c.splitRamp = &ramp{From: c.canaryWeight, To: target, Start: time.Now().UTC(), Duration: duration}
+			c.startSplitRamp()
+			c.publishState(r.Context())
+			log.Printf("Ramping canary traffic from %.1f%% to %.1f%% over %s", c.canaryWeight, target, duration)
+		} else {
+			c.canaryWeight = target
+			c.reapplySnapshot()
+			log.Printf("Canary traffic set to %.1f%%", target)
+		}
+		c.mu.Unlock()
+	case http.MethodDelete:
+		if !c.requireLeader(w) {
+			return
+		}
+		c.mu.Lock()
+		if c.stopSplitRamp() {
+			c.publishState(r.Context())
+			log.Printf("Traffic split ramp aborted at %.1f%% canary", c.canaryWeight)
+		}
+		c.mu.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	status := map[string]interface{}{
+		"canary_enabled": c.canaryEnabled(),
+		"canary_weight":  c.canaryWeight,
+		"main_weight":    100 - c.canaryWeight,
+		"ramp":           c.splitRamp,
+	}
+	if canary := c.clusterByRole(roleCanary); canary != nil {
+		status["canary_hosts"] = len(c.endpoints[canary.Name])
+	}
+	c.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to encode traffic split: %v", err)
+	}
+}
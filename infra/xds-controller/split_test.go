@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+)
+
+func TestCollectorRouteAction(t *testing.T) {
+	tests := []struct {
+		name         string
+		canary       bool
+		weight       float64
+		wantCluster  string         // a single cluster, or
+		wantWeighted map[string]int // the weighted split
+	}{
+		{"no canary", false, 30, collectorClusterName, nil},
+		{"canary at zero", true, 0, collectorClusterName, nil},
+		{"canary rounds to zero", true, 0.4, collectorClusterName, nil},
+		{"split", true, 25, "", map[string]int{collectorClusterName: 75, canaryClusterName: 25}},
+		{"split rounds", true, 12.6, "", map[string]int{collectorClusterName: 87, canaryClusterName: 13}},
+		{"canary rounds to all", true, 99.6, canaryClusterName, nil},
+		{"all to canary", true, 100, canaryClusterName, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testController(localityZoneLocal)
+			if tt.canary {
+				c.clusters = append(c.clusters, ClusterSpec{Name: canaryClusterName, Role: roleCanary, ConnectTimeout: time.Second})
+			}
+			c.canaryWeight = tt.weight
+
+			action := &route.RouteAction{}
+			c.collectorRouteAction(action)
+
+			if tt.wantWeighted == nil {
+				if got := action.GetCluster(); got != tt.wantCluster {
+					t.Errorf("routed to %q (%v), want %q", got, action.ClusterSpecifier, tt.wantCluster)
+				}
+				return
+			}
+			clusters := action.GetWeightedClusters().GetClusters()
+			if len(clusters) != len(tt.wantWeighted) {
+				t.Fatalf("split %v, want %v", clusters, tt.wantWeighted)
+			}
+			total := 0
+			for _, cluster := range clusters {
+				weight := int(cluster.GetWeight().GetValue())
+				if weight != tt.wantWeighted[cluster.Name] {
+					t.Errorf("%s weight = %d, want %d", cluster.Name, weight, tt.wantWeighted[cluster.Name])
+				}
+				total += weight
+			}
+			if total != 100 {
+				t.Errorf("weights sum to %d, want 100", total)
+			}
+		})
+	}
+}
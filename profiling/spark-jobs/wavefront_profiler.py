@@ -27,8 +27,9 @@ from pyspark.sql.functions import (
     when, isnan, isnull, size, explode, collect_list,
     percentile_approx, monotonically_increasing_id,
     window, avg, stddev, variance, max as spark_max, 
-    min as spark_min, sum as spark_sum
+    min as spark_min, sum as spark_sum, array_sort, map_entries, expr, lag
 )
+from pyspark.sql.window import Window
 from pyspark.sql.types import (
     StructType, StructField, StringType, DoubleType, 
     LongType, MapType, ArrayType, BooleanType, IntegerType
@@ -41,6 +42,32 @@ import seaborn as sns
 logging.basicConfig(level=logging.INFO)
 logger = logging.getLogger(__name__)
 
+# Lines an hour of the intensity curve needs for its own distributions
+SEASONALITY_MIN_SAMPLES = 100
+
+# Lags, in lines of a series, whose value autocorrelation is profiled
+AUTOCORRELATION_LAGS = [1, 2, 5, 10]
+
+# Seconds from either end of the capture within which a series' first or
+# last line is taken as the capture's edge rather than a birth or retirement
+CHURN_EDGE_SECONDS = 300
+
+# Share of the sources carrying a tag that must keep one value throughout
+# for it to count as a host-level tag
+HOST_TAG_FIXED_SHARE = 0.95
+
+# Compression of recorded t-digests; about half as many centroids result
+TDIGEST_COMPRESSION = 100
+
+# Relative width of the buckets centroids are pre-merged in before the
+# digest is built
+TDIGEST_BUCKET_WIDTH = 0.01
+
+# Intensity curve lengths in minutes; captures of a week or more get the
+# weekly one, so weekends show
+DAILY_MINUTES = 1440
+WEEKLY_MINUTES = 10080
+
 class WavefrontParser:
     """Parser for Wavefront line protocol with full semantic support."""
     
@@ -156,38 +183,35 @@ class WavefrontParser:
     
     @staticmethod
     def _parse_histogram(histo_match, full_line: str) -> Optional[Dict]:
-        """Parse histogram: !M|!H|!D [timestamp] #count centroid..."""
-        granularity = histo_match.group(1)  # M, H, or D
+        """Parse histogram: !M|!H|!D [timestamp] #count mean [#count mean ...] <metric> source=<source> [tags]"""
+        granularity = histo_match.group(1)[1:]  # M, H, or D
         timestamp = int(histo_match.group(2)) if histo_match.group(2) else None
-        count = int(histo_match.group(3))
-        centroids_str = histo_match.group(4)
         
-        # Parse centroids
-        centroid_parts = centroids_str.split()
+        # Centroids are #<count> <mean> pairs, up to the metric name
+        parts = f"#{histo_match.group(3)} {histo_match.group(4)}".split()
         centroids = []
         i = 0
-        while i < len(centroid_parts):
+        while i + 1 < len(parts) and parts[i].startswith('#'):
             try:
-                if i + 1 < len(centroid_parts):
-                    # Format: count value
-                    c_count = int(centroid_parts[i])
-                    c_value = float(centroid_parts[i + 1])
-                    centroids.append({"count": c_count, "value": c_value})
-                    i += 2
-                else:
-                    break
-            except (ValueError, IndexError):
-                break
+                centroids.append({"count": int(parts[i][1:]), "value": float(parts[i + 1])})
+            except ValueError:
+                return None
+            i += 2
         
-        # Next line should contain metric name, source, and tags
-        # In practice, we'd need to handle this in the calling context
+        # The rest is a metric's name, source and tags
+        metric = WavefrontParser._parse_metric(' '.join(parts[i:i + 1] + ["0"] + parts[i + 1:]))
+        if metric is None or not centroids:
+            return None
         
         return {
             "type": "histogram",
             "granularity": granularity,
             "timestamp": timestamp,
-            "count": count,
+            "count": sum(c["count"] for c in centroids),
             "centroids": centroids,
+            "metric": metric["metric"],
+            "source": metric["source"],
+            "tags": metric["tags"],
             "line_length": len(full_line)
         }
     
@@ -545,6 +569,10 @@ class WavefrontProfiler:
         
         stats = {
             "sample_count": metrics_df.count(),
+            "series_count": (metrics_df
+                            .select(col("source"), array_sort(map_entries(col("tags"))).alias("tags"))
+                            .distinct()
+                            .count()),
             "source_distribution": self._compute_categorical_distribution(metrics_df, "source"),
             "tag_distributions": {},
             "tag_cooccurrence": self._compute_tag_cooccurrence(metrics_df),
@@ -594,6 +622,14 @@ class WavefrontProfiler:
                 "frequency": frequency
             })
         
+        # Distinct values and the share of rows beyond the top values, from
+        # which the generator synthesizes a power-law tail
+        tail_stats = (df
+                     .filter(col(column).isNotNull())
+                     .agg(countDistinct(column).alias("distinct"), count("*").alias("rows"))
+                     .collect()[0])
+        tail_rows = tail_stats.rows - sum(row["count"] for row in value_counts)
+        
         # Compute entropy
         entropy = 0.0
         for item in top_values:
@@ -603,7 +639,8 @@ class WavefrontProfiler:
         
         return {
             "top_values": top_values,
-            "total_count": len(value_counts),
+            "total_count": max(tail_stats.distinct, 1),
+            "tail_mass": max(tail_rows, 0) / total_count,
             "entropy": entropy
         }
     
@@ -628,7 +665,34 @@ class WavefrontProfiler:
         # Create histogram bins based on quantiles
         bin_edges = np.linspace(quantiles[0], quantiles[-1], 33)  # 32 bins
         
-        # Count values in each bin (simplified - in practice use SQL histogram functions)
+        # Count values in each bin; values outside [p01, p99] belong to the tails
+        counts = [0] * 32
+        width = (quantiles[-1] - quantiles[0]) / 32
+        if width > 0:
+            in_range = df.where((col(column) >= quantiles[0]) & (col(column) <= quantiles[-1]))
+            bin_rows = (in_range
+                       .select(expr(f"least(cast(floor(({column} - {quantiles[0]}) / {width}) as int), 31)").alias("bin"))
+                       .groupBy("bin")
+                       .count()
+                       .collect())
+            for row in bin_rows:
+                counts[row.bin] = row["count"]
+        
+        # Values repeated often enough to be point masses (zeros, sentinels, constants)
+        total = df.where(col(column).isNotNull()).count()
+        point_masses = []
+        if total > 0:
+            repeated = (df
+                       .where(col(column).isNotNull())
+                       .groupBy(column)
+                       .count()
+                       .where(col("count") >= total * 0.01)
+                       .orderBy(col("count").desc())
+                       .limit(10)
+                       .collect())
+            point_masses = [{"value": row[column], "frequency": row["count"] / total}
+                            for row in repeated]
+        
         distribution = {
             "quantiles": {
                 "p01": quantiles[0],
@@ -638,7 +702,8 @@ class WavefrontProfiler:
                 "p99": quantiles[4]
             },
             "bins": bin_edges.tolist(),
-            "counts": [0] * 32,  # Placeholder - implement actual histogram
+            "counts": counts,
+            "point_masses": point_masses,
             "mean": stats_row.mean,
             "stddev": stats_row.stddev,
             "min": stats_row.min,
@@ -653,11 +718,32 @@ class WavefrontProfiler:
         # Sample records for co-occurrence analysis
         sampled = df.sample(0.1).limit(10000)
         
-        # Get all tag combinations (simplified - top pairs only)
+        # Joint value counts per tag-key pair
+        pair_counts = {}
+        for row in sampled.select("tags").collect():
+            tags = row.tags or {}
+            keys = sorted(tags)
+            for i, first in enumerate(keys):
+                for second in keys[i + 1:]:
+                    joint = pair_counts.setdefault((first, second), {})
+                    values = (tags[first], tags[second])
+                    joint[values] = joint.get(values, 0) + 1
+        
+        # Keep the pairs seen on most records, and their most frequent joint
+        # values as a share of the records carrying both keys
+        top_pairs = sorted(pair_counts.items(),
+                           key=lambda item: sum(item[1].values()),
+                           reverse=True)[:5]
         cooccurrence = []
-        
-        # This would involve complex SQL to compute all tag pair frequencies
-        # Simplified implementation for now
+        for (first, second), joint in top_pairs:
+            total = sum(joint.values())
+            for (first_value, second_value), count in sorted(joint.items(),
+                                                             key=lambda item: item[1],
+                                                             reverse=True)[:20]:
+                cooccurrence.append({
+                    "tags": {first: first_value, second: second_value},
+                    "frequency": count / total
+                })
         
         return cooccurrence[:100]  # Top 100 combinations
     
@@ -672,37 +758,173 @@ class WavefrontProfiler:
                    .select(col("window.start").alias("minute"), col("count"))
                    .orderBy("minute"))
         
-        minute_counts = [row.count for row in windowed.collect()]
+        minute_rows = windowed.collect()
+        minute_counts = [row["count"] for row in minute_rows]
         
         if not minute_counts:
             # Default flat pattern
-            minute_counts = [1.0] * 1440
-        
-        # Normalize to mean = 1.0
-        mean_count = np.mean(minute_counts)
-        if mean_count > 0:
-            intensity_curve = [c / mean_count for c in minute_counts]
-        else:
-            intensity_curve = [1.0] * len(minute_counts)
+            minute_counts = [1.0] * DAILY_MINUTES
         
-        # Pad or truncate to 1440 minutes (24 hours)
-        if len(intensity_curve) < 1440:
-            intensity_curve.extend([1.0] * (1440 - len(intensity_curve)))
-        elif len(intensity_curve) > 1440:
-            intensity_curve = intensity_curve[:1440]
+        intensity = self._compute_intensity_curve(minute_rows)
         
         # Compute burstiness metrics
         cv = np.std(minute_counts) / np.mean(minute_counts) if np.mean(minute_counts) > 0 else 0
         fano = np.var(minute_counts) / np.mean(minute_counts) if np.mean(minute_counts) > 0 else 1
         
         return {
-            "intensity_curve": intensity_curve,
+            **intensity,
             "burstiness": {
                 "coefficient_of_variation": cv,
                 "fano_factor": fano
-            }
+            },
+            "seasonality": self._compute_seasonality(metrics_df),
+            "value_autocorrelation": self._compute_value_autocorrelation(metrics_df)
         }
     
+    def _compute_intensity_curve(self, minute_rows: List) -> Dict:
+        """Fold per-minute line counts into a daily or weekly intensity curve.
+        
+        Minutes count from the capture's first, silent ones as zero. A
+        capture of two days or more has its linear trend fit and taken out
+        first, recorded as a trend component. Each minute of the curve is the
+        mean of that minute over the capture's cycles, normalized to mean 1;
+        minutes the capture never covered stay at 1. The curve's start is
+        recorded so the synthesizer keeps its phase of the day and week.
+        """
+        
+        if not minute_rows:
+            return {"intensity_curve": [1.0] * DAILY_MINUTES}
+        
+        first = minute_rows[0].minute
+        offsets = np.array([int((row.minute - first).total_seconds() // 60) for row in minute_rows])
+        span = int(offsets[-1]) + 1
+        counts = np.zeros(span)
+        counts[offsets] = [row["count"] for row in minute_rows]
+        if counts.mean() <= 0:
+            return {"intensity_curve": [1.0] * DAILY_MINUTES}
+        normalized = counts / counts.mean()
+        
+        trends = []
+        if span >= 2 * DAILY_MINUTES:
+            days = np.arange(span) / DAILY_MINUTES
+            slope, _ = np.polyfit(days, normalized, 1)
+            normalized = normalized - slope * (days - days.mean())
+            trends.append({"type": "linear", "per_day": float(slope)})
+        
+        period = WEEKLY_MINUTES if span >= WEEKLY_MINUTES else DAILY_MINUTES
+        phase = np.arange(span) % period
+        sums = np.bincount(phase, weights=normalized, minlength=period)
+        covered = np.bincount(phase, minlength=period)
+        curve = np.where(covered > 0, sums / np.maximum(covered, 1), 1.0)
+        curve = np.maximum(curve, 0.0)
+        if curve.mean() > 0:
+            curve = curve / curve.mean()
+        
+        intensity = {
+            "intensity_curve": curve.tolist(),
+            "intensity_curve_start": first.isoformat() + "Z"
+        }
+        if trends:
+            intensity["trends"] = trends
+        return intensity
+    
+    def _compute_value_autocorrelation(self, metrics_df: DataFrame) -> Dict:
+        """Compute the autocorrelation of each series' values at AUTOCORRELATION_LAGS.
+        
+        Each series (source and tags) is ordered by timestamp and its values
+        centred on its own mean; the autocorrelation at each lag is averaged
+        over the series, weighted by their pairs at that lag. Constant series
+        have none and are left out, as are series too short for the longest
+        lag. Smooth gauges come out near 1 and white noise near 0.
+        """
+        
+        max_lag = max(AUTOCORRELATION_LAGS)
+        series = ["source", "series_tags"]
+        ordered = Window.partitionBy(*series).orderBy("timestamp")
+        whole = Window.partitionBy(*series)
+        
+        centred = (metrics_df
+                  .filter(col("timestamp").isNotNull() & col("value").isNotNull())
+                  .withColumn("series_tags", array_sort(map_entries(col("tags"))))
+                  .withColumn("centred", col("value") - avg("value").over(whole)))
+        for k in AUTOCORRELATION_LAGS:
+            centred = centred.withColumn(f"lag_{k}", lag("centred", k).over(ordered))
+        
+        per_series = (centred
+                     .groupBy(*series)
+                     .agg(count("*").alias("n"),
+                          spark_sum(col("centred") * col("centred")).alias("variance"),
+                          *[spark_sum(col("centred") * col(f"lag_{k}")).alias(f"covariance_{k}")
+                            for k in AUTOCORRELATION_LAGS])
+                     .filter((col("variance") > 0) & (col("n") > max_lag + 2)))
+        
+        weighted = (per_series
+                   .agg(count("*").alias("series"),
+                        *[spark_sum(col(f"covariance_{k}") / col("variance") * (col("n") - k)).alias(f"acf_{k}")
+                          for k in AUTOCORRELATION_LAGS],
+                        *[spark_sum(col("n") - k).alias(f"pairs_{k}") for k in AUTOCORRELATION_LAGS])
+                   .collect()[0])
+        if not weighted.series:
+            return {"lags": AUTOCORRELATION_LAGS, "values": [], "series": 0}
+        
+        return {
+            "lags": AUTOCORRELATION_LAGS,
+            "values": [weighted[f"acf_{k}"] / weighted[f"pairs_{k}"] for k in AUTOCORRELATION_LAGS],
+            "series": weighted.series
+        }
+    
+    def _compute_seasonality(self, metrics_df: DataFrame) -> List[Dict]:
+        """Compute the distributions of each hour of the intensity curve.
+        
+        Hours count from the start of the capture, as the curve's minutes do,
+        so the divergence monitor can compare generated lines with the same
+        slice of the day rather than the all-day aggregate. Hours with too few
+        lines to estimate are left out.
+        """
+        
+        timed = metrics_df.filter(col("timestamp").isNotNull())
+        start = timed.agg(spark_min(col("timestamp").cast("double")).alias("start")).collect()[0].start
+        if start is None:
+            return []
+        
+        hourly = timed.withColumn(
+            "curve_hour",
+            expr(f"pmod(floor((cast(timestamp as double) - {start}) / 3600), 24)")
+        )
+        rows = (hourly
+               .groupBy("curve_hour")
+               .agg(count("*").alias("count"),
+                    percentile_approx("value", [0.01, 0.05, 0.5, 0.95, 0.99]).alias("q"))
+               .filter(col("count") >= SEASONALITY_MIN_SAMPLES)
+               .orderBy("curve_hour")
+               .collect())
+        
+        tag_keys = [row.key for row in (metrics_df
+                                        .select(explode(col("tags")).alias("tag"))
+                                        .select(col("tag.key"))
+                                        .distinct()
+                                        .collect())]
+        
+        slices = []
+        for row in rows:
+            hour_df = hourly.filter(col("curve_hour") == row.curve_hour)
+            slice_stats = {
+                "hour": int(row.curve_hour),
+                "sample_count": row["count"],
+                "source_distribution": self._compute_categorical_distribution(hour_df, "source"),
+                "tag_distributions": {},
+                "value_distribution": {
+                    "quantiles": dict(zip(["p01", "p05", "p50", "p95", "p99"], row.q))
+                }
+            }
+            for key in tag_keys:
+                slice_stats["tag_distributions"][key] = self._compute_categorical_distribution(
+                    hour_df.select(col(f"tags.{key}").alias("value")), "value"
+                )
+            slices.append(slice_stats)
+        
+        return slices
+    
     def _analyze_payload_characteristics(self, df: DataFrame) -> Dict:
         """Analyze payload size and error characteristics."""
         
@@ -721,9 +943,12 @@ class WavefrontProfiler:
     def _mine_string_patterns(self, df: DataFrame) -> Dict:
         """Mine string patterns for realistic generation."""
         
+        sources = [row.source for row in df.select("source").limit(1000).collect()]
         patterns = {
-            "source_patterns": self._extract_patterns(df, "source"),
-            "tag_value_patterns": {}
+            "source_patterns": self._extract_patterns_from_values(sources),
+            "tag_value_patterns": {},
+            "source_model": self._train_ngram_model(sources),
+            "tag_value_models": {}
         }
         
         # Get tag keys
@@ -743,16 +968,10 @@ class WavefrontProfiler:
             
             values = [r.value for r in tag_values]
             patterns["tag_value_patterns"][key] = self._extract_patterns_from_values(values)
+            patterns["tag_value_models"][key] = self._train_ngram_model(values)
         
         return patterns
     
-    def _extract_patterns(self, df: DataFrame, column: str) -> List[Dict]:
-        """Extract regex-like patterns from string values."""
-        
-        # Sample values
-        values = [row[column] for row in df.select(column).limit(1000).collect()]
-        return self._extract_patterns_from_values(values)
-    
     def _extract_patterns_from_values(self, values: List[str]) -> List[Dict]:
         """Extract patterns from list of string values."""
         
@@ -772,17 +991,46 @@ class WavefrontProfiler:
         
         return patterns[:5]  # Top 5 patterns
     
-    def _generalize_string(self, s: str) -> str:
-        """Convert string to regex-like pattern."""
+    def _train_ngram_model(self, values: List[str], order: int = 3,
+                           max_contexts: int = 5000) -> Dict:
+        """Count character transitions for Markov string generation.
         
-        # Replace digits with \d
-        pattern = re.sub(r'\d+', r'\\d+', s)
+        Each context is the previous `order` characters, shorter at the start
+        of a string; the empty next character marks the end of a string.
+        """
+        
+        transitions = {}
+        for value in values:
+            if not value:
+                continue
+            for i in range(len(value) + 1):
+                context = value[max(0, i - order):i]
+                next_char = value[i] if i < len(value) else ""
+                counts = transitions.setdefault(context, {})
+                counts[next_char] = counts.get(next_char, 0) + 1
+        
+        # Keep the most observed contexts; the generator backs off for the rest
+        if len(transitions) > max_contexts:
+            kept = sorted(transitions.items(), key=lambda item: sum(item[1].values()), reverse=True)
+            transitions = dict(kept[:max_contexts])
+        
+        return {
+            "order": order,
+            "transitions": transitions,
+            "max_length": max((len(v) for v in values if v), default=0)
+        }
+    
+    def _generalize_string(self, s: str) -> str:
+        """Convert string to a regex pattern matching it."""
         
-        # Replace letters with character classes
-        pattern = re.sub(r'[a-z]+', r'[a-z]+', pattern)
-        pattern = re.sub(r'[A-Z]+', r'[A-Z]+', pattern)
+        # Generalize runs of digits and letters into character classes and
+        # escape everything else, so separators such as '.' stay literal
+        classes = {"digits": r'\d+', "lower": '[a-z]+', "upper": '[A-Z]+'}
+        tokens = []
+        for run in re.finditer(r'(?P<digits>[0-9]+)|(?P<lower>[a-z]+)|(?P<upper>[A-Z]+)|.', s, re.DOTALL):
+            tokens.append(classes.get(run.lastgroup) or re.escape(run.group()))
         
-        return pattern
+        return ''.join(tokens)
     
     def _compute_generation_hints(self, df: DataFrame) -> Dict:
         """Compute hints for realistic generation."""
@@ -799,12 +1047,104 @@ class WavefrontProfiler:
         rates = [row.count for row in source_rates]
         rate_distribution = self._compute_numeric_distribution_from_list(rates)
         
-        return {
-            "entity_hints": {
-                "source_count_estimate": source_count,
-                "per_source_rate_distribution": rate_distribution
-            }
+        entity_hints = {
+            "source_count_estimate": source_count,
+            "per_source_rate_distribution": rate_distribution
+        }
+        churn = self._compute_series_churn(df)
+        if churn:
+            entity_hints["series_churn"] = churn
+        entity_hints["topology"] = self._compute_topology(df)
+        
+        return {"entity_hints": entity_hints}
+    
+    def _compute_series_churn(self, df: DataFrame) -> Optional[Dict]:
+        """Compute how series (source and tags) are born and retire.
+        
+        A series is born when its first line comes after the capture's first
+        edge and retires when its last comes before the closing edge. The
+        mean lifetime is the exponential estimate, the series' observed time
+        over their retirements, which counts the series cut off by the
+        capture too; the lifetime distribution is of the series seen whole.
+        Returns None when no series retires within the capture.
+        """
+        
+        per_series = (df
+                     .filter(col("timestamp").isNotNull())
+                     .withColumn("series_tags", array_sort(map_entries(col("tags"))))
+                     .groupBy("source", "series_tags")
+                     .agg(spark_min("timestamp").alias("first_ts"),
+                          spark_max("timestamp").alias("last_ts")))
+        
+        window_stats = per_series.agg(spark_min("first_ts").alias("start"),
+                                      spark_max("last_ts").alias("end")).collect()[0]
+        if window_stats.start is None or window_stats.end - window_stats.start <= 2 * CHURN_EDGE_SECONDS:
+            return None
+        start, end = window_stats.start, window_stats.end
+        
+        flagged = (per_series
+                  .withColumn("born", col("first_ts") > start + CHURN_EDGE_SECONDS)
+                  .withColumn("retired", col("last_ts") < end - CHURN_EDGE_SECONDS)
+                  .withColumn("observed", col("last_ts") - col("first_ts")))
+        totals = (flagged
+                 .agg(count("*").alias("series"),
+                      spark_sum(col("born").cast("int")).alias("births"),
+                      spark_sum(col("retired").cast("int")).alias("retirements"),
+                      spark_sum("observed").alias("observed"))
+                 .collect()[0])
+        if not totals.retirements:
+            return None
+        
+        lifetimes = [row.observed for row in (flagged
+                                              .filter(col("born") & col("retired"))
+                                              .select("observed")
+                                              .limit(100000)
+                                              .collect())]
+        duration_hours = (end - start) / 3600.0
+        churn = {
+            "birth_rate_per_hour": totals.births / duration_hours,
+            "mean_lifetime_seconds": max(float(totals.observed) / totals.retirements, 1.0),
+            "active_series": float(totals.observed) / (end - start)
+        }
+        if lifetimes:
+            churn["lifetime_distribution"] = self._compute_numeric_distribution_from_list(lifetimes)
+        return churn
+    
+    def _compute_topology(self, df: DataFrame) -> Dict:
+        """Compute the host-level structure of a family's sources.
+        
+        Host tags are the keys keeping a single value on nearly every source
+        with two or more lines carrying them, like region or instance type.
+        Hosts are replaced at the rate new sources appear after the
+        capture's opening edge, per source and hour.
+        """
+        per_key = (df
+                  .select("source", explode(col("tags")).alias("key", "value"))
+                  .groupBy("key", "source")
+                  .agg(countDistinct("value").alias("values"),
+                       count("*").alias("lines"))
+                  .filter(col("lines") >= 2)
+                  .groupBy("key")
+                  .agg(count("*").alias("sources"),
+                       spark_sum((col("values") == 1).cast("int")).alias("fixed"))
+                  .collect())
+        topology = {
+            "host_tag_keys": sorted(row.key for row in per_key
+                                    if row.fixed >= HOST_TAG_FIXED_SHARE * row.sources)
         }
+        
+        per_source = (df
+                     .filter(col("timestamp").isNotNull())
+                     .groupBy("source")
+                     .agg(spark_min("timestamp").alias("first_ts")))
+        window_stats = per_source.agg(spark_min("first_ts").alias("start"),
+                                      count("*").alias("sources")).collect()[0]
+        end = df.agg(spark_max("timestamp").alias("end")).collect()[0].end
+        if window_stats.start is not None and end - window_stats.start > 2 * CHURN_EDGE_SECONDS:
+            births = per_source.filter(col("first_ts") > window_stats.start + CHURN_EDGE_SECONDS).count()
+            duration_hours = (end - window_stats.start) / 3600.0
+            topology["replacement_rate_per_host_hour"] = births / duration_hours / window_stats.sources
+        return topology
     
     def _compute_numeric_distribution_from_list(self, values: List[float]) -> Dict:
         """Compute numeric distribution from Python list."""
@@ -860,11 +1200,88 @@ class WavefrontProfiler:
         for row in granularity_counts:
             granularities[row.granularity] = row.count / total
         
-        # Centroid analysis (simplified)
+        # Merged centroids, each weighted by its count, so the quantiles are
+        # those of the values the histograms summarise
+        centroids = (histos_df
+                    .select(col("granularity"), explode(col("centroids")).alias("centroid"))
+                    .select(col("granularity"),
+                            col("centroid.value").alias("value"),
+                            col("centroid.count").alias("count")))
+        quantiles = (centroids
+                    .select(expr("percentile(value, array(0.01, 0.05, 0.5, 0.95, 0.99), count)").alias("q"))
+                    .collect()[0].q)
+        value_distribution = {"bins": [], "counts": []}
+        if quantiles:
+            value_distribution["quantiles"] = dict(zip(["p01", "p05", "p50", "p95", "p99"], quantiles))
+        value_distribution.update(self._compute_centroid_digest(centroids))
+        
+        # Mean observations per histogram line, by granularity
+        observation_counts = (centroids
+                             .groupBy("granularity")
+                             .agg(spark_sum("count").alias("observations"))
+                             .collect())
+        lines = {row.granularity: row.count for row in granularity_counts}
+        count_per_histogram = {}
+        for row in observation_counts:
+            count_per_histogram[row.granularity] = row.observations / lines[row.granularity]
+        
+        # Centroids per histogram line, which the compression of the
+        # sender's digests sets
+        centroid_counts = histos_df.select(size(col("centroids")).alias("centroid_count"))
+        
         return {
             "granularities": granularities,
-            "centroid_count_distribution": {"bins": [], "counts": []},
-            "centroid_value_distribution": {"bins": [], "counts": []}
+            "centroid_count_distribution": self._compute_numeric_distribution(centroid_counts, "centroid_count"),
+            "centroid_value_distribution": value_distribution,
+            "count_per_histogram": count_per_histogram
+        }
+    
+    def _compute_centroid_digest(self, centroids: DataFrame) -> Dict:
+        """Merge weighted centroids (value, count) into one t-digest.
+        
+        Centroids are first pre-merged in Spark within log-scale buckets of
+        TDIGEST_BUCKET_WIDTH relative width, keeping the collected rows few,
+        then merged to TDIGEST_COMPRESSION with the k1 scale function so the
+        tails keep small centroids. Returns the digest's centroids and range,
+        or nothing without centroids.
+        """
+        
+        log_width = float(np.log1p(TDIGEST_BUCKET_WIDTH))
+        buckets = (centroids
+                  .where(col("value").isNotNull() & (col("count") > 0))
+                  .withColumn("bucket", expr(
+                      f"CASE WHEN value = 0 THEN 0 "
+                      f"ELSE signum(value) * (floor(ln(abs(value)) / {log_width}) + 1000000) END"))
+                  .groupBy("bucket")
+                  .agg(spark_sum(col("value") * col("count")).alias("weighted"),
+                       spark_sum("count").alias("count"),
+                       spark_min("value").alias("min"),
+                       spark_max("value").alias("max"))
+                  .collect())
+        if not buckets:
+            return {}
+        
+        pre_merged = sorted((row.weighted / row["count"], float(row["count"])) for row in buckets)
+        total = sum(weight for _, weight in pre_merged)
+        
+        def scale(q):
+            return TDIGEST_COMPRESSION / (2 * np.pi) * np.arcsin(2 * min(q, 1.0) - 1)
+        
+        merged = [list(pre_merged[0])]
+        before = 0.0
+        for mean, weight in pre_merged[1:]:
+            current = merged[-1]
+            if scale((before + current[1] + weight) / total) - scale(before / total) <= 1:
+                current[0] += (mean - current[0]) * weight / (current[1] + weight)
+                current[1] += weight
+            else:
+                before += current[1]
+                merged.append([mean, weight])
+        
+        return {
+            "centroids": [{"mean": mean, "count": weight} for mean, weight in merged],
+            "min": min(row.min for row in buckets),
+            "max": max(row.max for row in buckets)
         }
     
     def _generate_span_recipes(self, spans_df: DataFrame, output_path: str):
@@ -875,6 +1292,27 @@ class WavefrontProfiler:
                      .distinct()
                      .collect())
         
+        # Parent-child links within traces, from the traceId, spanId and
+        # parent span tags
+        linked = spans_df.select(
+            "operation", "duration_ms",
+            col("span_tags").getItem("traceId").alias("trace_id"),
+            col("span_tags").getItem("spanId").alias("span_id"),
+            col("span_tags").getItem("parent").alias("parent_id"))
+        parents = linked.select(
+            col("trace_id"), col("span_id").alias("parent_id"),
+            col("operation").alias("parent_operation"),
+            col("duration_ms").alias("parent_duration_ms"))
+        children = (linked
+                   .filter(col("parent_id").isNotNull())
+                   .join(parents, ["trace_id", "parent_id"])
+                   .withColumn("duration_ratio",
+                               when(col("parent_duration_ms") > 0,
+                                    col("duration_ms") / col("parent_duration_ms"))))
+        child_counts = (children
+                       .groupBy("trace_id", "parent_id")
+                       .agg(count("*").alias("children")))
+        
         for op_row in operations:
             operation = op_row.operation
             op_spans = spans_df.filter(col("operation") == operation)
@@ -888,7 +1326,11 @@ class WavefrontProfiler:
                     "sample_count": op_spans.count(),
                     "span_distribution": {
                         "duration_distribution": self._compute_numeric_distribution(op_spans, "duration_ms"),
-                        "operation_distribution": {"top_values": [{"value": operation, "frequency": 1.0}]}
+                        "operation_distribution": {"top_values": [{"value": operation, "frequency": 1.0}]},
+                        "trace_shape": self._compute_trace_shape(
+                            linked.filter(col("operation") == operation),
+                            children.filter(col("parent_operation") == operation),
+                            child_counts)
                     }
                 }
             }
@@ -897,6 +1339,26 @@ class WavefrontProfiler:
             recipe_path = f"{output_path}/spans/{recipe['family_id']}.json"
             self._write_json(recipe, recipe_path)
     
+    def _compute_trace_shape(self, op_spans: DataFrame, op_children: DataFrame,
+                             child_counts: DataFrame) -> Dict:
+        """Describe the subtrees under an operation's spans: how many children
+        each span has, their operations, and their share of its duration."""
+        
+        with_children = (op_spans
+                        .join(child_counts.withColumnRenamed("parent_id", "span_id"),
+                              ["trace_id", "span_id"], "left")
+                        .fillna(0, subset=["children"]))
+        shape = {
+            "children_per_span": self._compute_numeric_distribution(with_children, "children"),
+            "is_root": op_spans.filter(col("parent_id").isNull()).count() / max(op_spans.count(), 1)
+        }
+        if op_children.count() > 0:
+            shape["child_operation_distribution"] = self._compute_categorical_distribution(op_children, "operation")
+        ratios = op_children.filter(col("duration_ratio").isNotNull())
+        if ratios.count() > 0:
+            shape["child_duration_ratio"] = self._compute_numeric_distribution(ratios, "duration_ratio")
+        return shape
+    
     def _generate_qa_reports(self, metrics_df: DataFrame, histos_df: Optional[DataFrame], 
                             spans_df: Optional[DataFrame], output_path: str):
         """Generate QA and validation reports."""
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregator merges the status of sharded monitor replicas into one view
+// of the fleet. It keeps no state: each request is answered from the
+// replicas' own APIs, and requests about one family are passed to the
+// replica that owns it.
+type Aggregator struct {
+	ShardURLs []string // API base URLs, in shard order
+
+	client  *http.Client
+	proxies []*httputil.ReverseProxy
+}
+
+// shardResponse is one replica's answer to a fanned out request.
+type shardResponse struct {
+	Shard int
+	URL   string
+	Body  []byte
+	Err   error
+}
+
+func NewAggregator(shardURLs []string) (*Aggregator, error) {
+	ag := &Aggregator{
+		ShardURLs: shardURLs,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, shardURL := range shardURLs {
+		target, err := url.Parse(strings.TrimSuffix(shardURL, "/"))
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid shard URL %q", shardURL)
+		}
+		ag.proxies = append(ag.proxies, httputil.NewSingleHostReverseProxy(target))
+	}
+	return ag, nil
+}
+
+func (ag *Aggregator) Serve(port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/status", ag.handleStatus)
+	for _, path := range []string{"/families", "/alerts", "/silences"} {
+		mux.HandleFunc(path, ag.handleList)
+	}
+	mux.HandleFunc("/families/", ag.handleFamily)
+	mux.HandleFunc("/api/v1/report/top", ag.handleTop)
+	mux.HandleFunc("/alerts/", ag.handleFamily)
+
+	log.Printf("Aggregating %d shards on port %d", len(ag.ShardURLs), port)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+}
+
+// fetch GETs path from every replica at once.
+func (ag *Aggregator) fetch(path string) []shardResponse {
+	responses := make([]shardResponse, len(ag.ShardURLs))
+	var wg sync.WaitGroup
+	for i, shardURL := range ag.ShardURLs {
+		wg.Add(1)
+		go func(i int, shardURL string) {
+			defer wg.Done()
+			response := shardResponse{Shard: i, URL: shardURL}
+			response.Body, response.Err = ag.get(strings.TrimSuffix(shardURL, "/") + path)
+			responses[i] = response
+		}(i, shardURL)
+	}
+	wg.Wait()
+	return responses
+}
+
+func (ag *Aggregator) get(url string) ([]byte, error) {
+	resp, err := ag.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return body, nil
+}
+
+// handleStatus serves GET /status: the replicas' family, status and
+// reference error counts summed, their silences, and each replica's own
+// status or why it could not be reached. A replica reporting a different
+// shard than its place in -shard-urls is listed as misconfigured.
+func (ag *Aggregator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	type replicaStatus struct {
+		Families        int            `json:"families"`
+		Statuses        map[string]int `json:"statuses"`
+		ReferenceErrors int            `json:"reference_errors"`
+		Silences        []Silence      `json:"silences"`
+		Shard           *Shard         `json:"shard"`
+	}
+	type shardStatus struct {
+		Shard    int    `json:"shard"`
+		URL      string `json:"url"`
+		Families int    `json:"families"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	families, referenceErrors := 0, 0
+	statuses := map[string]int{"green": 0, "amber": 0, "red": 0}
+	silences := []Silence{}
+	shards := make([]shardStatus, 0, len(ag.ShardURLs))
+	unavailable := 0
+	for _, response := range ag.fetch("/status") {
+		shard := shardStatus{Shard: response.Shard, URL: response.URL}
+		var status replicaStatus
+		err := response.Err
+		if err == nil {
+			err = json.Unmarshal(response.Body, &status)
+		}
+		if err == nil && (status.Shard == nil && len(ag.ShardURLs) > 1 || status.Shard != nil && (status.Shard.ID != response.Shard || status.Shard.Count != len(ag.ShardURLs))) {
+			err = fmt.Errorf("replica is not shard %d of %d", response.Shard, len(ag.ShardURLs))
+		}
+		if err != nil {
+			shard.Error = err.Error()
+			shards = append(shards, shard)
+			unavailable++
+			continue
+		}
+
+		shard.Families = status.Families
+		shards = append(shards, shard)
+		families += status.Families
+		referenceErrors += status.ReferenceErrors
+		for name, count := range status.Statuses {
+			statuses[name] += count
+		}
+		silences = append(silences, status.Silences...)
+	}
+	sort.Slice(silences, func(i, j int) bool { return silences[i].EndsAt.Before(silences[j].EndsAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"families":           families,
+		"statuses":           statuses,
+		"reference_errors":   referenceErrors,
+		"silences":           silences,
+		"shards":             shards,
+		"shards_unavailable": unavailable,
+		"timestamp":          time.Now().UTC(),
+	})
+}
+
+// handleList serves GET /families, /alerts and /silences: the replicas'
+// lists concatenated. Replicas that cannot be reached are left out and
+// counted in the X-Shards-Unavailable header.
+func (ag *Aggregator) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	merged := []json.RawMessage{}
+	unavailable := 0
+	for _, response := range ag.fetch(r.URL.Path) {
+		var items []json.RawMessage
+		err := response.Err
+		if err == nil {
+			err = json.Unmarshal(response.Body, &items)
+		}
+		if err != nil {
+			log.Printf("Shard %d (%s): %s failed: %v", response.Shard, response.URL, r.URL.Path, err)
+			unavailable++
+			continue
+		}
+		merged = append(merged, items...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Shards-Unavailable", fmt.Sprint(unavailable))
+	json.NewEncoder(w).Encode(merged)
+}
+
+// handleTop serves GET /api/v1/report/top across the replicas: each
+// replica's top families, re-ranked together and cut to n again.
+// Replicas that cannot be reached are left out and counted in the
+// X-Shards-Unavailable header.
+func (ag *Aggregator) handleTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := defaultTopFamilies
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxTopFamilies {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxTopFamilies), http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	merged := TopReport{Metrics: make(map[string][]TopFamily), Timestamp: time.Now().UTC()}
+	unavailable := 0
+	var lastErr error
+	for _, response := range ag.fetch(r.URL.RequestURI()) {
+		var report TopReport
+		err := response.Err
+		if err == nil {
+			err = json.Unmarshal(response.Body, &report)
+		}
+		if err != nil {
+			log.Printf("Shard %d (%s): %s failed: %v", response.Shard, response.URL, r.URL.Path, err)
+			unavailable++
+			lastErr = err
+			continue
+		}
+		merged.Families += report.Families
+		for metric, top := range report.Metrics {
+			merged.Metrics[metric] = append(merged.Metrics[metric], top...)
+		}
+	}
+	if unavailable == len(ag.ShardURLs) {
+		http.Error(w, fmt.Sprintf("No shard answered: %v", lastErr), http.StatusBadGateway)
+		return
+	}
+	for metric, top := range merged.Metrics {
+		sort.Slice(top, func(i, j int) bool {
+			if top[i].Severity != top[j].Severity {
+				return top[i].Severity > top[j].Severity
+			}
+			return top[i].FamilyID < top[j].FamilyID
+		})
+		if len(top) > n {
+			merged.Metrics[metric] = top[:n]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Shards-Unavailable", fmt.Sprint(unavailable))
+	json.NewEncoder(w).Encode(merged)
+}
+
+// handleFamily passes /families/{id}/... and /alerts/{id}/... requests,
+// such as silences, to the replica that owns the family.
+func (ag *Aggregator) handleFamily(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/families/"), "/alerts/")
+	familyID, _, _ := strings.Cut(rest, "/")
+	if familyID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ag.proxies[shardOf(familyID, len(ag.proxies))].ServeHTTP(w, r)
+}
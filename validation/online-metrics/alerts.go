@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert destination types
+const (
+	destinationSlack        = "slack"
+	destinationPagerDuty    = "pagerduty"
+	destinationWebhook      = "webhook"
+	destinationAlertmanager = "alertmanager"
+)
+
+// Alert events
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+const (
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	alertmanagerAlertsPath = "/api/v2/alerts"
+	alertmanagerAlertName  = "LoadgenFamilyDivergence"
+
+	// Open alerts are re-posted to Alertmanager on every evaluation with
+	// an end this far ahead, so they resolve on their own if the monitor
+	// stops
+	alertmanagerEndsAfter = 5 * time.Minute
+
+	// Notifications waiting for delivery; more are dropped
+	alertQueueSize = 256
+
+	// Delivery attempts per notification and destination, backing off
+	// from alertRetryDelay
+	alertAttempts   = 3
+	alertRetryDelay = 2 * time.Second
+)
+
+var alertNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_alert_notifications_total",
+		Help: "Alert notifications by destination, event (firing, resolved) and result (sent, failed, dropped)",
+	},
+	[]string{"destination", "event", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(alertNotifications)
+}
+
+// AlertConfig is the file given by -alert-config. URLs, routing keys,
+// header and label values may reference environment variables as $VAR or ${VAR}, so
+// secrets need not be written to the file.
+type AlertConfig struct {
+	Destinations []AlertDestination `json:"destinations"`
+}
+
+type AlertDestination struct {
+	Name string `json:"name"` // Defaults to the type
+	Type string `json:"type"` // slack, pagerduty, webhook or alertmanager
+
+	// Slack incoming webhook, generic endpoint or Alertmanager base URL;
+	// PagerDuty defaults to the Events API v2
+	URL string `json:"url"`
+
+	// PagerDuty integration key
+	RoutingKey string `json:"routing_key"`
+
+	// Extra request headers, e.g. Authorization for generic webhooks
+	Headers map[string]string `json:"headers"`
+
+	// Extra Alertmanager labels, e.g. the environment routes match on
+	Labels map[string]string `json:"labels"`
+}
+
+// AlertEvent is one notification about a family, and the body posted to
+// generic webhooks.
+type AlertEvent struct {
+	Event      string             `json:"event"` // firing or resolved
+	FamilyID   string             `json:"family_id"`
+	MetricName string             `json:"metric_name"`
+	Severity   string             `json:"severity"`
+	StartsAt   time.Time          `json:"starts_at"`
+	EndsAt     *time.Time         `json:"ends_at,omitempty"`
+	RedMinutes int                `json:"red_minutes"`
+	Burn       string             `json:"burn,omitempty"` // fast or slow
+	BurnRates  map[string]float64 `json:"burn_rates,omitempty"`
+	Scores     DivergenceScores   `json:"scores"`
+	Thresholds AlertThresholds    `json:"thresholds"`
+}
+
+// AlertDispatcher turns family status transitions into notifications: a
+// family firing once it burns its divergence budget, critical on a fast
+// burn and a warning on a slow one, and resolving once neither burns and
+// it has been green for ResolveMinutes. A short burst of red minutes
+// burns neither, so it does not page. Each family has at most one open
+// alert, so repeated evaluations do not notify again until RepeatInterval
+// has passed, or a slow burn turns fast. Alertmanager instead receives every open alert
+// on each evaluation and deduplicates, groups and silences them itself.
+type AlertDispatcher struct {
+	Destinations   []AlertDestination
+	ResolveMinutes int
+	RepeatInterval time.Duration // 0 never repeats
+
+	client *http.Client
+	queue  chan alertDelivery
+
+	// Open alerts by family ID
+	active map[string]*activeAlert
+	mu     sync.Mutex
+}
+
+type activeAlert struct {
+	Event        AlertEvent `json:"alert"`
+	LastNotified time.Time  `json:"last_notified"` // Zero until the alert first notifies
+	Silenced     bool       `json:"silenced"`
+	Pending      bool       `json:"pending"` // Fired or escalated while silenced, so notifies when the silence ends
+}
+
+// alertDelivery is a request to one destination: a single event, or the
+// batch of open and just resolved alerts for Alertmanager.
+type alertDelivery struct {
+	dest   AlertDestination
+	events []AlertEvent
+}
+
+// LoadAlertConfig reads and validates an alert configuration file.
+func LoadAlertConfig(path string) (*AlertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AlertConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Destinations {
+		dest := &config.Destinations[i]
+		dest.URL = os.ExpandEnv(dest.URL)
+		dest.RoutingKey = os.ExpandEnv(dest.RoutingKey)
+		for key, value := range dest.Headers {
+			dest.Headers[key] = os.ExpandEnv(value)
+		}
+		if dest.Name == "" {
+			dest.Name = dest.Type
+		}
+		if names[dest.Name] {
+			return nil, fmt.Errorf("destination %d: duplicate name %q", i, dest.Name)
+		}
+		names[dest.Name] = true
+
+		switch dest.Type {
+		case destinationSlack, destinationWebhook:
+			if dest.URL == "" {
+				return nil, fmt.Errorf("destination %s: url is required", dest.Name)
+			}
+		case destinationAlertmanager:
+			if dest.URL == "" {
+				return nil, fmt.Errorf("destination %s: url is required", dest.Name)
+			}
+			if !strings.HasSuffix(dest.URL, alertmanagerAlertsPath) {
+				dest.URL = strings.TrimSuffix(dest.URL, "/") + alertmanagerAlertsPath
+			}
+			for key, value := range dest.Labels {
+				dest.Labels[key] = os.ExpandEnv(value)
+			}
+		case destinationPagerDuty:
+			if dest.RoutingKey == "" {
+				return nil, fmt.Errorf("destination %s: routing_key is required", dest.Name)
+			}
+			if dest.URL == "" {
+				dest.URL = pagerDutyEventsURL
+			}
+		default:
+			return nil, fmt.Errorf("destination %s: unknown type %q", dest.Name, dest.Type)
+		}
+	}
+	return &config, nil
+}
+
+func NewAlertDispatcher(config *AlertConfig, resolveMinutes int, repeatInterval time.Duration) *AlertDispatcher {
+	return &AlertDispatcher{
+		Destinations:   config.Destinations,
+		ResolveMinutes: resolveMinutes,
+		RepeatInterval: repeatInterval,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		queue:          make(chan alertDelivery, alertQueueSize),
+		active:         make(map[string]*activeAlert),
+	}
+}
+
+// Run delivers queued notifications until ctx is cancelled.
+func (ad *AlertDispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-ad.queue:
+			ad.deliver(ctx, delivery)
+		}
+	}
+}
+
+// dispatchAlerts opens, repeats and resolves alerts from the families'
+// latest statuses. It runs on the monitoring loop after the divergences are
+// computed. Silenced families' alerts change as usual but do not notify.
+func (dm *DivergenceMonitor) dispatchAlerts() {
+	if dm.alerts == nil {
+		return
+	}
+	ad := dm.alerts
+	now := time.Now()
+
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+
+	var resolved []AlertEvent
+	dm.mu.RLock()
+	for _, family := range dm.families {
+		family.mu.RLock()
+		burn := family.DivergenceScores.Burn
+		event := AlertEvent{
+			FamilyID:   family.FamilyID,
+			MetricName: family.MetricName,
+			Severity:   burnSeverity(burn),
+			RedMinutes: family.ConsecutiveRed,
+			Burn:       burn,
+			BurnRates:  family.DivergenceScores.BurnRates,
+			Scores:     *family.DivergenceScores,
+			Thresholds: family.Thresholds,
+		}
+		status := family.Status
+		consecutiveGreen := family.ConsecutiveGreen
+		family.mu.RUnlock()
+
+		silenced := dm.silences.Silenced(family.FamilyID, now)
+		alert, open := ad.active[family.FamilyID]
+		if open {
+			// Re-posted to Alertmanager
+			alert.Event.Scores = event.Scores
+			alert.Event.BurnRates = event.BurnRates
+			alert.Silenced = silenced
+		}
+		switch {
+		case burn != "" && !open:
+			event.Event = alertFiring
+			event.StartsAt = now
+			alert = &activeAlert{Event: event, Silenced: silenced, Pending: silenced}
+			ad.active[family.FamilyID] = alert
+			if !silenced {
+				alert.LastNotified = now
+				ad.enqueue(event)
+			}
+		case burn == burnFast && alert.Event.Burn != burnFast:
+			// Escalate; Alertmanager identifies alerts by their labels,
+			// severity among them, so the warning is resolved there
+			if !alert.LastNotified.IsZero() {
+				superseded := alert.Event
+				superseded.Event = alertResolved
+				superseded.EndsAt = &now
+				resolved = append(resolved, superseded)
+			}
+
+			event.Event = alertFiring
+			event.StartsAt = alert.Event.StartsAt
+			alert.Event = event
+			alert.Pending = silenced
+			if !silenced {
+				alert.LastNotified = now
+				ad.enqueue(event)
+			}
+		case burn != "":
+			if !silenced && (alert.Pending || ad.RepeatInterval > 0 && now.Sub(alert.LastNotified) >= ad.RepeatInterval) {
+				// A fast burn slowing down keeps its severity
+				event.Event = alertFiring
+				event.StartsAt = alert.Event.StartsAt
+				event.Severity = alert.Event.Severity
+				alert.Event = event
+				alert.LastNotified = now
+				alert.Pending = false
+				ad.enqueue(event)
+			}
+		case open && status == "green" && consecutiveGreen >= ad.ResolveMinutes:
+			if event, notified := ad.resolve(alert, event.Scores, now); notified {
+				resolved = append(resolved, event)
+			}
+			delete(ad.active, family.FamilyID)
+		}
+	}
+
+	// Families dropped with their recipes will not turn green again
+	for familyID, alert := range ad.active {
+		if _, exists := dm.families[familyID]; !exists {
+			if event, notified := ad.resolve(alert, alert.Event.Scores, now); notified {
+				resolved = append(resolved, event)
+			}
+			delete(ad.active, familyID)
+		}
+	}
+	dm.mu.RUnlock()
+
+	ad.refreshAlertmanager(resolved, now)
+}
+
+// resolve queues the resolution of an open alert and returns it. An alert
+// that never notified, having fired while silenced, resolves quietly and
+// notified is false. The caller holds ad.mu.
+func (ad *AlertDispatcher) resolve(alert *activeAlert, scores DivergenceScores, now time.Time) (resolved AlertEvent, notified bool) {
+	event := alert.Event
+	event.Event = alertResolved
+	event.EndsAt = &now
+	event.RedMinutes = 0
+	event.Burn = ""
+	event.BurnRates = scores.BurnRates
+	event.Scores = scores
+	if alert.LastNotified.IsZero() {
+		return event, false
+	}
+	ad.enqueue(event)
+	return event, true
+}
+
+// enqueue queues event for the destinations notified on transitions.
+func (ad *AlertDispatcher) enqueue(event AlertEvent) {
+	for _, dest := range ad.Destinations {
+		if dest.Type != destinationAlertmanager {
+			ad.send(alertDelivery{dest: dest, events: []AlertEvent{event}})
+		}
+	}
+}
+
+// refreshAlertmanager queues the open alerts, and those resolved in this
+// evaluation, for each Alertmanager. Silenced alerts are left out, so
+// Alertmanager ends them after alertmanagerEndsAfter. The caller holds
+// ad.mu.
+func (ad *AlertDispatcher) refreshAlertmanager(resolved []AlertEvent, now time.Time) {
+	events := resolved
+	endsAt := now.Add(alertmanagerEndsAfter)
+	for _, alert := range ad.active {
+		if alert.Silenced || alert.Pending {
+			continue
+		}
+		event := alert.Event
+		event.EndsAt = &endsAt
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return
+	}
+	for _, dest := range ad.Destinations {
+		if dest.Type == destinationAlertmanager {
+			ad.send(alertDelivery{dest: dest, events: events})
+		}
+	}
+}
+
+func (ad *AlertDispatcher) send(delivery alertDelivery) {
+	select {
+	case ad.queue <- delivery:
+	default:
+		log.Printf("Alert queue full, dropping notification to %s", delivery.dest.Name)
+		delivery.count("dropped")
+	}
+}
+
+func (delivery alertDelivery) count(result string) {
+	for _, event := range delivery.events {
+		alertNotifications.WithLabelValues(delivery.dest.Name, event.Event, result).Inc()
+	}
+}
+
+// deliver posts to the delivery's destination, retrying failed attempts.
+func (ad *AlertDispatcher) deliver(ctx context.Context, delivery alertDelivery) {
+	dest := delivery.dest
+	var payload interface{}
+	if dest.Type == destinationAlertmanager {
+		payload = dest.alertmanagerPayload(delivery.events)
+	} else {
+		payload = dest.payload(delivery.events[0])
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode alert for %s: %v", dest.Name, err)
+		delivery.count("failed")
+		return
+	}
+
+	delay := alertRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = ad.post(ctx, dest, body)
+		if err == nil {
+			delivery.count("sent")
+			return
+		}
+		if attempt == alertAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	log.Printf("Failed to send %d alert(s) to %s: %v", len(delivery.events), dest.Name, err)
+	delivery.count("failed")
+}
+
+func (ad *AlertDispatcher) post(ctx context.Context, dest AlertDestination, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dest.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range dest.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := ad.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// payload is the request body for the destination's API.
+func (dest AlertDestination) payload(event AlertEvent) interface{} {
+	switch dest.Type {
+	case destinationSlack:
+		return map[string]string{"text": event.summary()}
+	case destinationPagerDuty:
+		// Events API v2; the dedup key ties the resolve to its trigger
+		body := map[string]interface{}{
+			"routing_key":  dest.RoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    "loadgen-divergence-" + event.FamilyID,
+		}
+		if event.Event == alertResolved {
+			body["event_action"] = "resolve"
+			return body
+		}
+		body["payload"] = map[string]interface{}{
+			"summary":        event.summary(),
+			"source":         "divergence-monitor",
+			"severity":       event.Severity,
+			"component":      event.MetricName,
+			"group":          "loadgen",
+			"timestamp":      event.StartsAt.Format(time.RFC3339),
+			"custom_details": event,
+		}
+		return body
+	default:
+		return event
+	}
+}
+
+// alertmanagerPayload is an Alertmanager v2 postableAlerts body. Alerts are
+// identified by their labels, so a family's firing and resolved posts
+// update the same alert.
+func (dest AlertDestination) alertmanagerPayload(events []AlertEvent) []map[string]interface{} {
+	alerts := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		labels := map[string]string{
+			"alertname":   alertmanagerAlertName,
+			"family_id":   event.FamilyID,
+			"metric_name": event.MetricName,
+			"severity":    event.Severity,
+		}
+		for key, value := range dest.Labels {
+			if _, set := labels[key]; !set {
+				labels[key] = value
+			}
+		}
+
+		scores, thresholds := event.Scores, event.Thresholds
+		annotations := map[string]string{
+			"summary":                        event.summary(),
+			"red_minutes":                    strconv.Itoa(event.RedMinutes),
+			"burn":                           event.Burn,
+			"slo_target":                     strconv.FormatFloat(thresholds.SLOTarget, 'g', 4, 64),
+			"threshold_fast_burn_rate":       formatScore(thresholds.FastBurnRate),
+			"threshold_slow_burn_rate":       formatScore(thresholds.SlowBurnRate),
+			"js_categorical":                 formatScore(scores.JSCategorical),
+			"cooccurrence_js":                formatScore(scores.CooccurrenceJS),
+			"wasserstein":                    formatScore(scores.WassersteinValue),
+			"ks_size":                        formatScore(scores.KSSize),
+			"ks_size_pvalue":                 strconv.FormatFloat(scores.KSSizePValue, 'g', 4, 64),
+			"threshold_js":                   formatScore(thresholds.JSThreshold),
+			"threshold_wasserstein":          formatScore(thresholds.WassersteinThreshold),
+			"threshold_ks":                   formatScore(thresholds.KSThreshold),
+			"threshold_ks_pvalue":            strconv.FormatFloat(thresholds.KSPValueThreshold, 'g', 4, 64),
+			"threshold_temporal_correlation": formatScore(thresholds.TemporalCorrThreshold),
+			"threshold_burstiness":           formatScore(thresholds.BurstinessThreshold),
+			"threshold_autocorrelation":      formatScore(thresholds.AutocorrThreshold),
+		}
+		if scores.TemporalMinutes > 0 {
+			annotations["temporal_correlation"] = formatScore(scores.TemporalCorr)
+		}
+		if scores.BurstinessMinutes > 0 {
+			annotations["burstiness_ratio"] = formatScore(scores.BurstinessRatio)
+		}
+		if scores.Autocorrelation != nil {
+			annotations["autocorrelation_gap"] = formatScore(scores.AutocorrelationGap)
+		}
+		for window, rate := range event.BurnRates {
+			annotations["burn_rate_"+window] = formatScore(rate)
+		}
+		if red := divergedEndpoints(scores.Endpoints, "red"); len(red) > 0 {
+			annotations["red_endpoints"] = strings.Join(red, ",")
+		}
+
+		alert := map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+			"startsAt":    event.StartsAt.Format(time.RFC3339),
+		}
+		if event.EndsAt != nil {
+			alert["endsAt"] = event.EndsAt.Format(time.RFC3339)
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 4, 64)
+}
+
+// summary is a one-line description of the event for chat and paging.
+func (event AlertEvent) summary() string {
+	if event.Event == alertResolved {
+		return fmt.Sprintf("Resolved: %s (family %s) is back within its divergence thresholds", event.MetricName, event.FamilyID)
+	}
+	scores := event.Scores
+	windows := fastBurnWindows
+	if event.Burn == burnSlow {
+		windows = slowBurnWindows
+	}
+	summary := fmt.Sprintf("%s (family %s) is burning its divergence budget (%s burn, %.1fx over %s, %.1fx over %s): JS %.3f, co-occurrence JS %.3f, Wasserstein %.3f, KS %.3f",
+		event.MetricName, event.FamilyID, event.Burn,
+		event.BurnRates[windows[0].name], windows[0].name, event.BurnRates[windows[1].name], windows[1].name,
+		scores.JSCategorical, scores.CooccurrenceJS, scores.WassersteinValue, scores.KSSize)
+	if scores.TemporalMinutes > 0 {
+		summary += fmt.Sprintf(", temporal correlation %.2f", scores.TemporalCorr)
+	}
+	if scores.BurstinessMinutes > 0 {
+		summary += fmt.Sprintf(", burstiness ratio %.2f", scores.BurstinessRatio)
+	}
+	if scores.Autocorrelation != nil {
+		summary += fmt.Sprintf(", autocorrelation gap %.2f", scores.AutocorrelationGap)
+	}
+	var statuses []string
+	for _, name := range []string{windowShort, windowMedium, windowLong} {
+		if window := scores.Windows[name]; window != nil {
+			statuses = append(statuses, name+" "+window.Status)
+		}
+	}
+	if len(statuses) > 0 {
+		summary += " (" + strings.Join(statuses, ", ") + ")"
+	}
+	if endpoints := endpointSummary(scores.Endpoints); endpoints != "" {
+		summary += "; " + endpoints
+	}
+	return summary
+}
+
+// handleAlerts serves GET /alerts: the open alerts, oldest first.
+func (dm *DivergenceMonitor) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts := []*activeAlert{}
+	if dm.alerts != nil {
+		dm.alerts.mu.Lock()
+		for _, alert := range dm.alerts.active {
+			copied := *alert
+			alerts = append(alerts, &copied)
+		}
+		dm.alerts.mu.Unlock()
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Event.StartsAt.Before(alerts[j].Event.StartsAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
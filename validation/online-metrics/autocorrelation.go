@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Values kept per series, and series per family
+	autocorrSeriesValues = 64
+	autocorrMaxSeries    = 512
+
+	// A series not seen for this long is dropped
+	autocorrSeriesExpiry = time.Hour
+
+	// Pairs needed at every lag before the autocorrelation is compared
+	autocorrMinPairs = 100
+)
+
+// autocorrLags are the lags the profiler's recipes have, and the ones
+// verification measures on captured lines.
+var autocorrLags = []int{1, 2, 5, 10}
+
+var (
+	divergenceAutocorrelation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_autocorrelation",
+			Help: "Autocorrelation of generated series values at each lag, in lines of a series",
+		},
+		[]string{"family_id", "lag"},
+	)
+
+	divergenceAutocorrelationGap = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_autocorrelation_gap",
+			Help: "Largest absolute difference between the generated and reference value autocorrelation over the lags",
+		},
+		[]string{"family_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceAutocorrelation)
+	prometheus.MustRegister(divergenceAutocorrelationGap)
+}
+
+// seriesSequences keeps the latest generated values of each series of a
+// family, in the order of the lines' own timestamps, or of arrival for
+// lines without one. It is guarded by the family's mu.
+type seriesSequences struct {
+	series map[string]*valueSequence
+}
+
+type valueSequence struct {
+	points   []timedValue // oldest first
+	lastSeen time.Time
+}
+
+type timedValue struct {
+	at    time.Time
+	value float64
+}
+
+func newSeriesSequences() *seriesSequences {
+	return &seriesSequences{series: make(map[string]*valueSequence)}
+}
+
+// Add appends a sample's value to its series. Histogram samples have no
+// single value and are skipped, as are new series once the family has
+// autocorrMaxSeries.
+func (s *seriesSequences) Add(sample Sample, received time.Time) {
+	if sample.Centroids != nil || math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return
+	}
+	key := sample.Source + " " + tagsKey(sample.Tags)
+	seq, exists := s.series[key]
+	if !exists {
+		if len(s.series) >= autocorrMaxSeries {
+			return
+		}
+		seq = &valueSequence{}
+		s.series[key] = seq
+	}
+	at := sample.Emitted
+	if at.IsZero() {
+		at = received
+	}
+
+	// Lines mostly arrive in order, so the search rarely moves far
+	i := len(seq.points)
+	for i > 0 && seq.points[i-1].at.After(at) {
+		i--
+	}
+	seq.points = append(seq.points, timedValue{})
+	copy(seq.points[i+1:], seq.points[i:])
+	seq.points[i] = timedValue{at: at, value: sample.Value}
+	if len(seq.points) > autocorrSeriesValues {
+		seq.points = seq.points[len(seq.points)-autocorrSeriesValues:]
+	}
+	seq.lastSeen = received
+}
+
+// autocorrelation averages each series' autocorrelation at lags, weighted
+// by its pairs at each lag, as the profiler does: values are centred on
+// their series' mean, and constant series are left out. pairs is the
+// fewest pairs at any lag. Series not seen for autocorrSeriesExpiry are
+// dropped first.
+func (s *seriesSequences) autocorrelation(lags []int, now time.Time) (acf []float64, pairs int) {
+	sums := make([]float64, len(lags))
+	weights := make([]int, len(lags))
+	for key, seq := range s.series {
+		if now.Sub(seq.lastSeen) > autocorrSeriesExpiry {
+			delete(s.series, key)
+			continue
+		}
+		n := len(seq.points)
+		mean := 0.0
+		for _, p := range seq.points {
+			mean += p.value
+		}
+		mean /= float64(n)
+		variance := 0.0
+		for _, p := range seq.points {
+			variance += (p.value - mean) * (p.value - mean)
+		}
+		if variance == 0 {
+			continue
+		}
+		for i, lag := range lags {
+			if n <= lag+2 {
+				continue
+			}
+			covariance := 0.0
+			for t := lag; t < n; t++ {
+				covariance += (seq.points[t].value - mean) * (seq.points[t-lag].value - mean)
+			}
+			sums[i] += covariance / variance * float64(n-lag)
+			weights[i] += n - lag
+		}
+	}
+
+	acf = make([]float64, len(lags))
+	pairs = math.MaxInt
+	for i := range lags {
+		if weights[i] > 0 {
+			acf[i] = sums[i] / float64(weights[i])
+		}
+		pairs = min(pairs, weights[i])
+	}
+	return acf, pairs
+}
+
+// computeAutocorrelation compares the autocorrelation of the family's
+// generated series values with the reference's, catching values drawn
+// independently from the right marginal distribution where production
+// series move smoothly. The gap is the largest absolute difference over
+// the reference's lags. ok is false until every lag has autocorrMinPairs
+// pairs, or if the recipe has no autocorrelation. The monitor sees sampled
+// lines, so lags count sampled lines of a series; senders should sample
+// whole series for them to line up with the recipe's. The caller holds
+// family.mu.
+func (dm *DivergenceMonitor) computeAutocorrelation(family *FamilyMonitor, now time.Time) (gap float64, observed map[int]float64, ok bool) {
+	ref := family.ReferenceStats.Autocorrelation
+	if len(ref) == 0 || family.Sequences == nil {
+		return 0, nil, false
+	}
+	lags := make([]int, 0, len(ref))
+	for lag := range ref {
+		lags = append(lags, lag)
+	}
+	sort.Ints(lags)
+
+	acf, pairs := family.Sequences.autocorrelation(lags, now)
+	if pairs < autocorrMinPairs {
+		return 0, nil, false
+	}
+	observed = make(map[int]float64, len(lags))
+	for i, lag := range lags {
+		observed[lag] = acf[i]
+		gap = math.Max(gap, math.Abs(acf[i]-ref[lag]))
+		divergenceAutocorrelation.WithLabelValues(family.FamilyID, strconv.Itoa(lag)).Set(acf[i])
+	}
+	divergenceAutocorrelationGap.WithLabelValues(family.FamilyID).Set(gap)
+	return gap, observed, true
+}
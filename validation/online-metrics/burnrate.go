@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Burn severities: a fast burn pages, a slow one opens a ticket
+const (
+	burnFast = "fast"
+	burnSlow = "slow"
+)
+
+// burnHistoryMinutes is how far back red evaluations are kept, the
+// longest burn-rate window.
+const burnHistoryMinutes = 24 * 60
+
+// burnWindow is a window the share of red minutes is measured over.
+type burnWindow struct {
+	name    string
+	minutes int
+}
+
+// Window pairs of each burn: a pair burns when both of its windows do, the
+// long one showing the drift used up a share of the budget and the short
+// one that it still is, so the alert resolves soon after it stops.
+var (
+	fastBurnWindows = [2]burnWindow{{"5m", 5}, {"1h", 60}}
+	slowBurnWindows = [2]burnWindow{{"6h", 6 * 60}, {"24h", burnHistoryMinutes}}
+)
+
+var divergenceBurnRate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "loadgen_divergence_burn_rate",
+		Help: "Share of the window's minutes a family was red, over its divergence budget (1 - SLO target), by window",
+	},
+	[]string{"family_id", "window"},
+)
+
+func init() {
+	prometheus.MustRegister(divergenceBurnRate)
+}
+
+// redHistory records which of a family's minutes over the last day were
+// evaluated red. It is guarded by the family's mu.
+type redHistory struct {
+	red  []bool // indexed by unix minute modulo burnHistoryMinutes
+	last int64  // newest unix minute with a slot
+}
+
+func newRedHistory() *redHistory {
+	return &redHistory{red: make([]bool, burnHistoryMinutes)}
+}
+
+// Record marks the minute of now red or not. A minute evaluated more than
+// once keeps its last status.
+func (h *redHistory) Record(now time.Time, red bool) {
+	minute := now.Unix() / 60
+	h.advance(minute)
+	h.red[minute%burnHistoryMinutes] = red
+}
+
+// advance clears the slots of the minutes up to minute.
+func (h *redHistory) advance(minute int64) {
+	if minute <= h.last {
+		return
+	}
+	from := h.last + 1
+	if minute-from >= burnHistoryMinutes {
+		from = minute - burnHistoryMinutes + 1
+	}
+	for m := from; m <= minute; m++ {
+		h.red[m%burnHistoryMinutes] = false
+	}
+	h.last = minute
+}
+
+// share is the fraction of the window's minutes, up to and including the
+// minute of now, that were red. Minutes the family was not evaluated in,
+// before it had enough samples or the monitor started, count as within
+// thresholds, so a new family does not burn its whole budget on its first
+// red minute.
+func (h *redHistory) share(now time.Time, minutes int) float64 {
+	end := now.Unix() / 60
+	h.advance(end)
+	red := 0
+	for m := end - int64(minutes) + 1; m <= end; m++ {
+		if m > 0 && h.red[m%burnHistoryMinutes] {
+			red++
+		}
+	}
+	return float64(red) / float64(minutes)
+}
+
+// computeBurnRates records the family's latest status and returns how fast
+// it is burning its divergence budget over each window: the share of the
+// window's minutes it was red, over the share the SLO target allows. The
+// caller holds family.mu.
+func (dm *DivergenceMonitor) computeBurnRates(family *FamilyMonitor, thresholds AlertThresholds, now time.Time) map[string]float64 {
+	if family.RedHistory == nil {
+		family.RedHistory = newRedHistory()
+	}
+	family.RedHistory.Record(now, family.Status == "red")
+
+	budget := 1 - thresholds.SLOTarget
+	rates := make(map[string]float64, 4)
+	for _, window := range append(fastBurnWindows[:], slowBurnWindows[:]...) {
+		rate := family.RedHistory.share(now, window.minutes) / budget
+		rates[window.name] = rate
+		divergenceBurnRate.WithLabelValues(family.FamilyID, window.name).Set(rate)
+	}
+	return rates
+}
+
+// burning returns which burn the rates show, the fast one first, or ""
+// if neither pair of windows is over its rate.
+func burning(rates map[string]float64, thresholds AlertThresholds) string {
+	over := func(windows [2]burnWindow, rate float64) bool {
+		return rates[windows[0].name] >= rate && rates[windows[1].name] >= rate
+	}
+	switch {
+	case over(fastBurnWindows, thresholds.FastBurnRate):
+		return burnFast
+	case over(slowBurnWindows, thresholds.SlowBurnRate):
+		return burnSlow
+	}
+	return ""
+}
+
+// burnSeverity is the alert severity of a burn.
+func burnSeverity(burn string) string {
+	if burn == burnFast {
+		return "critical"
+	}
+	return "warning"
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBurnRates(t *testing.T) {
+	thresholds := AlertThresholds{SLOTarget: 0.98, FastBurnRate: 14.4, SlowBurnRate: 6}
+	start := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		minutes int              // evaluated once a minute from start
+		red     func(m int) bool // whether minute m is red
+		want    map[string]float64
+		burn    string
+	}{
+		{"first red minute", 1, func(int) bool { return true },
+			map[string]float64{"5m": 10, "1h": 1.0 / 60 / 0.02, "6h": 1.0 / 360 / 0.02, "24h": 1.0 / 1440 / 0.02}, ""},
+		{"fast burn", 20, func(int) bool { return true },
+			map[string]float64{"5m": 50, "1h": 20.0 / 60 / 0.02, "6h": 20.0 / 360 / 0.02, "24h": 20.0 / 1440 / 0.02}, burnFast},
+		{"fast burn stopped", 25, func(m int) bool { return m < 20 },
+			map[string]float64{"5m": 0, "1h": 20.0 / 60 / 0.02, "6h": 20.0 / 360 / 0.02, "24h": 20.0 / 1440 / 0.02}, ""},
+		{"slow burn", 1440, func(m int) bool { return m%4 == 0 },
+			map[string]float64{"5m": 10, "1h": 12.5, "6h": 12.5, "24h": 12.5}, burnSlow},
+		{"red minutes a day ago", 1440 + 60, func(m int) bool { return m < 60 },
+			map[string]float64{"5m": 0, "1h": 0, "6h": 0, "24h": 0}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm := &DivergenceMonitor{}
+			family := &FamilyMonitor{FamilyID: "burn-test"}
+			var rates map[string]float64
+			for m := 0; m < tt.minutes; m++ {
+				family.Status = "green"
+				if tt.red(m) {
+					family.Status = "red"
+				}
+				rates = dm.computeBurnRates(family, thresholds, start.Add(time.Duration(m)*time.Minute))
+			}
+
+			for window, want := range tt.want {
+				if got := rates[window]; math.Abs(got-want) > 1e-9 {
+					t.Errorf("%s burn rate = %v, want %v", window, got, want)
+				}
+			}
+			if got := burning(rates, thresholds); got != tt.burn {
+				t.Errorf("burning = %q, want %q", got, tt.burn)
+			}
+		})
+	}
+}
+
+func TestRedHistory(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("last evaluation in a minute wins", func(t *testing.T) {
+		h := newRedHistory()
+		h.Record(now, true)
+		h.Record(now.Add(30*time.Second), false)
+		if got := h.share(now.Add(30*time.Second), 5); got != 0 {
+			t.Errorf("share = %v, want 0", got)
+		}
+	})
+
+	t.Run("slots are reused after a day", func(t *testing.T) {
+		h := newRedHistory()
+		h.Record(now, true)
+		later := now.Add(burnHistoryMinutes * time.Minute)
+		h.Record(later, false)
+		if got := h.share(later, burnHistoryMinutes); got != 0 {
+			t.Errorf("share after a day = %v, want 0", got)
+		}
+	})
+
+	t.Run("late evaluation does not clear newer minutes", func(t *testing.T) {
+		h := newRedHistory()
+		h.Record(now, true)
+		h.share(now.Add(-time.Minute), 5)
+		if got := h.share(now, 5); got != 0.2 {
+			t.Errorf("share = %v, want 0.2", got)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	divergenceBurstiness = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_burstiness_ratio",
+			Help: "Coefficient of variation of the per-minute emission rate over the reference's, across the same minutes of the intensity curve",
+		},
+		[]string{"family_id"},
+	)
+
+	familyFano = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_family_fano_factor",
+			Help: "Variance over mean of the per-minute emission rate",
+		},
+		[]string{"family_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceBurstiness)
+	prometheus.MustRegister(familyFano)
+}
+
+// computeBurstiness compares how bursty the family's emission is with the
+// reference. Arrivals are counted per minute rather than timed one by one:
+// lines reach the monitor in batches, which would swamp the gaps between
+// them, and the reference's burstiness was measured on per-minute counts
+// too. The ratio is the coefficient of variation of the observed rate over
+// that of the reference intensity curve across the minutes it is aligned
+// with, so a partial day is not held to the full day's diurnal swing; once
+// a whole curve was observed that is the recipe's burstiness. The monitor
+// sees sampled lines, and sampling adds about as much variance as the
+// sampled counts' mean, so that is taken off the observed variance first.
+// The Fano factor is reported as observed, since sampling pulls it towards
+// 1. ok is false until enough minutes were observed. The caller holds
+// family.mu, after the temporal correlation aligned the rate with the curve.
+func (dm *DivergenceMonitor) computeBurstiness(family *FamilyMonitor, now time.Time) (ratio, fano float64, minutes int, ok bool) {
+	observed := family.Rates.Series(now)
+	if len(observed) < temporalMinMinutes {
+		return 0, 0, len(observed), false
+	}
+	mean, variance := meanVariance(observed)
+	if mean == 0 {
+		return 0, 0, len(observed), false
+	}
+	fano = variance / mean
+
+	expected := family.ReferenceStats.BurstinessMean
+	if curve := family.ReferenceStats.IntensityCurve; len(curve) > 0 && len(observed) < len(curve) {
+		aligned := make([]float64, len(observed))
+		for i := range aligned {
+			aligned[i] = curve[(family.Rates.lag+i)%len(curve)]
+		}
+		curveMean, curveVariance := meanVariance(aligned)
+		if curveMean > 0 {
+			expected = math.Sqrt(curveVariance) / curveMean
+		}
+	}
+	if expected <= 0 {
+		return 0, fano, len(observed), false
+	}
+	excess := math.Max(0, variance-mean)
+	return math.Sqrt(excess) / mean / expected, fano, len(observed), true
+}
+
+// meanVariance returns the mean and population variance of values.
+func meanVariance(values []float64) (float64, float64) {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(values))
+}
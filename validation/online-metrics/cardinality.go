@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var divergenceCardinality = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "loadgen_divergence_cardinality_ratio",
+		Help: "Distinct count in the current window over the reference distinct count, by dimension (source, series, tag_<key>)",
+	},
+	[]string{"family_id", "dimension"},
+)
+
+func init() {
+	prometheus.MustRegister(divergenceCardinality)
+}
+
+// computeCardinalityRatios compares the distinct sources, series and values
+// of each tag key in the current window with the reference cardinalities.
+// A ratio well below 1 means the generator emits too few distinct entities,
+// above 1 too many. The reference spans the whole capture window, so
+// dimensions whose values rotate over time read somewhat below 1 even when
+// generation is faithful. Dimensions without a reference are left out.
+func (dm *DivergenceMonitor) computeCardinalityRatios(ref *ReferenceStatistics, current *windowSummary) map[string]float64 {
+	ratios := make(map[string]float64)
+	if ref.SourceCardinality > 0 {
+		ratios["source"] = current.DistinctSources.Estimate() / ref.SourceCardinality
+	}
+	if ref.SeriesCardinality > 0 {
+		ratios["series"] = current.DistinctSeries.Estimate() / ref.SeriesCardinality
+	}
+	for key, cardinality := range ref.TagCardinalities {
+		if cardinality <= 0 {
+			continue
+		}
+		estimate := 0.0
+		if distinct, ok := current.DistinctTags[key]; ok {
+			estimate = distinct.Estimate()
+		}
+		ratios["tag_"+key] = estimate / cardinality
+	}
+	return ratios
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iterator"
+)
+
+// Checkpoints are written to <path>/checkpoint.gob.gz, or
+// checkpoint-shard-<id>.gob.gz when sharded, and overwritten on each save.
+const (
+	checkpointPrefix = "checkpoint"
+	checkpointSuffix = ".gob.gz"
+
+	// A checkpoint older than the long window has nothing left to restore.
+	checkpointMaxAge = longWindowSize
+
+	// Status, streaks and scores are only restored from a checkpoint this
+	// recent; older ones would show a status the windows no longer back,
+	// so the family waits for its first evaluation instead.
+	checkpointStatusAge = 15 * time.Minute
+)
+
+var checkpointWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_checkpoint_writes_total",
+		Help: "Window checkpoints written, by result (ok, failed)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(checkpointWrites)
+}
+
+// monitorCheckpoint is the state a replica needs to carry on scoring where
+// it left off: each family's windows, rates and recent statuses, and the
+// open alerts and silences.
+type monitorCheckpoint struct {
+	SavedAt  time.Time
+	Shard    Shard
+	Families []familyCheckpoint
+	Alerts   []activeAlert
+	Silences []Silence
+}
+
+type familyCheckpoint struct {
+	FamilyID   string
+	Windows    map[string]windowCheckpoint // short, medium, long, captured
+	Endpoints  map[string]windowCheckpoint
+	Rates      *ratesCheckpoint
+	RedHistory *redHistoryCheckpoint
+	Sequences  map[string]sequenceCheckpoint // by series
+
+	Status           string
+	ConsecutiveRed   int
+	ConsecutiveGreen int
+	Scores           DivergenceScores
+	LastUpdate       time.Time
+}
+
+type windowCheckpoint struct {
+	WindowSize time.Duration
+	BucketSize time.Duration
+	Buckets    []bucketCheckpoint // oldest first
+}
+
+type bucketCheckpoint struct {
+	Start   time.Time
+	Count   int
+	Values  digestCheckpoint
+	Sizes   digestCheckpoint
+	Sources map[string]int
+	Tags    map[string]map[string]int
+	Pairs   map[tagPair]map[string]int
+
+	HistogramValues digestCheckpoint
+	HistogramCounts map[string]histogramCounts
+
+	SchemaVariants int
+
+	DistinctSources hllCheckpoint
+	DistinctSeries  hllCheckpoint
+	DistinctTags    map[string]hllCheckpoint
+}
+
+type digestCheckpoint struct {
+	Means, Weights []float64
+	Count          float64
+	Min, Max       float64
+}
+
+type hllCheckpoint struct {
+	Registers []uint8
+	Sparse    map[uint16]uint8
+}
+
+type ratesCheckpoint struct {
+	Counts      []float64
+	First, Last int64
+	Lag         int
+}
+
+type redHistoryCheckpoint struct {
+	Red  []bool
+	Last int64
+}
+
+type sequenceCheckpoint struct {
+	At       []time.Time
+	Values   []float64
+	LastSeen time.Time
+}
+
+// Checkpointer periodically saves the replica's state under a
+// gs://bucket/prefix or local directory, and restores it on startup, so a
+// deploy does not empty the windows and reset every family to green until
+// they fill again. Without a path nothing is saved.
+type Checkpointer struct {
+	Path string
+
+	gcsClient *storage.Client
+}
+
+func NewCheckpointer(path string) *Checkpointer {
+	return &Checkpointer{Path: path}
+}
+
+// Run saves the monitor's state every interval until ctx is cancelled, and
+// once more on the way out.
+func (c *Checkpointer) Run(ctx context.Context, dm *DivergenceMonitor, interval time.Duration) {
+	if c.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			saveCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := c.Save(saveCtx, dm); err != nil {
+				log.Printf("Failed to write checkpoint: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := c.Save(ctx, dm); err != nil {
+				log.Printf("Failed to write checkpoint: %v", err)
+			}
+		}
+	}
+}
+
+// Save writes the monitor's state, replacing the replica's last checkpoint.
+func (c *Checkpointer) Save(ctx context.Context, dm *DivergenceMonitor) error {
+	checkpoint := dm.checkpoint(time.Now())
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(writer).Encode(checkpoint); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	name := checkpointPrefix + checkpointSuffix
+	if dm.shard.Sharded() {
+		name = fmt.Sprintf("%s-shard-%d%s", checkpointPrefix, dm.shard.ID, checkpointSuffix)
+	}
+	if err := c.write(ctx, name, buf.Bytes()); err != nil {
+		checkpointWrites.WithLabelValues("failed").Inc()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	checkpointWrites.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// write replaces an object. Local files are written aside and renamed, so
+// a replica killed mid-write leaves the previous checkpoint intact.
+func (c *Checkpointer) write(ctx context.Context, name string, data []byte) error {
+	bucket, prefix := parseReferencePath(c.Path)
+	if bucket == "" {
+		if err := os.MkdirAll(prefix, 0o755); err != nil {
+			return err
+		}
+		file := filepath.Join(prefix, name)
+		if err := os.WriteFile(file+".tmp", data, 0o644); err != nil {
+			return err
+		}
+		return os.Rename(file+".tmp", file)
+	}
+
+	client, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	writer := client.Bucket(bucket).Object(prefix + name).NewWriter(ctx)
+	writer.ContentType = "application/gzip"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Restore loads the state of the families this replica owns from every
+// replica's checkpoint, so it also picks up families that moved to it when
+// the shard count changed. A family in several checkpoints is restored
+// from the newest. It is called once the references are loaded; families
+// that no longer have a reference are skipped, and so are checkpoints that
+// cannot be read, so one truncated write does not lose the others.
+func (c *Checkpointer) Restore(ctx context.Context, dm *DivergenceMonitor) error {
+	if c.Path == "" {
+		return nil
+	}
+	names, err := c.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	now := time.Now()
+	var checkpoints []*monitorCheckpoint
+	for _, name := range names {
+		checkpoint, err := c.read(ctx, name)
+		if err != nil {
+			log.Printf("Skipping checkpoint %s: failed to read it: %v", name, err)
+			continue
+		}
+		if now.Sub(checkpoint.SavedAt) > checkpointMaxAge {
+			log.Printf("Skipping checkpoint %s from %s: older than %s", name, checkpoint.SavedAt.Format(time.RFC3339), checkpointMaxAge)
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	newest := make(map[string]*monitorCheckpoint)
+	for _, checkpoint := range checkpoints {
+		for _, fc := range checkpoint.Families {
+			if last, ok := newest[fc.FamilyID]; !ok || checkpoint.SavedAt.After(last.SavedAt) {
+				newest[fc.FamilyID] = checkpoint
+			}
+		}
+	}
+
+	restored := 0
+	for _, checkpoint := range checkpoints {
+		for _, fc := range checkpoint.Families {
+			if newest[fc.FamilyID] != checkpoint || !dm.shard.Owns(fc.FamilyID) {
+				continue
+			}
+			if dm.restoreFamily(fc, now.Sub(checkpoint.SavedAt) <= checkpointStatusAge) {
+				restored++
+			}
+		}
+		// Alerts and silences are taken with the family's newest state
+		current := func(familyID string) bool {
+			last, ok := newest[familyID]
+			return (!ok || last == checkpoint) && dm.shard.Owns(familyID)
+		}
+		for _, alert := range checkpoint.Alerts {
+			if dm.alerts != nil && current(alert.Event.FamilyID) {
+				dm.alerts.restore(alert)
+			}
+		}
+		for _, silence := range checkpoint.Silences {
+			if now.Before(silence.EndsAt) && current(silence.FamilyID) {
+				dm.silences.Set(silence)
+			}
+		}
+	}
+	log.Printf("Restored %d families from %d checkpoints in %s", restored, len(checkpoints), c.Path)
+	return nil
+}
+
+// list returns the checkpoint objects, as names read accepts.
+func (c *Checkpointer) list(ctx context.Context) ([]string, error) {
+	bucket, prefix := parseReferencePath(c.Path)
+	var names []string
+	if bucket == "" {
+		entries, err := os.ReadDir(prefix)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), checkpointPrefix) && strings.HasSuffix(entry.Name(), checkpointSuffix) {
+				names = append(names, filepath.Join(prefix, entry.Name()))
+			}
+		}
+		return names, nil
+	}
+
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix + checkpointPrefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, checkpointSuffix) {
+			names = append(names, attrs.Name)
+		}
+	}
+	return names, nil
+}
+
+func (c *Checkpointer) read(ctx context.Context, name string) (*monitorCheckpoint, error) {
+	var reader io.ReadCloser
+	bucket, _ := parseReferencePath(c.Path)
+	if bucket == "" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		reader = file
+	} else {
+		object, err := c.gcsClient.Bucket(bucket).Object(name).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reader = object
+	}
+	defer reader.Close()
+
+	decompressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	var checkpoint monitorCheckpoint
+	if err := gob.NewDecoder(decompressed).Decode(&checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (c *Checkpointer) client(ctx context.Context) (*storage.Client, error) {
+	if c.gcsClient == nil {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		c.gcsClient = client
+	}
+	return c.gcsClient, nil
+}
+
+// checkpoint captures the monitor's state at now.
+func (dm *DivergenceMonitor) checkpoint(now time.Time) *monitorCheckpoint {
+	checkpoint := &monitorCheckpoint{
+		SavedAt:  now,
+		Shard:    dm.shard,
+		Silences: dm.silences.Active(now),
+	}
+
+	dm.mu.RLock()
+	for _, family := range dm.families {
+		family.mu.RLock()
+		checkpoint.Families = append(checkpoint.Families, family.checkpoint())
+		family.mu.RUnlock()
+	}
+	dm.mu.RUnlock()
+
+	if dm.alerts != nil {
+		dm.alerts.mu.Lock()
+		for _, alert := range dm.alerts.active {
+			checkpoint.Alerts = append(checkpoint.Alerts, *alert)
+		}
+		dm.alerts.mu.Unlock()
+	}
+	return checkpoint
+}
+
+// checkpoint captures the family's state. The caller holds family.mu.
+func (family *FamilyMonitor) checkpoint() familyCheckpoint {
+	fc := familyCheckpoint{
+		FamilyID: family.FamilyID,
+		Windows: map[string]windowCheckpoint{
+			"short":    family.CurrentWindow.checkpoint(),
+			"medium":   family.MediumWindow.checkpoint(),
+			"long":     family.LongWindow.checkpoint(),
+			"captured": family.CapturedWindow.checkpoint(),
+		},
+		Status:           family.Status,
+		ConsecutiveRed:   family.ConsecutiveRed,
+		ConsecutiveGreen: family.ConsecutiveGreen,
+		Scores:           *family.DivergenceScores,
+		LastUpdate:       family.LastUpdate,
+	}
+	for endpoint, window := range family.Endpoints {
+		if fc.Endpoints == nil {
+			fc.Endpoints = make(map[string]windowCheckpoint, len(family.Endpoints))
+		}
+		fc.Endpoints[endpoint] = window.checkpoint()
+	}
+	if r := family.Rates; r != nil {
+		fc.Rates = &ratesCheckpoint{Counts: append([]float64(nil), r.counts...), First: r.first, Last: r.last, Lag: r.lag}
+	}
+	if h := family.RedHistory; h != nil {
+		fc.RedHistory = &redHistoryCheckpoint{Red: append([]bool(nil), h.red...), Last: h.last}
+	}
+	if family.Sequences != nil {
+		fc.Sequences = make(map[string]sequenceCheckpoint, len(family.Sequences.series))
+		for key, seq := range family.Sequences.series {
+			sc := sequenceCheckpoint{LastSeen: seq.lastSeen}
+			for _, point := range seq.points {
+				sc.At = append(sc.At, point.at)
+				sc.Values = append(sc.Values, point.value)
+			}
+			fc.Sequences[key] = sc
+		}
+	}
+	return fc
+}
+
+// restoreFamily installs a family's checkpointed state, with its status
+// too if withStatus. It returns false if the family is not monitored.
+func (dm *DivergenceMonitor) restoreFamily(fc familyCheckpoint, withStatus bool) bool {
+	dm.mu.RLock()
+	family, exists := dm.families[fc.FamilyID]
+	dm.mu.RUnlock()
+	if !exists {
+		return false
+	}
+
+	family.mu.Lock()
+	defer family.mu.Unlock()
+
+	family.CurrentWindow.restore(fc.Windows["short"])
+	family.MediumWindow.restore(fc.Windows["medium"])
+	family.LongWindow.restore(fc.Windows["long"])
+	family.CapturedWindow.restore(fc.Windows["captured"])
+	for endpoint, wc := range fc.Endpoints {
+		window, ok := family.Endpoints[endpoint]
+		if !ok {
+			if len(family.Endpoints) >= maxFamilyEndpoints {
+				continue
+			}
+			if family.Endpoints == nil {
+				family.Endpoints = make(map[string]*SlidingWindow)
+			}
+			window = NewSlidingWindowBuckets(mediumWindowSize, mediumWindowBuckets)
+			if family.ReferenceStats != nil {
+				window.TrackPairs(trackedPairs(family.ReferenceStats.TagCooccurrence))
+			}
+			family.Endpoints[endpoint] = window
+		}
+		window.restore(wc)
+	}
+
+	if rc := fc.Rates; rc != nil && len(rc.Counts) == curveMinutes {
+		family.Rates = &minuteRates{counts: rc.Counts, first: rc.First, last: rc.Last, lag: rc.Lag}
+	}
+	if hc := fc.RedHistory; hc != nil && len(hc.Red) == burnHistoryMinutes {
+		family.RedHistory = &redHistory{red: hc.Red, last: hc.Last}
+	}
+	if len(fc.Sequences) > 0 {
+		family.Sequences = newSeriesSequences()
+		for key, sc := range fc.Sequences {
+			seq := &valueSequence{lastSeen: sc.LastSeen}
+			for i := range sc.At {
+				seq.points = append(seq.points, timedValue{at: sc.At[i], value: sc.Values[i]})
+			}
+			family.Sequences.series[key] = seq
+		}
+	}
+
+	if withStatus {
+		scores := fc.Scores
+		family.Status = fc.Status
+		family.ConsecutiveRed = fc.ConsecutiveRed
+		family.ConsecutiveGreen = fc.ConsecutiveGreen
+		family.DivergenceScores = &scores
+		family.LastUpdate = fc.LastUpdate
+	}
+	return true
+}
+
+// restore re-opens an alert open before the restart, unless the family
+// already has one, so it is neither notified again nor forgotten.
+func (ad *AlertDispatcher) restore(alert activeAlert) {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	if _, exists := ad.active[alert.Event.FamilyID]; !exists {
+		ad.active[alert.Event.FamilyID] = &alert
+	}
+}
+
+// checkpoint captures the window's live buckets.
+func (sw *SlidingWindow) checkpoint() windowCheckpoint {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.expire(time.Now())
+	wc := windowCheckpoint{WindowSize: sw.WindowSize, BucketSize: sw.bucketSize}
+	for _, bucket := range sw.buckets {
+		bc := bucketCheckpoint{
+			Start:   bucket.start,
+			Count:   bucket.count,
+			Values:  bucket.values.checkpoint(),
+			Sizes:   bucket.sizes.checkpoint(),
+			Sources: copyCounts(bucket.sources),
+			Tags:    make(map[string]map[string]int, len(bucket.tags)),
+			Pairs:   make(map[tagPair]map[string]int, len(bucket.pairs)),
+
+			HistogramValues: bucket.histValues.checkpoint(),
+			HistogramCounts: make(map[string]histogramCounts, len(bucket.histCounts)),
+
+			SchemaVariants: bucket.schemaVariants,
+
+			DistinctSources: bucket.distinctSources.checkpoint(),
+			DistinctSeries:  bucket.distinctSeries.checkpoint(),
+			DistinctTags:    make(map[string]hllCheckpoint, len(bucket.distinctTags)),
+		}
+		for key, values := range bucket.tags {
+			bc.Tags[key] = copyCounts(values)
+		}
+		for pair, joint := range bucket.pairs {
+			bc.Pairs[pair] = copyCounts(joint)
+		}
+		for granularity, counts := range bucket.histCounts {
+			bc.HistogramCounts[granularity] = *counts
+		}
+		for key, distinct := range bucket.distinctTags {
+			bc.DistinctTags[key] = distinct.checkpoint()
+		}
+		wc.Buckets = append(wc.Buckets, bc)
+	}
+	return wc
+}
+
+// restore adds checkpointed buckets older than the window's own, unless
+// the window is now split differently. Buckets that have since expired are
+// dropped.
+func (sw *SlidingWindow) restore(wc windowCheckpoint) {
+	if wc.WindowSize != sw.WindowSize || wc.BucketSize != sw.bucketSize {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	var buckets []*windowBucket
+	for _, bc := range wc.Buckets {
+		if len(sw.buckets) > 0 && !bc.Start.Before(sw.buckets[0].start) {
+			break
+		}
+		bucket := &windowBucket{
+			start:   bc.Start,
+			count:   bc.Count,
+			values:  bc.Values.digest(),
+			sizes:   bc.Sizes.digest(),
+			sources: bc.Sources,
+			tags:    bc.Tags,
+			pairs:   bc.Pairs,
+
+			histValues: bc.HistogramValues.digest(),
+			histCounts: make(map[string]*histogramCounts, len(bc.HistogramCounts)),
+
+			schemaVariants: bc.SchemaVariants,
+
+			distinctSources: bc.DistinctSources.sketch(),
+			distinctSeries:  bc.DistinctSeries.sketch(),
+			distinctTags:    make(map[string]*hll, len(bc.DistinctTags)),
+		}
+		// gob decodes empty maps as nil, and AddSample writes to these
+		if bucket.sources == nil {
+			bucket.sources = make(map[string]int)
+		}
+		if bucket.tags == nil {
+			bucket.tags = make(map[string]map[string]int)
+		}
+		if bucket.pairs == nil {
+			bucket.pairs = make(map[tagPair]map[string]int)
+		}
+		for granularity, counts := range bc.HistogramCounts {
+			counts := counts
+			bucket.histCounts[granularity] = &counts
+		}
+		for key, distinct := range bc.DistinctTags {
+			bucket.distinctTags[key] = distinct.sketch()
+		}
+		buckets = append(buckets, bucket)
+	}
+	sw.buckets = append(buckets, sw.buckets...)
+	sw.expire(time.Now())
+}
+
+// copyCounts copies a count map, so the checkpoint can be encoded while
+// samples are added.
+func copyCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int, len(counts))
+	for key, n := range counts {
+		copied[key] = n
+	}
+	return copied
+}
+
+func (t *tdigest) checkpoint() digestCheckpoint {
+	t.compress()
+	dc := digestCheckpoint{
+		Means:   make([]float64, len(t.centroids)),
+		Weights: make([]float64, len(t.centroids)),
+		Count:   t.count,
+		Min:     t.min,
+		Max:     t.max,
+	}
+	for i, c := range t.centroids {
+		dc.Means[i], dc.Weights[i] = c.mean, c.weight
+	}
+	return dc
+}
+
+func (dc digestCheckpoint) digest() *tdigest {
+	t := newTDigest()
+	for i := range dc.Means {
+		t.centroids = append(t.centroids, centroid{mean: dc.Means[i], weight: dc.Weights[i]})
+	}
+	if len(t.centroids) > 0 {
+		t.count, t.min, t.max = dc.Count, dc.Min, dc.Max
+	}
+	return t
+}
+
+func (s *hll) checkpoint() hllCheckpoint {
+	if s.registers != nil {
+		return hllCheckpoint{Registers: append([]uint8(nil), s.registers...)}
+	}
+	hc := hllCheckpoint{Sparse: make(map[uint16]uint8, len(s.sparse))}
+	for index, rank := range s.sparse {
+		hc.Sparse[index] = rank
+	}
+	return hc
+}
+
+func (hc hllCheckpoint) sketch() *hll {
+	s := newHLL()
+	if len(hc.Registers) == hllRegisters {
+		s.registers, s.sparse = hc.Registers, nil
+		return s
+	}
+	for index, rank := range hc.Sparse {
+		s.sparse[index] = rank
+	}
+	return s
+}
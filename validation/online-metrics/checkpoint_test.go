@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testMonitor returns a monitor with an empty family for each ID, as
+// loading their references would leave it
+func testMonitor(ids ...string) *DivergenceMonitor {
+	dm := NewDivergenceMonitor("")
+	for _, id := range ids {
+		dm.families[id] = &FamilyMonitor{
+			FamilyID:         id,
+			CurrentWindow:    NewSlidingWindow(shortWindowSize),
+			MediumWindow:     NewSlidingWindowBuckets(mediumWindowSize, mediumWindowBuckets),
+			LongWindow:       NewSlidingWindowBuckets(longWindowSize, longWindowBuckets),
+			CapturedWindow:   NewSlidingWindow(shortWindowSize),
+			Rates:            newMinuteRates(),
+			DivergenceScores: &DivergenceScores{},
+			Status:           "green",
+		}
+	}
+	return dm
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	dm := testMonitor("cpu", "disk")
+	cpu := dm.families["cpu"]
+	for i := 0; i < 500; i++ {
+		sample := Sample{
+			Timestamp: now.Add(-time.Duration(i) * time.Second),
+			Value:     float64(i),
+			Source:    fmt.Sprintf("host-%d", i%10),
+			Tags:      map[string]string{"region": fmt.Sprintf("r%d", i%3)},
+			LineSize:  100 + i%7,
+		}
+		cpu.CurrentWindow.AddSample(sample)
+		cpu.MediumWindow.AddSample(sample)
+		cpu.LongWindow.AddSample(sample)
+	}
+	cpu.Status = "red"
+	cpu.ConsecutiveRed = 4
+	cpu.DivergenceScores = &DivergenceScores{JSCategorical: 0.2}
+	dm.silences.Set(Silence{FamilyID: "cpu", Reason: "investigating", StartsAt: now, EndsAt: now.Add(time.Hour)})
+
+	checkpointer := NewCheckpointer(t.TempDir())
+	if err := checkpointer.Save(ctx, dm); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// A truncated checkpoint from another replica is skipped, not fatal
+	corrupt := filepath.Join(checkpointer.Path, checkpointPrefix+"-shard-1"+checkpointSuffix)
+	if err := os.WriteFile(corrupt, []byte{0x1f, 0x8b, 0x08}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := testMonitor("cpu", "disk")
+	if err := checkpointer.Restore(ctx, restored); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	got := restored.families["cpu"]
+	for name, windows := range map[string][2]*SlidingWindow{
+		"short":  {cpu.CurrentWindow, got.CurrentWindow},
+		"medium": {cpu.MediumWindow, got.MediumWindow},
+		"long":   {cpu.LongWindow, got.LongWindow},
+	} {
+		want, have := windows[0].Summary(), windows[1].Summary()
+		if have.Count != want.Count {
+			t.Errorf("%s window has %d samples, want %d", name, have.Count, want.Count)
+		}
+		if want.Count == 0 {
+			continue
+		}
+		if median, wantMedian := have.Values.Quantile(0.5), want.Values.Quantile(0.5); math.Abs(median-wantMedian) > 1e-9 {
+			t.Errorf("%s window median = %g, want %g", name, median, wantMedian)
+		}
+		if have.DistinctSources.Estimate() != want.DistinctSources.Estimate() {
+			t.Errorf("%s window has %g distinct sources, want %g", name, have.DistinctSources.Estimate(), want.DistinctSources.Estimate())
+		}
+		if have.Tags["region"]["r1"] != want.Tags["region"]["r1"] {
+			t.Errorf("%s window region=r1 count = %d, want %d", name, have.Tags["region"]["r1"], want.Tags["region"]["r1"])
+		}
+	}
+	if got.Status != "red" || got.ConsecutiveRed != 4 || got.DivergenceScores.JSCategorical != 0.2 {
+		t.Errorf("restored status %s, %d red, JS %g; want red, 4, 0.2", got.Status, got.ConsecutiveRed, got.DivergenceScores.JSCategorical)
+	}
+	if !restored.silences.Silenced("cpu", now) {
+		t.Error("silence was not restored")
+	}
+	if disk := restored.families["disk"]; disk.CurrentWindow.Count() != 0 || disk.Status != "green" {
+		t.Errorf("empty family restored with %d samples, status %s", disk.CurrentWindow.Count(), disk.Status)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// maxTrackedPairs bounds the tag-key pairs whose joint values a window
+	// counts
+	maxTrackedPairs = 10
+
+	// Joint values listed per side of a pair in the drilldown
+	drilldownJointValues = 5
+)
+
+// tagPair is two tag keys in sorted order.
+type tagPair struct {
+	First, Second string
+}
+
+func newTagPair(a, b string) tagPair {
+	if b < a {
+		a, b = b, a
+	}
+	return tagPair{First: a, Second: b}
+}
+
+func (p tagPair) String() string {
+	return p.First + "," + p.Second
+}
+
+// jointValue keys a pair's joint distribution. Wavefront tag values cannot
+// contain a NUL, so the key splits back unambiguously.
+func jointValue(first, second string) string {
+	return first + "\x00" + second
+}
+
+// PairDivergence is the co-occurrence divergence of one tag-key pair, with
+// the most frequent joint values on each side.
+type PairDivergence struct {
+	Keys      [2]string        `json:"keys"`
+	JS        float64          `json:"js"`
+	Samples   int              `json:"samples"` // Samples carrying both keys
+	Reference []JointFrequency `json:"reference"`
+	Current   []JointFrequency `json:"current"`
+}
+
+type JointFrequency struct {
+	Values    [2]string `json:"values"`
+	Frequency float64   `json:"frequency"`
+}
+
+// trackedPairs picks the reference pairs a window counts joint values for,
+// in a stable order.
+func trackedPairs(cooccurrence map[tagPair]map[string]float64) []tagPair {
+	pairs := make([]tagPair, 0, len(cooccurrence))
+	for pair := range cooccurrence {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].String() < pairs[j].String() })
+	if len(pairs) > maxTrackedPairs {
+		pairs = pairs[:maxTrackedPairs]
+	}
+	return pairs
+}
+
+// computeCooccurrenceDivergence compares the joint value distribution of
+// each tracked tag-key pair in the current window with the reference, by
+// JS divergence. It returns the mean over the pairs and the pairs worst
+// first. A pair the generator never emits together scores the maximum.
+func (dm *DivergenceMonitor) computeCooccurrenceDivergence(ref *ReferenceStatistics, current *windowSummary) (float64, []PairDivergence) {
+	pairs := trackedPairs(ref.TagCooccurrence)
+	if len(pairs) == 0 {
+		return 0, nil
+	}
+
+	results := make([]PairDivergence, 0, len(pairs))
+	total := 0.0
+	for _, pair := range pairs {
+		refDist := ref.TagCooccurrence[pair]
+		counts := current.Pairs[pair]
+		currentDist := distribution(counts)
+		js := dm.computeJSDivergence(refDist, currentDist)
+		total += js
+
+		samples := 0
+		for _, count := range counts {
+			samples += count
+		}
+		results = append(results, PairDivergence{
+			Keys:      [2]string{pair.First, pair.Second},
+			JS:        js,
+			Samples:   samples,
+			Reference: topJointValues(refDist),
+			Current:   topJointValues(currentDist),
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].JS > results[j].JS })
+	return total / float64(len(pairs)), results
+}
+
+func topJointValues(dist map[string]float64) []JointFrequency {
+	top := make([]JointFrequency, 0, len(dist))
+	for key, frequency := range dist {
+		first, second, _ := strings.Cut(key, "\x00")
+		top = append(top, JointFrequency{Values: [2]string{first, second}, Frequency: frequency})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Frequency != top[j].Frequency {
+			return top[i].Frequency > top[j].Frequency
+		}
+		return jointValue(top[i].Values[0], top[i].Values[1]) < jointValue(top[j].Values[0], top[j].Values[1])
+	})
+	if len(top) > drilldownJointValues {
+		top = top[:drilldownJointValues]
+	}
+	return top
+}
@@ -8,39 +8,88 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"gonum.org/v1/gonum/stat"
 )
 
 // DivergenceMonitor tracks statistical divergence between generated and reference data
 type DivergenceMonitor struct {
 	families        map[string]*FamilyMonitor
+	byMetric        map[string][]*FamilyMonitor // Families by metric name
 	referencePath   string
 	mu              sync.RWMutex
-	alertThresholds AlertThresholds
+	alertThresholds AlertThresholds // Defaults, before the threshold config
+	thresholds      *ThresholdStore
+	scorers         []Scorer // Built-in scorers, then those of -scorer-config
+	shard           Shard    // Families this replica scores
+
+	// End-to-end request samples per upstream cluster, from Envoy access logs
+	requests        map[string]*RequestWindow
+
+	// Load status of each family's reference statistics, by family ID
+	references      map[string]*ReferenceLoad
+	loadMu          sync.Mutex // Serialises LoadReferences
+	gcsClient       *storage.Client
+
+	// Webhook notifications; nil without -alert-config
+	alerts          *AlertDispatcher
+	silences        *SilenceStore // Families whose notifications are suppressed
+
+	// Scores of past evaluations, by family
+	history         *DivergenceHistory
+
+	// Control plane actions on sustained red; nil without -remediation-config
+	remediator      *Remediator
+	live            *LiveBaseline // Refreshes references from production, if configured
+	reporter        *DivergenceReporter
 }
 
 type AlertThresholds struct {
 	JSThreshold           float64 // Jensen-Shannon divergence threshold
 	WassersteinThreshold  float64 // Wasserstein distance threshold  
 	KSThreshold           float64 // Kolmogorov-Smirnov threshold
-	RedStatusMinutes      int     // Minutes before alerting on red status
+	KSPValueThreshold     float64 // KS gaps only count when less likely than this by chance
+	TemporalCorrThreshold float64 // Minimum intensity curve correlation
+	BurstinessThreshold   float64 // Largest relative deviation of the burstiness ratio from 1
+	AutocorrThreshold     float64 // Largest autocorrelation gap at any lag
+	SLOTarget             float64 // Share of minutes a family should be within thresholds
+	FastBurnRate          float64 // Budget burn rate over 5m and 1h that pages
+	SlowBurnRate          float64 // Budget burn rate over 6h and 24h that opens a ticket
+	RedStatusMinutes      int     // Minutes red before remediation actions without after_minutes
 }
 
 type FamilyMonitor struct {
 	FamilyID           string
 	MetricName         string
 	ReferenceStats     *ReferenceStatistics
-	CurrentWindow      *SlidingWindow
+	ReferenceVersion   string // Recipe version and object generation of ReferenceStats
+	ReferenceGeneration int64
+	RecipeStats        *ReferenceStatistics // As the recipe has them; ReferenceStats may be refreshed live
+	RecipeVersion      string
+	Live               *liveStats // Distributions last queried from the live backend, if enabled
+	CurrentWindow      *SlidingWindow // The short window
+	MediumWindow       *SlidingWindow
+	LongWindow         *SlidingWindow
+	CapturedWindow     *SlidingWindow // Captured production lines, when streamed
+	Rates              *minuteRates   // Generated samples per minute
+	Endpoints          map[string]*SlidingWindow // Generated samples of the last hour by collector endpoint
+	Sequences          *seriesSequences // Latest generated values of each series
+	RedHistory         *redHistory      // Minutes evaluated red over the last day
 	DivergenceScores   *DivergenceScores
+	PairDivergences    []PairDivergence // Tag-key pairs, worst first
+	SchemaKeys         []KeyPresence    // Keys whose presence differs, worst first
 	LastUpdate         time.Time
 	Status             string // green, amber, red
 	ConsecutiveRed     int
+	ConsecutiveGreen   int
+	Thresholds         AlertThresholds // Resolved at the last evaluation
 	mu                 sync.RWMutex
 }
 
@@ -57,12 +106,34 @@ type ReferenceStatistics struct {
 	IntensityCurve        []float64
 	BurstinessMean        float64
 	BurstinessStdDev      float64
+
+	// Value autocorrelation by lag, in lines of a series
+	Autocorrelation       map[int]float64
 	
-	// Co-occurrence patterns
-	TagCooccurrence       map[string]float64
+	// Co-occurrence patterns: joint value distributions of tag-key pairs
+	TagCooccurrence       map[tagPair]map[string]float64 // by jointValue
 	
 	// Size distribution  
 	SizeQuantiles         []float64
+	SampleCount           float64 // Lines profiled; 0 when the recipe has none
+
+	// counter, gauge or histogram, for per-class thresholds
+	MetricClass           string
+
+	// Histogram families: quantiles of the merged centroids and mean
+	// observations per histogram, by granularity
+	HistogramQuantiles    []float64
+	HistogramCounts       map[string]float64
+
+	// Distinct counts over the capture window; 0 when the recipe has none
+	SourceCardinality     float64
+	SeriesCardinality     float64
+	TagCardinalities      map[string]float64
+	TagPresence           map[string]float64 // Share of lines carrying each tag key
+
+	// Distributions of each hour of the intensity curve, when the recipe
+	// has them; nil entries are hours with too few lines
+	Slices                []*ReferenceSlice
 }
 
 type HistogramBin struct {
@@ -72,27 +143,46 @@ type HistogramBin struct {
 	Density    float64
 }
 
-type SlidingWindow struct {
-	WindowSize    time.Duration
-	Samples       []Sample
-	maxSamples    int
-	mu            sync.Mutex
-}
-
 type Sample struct {
 	Timestamp    time.Time
 	Value        float64
 	Source       string
 	Tags         map[string]string
 	LineSize     int
+	Metric       string
+	Centroids    []centroid // Histogram lines only
+	Granularity  string     // Histogram lines only: M, H or D
+	SchemaVariant bool      // Tag keys differ from the family's; see schemaFamily
+	Endpoint     string     // Collector endpoint the line was sent to, if known
+	Emitted      time.Time  // The line's own timestamp; zero when it has none
 }
 
 type DivergenceScores struct {
 	JSCategorical     float64
 	WassersteinValue  float64
 	KSSize           float64
-	TemporalCorr     float64
+	KSSizePValue     float64 // Two-sample KS test, against the reference sample count
+	TemporalCorr     float64 // Pearson, at TemporalLag
+	TemporalSpearman float64
+	TemporalLag      int // Minutes into the reference intensity curve
+	TemporalMinutes  int // Minutes correlated; 0 until there are enough
+	BurstinessRatio  float64 // Coefficient of variation of the rate over the reference's
+	FanoFactor       float64
+	BurstinessMinutes int // Minutes compared; 0 until there are enough
+	Autocorrelation  map[int]float64 // Of generated series values, by lag; nil until there are enough
+	AutocorrelationGap float64 // Largest absolute difference from the reference's
 	CooccurrenceJS   float64
+	CardinalityRatios map[string]float64 // current/reference distinct counts, by dimension
+	HistogramWasserstein float64 // Over merged centroids; histogram families only
+	HistogramCountRatios map[string]float64 // current/reference observations per histogram, by granularity
+	SchemaDivergence float64 // Share of lines whose tag keys differ from the recipe schema
+	Windows          map[string]*WindowScores // By window; the fields above are the short window's
+	Endpoints        map[string]*WindowScores // By collector endpoint, when split between several
+	BurnRates        map[string]float64 // Red minutes over the divergence budget, by window
+	Burn             string             // fast or slow while a pair of windows burns, else empty
+	ReferenceVersion string // Reference the scores were computed against
+	ReferenceSlice   int    // Hour of the intensity curve the short window was compared against; -1 for all day
+	ReferenceGeneration int64
 	LastCalculated   time.Time
 }
 
@@ -148,63 +238,31 @@ func init() {
 }
 
 func NewDivergenceMonitor(referencePath string) *DivergenceMonitor {
-	return &DivergenceMonitor{
+	dm := &DivergenceMonitor{
 		families:      make(map[string]*FamilyMonitor),
+		byMetric:      make(map[string][]*FamilyMonitor),
+		requests:      make(map[string]*RequestWindow),
+		references:    make(map[string]*ReferenceLoad),
 		referencePath: referencePath,
+		history:       NewDivergenceHistory("", defaultHistoryWindow),
+		silences:      NewSilenceStore(),
 		alertThresholds: AlertThresholds{
-			JSThreshold:          0.05,
-			WassersteinThreshold: 0.1,
-			KSThreshold:          0.05,
-			RedStatusMinutes:     15,
+			JSThreshold:           0.05,
+			WassersteinThreshold:  0.1,
+			KSThreshold:           0.05,
+			KSPValueThreshold:     0.001,
+			TemporalCorrThreshold: 0.8,
+			BurstinessThreshold:   0.5,
+			AutocorrThreshold:     0.3,
+			SLOTarget:             0.98,
+			FastBurnRate:          14.4,
+			SlowBurnRate:          6,
+			RedStatusMinutes:      15,
 		},
 	}
-}
-
-func (dm *DivergenceMonitor) LoadReferences(ctx context.Context) error {
-	log.Println("Loading reference statistics...")
-	
-	// Load reference statistics from GCS or local file
-	// This would parse the Recipe files and extract reference distributions
-	
-	// For now, create mock reference data
-	mockFamily := &FamilyMonitor{
-		FamilyID:   "mock-family-123",
-		MetricName: "test.metric",
-		ReferenceStats: &ReferenceStatistics{
-			SourceDistribution: map[string]float64{
-				"host-001": 0.3,
-				"host-002": 0.2,
-				"host-003": 0.5,
-			},
-			TagDistributions: map[string]map[string]float64{
-				"env": {
-					"prod":    0.7,
-					"staging": 0.2, 
-					"dev":     0.1,
-				},
-				"region": {
-					"us-east-1": 0.4,
-					"us-west-2": 0.3,
-					"eu-west-1": 0.3,
-				},
-			},
-			ValueQuantiles:   []float64{1.0, 10.0, 50.0, 90.0, 99.0},
-			IntensityCurve:   generateMockIntensityCurve(),
-			BurstinessMean:   1.2,
-			BurstinessStdDev: 0.3,
-			SizeQuantiles:    []float64{80, 120, 200, 350, 500},
-		},
-		CurrentWindow: NewSlidingWindow(5 * time.Minute),
-		DivergenceScores: &DivergenceScores{},
-		Status: "green",
-	}
-	
-	dm.mu.Lock()
-	dm.families[mockFamily.FamilyID] = mockFamily
-	dm.mu.Unlock()
-	
-	log.Printf("Loaded references for %d families", len(dm.families))
-	return nil
+	dm.thresholds = NewThresholdStore("", dm.alertThresholds)
+	dm.scorers = dm.builtinScorers()
+	return dm
 }
 
 func (dm *DivergenceMonitor) Start(ctx context.Context, port int) error {
@@ -238,8 +296,18 @@ func (dm *DivergenceMonitor) startHTTPServer(ctx context.Context, port int) erro
 	mux.HandleFunc("/health", dm.handleHealth)
 	mux.HandleFunc("/status", dm.handleStatus)
 	mux.HandleFunc("/families", dm.handleFamilies)
-	mux.HandleFunc("/families/{id}/divergence", dm.handleFamilyDivergence)
+	mux.HandleFunc("/families/", dm.handleFamily)
 	mux.HandleFunc("/compute", dm.handleComputeDivergence)
+	mux.HandleFunc("/requests", dm.handleRequests)
+	mux.HandleFunc("/references", dm.handleReferences)
+	mux.HandleFunc("/references/reload", dm.handleReferencesReload)
+	mux.HandleFunc("/alerts", dm.handleAlerts)
+	mux.HandleFunc("/alerts/", dm.handleAlert)
+	mux.HandleFunc("/silences", dm.handleSilences)
+	mux.HandleFunc("/remediations", dm.handleRemediations)
+	mux.HandleFunc("/thresholds", dm.handleThresholds)
+	mux.HandleFunc("/report", dm.handleReport)
+	mux.HandleFunc("/api/v1/report/top", dm.handleTopFamilies)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -265,7 +333,9 @@ func (dm *DivergenceMonitor) monitoringLoop(ctx context.Context) {
 			return
 		case <-ticker.C:
 			dm.computeAllDivergences()
+			dm.updateRequestMetrics()
 			dm.updateAlertStatus()
+			dm.dispatchAlerts()
 		}
 	}
 }
@@ -287,23 +357,33 @@ func (dm *DivergenceMonitor) computeFamilyDivergence(family *FamilyMonitor) {
 	family.mu.Lock()
 	defer family.mu.Unlock()
 
-	if len(family.CurrentWindow.Samples) < 10 {
+	current := family.CurrentWindow.Summary()
+	if current.Count < 10 {
 		return // Need minimum samples
 	}
 
+	// Compare against the same slice of the day, where the recipe has one,
+	// so expected lulls and peaks are not scored as divergence
+	now := time.Now()
+	hour := family.sliceHour(shortWindowSize, now)
+	ref := family.ReferenceStats.slice(hour)
+	referenceSliceHour.WithLabelValues(family.FamilyID).Set(float64(hour))
+
 	// Compute categorical divergences (JS)
 	jsSource := dm.computeJSDivergence(
-		family.ReferenceStats.SourceDistribution,
-		dm.extractSourceDistribution(family.CurrentWindow.Samples),
+		ref.SourceDistribution,
+		distribution(current.Sources),
 	)
 
+	dimensions := map[string]float64{"source": jsSource}
 	jsTagAvg := 0.0
 	tagCount := 0
-	for tagKey, refDist := range family.ReferenceStats.TagDistributions {
-		currentDist := dm.extractTagDistribution(family.CurrentWindow.Samples, tagKey)
+	for tagKey, refDist := range ref.TagDistributions {
+		currentDist := distribution(current.Tags[tagKey])
 		jsTag := dm.computeJSDivergence(refDist, currentDist)
 		jsTagAvg += jsTag
 		tagCount++
+		dimensions["tag_"+tagKey] = jsTag
 		
 		// Update individual tag metrics
 		divergenceJS.WithLabelValues(family.FamilyID, fmt.Sprintf("tag_%s", tagKey)).Set(jsTag)
@@ -315,43 +395,149 @@ func (dm *DivergenceMonitor) computeFamilyDivergence(family *FamilyMonitor) {
 	divergenceJS.WithLabelValues(family.FamilyID, "source").Set(jsSource)
 	divergenceJS.WithLabelValues(family.FamilyID, "tags_average").Set(jsTagAvg)
 
-	// Compute numeric divergence (Wasserstein)
-	currentValues := dm.extractValues(family.CurrentWindow.Samples)
-	wasserstein := dm.computeWassersteinDistance(
-		family.ReferenceStats.ValueQuantiles,
-		dm.computeQuantiles(currentValues, []float64{0.01, 0.05, 0.5, 0.95, 0.99}),
-	)
-	divergenceWasserstein.WithLabelValues(family.FamilyID).Set(wasserstein)
+	// Compute numeric divergence (Wasserstein); families with only
+	// histograms in the reference are compared on their centroids instead
+	wasserstein := 0.0
+	if len(ref.ValueQuantiles) > 0 || len(ref.HistogramQuantiles) == 0 {
+		wasserstein = dm.computeWassersteinDistance(ref.ValueQuantiles, current.Values)
+		divergenceWasserstein.WithLabelValues(family.FamilyID).Set(wasserstein)
+	}
 
-	// Compute size distribution divergence (KS)
-	currentSizes := dm.extractSizes(family.CurrentWindow.Samples)
-	ks := dm.computeKSStatistic(
-		family.ReferenceStats.SizeQuantiles,
-		dm.computeQuantiles(currentSizes, []float64{0.01, 0.05, 0.5, 0.95, 0.99}),
-	)
+	// Compute size distribution divergence (two-sample KS)
+	ks, ksPValue := dm.computeKSTest(ref.SizeQuantiles, ref.SampleCount, current.Sizes)
 	divergenceKS.WithLabelValues(family.FamilyID).Set(ks)
+	divergenceKSPValue.WithLabelValues(family.FamilyID).Set(ksPValue)
+
+	// Compute tag co-occurrence divergence (JS over joint values)
+	cooccurrenceJS, pairs := dm.computeCooccurrenceDivergence(family.ReferenceStats, current)
+	if len(pairs) > 0 {
+		divergenceJS.WithLabelValues(family.FamilyID, "cooccurrence").Set(cooccurrenceJS)
+	}
+	family.PairDivergences = pairs
+	for _, pair := range pairs {
+		dimensions["pair_"+pair.Keys[0]+","+pair.Keys[1]] = pair.JS
+	}
+
+	// Compute histogram divergence (Wasserstein over centroids, count rates)
+	histogramWasserstein, countRatios, ok := dm.computeHistogramDivergence(family.ReferenceStats, current)
+	if ok {
+		divergenceHistogramWasserstein.WithLabelValues(family.FamilyID).Set(histogramWasserstein)
+		for granularity, ratio := range countRatios {
+			divergenceHistogramCounts.WithLabelValues(family.FamilyID, granularity).Set(ratio)
+		}
+	}
+
+	// Compute schema divergence (tag-key presence)
+	schemaDivergence, schemaKeys := dm.computeSchemaDivergence(family.ReferenceStats, current)
+	divergenceSchema.WithLabelValues(family.FamilyID).Set(schemaDivergence)
+	family.SchemaKeys = schemaKeys
+
+	// Compute cardinality ratios (HLL)
+	cardinalityRatios := dm.computeCardinalityRatios(family.ReferenceStats, current)
+	for dimension, ratio := range cardinalityRatios {
+		divergenceCardinality.WithLabelValues(family.FamilyID, dimension).Set(ratio)
+	}
+
+	// Compute temporal intensity correlation
+	pearson, spearman, lag, minutes, ok := dm.computeTemporalCorrelation(family, now)
+	if ok {
+		divergenceTemporal.WithLabelValues(family.FamilyID, "pearson").Set(pearson)
+		divergenceTemporal.WithLabelValues(family.FamilyID, "spearman").Set(spearman)
+		temporalLag.WithLabelValues(family.FamilyID).Set(float64(lag))
+		family.DivergenceScores.TemporalCorr = pearson
+		family.DivergenceScores.TemporalSpearman = spearman
+		family.DivergenceScores.TemporalLag = lag
+		family.DivergenceScores.TemporalMinutes = minutes
+	}
+
+	// Compute burstiness against the aligned reference curve
+	burstiness, fano, burstMinutes, ok := dm.computeBurstiness(family, now)
+	if ok {
+		divergenceBurstiness.WithLabelValues(family.FamilyID).Set(burstiness)
+		familyFano.WithLabelValues(family.FamilyID).Set(fano)
+		family.DivergenceScores.BurstinessRatio = burstiness
+		family.DivergenceScores.FanoFactor = fano
+		family.DivergenceScores.BurstinessMinutes = burstMinutes
+	}
+
+	// Compute value autocorrelation against the reference's
+	autocorrGap, autocorr, ok := dm.computeAutocorrelation(family, now)
+	if ok {
+		family.DivergenceScores.Autocorrelation = autocorr
+		family.DivergenceScores.AutocorrelationGap = autocorrGap
+	}
 
 	// Update family divergence scores
 	family.DivergenceScores.JSCategorical = (jsSource + jsTagAvg) / 2.0
 	family.DivergenceScores.WassersteinValue = wasserstein
 	family.DivergenceScores.KSSize = ks
-	family.DivergenceScores.LastCalculated = time.Now()
+	family.DivergenceScores.KSSizePValue = ksPValue
+	family.DivergenceScores.CooccurrenceJS = cooccurrenceJS
+	family.DivergenceScores.CardinalityRatios = cardinalityRatios
+	family.DivergenceScores.HistogramWasserstein = histogramWasserstein
+	family.DivergenceScores.HistogramCountRatios = countRatios
+	family.DivergenceScores.SchemaDivergence = schemaDivergence
+	family.DivergenceScores.ReferenceVersion = family.ReferenceVersion
+	family.DivergenceScores.ReferenceSlice = hour
+	family.DivergenceScores.ReferenceGeneration = family.ReferenceGeneration
+	family.DivergenceScores.LastCalculated = now
+
+	// Score the medium and long windows alongside the short one
+	thresholds := dm.familyThresholds(family)
+	short := &WindowScores{
+		Samples:              current.Count,
+		JSCategorical:        family.DivergenceScores.JSCategorical,
+		CooccurrenceJS:       cooccurrenceJS,
+		WassersteinValue:     wasserstein,
+		HistogramWasserstein: histogramWasserstein,
+		KSSize:               ks,
+		KSSizePValue:         ksPValue,
+	}
+	dm.scoreWindow(short, ref, current, false)
+	short.Status = dm.windowStatus(short, thresholds)
+	hourRef := family.ReferenceStats.slice(family.sliceHour(mediumWindowSize, now))
+	windows := map[string]*WindowScores{
+		windowShort:  short,
+		windowMedium: dm.windowScores(hourRef, family.MediumWindow.Summary(), thresholds),
+		windowLong:   dm.windowScores(family.ReferenceStats, family.LongWindow.Summary(), thresholds),
+	}
+	recordWindowScores(family.FamilyID, windows)
+	family.DivergenceScores.Windows = windows
+
+	// Score each collector endpoint's samples on their own
+	endpoints := dm.endpointScores(family, hourRef, thresholds)
+	for endpoint, scores := range endpoints {
+		if scores != nil {
+			dimensions["endpoint_"+endpoint] = scores.JSCategorical
+		}
+	}
+	family.DivergenceScores.Endpoints = endpoints
 
 	// Determine status
-	family.Status = dm.determineStatus(family.DivergenceScores)
+	family.Thresholds = thresholds
+	family.Status = dm.determineStatus(family.DivergenceScores, family.Thresholds)
 	
 	// Update status metric
 	statusValue := 0.0
 	switch family.Status {
 	case "amber":
 		statusValue = 1.0
+		family.ConsecutiveGreen = 0
 	case "red":
 		statusValue = 2.0
 		family.ConsecutiveRed++
+		family.ConsecutiveGreen = 0
 	default:
 		family.ConsecutiveRed = 0
+		family.ConsecutiveGreen++
 	}
+	family.DivergenceScores.BurnRates = dm.computeBurnRates(family, thresholds, now)
+	family.DivergenceScores.Burn = burning(family.DivergenceScores.BurnRates, thresholds)
 	familyStatus.WithLabelValues(family.FamilyID, family.MetricName).Set(statusValue)
+	dm.recordHistory(family, current.Count)
+	if dm.reporter != nil {
+		dm.reporter.observe(family, dimensions)
+	}
 
 	log.Printf("Family %s: JS=%.3f, Wasserstein=%.3f, KS=%.3f, Status=%s",
 		family.FamilyID[:8], family.DivergenceScores.JSCategorical,
@@ -359,18 +545,25 @@ func (dm *DivergenceMonitor) computeFamilyDivergence(family *FamilyMonitor) {
 		family.Status)
 }
 
-func (dm *DivergenceMonitor) determineStatus(scores *DivergenceScores) string {
-	// Red thresholds
-	if scores.JSCategorical > dm.alertThresholds.JSThreshold ||
-	   scores.WassersteinValue > dm.alertThresholds.WassersteinThreshold ||
-	   scores.KSSize > dm.alertThresholds.KSThreshold {
+func (dm *DivergenceMonitor) determineStatus(scores *DivergenceScores, thresholds AlertThresholds) string {
+	// Red thresholds (the distributions are weighed across windows; the
+	// temporal scores are over the per-minute rates)
+	status := combineWindowStatus(scores.Windows)
+	if endpoints := endpointStatus(scores.Endpoints); endpoints == "red" || status == "green" {
+		status = endpoints
+	}
+	if status == "red" ||
+	   (scores.TemporalMinutes > 0 && scores.TemporalCorr < thresholds.TemporalCorrThreshold) ||
+	   (scores.BurstinessMinutes > 0 && math.Abs(scores.BurstinessRatio-1) > thresholds.BurstinessThreshold) ||
+	   (scores.Autocorrelation != nil && scores.AutocorrelationGap > thresholds.AutocorrThreshold) {
 		return "red"
 	}
 
 	// Amber thresholds (50% of red thresholds)  
-	if scores.JSCategorical > dm.alertThresholds.JSThreshold*0.5 ||
-	   scores.WassersteinValue > dm.alertThresholds.WassersteinThreshold*0.5 ||
-	   scores.KSSize > dm.alertThresholds.KSThreshold*0.5 {
+	if status == "amber" ||
+	   (scores.TemporalMinutes > 0 && 1-scores.TemporalCorr > (1-thresholds.TemporalCorrThreshold)*0.5) ||
+	   (scores.BurstinessMinutes > 0 && math.Abs(scores.BurstinessRatio-1) > thresholds.BurstinessThreshold*0.5) ||
+	   (scores.Autocorrelation != nil && scores.AutocorrelationGap > thresholds.AutocorrThreshold*0.5) {
 		return "amber"
 	}
 
@@ -388,15 +581,15 @@ func (dm *DivergenceMonitor) updateAlertStatus() {
 	for _, family := range dm.families {
 		family.mu.RLock()
 		status := family.Status
-		consecutiveRed := family.ConsecutiveRed
+		burn := family.DivergenceScores.Burn
 		family.mu.RUnlock()
 
+		if burn == burnFast {
+			criticalAlerts++
+		}
 		switch status {
 		case "red":
 			redCount++
-			if consecutiveRed >= dm.alertThresholds.RedStatusMinutes {
-				criticalAlerts++
-			}
 		case "amber":
 			amberCount++
 		}
@@ -446,21 +639,23 @@ func (dm *DivergenceMonitor) computeJSDivergence(ref, current map[string]float64
 	return js / (2.0 * math.Log(2.0)) // Normalize to [0,1]
 }
 
-func (dm *DivergenceMonitor) computeWassersteinDistance(refQuantiles, currentQuantiles []float64) float64 {
-	if len(refQuantiles) == 0 || len(currentQuantiles) == 0 {
+// computeWassersteinDistance approximates the 1-Wasserstein distance
+// between the reference and current value distributions: the mean gap
+// between their quantile functions over [0.01, 0.99], normalised by the
+// reference range. The reference quantile function is interpolated
+// linearly between its referenceLevels.
+func (dm *DivergenceMonitor) computeWassersteinDistance(refQuantiles []float64, current *tdigest) float64 {
+	if len(refQuantiles) != len(referenceLevels) || current.Count() == 0 {
 		return 1.0
 	}
 
-	// Simplified 1-Wasserstein distance using quantiles
 	distance := 0.0
-	minLen := len(refQuantiles)
-	if len(currentQuantiles) < minLen {
-		minLen = len(currentQuantiles)
-	}
-
-	for i := 0; i < minLen; i++ {
-		distance += math.Abs(refQuantiles[i] - currentQuantiles[i])
+	steps := 0
+	for q := 0.01; q <= 0.99+1e-9; q += 0.01 {
+		distance += math.Abs(interpolateQuantile(refQuantiles, q) - current.Quantile(q))
+		steps++
 	}
+	distance /= float64(steps)
 
 	// Normalize by range
 	refRange := refQuantiles[len(refQuantiles)-1] - refQuantiles[0]
@@ -468,30 +663,22 @@ func (dm *DivergenceMonitor) computeWassersteinDistance(refQuantiles, currentQua
 		distance /= refRange
 	}
 
-	return distance / float64(minLen)
+	return distance
 }
 
-func (dm *DivergenceMonitor) computeKSStatistic(refQuantiles, currentQuantiles []float64) float64 {
-	if len(refQuantiles) == 0 || len(currentQuantiles) == 0 {
-		return 1.0
-	}
-
-	// Simplified KS statistic using quantiles
-	maxDiff := 0.0
-	minLen := len(refQuantiles)
-	if len(currentQuantiles) < minLen {
-		minLen = len(currentQuantiles)
+// interpolateQuantile evaluates the quantile function given by quantiles at
+// referenceLevels, linearly between levels and flat beyond them.
+func interpolateQuantile(quantiles []float64, q float64) float64 {
+	if q <= referenceLevels[0] {
+		return quantiles[0]
 	}
-
-	for i := 0; i < minLen; i++ {
-		// Approximate CDF difference at quantile points
-		diff := math.Abs(float64(i)/float64(minLen) - float64(i)/float64(minLen))
-		if diff > maxDiff {
-			maxDiff = diff
+	for i := 1; i < len(referenceLevels); i++ {
+		if q <= referenceLevels[i] {
+			frac := (q - referenceLevels[i-1]) / (referenceLevels[i] - referenceLevels[i-1])
+			return quantiles[i-1] + frac*(quantiles[i]-quantiles[i-1])
 		}
 	}
-
-	return maxDiff
+	return quantiles[len(quantiles)-1]
 }
 
 func (dm *DivergenceMonitor) computeQuantiles(values []float64, quantiles []float64) []float64 {
@@ -517,60 +704,6 @@ func (dm *DivergenceMonitor) computeQuantiles(values []float64, quantiles []floa
 	return result
 }
 
-// Data extraction methods
-
-func (dm *DivergenceMonitor) extractSourceDistribution(samples []Sample) map[string]float64 {
-	counts := make(map[string]int)
-	total := 0
-	
-	for _, sample := range samples {
-		counts[sample.Source]++
-		total++
-	}
-
-	dist := make(map[string]float64)
-	for source, count := range counts {
-		dist[source] = float64(count) / float64(total)
-	}
-	
-	return dist
-}
-
-func (dm *DivergenceMonitor) extractTagDistribution(samples []Sample, tagKey string) map[string]float64 {
-	counts := make(map[string]int)
-	total := 0
-	
-	for _, sample := range samples {
-		if tagValue, exists := sample.Tags[tagKey]; exists {
-			counts[tagValue]++
-			total++
-		}
-	}
-
-	dist := make(map[string]float64)
-	for value, count := range counts {
-		dist[value] = float64(count) / float64(total)
-	}
-	
-	return dist
-}
-
-func (dm *DivergenceMonitor) extractValues(samples []Sample) []float64 {
-	values := make([]float64, len(samples))
-	for i, sample := range samples {
-		values[i] = sample.Value
-	}
-	return values
-}
-
-func (dm *DivergenceMonitor) extractSizes(samples []Sample) []float64 {
-	sizes := make([]float64, len(samples))
-	for i, sample := range samples {
-		sizes[i] = float64(sample.LineSize)
-	}
-	return sizes
-}
-
 // HTTP handlers
 
 func (dm *DivergenceMonitor) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -580,9 +713,27 @@ func (dm *DivergenceMonitor) handleHealth(w http.ResponseWriter, r *http.Request
 
 func (dm *DivergenceMonitor) handleStatus(w http.ResponseWriter, r *http.Request) {
 	dm.mu.RLock()
+	referenceErrors := 0
+	for _, reference := range dm.references {
+		if reference.Error != "" {
+			referenceErrors++
+		}
+	}
+	statuses := map[string]int{"green": 0, "amber": 0, "red": 0}
+	for _, family := range dm.families {
+		family.mu.RLock()
+		statuses[family.Status]++
+		family.mu.RUnlock()
+	}
 	status := map[string]interface{}{
-		"families":  len(dm.families),
-		"timestamp": time.Now().UTC(),
+		"families":         len(dm.families),
+		"statuses":         statuses,
+		"reference_errors": referenceErrors,
+		"silences":         dm.silences.Active(time.Now()),
+		"timestamp":        time.Now().UTC(),
+	}
+	if dm.shard.Sharded() {
+		status["shard"] = dm.shard
 	}
 	dm.mu.RUnlock()
 
@@ -596,12 +747,14 @@ func (dm *DivergenceMonitor) handleFamilies(w http.ResponseWriter, r *http.Reque
 	for _, family := range dm.families {
 		family.mu.RLock()
 		families = append(families, map[string]interface{}{
-			"family_id":    family.FamilyID,
-			"metric_name":  family.MetricName,
-			"status":       family.Status,
-			"last_update":  family.LastUpdate,
-			"samples":      len(family.CurrentWindow.Samples),
-			"divergence":   family.DivergenceScores,
+			"family_id":        family.FamilyID,
+			"metric_name":      family.MetricName,
+			"status":           family.Status,
+			"last_update":      family.LastUpdate,
+			"samples":          family.CurrentWindow.Count(),
+			"captured_samples": family.CapturedWindow.Count(),
+			"divergence":       family.DivergenceScores,
+			"reference":        dm.references[family.FamilyID],
 		})
 		family.mu.RUnlock()
 	}
@@ -611,11 +764,19 @@ func (dm *DivergenceMonitor) handleFamilies(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(families)
 }
 
-func (dm *DivergenceMonitor) handleFamilyDivergence(w http.ResponseWriter, r *http.Request) {
-	// Extract family ID from URL path
-	// Simplified implementation
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "not implemented"})
+// handleFamily routes /families/{id}/divergence and /families/{id}/history.
+func (dm *DivergenceMonitor) handleFamily(w http.ResponseWriter, r *http.Request) {
+	familyID, view, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/families/"), "/")
+	switch {
+	case familyID == "":
+		http.NotFound(w, r)
+	case view == "divergence":
+		dm.handleFamilyDivergence(w, r, familyID)
+	case view == "history":
+		dm.handleFamilyHistory(w, r, familyID)
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 func (dm *DivergenceMonitor) handleComputeDivergence(w http.ResponseWriter, r *http.Request) {
@@ -629,73 +790,262 @@ func (dm *DivergenceMonitor) handleComputeDivergence(w http.ResponseWriter, r *h
 	w.Write([]byte("Divergence computation triggered"))
 }
 
-// Utility functions
+func main() {
+	var (
+		port               = flag.Int("port", 9100, "Metrics port")
+		referencePath      = flag.String("reference-path", "gs://bucket/recipes/v1/recipes", "Recipes to load reference statistics from (gs://bucket/prefix or a local directory)")
+		referenceRefresh   = flag.Duration("reference-refresh", 10*time.Minute, "How often to reload reference statistics")
+		kafkaBrokers       = flag.String("kafka-brokers", "", "Comma-separated Kafka brokers")
+		kafkaTopic         = flag.String("kafka-topic", "", "Kafka topic of sampled lines to consume")
+		kafkaGroup         = flag.String("kafka-group", "divergence-monitor", "Kafka consumer group")
+		pubsubSubscription = flag.String("pubsub-subscription", "", "Pub/Sub subscription of sampled lines to consume (projects/<project>/subscriptions/<subscription>)")
+		streamConsumers    = flag.Int("stream-consumers", 4, "Kafka readers or Pub/Sub receive goroutines")
+		alertConfig        = flag.String("alert-config", "", "JSON file of alert webhook destinations (Slack, PagerDuty, generic)")
+		alertResolve       = flag.Int("alert-resolve-minutes", 10, "Minutes a family must stay green before its alert resolves")
+		alertRepeat        = flag.Duration("alert-repeat", 4*time.Hour, "How often to repeat a firing alert; 0 never repeats")
+		historyPath        = flag.String("history-path", "", "Where to persist divergence history (gs://bucket/prefix or a local directory); empty keeps it in memory")
+		historyRetention   = flag.Duration("history-retention", 72*time.Hour, "How much divergence history to keep and serve")
+		historyFlush       = flag.Duration("history-flush", 5*time.Minute, "How often to write divergence history")
+		checkpointPath     = flag.String("checkpoint-path", "", "Where to checkpoint windows, statuses, alerts and silences so they survive restarts (gs://bucket/prefix or a local directory); empty disables checkpoints")
+		checkpointInterval = flag.Duration("checkpoint-interval", time.Minute, "How often to write the checkpoint")
+		remediationConfig  = flag.String("remediation-config", "", "JSON file of control plane actions to take on families that stay red")
+		thresholdConfig    = flag.String("threshold-config", "", "JSON file of per-class and per-family alert threshold overrides, reloaded when it changes")
+		thresholdReload    = flag.Duration("threshold-reload", 30*time.Second, "How often to check -threshold-config for changes")
+		shardID            = flag.Int("shard-id", 0, "This replica's shard, below -shard-count; -1 takes the host name's ordinal suffix, as of a StatefulSet pod")
+		shardCount         = flag.Int("shard-count", 1, "Replicas the families are partitioned between, by a hash of the family ID")
+		shardURLs          = flag.String("shard-urls", "", "Comma-separated API base URLs of the replicas, in shard order, for -mode=aggregate (http://monitor-0:9101,...)")
+		scorerConfig       = flag.String("scorer-config", "", "JSON file of divergence scorers to add to the built-in ones (chi_square, psi, energy_distance)")
+		grpcPort           = flag.Int("grpc-port", 9102, "gRPC sample ingestion port; 0 disables it")
+		grpcMaxMessage     = flag.Int("grpc-max-message", 16<<20, "Largest gRPC sample batch accepted, in bytes")
+		grpcStreamWindow   = flag.Int("grpc-stream-window", 1<<20, "Per-stream gRPC flow control window, in bytes")
+		grpcMaxStreams     = flag.Int("grpc-max-streams", 100, "Concurrent gRPC ingestion streams per connection")
+		grpcStreamRate     = flag.Float64("grpc-stream-rate", 0, "Lines and samples per second each gRPC stream may send; 0 is unpaced")
+		liveConfig         = flag.String("live-baseline-config", "", "JSON file of a Wavefront or Prometheus query API to refresh reference distributions from")
+		liveRefresh        = flag.Duration("live-baseline-refresh", 15*time.Minute, "How often to refresh reference distributions from -live-baseline-config")
+		liveLookback       = flag.Duration("live-baseline-lookback", time.Hour, "Span of production data each live refresh covers")
+		reportPath         = flag.String("report-path", "", "Where to write daily divergence reports (gs://bucket/prefix or a local directory); empty only serves the day so far on /report")
+		reportFlush        = flag.Duration("report-flush", 10*time.Minute, "How often to check for finished daily reports to write")
+		mode               = flag.String("mode", "monitor", "monitor scores live traffic; verify scores -verify-generated against -verify-captured once and exits; aggregate merges the status of the replicas in -shard-urls")
+		verifyCaptured     = flag.String("verify-captured", "", "Captured dataset to verify against (gs://bucket/prefix or a local directory of .wf, .wf.zst or .wf.gz files)")
+		verifyGenerated    = flag.String("verify-generated", "", "Generated dataset to verify (gs://bucket/prefix or a local directory of .wf, .wf.zst or .wf.gz files)")
+		verifyOutput       = flag.String("verify-output", "-", "File to write the verification report to; - writes to stdout")
+		verifyMaxLines     = flag.Int("verify-max-lines", 0, "Lines to read from each dataset; 0 reads them whole")
+		verifyFailOn       = flag.String("verify-fail-on", "red", "Lowest status that fails verification: red, amber or none (missing families count as red)")
+	)
+	flag.Parse()
 
-func NewSlidingWindow(duration time.Duration) *SlidingWindow {
-	return &SlidingWindow{
-		WindowSize: duration,
-		Samples:    make([]Sample, 0),
-		maxSamples: 10000, // Limit memory usage
+	if *referenceRefresh <= 0 {
+		log.Fatalf("-reference-refresh must be positive")
+	}
+	if *kafkaTopic != "" && *kafkaBrokers == "" {
+		log.Fatalf("-kafka-topic requires -kafka-brokers")
+	}
+	if *streamConsumers <= 0 {
+		log.Fatalf("-stream-consumers must be positive")
+	}
+	if *pubsubSubscription != "" {
+		if _, _, err := parseSubscription(*pubsubSubscription); err != nil {
+			log.Fatalf("Invalid -pubsub-subscription: %v", err)
+		}
 	}
-}
-
-func (sw *SlidingWindow) AddSample(sample Sample) {
-	sw.mu.Lock()
-	defer sw.mu.Unlock()
 
-	// Add new sample
-	sw.Samples = append(sw.Samples, sample)
+	if *alertResolve <= 0 {
+		log.Fatalf("-alert-resolve-minutes must be positive")
+	}
+	if *alertRepeat < 0 {
+		log.Fatalf("-alert-repeat must not be negative")
+	}
+	if *historyRetention <= 0 || *historyFlush <= 0 {
+		log.Fatalf("-history-retention and -history-flush must be positive")
+	}
+	if *checkpointInterval <= 0 {
+		log.Fatalf("-checkpoint-interval must be positive")
+	}
+	if *thresholdReload <= 0 {
+		log.Fatalf("-threshold-reload must be positive")
+	}
+	if *grpcMaxMessage <= 0 || *grpcStreamWindow < 64<<10 || *grpcMaxStreams <= 0 || *grpcStreamRate < 0 {
+		log.Fatalf("-grpc-max-message and -grpc-max-streams must be positive, -grpc-stream-window at least 64KiB and -grpc-stream-rate not negative")
+	}
+	if *reportFlush <= 0 {
+		log.Fatalf("-report-flush must be positive")
+	}
+	if *liveRefresh <= 0 || *liveLookback <= 0 {
+		log.Fatalf("-live-baseline-refresh and -live-baseline-lookback must be positive")
+	}
 
-	// Remove old samples outside window
-	cutoff := time.Now().Add(-sw.WindowSize)
-	validStart := 0
-	for i, s := range sw.Samples {
-		if s.Timestamp.After(cutoff) {
-			validStart = i
-			break
+	switch *mode {
+	case "monitor":
+	case "verify":
+		if *verifyCaptured == "" || *verifyGenerated == "" {
+			log.Fatalf("-mode=verify requires -verify-captured and -verify-generated")
+		}
+		if *verifyMaxLines < 0 {
+			log.Fatalf("-verify-max-lines must not be negative")
+		}
+		switch *verifyFailOn {
+		case "red", "amber", "none":
+		default:
+			log.Fatalf("-verify-fail-on must be red, amber or none")
+		}
+	case "aggregate":
+		if *shardURLs == "" {
+			log.Fatalf("-mode=aggregate requires -shard-urls")
 		}
+	default:
+		log.Fatalf("-mode must be monitor, verify or aggregate")
 	}
 
-	if validStart > 0 {
-		sw.Samples = sw.Samples[validStart:]
+	// Merge the replicas' status, and exit
+	if *mode == "aggregate" {
+		aggregator, err := NewAggregator(strings.Split(*shardURLs, ","))
+		if err != nil {
+			log.Fatalf("Invalid -shard-urls: %v", err)
+		}
+		if err := aggregator.Serve(*port + 1); err != nil {
+			log.Fatalf("Aggregator failed: %v", err)
+		}
+		return
 	}
 
-	// Limit total samples
-	if len(sw.Samples) > sw.maxSamples {
-		sw.Samples = sw.Samples[len(sw.Samples)-sw.maxSamples:]
+	monitor := NewDivergenceMonitor(*referencePath)
+	if *scorerConfig != "" {
+		config, err := LoadScorersConfig(*scorerConfig)
+		if err != nil {
+			log.Fatalf("Failed to load scorer config: %v", err)
+		}
+		if err := monitor.AddScorers(config); err != nil {
+			log.Fatalf("Invalid scorer config: %v", err)
+		}
 	}
-}
 
-func generateMockIntensityCurve() []float64 {
-	curve := make([]float64, 1440) // 24 hours * 60 minutes
-	for i := range curve {
-		// Simulate daily pattern with higher activity during business hours
-		hour := float64(i) / 60.0
-		if hour >= 8 && hour <= 18 {
-			curve[i] = 1.5 + 0.5*math.Sin((hour-8)*math.Pi/10)
-		} else {
-			curve[i] = 0.3 + 0.2*math.Sin((hour)*math.Pi/12)
+	// Verify a generated dataset against a captured one, and exit
+	if *mode == "verify" {
+		monitor.thresholds.Path = *thresholdConfig
+		if err := monitor.thresholds.Reload(); err != nil {
+			log.Fatalf("Failed to load threshold config: %v", err)
 		}
+		passed, err := monitor.Verify(context.Background(), VerifyConfig{
+			CapturedPath:  *verifyCaptured,
+			GeneratedPath: *verifyGenerated,
+			OutputPath:    *verifyOutput,
+			MaxLines:      *verifyMaxLines,
+			FailOn:        *verifyFailOn,
+		})
+		if err != nil {
+			log.Fatalf("Verification failed: %v", err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
 	}
-	return curve
-}
-
-func main() {
-	var (
-		port          = flag.Int("port", 9100, "Metrics port")
-		referencePath = flag.String("reference-path", "gs://bucket/references", "Path to reference statistics")
-	)
-	flag.Parse()
 
-	monitor := NewDivergenceMonitor(*referencePath)
+	shard, err := NewShard(*shardID, *shardCount)
+	if err != nil {
+		log.Fatalf("Invalid shard: %v", err)
+	}
+	if shard.Sharded() && *pubsubSubscription != "" && !strings.Contains(*pubsubSubscription, shardPlaceholder) {
+		log.Fatalf("-pubsub-subscription must contain %s when sharded, so each replica receives every line", shardPlaceholder)
+	}
+	monitor.shard = shard
+	if shard.Sharded() {
+		log.Printf("Scoring shard %d of %d", shard.ID, shard.Count)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Send alert notifications, if configured
+	if *alertConfig != "" {
+		config, err := LoadAlertConfig(*alertConfig)
+		if err != nil {
+			log.Fatalf("Failed to load alert config: %v", err)
+		}
+		monitor.alerts = NewAlertDispatcher(config, *alertResolve, *alertRepeat)
+		go monitor.alerts.Run(ctx)
+	}
+
+	// Remediate sustained divergence through the control plane, if configured
+	if *remediationConfig != "" {
+		config, err := LoadRemediationConfig(*remediationConfig)
+		if err != nil {
+			log.Fatalf("Failed to load remediation config: %v", err)
+		}
+		monitor.remediator = NewRemediator(config)
+		go monitor.RunRemediation(ctx)
+	}
+
+	// Load threshold overrides, and reload them as they change
+	monitor.thresholds.Path = *thresholdConfig
+	if err := monitor.thresholds.Reload(); err != nil {
+		log.Fatalf("Failed to load threshold config: %v", err)
+	}
+	go monitor.thresholds.Run(ctx, *thresholdReload)
+
+	// Restore and persist divergence history
+	monitor.history = NewDivergenceHistory(*historyPath, *historyRetention)
+	if err := monitor.history.Restore(ctx); err != nil {
+		log.Printf("Failed to restore divergence history: %v", err)
+	}
+	go monitor.history.Run(ctx, *historyFlush)
+
+	// Summarise each day per family, and write the summaries if configured
+	monitor.reporter = NewDivergenceReporter(*reportPath)
+	go monitor.reporter.Run(ctx, *reportFlush)
+
 	// Load references
 	if err := monitor.LoadReferences(ctx); err != nil {
 		log.Fatalf("Failed to load references: %v", err)
 	}
+	go monitor.RefreshReferences(ctx, *referenceRefresh)
+
+	// Restore windows, statuses, alerts and silences from the last
+	// checkpoint, and checkpoint them from now on
+	checkpointer := NewCheckpointer(*checkpointPath)
+	if err := checkpointer.Restore(ctx, monitor); err != nil {
+		log.Printf("Failed to restore checkpoint: %v", err)
+	}
+	go checkpointer.Run(ctx, monitor, *checkpointInterval)
+
+	// Refresh reference distributions from production, if configured
+	if *liveConfig != "" {
+		config, err := LoadLiveBaselineConfig(*liveConfig)
+		if err != nil {
+			log.Fatalf("Failed to load live baseline config: %v", err)
+		}
+		monitor.live = NewLiveBaseline(config, *liveLookback)
+		go monitor.RunLiveBaseline(ctx, *liveRefresh)
+	}
+
+	// Consume sampled lines from a stream, if configured
+	streams := StreamConfig{
+		KafkaTopic:         *kafkaTopic,
+		KafkaGroup:         *kafkaGroup,
+		PubSubSubscription: *pubsubSubscription,
+		Consumers:          *streamConsumers,
+	}
+	if *kafkaBrokers != "" {
+		streams.KafkaBrokers = strings.Split(*kafkaBrokers, ",")
+	}
+	monitor.ConsumeStreams(ctx, shard.streams(streams))
+
+	// Accept sample batches over gRPC, if enabled
+	if *grpcPort != 0 {
+		config := GRPCConfig{
+			Port:          *grpcPort,
+			MaxMessage:    *grpcMaxMessage,
+			StreamWindow:  int32(*grpcStreamWindow),
+			MaxStreams:    uint32(*grpcMaxStreams),
+			LineRate:      *grpcStreamRate,
+			LineRateBurst: *grpcStreamRate,
+		}
+		go func() {
+			if err := monitor.ServeGRPC(ctx, config); err != nil {
+				log.Fatalf("gRPC ingestion failed: %v", err)
+			}
+		}()
+	}
 
 	// Start monitoring
 	if err := monitor.Start(ctx, *port); err != nil {
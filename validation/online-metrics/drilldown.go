@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// Values listed per categorical dimension in the drilldown
+	drilldownValues = 10
+
+	// How far back the drilldown's status history reaches
+	drilldownStatusWindow = 24 * time.Hour
+)
+
+// FamilyDrilldown is the per-dimension breakdown of a family's divergence.
+type FamilyDrilldown struct {
+	FamilyID   string            `json:"family_id"`
+	MetricName string            `json:"metric_name"`
+	Status     string            `json:"status"`
+	Samples    int               `json:"samples"`
+	Divergence *DivergenceScores `json:"divergence"`
+
+	Source         *CategoricalBreakdown  `json:"source,omitempty"`
+	Tags           []CategoricalBreakdown `json:"tags"` // Most divergent first
+	TagPairs       []PairDivergence       `json:"tag_pairs"`
+	ValueQuantiles []QuantileDelta        `json:"value_quantiles"`
+	SizeQuantiles  []QuantileDelta        `json:"size_quantiles"`
+	StatusHistory  []StatusRun            `json:"status_history"` // Oldest first
+
+	HistogramQuantiles []QuantileDelta `json:"histogram_quantiles,omitempty"` // Merged centroids; histogram families only
+	Schema             []KeyPresence   `json:"schema"`                        // Tag keys whose presence differs, worst first
+}
+
+// CategoricalBreakdown compares the source or one tag key's value
+// distribution with the reference.
+type CategoricalBreakdown struct {
+	Dimension string       `json:"dimension"` // "source" or the tag key
+	JS        float64      `json:"js"`
+	Values    []ValueDelta `json:"values"` // Largest absolute delta first
+}
+
+type ValueDelta struct {
+	Value     string  `json:"value"`
+	Reference float64 `json:"reference"`
+	Observed  float64 `json:"observed"`
+	Delta     float64 `json:"delta"` // Observed - reference
+}
+
+type QuantileDelta struct {
+	Quantile  string   `json:"quantile"`
+	Reference float64  `json:"reference"`
+	Observed  float64  `json:"observed"`
+	Delta     float64  `json:"delta"`
+	Relative  *float64 `json:"relative,omitempty"` // Delta over the reference; absent when it is 0
+}
+
+// StatusRun is a stretch of consecutive evaluations with the same status.
+type StatusRun struct {
+	Status string    `json:"status"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// handleFamilyDivergence serves GET /families/{id}/divergence: where the
+// family diverges, dimension by dimension, against the current window.
+func (dm *DivergenceMonitor) handleFamilyDivergence(w http.ResponseWriter, r *http.Request, familyID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dm.mu.RLock()
+	family, exists := dm.families[familyID]
+	dm.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Unknown family", http.StatusNotFound)
+		return
+	}
+
+	current := family.CurrentWindow.Summary()
+	family.mu.RLock()
+	scores := *family.DivergenceScores
+	drilldown := FamilyDrilldown{
+		FamilyID:   family.FamilyID,
+		MetricName: family.MetricName,
+		Status:     family.Status,
+		Samples:    current.Count,
+		Divergence: &scores,
+		Tags:       []CategoricalBreakdown{},
+		TagPairs:   family.PairDivergences,
+		Schema:     family.SchemaKeys,
+	}
+	if drilldown.TagPairs == nil {
+		drilldown.TagPairs = []PairDivergence{}
+	}
+	if drilldown.Schema == nil {
+		drilldown.Schema = []KeyPresence{}
+	}
+	hour := scores.ReferenceSlice
+	if scores.LastCalculated.IsZero() {
+		hour = -1
+	}
+	if ref := family.ReferenceStats.slice(hour); ref != nil {
+		source := dm.categoricalBreakdown("source", ref.SourceDistribution, distribution(current.Sources))
+		drilldown.Source = &source
+		for key, refDist := range ref.TagDistributions {
+			drilldown.Tags = append(drilldown.Tags, dm.categoricalBreakdown(key, refDist, distribution(current.Tags[key])))
+		}
+		drilldown.ValueQuantiles = quantileDeltas(ref.ValueQuantiles, current.Values)
+		drilldown.SizeQuantiles = quantileDeltas(ref.SizeQuantiles, current.Sizes)
+		if len(ref.HistogramQuantiles) > 0 {
+			drilldown.HistogramQuantiles = quantileDeltas(ref.HistogramQuantiles, current.HistogramValues)
+		}
+	}
+	family.mu.RUnlock()
+
+	sort.Slice(drilldown.Tags, func(i, j int) bool { return drilldown.Tags[i].JS > drilldown.Tags[j].JS })
+	window := min(drilldownStatusWindow, dm.history.Retention)
+	drilldown.StatusHistory = statusRuns(dm.history.Points(familyID, time.Now().Add(-window)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drilldown)
+}
+
+// categoricalBreakdown lists the values whose observed frequency is
+// furthest from the reference, over the values either side has.
+func (dm *DivergenceMonitor) categoricalBreakdown(dimension string, ref, observed map[string]float64) CategoricalBreakdown {
+	deltas := make([]ValueDelta, 0, len(ref)+len(observed))
+	for value, p := range ref {
+		deltas = append(deltas, ValueDelta{Value: value, Reference: p, Observed: observed[value], Delta: observed[value] - p})
+	}
+	for value, q := range observed {
+		if _, ok := ref[value]; !ok {
+			deltas = append(deltas, ValueDelta{Value: value, Observed: q, Delta: q})
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if a, b := math.Abs(deltas[i].Delta), math.Abs(deltas[j].Delta); a != b {
+			return a > b
+		}
+		return deltas[i].Value < deltas[j].Value
+	})
+	if len(deltas) > drilldownValues {
+		deltas = deltas[:drilldownValues]
+	}
+	return CategoricalBreakdown{
+		Dimension: dimension,
+		JS:        dm.computeJSDivergence(ref, observed),
+		Values:    deltas,
+	}
+}
+
+// quantileDeltas compares the reference quantiles with the window's at the
+// same levels; none when either side is empty.
+func quantileDeltas(refQuantiles []float64, current *tdigest) []QuantileDelta {
+	if len(refQuantiles) != len(referenceLevels) || current.Count() == 0 {
+		return []QuantileDelta{}
+	}
+	deltas := make([]QuantileDelta, len(referenceLevels))
+	for i, level := range referenceLevels {
+		observed := current.Quantile(level)
+		deltas[i] = QuantileDelta{
+			Quantile:  referenceQuantiles[i],
+			Reference: refQuantiles[i],
+			Observed:  observed,
+			Delta:     observed - refQuantiles[i],
+		}
+		if refQuantiles[i] != 0 {
+			relative := deltas[i].Delta / math.Abs(refQuantiles[i])
+			deltas[i].Relative = &relative
+		}
+	}
+	return deltas
+}
+
+// statusRuns collapses history points into runs of the same status.
+func statusRuns(points []HistoryPoint) []StatusRun {
+	runs := []StatusRun{}
+	for _, point := range points {
+		if n := len(runs); n > 0 && runs[n-1].Status == point.Status {
+			runs[n-1].Until = point.Timestamp
+			continue
+		}
+		runs = append(runs, StatusRun{Status: point.Status, Since: point.Timestamp, Until: point.Timestamp})
+	}
+	return runs
+}
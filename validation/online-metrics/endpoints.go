@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// endpointTag is the tag a sender may add to a sampled line to name the
+// collector endpoint it was sent to. It is taken off before the line is
+// attributed to a family, since no recipe has it. Lines without it take
+// the endpoint of their message or batch, if any.
+const endpointTag = "loadgen_endpoint"
+
+// maxFamilyEndpoints bounds how many endpoints each family is split by;
+// samples of further endpoints are scored with the family only.
+const maxFamilyEndpoints = 16
+
+var (
+	divergenceEndpointScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_endpoint_score",
+			Help: "Divergence scores of the samples sent to each collector endpoint over the last hour, by score",
+		},
+		[]string{"family_id", "endpoint", "score"},
+	)
+
+	divergenceEndpointStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_endpoint_status",
+			Help: "Status of the samples sent to each collector endpoint alone (0=green, 1=amber, 2=red)",
+		},
+		[]string{"family_id", "endpoint"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceEndpointScore)
+	prometheus.MustRegister(divergenceEndpointStatus)
+}
+
+// takeEndpoint removes the endpoint tag from tags and returns its value.
+func takeEndpoint(tags map[string]string) string {
+	endpoint, ok := tags[endpointTag]
+	if ok {
+		delete(tags, endpointTag)
+	}
+	return endpoint
+}
+
+// endpointTagSize is how many bytes of line the endpoint tag takes, which
+// are not part of the line its recipe describes.
+func endpointTagSize(line, endpoint string) int {
+	if endpoint == "" {
+		return 0
+	}
+	if quoted := endpointTag + `="` + endpoint + `"`; strings.Contains(line, quoted) {
+		return len(quoted) + 1
+	}
+	return len(endpointTag) + len(endpoint) + 2
+}
+
+// addEndpointSample adds a generated sample to the window of its endpoint.
+// The windows span an hour, like the medium window, so an endpoint's
+// share of the samples is enough to score and a spike does not flap it.
+// The caller holds family.mu.
+func (family *FamilyMonitor) addEndpointSample(sample Sample) {
+	if sample.Endpoint == "" {
+		return
+	}
+	window, exists := family.Endpoints[sample.Endpoint]
+	if !exists {
+		if len(family.Endpoints) >= maxFamilyEndpoints {
+			return
+		}
+		if family.Endpoints == nil {
+			family.Endpoints = make(map[string]*SlidingWindow)
+		}
+		window = NewSlidingWindowBuckets(mediumWindowSize, mediumWindowBuckets)
+		if family.ReferenceStats != nil {
+			window.TrackPairs(trackedPairs(family.ReferenceStats.TagCooccurrence))
+		}
+		family.Endpoints[sample.Endpoint] = window
+	}
+	window.AddSample(sample)
+}
+
+// endpointScores scores each endpoint's samples against ref, the
+// reference for the last hour, so a bug that mangles the lines of one
+// endpoint (a proxy rewriting tags, say) shows on that endpoint rather
+// than being averaged into the family's scores. Endpoints whose samples have all expired are dropped.
+// It returns nil unless the family's samples were sent to more than one
+// endpoint, when the split says nothing the family's scores do not. The
+// caller holds family.mu.
+func (dm *DivergenceMonitor) endpointScores(family *FamilyMonitor, ref *ReferenceStatistics, thresholds AlertThresholds) map[string]*WindowScores {
+	summaries := make(map[string]*windowSummary, len(family.Endpoints))
+	for endpoint, window := range family.Endpoints {
+		summary := window.Summary()
+		if summary.Count == 0 {
+			delete(family.Endpoints, endpoint)
+			divergenceEndpointScore.DeletePartialMatch(prometheus.Labels{"family_id": family.FamilyID, "endpoint": endpoint})
+			divergenceEndpointStatus.DeleteLabelValues(family.FamilyID, endpoint)
+			continue
+		}
+		summaries[endpoint] = summary
+	}
+	if len(summaries) < 2 {
+		return nil
+	}
+
+	endpoints := make(map[string]*WindowScores, len(summaries))
+	for endpoint, summary := range summaries {
+		endpoints[endpoint] = dm.windowScores(ref, summary, thresholds)
+	}
+	recordEndpointScores(family.FamilyID, endpoints)
+	return endpoints
+}
+
+// endpointStatus is the worst status of the endpoints with enough samples.
+func endpointStatus(endpoints map[string]*WindowScores) string {
+	status := "green"
+	for _, scores := range endpoints {
+		switch {
+		case scores == nil:
+		case scores.Status == "red":
+			return "red"
+		case scores.Status == "amber":
+			status = "amber"
+		}
+	}
+	return status
+}
+
+// divergedEndpoints lists the endpoints with the given status, sorted.
+func divergedEndpoints(endpoints map[string]*WindowScores, status string) []string {
+	var names []string
+	for endpoint, scores := range endpoints {
+		if scores != nil && scores.Status == status {
+			names = append(names, endpoint)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordEndpointScores exports each endpoint's scores and status.
+func recordEndpointScores(familyID string, endpoints map[string]*WindowScores) {
+	for endpoint, scores := range endpoints {
+		if scores == nil {
+			continue
+		}
+		for score, value := range scores.values() {
+			divergenceEndpointScore.WithLabelValues(familyID, endpoint, score).Set(value)
+		}
+		statusValue := 0.0
+		switch scores.Status {
+		case "amber":
+			statusValue = 1
+		case "red":
+			statusValue = 2
+		}
+		divergenceEndpointStatus.WithLabelValues(familyID, endpoint).Set(statusValue)
+	}
+}
+
+// endpointSummary describes the diverged endpoints for an alert, or ""
+// if none did.
+func endpointSummary(endpoints map[string]*WindowScores) string {
+	var parts []string
+	if red := divergedEndpoints(endpoints, "red"); len(red) > 0 {
+		parts = append(parts, "red at "+strings.Join(red, ", "))
+	}
+	if amber := divergedEndpoints(endpoints, "amber"); len(amber) > 0 {
+		parts = append(parts, "amber at "+strings.Join(amber, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	grpcStreams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "loadgen_grpc_ingest_streams",
+			Help: "Open IngestSamples streams",
+		},
+	)
+
+	grpcBatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_grpc_ingest_batches_total",
+			Help: "Sample batches received over gRPC, by result (accepted, invalid)",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcStreams)
+	prometheus.MustRegister(grpcBatches)
+}
+
+// GRPCConfig configures the gRPC ingestion server. Each stream's HTTP/2
+// window bounds how much a client can send ahead of the monitor; LineRate
+// additionally paces each stream.
+type GRPCConfig struct {
+	Port          int
+	MaxMessage    int   // Largest batch accepted, in bytes
+	StreamWindow  int32 // Per-stream HTTP/2 flow control window, in bytes
+	MaxStreams    uint32
+	LineRate      float64 // Lines and samples per second per stream; 0 is unpaced
+	LineRateBurst float64
+}
+
+// ingestService serves the SampleIngestion service of ingest.proto.
+type ingestService struct {
+	dm     *DivergenceMonitor
+	config GRPCConfig
+}
+
+var sampleIngestionDesc = grpc.ServiceDesc{
+	ServiceName: "loadgen.monitor.v1.SampleIngestion",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "IngestSamples",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*ingestService).ingestSamples(stream)
+			},
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ingest.proto",
+}
+
+// ServeGRPC serves sample ingestion until ctx is cancelled.
+func (dm *DivergenceMonitor) ServeGRPC(ctx context.Context, config GRPCConfig) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(ingestCodec{}),
+		grpc.MaxRecvMsgSize(config.MaxMessage),
+		grpc.InitialWindowSize(config.StreamWindow),
+		grpc.MaxConcurrentStreams(config.MaxStreams),
+	)
+	server.RegisterService(&sampleIngestionDesc, &ingestService{dm: dm, config: config})
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	log.Printf("Serving gRPC sample ingestion on :%d", config.Port)
+	return server.Serve(listener)
+}
+
+// ingestSamples reads batches one at a time until the client closes the
+// stream. Not reading is the flow control: once the stream's window is
+// full, the client's sends block.
+func (s *ingestService) ingestSamples(stream grpc.ServerStream) error {
+	grpcStreams.Inc()
+	defer grpcStreams.Dec()
+
+	var summary IngestSummary
+	pacer := newStreamPacer(s.config.LineRate, s.config.LineRateBurst)
+	for {
+		var batch SampleBatch
+		err := stream.RecvMsg(&batch)
+		if errors.Is(err, io.EOF) {
+			return stream.SendMsg(&summary)
+		}
+		if err != nil {
+			return err
+		}
+
+		origin := batch.Origin
+		if origin == "" {
+			origin = originGenerated
+		}
+		if origin != originGenerated && origin != originCaptured {
+			grpcBatches.WithLabelValues("invalid").Inc()
+			return status.Errorf(codes.InvalidArgument, "unknown origin %q", origin)
+		}
+
+		received := time.Now()
+		counts := s.dm.IngestLines(origin, batch.Endpoint, received, batch.Lines)
+		if len(batch.Samples) > 0 {
+			byFamily := make(map[string][]Sample)
+			for _, sample := range batch.Samples {
+				sample.Endpoint = takeEndpoint(sample.Tags)
+				if sample.Endpoint == "" {
+					sample.Endpoint = batch.Endpoint
+				}
+				byFamily[sample.familyID] = append(byFamily[sample.familyID], sample.Sample)
+			}
+			sampleCounts := s.dm.ingestSamples(origin, received, byFamily)
+			sampleCounts.record(origin)
+			counts.Accepted += sampleCounts.Accepted
+			counts.UnknownFamily += sampleCounts.UnknownFamily
+			counts.OtherShard += sampleCounts.OtherShard
+		}
+		if len(batch.Requests) > 0 {
+			s.dm.AddRequestSamples(batch.Requests)
+		}
+		grpcBatches.WithLabelValues("accepted").Inc()
+
+		summary.Batches++
+		summary.Accepted += uint64(counts.Accepted)
+		summary.UnknownFamily += uint64(counts.UnknownFamily)
+		summary.OtherShard += uint64(counts.OtherShard)
+		summary.Unparsed += uint64(counts.Unparsed)
+		summary.Skipped += uint64(counts.Skipped)
+		summary.Requests += uint64(len(batch.Requests))
+
+		if err := pacer.wait(stream.Context(), len(batch.Lines)+len(batch.Samples)); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+}
+
+// streamPacer is a token bucket over one stream's lines.
+type streamPacer struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newStreamPacer(rate, burst float64) *streamPacer {
+	return &streamPacer{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens, sleeping until the bucket has refilled enough to
+// cover any debt.
+func (p *streamPacer) wait(ctx context.Context, n int) error {
+	if p.rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	p.tokens = math.Min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate) - float64(n)
+	p.last = now
+	if p.tokens >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-p.tokens / p.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SampleBatch, IngestSummary and the messages within are encoded as
+// ingest.proto describes.
+type SampleBatch struct {
+	Origin   string
+	Lines    []string
+	Samples  []familySample
+	Requests []RequestSample
+	Endpoint string
+}
+
+type familySample struct {
+	familyID string
+	Sample
+}
+
+type IngestSummary struct {
+	Batches       uint64
+	Accepted      uint64
+	UnknownFamily uint64
+	Unparsed      uint64
+	Skipped       uint64
+	Requests      uint64
+	OtherShard    uint64
+}
+
+// ingestCodec marshals the ingestion messages in protobuf wire format. It
+// is forced on the ingestion server only, under the "proto" name, so
+// clients generated from ingest.proto interoperate.
+type ingestCodec struct{}
+
+func (ingestCodec) Name() string { return "proto" }
+
+func (ingestCodec) Marshal(v interface{}) ([]byte, error) {
+	summary, ok := v.(*IngestSummary)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	var b []byte
+	for _, field := range []struct {
+		num   protowire.Number
+		value uint64
+	}{
+		{1, summary.Batches},
+		{2, summary.Accepted},
+		{3, summary.UnknownFamily},
+		{4, summary.Unparsed},
+		{5, summary.Skipped},
+		{6, summary.Requests},
+		{7, summary.OtherShard},
+	} {
+		if field.value != 0 {
+			b = protowire.AppendTag(b, field.num, protowire.VarintType)
+			b = protowire.AppendVarint(b, field.value)
+		}
+	}
+	return b, nil
+}
+
+func (ingestCodec) Unmarshal(data []byte, v interface{}) error {
+	batch, ok := v.(*SampleBatch)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return protoFields(data, func(field protoField) error {
+		switch field.num {
+		case 1:
+			batch.Origin = string(field.bytes)
+		case 2:
+			batch.Lines = append(batch.Lines, string(field.bytes))
+		case 3:
+			sample, err := unmarshalSample(field.bytes)
+			if err != nil {
+				return fmt.Errorf("samples: %w", err)
+			}
+			batch.Samples = append(batch.Samples, sample)
+		case 4:
+			request, err := unmarshalRequestSample(field.bytes)
+			if err != nil {
+				return fmt.Errorf("requests: %w", err)
+			}
+			batch.Requests = append(batch.Requests, request)
+		case 5:
+			batch.Endpoint = string(field.bytes)
+		}
+		return nil
+	})
+}
+
+func unmarshalSample(data []byte) (familySample, error) {
+	var sample familySample
+	err := protoFields(data, func(field protoField) error {
+		switch field.num {
+		case 1:
+			sample.familyID = string(field.bytes)
+		case 2:
+			sample.Value = math.Float64frombits(field.fixed)
+		case 3:
+			sample.Source = string(field.bytes)
+		case 4:
+			var key, value string
+			err := protoFields(field.bytes, func(entry protoField) error {
+				switch entry.num {
+				case 1:
+					key = string(entry.bytes)
+				case 2:
+					value = string(entry.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if sample.Tags == nil {
+				sample.Tags = make(map[string]string)
+			}
+			sample.Tags[key] = value
+		case 5:
+			sample.LineSize = int(field.varint)
+		case 6:
+			var c centroid
+			err := protoFields(field.bytes, func(part protoField) error {
+				switch part.num {
+				case 1:
+					c.mean = math.Float64frombits(part.fixed)
+				case 2:
+					c.weight = math.Float64frombits(part.fixed)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			sample.Centroids = append(sample.Centroids, c)
+		case 7:
+			sample.Granularity = string(field.bytes)
+		case 8:
+			sample.Metric = string(field.bytes)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+func unmarshalRequestSample(data []byte) (RequestSample, error) {
+	var request RequestSample
+	err := protoFields(data, func(field protoField) error {
+		switch field.num {
+		case 1:
+			request.Timestamp = time.Unix(0, int64(field.varint))
+		case 2:
+			request.Worker = string(field.bytes)
+		case 3:
+			request.Cluster = string(field.bytes)
+		case 4:
+			request.Upstream = string(field.bytes)
+		case 5:
+			request.Envoy = string(field.bytes)
+		case 6:
+			request.Path = string(field.bytes)
+		case 7:
+			request.Status = uint32(field.varint)
+		case 8:
+			request.BytesReceived = field.varint
+		case 9:
+			request.BytesSent = field.varint
+		case 10:
+			request.LatencyMs = math.Float64frombits(field.fixed)
+		}
+		return nil
+	})
+	return request, err
+}
+
+// protoField is one field of a protobuf message; which value is set
+// depends on its wire type.
+type protoField struct {
+	num    protowire.Number
+	varint uint64
+	fixed  uint64 // fixed64, or fixed32 widened
+	bytes  []byte
+}
+
+// protoFields calls fn for each field of a message in wire order. Groups
+// are skipped.
+func protoFields(data []byte, fn func(protoField) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		field := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			field.fixed, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var value uint32
+			value, n = protowire.ConsumeFixed32(data)
+			field.fixed = uint64(value)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n >= 0 {
+				data = data[n:]
+				continue
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
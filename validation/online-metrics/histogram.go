@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	divergenceHistogramWasserstein = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_histogram_wasserstein",
+			Help: "Wasserstein distance between the merged centroids of histogram lines and the reference",
+		},
+		[]string{"family_id"},
+	)
+
+	divergenceHistogramCounts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_histogram_count_ratio",
+			Help: "Mean observations per histogram line in the current window over the reference, by granularity",
+		},
+		[]string{"family_id", "granularity"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceHistogramWasserstein)
+	prometheus.MustRegister(divergenceHistogramCounts)
+}
+
+// histogramCounts tallies the histogram lines of one granularity.
+type histogramCounts struct {
+	Lines        int
+	Observations float64 // Sum of the lines' centroid counts
+}
+
+// computeHistogramDivergence compares the centroids of the window's
+// histogram lines, merged and weighted by their counts, with the
+// reference's centroid distribution, and the observations each histogram
+// summarises with the reference's, per granularity. A count ratio below 1
+// means the generator's histograms summarise too few values, so their
+// rates undershoot even when the line rate matches. It reports false when
+// the reference or the window has no histograms.
+func (dm *DivergenceMonitor) computeHistogramDivergence(ref *ReferenceStatistics, current *windowSummary) (float64, map[string]float64, bool) {
+	if len(ref.HistogramQuantiles) == 0 || current.HistogramValues.Count() == 0 {
+		return 0, nil, false
+	}
+	wasserstein := dm.computeWassersteinDistance(ref.HistogramQuantiles, current.HistogramValues)
+
+	ratios := make(map[string]float64)
+	for granularity, reference := range ref.HistogramCounts {
+		if reference <= 0 {
+			continue
+		}
+		observed := 0.0
+		if counts, ok := current.HistogramCounts[granularity]; ok && counts.Lines > 0 {
+			observed = counts.Observations / float64(counts.Lines)
+		}
+		ratios[granularity] = observed / reference
+	}
+	return wasserstein, ratios, true
+}
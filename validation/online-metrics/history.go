@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iterator"
+)
+
+// History objects are written under <path>/YYYY/MM/DD/, one per flush and
+// replica. The path needs a lifecycle rule (or, locally, a cron job) to
+// delete objects past the retention.
+const (
+	historyDayLayout  = "2006/01/02"
+	historyTimeLayout = "150405"
+	historySuffix     = ".jsonl"
+
+	defaultHistoryWindow = 24 * time.Hour
+)
+
+var historyWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_history_writes_total",
+		Help: "Divergence history objects written, by result (ok, failed)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(historyWrites)
+}
+
+// HistoryPoint is a family's scores at one evaluation.
+type HistoryPoint struct {
+	Timestamp        time.Time `json:"timestamp"`
+	FamilyID         string    `json:"family_id"`
+	Status           string    `json:"status"`
+	Samples          int       `json:"samples"`
+	JSCategorical    float64   `json:"js_categorical"`
+	CooccurrenceJS   float64   `json:"cooccurrence_js"`
+	WassersteinValue float64   `json:"wasserstein"`
+	KSSize           float64   `json:"ks_size"`
+	KSSizePValue     float64   `json:"ks_size_pvalue"`
+	SchemaDivergence float64   `json:"schema_divergence"`
+	TemporalCorr     *float64  `json:"temporal_correlation,omitempty"` // Until enough minutes were seen
+	BurstinessRatio  *float64  `json:"burstiness_ratio,omitempty"`     // Likewise
+	AutocorrGap      *float64  `json:"autocorrelation_gap,omitempty"`  // Likewise
+
+	// Status over each window alone, by window
+	Windows map[string]string `json:"windows,omitempty"`
+
+	// Status of each collector endpoint's samples alone, by endpoint
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+
+	ReferenceVersion    string `json:"reference_version,omitempty"`
+	ReferenceGeneration int64  `json:"reference_generation,omitempty"`
+}
+
+// DivergenceHistory keeps each family's scores over the retention in
+// memory for the history API, and appends them as JSONL objects under a
+// gs://bucket/prefix or local directory so they survive restarts. Without
+// a path the history is kept in memory only.
+type DivergenceHistory struct {
+	Path      string
+	Retention time.Duration
+
+	gcsClient *storage.Client
+	hostname  string
+
+	points  map[string][]HistoryPoint // by family ID, oldest first
+	pending []HistoryPoint            // not yet written
+	mu      sync.Mutex
+}
+
+func NewDivergenceHistory(path string, retention time.Duration) *DivergenceHistory {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "divergence-monitor"
+	}
+	return &DivergenceHistory{
+		Path:      path,
+		Retention: retention,
+		hostname:  hostname,
+		points:    make(map[string][]HistoryPoint),
+	}
+}
+
+// Record adds a point, dropping the family's points past the retention.
+func (h *DivergenceHistory) Record(point HistoryPoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.append(point)
+	if h.Path != "" {
+		h.pending = append(h.pending, point)
+	}
+}
+
+// append keeps points in time order. The caller holds h.mu.
+func (h *DivergenceHistory) append(point HistoryPoint) {
+	points := append(h.points[point.FamilyID], point)
+	for i := len(points) - 1; i > 0 && points[i].Timestamp.Before(points[i-1].Timestamp); i-- {
+		points[i], points[i-1] = points[i-1], points[i]
+	}
+	cutoff := time.Now().Add(-h.Retention)
+	expired := 0
+	for expired < len(points) && points[expired].Timestamp.Before(cutoff) {
+		expired++
+	}
+	h.points[point.FamilyID] = points[expired:]
+}
+
+// Points returns the family's points since since, oldest first.
+func (h *DivergenceHistory) Points(familyID string, since time.Time) []HistoryPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	points := h.points[familyID]
+	start := sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(since) })
+	return append([]HistoryPoint(nil), points[start:]...)
+}
+
+// Run writes the pending points every interval until ctx is cancelled, and
+// once more on the way out.
+func (h *DivergenceHistory) Run(ctx context.Context, interval time.Duration) {
+	if h.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := h.Flush(flushCtx); err != nil {
+				log.Printf("Failed to write divergence history: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := h.Flush(ctx); err != nil {
+				log.Printf("Failed to write divergence history: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes the pending points as one object. Points that fail to be
+// written are kept for the next flush.
+func (h *DivergenceHistory) Flush(ctx context.Context) error {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, point := range pending {
+		if err := encoder.Encode(point); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	name := path.Join(now.Format(historyDayLayout), fmt.Sprintf("%s-%s%s", now.Format(historyTimeLayout), h.hostname, historySuffix))
+	if err := h.write(ctx, name, buf.Bytes()); err != nil {
+		historyWrites.WithLabelValues("failed").Inc()
+		h.mu.Lock()
+		h.pending = append(pending, h.pending...)
+		h.mu.Unlock()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	historyWrites.WithLabelValues("ok").Inc()
+	return nil
+}
+
+func (h *DivergenceHistory) write(ctx context.Context, name string, data []byte) error {
+	bucket, prefix := parseReferencePath(h.Path)
+	if bucket == "" {
+		file := filepath.Join(prefix, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(file, data, 0o644)
+	}
+
+	client, err := h.client(ctx)
+	if err != nil {
+		return err
+	}
+	writer := client.Bucket(bucket).Object(prefix + name).NewWriter(ctx)
+	writer.ContentType = "application/x-ndjson"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Restore loads the points within the retention written by earlier runs,
+// by every replica.
+func (h *DivergenceHistory) Restore(ctx context.Context) error {
+	if h.Path == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	cutoff := now.Add(-h.Retention)
+
+	restored := 0
+	for day := cutoff.Truncate(24 * time.Hour); !day.After(now); day = day.Add(24 * time.Hour) {
+		names, err := h.list(ctx, day.Format(historyDayLayout))
+		if err != nil {
+			return fmt.Errorf("failed to list history for %s: %w", day.Format(time.DateOnly), err)
+		}
+		for _, name := range names {
+			points, err := h.read(ctx, name)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			h.mu.Lock()
+			for _, point := range points {
+				if !point.Timestamp.Before(cutoff) {
+					h.append(point)
+					restored++
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+	log.Printf("Restored %d divergence history points from %s", restored, h.Path)
+	return nil
+}
+
+// list returns the history objects of a day, as names read accepts.
+func (h *DivergenceHistory) list(ctx context.Context, day string) ([]string, error) {
+	bucket, prefix := parseReferencePath(h.Path)
+	var names []string
+	if bucket == "" {
+		dir := filepath.Join(prefix, filepath.FromSlash(day))
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == historySuffix {
+				names = append(names, filepath.Join(dir, entry.Name()))
+			}
+		}
+		return names, nil
+	}
+
+	client, err := h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix + day + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(attrs.Name) == historySuffix {
+			names = append(names, attrs.Name)
+		}
+	}
+	return names, nil
+}
+
+func (h *DivergenceHistory) read(ctx context.Context, name string) ([]HistoryPoint, error) {
+	var reader io.ReadCloser
+	bucket, _ := parseReferencePath(h.Path)
+	if bucket == "" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		reader = file
+	} else {
+		object, err := h.gcsClient.Bucket(bucket).Object(name).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reader = object
+	}
+	defer reader.Close()
+
+	var points []HistoryPoint
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var point HistoryPoint
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, scanner.Err()
+}
+
+func (h *DivergenceHistory) client(ctx context.Context) (*storage.Client, error) {
+	if h.gcsClient == nil {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		h.gcsClient = client
+	}
+	return h.gcsClient, nil
+}
+
+// recordHistory adds the family's latest scores to the history. The caller
+// holds family.mu.
+func (dm *DivergenceMonitor) recordHistory(family *FamilyMonitor, samples int) {
+	scores := family.DivergenceScores
+	point := HistoryPoint{
+		Timestamp:        scores.LastCalculated,
+		FamilyID:         family.FamilyID,
+		Status:           family.Status,
+		Samples:          samples,
+		JSCategorical:    scores.JSCategorical,
+		CooccurrenceJS:   scores.CooccurrenceJS,
+		WassersteinValue: scores.WassersteinValue,
+		KSSize:           scores.KSSize,
+		KSSizePValue:     scores.KSSizePValue,
+		SchemaDivergence: scores.SchemaDivergence,
+
+		ReferenceVersion:    scores.ReferenceVersion,
+		ReferenceGeneration: scores.ReferenceGeneration,
+	}
+	if scores.TemporalMinutes > 0 {
+		corr := scores.TemporalCorr
+		point.TemporalCorr = &corr
+	}
+	if scores.BurstinessMinutes > 0 {
+		ratio := scores.BurstinessRatio
+		point.BurstinessRatio = &ratio
+	}
+	if scores.Autocorrelation != nil {
+		gap := scores.AutocorrelationGap
+		point.AutocorrGap = &gap
+	}
+	for name, window := range scores.Windows {
+		if window == nil {
+			continue
+		}
+		if point.Windows == nil {
+			point.Windows = make(map[string]string, len(scores.Windows))
+		}
+		point.Windows[name] = window.Status
+	}
+	for endpoint, window := range scores.Endpoints {
+		if window == nil {
+			continue
+		}
+		if point.Endpoints == nil {
+			point.Endpoints = make(map[string]string, len(scores.Endpoints))
+		}
+		point.Endpoints[endpoint] = window.Status
+	}
+	dm.history.Record(point)
+}
+
+// handleFamilyHistory serves GET /families/{id}/history?window=24h: the
+// family's scores at each evaluation over the window, oldest first.
+func (dm *DivergenceMonitor) handleFamilyHistory(w http.ResponseWriter, r *http.Request, familyID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window := min(defaultHistoryWindow, dm.history.Retention)
+	if value := r.URL.Query().Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		window = parsed
+	}
+	if window > dm.history.Retention {
+		http.Error(w, fmt.Sprintf("Window exceeds the %s history retention", dm.history.Retention), http.StatusBadRequest)
+		return
+	}
+
+	points := dm.history.Points(familyID, time.Now().Add(-window))
+	dm.mu.RLock()
+	_, exists := dm.families[familyID]
+	dm.mu.RUnlock()
+	if !exists && len(points) == 0 {
+		http.Error(w, "Unknown family", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"family_id": familyID,
+		"window":    window.String(),
+		"points":    points,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision gives 2^11 registers, a standard error of about 2.3%.
+const (
+	hllPrecision = 11
+	hllRegisters = 1 << hllPrecision
+
+	// A sketch keeps its non-zero registers in a map until it would outgrow
+	// the dense form; most tag keys have a handful of values
+	hllSparseLimit = hllRegisters / 16
+)
+
+// hll is a HyperLogLog distinct-count sketch. Sketches over the same
+// values merge by taking the larger register. It is not safe for
+// concurrent use.
+type hll struct {
+	registers []uint8
+	sparse    map[uint16]uint8
+}
+
+func newHLL() *hll {
+	return &hll{sparse: make(map[uint16]uint8)}
+}
+
+// hashValue is 64-bit FNV-1a with the murmur3 finaliser, so the high bits
+// used for the register index are well mixed.
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (s *hll) Add(value string) {
+	x := hashValue(value)
+	index := uint16(x >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	s.set(index, rank)
+}
+
+func (s *hll) set(index uint16, rank uint8) {
+	if s.registers != nil {
+		if rank > s.registers[index] {
+			s.registers[index] = rank
+		}
+		return
+	}
+	if rank > s.sparse[index] {
+		s.sparse[index] = rank
+	}
+	if len(s.sparse) > hllSparseLimit {
+		s.registers = make([]uint8, hllRegisters)
+		for i, r := range s.sparse {
+			s.registers[i] = r
+		}
+		s.sparse = nil
+	}
+}
+
+// Merge adds the values counted by other.
+func (s *hll) Merge(other *hll) {
+	if other.registers == nil {
+		for index, rank := range other.sparse {
+			s.set(index, rank)
+		}
+		return
+	}
+	for index, rank := range other.registers {
+		if rank > 0 {
+			s.set(uint16(index), rank)
+		}
+	}
+}
+
+// Estimate is the estimated number of distinct values, using linear
+// counting while many registers are still empty.
+func (s *hll) Estimate() float64 {
+	sum, zeros := 0.0, 0
+	if s.registers == nil {
+		zeros = hllRegisters - len(s.sparse)
+		sum = float64(zeros)
+		for _, rank := range s.sparse {
+			sum += math.Ldexp(1, -int(rank))
+		}
+	} else {
+		for _, rank := range s.registers {
+			if rank == 0 {
+				zeros++
+			}
+			sum += math.Ldexp(1, -int(rank))
+		}
+	}
+
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// hllTolerance is three standard errors of a sketch with hllRegisters
+// registers
+var hllTolerance = 3 * 1.04 / math.Sqrt(hllRegisters)
+
+func TestHLLEstimate(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 1000, 10000, 100000, 1000000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			s := newHLL()
+			for i := 0; i < n; i++ {
+				s.Add(fmt.Sprintf("value-%d", i))
+				// Repeats never count
+				s.Add(fmt.Sprintf("value-%d", i/2))
+			}
+			if n > hllSparseLimit && s.registers == nil {
+				t.Errorf("%d values still in the sparse form", n)
+			}
+			if got := s.Estimate(); math.Abs(got-float64(n)) > hllTolerance*float64(n)+0.5 {
+				t.Errorf("Estimate() = %.1f, want %d within %.1f%%", got, n, 100*hllTolerance)
+			}
+		})
+	}
+
+	if got := newHLL().Estimate(); got != 0 {
+		t.Errorf("empty Estimate() = %v, want 0", got)
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b, want int // a counts [0, a), b counts [a/2, a/2+b)
+	}{
+		{"sparse into sparse", 40, 40, 60},
+		{"sparse into dense", 20000, 40, 20000},
+		{"dense into sparse", 40, 20000, 20020},
+		{"dense into dense", 20000, 20000, 30000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newHLL(), newHLL()
+			for i := 0; i < tt.a; i++ {
+				a.Add(fmt.Sprintf("value-%d", i))
+			}
+			for i := tt.a / 2; i < tt.a/2+tt.b; i++ {
+				b.Add(fmt.Sprintf("value-%d", i))
+			}
+
+			a.Merge(b)
+			if got := a.Estimate(); math.Abs(got-float64(tt.want)) > hllTolerance*float64(tt.want) {
+				t.Errorf("merged Estimate() = %.1f, want %d within %.1f%%", got, tt.want, 100*hllTolerance)
+			}
+
+			// Merging is idempotent
+			before := a.Estimate()
+			a.Merge(b)
+			if got := a.Estimate(); got != before {
+				t.Errorf("merging again changed the estimate from %v to %v", before, got)
+			}
+		})
+	}
+}
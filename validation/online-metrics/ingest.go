@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/loadgen/wavefront"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Origins of sampled lines: sent by the load generator, or captured from
+// production traffic.
+const (
+	originGenerated = "generated"
+	originCaptured  = "captured"
+)
+
+var (
+	ingestedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_ingest_lines_total",
+			Help: "Sampled lines ingested, by origin and result (accepted, unknown_family, other_shard, unparsed, skipped)",
+		},
+		[]string{"origin", "result"},
+	)
+
+	errSpanLine = errors.New("span lines are not sampled")
+
+	// zstdDecoder decodes compressed message payloads; DecodeAll is safe
+	// for concurrent use
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func init() {
+	prometheus.MustRegister(ingestedLines)
+}
+
+// sampleLine parses a Wavefront line into its family and sample. Metric
+// lines give their value; histograms give the mean of their centroids as
+// the value, and their centroids. Spans are not sampled, since no family
+// reference describes them.
+func sampleLine(line string) (string, Sample, error) {
+	parsed, err := wavefront.Parse(line)
+	if err != nil {
+		return "", Sample{}, err
+	}
+	switch parsed.Type {
+	case wavefront.TypeMetric:
+		metric := parsed.Metric
+		sample := Sample{Value: metric.Value, Source: metric.Source, Tags: metric.Tags, LineSize: parsed.Size, Metric: metric.Name, Emitted: metric.Timestamp}
+		sample.Endpoint = takeEndpoint(sample.Tags)
+		sample.LineSize -= endpointTagSize(line, sample.Endpoint)
+		return wavefront.FamilyID(metric.Name, metric.Tags), sample, nil
+	case wavefront.TypeHistogram:
+		histogram := parsed.Histogram
+		sample := Sample{Value: histogram.Mean(), Source: histogram.Source, Tags: histogram.Tags, LineSize: parsed.Size, Metric: histogram.Name, Granularity: histogram.Granularity}
+		sample.Endpoint = takeEndpoint(sample.Tags)
+		sample.LineSize -= endpointTagSize(line, sample.Endpoint)
+		sample.Centroids = make([]centroid, len(histogram.Centroids))
+		for i, c := range histogram.Centroids {
+			sample.Centroids[i] = centroid{mean: c.Value, weight: float64(c.Count)}
+		}
+		return wavefront.FamilyID(histogram.Name, histogram.Tags), sample, nil
+	default:
+		return "", Sample{}, errSpanLine
+	}
+}
+
+// decodeLines splits a stream message into lines, decompressing it first
+// when its encoding is zstd.
+func decodeLines(data []byte, encoding string) ([]string, error) {
+	switch encoding {
+	case "", "identity":
+	case "zstd":
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %w", err)
+		}
+		data = decoded
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	lines := make([]string, 0, bytes.Count(data, []byte{'\n'})+1)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// ingestCounts tallies what became of ingested lines or samples.
+type ingestCounts struct {
+	Accepted      int
+	UnknownFamily int
+	OtherShard    int // Lines of families another replica scores
+	Unparsed      int
+	Skipped       int
+}
+
+func (c ingestCounts) record(origin string) {
+	ingestedLines.WithLabelValues(origin, "accepted").Add(float64(c.Accepted))
+	ingestedLines.WithLabelValues(origin, "unknown_family").Add(float64(c.UnknownFamily))
+	ingestedLines.WithLabelValues(origin, "other_shard").Add(float64(c.OtherShard))
+	ingestedLines.WithLabelValues(origin, "unparsed").Add(float64(c.Unparsed))
+	ingestedLines.WithLabelValues(origin, "skipped").Add(float64(c.Skipped))
+}
+
+// IngestLines adds sampled lines to the windows of their families:
+// generated lines to the window compared against the reference, captured
+// ones to the captured window. received stamps the samples, so the window
+// covers what arrived recently regardless of the lines' own timestamps.
+// Lines whose tag keys match no family are attributed to the closest
+// family of their metric as schema variants; lines of metrics without
+// reference statistics are dropped. Generated lines are also scored by the
+// collector endpoint they were sent to: their endpoint tag's, or else
+// endpoint, which may be empty.
+func (dm *DivergenceMonitor) IngestLines(origin, endpoint string, received time.Time, lines []string) ingestCounts {
+	var counts ingestCounts
+	byFamily := make(map[string][]Sample)
+	for _, line := range lines {
+		id, sample, err := sampleLine(line)
+		if err == errSpanLine {
+			counts.Skipped++
+			continue
+		}
+		if err != nil {
+			counts.Unparsed++
+			continue
+		}
+		if sample.Endpoint == "" {
+			sample.Endpoint = endpoint
+		}
+		byFamily[id] = append(byFamily[id], sample)
+	}
+
+	sampled := dm.ingestSamples(origin, received, byFamily)
+	counts.Accepted, counts.UnknownFamily, counts.OtherShard = sampled.Accepted, sampled.UnknownFamily, sampled.OtherShard
+	counts.record(origin)
+	return counts
+}
+
+// ingestSamples adds already parsed samples, by family ID, as IngestLines
+// does. Samples of families other replicas own are dropped.
+func (dm *DivergenceMonitor) ingestSamples(origin string, received time.Time, byFamily map[string][]Sample) ingestCounts {
+	var counts ingestCounts
+	for id, samples := range byFamily {
+		if !dm.shard.Owns(id) {
+			counts.OtherShard += len(samples)
+			continue
+		}
+		dm.mu.RLock()
+		family, exists := dm.families[id]
+		dm.mu.RUnlock()
+		if !exists {
+			family = dm.schemaFamily(samples[0].Metric, samples[0].Tags)
+		}
+		if family == nil {
+			counts.UnknownFamily += len(samples)
+			continue
+		}
+
+		family.mu.Lock()
+		windows := []*SlidingWindow{family.CurrentWindow, family.MediumWindow, family.LongWindow}
+		if origin == originCaptured {
+			windows = []*SlidingWindow{family.CapturedWindow}
+		} else {
+			family.Rates.Add(received, len(samples))
+		}
+		for _, sample := range samples {
+			sample.Timestamp = received
+			sample.SchemaVariant = !exists
+			for _, window := range windows {
+				window.AddSample(sample)
+			}
+			if origin == originGenerated {
+				family.addEndpointSample(sample)
+				if family.Sequences == nil {
+					family.Sequences = newSeriesSequences()
+				}
+				family.Sequences.Add(sample, received)
+			}
+		}
+		family.LastUpdate = received
+		family.mu.Unlock()
+		counts.Accepted += len(samples)
+	}
+	return counts
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var divergenceKSPValue = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "loadgen_divergence_kolmogorov_smirnov_pvalue",
+		Help: "P-value of the two-sample Kolmogorov-Smirnov test on size distributions",
+	},
+	[]string{"family_id"},
+)
+
+func init() {
+	prometheus.MustRegister(divergenceKSPValue)
+}
+
+// computeKSTest runs a two-sample Kolmogorov-Smirnov test between the
+// reference distribution, known at its quantiles over refCount samples, and
+// the current window's sketch. The statistic is the largest gap between the
+// two empirical CDFs, evaluated at the reference quantiles and at every
+// percentile of the window; the p-value is the chance of a gap at least that
+// large between samples of these sizes drawn from one distribution. Without
+// a reference sample count the reference is taken as exact, which makes it
+// a one-sample test. A missing side scores as fully divergent.
+func (dm *DivergenceMonitor) computeKSTest(refQuantiles []float64, refCount float64, current *tdigest) (float64, float64) {
+	if len(refQuantiles) != len(referenceLevels) || current.Count() == 0 {
+		return 1.0, 0
+	}
+
+	maxDiff := 0.0
+	gap := func(x float64) {
+		maxDiff = math.Max(maxDiff, math.Abs(referenceCDF(refQuantiles, x)-current.CDF(x)))
+	}
+	for _, x := range refQuantiles {
+		gap(x)
+	}
+	for q := 0.01; q <= 0.99+1e-9; q += 0.01 {
+		gap(current.Quantile(q))
+	}
+
+	samples := current.Count()
+	if refCount > 0 {
+		samples = refCount * samples / (refCount + samples)
+	}
+	return maxDiff, ksPValue(maxDiff, samples)
+}
+
+// referenceCDF evaluates the CDF given by quantiles at referenceLevels,
+// linearly between them; the mass beyond the outer levels is placed just
+// outside the outer quantiles.
+func referenceCDF(quantiles []float64, x float64) float64 {
+	last := len(quantiles) - 1
+	if x < quantiles[0] {
+		return 0
+	}
+	if x > quantiles[last] {
+		return 1
+	}
+	for i := 1; i <= last; i++ {
+		if x < quantiles[i] {
+			frac := (x - quantiles[i-1]) / (quantiles[i] - quantiles[i-1])
+			return referenceLevels[i-1] + frac*(referenceLevels[i]-referenceLevels[i-1])
+		}
+	}
+	return referenceLevels[last]
+}
+
+// ksPValue is the asymptotic significance of KS statistic d over an
+// effective sample size n, from the Kolmogorov distribution with Stephens'
+// small-sample correction.
+func ksPValue(d, n float64) float64 {
+	if d <= 0 || n <= 0 {
+		return 1
+	}
+	sqrtN := math.Sqrt(n)
+	lambda := (sqrtN + 0.12 + 0.11/sqrtN) * d
+	if lambda < 0.3 {
+		return 1 // the series converges too slowly here, and the sum is 1 to 5 places
+	}
+
+	sum, sign := 0.0, 1.0
+	for j := 1.0; j <= 100; j++ {
+		term := sign * 2 * math.Exp(-2*j*j*lambda*lambda)
+		sum += term
+		if math.Abs(term) < 1e-12 {
+			break
+		}
+		sign = -sign
+	}
+	return math.Min(1, math.Max(0, sum))
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	liveBackendWavefront  = "wavefront"
+	liveBackendPrometheus = "prometheus"
+
+	// Largest query response read
+	liveMaxResponse = 64 << 20
+)
+
+var (
+	liveQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_live_baseline_queries_total",
+			Help: "Live baseline queries, by backend and result (ok, empty, failed)",
+		},
+		[]string{"backend", "result"},
+	)
+
+	liveRefreshed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_live_baseline_refreshed_timestamp_seconds",
+			Help: "When a family's reference distributions were last refreshed from the live backend",
+		},
+		[]string{"family_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(liveQueries)
+	prometheus.MustRegister(liveRefreshed)
+}
+
+// LiveBaselineConfig is the file given by -live-baseline-config. The URL
+// and header values may reference environment variables as $VAR or ${VAR},
+// so API tokens need not be written to the file.
+type LiveBaselineConfig struct {
+	Backend string `json:"backend"` // wavefront or prometheus
+	URL     string `json:"url"`     // Wavefront cluster or Prometheus base URL
+
+	// Wavefront API token, sent as a bearer token
+	Token string `json:"token"`
+
+	// Extra request headers, e.g. Authorization for Prometheus
+	Headers map[string]string `json:"headers"`
+
+	// Prometheus label holding the source; defaults to "source"
+	SourceLabel string `json:"source_label"`
+
+	// Prometheus labels that are not tags, e.g. the scrape's job and
+	// instance; defaults to job and instance
+	IgnoreLabels []string `json:"ignore_labels"`
+}
+
+// LoadLiveBaselineConfig reads and validates a live baseline configuration
+// file.
+func LoadLiveBaselineConfig(path string) (*LiveBaselineConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config LiveBaselineConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	config.URL = strings.TrimSuffix(os.ExpandEnv(config.URL), "/")
+	config.Token = os.ExpandEnv(config.Token)
+	for key, value := range config.Headers {
+		config.Headers[key] = os.ExpandEnv(value)
+	}
+	if config.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	switch config.Backend {
+	case liveBackendWavefront:
+		if config.Token == "" {
+			return nil, fmt.Errorf("token is required for wavefront")
+		}
+	case liveBackendPrometheus:
+		if config.SourceLabel == "" {
+			config.SourceLabel = "source"
+		}
+		if config.IgnoreLabels == nil {
+			config.IgnoreLabels = []string{"job", "instance"}
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", config.Backend)
+	}
+	return &config, nil
+}
+
+// LiveBaseline refreshes reference distributions from the production
+// backend, so divergence measures the generated lines against production
+// as it is now rather than as it was when the recipes were captured. Only
+// what a query API can answer is replaced: the source, tag and value
+// distributions and the cardinalities. Line sizes, co-occurrence, the
+// intensity curve and histograms stay as the recipe has them.
+type LiveBaseline struct {
+	Config   LiveBaselineConfig
+	Lookback time.Duration // Span of production data each refresh covers
+	client   *http.Client
+}
+
+func NewLiveBaseline(config *LiveBaselineConfig, lookback time.Duration) *LiveBaseline {
+	return &LiveBaseline{
+		Config:   *config,
+		Lookback: lookback,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// liveStats are the distributions a live query replaced in a family's
+// reference. It is guarded by the family's mu.
+type liveStats struct {
+	At                 time.Time
+	SourceDistribution map[string]float64
+	TagDistributions   map[string]map[string]float64
+	ValueQuantiles     []float64
+	SourceCardinality  float64
+	SeriesCardinality  float64
+	SampleCount        float64
+}
+
+// apply returns recipe with the live distributions in place; a nil
+// liveStats returns recipe itself.
+func (live *liveStats) apply(recipe *ReferenceStatistics) *ReferenceStatistics {
+	if live == nil {
+		return recipe
+	}
+	stats := *recipe
+	stats.SourceDistribution = live.SourceDistribution
+	stats.TagDistributions = live.TagDistributions
+	if len(recipe.ValueQuantiles) > 0 {
+		stats.ValueQuantiles = live.ValueQuantiles
+		stats.ValueHistogram = nil
+	}
+	stats.SourceCardinality = live.SourceCardinality
+	stats.SeriesCardinality = live.SeriesCardinality
+	stats.SampleCount = live.SampleCount
+	return &stats
+}
+
+// version names the reference a family is scored against: the recipe
+// version, marked with when the live distributions were queried.
+func (live *liveStats) version(recipe string) string {
+	if live == nil {
+		return recipe
+	}
+	return recipe + "+live@" + live.At.UTC().Format(time.RFC3339)
+}
+
+// liveSeries is one series a query returned.
+type liveSeries struct {
+	Source string
+	Tags   map[string]string
+	Values []float64
+}
+
+// RunLiveBaseline refreshes the live distributions now and every interval
+// until ctx is cancelled.
+func (dm *DivergenceMonitor) RunLiveBaseline(ctx context.Context, interval time.Duration) {
+	dm.refreshLiveBaseline(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dm.refreshLiveBaseline(ctx)
+		}
+	}
+}
+
+// refreshLiveBaseline queries each monitored metric once and refreshes
+// its families from the series whose tag keys are the family's. A family
+// with no matching series, or whose metric failed to query, keeps what it
+// had.
+func (dm *DivergenceMonitor) refreshLiveBaseline(ctx context.Context) {
+	dm.mu.RLock()
+	byMetric := make(map[string][]*FamilyMonitor, len(dm.byMetric))
+	for metric, families := range dm.byMetric {
+		byMetric[metric] = append([]*FamilyMonitor(nil), families...)
+	}
+	dm.mu.RUnlock()
+
+	lb := dm.live
+	end := time.Now()
+	start := end.Add(-lb.Lookback)
+	for metric, families := range byMetric {
+		if ctx.Err() != nil {
+			return
+		}
+		series, err := lb.query(ctx, metric, start, end)
+		if err != nil {
+			liveQueries.WithLabelValues(lb.Config.Backend, "failed").Inc()
+			log.Printf("Failed to query live baseline for %s: %v", metric, err)
+			continue
+		}
+		if len(series) == 0 {
+			liveQueries.WithLabelValues(lb.Config.Backend, "empty").Inc()
+			continue
+		}
+		liveQueries.WithLabelValues(lb.Config.Backend, "ok").Inc()
+
+		for _, family := range families {
+			family.mu.Lock()
+			if family.RecipeStats != nil {
+				if live := liveStatistics(familyTagKeys(family.RecipeStats), series, end); live != nil {
+					family.Live = live
+					family.ReferenceStats = live.apply(family.RecipeStats)
+					family.ReferenceVersion = live.version(family.RecipeVersion)
+					liveRefreshed.WithLabelValues(family.FamilyID).Set(float64(end.Unix()))
+				}
+			}
+			family.mu.Unlock()
+		}
+	}
+}
+
+// familyTagKeys returns the tag keys of a family's recipe schema.
+func familyTagKeys(stats *ReferenceStatistics) map[string]bool {
+	keys := make(map[string]bool, len(stats.TagPresence))
+	for key := range stats.TagPresence {
+		keys[key] = true
+	}
+	return keys
+}
+
+// liveStatistics computes a family's distributions from the points of the
+// series whose tag keys are exactly keys, or returns nil if there are none.
+func liveStatistics(keys map[string]bool, series []liveSeries, at time.Time) *liveStats {
+	live := &liveStats{
+		At:                 at,
+		SourceDistribution: make(map[string]float64),
+		TagDistributions:   make(map[string]map[string]float64, len(keys)),
+	}
+	for key := range keys {
+		live.TagDistributions[key] = make(map[string]float64)
+	}
+
+	var values []float64
+	for _, s := range series {
+		if len(s.Tags) != len(keys) || len(s.Values) == 0 {
+			continue
+		}
+		matches := true
+		for key := range s.Tags {
+			if !keys[key] {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		points := float64(len(s.Values))
+		live.SourceDistribution[s.Source] += points
+		for key, value := range s.Tags {
+			live.TagDistributions[key][value] += points
+		}
+		live.SeriesCardinality++
+		values = append(values, s.Values...)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	total := float64(len(values))
+	for source := range live.SourceDistribution {
+		live.SourceDistribution[source] /= total
+	}
+	for _, dist := range live.TagDistributions {
+		for value := range dist {
+			dist[value] /= total
+		}
+	}
+	live.SourceCardinality = float64(len(live.SourceDistribution))
+	live.SampleCount = total
+
+	sort.Float64s(values)
+	live.ValueQuantiles = make([]float64, len(referenceLevels))
+	for i, level := range referenceLevels {
+		live.ValueQuantiles[i] = sortedQuantile(values, level)
+	}
+	return live
+}
+
+// sortedQuantile interpolates the q quantile of sorted values.
+func sortedQuantile(values []float64, q float64) float64 {
+	pos := q * float64(len(values)-1)
+	lower := int(pos)
+	if lower >= len(values)-1 {
+		return values[len(values)-1]
+	}
+	frac := pos - float64(lower)
+	return values[lower] + frac*(values[lower+1]-values[lower])
+}
+
+// query returns the series of metric between start and end.
+func (lb *LiveBaseline) query(ctx context.Context, metric string, start, end time.Time) ([]liveSeries, error) {
+	switch lb.Config.Backend {
+	case liveBackendWavefront:
+		return lb.queryWavefront(ctx, metric, start, end)
+	default:
+		return lb.queryPrometheus(ctx, metric, start, end)
+	}
+}
+
+// queryWavefront runs ts() over the chart API at minute granularity.
+func (lb *LiveBaseline) queryWavefront(ctx context.Context, metric string, start, end time.Time) ([]liveSeries, error) {
+	params := url.Values{
+		"q":      {fmt.Sprintf("ts(%q)", metric)},
+		"s":      {strconv.FormatInt(start.UnixMilli(), 10)},
+		"e":      {strconv.FormatInt(end.UnixMilli(), 10)},
+		"g":      {"m"},
+		"strict": {"true"},
+	}
+	var response struct {
+		TimeSeries []struct {
+			Host string            `json:"host"`
+			Tags map[string]string `json:"tags"`
+			Data [][2]float64      `json:"data"` // [epoch seconds, value]
+		} `json:"timeseries"`
+	}
+	if err := lb.get(ctx, lb.Config.URL+"/api/v2/chart/api?"+params.Encode(), &response); err != nil {
+		return nil, err
+	}
+
+	series := make([]liveSeries, 0, len(response.TimeSeries))
+	for _, ts := range response.TimeSeries {
+		s := liveSeries{Source: ts.Host, Tags: ts.Tags, Values: make([]float64, len(ts.Data))}
+		for i, point := range ts.Data {
+			s.Values[i] = point[1]
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// queryPrometheus runs a range query over the metric's Prometheus name at
+// a one minute step.
+func (lb *LiveBaseline) queryPrometheus(ctx context.Context, metric string, start, end time.Time) ([]liveSeries, error) {
+	params := url.Values{
+		"query": {fmt.Sprintf("{__name__=%q}", prometheusName(metric))},
+		"start": {strconv.FormatInt(start.Unix(), 10)},
+		"end":   {strconv.FormatInt(end.Unix(), 10)},
+		"step":  {"60"},
+	}
+	var response struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string    `json:"metric"`
+				Values [][2]json.RawMessage `json:"values"` // [epoch seconds, "value"]
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := lb.get(ctx, lb.Config.URL+"/api/v1/query_range?"+params.Encode(), &response); err != nil {
+		return nil, err
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s", response.Error)
+	}
+
+	ignored := make(map[string]bool, len(lb.Config.IgnoreLabels)+1)
+	ignored["__name__"] = true
+	for _, label := range lb.Config.IgnoreLabels {
+		ignored[label] = true
+	}
+	series := make([]liveSeries, 0, len(response.Data.Result))
+	for _, result := range response.Data.Result {
+		s := liveSeries{Tags: make(map[string]string, len(result.Metric))}
+		for label, value := range result.Metric {
+			switch {
+			case label == lb.Config.SourceLabel:
+				s.Source = value
+			case !ignored[label]:
+				s.Tags[label] = value
+			}
+		}
+		for _, point := range result.Values {
+			var text string
+			if err := json.Unmarshal(point[1], &text); err != nil {
+				return nil, fmt.Errorf("invalid sample value: %w", err)
+			}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sample value: %w", err)
+			}
+			s.Values = append(s.Values, value)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// prometheusName maps a Wavefront metric name to the name Prometheus
+// stores it under, with characters Prometheus does not allow as _.
+func prometheusName(metric string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, metric)
+}
+
+func (lb *LiveBaseline) get(ctx context.Context, target string, response interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	if lb.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+lb.Config.Token)
+	}
+	for key, value := range lb.Config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := lb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, liveMaxResponse)).Decode(response)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Windows each family is scored over, by name. The short window reacts to
+// spikes within minutes but flaps on noisy families; the medium one
+// averages the noise out, and the long one shows drift too slow for
+// either.
+const (
+	windowShort  = "5m"
+	windowMedium = "1h"
+	windowLong   = "24h"
+)
+
+var (
+	divergenceWindowScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_window_score",
+			Help: "Divergence scores over each window, by window (5m, 1h, 24h) and score",
+		},
+		[]string{"family_id", "window", "score"},
+	)
+
+	divergenceWindowStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_window_status",
+			Help: "Status over each window alone (0=green, 1=amber, 2=red)",
+		},
+		[]string{"family_id", "window"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceWindowScore)
+	prometheus.MustRegister(divergenceWindowStatus)
+}
+
+// WindowScores are the distribution scores over one window. The temporal
+// scores are computed over the per-minute rates instead, and schema and
+// cardinality over the short window only.
+type WindowScores struct {
+	Samples              int
+	JSCategorical        float64
+	CooccurrenceJS       float64
+	WassersteinValue     float64
+	HistogramWasserstein float64
+	KSSize               float64
+	KSSizePValue         float64
+	Extra                map[string]float64 // Scores of the scorers in -scorer-config, by name
+	Status               string             // This window alone: green, amber, red
+}
+
+// windowScores scores a medium or long window, as computeFamilyDivergence
+// does the short one. It returns nil when the window has too few samples.
+func (dm *DivergenceMonitor) windowScores(ref *ReferenceStatistics, current *windowSummary, thresholds AlertThresholds) *WindowScores {
+	if current.Count < 10 {
+		return nil
+	}
+	scores := &WindowScores{Samples: current.Count}
+	dm.scoreWindow(scores, ref, current, true)
+	_, scores.KSSizePValue = dm.computeKSTest(ref.SizeQuantiles, ref.SampleCount, current.Sizes)
+	scores.Status = dm.windowStatus(scores, thresholds)
+	return scores
+}
+
+// combineWindowStatus weighs the windows against each other. A red hour
+// is sustained divergence. A red short window alone is a spike, which
+// turns the family red once the hour corroborates it and amber until
+// then; likewise the day's drift turns it red once the hour shows some of
+// it, so a family that recovered does not stay red for a day. A window
+// without enough samples has no say.
+func combineWindowStatus(windows map[string]*WindowScores) string {
+	status := func(name string) string {
+		if scores := windows[name]; scores != nil {
+			return scores.Status
+		}
+		return ""
+	}
+	short, medium, long := status(windowShort), status(windowMedium), status(windowLong)
+	switch {
+	case medium == "red":
+		return "red"
+	case (short == "red" || long == "red") && medium != "green":
+		return "red"
+	case short == "red" || short == "amber" || medium == "amber" || long == "red" || long == "amber":
+		return "amber"
+	}
+	return "green"
+}
+
+// recordWindowScores exports each window's scores and status.
+func recordWindowScores(familyID string, windows map[string]*WindowScores) {
+	for name, scores := range windows {
+		if scores == nil {
+			continue
+		}
+		for score, value := range scores.values() {
+			divergenceWindowScore.WithLabelValues(familyID, name, score).Set(value)
+		}
+		statusValue := 0.0
+		switch scores.Status {
+		case "amber":
+			statusValue = 1
+		case "red":
+			statusValue = 2
+		}
+		divergenceWindowStatus.WithLabelValues(familyID, name).Set(statusValue)
+	}
+}
+
+// values returns every score of the window, by name.
+func (scores *WindowScores) values() map[string]float64 {
+	values := map[string]float64{
+		scoreJSCategorical:        scores.JSCategorical,
+		scoreCooccurrenceJS:       scores.CooccurrenceJS,
+		scoreWasserstein:          scores.WassersteinValue,
+		scoreHistogramWasserstein: scores.HistogramWasserstein,
+		scoreKSSize:               scores.KSSize,
+	}
+	for name, value := range scores.Extra {
+		values[name] = value
+	}
+	return values
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iterator"
+)
+
+// recipeSuffix marks the per-family recipe objects the profiler writes.
+const recipeSuffix = ".json.zst"
+
+// referenceQuantiles are the recipe quantiles, at referenceLevels.
+var (
+	referenceQuantiles = []string{"p01", "p05", "p50", "p95", "p99"}
+	referenceLevels    = []float64{0.01, 0.05, 0.5, 0.95, 0.99}
+)
+
+// ReferenceLoad is the outcome of loading one family's reference statistics.
+// A family whose reload fails keeps the statistics it last loaded.
+type ReferenceLoad struct {
+	FamilyID    string    `json:"family_id"`
+	Object      string    `json:"object"`
+	Generation  int64     `json:"generation"`
+	Version     string    `json:"version,omitempty"`
+	LoadedAt    time.Time `json:"loaded_at"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// referenceObject is a recipe found under the reference path. Generation
+// changes whenever the object is rewritten.
+type referenceObject struct {
+	Name       string
+	FamilyID   string
+	Generation int64
+}
+
+// recipeFile is the part of a profiler recipe the monitor compares against.
+type recipeFile struct {
+	FamilyID   string `json:"family_id"`
+	MetricName string `json:"metric_name"`
+	Version    string `json:"version"`
+	Schema     struct {
+		IsDelta   bool `json:"is_delta"`
+		TagSchema map[string]struct {
+			Cardinality float64 `json:"cardinality"`
+			Presence    float64 `json:"presence"`
+		} `json:"tag_schema"`
+	} `json:"schema"`
+	Statistics struct {
+		SampleCount           float64                     `json:"sample_count"`
+		SeriesCount           float64                     `json:"series_count"`
+		SourceDistribution    categoricalStats            `json:"source_distribution"`
+		TagDistributions      map[string]categoricalStats `json:"tag_distributions"`
+		TagCooccurrence       []cooccurrenceStats         `json:"tag_cooccurrence"`
+		ValueDistribution     numericStats                `json:"value_distribution"`
+		HistogramDistribution struct {
+			CentroidValueDistribution numericStats       `json:"centroid_value_distribution"`
+			CountPerHistogram         map[string]float64 `json:"count_per_histogram"`
+		} `json:"histogram_distribution"`
+	} `json:"statistics"`
+	Temporal struct {
+		IntensityCurve []float64 `json:"intensity_curve"`
+		Burstiness     struct {
+			CoefficientOfVariation float64 `json:"coefficient_of_variation"`
+			FanoFactor             float64 `json:"fano_factor"`
+		} `json:"burstiness"`
+		ValueAutocorrelation struct {
+			Lags   []int     `json:"lags"`
+			Values []float64 `json:"values"`
+		} `json:"value_autocorrelation"`
+		Seasonality []struct {
+			Hour               int                         `json:"hour"`
+			SampleCount        float64                     `json:"sample_count"`
+			SourceDistribution categoricalStats            `json:"source_distribution"`
+			TagDistributions   map[string]categoricalStats `json:"tag_distributions"`
+			ValueDistribution  numericStats                `json:"value_distribution"`
+		} `json:"seasonality"`
+	} `json:"temporal"`
+	Payload struct {
+		SizeDistribution numericStats `json:"size_distribution"`
+	} `json:"payload"`
+	Generation struct {
+		EntityHints struct {
+			SourceCountEstimate float64 `json:"source_count_estimate"`
+		} `json:"entity_hints"`
+	} `json:"generation"`
+}
+
+type categoricalStats struct {
+	TopValues []struct {
+		Value     interface{} `json:"value"`
+		Frequency float64     `json:"frequency"`
+	} `json:"top_values"`
+}
+
+type cooccurrenceStats struct {
+	Tags      map[string]string `json:"tags"`
+	Frequency float64           `json:"frequency"`
+}
+
+type numericStats struct {
+	Quantiles map[string]*float64 `json:"quantiles"`
+	Bins      []float64           `json:"bins"`
+	Counts    []float64           `json:"counts"`
+}
+
+var (
+	referenceFamilies = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "loadgen_reference_families",
+			Help: "Families with reference statistics loaded",
+		},
+	)
+
+	referenceLoadErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_reference_load_errors_total",
+			Help: "Failed attempts to load a family's reference statistics",
+		},
+		[]string{"family_id"},
+	)
+
+	referenceLastRefresh = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "loadgen_reference_last_refresh_timestamp_seconds",
+			Help: "Time of the last successful listing of the reference path",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(referenceFamilies)
+	prometheus.MustRegister(referenceLoadErrors)
+	prometheus.MustRegister(referenceLastRefresh)
+}
+
+// LoadReferences loads the reference statistics of every family from the
+// recipes under the reference path, either gs://bucket/prefix or a local
+// directory. Recipes whose object did not change since the last successful
+// load are skipped, and families whose recipe disappeared are dropped. A
+// recipe that fails to load is reported for its family without failing the
+// others; only an unreadable path or no family loaded at all is an error.
+func (dm *DivergenceMonitor) LoadReferences(ctx context.Context) error {
+	dm.loadMu.Lock()
+	defer dm.loadMu.Unlock()
+	log.Printf("Loading reference statistics from %s...", dm.referencePath)
+
+	objects, err := dm.listReferenceObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list recipes under %s: %w", dm.referencePath, err)
+	}
+	referenceLastRefresh.SetToCurrentTime()
+
+	loaded, unchanged, failed := 0, 0, 0
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		if !dm.shard.Owns(obj.FamilyID) {
+			continue
+		}
+		seen[obj.FamilyID] = true
+
+		dm.mu.RLock()
+		previous := dm.references[obj.FamilyID]
+		dm.mu.RUnlock()
+		if previous != nil && previous.Error == "" && previous.Generation == obj.Generation {
+			unchanged++
+			continue
+		}
+
+		if err := dm.loadReference(ctx, obj); err != nil {
+			log.Printf("Failed to load reference statistics for family %s from %s: %v", obj.FamilyID, obj.Name, err)
+			referenceLoadErrors.WithLabelValues(obj.FamilyID).Inc()
+			dm.recordReferenceError(obj, err)
+			failed++
+			continue
+		}
+		loaded++
+	}
+	dm.pruneReferences(seen)
+
+	dm.mu.RLock()
+	families := len(dm.families)
+	dm.mu.RUnlock()
+	referenceFamilies.Set(float64(families))
+
+	log.Printf("Loaded references for %d families (%d updated, %d unchanged, %d failed)", families, loaded, unchanged, failed)
+	if families == 0 && failed > 0 {
+		return fmt.Errorf("failed to load any of %d recipes", failed)
+	}
+	return nil
+}
+
+// RefreshReferences reloads the reference statistics every interval, so
+// new profiler runs are picked up without a restart.
+func (dm *DivergenceMonitor) RefreshReferences(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := dm.LoadReferences(ctx); err != nil {
+				log.Printf("Failed to refresh references: %v", err)
+			}
+		}
+	}
+}
+
+// loadReference reads one recipe and installs its statistics, keeping the
+// sliding window of a family that is already monitored. The statistics are
+// swapped under the family lock, so each evaluation scores against one
+// reference, which it records.
+func (dm *DivergenceMonitor) loadReference(ctx context.Context, obj referenceObject) error {
+	reader, err := dm.openReferenceObject(ctx, obj.Name)
+	if err != nil {
+		return fmt.Errorf("failed to open recipe: %w", err)
+	}
+	defer reader.Close()
+
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer decoder.Close()
+
+	var recipe recipeFile
+	if err := json.NewDecoder(decoder).Decode(&recipe); err != nil {
+		return fmt.Errorf("failed to decode recipe: %w", err)
+	}
+	if recipe.FamilyID != "" && recipe.FamilyID != obj.FamilyID {
+		return fmt.Errorf("recipe is for family %s", recipe.FamilyID)
+	}
+	stats, err := recipe.referenceStatistics()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	family, exists := dm.families[obj.FamilyID]
+	if !exists {
+		family = &FamilyMonitor{
+			FamilyID:         obj.FamilyID,
+			CurrentWindow:    NewSlidingWindow(shortWindowSize),
+			MediumWindow:     NewSlidingWindowBuckets(mediumWindowSize, mediumWindowBuckets),
+			LongWindow:       NewSlidingWindowBuckets(longWindowSize, longWindowBuckets),
+			CapturedWindow:   NewSlidingWindow(shortWindowSize),
+			Rates:            newMinuteRates(),
+			DivergenceScores: &DivergenceScores{},
+			Status:           "green",
+		}
+		dm.families[obj.FamilyID] = family
+	}
+	family.mu.Lock()
+	if exists && family.ReferenceGeneration != obj.Generation {
+		log.Printf("Family %s: reference updated to %s (generation %d, was %d)", obj.FamilyID, recipe.Version, obj.Generation, family.ReferenceGeneration)
+	}
+	if !exists {
+		dm.indexFamily(family, recipe.MetricName)
+	} else if family.MetricName != recipe.MetricName {
+		dm.unindexFamily(family, family.MetricName)
+		dm.indexFamily(family, recipe.MetricName)
+	}
+	family.MetricName = recipe.MetricName
+	family.RecipeStats = stats
+	family.RecipeVersion = recipe.Version
+	family.ReferenceStats = family.Live.apply(stats)
+	family.ReferenceVersion = family.Live.version(recipe.Version)
+	family.ReferenceGeneration = obj.Generation
+	pairs := trackedPairs(stats.TagCooccurrence)
+	family.CurrentWindow.TrackPairs(pairs)
+	family.MediumWindow.TrackPairs(pairs)
+	family.LongWindow.TrackPairs(pairs)
+	for _, window := range family.Endpoints {
+		window.TrackPairs(pairs)
+	}
+	family.mu.Unlock()
+
+	dm.references[obj.FamilyID] = &ReferenceLoad{
+		FamilyID:    obj.FamilyID,
+		Object:      obj.Name,
+		Generation:  obj.Generation,
+		Version:     recipe.Version,
+		LoadedAt:    now,
+		LastAttempt: now,
+	}
+	return nil
+}
+
+func (dm *DivergenceMonitor) recordReferenceError(obj referenceObject, err error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	status, exists := dm.references[obj.FamilyID]
+	if !exists {
+		status = &ReferenceLoad{FamilyID: obj.FamilyID}
+		dm.references[obj.FamilyID] = status
+	}
+	status.Object = obj.Name
+	status.LastAttempt = time.Now()
+	status.Error = err.Error()
+}
+
+// pruneReferences drops the families whose recipe is no longer listed.
+func (dm *DivergenceMonitor) pruneReferences(seen map[string]bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	for familyID := range dm.references {
+		if seen[familyID] {
+			continue
+		}
+		if family, exists := dm.families[familyID]; exists {
+			familyStatus.DeleteLabelValues(familyID, family.MetricName)
+			dm.unindexFamily(family, family.MetricName)
+			delete(dm.families, familyID)
+		}
+		delete(dm.references, familyID)
+		log.Printf("Dropped family %s: its recipe was removed", familyID)
+	}
+}
+
+// referenceStatistics maps the recipe's statistics, temporal, payload and
+// cardinality hints to the distributions the divergence scores compare against.
+func (recipe *recipeFile) referenceStatistics() (*ReferenceStatistics, error) {
+	valueQuantiles, err := recipe.Statistics.ValueDistribution.quantiles()
+	if err != nil {
+		return nil, fmt.Errorf("value_distribution: %w", err)
+	}
+	histogramQuantiles, err := recipe.Statistics.HistogramDistribution.CentroidValueDistribution.quantiles()
+	if err != nil {
+		return nil, fmt.Errorf("histogram_distribution: %w", err)
+	}
+	if len(valueQuantiles) == 0 && len(histogramQuantiles) == 0 {
+		return nil, errors.New("value_distribution has no quantiles")
+	}
+	sizeQuantiles, err := recipe.Payload.SizeDistribution.quantiles()
+	if err != nil {
+		return nil, fmt.Errorf("size_distribution: %w", err)
+	}
+
+	stats := &ReferenceStatistics{
+		SourceDistribution: recipe.Statistics.SourceDistribution.distribution(),
+		TagDistributions:   make(map[string]map[string]float64, len(recipe.Statistics.TagDistributions)),
+		ValueQuantiles:     valueQuantiles,
+		ValueHistogram:     recipe.Statistics.ValueDistribution.histogram(),
+		IntensityCurve:     recipe.Temporal.IntensityCurve,
+		// Recipes carry a single burstiness estimate over the capture
+		// window, not its spread
+		BurstinessMean:  recipe.Temporal.Burstiness.CoefficientOfVariation,
+		TagCooccurrence: make(map[tagPair]map[string]float64),
+		SizeQuantiles:   sizeQuantiles,
+		SampleCount:     recipe.Statistics.SampleCount,
+		MetricClass:     metricClassGauge,
+
+		HistogramQuantiles: histogramQuantiles,
+		HistogramCounts:    recipe.Statistics.HistogramDistribution.CountPerHistogram,
+
+		SourceCardinality: recipe.Generation.EntityHints.SourceCountEstimate,
+		SeriesCardinality: recipe.Statistics.SeriesCount,
+		TagCardinalities:  make(map[string]float64, len(recipe.Schema.TagSchema)),
+		TagPresence:       make(map[string]float64, len(recipe.Schema.TagSchema)),
+	}
+	switch {
+	case len(histogramQuantiles) > 0:
+		stats.MetricClass = metricClassHistogram
+	case recipe.Schema.IsDelta:
+		stats.MetricClass = metricClassCounter
+	}
+	for key, schema := range recipe.Schema.TagSchema {
+		stats.TagCardinalities[key] = schema.Cardinality
+		stats.TagPresence[key] = schema.Presence
+	}
+	for key, dist := range recipe.Statistics.TagDistributions {
+		stats.TagDistributions[key] = dist.distribution()
+	}
+	for _, entry := range recipe.Statistics.TagCooccurrence {
+		if len(entry.Tags) != 2 {
+			continue // only pairwise joint distributions are compared
+		}
+		var keys, values []string
+		for key, value := range entry.Tags {
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		pair := newTagPair(keys[0], keys[1])
+		if pair.First != keys[0] {
+			values[0], values[1] = values[1], values[0]
+		}
+		joint, ok := stats.TagCooccurrence[pair]
+		if !ok {
+			joint = make(map[string]float64)
+			stats.TagCooccurrence[pair] = joint
+		}
+		joint[jointValue(values[0], values[1])] = entry.Frequency
+	}
+	if autocorr := recipe.Temporal.ValueAutocorrelation; len(autocorr.Values) > 0 {
+		if len(autocorr.Values) != len(autocorr.Lags) {
+			return nil, fmt.Errorf("value_autocorrelation: %d values for %d lags", len(autocorr.Values), len(autocorr.Lags))
+		}
+		stats.Autocorrelation = make(map[int]float64, len(autocorr.Lags))
+		for i, lag := range autocorr.Lags {
+			if lag < 1 || lag >= autocorrSeriesValues-2 {
+				return nil, fmt.Errorf("value_autocorrelation: lag %d out of range", lag)
+			}
+			stats.Autocorrelation[lag] = autocorr.Values[i]
+		}
+	}
+	for _, hour := range recipe.Temporal.Seasonality {
+		if hour.Hour < 0 || hour.Hour >= curveMinutes/sliceMinutes {
+			return nil, fmt.Errorf("seasonality: hour %d out of range", hour.Hour)
+		}
+		quantiles, err := hour.ValueDistribution.quantiles()
+		if err != nil {
+			return nil, fmt.Errorf("seasonality: hour %d: %w", hour.Hour, err)
+		}
+		slice := &ReferenceSlice{
+			SourceDistribution: hour.SourceDistribution.distribution(),
+			TagDistributions:   make(map[string]map[string]float64, len(hour.TagDistributions)),
+			ValueQuantiles:     quantiles,
+			SampleCount:        hour.SampleCount,
+		}
+		for key, dist := range hour.TagDistributions {
+			slice.TagDistributions[key] = dist.distribution()
+		}
+		if stats.Slices == nil {
+			stats.Slices = make([]*ReferenceSlice, curveMinutes/sliceMinutes)
+		}
+		stats.Slices[hour.Hour] = slice
+	}
+	return stats, nil
+}
+
+func (c categoricalStats) distribution() map[string]float64 {
+	dist := make(map[string]float64, len(c.TopValues))
+	for _, top := range c.TopValues {
+		switch value := top.Value.(type) {
+		case nil:
+			continue
+		case string:
+			dist[value] = top.Frequency
+		default:
+			dist[fmt.Sprint(value)] = top.Frequency
+		}
+	}
+	return dist
+}
+
+// quantiles returns the referenceQuantiles of the distribution, or none if
+// the profiler saw no values.
+func (n numericStats) quantiles() ([]float64, error) {
+	if len(n.Quantiles) == 0 {
+		return nil, nil
+	}
+	quantiles := make([]float64, len(referenceQuantiles))
+	for i, name := range referenceQuantiles {
+		value := n.Quantiles[name]
+		if value == nil {
+			return nil, fmt.Errorf("missing quantile %s", name)
+		}
+		quantiles[i] = *value
+	}
+	return quantiles, nil
+}
+
+// histogram turns bin edges and per-bin counts into bins; it returns nil
+// when the recipe has no counts for its edges.
+func (n numericStats) histogram() []HistogramBin {
+	if len(n.Counts) == 0 || len(n.Bins) != len(n.Counts)+1 {
+		return nil
+	}
+	total := 0.0
+	for _, count := range n.Counts {
+		total += count
+	}
+	bins := make([]HistogramBin, len(n.Counts))
+	for i, count := range n.Counts {
+		bins[i] = HistogramBin{LowerBound: n.Bins[i], UpperBound: n.Bins[i+1], Count: int(count)}
+		if width := n.Bins[i+1] - n.Bins[i]; total > 0 && width > 0 {
+			bins[i].Density = count / (total * width)
+		}
+	}
+	return bins
+}
+
+// tagsKey is the tags as sorted k=v pairs.
+func tagsKey(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// parseReferencePath splits gs://bucket/prefix; a path without the scheme
+// is a local directory and yields an empty bucket.
+func parseReferencePath(path string) (bucket, prefix string) {
+	rest, ok := strings.CutPrefix(path, "gs://")
+	if !ok {
+		return "", path
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucket, prefix
+}
+
+func (dm *DivergenceMonitor) listReferenceObjects(ctx context.Context) ([]referenceObject, error) {
+	bucket, prefix := parseReferencePath(dm.referencePath)
+	if bucket == "" {
+		return listLocalReferences(prefix)
+	}
+
+	if dm.gcsClient == nil {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		dm.gcsClient = client
+	}
+
+	var objects []referenceObject
+	it := dm.gcsClient.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(attrs.Name, recipeSuffix) {
+			continue
+		}
+		objects = append(objects, referenceObject{
+			Name:       attrs.Name,
+			FamilyID:   strings.TrimSuffix(filepath.Base(attrs.Name), recipeSuffix),
+			Generation: attrs.Generation,
+		})
+	}
+	return objects, nil
+}
+
+// listLocalReferences finds the recipes below dir; the modification time
+// stands in for the object generation.
+func listLocalReferences(dir string) ([]referenceObject, error) {
+	var objects []referenceObject
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, recipeSuffix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, referenceObject{
+			Name:       path,
+			FamilyID:   strings.TrimSuffix(filepath.Base(path), recipeSuffix),
+			Generation: info.ModTime().UnixNano(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (dm *DivergenceMonitor) openReferenceObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	bucket, _ := parseReferencePath(dm.referencePath)
+	if bucket == "" {
+		return os.Open(name)
+	}
+	return dm.gcsClient.Bucket(bucket).Object(name).NewReader(ctx)
+}
+
+// handleReferencesReload serves POST /references/reload: reload the
+// reference statistics now rather than at the next refresh, e.g. right
+// after a profiler run, and return their load status.
+func (dm *DivergenceMonitor) handleReferencesReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := dm.LoadReferences(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dm.referenceStatuses(false))
+}
+
+// handleReferences serves GET /references: the load status of every
+// family's reference statistics, failed ones included (?failed=true keeps
+// only those).
+func (dm *DivergenceMonitor) handleReferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dm.referenceStatuses(r.URL.Query().Get("failed") == "true"))
+}
+
+// referenceStatuses lists the families' reference load statuses by family
+// ID.
+func (dm *DivergenceMonitor) referenceStatuses(failedOnly bool) []ReferenceLoad {
+	dm.mu.RLock()
+	statuses := make([]ReferenceLoad, 0, len(dm.references))
+	for _, status := range dm.references {
+		if !failedOnly || status.Error != "" {
+			statuses = append(statuses, *status)
+		}
+	}
+	dm.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].FamilyID < statuses[j].FamilyID })
+	return statuses
+}
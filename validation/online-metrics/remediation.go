@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Remediation actions, taken through the generator control plane
+const (
+	actionReduceMultiplier = "reduce_multiplier"
+	actionPause            = "pause"
+	actionFlagStale        = "flag_stale"
+)
+
+const (
+	// remediationLogSize is how many remediation records /remediations
+	// serves
+	remediationLogSize = 200
+
+	// Control plane phase of a paused scenario
+	scenarioPaused = "Paused"
+)
+
+var remediationActions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_remediation_actions_total",
+		Help: "Remediation actions by action and result (applied, dry_run, skipped, failed)",
+	},
+	[]string{"action", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(remediationActions)
+}
+
+// RemediationConfig is the file given by -remediation-config.
+type RemediationConfig struct {
+	ControlPlaneURL string              `json:"control_plane_url"`
+	DryRun          bool                `json:"dry_run"` // Log actions without taking them
+	Actions         []RemediationAction `json:"actions"`
+}
+
+type RemediationAction struct {
+	Action string `json:"action"` // reduce_multiplier, pause or flag_stale
+
+	// Minutes a family must have been red; defaults to the red status
+	// alert threshold
+	AfterMinutes int `json:"after_minutes"`
+
+	// reduce_multiplier scales the family's multiplier in every scenario
+	// generating it by Factor, down to MinMultiplier
+	Factor        float64 `json:"factor"`
+	MinMultiplier float64 `json:"min_multiplier"`
+
+	// Overrides the config's dry_run for this action
+	DryRun *bool `json:"dry_run"`
+}
+
+// RemediationRecord is one action taken, or that would have been taken in
+// dry-run mode.
+type RemediationRecord struct {
+	Time       time.Time `json:"time"`
+	FamilyID   string    `json:"family_id"`
+	MetricName string    `json:"metric_name"`
+	Action     string    `json:"action"`
+	RedMinutes int       `json:"red_minutes"`
+	Scenario   string    `json:"scenario,omitempty"`
+	Multiplier float64   `json:"multiplier,omitempty"`
+	DryRun     bool      `json:"dry_run"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Remediator closes the loop on sustained divergence: once a family has
+// been red for an action's AfterMinutes, it asks the control plane to
+// throttle the family, pause the scenarios generating it or flag its
+// recipe as stale. Each action is taken once per red episode; a family
+// that turns green starts a new one. Failed actions are retried on the
+// next evaluation.
+type Remediator struct {
+	Config RemediationConfig
+	client *http.Client
+
+	// Actions taken in each family's current red episode
+	taken map[string]map[string]bool
+	log   []RemediationRecord // newest last
+	mu    sync.Mutex
+}
+
+// controlPlaneScenario is the part of a control plane scenario remediation
+// reads.
+type controlPlaneScenario struct {
+	Name string `json:"name"`
+	Spec struct {
+		Families          []string           `json:"families"`
+		FamilyMultipliers map[string]float64 `json:"familyMultipliers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// LoadRemediationConfig reads and validates a remediation configuration
+// file. The control plane URL may reference environment variables.
+func LoadRemediationConfig(path string) (*RemediationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RemediationConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	config.ControlPlaneURL = strings.TrimSuffix(os.ExpandEnv(config.ControlPlaneURL), "/")
+	if config.ControlPlaneURL == "" {
+		return nil, fmt.Errorf("control_plane_url is required")
+	}
+	seen := make(map[string]bool)
+	for i, action := range config.Actions {
+		switch action.Action {
+		case actionReduceMultiplier:
+			if action.Factor <= 0 || action.Factor >= 1 {
+				return nil, fmt.Errorf("action %d: factor must be between 0 and 1", i)
+			}
+			if action.MinMultiplier < 0 {
+				return nil, fmt.Errorf("action %d: min_multiplier must not be negative", i)
+			}
+		case actionPause, actionFlagStale:
+		default:
+			return nil, fmt.Errorf("action %d: unknown action %q", i, action.Action)
+		}
+		if seen[action.Action] {
+			return nil, fmt.Errorf("action %d: %s is configured twice", i, action.Action)
+		}
+		seen[action.Action] = true
+		if action.AfterMinutes < 0 {
+			return nil, fmt.Errorf("action %d: after_minutes must not be negative", i)
+		}
+	}
+	return &config, nil
+}
+
+func NewRemediator(config *RemediationConfig) *Remediator {
+	return &Remediator{
+		Config: *config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		taken:  make(map[string]map[string]bool),
+	}
+}
+
+// RunRemediation evaluates the families every minute until ctx is
+// cancelled.
+func (dm *DivergenceMonitor) RunRemediation(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dm.remediate(ctx)
+		}
+	}
+}
+
+func (dm *DivergenceMonitor) remediate(ctx context.Context) {
+	rm := dm.remediator
+	type familyState struct {
+		id, metricName, status string
+		consecutiveRed         int
+		redMinutes             int // The family's RedStatusMinutes
+	}
+
+	dm.mu.RLock()
+	families := make([]familyState, 0, len(dm.families))
+	for _, family := range dm.families {
+		family.mu.RLock()
+		families = append(families, familyState{family.FamilyID, family.MetricName, family.Status, family.ConsecutiveRed, family.Thresholds.RedStatusMinutes})
+		family.mu.RUnlock()
+	}
+	dm.mu.RUnlock()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	var scenarios []controlPlaneScenario
+	scenariosFetched := false
+	for _, family := range families {
+		if family.status != "red" {
+			if family.status == "green" {
+				delete(rm.taken, family.id)
+			}
+			continue
+		}
+
+		for _, action := range rm.Config.Actions {
+			after := action.AfterMinutes
+			if after == 0 {
+				after = family.redMinutes
+			}
+			if family.consecutiveRed < after || rm.taken[family.id][action.Action] {
+				continue
+			}
+
+			if action.Action != actionFlagStale && !scenariosFetched {
+				var err error
+				scenarios, err = rm.listScenarios(ctx)
+				if err != nil {
+					log.Printf("Remediation: failed to list scenarios: %v", err)
+					remediationActions.WithLabelValues(action.Action, "failed").Inc()
+					return
+				}
+				scenariosFetched = true
+			}
+
+			record := RemediationRecord{
+				Time:       time.Now(),
+				FamilyID:   family.id,
+				MetricName: family.metricName,
+				Action:     action.Action,
+				RedMinutes: family.consecutiveRed,
+				DryRun:     rm.Config.DryRun,
+			}
+			if action.DryRun != nil {
+				record.DryRun = *action.DryRun
+			}
+			if rm.apply(ctx, action, record, scenarios) {
+				if rm.taken[family.id] == nil {
+					rm.taken[family.id] = make(map[string]bool)
+				}
+				rm.taken[family.id][action.Action] = true
+			}
+		}
+	}
+
+	// Families dropped with their recipes
+	monitored := make(map[string]bool, len(families))
+	for _, family := range families {
+		monitored[family.id] = true
+	}
+	for familyID := range rm.taken {
+		if !monitored[familyID] {
+			delete(rm.taken, familyID)
+		}
+	}
+}
+
+// apply takes one action for a family and reports whether it is done for
+// this red episode. The caller holds rm.mu.
+func (rm *Remediator) apply(ctx context.Context, action RemediationAction, record RemediationRecord, scenarios []controlPlaneScenario) bool {
+	reason := fmt.Sprintf("family %s (%s) diverged from its reference for %d minutes", record.FamilyID, record.MetricName, record.RedMinutes)
+
+	if action.Action == actionFlagStale {
+		err := rm.call(ctx, record, http.MethodPost, "/api/v1/recipes/"+url.PathEscape(record.FamilyID)+"/stale",
+			map[string]string{"reason": reason, "source": "divergence-monitor"})
+		return rm.record(record, err)
+	}
+
+	done := true
+	matched := false
+	for _, scenario := range scenarios {
+		if !scenario.generates(record.FamilyID, record.MetricName) {
+			continue
+		}
+		matched = true
+		record := record
+		record.Scenario = scenario.Name
+		var err error
+
+		switch action.Action {
+		case actionReduceMultiplier:
+			current, ok := scenario.Spec.FamilyMultipliers[record.FamilyID]
+			if !ok {
+				current = 1
+			}
+			record.Multiplier = math.Max(current*action.Factor, action.MinMultiplier)
+			if record.Multiplier >= current {
+				remediationActions.WithLabelValues(action.Action, "skipped").Inc()
+				continue // already at the floor
+			}
+			err = rm.call(ctx, record, http.MethodPut,
+				"/api/v1/scenarios/"+url.PathEscape(scenario.Name)+"/families/"+url.PathEscape(record.FamilyID)+"/multiplier",
+				map[string]float64{"multiplier": record.Multiplier})
+		case actionPause:
+			if scenario.Status.Phase == scenarioPaused {
+				remediationActions.WithLabelValues(action.Action, "skipped").Inc()
+				continue
+			}
+			err = rm.call(ctx, record, http.MethodPost, "/api/v1/scenarios/"+url.PathEscape(scenario.Name)+"/pause",
+				map[string]string{"reason": reason})
+		}
+		if !rm.record(record, err) {
+			done = false
+		}
+	}
+	if !matched {
+		log.Printf("Remediation: no scenario generates family %s, skipping %s", record.FamilyID, action.Action)
+		remediationActions.WithLabelValues(action.Action, "skipped").Inc()
+	}
+	return done
+}
+
+// call sends a control plane request, or only logs it in dry-run mode.
+func (rm *Remediator) call(ctx context.Context, record RemediationRecord, method, path string, body interface{}) error {
+	if record.DryRun {
+		log.Printf("Remediation (dry run): would %s %s for family %s", method, path, record.FamilyID)
+		return nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rm.Config.ControlPlaneURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(message))
+	}
+	log.Printf("Remediation: %s %s for family %s", method, path, record.FamilyID)
+	return nil
+}
+
+// record logs the outcome of an action and reports whether it succeeded.
+// The caller holds rm.mu.
+func (rm *Remediator) record(record RemediationRecord, err error) bool {
+	result := "applied"
+	switch {
+	case err != nil:
+		result = "failed"
+		record.Error = err.Error()
+		log.Printf("Remediation: %s for family %s failed: %v", record.Action, record.FamilyID, err)
+	case record.DryRun:
+		result = "dry_run"
+	}
+	remediationActions.WithLabelValues(record.Action, result).Inc()
+
+	rm.log = append(rm.log, record)
+	if len(rm.log) > remediationLogSize {
+		rm.log = rm.log[len(rm.log)-remediationLogSize:]
+	}
+	return err == nil
+}
+
+func (rm *Remediator) listScenarios(ctx context.Context) ([]controlPlaneScenario, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rm.Config.ControlPlaneURL+"/api/v1/scenarios", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rm.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var scenarios []controlPlaneScenario
+	if err := json.NewDecoder(resp.Body).Decode(&scenarios); err != nil {
+		return nil, err
+	}
+	return scenarios, nil
+}
+
+// generates reports whether one of the scenario's family patterns matches
+// the family ID or metric name.
+func (s controlPlaneScenario) generates(familyID, metricName string) bool {
+	for _, pattern := range s.Spec.Families {
+		for _, name := range []string{familyID, metricName} {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleRemediations serves GET /remediations: the recent remediation
+// actions, newest first.
+func (dm *DivergenceMonitor) handleRemediations(w http.ResponseWriter, r *http.Request) {
+	records := []RemediationRecord{}
+	if dm.remediator != nil {
+		dm.remediator.mu.Lock()
+		for i := len(dm.remediator.log) - 1; i >= 0; i-- {
+			records = append(records, dm.remediator.log[i])
+		}
+		dm.remediator.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
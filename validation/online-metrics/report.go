@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Dimensions listed per family in a report, most divergent first
+	reportTopDimensions = 5
+
+	// Scores summarised per family, in report and CSV column order
+	reportJSCategorical        = "js_categorical"
+	reportCooccurrenceJS       = "cooccurrence_js"
+	reportWasserstein          = "wasserstein"
+	reportHistogramWasserstein = "histogram_wasserstein"
+	reportKSSize               = "ks_size"
+	reportSchemaDivergence     = "schema_divergence"
+	reportTemporalCorrelation  = "temporal_correlation"
+	reportBurstinessRatio      = "burstiness_ratio"
+)
+
+var reportScores = []string{
+	reportJSCategorical, reportCooccurrenceJS, reportWasserstein, reportHistogramWasserstein,
+	reportKSSize, reportSchemaDivergence, reportTemporalCorrelation, reportBurstinessRatio,
+}
+
+var reportWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_report_writes_total",
+		Help: "Daily divergence report objects written, by result (ok, failed)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(reportWrites)
+}
+
+// FamilyReport summarises a family's evaluations over (part of) a UTC day.
+type FamilyReport struct {
+	Day               string                  `json:"day"`
+	FamilyID          string                  `json:"family_id"`
+	MetricName        string                  `json:"metric_name"`
+	From              time.Time               `json:"from"` // First and last evaluation
+	To                time.Time               `json:"to"`
+	Evaluations       int                     `json:"evaluations"`
+	MinutesRed        int                     `json:"minutes_red"`
+	MinutesAmber      int                     `json:"minutes_amber"`
+	Scores            map[string]ScoreSummary `json:"scores"`         // Scores never computed are left out
+	TopDimensions     []DimensionSummary      `json:"top_dimensions"` // By mean JS, worst first
+	ReferenceVersions []string                `json:"reference_versions"`
+}
+
+type ScoreSummary struct {
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+}
+
+// DimensionSummary is a source, tag key (tag_<key>) or tag-key pair
+// (pair_<key>,<key>) and its JS divergence over the day.
+type DimensionSummary struct {
+	Dimension string  `json:"dimension"`
+	Mean      float64 `json:"mean"`
+	Max       float64 `json:"max"`
+}
+
+type scoreStats struct {
+	sum, max float64
+	n        int
+}
+
+func (s *scoreStats) add(value float64) {
+	if s.n == 0 || value > s.max {
+		s.max = value
+	}
+	s.sum += value
+	s.n++
+}
+
+func (s *scoreStats) summary() ScoreSummary {
+	return ScoreSummary{Mean: s.sum / float64(s.n), Max: s.max}
+}
+
+// familyDay accumulates one family's evaluations of the day.
+type familyDay struct {
+	metricName  string
+	from, to    time.Time
+	evaluations int
+	red, amber  int
+	scores      map[string]*scoreStats
+	dimensions  map[string]*scoreStats
+	versions    map[string]bool
+}
+
+// DivergenceReporter accumulates each family's evaluations per UTC day and,
+// given a path, writes a JSONL and a CSV summary of each day under a
+// gs://bucket/prefix or local directory, for comparing fidelity across
+// recipe releases offline. Evaluations run once a minute, so a red
+// evaluation is a red minute. Each replica reports what it evaluated; a
+// restart writes the day so far and starts a new report, and From and To
+// show what a report covers.
+type DivergenceReporter struct {
+	Path string
+
+	gcsClient *storage.Client
+	hostname  string
+
+	day      string
+	families map[string]*familyDay
+	finished [][]FamilyReport // Reports of past days not yet written
+	mu       sync.Mutex
+}
+
+func NewDivergenceReporter(path string) *DivergenceReporter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "divergence-monitor"
+	}
+	return &DivergenceReporter{
+		Path:     path,
+		hostname: hostname,
+		families: make(map[string]*familyDay),
+	}
+}
+
+// observe adds a family's latest evaluation, and the JS divergence of each
+// of its dimensions, to the day's report. The caller holds family.mu.
+func (r *DivergenceReporter) observe(family *FamilyMonitor, dimensions map[string]float64) {
+	scores := family.DivergenceScores
+	now := scores.LastCalculated.UTC()
+	day := now.Format(time.DateOnly)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if day != r.day {
+		if len(r.families) > 0 && r.Path != "" {
+			r.finished = append(r.finished, r.reports())
+		}
+		r.day = day
+		r.families = make(map[string]*familyDay)
+	}
+	fd, ok := r.families[family.FamilyID]
+	if !ok {
+		fd = &familyDay{
+			from:       now,
+			scores:     make(map[string]*scoreStats),
+			dimensions: make(map[string]*scoreStats),
+			versions:   make(map[string]bool),
+		}
+		r.families[family.FamilyID] = fd
+	}
+	fd.metricName = family.MetricName
+	fd.to = now
+	fd.evaluations++
+	switch family.Status {
+	case "red":
+		fd.red++
+	case "amber":
+		fd.amber++
+	}
+	fd.versions[scores.ReferenceVersion] = true
+
+	values := map[string]float64{
+		reportJSCategorical:    scores.JSCategorical,
+		reportCooccurrenceJS:   scores.CooccurrenceJS,
+		reportWasserstein:      scores.WassersteinValue,
+		reportKSSize:           scores.KSSize,
+		reportSchemaDivergence: scores.SchemaDivergence,
+	}
+	if ref := family.ReferenceStats; ref != nil && len(ref.HistogramQuantiles) > 0 {
+		values[reportHistogramWasserstein] = scores.HistogramWasserstein
+	}
+	if scores.TemporalMinutes > 0 {
+		values[reportTemporalCorrelation] = scores.TemporalCorr
+	}
+	if scores.BurstinessMinutes > 0 {
+		values[reportBurstinessRatio] = scores.BurstinessRatio
+	}
+	for name, value := range values {
+		addStats(fd.scores, name, value)
+	}
+	for dimension, js := range dimensions {
+		addStats(fd.dimensions, dimension, js)
+	}
+}
+
+func addStats(stats map[string]*scoreStats, name string, value float64) {
+	s, ok := stats[name]
+	if !ok {
+		s = &scoreStats{}
+		stats[name] = s
+	}
+	s.add(value)
+}
+
+// reports summarises the day so far, by family ID. The caller holds r.mu.
+func (r *DivergenceReporter) reports() []FamilyReport {
+	reports := make([]FamilyReport, 0, len(r.families))
+	for familyID, fd := range r.families {
+		report := FamilyReport{
+			Day:               r.day,
+			FamilyID:          familyID,
+			MetricName:        fd.metricName,
+			From:              fd.from,
+			To:                fd.to,
+			Evaluations:       fd.evaluations,
+			MinutesRed:        fd.red,
+			MinutesAmber:      fd.amber,
+			Scores:            make(map[string]ScoreSummary, len(fd.scores)),
+			TopDimensions:     make([]DimensionSummary, 0, len(fd.dimensions)),
+			ReferenceVersions: make([]string, 0, len(fd.versions)),
+		}
+		for name, stats := range fd.scores {
+			report.Scores[name] = stats.summary()
+		}
+		for dimension, stats := range fd.dimensions {
+			summary := stats.summary()
+			report.TopDimensions = append(report.TopDimensions, DimensionSummary{Dimension: dimension, Mean: summary.Mean, Max: summary.Max})
+		}
+		sort.Slice(report.TopDimensions, func(i, j int) bool {
+			a, b := report.TopDimensions[i], report.TopDimensions[j]
+			if a.Mean != b.Mean {
+				return a.Mean > b.Mean
+			}
+			return a.Dimension < b.Dimension
+		})
+		if len(report.TopDimensions) > reportTopDimensions {
+			report.TopDimensions = report.TopDimensions[:reportTopDimensions]
+		}
+		for version := range fd.versions {
+			report.ReferenceVersions = append(report.ReferenceVersions, version)
+		}
+		sort.Strings(report.ReferenceVersions)
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].FamilyID < reports[j].FamilyID })
+	return reports
+}
+
+// Current summarises the day so far.
+func (r *DivergenceReporter) Current() []FamilyReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reports()
+}
+
+// Run writes the reports of finished days every interval until ctx is
+// cancelled, and on the way out the day so far.
+func (r *DivergenceReporter) Run(ctx context.Context, interval time.Duration) {
+	if r.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			if len(r.families) > 0 {
+				r.finished = append(r.finished, r.reports())
+				r.families = make(map[string]*familyDay)
+			}
+			r.mu.Unlock()
+			flushCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := r.Flush(flushCtx); err != nil {
+				log.Printf("Failed to write divergence report: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil {
+				log.Printf("Failed to write divergence report: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes the finished reports. Reports that fail to be written are
+// kept for the next flush.
+func (r *DivergenceReporter) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	finished := r.finished
+	r.finished = nil
+	r.mu.Unlock()
+
+	for i, reports := range finished {
+		if err := r.write(ctx, reports); err != nil {
+			reportWrites.WithLabelValues("failed").Inc()
+			r.mu.Lock()
+			r.finished = append(finished[i:], r.finished...)
+			r.mu.Unlock()
+			return err
+		}
+		reportWrites.WithLabelValues("ok").Inc()
+	}
+	return nil
+}
+
+// write stores a day's reports as <path>/YYYY/MM/DD/<from>-<hostname>.jsonl
+// and .csv, from being when the report's first evaluation ran.
+func (r *DivergenceReporter) write(ctx context.Context, reports []FamilyReport) error {
+	if len(reports) == 0 {
+		return nil
+	}
+	from := reports[0].From
+	for _, report := range reports {
+		if report.From.Before(from) {
+			from = report.From
+		}
+	}
+	base := path.Join(from.Format(historyDayLayout), fmt.Sprintf("%s-%s", from.Format(historyTimeLayout), r.hostname))
+
+	var jsonl bytes.Buffer
+	encoder := json.NewEncoder(&jsonl)
+	for _, report := range reports {
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	if err := r.writeObject(ctx, base+".jsonl", "application/x-ndjson", jsonl.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s.jsonl: %w", base, err)
+	}
+
+	data, err := reportCSV(reports)
+	if err != nil {
+		return err
+	}
+	if err := r.writeObject(ctx, base+".csv", "text/csv", data); err != nil {
+		return fmt.Errorf("failed to write %s.csv: %w", base, err)
+	}
+	log.Printf("Wrote divergence report for %s (%d families) to %s", reports[0].Day, len(reports), r.Path)
+	return nil
+}
+
+// reportCSV renders reports one family per row, with each score's mean and
+// max; scores never computed are left empty.
+func reportCSV(reports []FamilyReport) ([]byte, error) {
+	header := []string{"day", "family_id", "metric_name", "from", "to", "evaluations", "minutes_red", "minutes_amber"}
+	for _, name := range reportScores {
+		header = append(header, name+"_mean", name+"_max")
+	}
+	header = append(header, "top_dimensions", "reference_versions")
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(header)
+	for _, report := range reports {
+		row := []string{
+			report.Day, report.FamilyID, report.MetricName,
+			report.From.Format(time.RFC3339), report.To.Format(time.RFC3339),
+			strconv.Itoa(report.Evaluations), strconv.Itoa(report.MinutesRed), strconv.Itoa(report.MinutesAmber),
+		}
+		for _, name := range reportScores {
+			if score, ok := report.Scores[name]; ok {
+				row = append(row, formatScore(score.Mean), formatScore(score.Max))
+			} else {
+				row = append(row, "", "")
+			}
+		}
+		dimensions := make([]string, len(report.TopDimensions))
+		for i, dimension := range report.TopDimensions {
+			dimensions[i] = dimension.Dimension + "=" + formatScore(dimension.Mean)
+		}
+		row = append(row, strings.Join(dimensions, ";"), strings.Join(report.ReferenceVersions, ";"))
+		writer.Write(row)
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func (r *DivergenceReporter) writeObject(ctx context.Context, name, contentType string, data []byte) error {
+	bucket, prefix := parseReferencePath(r.Path)
+	if bucket == "" {
+		file := filepath.Join(prefix, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(file, data, 0o644)
+	}
+
+	if r.gcsClient == nil {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		r.gcsClient = client
+	}
+	writer := r.gcsClient.Bucket(bucket).Object(prefix + name).NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// handleReport serves GET /report: the day's report so far.
+func (dm *DivergenceMonitor) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports := []FamilyReport{}
+	if dm.reporter != nil {
+		reports = dm.reporter.Current()
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		data, err := reportCSV(reports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
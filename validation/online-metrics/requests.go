@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RequestSample is one load generator request as an Envoy saw it, forwarded
+// by the xDS controller's access log receiver.
+type RequestSample struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Worker        string    `json:"worker,omitempty"`
+	Cluster       string    `json:"cluster"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Envoy         string    `json:"envoy,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	Status        uint32    `json:"status"`
+	BytesReceived uint64    `json:"bytes_received"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	LatencyMs     float64   `json:"latency_ms"`
+}
+
+// requestReservoirSize bounds the samples kept per minute of a window.
+const requestReservoirSize = 10000
+
+// RequestWindow keeps the request samples of one cluster over a sliding
+// window, for end-to-end validation of what the collectors received. Each
+// minute keeps a uniform sample of its requests, so a burst cannot crowd
+// out the rest of the window; statistics weight each minute's samples by
+// how many requests they stand for.
+type RequestWindow struct {
+	WindowSize time.Duration
+	minutes    []*requestReservoir // oldest first
+	mu         sync.Mutex
+}
+
+// requestReservoir is a uniform sample (Vitter's algorithm R) of the
+// requests of one minute.
+type requestReservoir struct {
+	start   time.Time
+	seen    int
+	samples []RequestSample
+}
+
+func (r *requestReservoir) add(sample RequestSample) {
+	r.seen++
+	if len(r.samples) < requestReservoirSize {
+		r.samples = append(r.samples, sample)
+	} else if i := rand.Intn(r.seen); i < requestReservoirSize {
+		r.samples[i] = sample
+	}
+}
+
+// weight is how many requests each kept sample stands for.
+func (r *requestReservoir) weight() float64 {
+	return float64(r.seen) / float64(len(r.samples))
+}
+
+// RequestStats summarises a request window.
+type RequestStats struct {
+	Cluster       string             `json:"cluster"`
+	Requests      int                `json:"requests"`
+	ErrorRatio    float64            `json:"error_ratio"`
+	StatusClasses map[string]int     `json:"status_classes"`
+	LatencyMs     map[string]float64 `json:"latency_ms"`
+	RequestBytes  map[string]float64 `json:"request_bytes"`
+	Workers       map[string]int     `json:"workers"`
+	Sources       map[string]int     `json:"sources"`
+}
+
+var (
+	e2eRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_e2e_requests_total",
+			Help: "Loadgen request samples received from Envoy access logs",
+		},
+		[]string{"cluster", "status_class"},
+	)
+
+	e2eErrorRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_e2e_error_ratio",
+			Help: "Share of loadgen requests in the window that failed (5xx or no response)",
+		},
+		[]string{"cluster"},
+	)
+
+	e2eLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_e2e_latency_ms",
+			Help: "Loadgen request latency quantiles in the window, as seen by Envoy",
+		},
+		[]string{"cluster", "quantile"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(e2eRequests)
+	prometheus.MustRegister(e2eErrorRatio)
+	prometheus.MustRegister(e2eLatency)
+}
+
+func NewRequestWindow(duration time.Duration) *RequestWindow {
+	return &RequestWindow{WindowSize: duration}
+}
+
+func (rw *RequestWindow) AddSamples(samples []RequestSample) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	cutoff := time.Now().Add(-rw.WindowSize)
+	for _, sample := range samples {
+		if sample.Timestamp.Before(cutoff) {
+			continue
+		}
+		rw.reservoir(sample.Timestamp.Truncate(time.Minute)).add(sample)
+	}
+	rw.prune(time.Now())
+}
+
+// reservoir returns the reservoir of the minute starting at start, adding
+// it in order if needed. Batches arrive roughly in time order, so the
+// search starts from the newest.
+func (rw *RequestWindow) reservoir(start time.Time) *requestReservoir {
+	i := len(rw.minutes)
+	for i > 0 && rw.minutes[i-1].start.After(start) {
+		i--
+	}
+	if i > 0 && rw.minutes[i-1].start.Equal(start) {
+		return rw.minutes[i-1]
+	}
+	reservoir := &requestReservoir{start: start}
+	rw.minutes = append(rw.minutes, nil)
+	copy(rw.minutes[i+1:], rw.minutes[i:])
+	rw.minutes[i] = reservoir
+	return reservoir
+}
+
+// prune drops the minutes that ended before the window.
+func (rw *RequestWindow) prune(now time.Time) {
+	cutoff := now.Add(-rw.WindowSize)
+	expired := 0
+	for expired < len(rw.minutes) && !rw.minutes[expired].start.Add(time.Minute).After(cutoff) {
+		expired++
+	}
+	rw.minutes = rw.minutes[expired:]
+}
+
+// statusClass groups a response code into 2xx..5xx; "none" means Envoy
+// sent no response.
+func statusClass(status uint32) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func (dm *DivergenceMonitor) requestStats(cluster string, rw *RequestWindow) *RequestStats {
+	// Counts are estimated from the weighted samples, then rounded
+	requests := 0
+	failed := 0.0
+	statusClasses := make(map[string]float64)
+	workers := make(map[string]float64)
+	sources := make(map[string]float64)
+	latencies := newTDigest()
+	sizes := newTDigest()
+
+	rw.mu.Lock()
+	rw.prune(time.Now())
+	for _, minute := range rw.minutes {
+		requests += minute.seen
+		weight := minute.weight()
+		for _, sample := range minute.samples {
+			class := statusClass(sample.Status)
+			statusClasses[class] += weight
+			if class == "5xx" || class == "none" {
+				failed += weight
+			}
+			workers[sample.Worker] += weight
+			sources[sample.Envoy] += weight
+			latencies.add(centroid{mean: sample.LatencyMs, weight: weight})
+			sizes.add(centroid{mean: float64(sample.BytesReceived), weight: weight})
+		}
+	}
+	rw.mu.Unlock()
+
+	stats := &RequestStats{
+		Cluster:       cluster,
+		Requests:      requests,
+		StatusClasses: roundCounts(statusClasses),
+		Workers:       roundCounts(workers),
+		Sources:       roundCounts(sources),
+	}
+	if requests > 0 {
+		stats.ErrorRatio = failed / float64(requests)
+	}
+
+	quantiles := []float64{0.5, 0.9, 0.99}
+	names := []string{"p50", "p90", "p99"}
+	stats.LatencyMs = make(map[string]float64, len(names))
+	stats.RequestBytes = make(map[string]float64, len(names))
+	for i, name := range names {
+		stats.LatencyMs[name] = latencies.Quantile(quantiles[i])
+		stats.RequestBytes[name] = sizes.Quantile(quantiles[i])
+	}
+	return stats
+}
+
+func roundCounts(estimates map[string]float64) map[string]int {
+	counts := make(map[string]int, len(estimates))
+	for key, estimate := range estimates {
+		counts[key] = int(math.Round(estimate))
+	}
+	return counts
+}
+
+// updateRequestMetrics refreshes the end-to-end gauges of every cluster.
+func (dm *DivergenceMonitor) updateRequestMetrics() {
+	dm.mu.RLock()
+	windows := make(map[string]*RequestWindow, len(dm.requests))
+	for cluster, rw := range dm.requests {
+		windows[cluster] = rw
+	}
+	dm.mu.RUnlock()
+
+	for cluster, rw := range windows {
+		stats := dm.requestStats(cluster, rw)
+		e2eErrorRatio.WithLabelValues(cluster).Set(stats.ErrorRatio)
+		for quantile, value := range stats.LatencyMs {
+			e2eLatency.WithLabelValues(cluster, quantile).Set(value)
+		}
+	}
+}
+
+// AddRequestSamples adds request samples to the windows of their clusters.
+func (dm *DivergenceMonitor) AddRequestSamples(batch []RequestSample) {
+	byCluster := make(map[string][]RequestSample)
+	for _, sample := range batch {
+		byCluster[sample.Cluster] = append(byCluster[sample.Cluster], sample)
+		e2eRequests.WithLabelValues(sample.Cluster, statusClass(sample.Status)).Inc()
+	}
+	for cluster, samples := range byCluster {
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+
+		dm.mu.Lock()
+		rw, exists := dm.requests[cluster]
+		if !exists {
+			rw = NewRequestWindow(5 * time.Minute)
+			dm.requests[cluster] = rw
+		}
+		dm.mu.Unlock()
+		rw.AddSamples(samples)
+	}
+}
+
+// handleRequests accepts POST batches of request samples from the xDS
+// controller ({"source": ..., "samples": [...]}) and serves GET with the
+// per-cluster statistics of the current window (?cluster= filters).
+func (dm *DivergenceMonitor) handleRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var batch struct {
+			Source  string          `json:"source"`
+			Samples []RequestSample `json:"samples"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		dm.AddRequestSamples(batch.Samples)
+		w.WriteHeader(http.StatusAccepted)
+
+	case "GET":
+		cluster := r.URL.Query().Get("cluster")
+		dm.mu.RLock()
+		windows := make(map[string]*RequestWindow, len(dm.requests))
+		for name, rw := range dm.requests {
+			if cluster == "" || name == cluster {
+				windows[name] = rw
+			}
+		}
+		dm.mu.RUnlock()
+
+		stats := make([]*RequestStats, 0, len(windows))
+		for name, rw := range windows {
+			stats = append(stats, dm.requestStats(name, rw))
+		}
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Cluster < stats[j].Cluster })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
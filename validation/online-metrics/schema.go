@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Keys listed in a family's schema breakdown
+const maxSchemaKeys = 20
+
+var divergenceSchema = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "loadgen_divergence_schema",
+		Help: "Share of a family's lines in the current window whose tag keys differ from its recipe schema",
+	},
+	[]string{"family_id"},
+)
+
+func init() {
+	prometheus.MustRegister(divergenceSchema)
+}
+
+// KeyPresence compares how often lines carry a tag key with the recipe
+// schema. Unexpected keys have a reference presence of 0.
+type KeyPresence struct {
+	Key        string  `json:"key"`
+	Reference  float64 `json:"reference"`
+	Observed   float64 `json:"observed"`
+	Unexpected bool    `json:"unexpected,omitempty"`
+}
+
+// A family is its metric name and tag-key set, so a line with an added or
+// dropped key hashes to a family with no reference. Such lines are
+// attributed to the family of the same metric whose keys differ least, and
+// counted as schema variants; that is what schema drift looks like from
+// here.
+
+// indexFamily adds a family to the by-metric index. The caller holds dm.mu.
+func (dm *DivergenceMonitor) indexFamily(family *FamilyMonitor, metric string) {
+	dm.byMetric[metric] = append(dm.byMetric[metric], family)
+}
+
+// unindexFamily removes a family from the by-metric index. The caller holds
+// dm.mu.
+func (dm *DivergenceMonitor) unindexFamily(family *FamilyMonitor, metric string) {
+	families := dm.byMetric[metric]
+	for i, candidate := range families {
+		if candidate == family {
+			families = append(families[:i], families[i+1:]...)
+			break
+		}
+	}
+	if len(families) == 0 {
+		delete(dm.byMetric, metric)
+	} else {
+		dm.byMetric[metric] = families
+	}
+}
+
+// schemaFamily returns the monitored family of metric whose schema keys
+// differ least from tags, or nil if the metric has none.
+func (dm *DivergenceMonitor) schemaFamily(metric string, tags map[string]string) *FamilyMonitor {
+	dm.mu.RLock()
+	candidates := dm.byMetric[metric]
+	dm.mu.RUnlock()
+
+	var best *FamilyMonitor
+	bestDistance := math.MaxInt
+	for _, family := range candidates {
+		family.mu.RLock()
+		distance := 0
+		if ref := family.ReferenceStats; ref != nil {
+			for key := range tags {
+				if _, ok := ref.TagPresence[key]; !ok {
+					distance++
+				}
+			}
+			for key := range ref.TagPresence {
+				if _, ok := tags[key]; !ok {
+					distance++
+				}
+			}
+		}
+		family.mu.RUnlock()
+		if distance < bestDistance || (distance == bestDistance && family.FamilyID < best.FamilyID) {
+			best, bestDistance = family, distance
+		}
+	}
+	return best
+}
+
+// computeSchemaDivergence returns the share of the window's lines that are
+// schema variants, and the keys whose presence differs from the reference,
+// most different first. A scenario's schemaDrift adds or changes keys on
+// about half the lines it drifts, so the share should sit near half of it.
+func (dm *DivergenceMonitor) computeSchemaDivergence(ref *ReferenceStatistics, current *windowSummary) (float64, []KeyPresence) {
+	if current.Count == 0 {
+		return 0, nil
+	}
+	observed := func(key string) float64 {
+		present := 0
+		for _, count := range current.Tags[key] {
+			present += count
+		}
+		return float64(present) / float64(current.Count)
+	}
+
+	keys := []KeyPresence{}
+	for key, presence := range ref.TagPresence {
+		if p := observed(key); p != presence {
+			keys = append(keys, KeyPresence{Key: key, Reference: presence, Observed: p})
+		}
+	}
+	for key := range current.Tags {
+		if _, ok := ref.TagPresence[key]; !ok {
+			keys = append(keys, KeyPresence{Key: key, Observed: observed(key), Unexpected: true})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a := math.Abs(keys[i].Observed - keys[i].Reference)
+		b := math.Abs(keys[j].Observed - keys[j].Reference)
+		if a != b {
+			return a > b
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > maxSchemaKeys {
+		keys = keys[:maxSchemaKeys]
+	}
+	return float64(current.SchemaVariants) / float64(current.Count), keys
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Dimensions the categorical and value scorers compare
+const (
+	dimensionValues  = "values"
+	dimensionSources = "sources"
+	dimensionTags    = "tags"
+)
+
+// Share given to a category or bin one side lacks, so the statistics stay
+// finite
+const scorerMinShare = 1e-4
+
+func init() {
+	RegisterScorer("chi_square", newConfiguredScorer(chiSquare, nil, dimensionSources, dimensionTags))
+	RegisterScorer("psi", newConfiguredScorer(populationStability, nil, dimensionValues, dimensionSources, dimensionTags))
+	RegisterScorer("energy_distance", newConfiguredScorer(nil, energyDistance, dimensionValues))
+}
+
+// configuredScorer scores one dimension of a window against a fixed
+// threshold.
+type configuredScorer struct {
+	config ScorerConfig
+	shares func(ref, current map[string]float64) float64          // Over categorical shares, or values binned at the reference quantiles
+	values func(refQuantiles []float64, current *tdigest) float64 // Over the value distribution, instead of binning it
+}
+
+// newConfiguredScorer returns a factory for a scorer supporting the given
+// dimensions, the first being the default.
+func newConfiguredScorer(shares func(ref, current map[string]float64) float64, values func(refQuantiles []float64, current *tdigest) float64, dimensions ...string) ScorerFactory {
+	return func(config ScorerConfig) (Scorer, error) {
+		if config.Dimension == "" {
+			config.Dimension = dimensions[0]
+		}
+		for _, dimension := range dimensions {
+			if config.Dimension == dimension {
+				return &configuredScorer{config: config, shares: shares, values: values}, nil
+			}
+		}
+		return nil, fmt.Errorf("%s does not support dimension %q", config.Type, config.Dimension)
+	}
+}
+
+func (s *configuredScorer) Name() string { return s.config.Name }
+
+func (s *configuredScorer) Threshold(AlertThresholds) float64 { return s.config.Threshold }
+
+func (s *configuredScorer) Compute(ref *ReferenceStatistics, window *windowSummary) float64 {
+	switch s.config.Dimension {
+	case dimensionSources:
+		if len(ref.SourceDistribution) == 0 {
+			return math.NaN()
+		}
+		return s.shares(ref.SourceDistribution, distribution(window.Sources))
+	case dimensionTags:
+		if len(ref.TagDistributions) == 0 {
+			return math.NaN()
+		}
+		total := 0.0
+		for tagKey, refDist := range ref.TagDistributions {
+			total += s.shares(refDist, distribution(window.Tags[tagKey]))
+		}
+		return total / float64(len(ref.TagDistributions))
+	}
+
+	if len(ref.ValueQuantiles) != len(referenceLevels) || window.Values.Count() == 0 {
+		return math.NaN()
+	}
+	if s.values != nil {
+		return s.values(ref.ValueQuantiles, window.Values)
+	}
+	refBins, currentBins := valueBins(ref.ValueQuantiles, window.Values)
+	return s.shares(refBins, currentBins)
+}
+
+// chiSquare is Pearson's chi-square statistic of the current shares
+// against the reference's, divided by the sample count (phi squared), so
+// thresholds hold whatever the window's traffic.
+func chiSquare(ref, current map[string]float64) float64 {
+	score := 0.0
+	for key, expected := range ref {
+		diff := current[key] - expected
+		score += diff * diff / math.Max(expected, scorerMinShare)
+	}
+	for key, observed := range current {
+		if _, ok := ref[key]; !ok {
+			score += observed * observed / scorerMinShare
+		}
+	}
+	return score
+}
+
+// populationStability is the population stability index: the sum over
+// categories of (current - reference) * ln(current / reference). Below
+// 0.1 is usually read as stable and above 0.25 as shifted.
+func populationStability(ref, current map[string]float64) float64 {
+	keys := make(map[string]bool, len(ref)+len(current))
+	for key := range ref {
+		keys[key] = true
+	}
+	for key := range current {
+		keys[key] = true
+	}
+	score := 0.0
+	for key := range keys {
+		expected := math.Max(ref[key], scorerMinShare)
+		observed := math.Max(current[key], scorerMinShare)
+		score += (observed - expected) * math.Log(observed/expected)
+	}
+	return score
+}
+
+// valueBins splits values at the reference quantiles, returning the share
+// of the reference and of the current window in each bin.
+func valueBins(refQuantiles []float64, current *tdigest) (ref, cur map[string]float64) {
+	ref = make(map[string]float64, len(refQuantiles)+1)
+	cur = make(map[string]float64, len(refQuantiles)+1)
+	prevLevel, prevCDF := 0.0, 0.0
+	for i, edge := range refQuantiles {
+		bin := fmt.Sprint(i)
+		cdf := current.CDF(edge)
+		ref[bin] = referenceLevels[i] - prevLevel
+		cur[bin] = math.Max(0, cdf-prevCDF)
+		prevLevel, prevCDF = referenceLevels[i], math.Max(prevCDF, cdf)
+	}
+	bin := fmt.Sprint(len(refQuantiles))
+	ref[bin] = 1 - prevLevel
+	cur[bin] = 1 - prevCDF
+	return ref, cur
+}
+
+// energyDistance is the energy distance between the reference and current
+// value distributions, which in one dimension is twice the integral of the
+// squared difference of their CDFs, divided by the reference's range so
+// it compares across metrics like the Wasserstein score. Unlike KS it
+// adds up the gaps over the whole range rather than taking the largest.
+func energyDistance(refQuantiles []float64, current *tdigest) float64 {
+	const steps = 200
+	lo := math.Min(refQuantiles[0], current.Quantile(0.01))
+	hi := math.Max(refQuantiles[len(refQuantiles)-1], current.Quantile(0.99))
+	if hi <= lo {
+		return 0
+	}
+	width := (hi - lo) / steps
+	integral := 0.0
+	for i := 0; i < steps; i++ {
+		x := lo + (float64(i)+0.5)*width
+		diff := referenceCDF(refQuantiles, x) - current.CDF(x)
+		integral += diff * diff * width
+	}
+	distance := 2 * integral
+	if refRange := refQuantiles[len(refQuantiles)-1] - refQuantiles[0]; refRange > 0 {
+		distance /= refRange
+	}
+	return distance
+}
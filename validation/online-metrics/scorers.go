@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in scores, as in metrics and reports
+const (
+	scoreJSCategorical        = "js_categorical"
+	scoreCooccurrenceJS       = "cooccurrence_js"
+	scoreWasserstein          = "wasserstein"
+	scoreHistogramWasserstein = "histogram_wasserstein"
+	scoreKSSize               = "ks_size"
+)
+
+// Scorer is one divergence statistic of a window of generated samples
+// against the reference. Larger scores are more divergent: a window is red
+// above the threshold and amber above half of it. Compute returns NaN when
+// the statistic does not apply to the family, e.g. a value score on a
+// histogram family.
+type Scorer interface {
+	Name() string
+	Compute(ref *ReferenceStatistics, window *windowSummary) float64
+	Threshold(thresholds AlertThresholds) float64
+}
+
+// gatedScorer is a Scorer whose score only counts when it is significant,
+// as a test statistic is.
+type gatedScorer interface {
+	Scorer
+	Significant(scores *WindowScores, thresholds AlertThresholds) bool
+}
+
+// ScorerConfig adds one scorer of a registered type, from -scorer-config.
+type ScorerConfig struct {
+	Name      string  `json:"name"` // Defaults to the type
+	Type      string  `json:"type"`
+	Threshold float64 `json:"threshold"` // Red threshold, for every family
+
+	// What the scorer compares, for the types that compare several:
+	// values, sources or tags (averaged over the tag keys)
+	Dimension string `json:"dimension,omitempty"`
+}
+
+// ScorersConfig is the file given by -scorer-config.
+type ScorersConfig struct {
+	Scorers []ScorerConfig `json:"scorers"`
+}
+
+// ScorerFactory builds a scorer from its config, or rejects the config.
+type ScorerFactory func(config ScorerConfig) (Scorer, error)
+
+// scorerTypes are the registered scorer types, by type name.
+var scorerTypes = make(map[string]ScorerFactory)
+
+// RegisterScorer makes a scorer type available to -scorer-config. It is
+// meant to be called from init functions, so deployments can build the
+// monitor with statistics of their own.
+func RegisterScorer(kind string, factory ScorerFactory) {
+	if _, exists := scorerTypes[kind]; exists {
+		panic(fmt.Sprintf("scorer type %q registered twice", kind))
+	}
+	scorerTypes[kind] = factory
+}
+
+// LoadScorersConfig reads a scorer configuration file.
+func LoadScorersConfig(path string) (*ScorersConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config ScorersConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// AddScorers builds the configured scorers, which score every window
+// after the built-in ones. On error none are added.
+func (dm *DivergenceMonitor) AddScorers(config *ScorersConfig) error {
+	scorers := append([]Scorer(nil), dm.scorers...)
+	names := make(map[string]bool, len(dm.scorers))
+	for _, scorer := range dm.scorers {
+		names[scorer.Name()] = true
+	}
+	for i, sc := range config.Scorers {
+		factory, ok := scorerTypes[sc.Type]
+		if !ok {
+			return fmt.Errorf("scorer %d: unknown type %q (have %s)", i, sc.Type, strings.Join(scorerTypeNames(), ", "))
+		}
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		if names[sc.Name] {
+			return fmt.Errorf("scorer %d: duplicate name %q", i, sc.Name)
+		}
+		if sc.Threshold <= 0 {
+			return fmt.Errorf("scorer %s: threshold must be positive", sc.Name)
+		}
+		scorer, err := factory(sc)
+		if err != nil {
+			return fmt.Errorf("scorer %s: %w", sc.Name, err)
+		}
+		names[sc.Name] = true
+		scorers = append(scorers, scorer)
+	}
+	dm.scorers = scorers
+	return nil
+}
+
+func scorerTypeNames() []string {
+	kinds := make([]string, 0, len(scorerTypes))
+	for kind := range scorerTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// builtinScorer is one of the scores every window has fields for, with
+// thresholds of its own in AlertThresholds.
+type builtinScorer struct {
+	name        string
+	compute     func(ref *ReferenceStatistics, window *windowSummary) float64
+	threshold   func(thresholds AlertThresholds) float64
+	significant func(scores *WindowScores, thresholds AlertThresholds) bool // nil always counts
+}
+
+func (s *builtinScorer) Name() string { return s.name }
+
+func (s *builtinScorer) Compute(ref *ReferenceStatistics, window *windowSummary) float64 {
+	return s.compute(ref, window)
+}
+
+func (s *builtinScorer) Threshold(thresholds AlertThresholds) float64 {
+	return s.threshold(thresholds)
+}
+
+func (s *builtinScorer) Significant(scores *WindowScores, thresholds AlertThresholds) bool {
+	return s.significant == nil || s.significant(scores, thresholds)
+}
+
+// builtinScorers are the scores every window has: JS over sources and
+// tags, JS over tag-key pairs, Wasserstein over values and histogram
+// centroids, and KS over line sizes, which only counts when the gap is
+// unlikely by chance.
+func (dm *DivergenceMonitor) builtinScorers() []Scorer {
+	js := func(t AlertThresholds) float64 { return t.JSThreshold }
+	wasserstein := func(t AlertThresholds) float64 { return t.WassersteinThreshold }
+	return []Scorer{
+		&builtinScorer{
+			name: scoreJSCategorical,
+			compute: func(ref *ReferenceStatistics, window *windowSummary) float64 {
+				jsSource := dm.computeJSDivergence(ref.SourceDistribution, distribution(window.Sources))
+				jsTagAvg := 0.0
+				for tagKey, refDist := range ref.TagDistributions {
+					jsTagAvg += dm.computeJSDivergence(refDist, distribution(window.Tags[tagKey]))
+				}
+				if len(ref.TagDistributions) > 0 {
+					jsTagAvg /= float64(len(ref.TagDistributions))
+				}
+				return (jsSource + jsTagAvg) / 2.0
+			},
+			threshold: js,
+		},
+		&builtinScorer{
+			name: scoreCooccurrenceJS,
+			compute: func(ref *ReferenceStatistics, window *windowSummary) float64 {
+				score, _ := dm.computeCooccurrenceDivergence(ref, window)
+				return score
+			},
+			threshold: js,
+		},
+		&builtinScorer{
+			name: scoreWasserstein,
+			compute: func(ref *ReferenceStatistics, window *windowSummary) float64 {
+				if len(ref.ValueQuantiles) == 0 && len(ref.HistogramQuantiles) > 0 {
+					return math.NaN()
+				}
+				return dm.computeWassersteinDistance(ref.ValueQuantiles, window.Values)
+			},
+			threshold: wasserstein,
+		},
+		&builtinScorer{
+			name: scoreHistogramWasserstein,
+			compute: func(ref *ReferenceStatistics, window *windowSummary) float64 {
+				score, _, _ := dm.computeHistogramDivergence(ref, window)
+				return score
+			},
+			threshold: wasserstein,
+		},
+		&builtinScorer{
+			name: scoreKSSize,
+			compute: func(ref *ReferenceStatistics, window *windowSummary) float64 {
+				score, _ := dm.computeKSTest(ref.SizeQuantiles, ref.SampleCount, window.Sizes)
+				return score
+			},
+			threshold: func(t AlertThresholds) float64 { return t.KSThreshold },
+			significant: func(scores *WindowScores, t AlertThresholds) bool {
+				return scores.KSSizePValue < t.KSPValueThreshold
+			},
+		},
+	}
+}
+
+// score returns the window's score of the given name, and whether it has
+// one.
+func (scores *WindowScores) score(name string) (float64, bool) {
+	switch name {
+	case scoreJSCategorical:
+		return scores.JSCategorical, true
+	case scoreCooccurrenceJS:
+		return scores.CooccurrenceJS, true
+	case scoreWasserstein:
+		return scores.WassersteinValue, true
+	case scoreHistogramWasserstein:
+		return scores.HistogramWasserstein, true
+	case scoreKSSize:
+		return scores.KSSize, true
+	}
+	value, ok := scores.Extra[name]
+	return value, ok
+}
+
+// setScore records a score computed by the scorer of the given name.
+func (scores *WindowScores) setScore(name string, value float64) {
+	switch name {
+	case scoreJSCategorical:
+		scores.JSCategorical = value
+	case scoreCooccurrenceJS:
+		scores.CooccurrenceJS = value
+	case scoreWasserstein:
+		scores.WassersteinValue = value
+	case scoreHistogramWasserstein:
+		scores.HistogramWasserstein = value
+	case scoreKSSize:
+		scores.KSSize = value
+	default:
+		if scores.Extra == nil {
+			scores.Extra = make(map[string]float64)
+		}
+		scores.Extra[name] = value
+	}
+}
+
+// scoreWindow computes each scorer's score of the window into scores.
+// Built-in scores are skipped when builtin is false, for the short
+// window, which computeFamilyDivergence scores in detail itself.
+func (dm *DivergenceMonitor) scoreWindow(scores *WindowScores, ref *ReferenceStatistics, window *windowSummary, builtin bool) {
+	for _, scorer := range dm.scorers {
+		if _, ok := scorer.(*builtinScorer); ok && !builtin {
+			continue
+		}
+		if value := scorer.Compute(ref, window); !math.IsNaN(value) {
+			scores.setScore(scorer.Name(), value)
+		}
+	}
+}
+
+// windowStatus judges one window's scores alone.
+func (dm *DivergenceMonitor) windowStatus(scores *WindowScores, thresholds AlertThresholds) string {
+	exceeds := func(factor float64) bool {
+		for _, scorer := range dm.scorers {
+			value, ok := scores.score(scorer.Name())
+			if !ok || value <= scorer.Threshold(thresholds)*factor {
+				continue
+			}
+			if gated, ok := scorer.(gatedScorer); ok && !gated.Significant(scores, thresholds) {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+	switch {
+	case exceeds(1):
+		return "red"
+	case exceeds(0.5):
+		return "amber"
+	}
+	return "green"
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// shardPlaceholder in -pubsub-subscription is replaced by the shard ID, so
+// each replica receives every message from a subscription of its own.
+const shardPlaceholder = "{shard}"
+
+// Shard is the part of the family set a monitor replica scores: the
+// families whose ID hashes to ID modulo Count. The zero Shard owns every
+// family.
+type Shard struct {
+	ID    int `json:"id"`
+	Count int `json:"count"`
+}
+
+// Owns reports whether the replica scores the family. Lines whose tag keys
+// match no family are owned by the shard their family ID would hash to,
+// which attributes them to the closest of its families of their metric.
+func (s Shard) Owns(familyID string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	return shardOf(familyID, s.Count) == s.ID
+}
+
+func (s Shard) Sharded() bool {
+	return s.Count > 1
+}
+
+func shardOf(familyID string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(familyID))
+	return int(h.Sum32() % uint32(count))
+}
+
+// NewShard validates a shard ID and count. An ID of -1 takes the ordinal
+// suffix of the host name, as a StatefulSet names its pods (monitor-3).
+func NewShard(id, count int) (Shard, error) {
+	if count < 1 {
+		return Shard{}, fmt.Errorf("shard count must be positive")
+	}
+	if id == -1 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return Shard{}, err
+		}
+		i := strings.LastIndex(hostname, "-")
+		ordinal, err := strconv.Atoi(hostname[i+1:])
+		if i < 0 || err != nil {
+			return Shard{}, fmt.Errorf("host name %q has no ordinal suffix", hostname)
+		}
+		id = ordinal
+	}
+	if id < 0 || id >= count {
+		return Shard{}, fmt.Errorf("shard ID %d is not below the shard count %d", id, count)
+	}
+	return Shard{ID: id, Count: count}, nil
+}
+
+// streams adjusts a stream config so the replica sees every line: each
+// shard joins a Kafka consumer group of its own, and receives from a
+// Pub/Sub subscription of its own, and drops the lines of other shards'
+// families.
+func (s Shard) streams(cfg StreamConfig) StreamConfig {
+	if !s.Sharded() {
+		return cfg
+	}
+	cfg.KafkaGroup = fmt.Sprintf("%s-shard-%d", cfg.KafkaGroup, s.ID)
+	cfg.PubSubSubscription = strings.ReplaceAll(cfg.PubSubSubscription, shardPlaceholder, strconv.Itoa(s.ID))
+	return cfg
+}
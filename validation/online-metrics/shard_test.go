@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardOwnership(t *testing.T) {
+	families := make([]string, 1000)
+	for i := range families {
+		families[i] = fmt.Sprintf("family-%d", i)
+	}
+
+	for _, count := range []int{1, 2, 3, 8} {
+		t.Run(fmt.Sprint(count), func(t *testing.T) {
+			owned := make([]int, count)
+			for _, family := range families {
+				owners := 0
+				for id := 0; id < count; id++ {
+					shard, err := NewShard(id, count)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if shard.Owns(family) {
+						owners++
+						owned[id]++
+					}
+				}
+				if owners != 1 {
+					t.Fatalf("%s owned by %d of %d shards", family, owners, count)
+				}
+			}
+
+			// Families spread evenly enough that no replica carries twice
+			// its share
+			for id, n := range owned {
+				if n > 2*len(families)/count {
+					t.Errorf("shard %d owns %d of %d families", id, n, len(families))
+				}
+			}
+		})
+	}
+
+	var unsharded Shard
+	if unsharded.Sharded() || !unsharded.Owns("any") {
+		t.Error("the zero shard must own every family")
+	}
+}
+
+func TestNewShard(t *testing.T) {
+	tests := []struct {
+		id, count int
+		wantErr   bool
+	}{
+		{0, 1, false},
+		{2, 3, false},
+		{3, 3, true},
+		{-2, 3, true},
+		{0, 0, true},
+	}
+	for _, tt := range tests {
+		_, err := NewShard(tt.id, tt.count)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewShard(%d, %d) error = %v, want error %v", tt.id, tt.count, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShardStreams(t *testing.T) {
+	cfg := StreamConfig{KafkaGroup: "monitor", PubSubSubscription: "sampled-{shard}"}
+
+	if got := (Shard{}).streams(cfg); got.KafkaGroup != "monitor" || got.PubSubSubscription != "sampled-{shard}" {
+		t.Errorf("unsharded streams = %+v, want the config unchanged", got)
+	}
+	got := Shard{ID: 2, Count: 4}.streams(cfg)
+	if got.KafkaGroup != "monitor-shard-2" {
+		t.Errorf("Kafka group = %q, want monitor-shard-2", got.KafkaGroup)
+	}
+	if got.PubSubSubscription != "sampled-2" {
+		t.Errorf("Pub/Sub subscription = %q, want sampled-2", got.PubSubSubscription)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxSilenceDuration bounds a silence, so one forgotten after an
+// investigation does not hide a family for good.
+const maxSilenceDuration = 7 * 24 * time.Hour
+
+var alertSilences = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "loadgen_alert_silences",
+		Help: "Families whose alerts are silenced",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(alertSilences)
+}
+
+// Silence suppresses a family's notifications while it is investigated.
+// Its alert still opens, escalates and resolves, and is listed at /alerts;
+// an alert that fired during the silence notifies once the silence ends.
+type Silence struct {
+	FamilyID  string    `json:"family_id"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+}
+
+// SilenceStore holds the silences by family ID. Silences are kept in
+// memory, and survive restarts only through the checkpoint.
+type SilenceStore struct {
+	silences map[string]*Silence
+	mu       sync.Mutex
+}
+
+func NewSilenceStore() *SilenceStore {
+	return &SilenceStore{silences: make(map[string]*Silence)}
+}
+
+// Silenced reports whether the family has a silence at now.
+func (ss *SilenceStore) Silenced(familyID string, now time.Time) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	silence, ok := ss.silences[familyID]
+	return ok && now.Before(silence.EndsAt)
+}
+
+// Set silences a family, replacing any silence it has.
+func (ss *SilenceStore) Set(silence Silence) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.silences[silence.FamilyID] = &silence
+	alertSilences.Set(float64(len(ss.silences)))
+}
+
+// Remove lifts a family's silence, returning false if it had none.
+func (ss *SilenceStore) Remove(familyID string, now time.Time) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	silence, ok := ss.silences[familyID]
+	delete(ss.silences, familyID)
+	alertSilences.Set(float64(len(ss.silences)))
+	return ok && now.Before(silence.EndsAt)
+}
+
+// Active returns the silences in effect at now, ending soonest first, and
+// drops the expired ones.
+func (ss *SilenceStore) Active(now time.Time) []Silence {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	silences := make([]Silence, 0, len(ss.silences))
+	for familyID, silence := range ss.silences {
+		if !now.Before(silence.EndsAt) {
+			delete(ss.silences, familyID)
+			continue
+		}
+		silences = append(silences, *silence)
+	}
+	alertSilences.Set(float64(len(ss.silences)))
+	sort.Slice(silences, func(i, j int) bool { return silences[i].EndsAt.Before(silences[j].EndsAt) })
+	return silences
+}
+
+// handleAlert routes /alerts/{family_id}/silence: POST silences the family
+// for a duration, with the reason it is being investigated; DELETE lifts
+// the silence.
+func (dm *DivergenceMonitor) handleAlert(w http.ResponseWriter, r *http.Request) {
+	familyID, view, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/alerts/"), "/")
+	if familyID == "" || view != "silence" {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	switch r.Method {
+	case "POST":
+	case "DELETE":
+		if !dm.silences.Remove(familyID, now) {
+			http.Error(w, "Family is not silenced", http.StatusNotFound)
+			return
+		}
+		log.Printf("Family %s: silence lifted", familyID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Duration  string `json:"duration"` // e.g. 2h
+		Reason    string `json:"reason"`
+		CreatedBy string `json:"created_by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+	if duration > maxSilenceDuration {
+		http.Error(w, fmt.Sprintf("Duration exceeds %s", maxSilenceDuration), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	dm.mu.RLock()
+	_, exists := dm.families[familyID]
+	dm.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Unknown family", http.StatusNotFound)
+		return
+	}
+
+	silence := Silence{
+		FamilyID:  familyID,
+		Reason:    request.Reason,
+		CreatedBy: request.CreatedBy,
+		StartsAt:  now,
+		EndsAt:    now.Add(duration),
+	}
+	dm.silences.Set(silence)
+	log.Printf("Family %s: silenced until %s: %s", familyID, silence.EndsAt.Format(time.RFC3339), silence.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(silence)
+}
+
+// handleSilences serves GET /silences: the silences in effect, ending
+// soonest first.
+func (dm *DivergenceMonitor) handleSilences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dm.silences.Active(time.Now()))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+// Message attributes (Kafka headers or Pub/Sub attributes) set by the
+// publishers of sampled lines. A message without an origin holds generated
+// lines; one with an endpoint holds lines sent to that collector endpoint.
+const (
+	streamOriginAttribute   = "origin"
+	streamEncodingAttribute = "content-encoding"
+	streamEndpointAttribute = "endpoint"
+)
+
+// streamRetryDelay is how long a failed consumer waits before reconnecting.
+const streamRetryDelay = 10 * time.Second
+
+// StreamConfig selects the Kafka topic or Pub/Sub subscription the monitor
+// consumes sampled lines from. Each message holds newline-separated lines.
+type StreamConfig struct {
+	KafkaBrokers []string
+	KafkaTopic   string
+	KafkaGroup   string
+
+	// projects/<project>/subscriptions/<subscription>
+	PubSubSubscription string
+
+	// Kafka readers in the consumer group, or Pub/Sub receive goroutines
+	Consumers int
+}
+
+var streamMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_stream_messages_total",
+		Help: "Stream messages consumed, by stream and result (ok, invalid)",
+	},
+	[]string{"stream", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(streamMessages)
+}
+
+// ConsumeStreams starts the consumers configured in cfg. They run until
+// ctx is cancelled and reconnect after failures. Replicas sharing a Kafka
+// consumer group or a Pub/Sub subscription split the stream between them.
+func (dm *DivergenceMonitor) ConsumeStreams(ctx context.Context, cfg StreamConfig) {
+	if cfg.KafkaTopic != "" {
+		for i := 0; i < cfg.Consumers; i++ {
+			go runConsumer(ctx, "kafka", func(ctx context.Context) error { return dm.consumeKafka(ctx, cfg) })
+		}
+		log.Printf("Consuming sampled lines from Kafka topic %s (group %s, %d readers)", cfg.KafkaTopic, cfg.KafkaGroup, cfg.Consumers)
+	}
+	if cfg.PubSubSubscription != "" {
+		go runConsumer(ctx, "pubsub", func(ctx context.Context) error { return dm.consumePubSub(ctx, cfg) })
+		log.Printf("Consuming sampled lines from Pub/Sub subscription %s", cfg.PubSubSubscription)
+	}
+}
+
+func runConsumer(ctx context.Context, stream string, consume func(context.Context) error) {
+	for {
+		err := consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("%s consumer stopped: %v; reconnecting in %s", stream, err, streamRetryDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryDelay):
+		}
+	}
+}
+
+// ingestMessage ingests the lines of one message. A message that cannot
+// be decoded is counted and dropped rather than redelivered, since it
+// would fail again.
+func (dm *DivergenceMonitor) ingestMessage(stream, origin, endpoint, encoding string, data []byte, received time.Time) {
+	if origin == "" {
+		origin = originGenerated
+	}
+	if origin != originGenerated && origin != originCaptured {
+		log.Printf("Dropping %s message with unknown origin %q", stream, origin)
+		streamMessages.WithLabelValues(stream, "invalid").Inc()
+		return
+	}
+	lines, err := decodeLines(data, encoding)
+	if err != nil {
+		log.Printf("Dropping %s message: %v", stream, err)
+		streamMessages.WithLabelValues(stream, "invalid").Inc()
+		return
+	}
+	dm.IngestLines(origin, endpoint, received, lines)
+	streamMessages.WithLabelValues(stream, "ok").Inc()
+}
+
+// consumeKafka reads the topic as one member of the consumer group.
+// Offsets are committed in the background once messages are ingested.
+func (dm *DivergenceMonitor) consumeKafka(ctx context.Context, cfg StreamConfig) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        cfg.KafkaBrokers,
+		GroupID:        cfg.KafkaGroup,
+		Topic:          cfg.KafkaTopic,
+		MinBytes:       1 << 10,
+		MaxBytes:       10 << 20,
+		MaxWait:        time.Second,
+		CommitInterval: time.Second,
+		StartOffset:    kafka.LastOffset,
+	})
+	defer reader.Close()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch message: %w", err)
+		}
+
+		var origin, endpoint, encoding string
+		for _, header := range msg.Headers {
+			switch header.Key {
+			case streamOriginAttribute:
+				origin = string(header.Value)
+			case streamEndpointAttribute:
+				endpoint = string(header.Value)
+			case streamEncodingAttribute:
+				encoding = string(header.Value)
+			}
+		}
+		dm.ingestMessage("kafka", origin, endpoint, encoding, msg.Value, time.Now())
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return fmt.Errorf("failed to commit offset: %w", err)
+		}
+	}
+}
+
+// consumePubSub receives from the subscription until ctx is cancelled.
+func (dm *DivergenceMonitor) consumePubSub(ctx context.Context, cfg StreamConfig) error {
+	project, subscription, err := parseSubscription(cfg.PubSubSubscription)
+	if err != nil {
+		return err
+	}
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+	defer client.Close()
+
+	sub := client.Subscription(subscription)
+	sub.ReceiveSettings.NumGoroutines = cfg.Consumers
+	sub.ReceiveSettings.MaxOutstandingMessages = 100 * cfg.Consumers
+
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		dm.ingestMessage("pubsub", msg.Attributes[streamOriginAttribute], msg.Attributes[streamEndpointAttribute], msg.Attributes[streamEncodingAttribute], msg.Data, time.Now())
+		msg.Ack()
+	})
+}
+
+// parseSubscription splits projects/<project>/subscriptions/<subscription>.
+func parseSubscription(name string) (project, subscription string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "subscriptions" || parts[1] == "" || parts[3] == "" {
+		return "", "", errors.New("subscription must be projects/<project>/subscriptions/<subscription>")
+	}
+	return parts[1], parts[3], nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// tdigestCompression bounds a digest to about compression/2 centroids;
+// 200 keeps tail quantiles within a fraction of a percent.
+const tdigestCompression = 200
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigest is a merging t-digest (Dunning): a streaming quantile sketch
+// accurate at the tails, with bounded size regardless of how many values
+// it summarises. It is not safe for concurrent use.
+type tdigest struct {
+	compression float64
+	centroids   []centroid // sorted by mean once compressed
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+func newTDigest() *tdigest {
+	return &tdigest{compression: tdigestCompression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (t *tdigest) Add(x float64) {
+	t.add(centroid{mean: x, weight: 1})
+}
+
+func (t *tdigest) add(c centroid) {
+	t.buffer = append(t.buffer, c)
+	t.count += c.weight
+	t.min = math.Min(t.min, c.mean)
+	t.max = math.Max(t.max, c.mean)
+	if len(t.buffer) >= 5*int(t.compression) {
+		t.compress()
+	}
+}
+
+// Merge adds the values summarised by other.
+func (t *tdigest) Merge(other *tdigest) {
+	other.compress()
+	for _, c := range other.centroids {
+		t.add(c)
+	}
+	t.min = math.Min(t.min, other.min)
+	t.max = math.Max(t.max, other.max)
+}
+
+// Count is the number of values added.
+func (t *tdigest) Count() float64 {
+	return t.count
+}
+
+// compress merges buffered values into the centroids. Centroids are sized
+// by the k1 scale function k(q) = compression/(2π)·asin(2q-1): each spans at
+// most one unit of k, so they stay small near the tails.
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	t.buffer = t.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	current := all[0]
+	soFar := 0.0
+	qLimit := t.quantileLimit(0)
+	for _, c := range all[1:] {
+		proposed := current.weight + c.weight
+		if (soFar+proposed)/t.count <= qLimit {
+			current.mean += (c.mean - current.mean) * c.weight / proposed
+			current.weight = proposed
+			continue
+		}
+		soFar += current.weight
+		merged = append(merged, current)
+		current = c
+		qLimit = t.quantileLimit(soFar / t.count)
+	}
+	t.centroids = append(merged, current)
+}
+
+// quantileLimit is the quantile one unit of k above q0.
+func (t *tdigest) quantileLimit(q0 float64) float64 {
+	k := math.Asin(2*q0-1) + 2*math.Pi/t.compression
+	if k >= math.Pi/2 {
+		return 1
+	}
+	return (1 + math.Sin(k)) / 2
+}
+
+// Quantile estimates the q quantile, interpolating between centroid
+// centres and the observed min and max.
+func (t *tdigest) Quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 || q <= 0 {
+		if q >= 1 {
+			return t.max
+		}
+		if q <= 0 {
+			return t.min
+		}
+		return t.centroids[0].mean
+	}
+	if q >= 1 {
+		return t.max
+	}
+
+	target := q * t.count
+	first := t.centroids[0]
+	if target < first.weight/2 {
+		return t.min + (first.mean-t.min)*target/(first.weight/2)
+	}
+	cumulative := first.weight / 2 // position of the current centroid's centre
+	for i := 1; i < len(t.centroids); i++ {
+		prev, next := t.centroids[i-1], t.centroids[i]
+		step := (prev.weight + next.weight) / 2
+		if target < cumulative+step {
+			return prev.mean + (next.mean-prev.mean)*(target-cumulative)/step
+		}
+		cumulative += step
+	}
+	last := t.centroids[len(t.centroids)-1]
+	remaining := last.weight / 2
+	if remaining == 0 {
+		return t.max
+	}
+	return last.mean + (t.max-last.mean)*math.Min(1, (target-cumulative)/remaining)
+}
+
+// CDF estimates the share of values at or below x.
+func (t *tdigest) CDF(x float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if x < t.min {
+		return 0
+	}
+	if x >= t.max {
+		return 1
+	}
+
+	first := t.centroids[0]
+	if x < first.mean {
+		if first.mean == t.min {
+			return 0
+		}
+		return (first.weight / 2) * (x - t.min) / (first.mean - t.min) / t.count
+	}
+	cumulative := first.weight / 2
+	for i := 1; i < len(t.centroids); i++ {
+		prev, next := t.centroids[i-1], t.centroids[i]
+		step := (prev.weight + next.weight) / 2
+		if x < next.mean {
+			if next.mean == prev.mean {
+				return (cumulative + step) / t.count
+			}
+			return (cumulative + step*(x-prev.mean)/(next.mean-prev.mean)) / t.count
+		}
+		cumulative += step
+	}
+	last := t.centroids[len(t.centroids)-1]
+	if t.max == last.mean {
+		return 1
+	}
+	return (cumulative + (last.weight/2)*(x-last.mean)/(t.max-last.mean)) / t.count
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// rankOf is the share of sorted values at or below x
+func rankOf(sorted []float64, x float64) float64 {
+	return float64(sort.SearchFloat64s(sorted, math.Nextafter(x, math.Inf(1)))) / float64(len(sorted))
+}
+
+func TestTDigestQuantiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	distributions := []struct {
+		name   string
+		sample func() float64
+	}{
+		{"uniform", func() float64 { return rng.Float64() * 1000 }},
+		{"exponential", func() float64 { return rng.ExpFloat64() * 50 }},
+		{"lognormal", func() float64 { return math.Exp(rng.NormFloat64()) }},
+	}
+
+	for _, d := range distributions {
+		sample := d.sample
+		t.Run(d.name, func(t *testing.T) {
+			// Two digests merged, as windows are
+			a, b := newTDigest(), newTDigest()
+			values := make([]float64, 100000)
+			for i := range values {
+				values[i] = sample()
+				if i%2 == 0 {
+					a.Add(values[i])
+				} else {
+					b.Add(values[i])
+				}
+			}
+			a.Merge(b)
+			sort.Float64s(values)
+
+			if a.Count() != float64(len(values)) {
+				t.Errorf("count = %v, want %d", a.Count(), len(values))
+			}
+			if len(a.centroids) > tdigestCompression {
+				t.Errorf("%d centroids, want at most %d", len(a.centroids), tdigestCompression)
+			}
+
+			// Rank error shrinks towards the tails
+			for _, q := range []float64{0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999} {
+				tolerance := math.Min(0.005, 0.25*math.Min(q, 1-q))
+				if got := rankOf(values, a.Quantile(q)); math.Abs(got-q) > tolerance {
+					t.Errorf("Quantile(%v) has rank %v, want within %v", q, got, tolerance)
+				}
+
+				exact := values[int(q*float64(len(values)))]
+				if got := a.CDF(exact); math.Abs(got-q) > tolerance {
+					t.Errorf("CDF(%v) = %v, want %v within %v", exact, got, q, tolerance)
+				}
+			}
+
+			if got := a.Quantile(0); got != values[0] {
+				t.Errorf("Quantile(0) = %v, want the minimum %v", got, values[0])
+			}
+			if got := a.Quantile(1); got != values[len(values)-1] {
+				t.Errorf("Quantile(1) = %v, want the maximum %v", got, values[len(values)-1])
+			}
+			if got := a.CDF(values[0] - 1); got != 0 {
+				t.Errorf("CDF below the minimum = %v, want 0", got)
+			}
+			if got := a.CDF(values[len(values)-1]); got != 1 {
+				t.Errorf("CDF at the maximum = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestTDigestSmall(t *testing.T) {
+	empty := newTDigest()
+	if got := empty.Quantile(0.5); got != 0 {
+		t.Errorf("empty Quantile(0.5) = %v, want 0", got)
+	}
+	if got := empty.CDF(1); got != 0 {
+		t.Errorf("empty CDF(1) = %v, want 0", got)
+	}
+
+	single := newTDigest()
+	single.Add(42)
+	for _, q := range []float64{0, 0.5, 1} {
+		if got := single.Quantile(q); got != 42 {
+			t.Errorf("single value Quantile(%v) = %v, want 42", q, got)
+		}
+	}
+
+	constant := newTDigest()
+	for i := 0; i < 5000; i++ {
+		constant.Add(7)
+	}
+	if got := constant.Quantile(0.9); got != 7 {
+		t.Errorf("constant Quantile(0.9) = %v, want 7", got)
+	}
+	if got := constant.CDF(7); got != 1 {
+		t.Errorf("constant CDF(7) = %v, want 1", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Minutes in the reference intensity curve, and of rate history kept
+	curveMinutes = 1440
+
+	// Complete minutes needed before the correlation is meaningful
+	temporalMinMinutes = 30
+
+	// The phase is searched in full this often, and only around the last
+	// best lag in between
+	temporalLagSearchInterval = time.Hour
+	temporalLagRefine         = 10
+)
+
+var (
+	divergenceTemporal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_temporal_correlation",
+			Help: "Correlation of the per-minute emission rate with the reference intensity curve, at the best phase",
+		},
+		[]string{"family_id", "method"},
+	)
+
+	temporalLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loadgen_divergence_temporal_lag_minutes",
+			Help: "Offset into the reference intensity curve the emission rate aligns best with",
+		},
+		[]string{"family_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(divergenceTemporal)
+	prometheus.MustRegister(temporalLag)
+}
+
+// minuteRates counts a family's generated samples per minute over the last
+// day. It is guarded by the family's mu.
+type minuteRates struct {
+	counts []float64 // indexed by unix minute modulo curveMinutes
+	first  int64     // unix minute of the first sample
+	last   int64     // newest unix minute with a slot
+
+	// Best phase found against the reference curve
+	lag           int
+	lagSearchedAt time.Time
+}
+
+func newMinuteRates() *minuteRates {
+	return &minuteRates{counts: make([]float64, curveMinutes)}
+}
+
+func (r *minuteRates) Add(t time.Time, n int) {
+	minute := t.Unix() / 60
+	if r.first == 0 {
+		r.first, r.last = minute, minute
+	}
+	r.advance(minute)
+	if minute <= r.last-curveMinutes {
+		return // older than the history
+	}
+	r.counts[minute%curveMinutes] += float64(n)
+}
+
+// advance clears the slots of the minutes up to minute.
+func (r *minuteRates) advance(minute int64) {
+	if minute <= r.last {
+		return
+	}
+	from := r.last + 1
+	if minute-from >= curveMinutes {
+		from = minute - curveMinutes + 1
+	}
+	for m := from; m <= minute; m++ {
+		r.counts[m%curveMinutes] = 0
+	}
+	r.last = minute
+}
+
+// Series returns the counts of the complete minutes before now, oldest
+// first.
+func (r *minuteRates) Series(now time.Time) []float64 {
+	if r.first == 0 {
+		return nil
+	}
+	end := now.Unix() / 60
+	r.advance(end)
+	start := r.first
+	if start < end-curveMinutes+1 {
+		start = end - curveMinutes + 1
+	}
+	series := make([]float64, 0, end-start)
+	for m := start; m < end; m++ {
+		series = append(series, r.counts[m%curveMinutes])
+	}
+	return series
+}
+
+// computeTemporalCorrelation correlates the family's per-minute emission
+// rate with its reference intensity curve. The generator starts the curve
+// when its scenario starts, so the rate is aligned with the curve at the
+// phase that maximises the Pearson correlation; Spearman is reported at the
+// same phase. ok is false until enough minutes were observed. The caller
+// holds family.mu.
+func (dm *DivergenceMonitor) computeTemporalCorrelation(family *FamilyMonitor, now time.Time) (pearson, spearman float64, lag, minutes int, ok bool) {
+	curve := family.ReferenceStats.IntensityCurve
+	observed := family.Rates.Series(now)
+	if len(curve) == 0 || len(observed) < temporalMinMinutes {
+		return 0, 0, 0, len(observed), false
+	}
+
+	rates := family.Rates
+	var lags []int
+	if rates.lagSearchedAt.IsZero() || now.Sub(rates.lagSearchedAt) >= temporalLagSearchInterval {
+		lags = make([]int, len(curve))
+		for i := range lags {
+			lags[i] = i
+		}
+		rates.lagSearchedAt = now
+	} else {
+		for d := -temporalLagRefine; d <= temporalLagRefine; d++ {
+			lags = append(lags, ((rates.lag+d)%len(curve)+len(curve))%len(curve))
+		}
+	}
+
+	aligned := make([]float64, len(observed))
+	best := math.Inf(-1)
+	for _, l := range lags {
+		for i := range observed {
+			aligned[i] = curve[(l+i)%len(curve)]
+		}
+		if r := pearsonCorrelation(observed, aligned); r > best {
+			best, lag = r, l
+		}
+	}
+	rates.lag = lag
+
+	for i := range observed {
+		aligned[i] = curve[(lag+i)%len(curve)]
+	}
+	pearson = best
+	spearman = pearsonCorrelation(ranks(observed), ranks(aligned))
+	return pearson, spearman, lag, len(observed), true
+}
+
+// pearsonCorrelation is 0 when either series is constant.
+func pearsonCorrelation(x, y []float64) float64 {
+	n := float64(len(x))
+	if n == 0 {
+		return 0
+	}
+	meanX, meanY := 0.0, 0.0
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	cov, varX, varY := 0.0, 0.0, 0.0
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// ranks returns the rank of each value, averaging ties.
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+
+	result := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && values[order[j+1]] == values[order[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			result[order[k]] = rank
+		}
+		i = j + 1
+	}
+	return result
+}
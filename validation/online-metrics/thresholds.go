@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric classes thresholds can be set for. A family's class comes from its
+// recipe: histograms, delta counters, and everything else as gauges.
+const (
+	metricClassCounter   = "counter"
+	metricClassGauge     = "gauge"
+	metricClassHistogram = "histogram"
+)
+
+var thresholdReloads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "loadgen_threshold_reloads_total",
+		Help: "Threshold config reloads, by source (file, api) and result (ok, failed)",
+	},
+	[]string{"source", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(thresholdReloads)
+}
+
+// ThresholdConfig overrides the default alert thresholds. A family takes
+// the defaults, then its class's overrides, then its own.
+type ThresholdConfig struct {
+	Defaults ThresholdOverrides            `json:"defaults"`
+	Classes  map[string]ThresholdOverrides `json:"classes,omitempty"`  // counter, gauge or histogram
+	Families map[string]ThresholdOverrides `json:"families,omitempty"` // by family ID
+}
+
+// ThresholdOverrides sets some of the alert thresholds; unset ones are
+// inherited.
+type ThresholdOverrides struct {
+	JS           *float64 `json:"js,omitempty"`
+	Wasserstein  *float64 `json:"wasserstein,omitempty"`
+	KS           *float64 `json:"ks,omitempty"`
+	KSPValue     *float64 `json:"ks_pvalue,omitempty"`
+	TemporalCorr *float64 `json:"temporal_correlation,omitempty"`
+	Burstiness   *float64 `json:"burstiness,omitempty"`
+	Autocorr     *float64 `json:"autocorrelation,omitempty"`
+	SLOTarget    *float64 `json:"slo_target,omitempty"`
+	FastBurn     *float64 `json:"fast_burn_rate,omitempty"`
+	SlowBurn     *float64 `json:"slow_burn_rate,omitempty"`
+	RedMinutes   *int     `json:"red_minutes,omitempty"`
+}
+
+func (o ThresholdOverrides) apply(t AlertThresholds) AlertThresholds {
+	if o.JS != nil {
+		t.JSThreshold = *o.JS
+	}
+	if o.Wasserstein != nil {
+		t.WassersteinThreshold = *o.Wasserstein
+	}
+	if o.KS != nil {
+		t.KSThreshold = *o.KS
+	}
+	if o.KSPValue != nil {
+		t.KSPValueThreshold = *o.KSPValue
+	}
+	if o.TemporalCorr != nil {
+		t.TemporalCorrThreshold = *o.TemporalCorr
+	}
+	if o.Burstiness != nil {
+		t.BurstinessThreshold = *o.Burstiness
+	}
+	if o.Autocorr != nil {
+		t.AutocorrThreshold = *o.Autocorr
+	}
+	if o.SLOTarget != nil {
+		t.SLOTarget = *o.SLOTarget
+	}
+	if o.FastBurn != nil {
+		t.FastBurnRate = *o.FastBurn
+	}
+	if o.SlowBurn != nil {
+		t.SlowBurnRate = *o.SlowBurn
+	}
+	if o.RedMinutes != nil {
+		t.RedStatusMinutes = *o.RedMinutes
+	}
+	return t
+}
+
+func (o ThresholdOverrides) validate() error {
+	for name, value := range map[string]*float64{"js": o.JS, "wasserstein": o.Wasserstein, "ks": o.KS, "burstiness": o.Burstiness, "autocorrelation": o.Autocorr, "fast_burn_rate": o.FastBurn, "slow_burn_rate": o.SlowBurn} {
+		if value != nil && *value <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if o.KSPValue != nil && (*o.KSPValue <= 0 || *o.KSPValue >= 1) {
+		return fmt.Errorf("ks_pvalue must be between 0 and 1")
+	}
+	if o.TemporalCorr != nil && (*o.TemporalCorr < -1 || *o.TemporalCorr > 1) {
+		return fmt.Errorf("temporal_correlation must be between -1 and 1")
+	}
+	if o.SLOTarget != nil && (*o.SLOTarget <= 0 || *o.SLOTarget >= 1) {
+		return fmt.Errorf("slo_target must be between 0 and 1")
+	}
+	if o.RedMinutes != nil && *o.RedMinutes <= 0 {
+		return fmt.Errorf("red_minutes must be positive")
+	}
+	return nil
+}
+
+func (config *ThresholdConfig) validate() error {
+	if err := config.Defaults.validate(); err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	for class, overrides := range config.Classes {
+		switch class {
+		case metricClassCounter, metricClassGauge, metricClassHistogram:
+		default:
+			return fmt.Errorf("unknown metric class %q", class)
+		}
+		if err := overrides.validate(); err != nil {
+			return fmt.Errorf("class %s: %w", class, err)
+		}
+	}
+	for familyID, overrides := range config.Families {
+		if err := overrides.validate(); err != nil {
+			return fmt.Errorf("family %s: %w", familyID, err)
+		}
+	}
+	return nil
+}
+
+// ThresholdStore resolves each family's alert thresholds from the built-in
+// defaults and a config that is reloaded from Path when the file changes,
+// or replaced through the API. An API update lasts until the file next
+// changes.
+type ThresholdStore struct {
+	Path string
+	Base AlertThresholds
+
+	config  ThresholdConfig
+	modTime time.Time
+	mu      sync.RWMutex
+}
+
+func NewThresholdStore(path string, base AlertThresholds) *ThresholdStore {
+	return &ThresholdStore{Path: path, Base: base}
+}
+
+// Reload reads the config file if it changed since the last load. A file
+// that fails to parse or validate leaves the current config in place.
+func (ts *ThresholdStore) Reload() error {
+	if ts.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(ts.Path)
+	if err != nil {
+		return err
+	}
+	ts.mu.RLock()
+	unchanged := info.ModTime().Equal(ts.modTime)
+	ts.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(ts.Path)
+	if err != nil {
+		return err
+	}
+	var config ThresholdConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		thresholdReloads.WithLabelValues("file", "failed").Inc()
+		return fmt.Errorf("failed to parse %s: %w", ts.Path, err)
+	}
+	if err := config.validate(); err != nil {
+		thresholdReloads.WithLabelValues("file", "failed").Inc()
+		return fmt.Errorf("invalid %s: %w", ts.Path, err)
+	}
+
+	ts.mu.Lock()
+	ts.config = config
+	ts.modTime = info.ModTime()
+	ts.mu.Unlock()
+	thresholdReloads.WithLabelValues("file", "ok").Inc()
+	log.Printf("Loaded thresholds from %s (%d class, %d family overrides)", ts.Path, len(config.Classes), len(config.Families))
+	return nil
+}
+
+// Run reloads the config file every interval until ctx is cancelled.
+func (ts *ThresholdStore) Run(ctx context.Context, interval time.Duration) {
+	if ts.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ts.Reload(); err != nil {
+				log.Printf("Failed to reload thresholds: %v", err)
+			}
+		}
+	}
+}
+
+// Set replaces the config.
+func (ts *ThresholdStore) Set(config ThresholdConfig) error {
+	if err := config.validate(); err != nil {
+		thresholdReloads.WithLabelValues("api", "failed").Inc()
+		return err
+	}
+	ts.mu.Lock()
+	ts.config = config
+	ts.mu.Unlock()
+	thresholdReloads.WithLabelValues("api", "ok").Inc()
+	return nil
+}
+
+func (ts *ThresholdStore) Config() ThresholdConfig {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.config
+}
+
+// Resolve returns the thresholds of a family of the given class.
+func (ts *ThresholdStore) Resolve(familyID, class string) AlertThresholds {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	thresholds := ts.config.Defaults.apply(ts.Base)
+	if overrides, ok := ts.config.Classes[class]; ok {
+		thresholds = overrides.apply(thresholds)
+	}
+	if overrides, ok := ts.config.Families[familyID]; ok {
+		thresholds = overrides.apply(thresholds)
+	}
+	return thresholds
+}
+
+// familyThresholds resolves the thresholds a family is scored against. The
+// caller holds family.mu.
+func (dm *DivergenceMonitor) familyThresholds(family *FamilyMonitor) AlertThresholds {
+	class := metricClassGauge
+	if family.ReferenceStats != nil {
+		class = family.ReferenceStats.MetricClass
+	}
+	return dm.thresholds.Resolve(family.FamilyID, class)
+}
+
+// handleThresholds serves the threshold config: GET returns it along with
+// every family's resolved thresholds, PUT replaces it.
+func (dm *DivergenceMonitor) handleThresholds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var config ThresholdConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := dm.thresholds.Set(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Thresholds replaced through the API (%d class, %d family overrides)", len(config.Classes), len(config.Families))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type familyThresholds struct {
+		FamilyID   string          `json:"family_id"`
+		Class      string          `json:"class"`
+		Thresholds AlertThresholds `json:"thresholds"`
+	}
+	dm.mu.RLock()
+	families := make([]familyThresholds, 0, len(dm.families))
+	for _, family := range dm.families {
+		family.mu.RLock()
+		resolved := familyThresholds{FamilyID: family.FamilyID, Class: metricClassGauge, Thresholds: dm.familyThresholds(family)}
+		if family.ReferenceStats != nil {
+			resolved.Class = family.ReferenceStats.MetricClass
+		}
+		family.mu.RUnlock()
+		families = append(families, resolved)
+	}
+	dm.mu.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].FamilyID < families[j].FamilyID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config":   dm.thresholds.Config(),
+		"families": families,
+	})
+}
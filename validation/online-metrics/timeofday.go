@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Minutes of the intensity curve each reference slice covers, so the day
+// is split into hourly slices, counted from the start of the capture.
+const sliceMinutes = 60
+
+var referenceSliceHour = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "loadgen_reference_slice_hour",
+		Help: "Hour of the intensity curve whose distributions the current window is compared against; -1 is the all-day reference",
+	},
+	[]string{"family_id"},
+)
+
+func init() {
+	prometheus.MustRegister(referenceSliceHour)
+}
+
+// ReferenceSlice holds the distributions of one hour of the capture. Any
+// of them may be missing, when the reference's all-day ones stand in.
+type ReferenceSlice struct {
+	SourceDistribution map[string]float64
+	TagDistributions   map[string]map[string]float64
+	ValueQuantiles     []float64
+	SampleCount        float64
+}
+
+// slice returns the reference with the distributions of hour in place of
+// the all-day ones, or the reference itself if it has no such slice.
+func (ref *ReferenceStatistics) slice(hour int) *ReferenceStatistics {
+	if ref == nil || hour < 0 || hour >= len(ref.Slices) || ref.Slices[hour] == nil {
+		return ref
+	}
+	slice := ref.Slices[hour]
+	sliced := *ref
+	if len(slice.SourceDistribution) > 0 {
+		sliced.SourceDistribution = slice.SourceDistribution
+	}
+	if len(slice.TagDistributions) > 0 {
+		sliced.TagDistributions = make(map[string]map[string]float64, len(ref.TagDistributions))
+		for key, dist := range ref.TagDistributions {
+			sliced.TagDistributions[key] = dist
+		}
+		for key, dist := range slice.TagDistributions {
+			if len(dist) > 0 {
+				sliced.TagDistributions[key] = dist
+			}
+		}
+	}
+	if len(slice.ValueQuantiles) > 0 && len(ref.ValueQuantiles) > 0 {
+		sliced.ValueQuantiles = slice.ValueQuantiles
+	}
+	if slice.SampleCount > 0 {
+		sliced.SampleCount = slice.SampleCount
+	}
+	return &sliced
+}
+
+// curveMinute is the minute of the intensity curve the generator emitted
+// at back before now, or at its first sample if that is later. The
+// generator starts the curve when its scenario starts, so until the
+// temporal correlation has found the phase, the family's first sample is
+// taken as the curve's start.
+func (r *minuteRates) curveMinute(now time.Time, back time.Duration) int {
+	if r.first == 0 {
+		return 0
+	}
+	end := now.Unix() / 60
+	start := r.first
+	if start < end-curveMinutes+1 {
+		start = end - curveMinutes + 1 // as Series, which lag is relative to
+	}
+	elapsed := max(0, end-start-int64(back/time.Minute))
+	return (r.lag + int(elapsed)) % curveMinutes
+}
+
+// sliceHour picks the hour of the capture a window ending at now should be
+// compared against: the hour around the window's middle, on the family's
+// intensity curve. It returns -1 when the reference has no hourly slices,
+// or its distributions were refreshed live and are already current. The
+// caller holds family.mu.
+func (family *FamilyMonitor) sliceHour(window time.Duration, now time.Time) int {
+	if family.ReferenceStats == nil || len(family.ReferenceStats.Slices) == 0 || family.Live != nil {
+		return -1
+	}
+	return family.Rates.curveMinute(now, window/2) / sliceMinutes
+}
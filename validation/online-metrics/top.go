@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Families listed per metric by /api/v1/report/top by default, and at most
+const (
+	defaultTopFamilies = 20
+	maxTopFamilies     = 500
+)
+
+// Names of the temporal scores, which are over the per-minute rates and
+// series rather than a window
+const (
+	scoreTemporalCorr    = "temporal_correlation"
+	scoreBurstiness      = "burstiness"
+	scoreAutocorrelation = "autocorrelation"
+)
+
+// topMetricAliases are the short names /api/v1/report/top also accepts.
+var topMetricAliases = map[string]string{
+	"js":           scoreJSCategorical,
+	"cooccurrence": scoreCooccurrenceJS,
+	"ks":           scoreKSSize,
+	"histogram":    scoreHistogramWasserstein,
+	"temporal":     scoreTemporalCorr,
+}
+
+// TopFamily is one family's place in a metric's ranking.
+type TopFamily struct {
+	FamilyID   string  `json:"family_id"`
+	MetricName string  `json:"metric_name"`
+	Status     string  `json:"status"`
+	Score      float64 `json:"score"`
+	Threshold  float64 `json:"threshold"` // Red threshold; a minimum for temporal_correlation
+	Severity   float64 `json:"severity"`  // The score's divergence over the threshold's: red above 1
+
+	// Where the family diverges most on the metric: source, tag:<key>,
+	// pair:<key>,<key>, value:<quantile>, size:<quantile>,
+	// histogram:<quantile>, rate or lag:<n>
+	Dimension string `json:"dimension,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// TopReport ranks the scored families by each metric, most severe first.
+type TopReport struct {
+	Families  int                    `json:"families"` // Families scored at least once
+	Metrics   map[string][]TopFamily `json:"metrics"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// handleTopFamilies serves GET /api/v1/report/top?n=20&metric=js: the n
+// most divergent families by each metric, or by the one given, with the
+// dimension each diverges most on, to triage from one call.
+func (dm *DivergenceMonitor) handleTopFamilies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, metrics, err := dm.parseTopQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dm.topFamilies(metrics, n))
+}
+
+// parseTopQuery reads n and metric, resolving aliases.
+func (dm *DivergenceMonitor) parseTopQuery(r *http.Request) (int, []string, error) {
+	n := defaultTopFamilies
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxTopFamilies {
+			return 0, nil, fmt.Errorf("n must be between 1 and %d", maxTopFamilies)
+		}
+		n = parsed
+	}
+
+	metrics := dm.topMetrics()
+	metric := r.URL.Query().Get("metric")
+	if metric == "" {
+		return n, metrics, nil
+	}
+	if name, ok := topMetricAliases[metric]; ok {
+		metric = name
+	}
+	for _, name := range metrics {
+		if name == metric {
+			return n, []string{metric}, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("unknown metric %q (have %s)", metric, strings.Join(metrics, ", "))
+}
+
+// topMetrics are the scorers' names, then the temporal scores.
+func (dm *DivergenceMonitor) topMetrics() []string {
+	metrics := make([]string, 0, len(dm.scorers)+3)
+	for _, scorer := range dm.scorers {
+		metrics = append(metrics, scorer.Name())
+	}
+	return append(metrics, scoreTemporalCorr, scoreBurstiness, scoreAutocorrelation)
+}
+
+// topFamilies ranks the families by each metric. Dimensions are only
+// worked out for the families listed, so a large fleet costs one pass over
+// the latest scores.
+func (dm *DivergenceMonitor) topFamilies(metrics []string, n int) TopReport {
+	type candidate struct {
+		TopFamily
+		family *FamilyMonitor
+	}
+
+	dm.mu.RLock()
+	families := make([]*FamilyMonitor, 0, len(dm.families))
+	for _, family := range dm.families {
+		families = append(families, family)
+	}
+	dm.mu.RUnlock()
+
+	report := TopReport{Metrics: make(map[string][]TopFamily, len(metrics)), Timestamp: time.Now().UTC()}
+	ranked := make(map[string][]candidate, len(metrics))
+	for _, family := range families {
+		family.mu.RLock()
+		if family.DivergenceScores.LastCalculated.IsZero() {
+			family.mu.RUnlock()
+			continue
+		}
+		report.Families++
+		for _, metric := range metrics {
+			score, threshold, severity, ok := dm.familyScore(family, metric)
+			if !ok {
+				continue
+			}
+			ranked[metric] = append(ranked[metric], candidate{
+				TopFamily: TopFamily{
+					FamilyID:   family.FamilyID,
+					MetricName: family.MetricName,
+					Status:     family.Status,
+					Score:      score,
+					Threshold:  threshold,
+					Severity:   severity,
+				},
+				family: family,
+			})
+		}
+		family.mu.RUnlock()
+	}
+
+	summaries := make(map[*FamilyMonitor]*windowSummary)
+	for _, metric := range metrics {
+		candidates := ranked[metric]
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Severity != candidates[j].Severity {
+				return candidates[i].Severity > candidates[j].Severity
+			}
+			return candidates[i].FamilyID < candidates[j].FamilyID
+		})
+		if len(candidates) > n {
+			candidates = candidates[:n]
+		}
+
+		top := make([]TopFamily, len(candidates))
+		for i, c := range candidates {
+			current, ok := summaries[c.family]
+			if !ok {
+				current = c.family.CurrentWindow.Summary()
+				summaries[c.family] = current
+			}
+			c.family.mu.RLock()
+			c.Dimension, c.Detail = dm.dominantDimension(c.family, metric, current)
+			c.family.mu.RUnlock()
+			top[i] = c.TopFamily
+		}
+		report.Metrics[metric] = top
+	}
+	return report
+}
+
+// familyScore returns the family's latest score on a metric, its red
+// threshold, and how severe the score is: its distance from no divergence
+// over the threshold's. ok is false if the family has no such score. The
+// caller holds family.mu.
+func (dm *DivergenceMonitor) familyScore(family *FamilyMonitor, metric string) (score, threshold, severity float64, ok bool) {
+	scores := family.DivergenceScores
+	thresholds := family.Thresholds
+	switch metric {
+	case scoreTemporalCorr:
+		if scores.TemporalMinutes == 0 {
+			return 0, 0, 0, false
+		}
+		threshold = thresholds.TemporalCorrThreshold
+		return scores.TemporalCorr, threshold, (1 - scores.TemporalCorr) / math.Max(1-threshold, 1e-9), true
+	case scoreBurstiness:
+		if scores.BurstinessMinutes == 0 {
+			return 0, 0, 0, false
+		}
+		threshold = thresholds.BurstinessThreshold
+		return scores.BurstinessRatio, threshold, math.Abs(scores.BurstinessRatio-1) / threshold, true
+	case scoreAutocorrelation:
+		if scores.Autocorrelation == nil {
+			return 0, 0, 0, false
+		}
+		threshold = thresholds.AutocorrThreshold
+		return scores.AutocorrelationGap, threshold, scores.AutocorrelationGap / threshold, true
+	}
+
+	short := scores.Windows[windowShort]
+	if short == nil {
+		return 0, 0, 0, false
+	}
+	score, ok = short.score(metric)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	for _, scorer := range dm.scorers {
+		if scorer.Name() == metric {
+			threshold = scorer.Threshold(thresholds)
+			break
+		}
+	}
+	if threshold <= 0 {
+		return 0, 0, 0, false
+	}
+	return score, threshold, score / threshold, true
+}
+
+// dominantDimension names what the family diverges most on for a metric,
+// against the current window, as the drilldown would show it first. The
+// caller holds family.mu.
+func (dm *DivergenceMonitor) dominantDimension(family *FamilyMonitor, metric string, current *windowSummary) (dimension, detail string) {
+	scores := family.DivergenceScores
+	switch metric {
+	case scoreTemporalCorr:
+		return "rate", fmt.Sprintf("intensity curve correlation %.2f at a lag of %d minutes", scores.TemporalCorr, scores.TemporalLag)
+	case scoreBurstiness:
+		return "rate", fmt.Sprintf("burstiness %.2fx the reference's", scores.BurstinessRatio)
+	case scoreAutocorrelation:
+		return worstLag(family.ReferenceStats.Autocorrelation, scores.Autocorrelation)
+	case scoreCooccurrenceJS:
+		if len(family.PairDivergences) == 0 {
+			return "", ""
+		}
+		pair := family.PairDivergences[0]
+		return "pair:" + pair.Keys[0] + "," + pair.Keys[1], fmt.Sprintf("JS %.3f over %d samples", pair.JS, pair.Samples)
+	}
+
+	ref := family.ReferenceStats.slice(scores.ReferenceSlice)
+	if ref == nil {
+		return "", ""
+	}
+	switch metric {
+	case scoreJSCategorical:
+		return dm.worstCategorical(ref, current, true, true)
+	case scoreWasserstein:
+		return worstQuantile("value", quantileDeltas(ref.ValueQuantiles, current.Values))
+	case scoreHistogramWasserstein:
+		return worstQuantile("histogram", quantileDeltas(ref.HistogramQuantiles, current.HistogramValues))
+	case scoreKSSize:
+		return worstQuantile("size", quantileDeltas(ref.SizeQuantiles, current.Sizes))
+	}
+	for _, scorer := range dm.scorers {
+		configured, ok := scorer.(*configuredScorer)
+		if !ok || configured.Name() != metric {
+			continue
+		}
+		switch configured.config.Dimension {
+		case dimensionSources:
+			return dm.worstCategorical(ref, current, true, false)
+		case dimensionTags:
+			return dm.worstCategorical(ref, current, false, true)
+		default:
+			return worstQuantile("value", quantileDeltas(ref.ValueQuantiles, current.Values))
+		}
+	}
+	return "", ""
+}
+
+// worstCategorical finds the source or tag key whose distribution is
+// furthest from the reference, and its value furthest off.
+func (dm *DivergenceMonitor) worstCategorical(ref *ReferenceStatistics, current *windowSummary, sources, tags bool) (dimension, detail string) {
+	var worst *CategoricalBreakdown
+	consider := func(breakdown CategoricalBreakdown) {
+		if worst == nil || breakdown.JS > worst.JS || breakdown.JS == worst.JS && breakdown.Dimension < worst.Dimension {
+			worst = &breakdown
+		}
+	}
+	if sources && len(ref.SourceDistribution) > 0 {
+		consider(dm.categoricalBreakdown("source", ref.SourceDistribution, distribution(current.Sources)))
+	}
+	if tags {
+		for key, refDist := range ref.TagDistributions {
+			breakdown := dm.categoricalBreakdown(key, refDist, distribution(current.Tags[key]))
+			breakdown.Dimension = "tag:" + key
+			consider(breakdown)
+		}
+	}
+	if worst == nil {
+		return "", ""
+	}
+	detail = fmt.Sprintf("JS %.3f", worst.JS)
+	if len(worst.Values) > 0 {
+		value := worst.Values[0]
+		detail += fmt.Sprintf("; %q at %.1f%%, %.1f%% in the reference", value.Value, value.Observed*100, value.Reference*100)
+	}
+	return worst.Dimension, detail
+}
+
+// worstQuantile finds the quantile furthest from the reference's,
+// relatively where the reference is not 0.
+func worstQuantile(kind string, deltas []QuantileDelta) (dimension, detail string) {
+	worst, worstGap := -1, 0.0
+	for i, delta := range deltas {
+		gap := math.Abs(delta.Delta)
+		if delta.Relative != nil {
+			gap = math.Abs(*delta.Relative)
+		}
+		if worst < 0 || gap > worstGap {
+			worst, worstGap = i, gap
+		}
+	}
+	if worst < 0 {
+		return "", ""
+	}
+	delta := deltas[worst]
+	return kind + ":" + delta.Quantile, fmt.Sprintf("%s %.4g, %.4g in the reference", delta.Quantile, delta.Observed, delta.Reference)
+}
+
+// worstLag finds the lag whose autocorrelation is furthest from the
+// reference's.
+func worstLag(ref, observed map[int]float64) (dimension, detail string) {
+	worst, worstGap := 0, -1.0
+	for lag, value := range observed {
+		gap := math.Abs(value - ref[lag])
+		if gap > worstGap || gap == worstGap && lag < worst {
+			worst, worstGap = lag, gap
+		}
+	}
+	if worstGap < 0 {
+		return "", ""
+	}
+	return fmt.Sprintf("lag:%d", worst), fmt.Sprintf("autocorrelation %.2f, %.2f in the reference", observed[worst], ref[worst])
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// Verification reads whole datasets, so its windows never expire
+	verifyWindowSize = 100 * 365 * 24 * time.Hour
+
+	// Lines ingested per batch, and the longest line read
+	verifyBatchLines = 1000
+	verifyMaxLine    = 4 << 20
+
+	// Statuses of families verification could not score
+	verifyMissing      = "missing"      // Captured, but never generated
+	verifyInsufficient = "insufficient" // Generated, but too rarely to score
+)
+
+// VerifyConfig is a one-shot comparison of a generated dataset with a
+// captured one, both gs://bucket/prefix or local directories of .wf,
+// .wf.zst or .wf.gz line files.
+type VerifyConfig struct {
+	CapturedPath  string
+	GeneratedPath string
+	OutputPath    string // "-" writes to stdout
+	MaxLines      int    // Per dataset; 0 reads everything
+	FailOn        string // red, amber or none
+}
+
+// VerifyResult is the report verification writes.
+type VerifyResult struct {
+	Captured       string               `json:"captured"`
+	Generated      string               `json:"generated"`
+	CapturedLines  int                  `json:"captured_lines"`
+	GeneratedLines int                  `json:"generated_lines"`
+	Unparsed       int                  `json:"unparsed"`       // Lines of either dataset
+	UnknownFamily  int                  `json:"unknown_family"` // Generated lines of metrics never captured
+	Statuses       map[string]int       `json:"statuses"`       // Families by status
+	Families       []FamilyVerification `json:"families"`       // Worst first
+}
+
+// FamilyVerification is one captured family's divergence, scored with the
+// captured dataset as its reference.
+type FamilyVerification struct {
+	FamilyID         string             `json:"family_id"`
+	MetricName       string             `json:"metric_name"`
+	Status           string             `json:"status"` // green, amber, red, missing or insufficient
+	CapturedSamples  int                `json:"captured_samples"`
+	GeneratedSamples int                `json:"generated_samples"`
+	Divergence       *DivergenceScores  `json:"divergence,omitempty"`
+	TopDimensions    []DimensionSummary `json:"top_dimensions,omitempty"`
+	Schema           []KeyPresence      `json:"schema,omitempty"`
+}
+
+// Verify scores a generated dataset against a captured one without live
+// traffic: each captured family's lines become its reference, the
+// generated lines are ingested as the monitor would ingest them, and every
+// family is scored once. The temporal scores need minutes of traffic and
+// are left out. It returns whether the result passes config.FailOn.
+func (dm *DivergenceMonitor) Verify(ctx context.Context, config VerifyConfig) (bool, error) {
+	result := &VerifyResult{
+		Captured:  config.CapturedPath,
+		Generated: config.GeneratedPath,
+		Statuses:  make(map[string]int),
+	}
+	started := time.Now()
+	if dm.reporter == nil {
+		dm.reporter = NewDivergenceReporter("")
+	}
+
+	// The captured lines make up each family's reference
+	captured := make(map[string]int)
+	sequences := make(map[string]*seriesSequences)
+	lines, err := readDataset(ctx, config.CapturedPath, config.MaxLines, func(batch []string) {
+		for _, line := range batch {
+			id, sample, err := sampleLine(line)
+			if err == errSpanLine {
+				continue
+			}
+			if err != nil {
+				result.Unparsed++
+				continue
+			}
+			family, exists := dm.families[id]
+			if !exists {
+				family = newVerifyFamily(id, sample)
+				dm.families[id] = family
+			}
+			sample.Timestamp = started
+			family.CapturedWindow.AddSample(sample)
+			captured[id]++
+			if sequences[id] == nil {
+				sequences[id] = newSeriesSequences()
+			}
+			sequences[id].Add(sample, started)
+		}
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read captured dataset: %w", err)
+	}
+	result.CapturedLines = lines
+	for _, family := range dm.families {
+		stats := summaryReference(family.CapturedWindow.Summary())
+		if acf, pairs := sequences[family.FamilyID].autocorrelation(autocorrLags, started); pairs >= autocorrMinPairs {
+			stats.Autocorrelation = make(map[int]float64, len(autocorrLags))
+			for i, lag := range autocorrLags {
+				stats.Autocorrelation[lag] = acf[i]
+			}
+		}
+		family.RecipeStats = stats
+		family.ReferenceStats = stats
+		family.ReferenceVersion = config.CapturedPath
+		pairs := trackedPairs(stats.TagCooccurrence)
+		family.CurrentWindow.TrackPairs(pairs)
+		family.MediumWindow.TrackPairs(pairs)
+		family.LongWindow.TrackPairs(pairs)
+		dm.indexFamily(family, family.MetricName)
+	}
+	log.Printf("Read %d captured lines of %d families from %s", lines, len(dm.families), config.CapturedPath)
+
+	// The generated lines are scored against them
+	lines, err = readDataset(ctx, config.GeneratedPath, config.MaxLines, func(batch []string) {
+		counts := dm.IngestLines(originGenerated, "", started, batch)
+		result.Unparsed += counts.Unparsed
+		result.UnknownFamily += counts.UnknownFamily
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read generated dataset: %w", err)
+	}
+	result.GeneratedLines = lines
+	log.Printf("Read %d generated lines from %s", lines, config.GeneratedPath)
+
+	dm.computeAllDivergences()
+	dimensions := make(map[string][]DimensionSummary)
+	for _, report := range dm.reporter.Current() {
+		dimensions[report.FamilyID] = report.TopDimensions
+	}
+	for id, family := range dm.families {
+		verification := FamilyVerification{
+			FamilyID:         id,
+			MetricName:       family.MetricName,
+			Status:           family.Status,
+			CapturedSamples:  captured[id],
+			GeneratedSamples: family.CurrentWindow.Count(),
+		}
+		switch {
+		case verification.GeneratedSamples == 0:
+			verification.Status = verifyMissing
+		case family.DivergenceScores.LastCalculated.IsZero():
+			verification.Status = verifyInsufficient
+		default:
+			verification.Divergence = family.DivergenceScores
+			verification.TopDimensions = dimensions[id]
+			verification.Schema = family.SchemaKeys
+		}
+		result.Statuses[verification.Status]++
+		result.Families = append(result.Families, verification)
+	}
+	rank := map[string]int{"red": 0, verifyMissing: 1, "amber": 2, verifyInsufficient: 3, "green": 4}
+	sort.Slice(result.Families, func(i, j int) bool {
+		a, b := result.Families[i], result.Families[j]
+		if rank[a.Status] != rank[b.Status] {
+			return rank[a.Status] < rank[b.Status]
+		}
+		return a.FamilyID < b.FamilyID
+	})
+
+	if err := writeVerifyResult(config.OutputPath, result); err != nil {
+		return false, err
+	}
+	log.Printf("Verified %d families: %d red, %d missing, %d amber, %d insufficient, %d green; %d generated lines of unknown families",
+		len(result.Families), result.Statuses["red"], result.Statuses[verifyMissing], result.Statuses["amber"],
+		result.Statuses[verifyInsufficient], result.Statuses["green"], result.UnknownFamily)
+
+	switch config.FailOn {
+	case "red":
+		return result.Statuses["red"]+result.Statuses[verifyMissing] == 0, nil
+	case "amber":
+		return result.Statuses["red"]+result.Statuses[verifyMissing]+result.Statuses["amber"] == 0, nil
+	}
+	return true, nil
+}
+
+// newVerifyFamily creates a family for verification from its first
+// captured sample, counting the joint values of every pair of its tag keys.
+func newVerifyFamily(id string, sample Sample) *FamilyMonitor {
+	family := &FamilyMonitor{
+		FamilyID:         id,
+		MetricName:       sample.Metric,
+		CurrentWindow:    NewSlidingWindow(verifyWindowSize),
+		MediumWindow:     NewSlidingWindow(verifyWindowSize),
+		LongWindow:       NewSlidingWindow(verifyWindowSize),
+		CapturedWindow:   NewSlidingWindow(verifyWindowSize),
+		Rates:            newMinuteRates(),
+		DivergenceScores: &DivergenceScores{},
+		Status:           "green",
+	}
+	keys := make([]string, 0, len(sample.Tags))
+	for key := range sample.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []tagPair
+	for i := range keys {
+		for j := i + 1; j < len(keys) && len(pairs) < maxTrackedPairs; j++ {
+			pairs = append(pairs, newTagPair(keys[i], keys[j]))
+		}
+	}
+	family.CapturedWindow.TrackPairs(pairs)
+	return family
+}
+
+// summaryReference turns a window of captured lines into the reference
+// statistics a recipe would give. Families with histogram lines are
+// compared on their centroids, as recipes of histogram families are.
+func summaryReference(summary *windowSummary) *ReferenceStatistics {
+	stats := &ReferenceStatistics{
+		SourceDistribution: distribution(summary.Sources),
+		TagDistributions:   make(map[string]map[string]float64, len(summary.Tags)),
+		TagCooccurrence:    make(map[tagPair]map[string]float64, len(summary.Pairs)),
+		SizeQuantiles:      digestQuantiles(summary.Sizes),
+		SampleCount:        float64(summary.Count),
+		MetricClass:        metricClassGauge,
+		SourceCardinality:  summary.DistinctSources.Estimate(),
+		SeriesCardinality:  summary.DistinctSeries.Estimate(),
+		TagCardinalities:   make(map[string]float64, len(summary.DistinctTags)),
+		TagPresence:        make(map[string]float64, len(summary.Tags)),
+	}
+	if summary.HistogramValues.Count() > 0 {
+		stats.MetricClass = metricClassHistogram
+		stats.HistogramQuantiles = digestQuantiles(summary.HistogramValues)
+		stats.HistogramCounts = make(map[string]float64, len(summary.HistogramCounts))
+		for granularity, counts := range summary.HistogramCounts {
+			stats.HistogramCounts[granularity] = counts.Observations / float64(counts.Lines)
+		}
+	} else {
+		stats.ValueQuantiles = digestQuantiles(summary.Values)
+	}
+	for key, counts := range summary.Tags {
+		stats.TagDistributions[key] = distribution(counts)
+		present := 0
+		for _, count := range counts {
+			present += count
+		}
+		stats.TagPresence[key] = float64(present) / float64(summary.Count)
+	}
+	for key, distinct := range summary.DistinctTags {
+		stats.TagCardinalities[key] = distinct.Estimate()
+	}
+	for pair, counts := range summary.Pairs {
+		stats.TagCooccurrence[pair] = distribution(counts)
+	}
+	return stats
+}
+
+// digestQuantiles returns the digest's quantiles at referenceLevels.
+func digestQuantiles(digest *tdigest) []float64 {
+	quantiles := make([]float64, len(referenceLevels))
+	for i, level := range referenceLevels {
+		quantiles[i] = digest.Quantile(level)
+	}
+	return quantiles
+}
+
+func writeVerifyResult(output string, result *VerifyResult) error {
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// readDataset calls fn with batches of the dataset's lines, object by
+// object, until maxLines were read, and returns how many were.
+func readDataset(ctx context.Context, dataset string, maxLines int, fn func([]string)) (int, error) {
+	bucket, prefix := parseReferencePath(dataset)
+	var names []string
+	var client *storage.Client
+	if bucket == "" {
+		err := filepath.WalkDir(prefix, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && datasetCompression(path) != "" {
+				names = append(names, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		var err error
+		client, err = storage.NewClient(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		defer client.Close()
+		it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			if datasetCompression(attrs.Name) != "" {
+				names = append(names, attrs.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return 0, fmt.Errorf("no .wf, .wf.zst or .wf.gz objects under %s", dataset)
+	}
+	sort.Strings(names)
+
+	total := 0
+	for _, name := range names {
+		var reader io.ReadCloser
+		if client == nil {
+			file, err := os.Open(name)
+			if err != nil {
+				return total, err
+			}
+			reader = file
+		} else {
+			object, err := client.Bucket(bucket).Object(name).NewReader(ctx)
+			if err != nil {
+				return total, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			reader = object
+		}
+		n, err := readLines(reader, datasetCompression(name), maxLines-total, maxLines > 0, fn)
+		reader.Close()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if maxLines > 0 && total >= maxLines {
+			break
+		}
+	}
+	return total, nil
+}
+
+// datasetCompression returns how an object of line files is compressed:
+// none, zstd or gzip, or "" for objects that are not line files.
+func datasetCompression(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".wf"):
+		return "none"
+	case strings.HasSuffix(name, ".wf.zst"):
+		return "zstd"
+	case strings.HasSuffix(name, ".wf.gz"):
+		return "gzip"
+	}
+	return ""
+}
+
+// readLines decompresses a line file and calls fn with its lines in
+// batches, reading at most limit lines if limited. Objects compressed
+// with a trained zstd dictionary cannot be read.
+func readLines(reader io.Reader, compression string, limit int, limited bool, fn func([]string)) (int, error) {
+	switch compression {
+	case "zstd":
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	case "gzip":
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), verifyMaxLine)
+	batch := make([]string, 0, verifyBatchLines)
+	read := 0
+	for scanner.Scan() && (!limited || read < limit) {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		batch = append(batch, line)
+		read++
+		if len(batch) == verifyBatchLines {
+			fn(batch)
+			batch = make([]string, 0, verifyBatchLines)
+		}
+	}
+	if len(batch) > 0 {
+		fn(batch)
+	}
+	return read, scanner.Err()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// windowBuckets is how many buckets a window is split into by default;
+// the oldest bucket expires as a whole, so the window decays in steps of
+// WindowSize/windowBuckets.
+const windowBuckets = 5
+
+// Window sizes each family is scored over (see multiwindow.go). The longer
+// windows decay in 5 minute and 1 hour steps.
+const (
+	shortWindowSize     = 5 * time.Minute
+	mediumWindowSize    = time.Hour
+	mediumWindowBuckets = 12
+	longWindowSize      = 24 * time.Hour
+	longWindowBuckets   = 24
+)
+
+// SlidingWindow summarises the samples of a family over a sliding window:
+// t-digests of values and line sizes, counts of sources, tag values and the
+// joint values of tracked tag-key pairs, the merged centroids and counts of
+// histogram lines, and HyperLogLog sketches of distinct sources, tag values
+// and series.
+type SlidingWindow struct {
+	WindowSize time.Duration
+	bucketSize time.Duration
+	buckets    []*windowBucket // oldest first
+	pairs      []tagPair
+	mu         sync.Mutex
+}
+
+type windowBucket struct {
+	start   time.Time
+	count   int
+	values  *tdigest
+	sizes   *tdigest
+	sources map[string]int
+	tags    map[string]map[string]int
+	pairs   map[tagPair]map[string]int
+
+	histValues *tdigest
+	histCounts map[string]*histogramCounts // by granularity
+
+	schemaVariants int
+
+	distinctSources *hll
+	distinctSeries  *hll
+	distinctTags    map[string]*hll
+}
+
+// windowSummary merges the live buckets of a window.
+type windowSummary struct {
+	Count   int
+	Values  *tdigest
+	Sizes   *tdigest
+	Sources map[string]int
+	Tags    map[string]map[string]int
+	Pairs   map[tagPair]map[string]int // by jointValue
+
+	HistogramValues *tdigest
+	HistogramCounts map[string]*histogramCounts // by granularity
+
+	SchemaVariants int // Lines whose tag keys differ from the family's
+
+	DistinctSources *hll
+	DistinctSeries  *hll
+	DistinctTags    map[string]*hll
+}
+
+func NewSlidingWindow(duration time.Duration) *SlidingWindow {
+	return NewSlidingWindowBuckets(duration, windowBuckets)
+}
+
+func NewSlidingWindowBuckets(duration time.Duration, buckets int) *SlidingWindow {
+	return &SlidingWindow{
+		WindowSize: duration,
+		bucketSize: duration / time.Duration(buckets),
+	}
+}
+
+// TrackPairs sets the tag-key pairs whose joint values are counted from now
+// on.
+func (sw *SlidingWindow) TrackPairs(pairs []tagPair) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.pairs = pairs
+}
+
+func (sw *SlidingWindow) AddSample(sample Sample) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.expire(time.Now())
+	var bucket *windowBucket
+	if n := len(sw.buckets); n > 0 && sample.Timestamp.Before(sw.buckets[n-1].start.Add(sw.bucketSize)) {
+		bucket = sw.buckets[n-1]
+	} else {
+		bucket = &windowBucket{
+			start:   sample.Timestamp.Truncate(sw.bucketSize),
+			values:  newTDigest(),
+			sizes:   newTDigest(),
+			sources: make(map[string]int),
+			tags:    make(map[string]map[string]int),
+			pairs:   make(map[tagPair]map[string]int),
+
+			histValues: newTDigest(),
+			histCounts: make(map[string]*histogramCounts),
+
+			distinctSources: newHLL(),
+			distinctSeries:  newHLL(),
+			distinctTags:    make(map[string]*hll),
+		}
+		sw.buckets = append(sw.buckets, bucket)
+	}
+
+	bucket.count++
+	if sample.SchemaVariant {
+		bucket.schemaVariants++
+	}
+	bucket.values.Add(sample.Value)
+	bucket.sizes.Add(float64(sample.LineSize))
+	bucket.sources[sample.Source]++
+	for key, value := range sample.Tags {
+		values, ok := bucket.tags[key]
+		if !ok {
+			values = make(map[string]int)
+			bucket.tags[key] = values
+		}
+		values[value]++
+
+		distinct, ok := bucket.distinctTags[key]
+		if !ok {
+			distinct = newHLL()
+			bucket.distinctTags[key] = distinct
+		}
+		distinct.Add(value)
+	}
+	for _, pair := range sw.pairs {
+		first, ok := sample.Tags[pair.First]
+		if !ok {
+			continue
+		}
+		second, ok := sample.Tags[pair.Second]
+		if !ok {
+			continue
+		}
+		joint, ok := bucket.pairs[pair]
+		if !ok {
+			joint = make(map[string]int)
+			bucket.pairs[pair] = joint
+		}
+		joint[jointValue(first, second)]++
+	}
+	if len(sample.Centroids) > 0 {
+		counts, ok := bucket.histCounts[sample.Granularity]
+		if !ok {
+			counts = &histogramCounts{}
+			bucket.histCounts[sample.Granularity] = counts
+		}
+		counts.Lines++
+		for _, c := range sample.Centroids {
+			bucket.histValues.add(c)
+			counts.Observations += c.weight
+		}
+	}
+	bucket.distinctSources.Add(sample.Source)
+	bucket.distinctSeries.Add(sample.Source + " " + tagsKey(sample.Tags))
+}
+
+// expire drops the buckets that ended before the window.
+func (sw *SlidingWindow) expire(now time.Time) {
+	cutoff := now.Add(-sw.WindowSize)
+	expired := 0
+	for expired < len(sw.buckets) && !sw.buckets[expired].start.Add(sw.bucketSize).After(cutoff) {
+		expired++
+	}
+	sw.buckets = sw.buckets[expired:]
+}
+
+// Count is the number of samples in the window.
+func (sw *SlidingWindow) Count() int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.expire(time.Now())
+	count := 0
+	for _, bucket := range sw.buckets {
+		count += bucket.count
+	}
+	return count
+}
+
+// Summary merges the window's buckets.
+func (sw *SlidingWindow) Summary() *windowSummary {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.expire(time.Now())
+	summary := &windowSummary{
+		Values:  newTDigest(),
+		Sizes:   newTDigest(),
+		Sources: make(map[string]int),
+		Tags:    make(map[string]map[string]int),
+		Pairs:   make(map[tagPair]map[string]int),
+
+		HistogramValues: newTDigest(),
+		HistogramCounts: make(map[string]*histogramCounts),
+
+		DistinctSources: newHLL(),
+		DistinctSeries:  newHLL(),
+		DistinctTags:    make(map[string]*hll),
+	}
+	for _, bucket := range sw.buckets {
+		summary.Count += bucket.count
+		summary.SchemaVariants += bucket.schemaVariants
+		summary.Values.Merge(bucket.values)
+		summary.Sizes.Merge(bucket.sizes)
+		for source, count := range bucket.sources {
+			summary.Sources[source] += count
+		}
+		for key, counts := range bucket.tags {
+			values, ok := summary.Tags[key]
+			if !ok {
+				values = make(map[string]int)
+				summary.Tags[key] = values
+			}
+			for value, count := range counts {
+				values[value] += count
+			}
+		}
+		for pair, counts := range bucket.pairs {
+			joint, ok := summary.Pairs[pair]
+			if !ok {
+				joint = make(map[string]int)
+				summary.Pairs[pair] = joint
+			}
+			for value, count := range counts {
+				joint[value] += count
+			}
+		}
+		summary.HistogramValues.Merge(bucket.histValues)
+		for granularity, counts := range bucket.histCounts {
+			merged, ok := summary.HistogramCounts[granularity]
+			if !ok {
+				merged = &histogramCounts{}
+				summary.HistogramCounts[granularity] = merged
+			}
+			merged.Lines += counts.Lines
+			merged.Observations += counts.Observations
+		}
+		summary.DistinctSources.Merge(bucket.distinctSources)
+		summary.DistinctSeries.Merge(bucket.distinctSeries)
+		for key, distinct := range bucket.distinctTags {
+			merged, ok := summary.DistinctTags[key]
+			if !ok {
+				merged = newHLL()
+				summary.DistinctTags[key] = merged
+			}
+			merged.Merge(distinct)
+		}
+	}
+	return summary
+}
+
+// distribution normalises counts into frequencies.
+func distribution(counts map[string]int) map[string]float64 {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	dist := make(map[string]float64, len(counts))
+	for value, count := range counts {
+		dist[value] = float64(count) / float64(total)
+	}
+	return dist
+}
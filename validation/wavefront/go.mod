@@ -0,0 +1,3 @@
+module github.com/loadgen/wavefront
+
+go 1.21
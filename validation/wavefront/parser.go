@@ -0,0 +1,401 @@
+// Package wavefront parses the Wavefront line protocol: metrics, histograms
+// and spans, with the proxy's quoting and escaping rules.
+package wavefront
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type is the kind of data a line carries.
+type Type string
+
+const (
+	TypeMetric    Type = "metric"
+	TypeHistogram Type = "histogram"
+	TypeSpan      Type = "span"
+)
+
+// Line is one parsed line; exactly one of Metric, Histogram and Span is set.
+type Line struct {
+	Type      Type
+	Metric    *Metric
+	Histogram *Histogram
+	Span      *Span
+
+	// Size is the length of the raw line in bytes
+	Size int
+}
+
+// Metric is a point: <metric> <value> [<timestamp>] source=<source> [tags]
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp time.Time // zero when the line has none
+	Source    string
+	Tags      map[string]string
+
+	// Delta counters are prefixed with ∆ (or Δ) on the wire; Name has the
+	// prefix removed
+	Delta bool
+}
+
+// Centroid is one bin of a histogram distribution.
+type Centroid struct {
+	Count int
+	Value float64
+}
+
+// Histogram is a distribution:
+// !<M|H|D> [<timestamp>] #<count> <mean> [#<count> <mean> ...] <metric> source=<source> [tags]
+type Histogram struct {
+	Granularity string // M, H or D: minute, hour or day
+	Timestamp   time.Time
+	Centroids   []Centroid
+	Name        string
+	Source      string
+	Tags        map[string]string
+}
+
+// Count is the number of values the histogram summarises.
+func (h *Histogram) Count() int {
+	count := 0
+	for _, centroid := range h.Centroids {
+		count += centroid.Count
+	}
+	return count
+}
+
+// Mean is the mean of the histogram's values.
+func (h *Histogram) Mean() float64 {
+	count, sum := 0, 0.0
+	for _, centroid := range h.Centroids {
+		count += centroid.Count
+		sum += float64(centroid.Count) * centroid.Value
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// Span is a trace span:
+// <operation> source=<source> traceId=<id> spanId=<id> [tags] <start_ms> <duration_ms>
+type Span struct {
+	Operation string
+	Source    string
+	TraceID   string
+	SpanID    string
+	Tags      map[string]string
+	Start     time.Time
+	Duration  time.Duration
+}
+
+// field is one whitespace-separated element of a line: a bare or quoted
+// word, or a key=value pair.
+type field struct {
+	key    string
+	value  string
+	hasKey bool
+	quoted bool
+}
+
+// Parse parses one line. Comments and blank lines are errors; callers
+// skip them beforehand.
+func Parse(line string) (*Line, error) {
+	fields, err := splitFields(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty line")
+	}
+
+	first := fields[0]
+	switch {
+	case !first.hasKey && !first.quoted && strings.HasPrefix(first.value, "!"):
+		histogram, err := parseHistogram(fields)
+		if err != nil {
+			return nil, err
+		}
+		return &Line{Type: TypeHistogram, Histogram: histogram, Size: len(line)}, nil
+	case len(fields) > 1 && fields[1].hasKey:
+		span, err := parseSpan(fields)
+		if err != nil {
+			return nil, err
+		}
+		return &Line{Type: TypeSpan, Span: span, Size: len(line)}, nil
+	default:
+		metric, err := parseMetric(fields)
+		if err != nil {
+			return nil, err
+		}
+		return &Line{Type: TypeMetric, Metric: metric, Size: len(line)}, nil
+	}
+}
+
+func parseMetric(fields []field) (*Metric, error) {
+	name, err := metricName(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	metric := &Metric{Name: name}
+	for _, prefix := range []string{"∆", "Δ"} {
+		if trimmed, ok := strings.CutPrefix(metric.Name, prefix); ok {
+			metric.Name, metric.Delta = trimmed, true
+			break
+		}
+	}
+	if metric.Name == "" {
+		return nil, errors.New("empty metric name")
+	}
+
+	if len(fields) < 2 || fields[1].hasKey || fields[1].quoted {
+		return nil, fmt.Errorf("metric %s has no value", metric.Name)
+	}
+	if metric.Value, err = parseValue(fields[1].value); err != nil {
+		return nil, err
+	}
+
+	rest := fields[2:]
+	if len(rest) > 0 && !rest[0].hasKey && !rest[0].quoted {
+		if metric.Timestamp, err = parseTimestamp(rest[0].value); err != nil {
+			return nil, err
+		}
+		rest = rest[1:]
+	}
+	if metric.Source, metric.Tags, err = parseTags(rest); err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+func parseHistogram(fields []field) (*Histogram, error) {
+	histogram := &Histogram{Granularity: strings.TrimPrefix(fields[0].value, "!")}
+	switch histogram.Granularity {
+	case "M", "H", "D":
+	default:
+		return nil, fmt.Errorf("invalid histogram granularity %q", fields[0].value)
+	}
+
+	rest := fields[1:]
+	if len(rest) > 0 && !rest[0].hasKey && !rest[0].quoted && !strings.HasPrefix(rest[0].value, "#") {
+		timestamp, err := parseTimestamp(rest[0].value)
+		if err != nil {
+			return nil, err
+		}
+		histogram.Timestamp = timestamp
+		rest = rest[1:]
+	}
+
+	for len(rest) > 0 && !rest[0].hasKey && !rest[0].quoted && strings.HasPrefix(rest[0].value, "#") {
+		count, err := strconv.Atoi(strings.TrimPrefix(rest[0].value, "#"))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid centroid count %q", rest[0].value)
+		}
+		if len(rest) < 2 || rest[1].hasKey || rest[1].quoted {
+			return nil, fmt.Errorf("centroid %q has no mean", rest[0].value)
+		}
+		value, err := parseValue(rest[1].value)
+		if err != nil {
+			return nil, err
+		}
+		histogram.Centroids = append(histogram.Centroids, Centroid{Count: count, Value: value})
+		rest = rest[2:]
+	}
+	if len(histogram.Centroids) == 0 {
+		return nil, errors.New("histogram has no centroids")
+	}
+
+	if len(rest) == 0 || rest[0].hasKey {
+		return nil, errors.New("histogram has no metric name")
+	}
+	name, err := metricName(rest[0])
+	if err != nil {
+		return nil, err
+	}
+	histogram.Name = name
+	if histogram.Source, histogram.Tags, err = parseTags(rest[1:]); err != nil {
+		return nil, err
+	}
+	return histogram, nil
+}
+
+func parseSpan(fields []field) (*Span, error) {
+	if fields[0].hasKey {
+		return nil, errors.New("span has no operation name")
+	}
+	span := &Span{Operation: fields[0].value}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("span %s has no start and duration", span.Operation)
+	}
+
+	last := len(fields) - 2
+	start, duration := fields[last], fields[last+1]
+	if start.hasKey || start.quoted || duration.hasKey || duration.quoted {
+		return nil, fmt.Errorf("span %s has no start and duration", span.Operation)
+	}
+	startMs, err := strconv.ParseInt(start.value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid span start %q", start.value)
+	}
+	durationMs, err := strconv.ParseInt(duration.value, 10, 64)
+	if err != nil || durationMs < 0 {
+		return nil, fmt.Errorf("invalid span duration %q", duration.value)
+	}
+	span.Start = time.UnixMilli(startMs)
+	span.Duration = time.Duration(durationMs) * time.Millisecond
+
+	if span.Source, span.Tags, err = parseTags(fields[1:last]); err != nil {
+		return nil, err
+	}
+	span.TraceID, span.SpanID = span.Tags["traceId"], span.Tags["spanId"]
+	if span.TraceID == "" || span.SpanID == "" {
+		return nil, fmt.Errorf("span %s needs traceId and spanId", span.Operation)
+	}
+	delete(span.Tags, "traceId")
+	delete(span.Tags, "spanId")
+	return span, nil
+}
+
+func metricName(f field) (string, error) {
+	if f.hasKey || f.value == "" {
+		return "", errors.New("missing metric name")
+	}
+	return f.value, nil
+}
+
+// parseTags reads key=value pairs; source (or its alias host) is required.
+// A repeated key keeps its last value.
+func parseTags(fields []field) (string, map[string]string, error) {
+	var source string
+	tags := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if !f.hasKey {
+			return "", nil, fmt.Errorf("unexpected %q, expected a tag", f.value)
+		}
+		if f.key == "" {
+			return "", nil, errors.New("empty tag key")
+		}
+		switch f.key {
+		case "source", "host":
+			source = f.value
+		default:
+			tags[f.key] = f.value
+		}
+	}
+	if source == "" {
+		return "", nil, errors.New("missing source")
+	}
+	return source, tags, nil
+}
+
+func parseValue(s string) (float64, error) {
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return value, nil
+}
+
+// parseTimestamp reads an epoch timestamp in seconds, milliseconds,
+// microseconds or nanoseconds, told apart by magnitude like the proxy does.
+func parseTimestamp(s string) (time.Time, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ts < 0 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	switch {
+	case ts < 1e11:
+		return time.Unix(ts, 0), nil
+	case ts < 1e14:
+		return time.UnixMilli(ts), nil
+	case ts < 1e17:
+		return time.UnixMicro(ts), nil
+	default:
+		return time.Unix(0, ts), nil
+	}
+}
+
+// splitFields splits a line on whitespace outside quotes. Words and tag
+// keys and values may be double-quoted, with \" and \\ escaped inside.
+func splitFields(line string) ([]field, error) {
+	var fields []field
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return fields, nil
+		}
+
+		var f field
+		word, quoted, next, err := readWord(line, i, true)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+		if i < len(line) && line[i] == '=' {
+			f.key, f.hasKey = word, true
+			if f.value, f.quoted, i, err = readWord(line, i+1, false); err != nil {
+				return nil, err
+			}
+		} else {
+			f.value, f.quoted = word, quoted
+		}
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, fmt.Errorf("unexpected %q at offset %d", line[i], i)
+		}
+		fields = append(fields, f)
+	}
+}
+
+// readWord reads a quoted or bare word at i and returns the offset after
+// it. A bare key stops at '='; a bare value may contain it.
+func readWord(line string, i int, key bool) (string, bool, int, error) {
+	if i < len(line) && line[i] == '"' {
+		var b strings.Builder
+		for j := i + 1; j < len(line); j++ {
+			switch c := line[j]; {
+			case c == '\\' && j+1 < len(line) && (line[j+1] == '"' || line[j+1] == '\\'):
+				b.WriteByte(line[j+1])
+				j++
+			case c == '"':
+				return b.String(), true, j + 1, nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", false, 0, fmt.Errorf("unterminated quote at offset %d", i)
+	}
+
+	start := i
+	for i < len(line) && !isSpace(line[i]) && !(key && line[i] == '=') && line[i] != '"' {
+		i++
+	}
+	return line[start:i], false, i, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// FamilyID is the ID the profiler gives a metric family: the SHA-1 of the
+// metric name and its sorted tag keys.
+func FamilyID(metric string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sum := sha1.Sum([]byte(metric + "|" + strings.Join(keys, ",")))
+	return hex.EncodeToString(sum[:])
+}
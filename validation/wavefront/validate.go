@@ -0,0 +1,149 @@
+package wavefront
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of the data format, in characters.
+const (
+	MaxMetricNameLength = 256
+	MaxSourceLength     = 128
+	MaxTagLength        = 254 // Key and value together, without the '='
+)
+
+// Validate checks a line against the Wavefront data format as the proxy
+// enforces it, beyond what Parse needs to read it: name and tag key
+// characters, length limits, control characters, and the tags spans
+// require. It returns the parsed line, or the first rule the line breaks.
+func Validate(line string) (*Line, error) {
+	for i, r := range line {
+		if unicode.IsControl(r) && r != '\t' {
+			return nil, fmt.Errorf("control character %q at offset %d", r, i)
+		}
+	}
+	if !utf8.ValidString(line) {
+		return nil, errors.New("invalid UTF-8")
+	}
+
+	parsed, err := Parse(line)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse drops the quoting, which decides the characters a name may have
+	fields, _ := splitFields(line)
+	switch parsed.Type {
+	case TypeMetric:
+		m := parsed.Metric
+		if err := validateMetricName(m.Name, fields[0].quoted); err != nil {
+			return nil, err
+		}
+		return parsed, validateTags(m.Source, m.Tags)
+	case TypeHistogram:
+		h := parsed.Histogram
+		// The name follows the granularity, timestamp and centroid pairs
+		at := 1 + 2*len(h.Centroids)
+		if !h.Timestamp.IsZero() {
+			at++
+		}
+		if err := validateMetricName(h.Name, fields[at].quoted); err != nil {
+			return nil, err
+		}
+		return parsed, validateTags(h.Source, h.Tags)
+	default:
+		return parsed, validateSpan(parsed.Span)
+	}
+}
+
+// validateMetricName allows letters, digits, '-', '_' and '.', a leading
+// '~' for internal metrics, and '/' and ',' when quoted. Delta prefixes are
+// removed by Parse.
+func validateMetricName(name string, quoted bool) error {
+	if utf8.RuneCountInString(name) > MaxMetricNameLength {
+		return fmt.Errorf("metric name longer than %d characters", MaxMetricNameLength)
+	}
+	for i, r := range name {
+		switch {
+		case isNameRune(r):
+		case r == '~' && i == 0:
+		case (r == '/' || r == ',') && quoted:
+		default:
+			return fmt.Errorf("invalid character %q in metric name %q", r, name)
+		}
+	}
+	return nil
+}
+
+// validateTags checks the source and tags: keys of letters, digits, '-',
+// '_' and '.', and the length limits.
+func validateTags(source string, tags map[string]string) error {
+	if n := utf8.RuneCountInString(source); n > MaxSourceLength {
+		return fmt.Errorf("source longer than %d characters", MaxSourceLength)
+	}
+	for key, value := range tags {
+		for _, r := range key {
+			if !isNameRune(r) {
+				return fmt.Errorf("invalid character %q in tag key %q", r, key)
+			}
+		}
+		if value == "" {
+			return fmt.Errorf("empty value for tag %q", key)
+		}
+		if utf8.RuneCountInString(key)+utf8.RuneCountInString(value) > MaxTagLength {
+			return fmt.Errorf("tag %q longer than %d characters with its value", key, MaxTagLength)
+		}
+	}
+	return nil
+}
+
+// validateSpan checks a span's IDs are UUIDs, as are its parents', and
+// that it carries the application and service tags.
+func validateSpan(span *Span) error {
+	if span.Operation == "" {
+		return errors.New("empty span operation")
+	}
+	if !isUUID(span.TraceID) {
+		return fmt.Errorf("traceId %q is not a UUID", span.TraceID)
+	}
+	if !isUUID(span.SpanID) {
+		return fmt.Errorf("spanId %q is not a UUID", span.SpanID)
+	}
+	for _, key := range []string{"parent", "followsFrom"} {
+		if id, ok := span.Tags[key]; ok && !isUUID(id) {
+			return fmt.Errorf("%s %q is not a UUID", key, id)
+		}
+	}
+	for _, key := range []string{"application", "service"} {
+		if span.Tags[key] == "" {
+			return fmt.Errorf("span %s has no %s tag", span.Operation, key)
+		}
+	}
+	return validateTags(span.Source, span.Tags)
+}
+
+func isNameRune(r rune) bool {
+	return r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '-' || r == '_' || r == '.')
+}
+
+// isUUID reports whether s is 8-4-4-4-12 hexadecimal digits.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
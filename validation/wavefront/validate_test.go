@@ -0,0 +1,63 @@
+package wavefront
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const (
+		traceID = "7b3bf470-9456-11e8-9eb6-529269fb1459"
+		spanID  = "0313bafe-9457-11e8-9eb6-529269fb1459"
+	)
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr string // "" for a valid line
+	}{
+		{"metric", "cpu.load 1.5 1533529977 source=host-1 env=prod", ""},
+		{"metric without timestamp", "cpu.load 1 source=a", ""},
+		{"delta metric", "∆requests.count 3 source=a", ""},
+		{"internal metric", "~proxy.points 3 source=a", ""},
+		{"quoted name with slash", `"disk./var" 1 source=a`, ""},
+		{"tab separator", "cpu.load 1 source=a\tenv=prod", ""},
+		{"histogram", "!M 1533529977 #20 30.0 #10 5.1 request.latency source=a region=us", ""},
+		{"span", "getUser source=a traceId=" + traceID + " spanId=" + spanID +
+			" application=shop service=users 1533529977000 343", ""},
+
+		{"control character", "cpu.load 1 source=a\x01", "control character"},
+		{"delete character", "cpu.load 1 source=a\x7f", "control character"},
+		{"control character after tab", "cpu.load 1 source=a\tb=c\x01d", "control character"},
+		{"newline", "cpu.load 1 source=a\nb 2 source=a", "control character"},
+		{"invalid UTF-8", "cpu.load 1 source=a env=\xff", "invalid UTF-8"},
+		{"no source", "cpu.load 1", "missing source"},
+		{"bad name character", "cpu:load 1 source=a", "invalid character"},
+		{"unquoted slash", "disk./var 1 source=a", "invalid character"},
+		{"bad tag key", "cpu.load 1 source=a e/nv=prod", "invalid character"},
+		{"long name", strings.Repeat("a", MaxMetricNameLength+1) + " 1 source=a", "metric name longer"},
+		{"long source", "cpu.load 1 source=" + strings.Repeat("a", MaxSourceLength+1), "source longer"},
+		{"long tag", "cpu.load 1 source=a k=" + strings.Repeat("v", MaxTagLength), "longer than"},
+		{"histogram bad name", "!M #1 2.0 cpu:load source=a", "invalid character"},
+		{"span bad trace ID", "getUser source=a traceId=abc spanId=" + spanID +
+			" application=shop service=users 1533529977000 343", "not a UUID"},
+		{"span bad parent", "getUser source=a traceId=" + traceID + " spanId=" + spanID +
+			" parent=abc application=shop service=users 1533529977000 343", "not a UUID"},
+		{"span without service", "getUser source=a traceId=" + traceID + " spanId=" + spanID +
+			" application=shop 1533529977000 343", "no service tag"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Validate(tt.line)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate(%q) = %v, want nil", tt.line, err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("Validate(%q) = nil, want error containing %q", tt.line, tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("Validate(%q) = %v, want error containing %q", tt.line, err, tt.wantErr)
+			}
+		})
+	}
+}